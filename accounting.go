@@ -0,0 +1,81 @@
+package ethwal
+
+import (
+	"strings"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/local"
+)
+
+// Accounting classes of ClassifyObjectPath.
+const (
+	AccountingClassData      = string(ObjectClassData)
+	AccountingClassFileIndex = "file-index"
+	AccountingClassIndex     = string(ObjectClassIndex)
+	AccountingClassMeta      = string(ObjectClassMeta)
+)
+
+// ClassifyObjectPath returns the accounting class of the dataset object at the path. The path may have any
+// prefix, e.g. the dataset path, the classes are recognized by the ethwal object names:
+//   - AccountingClassIndex are the objects in the indexes directory,
+//   - AccountingClassFileIndex is the file index,
+//   - AccountingClassMeta are the schema, the manifest, the tail, the presence shards, the patch manifest, the
+//     bloom filters and the block digests,
+//   - AccountingClassData are the ethwal files, the patches and the blobs.
+func ClassifyObjectPath(path string) string {
+	segments := strings.Split(path, "/")
+	for _, segment := range segments[:len(segments)-1] {
+		switch segment {
+		case IndexesDirectory:
+			return AccountingClassIndex
+		case PresenceDirectory, ChangelogDirectory:
+			return AccountingClassMeta
+		}
+	}
+
+	name := segments[len(segments)-1]
+	switch {
+	case name == FileIndexFileName:
+		return AccountingClassFileIndex
+	case name == DatasetSchemaFileName, name == DatasetDictionaryFileName, name == TailFileName, name == PatchManifestFileName,
+		strings.HasSuffix(name, BloomFileSuffix), strings.HasSuffix(name, BlockDigestFileSuffix):
+		return AccountingClassMeta
+	}
+	return AccountingClassData
+}
+
+// withAccounting installs the accounting wrapper on the file system if Options.EnableAccounting is set.
+func (o Options) withAccounting() Options {
+	if !o.EnableAccounting {
+		o.Accounting = nil
+		return o
+	}
+	if o.Accounting == nil {
+		o.Accounting = storage.NewAccounting(ClassifyObjectPath)
+	}
+	if !storage.IsAccounted(o.FileSystem, o.Accounting) {
+		o.FileSystem = storage.NewAccountingWrapper(o.FileSystem, o.Accounting)
+	}
+	return o
+}
+
+// withAccounting installs the accounting wrapper on the file system if IndexerOptions.EnableAccounting is set.
+func (o IndexerOptions[T]) withAccounting() IndexerOptions[T] {
+	if !o.EnableAccounting {
+		o.Accounting = nil
+		return o
+	}
+	if o.Accounting == nil {
+		o.Accounting = storage.NewAccounting(ClassifyObjectPath)
+	}
+	if !storage.IsAccounted(o.FileSystem, o.Accounting) {
+		o.FileSystem = storage.NewAccountingWrapper(o.FileSystem, o.Accounting)
+	}
+	return o
+}
+
+// isLocalFS reports whether fs is the local file system, possibly wrapped by the accounting wrapper.
+func isLocalFS(fs storage.FS) bool {
+	_, ok := storage.Unwrap(fs).(*local.LocalFS)
+	return ok
+}
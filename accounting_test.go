@@ -0,0 +1,148 @@
+package ethwal
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/local"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyObjectPath(t *testing.T) {
+	file := &File{FirstBlockNum: 1, LastBlockNum: 10}
+
+	for objectPath, class := range map[string]string{
+		"ethwal/v1/" + file.Path():                                    AccountingClassData,
+		file.Path():                                                   AccountingClassData,
+		"ethwal/v1/1_10.wal":                                          AccountingClassData,
+		"ethwal/v1/.blobs/ab/abcd":                                    AccountingClassData,
+		"ethwal/v1/" + FileIndexFileName:                              AccountingClassFileIndex,
+		FileIndexFileName:                                             AccountingClassFileIndex,
+		"ethwal/v1/.indexes/all/000/001/002/1.idx":                    AccountingClassIndex,
+		"ethwal/v1/.indexes/all/.lastBlockNumIndexed":                 AccountingClassIndex,
+		"ethwal/v1/" + DatasetSchemaFileName:                          AccountingClassMeta,
+		"ethwal/v1/" + TailFileName:                                   AccountingClassMeta,
+		"ethwal/v1/.presence/000001":                                  AccountingClassMeta,
+		"ethwal/v1/" + file.Path() + BloomFileSuffix:                  AccountingClassMeta,
+		"ethwal/v1/" + file.Path() + BlockDigestFileSuffix:            AccountingClassMeta,
+		"ethwal/v1/" + PatchesDirectory + "/" + PatchManifestFileName: AccountingClassMeta,
+	} {
+		require.Equal(t, class, ClassifyObjectPath(objectPath), objectPath)
+	}
+}
+
+// accountingObjects returns the number of objects and their total size per class under the path.
+func accountingObjects(t *testing.T, fs storage.FS, prefix string) (map[string]uint64, map[string]uint64) {
+	counts, sizes := make(map[string]uint64), make(map[string]uint64)
+	require.NoError(t, fs.Walk(context.Background(), prefix, func(objectPath string) error {
+		attrs, err := fs.Attributes(context.Background(), objectPath, nil)
+		if err != nil {
+			return err
+		}
+
+		class := ClassifyObjectPath(objectPath)
+		counts[class]++
+		sizes[class] += uint64(attrs.Size)
+		return nil
+	}))
+	return counts, sizes
+}
+
+func TestAccounting(t *testing.T) {
+	defer os.RemoveAll(testRoot)
+
+	fs := local.NewLocalFS("")
+	accounting := storage.NewAccounting(ClassifyObjectPath)
+	opt := Options{
+		Dataset:          Dataset{Path: testPath},
+		FileSystem:       fs,
+		FileRollPolicy:   NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose:  true,
+		EnableAccounting: true,
+		Accounting:       accounting,
+	}
+
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+		Dataset:          opt.Dataset,
+		FileSystem:       fs,
+		Indexes:          generateMixedIntIndexes(),
+		EnableAccounting: true,
+		Accounting:       accounting,
+	})
+	require.NoError(t, err)
+	require.Same(t, accounting, indexer.Accounting())
+
+	w, err := NewWriter[[]int](opt)
+	require.NoError(t, err)
+	w, err = NewWriterWithIndexer(w, indexer)
+	require.NoError(t, err)
+	require.Same(t, accounting, w.Accounting())
+
+	blocks := generateMixedIntBlocks()
+	for _, b := range blocks {
+		require.NoError(t, w.Write(context.Background(), b))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	written := accounting.SnapshotAndReset()
+	require.Empty(t, accounting.Snapshot())
+
+	counts, sizes := accountingObjects(t, fs, testPath+"/")
+	numFiles := len(blocks) / 10
+
+	// every file is written once, the file index is rewritten on every roll and the index files on every flush
+	require.Equal(t, uint64(numFiles), counts[AccountingClassData])
+	require.Equal(t, counts[AccountingClassData], written[AccountingClassData].Creates)
+	require.Equal(t, sizes[AccountingClassData], written[AccountingClassData].BytesWritten)
+	require.Equal(t, uint64(numFiles), written[AccountingClassFileIndex].Creates)
+	require.Greater(t, written[AccountingClassFileIndex].BytesWritten, sizes[AccountingClassFileIndex])
+	require.GreaterOrEqual(t, written[AccountingClassIndex].Creates, counts[AccountingClassIndex])
+	require.GreaterOrEqual(t, written[AccountingClassIndex].BytesWritten, sizes[AccountingClassIndex])
+	require.Zero(t, written[AccountingClassData].BytesRead)
+
+	t.Run("read", func(t *testing.T) {
+		// the prefetch racing with the foreground read may open the file twice
+		readOpt := opt
+		readOpt.Accounting = nil
+		readOpt.DisablePrefetch = true
+
+		r, err := NewReader[[]int](readOpt)
+		require.NoError(t, err)
+		defer r.Close()
+		require.NotSame(t, accounting, r.Accounting())
+
+		for {
+			_, err := r.Read(context.Background())
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+		}
+
+		// every file and the file index are read once
+		read := r.Accounting().Snapshot()
+		require.Equal(t, uint64(numFiles), read[AccountingClassData].Opens)
+		require.Equal(t, sizes[AccountingClassData], read[AccountingClassData].BytesRead)
+		require.Equal(t, uint64(1), read[AccountingClassFileIndex].Opens)
+		require.Equal(t, sizes[AccountingClassFileIndex], read[AccountingClassFileIndex].BytesRead)
+		require.Zero(t, read[AccountingClassIndex])
+		for _, stats := range read {
+			require.Zero(t, stats.Creates)
+			require.Zero(t, stats.BytesWritten)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		r, err := NewReader[[]int](Options{Dataset: opt.Dataset, FileSystem: fs, Accounting: accounting})
+		require.NoError(t, err)
+		defer r.Close()
+
+		require.Nil(t, r.Accounting())
+		_, err = r.Read(context.Background())
+		require.NoError(t, err)
+		require.Empty(t, accounting.Snapshot())
+	})
+}
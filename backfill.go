@@ -0,0 +1,651 @@
+package ethwal
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+)
+
+var (
+	ErrChainBroken = fmt.Errorf("block hash chain broken")
+	// ErrBackfillBlockEmpty is returned by the backfill fetch function for the blocks without data, they
+	// aren't written but marked as examined, see Options.TrackPresence.
+	ErrBackfillBlockEmpty = fmt.Errorf("backfill block has no data")
+)
+
+// ErrParentHashMismatch is the ErrChainBroken error of the block whose parent hash isn't the hash of the
+// previous block.
+type ErrParentHashMismatch struct {
+	BlockNumber uint64
+	// ExpectedParent is the hash of the previous block.
+	ExpectedParent common.Hash
+	// GotParent is the parent hash of the block.
+	GotParent common.Hash
+}
+
+func (e *ErrParentHashMismatch) Error() string {
+	return fmt.Sprintf("%s: block %d parent hash %s, block %d hash %s", ErrChainBroken, e.BlockNumber, e.GotParent, e.BlockNumber-1, e.ExpectedParent)
+}
+
+func (e *ErrParentHashMismatch) Unwrap() error {
+	return ErrChainBroken
+}
+
+// BlockRange is the range of block numbers [From, To].
+type BlockRange struct {
+	From uint64
+	To   uint64
+}
+
+// ChainedData is implemented by the block data that references the hash of its parent block, so that
+// the hash chain of the blocks can be verified.
+type ChainedData interface {
+	ParentHash() common.Hash
+}
+
+// BackfillFetchFunc fetches the block from the external source.
+type BackfillFetchFunc[T any] func(ctx context.Context, blockNum uint64) (Block[T], error)
+
+// BackfillOptions are the options of BackfillGaps.
+type BackfillOptions[T any] struct {
+	// VerifyChain verifies the consecutive stored blocks around the backfilled blocks. Defaults to the
+	// parent hash check of Block.ParentHash.
+	VerifyChain func(prev, next Block[T]) error
+	// OnProgress is called after each block is fetched.
+	OnProgress func(blockNum uint64)
+}
+
+// verifyParentHash checks that the parent hash of the next block, see Block.ParentHash, is the hash of the
+// previous block. The blocks that aren't consecutive or have no hashes, like the filler blocks, aren't verified. The mismatch
+// fails with ErrParentHashMismatch.
+func verifyParentHash[T any](prev, next Block[T]) error {
+	if next.Number != prev.Number+1 {
+		return nil
+	}
+
+	parentHash := next.ParentHash()
+	if parentHash == (common.Hash{}) || prev.Hash == (common.Hash{}) {
+		return nil
+	}
+	if parentHash != prev.Hash {
+		return &ErrParentHashMismatch{BlockNumber: next.Number, ExpectedParent: prev.Hash, GotParent: parentHash}
+	}
+	return nil
+}
+
+// skippedData is the block data that isn't decoded.
+type skippedData struct{}
+
+func (skippedData) UnmarshalJSON([]byte) error { return nil }
+
+func (skippedData) UnmarshalCBOR([]byte) error { return nil }
+
+// FindGaps returns the ranges of the block numbers in [from, to] that are not stored in the dataset. The
+// files of the range are decoded, so that the blocks missing within the files are found as well. The
+// blocks examined by the writer with Options.TrackPresence and the blocks after the last rolled file
+// are not gaps.
+func FindGaps(ctx context.Context, opt Options, from, to uint64) ([]BlockRange, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid block range %d-%d", from, to)
+	}
+
+	opt = opt.WithDefaults()
+	// only block numbers are decoded
+	opt.SchemaVersion = 0
+
+	fs := storage.NewPrefixWrapper(newReplicaFS(opt), opt.Dataset.FullPath())
+	fileIndex := NewFileIndex(fs)
+	err := fileIndex.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file index: %w", err)
+	}
+
+	files := fileIndex.Files()
+	if len(files) == 0 {
+		return nil, nil
+	}
+	to = min(to, files[len(files)-1].LastBlockNum)
+	if from > to {
+		return nil, nil
+	}
+
+	missing := roaring64.New()
+	missing.AddRange(from, to+1)
+
+	// the ranges not covered by any file stay missing as a whole
+	_, index, err := fileIndex.FindFile(from)
+	if err != nil {
+		return nil, err
+	}
+	for ; index < len(files) && files[index].FirstBlockNum <= to; index++ {
+		err = decodeFile(ctx, opt, fs, files[index], func(b Block[skippedData]) error {
+			missing.Remove(b.Number)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("file[%d-%d]: %w", files[index].FirstBlockNum, files[index].LastBlockNum, err)
+		}
+	}
+
+	examined, err := newPresenceStore(fs).marked(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	missing.AndNot(examined)
+
+	var gaps []BlockRange
+	it := missing.Iterator()
+	for it.HasNext() {
+		blockNum := it.Next()
+		if len(gaps) > 0 && gaps[len(gaps)-1].To+1 == blockNum {
+			gaps[len(gaps)-1].To = blockNum
+			continue
+		}
+		gaps = append(gaps, BlockRange{From: blockNum, To: blockNum})
+	}
+	return gaps, nil
+}
+
+// BackfillGaps fetches the blocks of the gaps from the external source and writes them to the dataset.
+// The blocks missing within the existing files are merged into the files, which are rewritten in place,
+// the ranges not covered by any file are stored in new files inserted into the file index. The hash chain
+// of the stored blocks around the gaps is verified before anything is written.
+//
+// The new files are inserted into the file index, so it must not run concurrently with the writer of the
+// dataset unless all gaps are within the existing files. The indexes are not updated.
+func BackfillGaps[T any](ctx context.Context, opt Options, gaps []BlockRange, fetch BackfillFetchFunc[T], backfillOpt BackfillOptions[T]) error {
+	opt = opt.WithDefaults()
+	verifyChain := backfillOpt.VerifyChain
+	if verifyChain == nil {
+		verifyChain = verifyParentHash[T]
+	}
+
+	gaps = slices.Clone(gaps)
+	slices.SortFunc(gaps, func(a, b BlockRange) int {
+		return cmp.Compare(a.From, b.From)
+	})
+	for i, gap := range gaps {
+		if gap.From > gap.To {
+			return fmt.Errorf("backfill: invalid block range %d-%d", gap.From, gap.To)
+		}
+		if err := validateBlockNum(gap.To); err != nil {
+			return fmt.Errorf("backfill: %w", err)
+		}
+		if i > 0 && gaps[i-1].To >= gap.From {
+			return fmt.Errorf("backfill: overlapping block ranges %d-%d and %d-%d", gaps[i-1].From, gaps[i-1].To, gap.From, gap.To)
+		}
+	}
+
+	b, err := newBackfill[T](ctx, opt)
+	if err != nil {
+		return fmt.Errorf("backfill: %w", err)
+	}
+
+	// fetch the missing blocks
+	examined := roaring64.New()
+	fetched := make(map[uint64]Block[T])
+	for _, gap := range gaps {
+		for blockNum := gap.From; blockNum <= gap.To; blockNum++ {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			block, err := fetch(ctx, blockNum)
+			if err != nil && !errors.Is(err, ErrBackfillBlockEmpty) {
+				return fmt.Errorf("backfill: failed to fetch block %d: %w", blockNum, err)
+			}
+			if err == nil {
+				if block.Number != blockNum {
+					return fmt.Errorf("backfill: fetched block %d instead of %d", block.Number, blockNum)
+				}
+				if err := validateBlockMeta(opt, block.Meta); err != nil {
+					return fmt.Errorf("backfill: block %d: %w", blockNum, err)
+				}
+				fetched[blockNum] = block
+			}
+			examined.Add(blockNum)
+
+			if backfillOpt.OnProgress != nil {
+				backfillOpt.OnProgress(blockNum)
+			}
+		}
+	}
+
+	// merge the fetched blocks into the files
+	for _, gap := range gaps {
+		err = b.merge(ctx, gap, fetched)
+		if err != nil {
+			return fmt.Errorf("backfill: %w", err)
+		}
+	}
+
+	// verify the chain before anything is written
+	for _, gap := range gaps {
+		blocks, err := b.blocksAround(ctx, gap)
+		if err != nil {
+			return fmt.Errorf("backfill: %w", err)
+		}
+		for i := 1; i < len(blocks); i++ {
+			err = verifyChain(blocks[i-1], blocks[i])
+			if err != nil {
+				return fmt.Errorf("backfill: %w", err)
+			}
+		}
+	}
+
+	err = b.write(ctx)
+	if err != nil {
+		return fmt.Errorf("backfill: %w", err)
+	}
+
+	if opt.TrackPresence {
+		err = newPresenceStore(b.metaFs).mark(ctx, examined)
+		if err != nil {
+			return fmt.Errorf("backfill: failed to store examined blocks: %w", err)
+		}
+	}
+	return nil
+}
+
+// backfill keeps the decoded blocks of the files affected by the backfill.
+type backfill[T any] struct {
+	opt Options
+
+	fs     storage.FS
+	metaFs storage.FS
+
+	fileIndex *FileIndex
+	// blocks are the decoded blocks of the files by their first block number
+	blocks map[uint64][]Block[T]
+	// changed are the files to write by their first block number
+	changed map[uint64]*File
+	// modified are the stored blocks changed in place, their recorded digests are recomputed
+	modified map[uint64]struct{}
+
+	blobs       BlobStore
+	bloomKeys   BloomKeysFunc[T]
+	blockDigest BlockDigestFunc[T]
+
+	changelog *changelog
+}
+
+func newBackfill[T any](ctx context.Context, opt Options) (*backfill[T], error) {
+	bloomKeys, err := bloomKeysFunc[T](opt)
+	if err != nil {
+		return nil, err
+	}
+
+	blockDigest, err := blockDigestFunc[T](opt)
+	if err != nil {
+		return nil, err
+	}
+
+	datasetPath := opt.Dataset.FullPath()
+	fs := opt.withObjectClass(storage.NewPrefixWrapper(opt.FileSystem, datasetPath), ObjectClassData)
+	metaFs := opt.withObjectClass(storage.NewPrefixWrapper(opt.FileSystem, datasetPath), ObjectClassMeta)
+
+	fileIndex := NewFileIndex(metaFs)
+	err = fileIndex.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file index: %w", err)
+	}
+
+	var changes *changelog
+	if opt.EnableChangefeed {
+		changes = newChangelog(metaFs)
+	}
+
+	return &backfill[T]{
+		opt:         opt,
+		fs:          fs,
+		metaFs:      metaFs,
+		fileIndex:   fileIndex,
+		blocks:      make(map[uint64][]Block[T]),
+		changed:     make(map[uint64]*File),
+		modified:    make(map[uint64]struct{}),
+		blobs:       cmp.Or(opt.BlobStore, NewFSBlobStore(fs)),
+		bloomKeys:   bloomKeys,
+		blockDigest: blockDigest,
+		changelog:   changes,
+	}, nil
+}
+
+// load returns the decoded blocks of the file.
+func (b *backfill[T]) load(ctx context.Context, file *File) ([]Block[T], error) {
+	if blocks, ok := b.blocks[file.FirstBlockNum]; ok {
+		return blocks, nil
+	}
+
+	var blocks []Block[T]
+	err := decodeFile(ctx, b.opt, b.fs, file, func(block Block[T]) error {
+		blocks = append(blocks, block)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err)
+	}
+
+	b.blocks[file.FirstBlockNum] = blocks
+	return blocks, nil
+}
+
+// merge adds the fetched blocks of the gap to the files covering them, the ranges not covered by any file
+// are added as new files.
+func (b *backfill[T]) merge(ctx context.Context, gap BlockRange, fetched map[uint64]Block[T]) error {
+	for _, uncovered := range b.fileIndex.gaps(gap.From-1, gap.To+1) {
+		file := &File{FirstBlockNum: uncovered[0] + 1, LastBlockNum: uncovered[1] - 1, SchemaVersion: b.opt.SchemaVersion}
+		err := b.fileIndex.AddFile(file)
+		if err != nil {
+			return err
+		}
+		b.blocks[file.FirstBlockNum] = nil
+		b.changed[file.FirstBlockNum] = file
+	}
+
+	for blockNum := gap.From; blockNum <= gap.To; blockNum++ {
+		block, ok := fetched[blockNum]
+		if !ok {
+			continue
+		}
+
+		file, _, err := b.fileIndex.FindFile(blockNum)
+		if err != nil {
+			return err
+		}
+
+		blocks, err := b.load(ctx, file)
+		if err != nil {
+			return err
+		}
+
+		i := sort.Search(len(blocks), func(i int) bool {
+			return blocks[i].Number >= blockNum
+		})
+		if i < len(blocks) && blocks[i].Number == blockNum {
+			return fmt.Errorf("block %d already exists", blockNum)
+		}
+
+		b.blocks[file.FirstBlockNum] = slices.Insert(blocks, i, block)
+		b.changed[file.FirstBlockNum] = file
+	}
+	return nil
+}
+
+// blocksAround returns the blocks of the gap with the stored blocks before and after it.
+func (b *backfill[T]) blocksAround(ctx context.Context, gap BlockRange) ([]Block[T], error) {
+	files := b.fileIndex.Files()
+
+	// the first file that might store the block before the gap
+	start := sort.Search(len(files), func(i int) bool {
+		return files[i].LastBlockNum >= gap.From
+	})
+
+	var result []Block[T]
+	for i := min(start, len(files)-1); i >= 0; i-- {
+		blocks, err := b.load(ctx, files[i])
+		if err != nil {
+			return nil, err
+		}
+
+		j := sort.Search(len(blocks), func(j int) bool {
+			return blocks[j].Number >= gap.From
+		})
+		if j > 0 {
+			result = append(result, blocks[j-1])
+			break
+		}
+	}
+
+	for i := start; i < len(files); i++ {
+		blocks, err := b.load(ctx, files[i])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, block := range blocks {
+			if block.Number < gap.From {
+				continue
+			}
+
+			// the first block after the gap ends the sequence
+			result = append(result, block)
+			if block.Number > gap.To {
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
+
+// write stores the changed files and the file index if new files were added, the changes are appended to
+// the changelog once all are stored.
+func (b *backfill[T]) write(ctx context.Context) error {
+	var (
+		indexChanged bool
+		events       []ChangeEvent
+	)
+	for _, file := range b.fileIndex.Files() {
+		if _, ok := b.changed[file.FirstBlockNum]; !ok {
+			continue
+		}
+
+		isNew := !file.Exist(ctx, b.fs)
+		hadDigests := file.DigestRoot != nil
+		if file.SchemaVersion != b.opt.SchemaVersion {
+			return fmt.Errorf("file[%d-%d]: schema version %d doesn't match %d", file.FirstBlockNum, file.LastBlockNum, file.SchemaVersion, b.opt.SchemaVersion)
+		}
+
+		err := b.writeFile(ctx, file)
+		if err != nil {
+			return fmt.Errorf("file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err)
+		}
+
+		// the bloom filter of the file that was stored at the legacy path isn't found by ProbeFiles
+		hasBloom := b.bloomKeys != nil
+		indexChanged = indexChanged || isNew || file.Bloom != hasBloom || hadDigests || file.DigestRoot != nil
+		file.Bloom = hasBloom
+
+		event := ChangeEvent{Type: ChangeFileReplaced, File: file}
+		if isNew {
+			event.Type = ChangeFileAdded
+		}
+		events = append(events, event)
+	}
+
+	if indexChanged {
+		err := b.fileIndex.Save(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if b.changelog == nil {
+		return nil
+	}
+	for i := range events {
+		events[i].File = events[i].File.clone()
+	}
+	return b.changelog.publish(ctx, events...)
+}
+
+// writeFile encodes the blocks of the file and writes it with its bloom filter and block digests. The
+// digests recorded for the existing blocks are kept, unless the blocks were modified.
+func (b *backfill[T]) writeFile(ctx context.Context, file *File) error {
+	var (
+		buf         bytes.Buffer
+		bloomHashes = make(map[[2]uint64]struct{})
+		digests     *blockDigests
+		recorded    = make(map[uint64][32]byte)
+	)
+
+	if b.blockDigest != nil {
+		digests = &blockDigests{}
+		if file.DigestRoot != nil {
+			prev, err := readBlockDigests(ctx, b.fs, file)
+			if err != nil {
+				return err
+			}
+			for i, blockNum := range prev.BlockNums {
+				recorded[blockNum] = prev.Digests[i]
+			}
+		}
+	}
+
+	bufferWriter := io.Writer(&buf)
+	var compressor Compressor
+	if b.opt.NewCompressor != nil {
+		compressor = b.opt.NewCompressor(bufferWriter)
+		bufferWriter = compressor
+	}
+	encoder := b.opt.NewEncoder(bufferWriter)
+
+	for _, block := range b.blocks[file.FirstBlockNum] {
+		var err error
+
+		// the bloom keys and the digests are collected from the data, the stored blocks may have it offloaded
+		dataBlock := block
+		if dataBlock.Blob != nil && (b.bloomKeys != nil || b.blockDigest != nil) {
+			dataBlock, err = resolveBlob(ctx, b.opt, b.blobs, dataBlock)
+			if err != nil {
+				return err
+			}
+		}
+
+		if b.bloomKeys != nil {
+			for _, key := range b.bloomKeys(dataBlock) {
+				h1, h2 := bloomHash(key)
+				bloomHashes[[2]uint64{h1, h2}] = struct{}{}
+			}
+		}
+
+		if digests != nil {
+			digest, ok := recorded[block.Number]
+			if _, modified := b.modified[block.Number]; !ok || modified {
+				digest = b.blockDigest(dataBlock)
+			}
+			digests.add(block.Number, digest)
+		}
+
+		if b.opt.BlobThreshold > 0 {
+			block, err = offloadBlob(ctx, b.opt, b.blobs, block)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = encoder.Encode(block)
+		if err != nil {
+			return fmt.Errorf("failed to encode file data: %w", err)
+		}
+	}
+
+	if compressor != nil {
+		err := compressor.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the file is replaced in one go
+	w, err := file.Create(ctx, b.fs)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	file.recordChecksum(buf.Bytes())
+
+	// the file stored at the legacy path is now stored at the canonical path
+	err = b.fs.Delete(ctx, file.legacyPath())
+	if err != nil && !storage.IsNotExist(err) {
+		return err
+	}
+
+	if digests != nil {
+		err = writeBlockDigests(ctx, b.fs, file, digests)
+		if err != nil {
+			return err
+		}
+		root := digests.root()
+		file.DigestRoot = &root
+	} else if file.DigestRoot != nil {
+		err = b.fs.Delete(ctx, file.DigestsPath())
+		if err != nil && !storage.IsNotExist(err) {
+			return err
+		}
+		file.DigestRoot = nil
+	}
+
+	if b.bloomKeys == nil {
+		if file.Bloom {
+			err = b.fs.Delete(ctx, file.BloomPath())
+			if err != nil && !storage.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	bloom := newBloomFilter(uint64(len(bloomHashes)), b.opt.BloomFalsePositiveRate)
+	for h := range bloomHashes {
+		bloom.addHash(h[0], h[1])
+	}
+	return writeBloomFilter(ctx, b.fs, file, bloom)
+}
+
+// decodeFile decodes the blocks of the file written under Options.SchemaVersion.
+func decodeFile[T any](ctx context.Context, opt Options, fs storage.FS, file *File, fn func(Block[T]) error) error {
+	decodeBlock, err := newSchemaDecoder[T](opt, nil, file.SchemaVersion)
+	if err != nil {
+		return err
+	}
+
+	rdr, err := file.Open(ctx, fs)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	decmprRdr := io.NopCloser(rdr)
+	if opt.NewDecompressor != nil {
+		decmprRdr = opt.NewDecompressor(rdr)
+		defer decmprRdr.Close()
+	}
+
+	decoder := newBlockDecoder(opt, decmprRdr, nil)
+	for {
+		var block Block[T]
+		err = decodeBlock(decoder, &block)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode file data: %w", err)
+		}
+
+		if block.Number < file.FirstBlockNum || block.Number > file.LastBlockNum {
+			return fmt.Errorf("block number %d is out of file block %d-%d range", block.Number, file.FirstBlockNum, file.LastBlockNum)
+		}
+
+		err = fn(block)
+		if err != nil {
+			return err
+		}
+	}
+}
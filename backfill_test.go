@@ -0,0 +1,157 @@
+package ethwal
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+type chainedTestData struct {
+	Parent common.Hash
+	Value  uint64
+}
+
+func (d chainedTestData) ParentHash() common.Hash {
+	return d.Parent
+}
+
+func chainedTestBlock(blockNum uint64) Block[chainedTestData] {
+	hash := func(n uint64) common.Hash {
+		return common.BytesToHash(binary.BigEndian.AppendUint64([]byte{0xbb}, n))
+	}
+	return Block[chainedTestData]{
+		Hash:   hash(blockNum),
+		Number: blockNum,
+		Data:   chainedTestData{Parent: hash(blockNum - 1), Value: blockNum * 2},
+	}
+}
+
+// writeGappedDataset writes the blocks 1-60 except the blocks 14-16 missing within the file 11-20 and the
+// blocks 31-40 not covered by any file.
+func writeGappedDataset(t *testing.T) Options {
+	opt := Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      gostorage.NewMemoryFS(),
+		NewCompressor:   NewZSTDCompressor,
+		NewDecompressor: NewZSTDDecompressor,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+
+	w, err := NewWriter[chainedTestData](opt)
+	require.NoError(t, err)
+	for i := uint64(1); i <= 60; i++ {
+		if (i >= 14 && i <= 16) || (i >= 31 && i <= 40) {
+			continue
+		}
+		require.NoError(t, w.Write(context.Background(), chainedTestBlock(i)))
+	}
+	require.NoError(t, w.Close(context.Background()))
+	return opt
+}
+
+func TestBackfillGaps(t *testing.T) {
+	opt := writeGappedDataset(t)
+
+	gaps, err := FindGaps(context.Background(), opt, 1, 100)
+	require.NoError(t, err)
+	require.Equal(t, []BlockRange{{From: 14, To: 16}, {From: 31, To: 40}}, gaps)
+
+	var fetched []uint64
+	err = BackfillGaps(context.Background(), opt, gaps, func(ctx context.Context, blockNum uint64) (Block[chainedTestData], error) {
+		return chainedTestBlock(blockNum), nil
+	}, BackfillOptions[chainedTestData]{
+		OnProgress: func(blockNum uint64) {
+			fetched = append(fetched, blockNum)
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{14, 15, 16, 31, 32, 33, 34, 35, 36, 37, 38, 39, 40}, fetched)
+
+	gaps, err = FindGaps(context.Background(), opt, 1, 100)
+	require.NoError(t, err)
+	require.Empty(t, gaps)
+
+	opt.OnGap = func(fromExclusive, toExclusive uint64) {
+		t.Errorf("unexpected gap %d-%d", fromExclusive, toExclusive)
+	}
+	r, err := NewReader[chainedTestData](opt)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var prev Block[chainedTestData]
+	for i := uint64(1); i <= 60; i++ {
+		b, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, chainedTestBlock(i), b)
+		if i > 1 {
+			require.NoError(t, verifyParentHash(prev, b))
+		}
+		prev = b
+	}
+	_, err = r.Read(context.Background())
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestBackfillGaps_ChainBroken(t *testing.T) {
+	opt := writeGappedDataset(t)
+
+	err := BackfillGaps(context.Background(), opt, []BlockRange{{From: 14, To: 16}}, func(ctx context.Context, blockNum uint64) (Block[chainedTestData], error) {
+		b := chainedTestBlock(blockNum)
+		if blockNum == 16 {
+			b.Hash = common.Hash{0x01}
+		}
+		return b, nil
+	}, BackfillOptions[chainedTestData]{})
+	require.ErrorIs(t, err, ErrChainBroken)
+
+	// nothing is written
+	gaps, err := FindGaps(context.Background(), opt, 1, 60)
+	require.NoError(t, err)
+	require.Equal(t, []BlockRange{{From: 14, To: 16}, {From: 31, To: 40}}, gaps)
+}
+
+func TestBackfillGaps_Errors(t *testing.T) {
+	opt := writeGappedDataset(t)
+	fetch := func(ctx context.Context, blockNum uint64) (Block[chainedTestData], error) {
+		return chainedTestBlock(blockNum), nil
+	}
+
+	t.Run("overlapping", func(t *testing.T) {
+		err := BackfillGaps(context.Background(), opt, []BlockRange{{From: 14, To: 16}, {From: 16, To: 18}}, fetch, BackfillOptions[chainedTestData]{})
+		require.Error(t, err)
+	})
+
+	t.Run("existing_block", func(t *testing.T) {
+		err := BackfillGaps(context.Background(), opt, []BlockRange{{From: 13, To: 14}}, fetch, BackfillOptions[chainedTestData]{})
+		require.ErrorContains(t, err, "block 13 already exists")
+	})
+
+	t.Run("fetch", func(t *testing.T) {
+		err := BackfillGaps(context.Background(), opt, []BlockRange{{From: 31, To: 40}}, func(ctx context.Context, blockNum uint64) (Block[chainedTestData], error) {
+			return Block[chainedTestData]{}, fmt.Errorf("unavailable")
+		}, BackfillOptions[chainedTestData]{})
+		require.ErrorContains(t, err, "unavailable")
+	})
+}
+
+func TestBackfillGaps_TrackPresence(t *testing.T) {
+	opt := writeGappedDataset(t)
+	opt.TrackPresence = true
+
+	// the blocks 31-40 have no data
+	err := BackfillGaps(context.Background(), opt, []BlockRange{{From: 31, To: 40}}, func(ctx context.Context, blockNum uint64) (Block[chainedTestData], error) {
+		return Block[chainedTestData]{}, ErrBackfillBlockEmpty
+	}, BackfillOptions[chainedTestData]{})
+	require.NoError(t, err)
+
+	gaps, err := FindGaps(context.Background(), opt, 1, 60)
+	require.NoError(t, err)
+	require.Equal(t, []BlockRange{{From: 14, To: 16}}, gaps)
+}
@@ -0,0 +1,281 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/0xsequence/ethwal/storage"
+)
+
+const BlobsDirectory = ".blobs"
+
+// Blob codecs describe how the encoded block data is stored in the blob store.
+const (
+	BlobCodecRaw  = "raw"
+	BlobCodecZSTD = "zstd"
+)
+
+var (
+	ErrBlobNotExist = fmt.Errorf("blob does not exist")
+)
+
+// BlobRef is the reference to the block data offloaded to the blob store. The hash is the sha-256 of
+// the encoded data, the size is the size of the encoded data before compression.
+type BlobRef struct {
+	Hash  common.Hash `json:"hash" cbor:"0,keyasint"`
+	Size  uint64      `json:"size" cbor:"1,keyasint"`
+	Codec string      `json:"codec" cbor:"2,keyasint"`
+}
+
+// BlobStore stores the offloaded block data by content hash.
+type BlobStore interface {
+	Put(ctx context.Context, hash common.Hash, data []byte) error
+	Get(ctx context.Context, hash common.Hash) ([]byte, error)
+	Delete(ctx context.Context, hash common.Hash) error
+	// Walk calls fn for each blob in the store.
+	Walk(ctx context.Context, fn func(hash common.Hash) error) error
+}
+
+// fsBlobStore is the default BlobStore, it keeps blobs on the dataset file system.
+//
+// The directory structure:
+//
+//	-- ethwal
+//		|-- .blobs
+//		|   |-- 28
+//		|   |   |-- 28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef
+//		|   |-- f5
+//		|   |   |-- f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef28
+type fsBlobStore struct {
+	fs storage.FS
+}
+
+// NewFSBlobStore creates the blob store on the file system mounted to the dataset path.
+func NewFSBlobStore(fs storage.FS) BlobStore {
+	return &fsBlobStore{fs: storage.NewPrefixWrapper(fs, BlobsDirectory+"/")}
+}
+
+func (s *fsBlobStore) Put(ctx context.Context, hash common.Hash, data []byte) error {
+	// blobs are content addressed, existing blob has the same content
+	if _, err := s.fs.Attributes(ctx, blobPath(hash), nil); err == nil {
+		return nil
+	}
+
+	file, err := s.fs.Create(ctx, blobPath(hash), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create blob: %w", err)
+	}
+
+	_, err = file.Write(data)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	return file.Close()
+}
+
+func (s *fsBlobStore) Get(ctx context.Context, hash common.Hash) ([]byte, error) {
+	file, err := s.fs.Open(ctx, blobPath(hash), nil)
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrBlobNotExist, hash)
+		}
+		return nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob: %w", err)
+	}
+	return data, nil
+}
+
+func (s *fsBlobStore) Delete(ctx context.Context, hash common.Hash) error {
+	err := s.fs.Delete(ctx, blobPath(hash))
+	if err != nil && !storage.IsNotExist(err) {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return nil
+}
+
+func (s *fsBlobStore) Walk(ctx context.Context, fn func(hash common.Hash) error) error {
+	err := s.fs.Walk(ctx, "", func(filePath string) error {
+		data, err := hex.DecodeString(path.Base(filePath))
+		if err != nil || len(data) != common.HashLength {
+			// not a blob
+			return nil
+		}
+		return fn(common.BytesToHash(data))
+	})
+	if errors.Is(err, os.ErrNotExist) || storage.IsNotExist(err) {
+		// no blobs stored yet
+		return nil
+	}
+	return err
+}
+
+func blobPath(hash common.Hash) string {
+	name := hex.EncodeToString(hash[:])
+	return fmt.Sprintf("%s/%s", name[:2], name)
+}
+
+// offloadBlob stores the block data in the blob store if its encoded size exceeds Options.BlobThreshold
+// and replaces the data with the reference.
+func offloadBlob[T any](ctx context.Context, opt Options, store BlobStore, b Block[T]) (Block[T], error) {
+	if opt.BlobThreshold == 0 || b.Blob != nil {
+		return b, nil
+	}
+
+	var data bytes.Buffer
+	err := opt.NewEncoder(&data).Encode(b.Data)
+	if err != nil {
+		return Block[T]{}, fmt.Errorf("failed to encode block data: %w", err)
+	}
+
+	if uint64(data.Len()) <= opt.BlobThreshold.Bytes() {
+		return b, nil
+	}
+
+	ref := &BlobRef{
+		Hash:  sha256.Sum256(data.Bytes()),
+		Size:  uint64(data.Len()),
+		Codec: BlobCodecZSTD,
+	}
+
+	var compressed bytes.Buffer
+	comp := NewZSTDCompressor(&compressed)
+	_, err = comp.Write(data.Bytes())
+	if err != nil {
+		_ = comp.Close()
+		return Block[T]{}, fmt.Errorf("failed to compress blob: %w", err)
+	}
+	err = comp.Close()
+	if err != nil {
+		return Block[T]{}, fmt.Errorf("failed to compress blob: %w", err)
+	}
+
+	err = store.Put(ctx, ref.Hash, compressed.Bytes())
+	if err != nil {
+		return Block[T]{}, err
+	}
+
+	var zero T
+	b.Data = zero
+	b.Blob = ref
+	return b, nil
+}
+
+// resolveBlob fetches the offloaded block data and decodes it into the block.
+func resolveBlob[T any](ctx context.Context, opt Options, store BlobStore, b Block[T]) (Block[T], error) {
+	if b.Blob == nil {
+		return b, nil
+	}
+
+	data, err := store.Get(ctx, b.Blob.Hash)
+	if err != nil {
+		return Block[T]{}, err
+	}
+
+	switch b.Blob.Codec {
+	case BlobCodecRaw:
+	case BlobCodecZSTD:
+		decomp := NewZSTDDecompressor(bytes.NewReader(data))
+		data, err = io.ReadAll(decomp)
+		_ = decomp.Close()
+		if err != nil {
+			return Block[T]{}, fmt.Errorf("failed to decompress blob: %w", err)
+		}
+	default:
+		return Block[T]{}, fmt.Errorf("unknown blob codec: %s", b.Blob.Codec)
+	}
+
+	if sha256.Sum256(data) != b.Blob.Hash {
+		return Block[T]{}, fmt.Errorf("blob %s is corrupted", b.Blob.Hash)
+	}
+
+	err = opt.NewDecoder(bytes.NewReader(data)).Decode(&b.Data)
+	if err != nil {
+		return Block[T]{}, fmt.Errorf("failed to decode blob: %w", err)
+	}
+
+	b.Blob = nil
+	return b, nil
+}
+
+// CollectBlobs deletes the blobs that are not referenced by any block of the dataset and returns the number
+// of deleted blobs. It must not run concurrently with the writer, as the writer stores blobs before
+// the blocks referencing them.
+func CollectBlobs(ctx context.Context, opt Options) (int, error) {
+	// patched blocks don't hide the base blocks
+	applyPatches := false
+	opt.ApplyPatches = &applyPatches
+	opt.ResolveBlobs = false
+	opt.FollowTail = false
+	opt = opt.WithDefaults()
+
+	r, err := NewReader[any](opt)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	referenced := make(map[common.Hash]struct{})
+	for {
+		b, err := r.Read(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if b.Blob != nil {
+			referenced[b.Blob.Hash] = struct{}{}
+		}
+	}
+
+	fs := storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath())
+
+	// blocks that are not rolled yet
+	tailBlocks, err := readTail[any](ctx, fs, opt)
+	if err != nil {
+		return 0, err
+	}
+	for _, b := range tailBlocks {
+		if b.Blob != nil {
+			referenced[b.Blob.Hash] = struct{}{}
+		}
+	}
+
+	store := opt.BlobStore
+	if store == nil {
+		store = NewFSBlobStore(fs)
+	}
+
+	var unreferenced []common.Hash
+	err = store.Walk(ctx, func(hash common.Hash) error {
+		if _, ok := referenced[hash]; !ok {
+			unreferenced = append(unreferenced, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list blobs: %w", err)
+	}
+
+	for i, hash := range unreferenced {
+		err = store.Delete(ctx, hash)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(unreferenced), nil
+}
@@ -0,0 +1,144 @@
+package ethwal
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/c2h5oh/datasize"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter_BlobOffload(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	opt := Options{
+		Dataset:         Dataset{Path: testPath},
+		NewCompressor:   NewZSTDCompressor,
+		NewDecompressor: NewZSTDDecompressor,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(5),
+		FileRollOnClose: true,
+		BlobThreshold:   256 * datasize.B,
+	}
+
+	// every third block has the data above the threshold
+	var blocks []Block[[]int]
+	for i := 1; i <= 12; i++ {
+		data := []int{i}
+		if i%3 == 0 {
+			data = make([]int, 1000)
+			for j := range data {
+				data[j] = i * j
+			}
+		}
+		blocks = append(blocks, Block[[]int]{Number: uint64(i), Data: data})
+	}
+
+	w, err := NewWriter[[]int](opt)
+	require.NoError(t, err)
+	for _, b := range blocks {
+		require.NoError(t, w.Write(context.Background(), b))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	readAll := func(t *testing.T, opt Options) []Block[[]int] {
+		r, err := NewReader[[]int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		var blocks []Block[[]int]
+		for {
+			b, err := r.Read(context.Background())
+			if errors.Is(err, io.EOF) {
+				return blocks
+			}
+			require.NoError(t, err)
+			blocks = append(blocks, b)
+		}
+	}
+
+	t.Run("resolve", func(t *testing.T) {
+		ropt := opt
+		ropt.ResolveBlobs = true
+		require.Equal(t, blocks, readAll(t, ropt))
+	})
+
+	t.Run("reference", func(t *testing.T) {
+		for i, b := range readAll(t, opt) {
+			if blocks[i].Number%3 != 0 {
+				require.Equal(t, blocks[i], b)
+				continue
+			}
+
+			require.Nil(t, b.Data)
+			require.NotNil(t, b.Blob)
+			require.Equal(t, BlobCodecZSTD, b.Blob.Codec)
+
+			data, err := os.ReadFile(path.Join(opt.Dataset.FullPath(), BlobsDirectory, blobPath(b.Blob.Hash)))
+			require.NoError(t, err)
+			require.Less(t, uint64(len(data)), b.Blob.Size)
+		}
+	})
+}
+
+func TestCollectBlobs(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	opt := Options{
+		Dataset:         Dataset{Path: testPath},
+		FileRollOnClose: true,
+		BlobThreshold:   16 * datasize.B,
+	}
+
+	w, err := NewWriter[string](opt)
+	require.NoError(t, err)
+	require.NoError(t, w.Write(context.Background(), Block[string]{Number: 1, Data: "small"}))
+	require.NoError(t, w.Write(context.Background(), Block[string]{Number: 2, Data: "large enough to be offloaded"}))
+	require.NoError(t, w.Close(context.Background()))
+
+	// blob that is not referenced by any block
+	store := NewFSBlobStore(storage.NewPrefixWrapper(opt.WithDefaults().FileSystem, opt.Dataset.FullPath()))
+	orphan := sha256.Sum256([]byte("orphan"))
+	require.NoError(t, store.Put(context.Background(), orphan, []byte("orphan")))
+
+	countBlobs := func() int {
+		var count int
+		require.NoError(t, store.Walk(context.Background(), func(hash common.Hash) error {
+			count++
+			return nil
+		}))
+		return count
+	}
+	require.Equal(t, 2, countBlobs())
+
+	deleted, err := CollectBlobs(context.Background(), opt)
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+	require.Equal(t, 1, countBlobs())
+
+	_, err = store.Get(context.Background(), orphan)
+	require.ErrorIs(t, err, ErrBlobNotExist)
+
+	// referenced blob is kept
+	ropt := opt
+	ropt.ResolveBlobs = true
+	r, err := NewReader[string](ropt)
+	require.NoError(t, err)
+	defer r.Close()
+
+	_, err = r.Read(context.Background())
+	require.NoError(t, err)
+	b, err := r.Read(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "large enough to be offloaded", b.Data)
+}
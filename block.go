@@ -1,14 +1,150 @@
 package ethwal
 
 import (
+	"cmp"
+	"fmt"
+	"math"
+
 	"github.com/0xsequence/ethkit/go-ethereum/common"
 )
 
+// MaxSupportedBlockNum is the highest block number that can be stored. It's limited by the 48-bit block
+// number field of IndexCompoundID.
+const MaxSupportedBlockNum uint64 = 1<<48 - 1
+
+// NoBlockNum is the block number before block 0, the last block number of the reader that hasn't read any
+// block or of the no-gap writer filling the gaps from block 0. The block number after it is block 0.
+const NoBlockNum uint64 = math.MaxUint64
+
+// BlockMetaFiller is the Block.Meta key set to "true" on the blocks written by the no-gap writer to
+// fill the gaps, see NewWriterNoGap.
+const BlockMetaFiller = "filler"
+
+const (
+	defaultMaxBlockMetaKeys  = 16
+	defaultMaxBlockMetaBytes = 1024
+)
+
+var (
+	ErrBlockNumOutOfRange = fmt.Errorf("block number out of supported range")
+	ErrBlockMetaTooLarge  = fmt.Errorf("block meta too large")
+	ErrBatchNotSorted     = fmt.Errorf("batch blocks not sorted")
+	// ErrBlockOutOfSequence is matched by the errors of the blocks refused by the writer with
+	// Options.StrictSequence, see ErrNonMonotonicBlock and ErrBlockGap.
+	ErrBlockOutOfSequence = fmt.Errorf("block out of sequence")
+)
+
+// ErrNonMonotonicBlock is the ErrBlockOutOfSequence error of the block less than or equal to the last block
+// accepted by the writer, e.g. the block replayed by the reorg handler.
+type ErrNonMonotonicBlock struct {
+	Got uint64
+	// Last is the last block accepted by the writer.
+	Last uint64
+}
+
+func (e *ErrNonMonotonicBlock) Error() string {
+	return fmt.Sprintf("%s: block %d not after block %d", ErrBlockOutOfSequence, e.Got, e.Last)
+}
+
+func (e *ErrNonMonotonicBlock) Unwrap() error {
+	return ErrBlockOutOfSequence
+}
+
+// ErrBlockGap is the ErrBlockOutOfSequence error of the block that skips the block numbers after the last block
+// accepted by the writer.
+type ErrBlockGap struct {
+	// Expected is the block after the last block accepted by the writer.
+	Expected uint64
+	Got      uint64
+}
+
+func (e *ErrBlockGap) Error() string {
+	return fmt.Sprintf("%s: block %d, expected block %d", ErrBlockOutOfSequence, e.Got, e.Expected)
+}
+
+func (e *ErrBlockGap) Unwrap() error {
+	return ErrBlockOutOfSequence
+}
+
+// validateBlockNum returns ErrBlockNumOutOfRange if the block number is higher than MaxSupportedBlockNum.
+func validateBlockNum(blockNum uint64) error {
+	if blockNum > MaxSupportedBlockNum {
+		return fmt.Errorf("%w: %d > %d", ErrBlockNumOutOfRange, blockNum, MaxSupportedBlockNum)
+	}
+	return nil
+}
+
+// validateBatch returns ErrBatchNotSorted if the blocks of the batch aren't sorted strictly ascending by the
+// block number, or ErrBlockNumOutOfRange if any block number is out of range.
+func validateBatch[T any](blocks []Block[T]) error {
+	for i, b := range blocks {
+		if err := validateBlockNum(b.Number); err != nil {
+			return err
+		}
+		if i > 0 && blocks[i-1].Number >= b.Number {
+			return fmt.Errorf("%w: block %d after block %d", ErrBatchNotSorted, b.Number, blocks[i-1].Number)
+		}
+	}
+	return nil
+}
+
+// batchBlockNums returns the block numbers of the batch.
+func batchBlockNums[T any](blocks []Block[T]) []uint64 {
+	blockNums := make([]uint64, 0, len(blocks))
+	for _, b := range blocks {
+		blockNums = append(blockNums, b.Number)
+	}
+	return blockNums
+}
+
+// validateBlockMeta returns ErrBlockMetaTooLarge if the block meta exceeds Options.MaxBlockMetaKeys or
+// Options.MaxBlockMetaBytes.
+func validateBlockMeta(opt Options, meta map[string]string) error {
+	maxKeys := cmp.Or(opt.MaxBlockMetaKeys, defaultMaxBlockMetaKeys)
+	if len(meta) > maxKeys {
+		return fmt.Errorf("%w: %d keys > %d", ErrBlockMetaTooLarge, len(meta), maxKeys)
+	}
+
+	var size int
+	for k, v := range meta {
+		size += len(k) + len(v)
+	}
+	maxBytes := cmp.Or(int(opt.MaxBlockMetaBytes), defaultMaxBlockMetaBytes)
+	if size > maxBytes {
+		return fmt.Errorf("%w: %d bytes > %d", ErrBlockMetaTooLarge, size, maxBytes)
+	}
+	return nil
+}
+
 type Block[T any] struct {
 	Hash   common.Hash `json:"blockHash"`
 	Number uint64      `json:"blockNum"`
 	TS     uint64      `json:"blockTS"` // unix ts
 	Data   T           `json:"blockData"`
+
+	// Blob is the reference to the data offloaded to the blob store, see Options.BlobThreshold. It's set
+	// only if the reader doesn't resolve blobs.
+	Blob *BlobRef `json:"blob,omitempty" cbor:",omitempty"`
+
+	// Meta is the small set of annotations of the block, e.g. the source of the block, stored next to the
+	// data. Its size is limited by Options.MaxBlockMetaKeys and Options.MaxBlockMetaBytes.
+	Meta map[string]string `json:"meta,omitempty" cbor:",omitempty"`
+
+	// Parent is the hash of the parent block, verified like the ParentHash of ChainedData. It's stored only
+	// if set, with the integer CBOR key, so the blocks without it are encoded as before.
+	Parent *common.Hash `json:"parentHash,omitempty" cbor:"0,keyasint,omitempty"`
+}
+
+// ParentHash returns the hash of the parent block, Parent if set, or the ParentHash of the ChainedData
+// block data. It's zero if the block has neither.
+func (b Block[T]) ParentHash() common.Hash {
+	if b.Parent != nil {
+		return *b.Parent
+	}
+	if data, ok := any(b.Data).(ChainedData); ok {
+		return data.ParentHash()
+	}
+	return common.Hash{}
 }
 
 type Blocks[T any] []Block[T]
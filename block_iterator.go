@@ -0,0 +1,169 @@
+package ethwal
+
+import (
+	"math"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+)
+
+// BlockIterator iterates over block numbers in ascending order.
+type BlockIterator interface {
+	HasNext() bool
+	Next() uint64
+	Peek() uint64
+	// AdvanceIfNeeded skips the block numbers lower than blockNum.
+	AdvanceIfNeeded(blockNum uint64)
+}
+
+// sliceBlockIterator iterates over the sorted slice of block numbers.
+type sliceBlockIterator struct {
+	blockNums []uint64
+	pos       int
+}
+
+// NewSliceBlockIterator creates the BlockIterator over the sorted slice of block numbers.
+func NewSliceBlockIterator(blockNums []uint64) BlockIterator {
+	return &sliceBlockIterator{blockNums: blockNums}
+}
+
+func (s *sliceBlockIterator) HasNext() bool {
+	return s.pos < len(s.blockNums)
+}
+
+func (s *sliceBlockIterator) Next() uint64 {
+	blockNum := s.blockNums[s.pos]
+	s.pos++
+	return blockNum
+}
+
+func (s *sliceBlockIterator) Peek() uint64 {
+	return s.blockNums[s.pos]
+}
+
+func (s *sliceBlockIterator) AdvanceIfNeeded(blockNum uint64) {
+	rest := s.blockNums[s.pos:]
+	s.pos += sort.Search(len(rest), func(i int) bool {
+		return rest[i] >= blockNum
+	})
+}
+
+// bitmapBlockIterator iterates over the bitmap of block numbers.
+type bitmapBlockIterator struct {
+	iter roaring64.IntPeekable64
+}
+
+// NewBitmapBlockIterator creates the BlockIterator over the bitmap of block numbers. The bitmap holds
+// plain block numbers, not IndexCompoundID.
+func NewBitmapBlockIterator(bmap *roaring64.Bitmap) BlockIterator {
+	return &bitmapBlockIterator{iter: bmap.Iterator()}
+}
+
+func (b *bitmapBlockIterator) HasNext() bool {
+	return b.iter.HasNext()
+}
+
+func (b *bitmapBlockIterator) Next() uint64 {
+	return b.iter.Next()
+}
+
+func (b *bitmapBlockIterator) Peek() uint64 {
+	return b.iter.PeekNext()
+}
+
+func (b *bitmapBlockIterator) AdvanceIfNeeded(blockNum uint64) {
+	b.iter.AdvanceIfNeeded(blockNum)
+}
+
+// filterBlockIterator iterates over the distinct block numbers of the filter result.
+type filterBlockIterator struct {
+	iter FilterIterator
+}
+
+// NewFilterBlockIterator creates the BlockIterator over the block numbers of the filter result.
+func NewFilterBlockIterator(iter FilterIterator) BlockIterator {
+	return &filterBlockIterator{iter: iter}
+}
+
+func (f *filterBlockIterator) HasNext() bool {
+	return f.iter.HasNext()
+}
+
+func (f *filterBlockIterator) Next() uint64 {
+	blockNum, _ := f.iter.Next()
+	if blockNum < MaxSupportedBlockNum {
+		// skip the remaining data indexes of the block
+		f.iter.AdvanceIfNeeded(blockNum + 1)
+	} else {
+		for f.iter.HasNext() {
+			f.iter.Next()
+		}
+	}
+	return blockNum
+}
+
+func (f *filterBlockIterator) Peek() uint64 {
+	blockNum, _ := f.iter.Peek()
+	return blockNum
+}
+
+func (f *filterBlockIterator) AdvanceIfNeeded(blockNum uint64) {
+	f.iter.AdvanceIfNeeded(blockNum)
+}
+
+// intersectBlockIterator iterates over the block numbers present in both iterators.
+type intersectBlockIterator struct {
+	a, b BlockIterator
+}
+
+// IntersectIterators creates the BlockIterator over the block numbers present in both a and b. The
+// intersection is streamed, the iterator that is behind is advanced to the other one, so the blocks
+// that are only in one of the iterators are skipped rather than scanned.
+func IntersectIterators(a, b BlockIterator) BlockIterator {
+	return &intersectBlockIterator{a: a, b: b}
+}
+
+// align advances the iterators until they point to the same block number.
+func (i *intersectBlockIterator) align() bool {
+	for i.a.HasNext() && i.b.HasNext() {
+		aBlockNum, bBlockNum := i.a.Peek(), i.b.Peek()
+		switch {
+		case aBlockNum == bBlockNum:
+			return true
+		case aBlockNum < bBlockNum:
+			i.a.AdvanceIfNeeded(bBlockNum)
+		default:
+			i.b.AdvanceIfNeeded(aBlockNum)
+		}
+	}
+	return false
+}
+
+func (i *intersectBlockIterator) HasNext() bool {
+	return i.align()
+}
+
+func (i *intersectBlockIterator) Next() uint64 {
+	i.align()
+	i.b.Next()
+	return i.a.Next()
+}
+
+func (i *intersectBlockIterator) Peek() uint64 {
+	i.align()
+	return i.a.Peek()
+}
+
+func (i *intersectBlockIterator) AdvanceIfNeeded(blockNum uint64) {
+	i.a.AdvanceIfNeeded(blockNum)
+	i.b.AdvanceIfNeeded(blockNum)
+}
+
+// advanceTarget returns the lowest IndexCompoundID of the block. Block numbers above MaxSupportedBlockNum
+// are clamped to the highest IndexCompoundID.
+func advanceTarget(blockNum uint64) uint64 {
+	if blockNum > MaxSupportedBlockNum {
+		return math.MaxUint64
+	}
+	return uint64(NewIndexCompoundID(blockNum, 0))
+}
@@ -0,0 +1,122 @@
+package ethwal
+
+import (
+	"testing"
+
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/stretchr/testify/require"
+)
+
+// countingBlockIterator counts the calls to the wrapped iterator.
+type countingBlockIterator struct {
+	BlockIterator
+	next    int
+	advance int
+}
+
+func (c *countingBlockIterator) Next() uint64 {
+	c.next++
+	return c.BlockIterator.Next()
+}
+
+func (c *countingBlockIterator) AdvanceIfNeeded(blockNum uint64) {
+	c.advance++
+	c.BlockIterator.AdvanceIfNeeded(blockNum)
+}
+
+func collectBlockNums(iter BlockIterator) []uint64 {
+	var blockNums []uint64
+	for iter.HasNext() {
+		blockNums = append(blockNums, iter.Next())
+	}
+	return blockNums
+}
+
+// newTestFilterIterator creates the filter result with dataIndexes entries per block.
+func newTestFilterIterator(blockNums []uint64, dataIndexes uint16) FilterIterator {
+	bmap := roaring64.New()
+	for _, blockNum := range blockNums {
+		for i := uint16(0); i < dataIndexes; i++ {
+			bmap.Add(uint64(NewIndexCompoundID(blockNum, i)))
+		}
+	}
+	return newFilterIterator(bmap)
+}
+
+func TestBlockIterator_Adapters(t *testing.T) {
+	blockNums := []uint64{1, 5, 6, 100, 1 << 40}
+
+	t.Run("slice", func(t *testing.T) {
+		require.Equal(t, blockNums, collectBlockNums(NewSliceBlockIterator(blockNums)))
+
+		iter := NewSliceBlockIterator(blockNums)
+		iter.AdvanceIfNeeded(6)
+		require.Equal(t, uint64(6), iter.Peek())
+		iter.AdvanceIfNeeded(2)
+		require.Equal(t, uint64(6), iter.Peek())
+		iter.AdvanceIfNeeded(101)
+		require.Equal(t, []uint64{1 << 40}, collectBlockNums(iter))
+	})
+
+	t.Run("bitmap", func(t *testing.T) {
+		require.Equal(t, blockNums, collectBlockNums(NewBitmapBlockIterator(roaring64.BitmapOf(blockNums...))))
+
+		iter := NewBitmapBlockIterator(roaring64.BitmapOf(blockNums...))
+		iter.AdvanceIfNeeded(7)
+		require.Equal(t, []uint64{100, 1 << 40}, collectBlockNums(iter))
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		require.Equal(t, blockNums, collectBlockNums(NewFilterBlockIterator(newTestFilterIterator(blockNums, 3))))
+
+		iter := NewFilterBlockIterator(newTestFilterIterator(blockNums, 3))
+		iter.AdvanceIfNeeded(6)
+		require.Equal(t, []uint64{6, 100, 1 << 40}, collectBlockNums(iter))
+	})
+}
+
+func TestIntersectIterators(t *testing.T) {
+	var filterBlockNums []uint64
+	for i := uint64(1); i <= 100_000; i++ {
+		filterBlockNums = append(filterBlockNums, i*3)
+	}
+
+	t.Run("small_allow_list", func(t *testing.T) {
+		filterIter := &countingBlockIterator{BlockIterator: NewFilterBlockIterator(newTestFilterIterator(filterBlockNums, 2))}
+		allowIter := &countingBlockIterator{BlockIterator: NewSliceBlockIterator([]uint64{4, 9, 3000, 3001, 299_997, 400_000})}
+
+		require.Equal(t, []uint64{9, 3000, 299_997}, collectBlockNums(IntersectIterators(filterIter, allowIter)))
+
+		// only the matched blocks are iterated, the rest is skipped
+		require.Equal(t, 3, filterIter.next)
+		require.LessOrEqual(t, filterIter.advance, 6)
+	})
+
+	t.Run("large_allow_list", func(t *testing.T) {
+		var allowList []uint64
+		for i := uint64(0); i <= 1_000_000; i += 2 {
+			allowList = append(allowList, i)
+		}
+
+		filterIter := &countingBlockIterator{BlockIterator: NewFilterBlockIterator(newTestFilterIterator([]uint64{7, 10, 500_000, 999_999}, 2))}
+		allowIter := &countingBlockIterator{BlockIterator: NewSliceBlockIterator(allowList)}
+
+		require.Equal(t, []uint64{10, 500_000}, collectBlockNums(IntersectIterators(filterIter, allowIter)))
+		require.Equal(t, 2, allowIter.next)
+		require.LessOrEqual(t, allowIter.advance, 4)
+	})
+
+	t.Run("bitmap_allow_list", func(t *testing.T) {
+		allowIter := &countingBlockIterator{BlockIterator: NewBitmapBlockIterator(roaring64.BitmapOf(6, 7, 8, 9, 299_999, 300_000))}
+		filterIter := &countingBlockIterator{BlockIterator: NewFilterBlockIterator(newTestFilterIterator(filterBlockNums, 1))}
+
+		require.Equal(t, []uint64{6, 9, 300_000}, collectBlockNums(IntersectIterators(allowIter, filterIter)))
+		require.Equal(t, 3, filterIter.next)
+		require.Equal(t, 3, allowIter.next)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		iter := IntersectIterators(NewSliceBlockIterator(nil), NewFilterBlockIterator(newTestFilterIterator(filterBlockNums, 1)))
+		require.Empty(t, collectBlockNums(iter))
+	})
+}
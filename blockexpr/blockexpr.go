@@ -0,0 +1,108 @@
+// Package blockexpr evaluates the small filter expressions against the decoded blocks, e.g. to filter the
+// blocks read by ethwalcat or to filter the blocks that aren't covered by the indexes.
+//
+// The expression compares the block fields and the values of the block data:
+//
+//	number >= 100 AND number < 200
+//	data.logs.address == "0xc2132d05d31c914a87c6611c10748aeb04b58e8f"
+//	len(data.transactions) > 50 OR NOT meta.source == "backfill"
+//	data.input contains "0xa9059cbb"
+//
+// The fields are number, ts, hash, meta.<key> and data, the dotted path into data selects the object
+// fields by their name or json tag, case-insensitively, and the list elements by their index. The path
+// segments applied to a list select from all its elements, and the comparison matches if any of the
+// selected values matches, so the first example above matches the blocks with any log of the address.
+// The missing values match no comparison.
+//
+// The operators are ==, !=, <, <=, >, >=, contains and len(field). The numbers are compared by value,
+// including the decimal and hex strings of the data, and the hex strings are compared case-insensitively.
+// contains tests the substring of the string or the element of the list. The comparisons are combined
+// with AND (&&), OR (||), NOT (!) and parentheses.
+package blockexpr
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/0xsequence/ethwal"
+)
+
+var ErrSyntax = fmt.Errorf("syntax error")
+
+// SyntaxError is the error of the invalid expression and its position.
+type SyntaxError struct {
+	Expr string
+	// Pos is the byte offset of the error in the expression.
+	Pos int
+	Msg string
+}
+
+func newSyntaxError(src string, pos int, msg string) *SyntaxError {
+	return &SyntaxError{Expr: src, Pos: pos, Msg: msg}
+}
+
+// Column returns the 1-based column of the error in the expression.
+func (e *SyntaxError) Column() int {
+	return utf8.RuneCountInString(e.Expr[:e.Pos]) + 1
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at column %d: %s", ErrSyntax, e.Column(), e.Msg)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return ErrSyntax
+}
+
+// Context returns the expression with the error position marked in the line below it.
+func (e *SyntaxError) Context() string {
+	return fmt.Sprintf("%s\n%s^", e.Expr, strings.Repeat(" ", e.Column()-1))
+}
+
+// Expr is the compiled expression, it's safe for concurrent use.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Compile compiles the expression, the invalid expression fails with *SyntaxError.
+func Compile(src string) (*Expr, error) {
+	root, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// MustCompile compiles the expression and panics if it's invalid.
+func MustCompile(src string) *Expr {
+	e, err := Compile(src)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Match reports whether the block matches the expression.
+func Match[T any](e *Expr, b ethwal.Block[T]) bool {
+	return e.root.eval(&blockView{
+		number: b.Number,
+		ts:     b.TS,
+		hash:   b.Hash,
+		data:   b.Data,
+		meta:   b.Meta,
+	})
+}
+
+// Filter returns the function reporting whether the block matches the expression.
+func Filter[T any](e *Expr) func(b ethwal.Block[T]) bool {
+	return func(b ethwal.Block[T]) bool {
+		return Match(e, b)
+	}
+}
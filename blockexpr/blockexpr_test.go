@@ -0,0 +1,304 @@
+package blockexpr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/0xsequence/ethwal"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testToken = "0xc2132D05D31c914a87C6611C10748AEb04B58e8F"
+	testOther = "0x2791bca1f2de4661ed88a30c99a7a9449aa84174"
+)
+
+type testLog struct {
+	Address common.Address `json:"address"`
+	Topics  []common.Hash  `json:"topics"`
+	Data    []byte         `json:"data"`
+}
+
+type testTransaction struct {
+	Hash  common.Hash `json:"hash"`
+	Input string      `json:"input"`
+	Value *big.Int    `json:"value"`
+	Logs  []testLog   `json:"logs"`
+}
+
+type testPayload struct {
+	Transactions []testTransaction `json:"transactions"`
+	GasUsed      uint64            `json:"gasUsed"`
+	Removed      bool              `json:"removed"`
+}
+
+var testTopic = common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+
+func testBlock() ethwal.Block[testPayload] {
+	return ethwal.Block[testPayload]{
+		Hash:   common.HexToHash("0x01"),
+		Number: 150,
+		TS:     1_700_000_000,
+		Meta:   map[string]string{"source": "backfill"},
+		Data: testPayload{
+			GasUsed: 21_000,
+			Transactions: []testTransaction{
+				{
+					Hash:  common.HexToHash("0xaa"),
+					Input: "0xa9059cbb000000",
+					Value: big.NewInt(1000),
+					Logs: []testLog{
+						{Address: common.HexToAddress(testOther), Topics: []common.Hash{testTopic}, Data: []byte{1, 2}},
+					},
+				},
+				{
+					Hash:  common.HexToHash("0xbb"),
+					Input: "0x",
+					Value: big.NewInt(0),
+					Logs: []testLog{
+						{Address: common.HexToAddress(testToken), Topics: []common.Hash{testTopic}},
+						{Address: common.HexToAddress(testToken)},
+					},
+				},
+			},
+		},
+	}
+}
+
+// payloadShapes returns the test block with the data as decoded by the typed reader and the json and cbor
+// decoders of ethwal.Reader[any].
+func payloadShapes(t *testing.T) map[string]ethwal.Block[any] {
+	b := testBlock()
+	typed := ethwal.Block[any]{Hash: b.Hash, Number: b.Number, TS: b.TS, Meta: b.Meta, Data: b.Data}
+
+	jsonData, err := json.Marshal(b.Data)
+	require.NoError(t, err)
+	var fromJSON any
+	require.NoError(t, json.Unmarshal(jsonData, &fromJSON))
+
+	cborData, err := cbor.Marshal(b.Data)
+	require.NoError(t, err)
+	var fromCBOR any
+	require.NoError(t, cbor.Unmarshal(cborData, &fromCBOR))
+
+	shapes := map[string]ethwal.Block[any]{"typed": typed}
+	for name, data := range map[string]any{"json": fromJSON, "cbor": fromCBOR} {
+		block := typed
+		block.Data = data
+		shapes[name] = block
+	}
+	return shapes
+}
+
+func TestMatch(t *testing.T) {
+	testCases := []struct {
+		expr  string
+		match bool
+		// shapes are the payload shapes the case applies to, all if empty
+		shapes []string
+	}{
+		{expr: "number == 150", match: true},
+		{expr: "number >= 100 AND number < 200", match: true},
+		{expr: "number > 150", match: false},
+		{expr: "blockNum != 150", match: false},
+		{expr: "ts >= 1700000000 && ts <= 0x6553f100", match: true},
+		{expr: "hash == '0x0000000000000000000000000000000000000000000000000000000000000001'", match: true},
+		{expr: "meta.source == 'backfill'", match: true},
+		{expr: "meta.missing == 'backfill'", match: false},
+		{expr: "NOT meta.missing == 'backfill'", match: true},
+		{expr: "data.gasUsed == 21000", match: true},
+		{expr: "data.gasUsed > 2.1e4", match: false},
+		{expr: "data.removed == false", match: true},
+		{expr: "data.removed == true", match: false},
+		{expr: "len(data.transactions) == 2", match: true},
+		{expr: "len(data.transactions) > 50", match: false},
+		{expr: "len(data.transactions.logs) == 2", match: true},
+		{expr: "len(data.transactions.1.logs) == 1", match: false},
+		// any log address, case-insensitive for the hex strings
+		{expr: "data.transactions.logs.address == '" + testToken + "'", match: true},
+		{expr: "data.TRANSACTIONS.Logs.Address == '0xc2132d05d31c914a87c6611c10748aeb04b58e8f'", match: true},
+		{expr: "data.transactions.0.logs.address == '" + testToken + "'", match: false},
+		{expr: "data.transactions.5.logs.address == '" + testToken + "'", match: false},
+		{expr: "data.transactions.logs.topics contains '" + testTopic.Hex() + "'", match: true},
+		{expr: "data.transactions.logs.topics == '" + testTopic.Hex() + "'", match: true},
+		{expr: "data.transactions.input contains '0xA9059CBB'", match: true},
+		{expr: "data.transactions.input contains 'transfer'", match: false},
+		{expr: "data.transactions.value > 999", match: true},
+		{expr: "data.transactions.value > 1000", match: false},
+		{expr: "data.transactions.hash == '0xbb'", match: false},
+		{expr: "data.transactions.logs.data == '0x0102'", match: true, shapes: []string{"typed", "cbor"}},
+		{expr: "data.transactions.logs.data == 'AQI='", match: true, shapes: []string{"json"}},
+		{expr: "data.missing.field == 1 OR data.gasUsed == 21000", match: true},
+		{expr: "(number == 1 OR number == 150) AND !(data.gasUsed < 21000)", match: true},
+		{expr: "number == 1 OR number == 2 AND number == 150", match: false},
+		// the hex strings are numbers
+		{expr: "data.transactions.input > 1", match: true},
+		{expr: "data.removed > 1", match: false},
+		{expr: "data.transactions.logs.address != '" + testToken + "'", match: true},
+	}
+
+	shapes := payloadShapes(t)
+	for _, tc := range testCases {
+		e, err := Compile(tc.expr)
+		require.NoError(t, err, tc.expr)
+
+		for name, b := range shapes {
+			if len(tc.shapes) > 0 && !contains(tc.shapes, name) {
+				continue
+			}
+			require.Equal(t, tc.match, Match(e, b), "%s: %s", name, tc.expr)
+		}
+	}
+
+	// the typed block without the conversion to Block[any]
+	require.True(t, Match(MustCompile("data.transactions.logs.address == '"+testToken+"'"), testBlock()))
+	require.True(t, Filter[testPayload](MustCompile("number == 150"))(testBlock()))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCompile_SyntaxError(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		column int
+		msg    string
+	}{
+		{expr: "", column: 1, msg: "empty expression"},
+		{expr: "number ==", column: 10, msg: "expected field, number or string, found \"end of expression\""},
+		{expr: "number 150", column: 8, msg: "expected comparison operator after number, found number \"150\""},
+		{expr: "block == 1", column: 1, msg: "unknown field \"block\""},
+		{expr: "number == 1 AND (ts > 2", column: 24, msg: "expected \")\""},
+		{expr: "number == 1)", column: 12, msg: "unexpected \")\""},
+		{expr: "data.logs == 'x", column: 14, msg: "unterminated string"},
+		{expr: "number = 1 & ts = 2", column: 12, msg: "did you mean \"&&\""},
+		{expr: "number < 'abc'", column: 10, msg: "operator \"<\" requires a number"},
+		{expr: "number == 0xzz", column: 11, msg: "invalid number \"0xzz\""},
+		{expr: "number.x == 1", column: 1, msg: "field \"number\" has no fields"},
+		{expr: "meta == 'x'", column: 1, msg: "meta field must be meta.<key>"},
+		{expr: "len(number == 1", column: 12, msg: "expected \")\""},
+		{expr: "data.a..b == 1", column: 1, msg: "invalid field path"},
+		{expr: "données == 1 OR € == 2", column: 17, msg: "unexpected '€'"},
+	}
+
+	for _, tc := range testCases {
+		_, err := Compile(tc.expr)
+		require.ErrorIs(t, err, ErrSyntax, tc.expr)
+
+		var syntaxErr *SyntaxError
+		require.True(t, errors.As(err, &syntaxErr), tc.expr)
+		require.Equal(t, tc.column, syntaxErr.Column(), "%s: %s", tc.expr, err)
+		require.Contains(t, err.Error(), tc.msg, tc.expr)
+		require.Contains(t, err.Error(), fmt.Sprintf("column %d", tc.column))
+	}
+
+	_, err := Compile("number == 1 AND (ts > 2")
+	var syntaxErr *SyntaxError
+	require.True(t, errors.As(err, &syntaxErr))
+	require.Equal(t, "number == 1 AND (ts > 2\n                       ^", syntaxErr.Context())
+}
+
+// benchmarkBlocks returns the json decoded blocks, one in ten has the log of the test token.
+func benchmarkBlocks(b *testing.B) []ethwal.Block[any] {
+	var blocks []ethwal.Block[any]
+	for i := 0; i < 1000; i++ {
+		block := testBlock()
+		block.Number = uint64(i)
+		if i%10 != 0 {
+			for j := range block.Data.Transactions {
+				for k := range block.Data.Transactions[j].Logs {
+					block.Data.Transactions[j].Logs[k].Address = common.HexToAddress(testOther)
+				}
+			}
+		}
+
+		data, err := json.Marshal(block.Data)
+		require.NoError(b, err)
+		var decoded any
+		require.NoError(b, json.Unmarshal(data, &decoded))
+		blocks = append(blocks, ethwal.Block[any]{Number: block.Number, TS: block.TS, Hash: block.Hash, Data: decoded})
+	}
+	return blocks
+}
+
+// BenchmarkWhere filters the decoded blocks in-process and serializes only the matching blocks, as
+// ethwalcat --where does.
+func BenchmarkWhere(b *testing.B) {
+	blocks := benchmarkBlocks(b)
+	e := MustCompile("data.transactions.logs.address == '" + testToken + "'")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var matched int
+		for _, block := range blocks {
+			if !Match(e, block) {
+				continue
+			}
+			_, err := json.Marshal(block)
+			if err != nil {
+				b.Fatal(err)
+			}
+			matched++
+		}
+		if matched != len(blocks)/10 {
+			b.Fatalf("matched %d blocks", matched)
+		}
+	}
+}
+
+// BenchmarkJSONPipeline serializes every block and filters the parsed output, the work of piping
+// ethwalcat to jq 'select(any(.blockData.transactions[].logs[]; .address == ...))'.
+func BenchmarkJSONPipeline(b *testing.B) {
+	blocks := benchmarkBlocks(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var matched int
+		for _, block := range blocks {
+			data, err := json.Marshal(block)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var parsed struct {
+				BlockData struct {
+					Transactions []struct {
+						Logs []struct {
+							Address string `json:"address"`
+						} `json:"logs"`
+					} `json:"transactions"`
+				} `json:"blockData"`
+			}
+			err = json.Unmarshal(data, &parsed)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+		match:
+			for _, tx := range parsed.BlockData.Transactions {
+				for _, log := range tx.Logs {
+					if strings.EqualFold(log.Address, testToken) {
+						_, _ = json.Marshal(parsed)
+						matched++
+						break match
+					}
+				}
+			}
+		}
+		if matched != len(blocks)/10 {
+			b.Fatalf("matched %d blocks", matched)
+		}
+	}
+}
@@ -0,0 +1,467 @@
+package blockexpr
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+)
+
+// blockView is the block the expression is evaluated against.
+type blockView struct {
+	number uint64
+	ts     uint64
+	hash   common.Hash
+	data   any
+	meta   map[string]string
+}
+
+type fieldRoot int
+
+const (
+	rootNumber fieldRoot = iota
+	rootTS
+	rootHash
+	rootData
+	rootMeta
+)
+
+var fieldRoots = map[string]fieldRoot{
+	"number":    rootNumber,
+	"blocknum":  rootNumber,
+	"ts":        rootTS,
+	"blockts":   rootTS,
+	"hash":      rootHash,
+	"blockhash": rootHash,
+	"data":      rootData,
+	"blockdata": rootData,
+	"meta":      rootMeta,
+}
+
+// field is the block field or the value within the block data selected by the dotted path.
+type field struct {
+	text string
+	root fieldRoot
+	path []string
+}
+
+func newField(text string) (*field, error) {
+	segments := strings.Split(text, ".")
+
+	root, ok := fieldRoots[strings.ToLower(segments[0])]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q, the fields are number, ts, hash, data and meta", segments[0])
+	}
+
+	switch root {
+	case rootNumber, rootTS, rootHash:
+		if len(segments) > 1 {
+			return nil, fmt.Errorf("field %q has no fields", segments[0])
+		}
+	case rootMeta:
+		if len(segments) != 2 {
+			return nil, fmt.Errorf("meta field must be meta.<key>")
+		}
+	}
+	return &field{text: text, root: root, path: segments[1:]}, nil
+}
+
+func (f *field) String() string {
+	return f.text
+}
+
+func (f *field) values(b *blockView) []any {
+	switch f.root {
+	case rootNumber:
+		return []any{b.number}
+	case rootTS:
+		return []any{b.ts}
+	case rootHash:
+		return []any{b.hash.Hex()}
+	case rootMeta:
+		value, ok := b.meta[f.path[0]]
+		if !ok {
+			return nil
+		}
+		return []any{value}
+	default:
+		return resolve(b.data, f.path, nil)
+	}
+}
+
+// lenOperand is the length of the string, the list or the object selected by the field.
+type lenOperand struct {
+	field *field
+}
+
+func (l *lenOperand) String() string {
+	return fmt.Sprintf("len(%s)", l.field)
+}
+
+func (l *lenOperand) values(b *blockView) []any {
+	var lengths []any
+	for _, value := range l.field.values(b) {
+		switch v := value.(type) {
+		case string:
+			lengths = append(lengths, uint64(len(v)))
+		case []any:
+			lengths = append(lengths, uint64(len(v)))
+		case map[string]any:
+			lengths = append(lengths, uint64(len(v)))
+		case map[any]any:
+			lengths = append(lengths, uint64(len(v)))
+		default:
+			rv := reflect.ValueOf(value)
+			switch rv.Kind() {
+			case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+				lengths = append(lengths, uint64(rv.Len()))
+			}
+		}
+	}
+	return lengths
+}
+
+// resolve appends the values selected by the path. The path selects the object fields by their name or
+// json tag, case-insensitively, and the list elements by their index. The other segments applied to a list
+// select from all its elements.
+func resolve(value any, path []string, out []any) []any {
+	if len(path) == 0 {
+		if value == nil {
+			return out
+		}
+		return append(out, value)
+	}
+
+	segment := path[0]
+	switch v := value.(type) {
+	case nil:
+		return out
+	case map[string]any:
+		if child, ok := v[segment]; ok {
+			return resolve(child, path[1:], out)
+		}
+		for key, child := range v {
+			if strings.EqualFold(key, segment) {
+				return resolve(child, path[1:], out)
+			}
+		}
+		return out
+	case map[any]any:
+		for key, child := range v {
+			if strings.EqualFold(fmt.Sprint(key), segment) {
+				return resolve(child, path[1:], out)
+			}
+		}
+		return out
+	case []any:
+		if i, err := strconv.Atoi(segment); err == nil {
+			if i < 0 || i >= len(v) {
+				return out
+			}
+			return resolve(v[i], path[1:], out)
+		}
+		for _, child := range v {
+			out = resolve(child, path, out)
+		}
+		return out
+	}
+	return resolveValue(reflect.ValueOf(value), path, out)
+}
+
+func resolveValue(rv reflect.Value, path []string, out []any) []any {
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return out
+		}
+		rv = rv.Elem()
+	}
+
+	if len(path) == 0 {
+		return append(out, rv.Interface())
+	}
+
+	segment := path[0]
+	switch rv.Kind() {
+	case reflect.Struct:
+		i, ok := structFields(rv.Type())[strings.ToLower(segment)]
+		if !ok {
+			return out
+		}
+		return resolveValue(rv.Field(i), path[1:], out)
+	case reflect.Map:
+		iter := rv.MapRange()
+		for iter.Next() {
+			if strings.EqualFold(fmt.Sprint(iter.Key().Interface()), segment) {
+				return resolveValue(iter.Value(), path[1:], out)
+			}
+		}
+		return out
+	case reflect.Slice, reflect.Array:
+		if i, err := strconv.Atoi(segment); err == nil {
+			if i < 0 || i >= rv.Len() {
+				return out
+			}
+			return resolveValue(rv.Index(i), path[1:], out)
+		}
+		for i := 0; i < rv.Len(); i++ {
+			out = resolveValue(rv.Index(i), path, out)
+		}
+		return out
+	default:
+		return out
+	}
+}
+
+// structFieldsCache maps the struct types to their exported fields by the lower case name and json tag.
+var structFieldsCache sync.Map
+
+func structFields(t reflect.Type) map[string]int {
+	if fields, ok := structFieldsCache.Load(t); ok {
+		return fields.(map[string]int)
+	}
+
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		fields[strings.ToLower(sf.Name)] = i
+	}
+	// the json names take precedence over the field names
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		if name, _, _ := strings.Cut(sf.Tag.Get("json"), ","); name != "" && name != "-" {
+			fields[strings.ToLower(name)] = i
+		}
+	}
+
+	structFieldsCache.Store(t, fields)
+	return fields
+}
+
+// compare reports whether any pair of the values matches. The lists are compared by their elements, except
+// for contains that checks whether the list contains the right value.
+func compare(left []any, op tokenKind, right []any) bool {
+	for _, l := range left {
+		for _, r := range right {
+			if compareValues(l, op, r) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func compareValues(left any, op tokenKind, right any) bool {
+	if op == tokenContains {
+		if elems, ok := listElements(left); ok {
+			for _, elem := range elems {
+				if compareValues(elem, tokenEq, right) {
+					return true
+				}
+			}
+			return false
+		}
+
+		l, lok := toString(left)
+		r, rok := toString(right)
+		if !lok || !rok {
+			return false
+		}
+		if isHex(l) {
+			return strings.Contains(strings.ToLower(l), strings.ToLower(r))
+		}
+		return strings.Contains(l, r)
+	}
+
+	if elems, ok := listElements(left); ok {
+		for _, elem := range elems {
+			if compareValues(elem, op, right) {
+				return true
+			}
+		}
+		return false
+	}
+	if elems, ok := listElements(right); ok {
+		for _, elem := range elems {
+			if compareValues(left, op, elem) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if l, ok := left.(bool); ok {
+		r, ok := right.(bool)
+		if !ok {
+			return false
+		}
+		switch op {
+		case tokenEq:
+			return l == r
+		case tokenNeq:
+			return l != r
+		default:
+			return false
+		}
+	}
+
+	// the numbers are compared by value, the strings that are numbers are compared with the numbers
+	_, lnum := left.(*big.Float)
+	_, rnum := right.(*big.Float)
+	if lnum || rnum || (isNumber(left) && isNumber(right)) {
+		l, lok := toNumber(left)
+		r, rok := toNumber(right)
+		if !lok || !rok {
+			return false
+		}
+		c := l.Cmp(r)
+		switch op {
+		case tokenEq:
+			return c == 0
+		case tokenNeq:
+			return c != 0
+		case tokenLt:
+			return c < 0
+		case tokenLte:
+			return c <= 0
+		case tokenGt:
+			return c > 0
+		case tokenGte:
+			return c >= 0
+		}
+		return false
+	}
+
+	l, lok := toString(left)
+	r, rok := toString(right)
+	if !lok || !rok {
+		return false
+	}
+	equal := l == r || (isHex(l) && isHex(r) && strings.EqualFold(l, r))
+	switch op {
+	case tokenEq:
+		return equal
+	case tokenNeq:
+		return !equal
+	default:
+		return false
+	}
+}
+
+// listElements returns the elements of the list, the byte slices and arrays are values.
+func listElements(value any) ([]any, bool) {
+	switch v := value.(type) {
+	case []any:
+		return v, true
+	case []byte, string:
+		return nil, false
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	if rv.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	// the types with the string form, e.g. common.Hash, are values
+	if _, ok := value.(fmt.Stringer); ok {
+		return nil, false
+	}
+
+	elems := make([]any, rv.Len())
+	for i := range elems {
+		elems[i] = rv.Index(i).Interface()
+	}
+	return elems, true
+}
+
+func isHex(s string) bool {
+	return len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X')
+}
+
+func isNumber(value any) bool {
+	switch value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, json.Number, *big.Int, big.Int, *big.Float:
+		return true
+	}
+	return false
+}
+
+// toNumber converts the number or the decimal or hex string to the number.
+func toNumber(value any) (*big.Float, bool) {
+	switch v := value.(type) {
+	case *big.Float:
+		return v, true
+	case int:
+		return new(big.Float).SetInt64(int64(v)), true
+	case int8:
+		return new(big.Float).SetInt64(int64(v)), true
+	case int16:
+		return new(big.Float).SetInt64(int64(v)), true
+	case int32:
+		return new(big.Float).SetInt64(int64(v)), true
+	case int64:
+		return new(big.Float).SetInt64(v), true
+	case uint:
+		return new(big.Float).SetUint64(uint64(v)), true
+	case uint8:
+		return new(big.Float).SetUint64(uint64(v)), true
+	case uint16:
+		return new(big.Float).SetUint64(uint64(v)), true
+	case uint32:
+		return new(big.Float).SetUint64(uint64(v)), true
+	case uint64:
+		return new(big.Float).SetUint64(v), true
+	case float32:
+		return new(big.Float).SetFloat64(float64(v)), true
+	case float64:
+		return new(big.Float).SetFloat64(v), true
+	case json.Number:
+		return parseNumber(string(v))
+	case *big.Int:
+		if v == nil {
+			return nil, false
+		}
+		return new(big.Float).SetInt(v), true
+	case big.Int:
+		return new(big.Float).SetInt(&v), true
+	case string:
+		return parseNumber(v)
+	}
+	return nil, false
+}
+
+// toString returns the string form of the value, the bytes are hex encoded.
+func toString(value any) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return "0x" + hex.EncodeToString(v), true
+	case fmt.Stringer:
+		return v.String(), true
+	}
+
+	rv := reflect.ValueOf(value)
+	switch {
+	case rv.Kind() == reflect.String:
+		return rv.String(), true
+	case rv.Kind() == reflect.Array && rv.Type().Elem().Kind() == reflect.Uint8:
+		b := make([]byte, rv.Len())
+		reflect.Copy(reflect.ValueOf(b), rv)
+		return "0x" + hex.EncodeToString(b), true
+	}
+	return "", false
+}
@@ -0,0 +1,215 @@
+package blockexpr
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenEq
+	tokenNeq
+	tokenLt
+	tokenLte
+	tokenGt
+	tokenGte
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenContains
+)
+
+var tokenNames = map[tokenKind]string{
+	tokenEOF:      "end of expression",
+	tokenIdent:    "field",
+	tokenNumber:   "number",
+	tokenString:   "string",
+	tokenLParen:   "(",
+	tokenRParen:   ")",
+	tokenComma:    ",",
+	tokenEq:       "==",
+	tokenNeq:      "!=",
+	tokenLt:       "<",
+	tokenLte:      "<=",
+	tokenGt:       ">",
+	tokenGte:      ">=",
+	tokenAnd:      "AND",
+	tokenOr:       "OR",
+	tokenNot:      "NOT",
+	tokenContains: "contains",
+}
+
+func (k tokenKind) String() string {
+	return tokenNames[k]
+}
+
+// keywords are case-insensitive.
+var keywords = map[string]tokenKind{
+	"and":      tokenAnd,
+	"or":       tokenOr,
+	"not":      tokenNot,
+	"contains": tokenContains,
+}
+
+type token struct {
+	kind tokenKind
+	// text is the identifier, the number or the unquoted string.
+	text string
+	// pos is the byte offset of the token in the expression.
+	pos int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenIdent, tokenNumber:
+		return fmt.Sprintf("%s %q", t.kind, t.text)
+	case tokenString:
+		return fmt.Sprintf("string %q", t.text)
+	default:
+		return fmt.Sprintf("%q", t.kind.String())
+	}
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentPart(r rune) bool {
+	return r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// lex splits the expression into tokens.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, pos: i})
+			i++
+		case c == '=' || c == '!' || c == '<' || c == '>' || c == '&' || c == '|':
+			tok, n, err := lexOperator(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			i += n
+		case c == '"' || c == '\'':
+			tok, n, err := lexString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			i += n
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			i++
+			for i < len(src) && isIdentPart(rune(src[i])) {
+				i++
+			}
+			if src[start:i] == "-" {
+				return nil, newSyntaxError(src, start, "unexpected \"-\"")
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: src[start:i], pos: start})
+		default:
+			r := []rune(src[i:])[0]
+			if !isIdentStart(r) {
+				return nil, newSyntaxError(src, i, fmt.Sprintf("unexpected %q", r))
+			}
+
+			start := i
+			for i < len(src) {
+				r := []rune(src[i:])[0]
+				if !isIdentPart(r) {
+					break
+				}
+				i += len(string(r))
+			}
+
+			text := src[start:i]
+			if kind, ok := keywords[strings.ToLower(text)]; ok {
+				tokens = append(tokens, token{kind: kind, text: text, pos: start})
+				continue
+			}
+			if strings.HasSuffix(text, ".") || strings.Contains(text, "..") {
+				return nil, newSyntaxError(src, start, fmt.Sprintf("invalid field path %q", text))
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: text, pos: start})
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+func lexOperator(src string, i int) (token, int, error) {
+	two := ""
+	if i+1 < len(src) {
+		two = src[i : i+2]
+	}
+
+	switch two {
+	case "==":
+		return token{kind: tokenEq, pos: i}, 2, nil
+	case "!=":
+		return token{kind: tokenNeq, pos: i}, 2, nil
+	case "<=":
+		return token{kind: tokenLte, pos: i}, 2, nil
+	case ">=":
+		return token{kind: tokenGte, pos: i}, 2, nil
+	case "&&":
+		return token{kind: tokenAnd, pos: i}, 2, nil
+	case "||":
+		return token{kind: tokenOr, pos: i}, 2, nil
+	}
+
+	switch src[i] {
+	case '=':
+		return token{kind: tokenEq, pos: i}, 1, nil
+	case '!':
+		return token{kind: tokenNot, pos: i}, 1, nil
+	case '<':
+		return token{kind: tokenLt, pos: i}, 1, nil
+	case '>':
+		return token{kind: tokenGt, pos: i}, 1, nil
+	default:
+		return token{}, 0, newSyntaxError(src, i, fmt.Sprintf("unexpected %q, did you mean %q", src[i], strings.Repeat(string(src[i]), 2)))
+	}
+}
+
+// lexString reads the string quoted with ' or ", the quote and the backslash are escaped with a backslash.
+func lexString(src string, i int) (token, int, error) {
+	quote := src[i]
+
+	var sb strings.Builder
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			if j+1 == len(src) {
+				return token{}, 0, newSyntaxError(src, j, "unterminated escape")
+			}
+			j++
+			sb.WriteByte(src[j])
+		case quote:
+			return token{kind: tokenString, text: sb.String(), pos: i}, j - i + 1, nil
+		default:
+			sb.WriteByte(src[j])
+		}
+	}
+	return token{}, 0, newSyntaxError(src, i, "unterminated string")
+}
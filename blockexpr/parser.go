@@ -0,0 +1,271 @@
+package blockexpr
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// node is the compiled boolean expression.
+type node interface {
+	eval(b *blockView) bool
+	String() string
+}
+
+type andNode struct{ left, right node }
+
+func (n *andNode) eval(b *blockView) bool { return n.left.eval(b) && n.right.eval(b) }
+func (n *andNode) String() string         { return fmt.Sprintf("(%s AND %s)", n.left, n.right) }
+
+type orNode struct{ left, right node }
+
+func (n *orNode) eval(b *blockView) bool { return n.left.eval(b) || n.right.eval(b) }
+func (n *orNode) String() string         { return fmt.Sprintf("(%s OR %s)", n.left, n.right) }
+
+type notNode struct{ expr node }
+
+func (n *notNode) eval(b *blockView) bool { return !n.expr.eval(b) }
+func (n *notNode) String() string         { return fmt.Sprintf("NOT %s", n.expr) }
+
+type compareNode struct {
+	left  operand
+	op    tokenKind
+	right operand
+}
+
+func (n *compareNode) eval(b *blockView) bool {
+	return compare(n.left.values(b), n.op, n.right.values(b))
+}
+
+func (n *compareNode) String() string {
+	return fmt.Sprintf("%s %s %s", n.left, n.op, n.right)
+}
+
+// operand is the side of the comparison, it evaluates to the values of the block. The comparison
+// matches if any pair of the values matches.
+type operand interface {
+	values(b *blockView) []any
+	String() string
+}
+
+type literal struct {
+	value any
+	text  string
+}
+
+func (l *literal) values(b *blockView) []any { return []any{l.value} }
+func (l *literal) String() string            { return l.text }
+
+type parser struct {
+	src    string
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) errorf(tok token, format string, args ...any) error {
+	return newSyntaxError(p.src, tok.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+	tok := p.next()
+	if tok.kind != kind {
+		return tok, p.errorf(tok, "expected %q, found %s", kind.String(), tok)
+	}
+	return tok, nil
+}
+
+// parse parses the expression:
+//
+//	expr       = and { ("OR" | "||") and }
+//	and        = not { ("AND" | "&&") not }
+//	not        = ("NOT" | "!") not | "(" expr ")" | comparison
+//	comparison = operand ("==" | "!=" | "<" | "<=" | ">" | ">=" | "contains") operand
+//	operand    = field | "len(" field ")" | number | string | "true" | "false"
+func parse(src string) (node, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{src: src, tokens: tokens}
+	if p.peek().kind == tokenEOF {
+		return nil, p.errorf(p.peek(), "empty expression")
+	}
+
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, p.errorf(tok, "unexpected %s", tok)
+	}
+	return n, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenAnd {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	switch p.peek().kind {
+	case tokenNot:
+		p.next()
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{expr: expr}, nil
+	case tokenLParen:
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(tokenRParen)
+		if err != nil {
+			return nil, err
+		}
+		return expr, nil
+	default:
+		return p.parseComparison()
+	}
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	opTok := p.next()
+	switch opTok.kind {
+	case tokenEq, tokenNeq, tokenLt, tokenLte, tokenGt, tokenGte, tokenContains:
+	default:
+		return nil, p.errorf(opTok, "expected comparison operator after %s, found %s", left, opTok)
+	}
+
+	rightTok := p.peek()
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if isOrdering(opTok.kind) {
+		if l, ok := right.(*literal); ok {
+			if _, ok := l.value.(*big.Float); !ok {
+				return nil, p.errorf(rightTok, "operator %q requires a number, found %s", opTok.kind.String(), l)
+			}
+		}
+	}
+	return &compareNode{left: left, op: opTok.kind, right: right}, nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenNumber:
+		value, ok := parseNumber(tok.text)
+		if !ok {
+			return nil, p.errorf(tok, "invalid number %q", tok.text)
+		}
+		return &literal{value: value, text: tok.text}, nil
+	case tokenString:
+		return &literal{value: tok.text, text: strconv.Quote(tok.text)}, nil
+	case tokenIdent:
+		switch strings.ToLower(tok.text) {
+		case "true":
+			return &literal{value: true, text: "true"}, nil
+		case "false":
+			return &literal{value: false, text: "false"}, nil
+		case "len":
+			if p.peek().kind != tokenLParen {
+				break
+			}
+			p.next()
+
+			fieldTok, err := p.expect(tokenIdent)
+			if err != nil {
+				return nil, err
+			}
+			f, err := p.newField(fieldTok)
+			if err != nil {
+				return nil, err
+			}
+
+			_, err = p.expect(tokenRParen)
+			if err != nil {
+				return nil, err
+			}
+			return &lenOperand{field: f}, nil
+		}
+		return p.newField(tok)
+	default:
+		return nil, p.errorf(tok, "expected field, number or string, found %s", tok)
+	}
+}
+
+func (p *parser) newField(tok token) (*field, error) {
+	f, err := newField(tok.text)
+	if err != nil {
+		return nil, p.errorf(tok, "%s", err)
+	}
+	return f, nil
+}
+
+func isOrdering(op tokenKind) bool {
+	return op == tokenLt || op == tokenLte || op == tokenGt || op == tokenGte
+}
+
+// parseNumber parses the decimal, the hex (0x) or the floating point number.
+func parseNumber(text string) (*big.Float, bool) {
+	if i, ok := new(big.Int).SetString(text, 0); ok {
+		return new(big.Float).SetInt(i), true
+	}
+
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, false
+	}
+	return big.NewFloat(f), true
+}
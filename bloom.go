@@ -0,0 +1,230 @@
+package ethwal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+// BloomFileSuffix is the suffix of the bloom filter object stored next to the ethwal file.
+const BloomFileSuffix = ".bloom"
+
+const defaultBloomFalsePositiveRate = 0.01
+
+const (
+	bloomFilterMagic   = "EWBF"
+	bloomFilterVersion = 1
+
+	// bloomFilterHeaderSize is the size of the magic, the version, the number of hash functions and
+	// the number of bits
+	bloomFilterHeaderSize = 4 + 1 + 4 + 8
+)
+
+var (
+	ErrBloomFilterInvalid            = fmt.Errorf("invalid bloom filter")
+	ErrBloomFilterVersionUnsupported = fmt.Errorf("bloom filter version is not supported")
+)
+
+// BloomKeysFunc returns the keys of the block that are added to the bloom filter of the file.
+type BloomKeysFunc[T any] func(b Block[T]) [][]byte
+
+// bloomKeysFunc returns the bloom keys function of the options, see Options.BloomKeys.
+func bloomKeysFunc[T any](opt Options) (BloomKeysFunc[T], error) {
+	switch fn := opt.BloomKeys.(type) {
+	case nil:
+		return nil, nil
+	case BloomKeysFunc[T]:
+		return fn, nil
+	case func(b Block[T]) [][]byte:
+		return fn, nil
+	default:
+		return nil, fmt.Errorf("bloom keys function %T doesn't match the block type %T", opt.BloomKeys, Block[T]{})
+	}
+}
+
+// bloomFilter is the bloom filter with double hashing, the i-th bit position of the key
+// is h1 + i*h2 mod m.
+type bloomFilter struct {
+	k    uint32
+	m    uint64
+	bits []uint64
+}
+
+// newBloomFilter returns the bloom filter sized for n keys and the target false-positive rate p.
+func newBloomFilter(n uint64, p float64) *bloomFilter {
+	if p <= 0 || p >= 1 {
+		p = defaultBloomFalsePositiveRate
+	}
+
+	// m = -n*ln(p) / ln(2)^2, k = m/n * ln(2)
+	m := uint64(math.Ceil(-float64(max(n, 1)) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = max((m+63)/64*64, 64)
+
+	k := uint32(math.Round(float64(m) / float64(max(n, 1)) * math.Ln2))
+	k = min(max(k, 1), 32)
+
+	return &bloomFilter{k: k, m: m, bits: make([]uint64, m/64)}
+}
+
+// bloomHash returns the two hashes of the key used for double hashing.
+func bloomHash(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	sum := h.Sum64()
+
+	// the second hash is odd, so that the bit positions don't repeat for power of two m
+	return mix64(sum), mix64(sum^0x9e3779b97f4a7c15) | 1
+}
+
+// mix64 is the splitmix64 finalizer.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (b *bloomFilter) addHash(h1, h2 uint64) {
+	for i := uint64(0); i < uint64(b.k); i++ {
+		pos := (h1 + i*h2) % b.m
+		b.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+func (b *bloomFilter) mayContainHash(h1, h2 uint64) bool {
+	for i := uint64(0); i < uint64(b.k); i++ {
+		pos := (h1 + i*h2) % b.m
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MayContain reports whether the key may have been added to the filter.
+func (b *bloomFilter) MayContain(key []byte) bool {
+	return b.mayContainHash(bloomHash(key))
+}
+
+func (b *bloomFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, bloomFilterHeaderSize, bloomFilterHeaderSize+len(b.bits)*8)
+	copy(data, bloomFilterMagic)
+	data[4] = bloomFilterVersion
+	binary.BigEndian.PutUint32(data[5:9], b.k)
+	binary.BigEndian.PutUint64(data[9:17], b.m)
+	for _, word := range b.bits {
+		data = binary.LittleEndian.AppendUint64(data, word)
+	}
+	return data, nil
+}
+
+func (b *bloomFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < bloomFilterHeaderSize || string(data[:4]) != bloomFilterMagic {
+		return ErrBloomFilterInvalid
+	}
+	if data[4] != bloomFilterVersion {
+		return fmt.Errorf("%w: %d", ErrBloomFilterVersionUnsupported, data[4])
+	}
+
+	k := binary.BigEndian.Uint32(data[5:9])
+	m := binary.BigEndian.Uint64(data[9:17])
+	if k == 0 || m == 0 || m%64 != 0 || uint64(len(data)-bloomFilterHeaderSize) != m/8 {
+		return ErrBloomFilterInvalid
+	}
+
+	bits := make([]uint64, m/64)
+	for i := range bits {
+		bits[i] = binary.LittleEndian.Uint64(data[bloomFilterHeaderSize+i*8:])
+	}
+
+	*b = bloomFilter{k: k, m: m, bits: bits}
+	return nil
+}
+
+// BloomPath returns the path to the bloom filter of the file.
+func (f *File) BloomPath() string {
+	return f.Path() + BloomFileSuffix
+}
+
+func writeBloomFilter(ctx context.Context, fs storage.FS, file *File, bloom *bloomFilter) error {
+	data, err := bloom.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	w, err := fs.Create(ctx, file.BloomPath(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create bloom filter: %w", err)
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed to write bloom filter: %w", err)
+	}
+	return w.Close()
+}
+
+func readBloomFilter(ctx context.Context, fs storage.FS, file *File) (*bloomFilter, error) {
+	r, err := fs.Open(ctx, file.BloomPath(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var bloom bloomFilter
+	err = bloom.UnmarshalBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	return &bloom, nil
+}
+
+// ProbeFiles returns the files that might contain the key according to their bloom filters, see
+// Options.BloomKeys. The files without the bloom filter are always returned.
+func ProbeFiles(ctx context.Context, opt Options, key []byte) ([]*File, error) {
+	opt = opt.WithDefaults()
+	fs := storage.NewPrefixWrapper(newReplicaFS(opt), opt.Dataset.FullPath())
+
+	h1, h2 := bloomHash(key)
+
+	var files []*File
+	err := NewFileIndex(fs).Stream(ctx, func(file *File) error {
+		if !file.Bloom {
+			files = append(files, file)
+			return nil
+		}
+
+		bloom, err := readBloomFilter(ctx, fs, file)
+		if err != nil {
+			// the filter may be missing or written by the newer version
+			if storage.IsNotExist(err) || errors.Is(err, ErrBloomFilterVersionUnsupported) {
+				files = append(files, file)
+				return nil
+			}
+			return fmt.Errorf("failed to read bloom filter of file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err)
+		}
+
+		if bloom.mayContainHash(h1, h2) {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
@@ -0,0 +1,194 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilter_FalsePositiveRate(t *testing.T) {
+	const (
+		numKeys   = 10_000
+		numProbes = 200_000
+	)
+
+	for _, rate := range []float64{0.05, 0.01, 0.001} {
+		t.Run(fmt.Sprintf("%g", rate), func(t *testing.T) {
+			bloom := newBloomFilter(numKeys, rate)
+			for i := 0; i < numKeys; i++ {
+				bloom.addHash(bloomHash([]byte(fmt.Sprintf("key-%d", i))))
+			}
+
+			for i := 0; i < numKeys; i++ {
+				require.True(t, bloom.MayContain([]byte(fmt.Sprintf("key-%d", i))))
+			}
+
+			var falsePositives int
+			for i := 0; i < numProbes; i++ {
+				if bloom.MayContain([]byte(fmt.Sprintf("absent-%d", i))) {
+					falsePositives++
+				}
+			}
+
+			measured := float64(falsePositives) / numProbes
+			t.Logf("target: %g, measured: %g, bits: %d, hashes: %d", rate, measured, bloom.m, bloom.k)
+			require.LessOrEqual(t, measured, rate*1.5)
+		})
+	}
+}
+
+func TestBloomFilter_Marshal(t *testing.T) {
+	bloom := newBloomFilter(100, 0.01)
+	for i := 0; i < 100; i++ {
+		bloom.addHash(bloomHash([]byte{byte(i)}))
+	}
+
+	data, err := bloom.MarshalBinary()
+	require.NoError(t, err)
+
+	var decoded bloomFilter
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	require.Equal(t, *bloom, decoded)
+
+	require.ErrorIs(t, decoded.UnmarshalBinary(data[:10]), ErrBloomFilterInvalid)
+	require.ErrorIs(t, decoded.UnmarshalBinary(data[:len(data)-1]), ErrBloomFilterInvalid)
+
+	future := append([]byte(nil), data...)
+	future[4] = bloomFilterVersion + 1
+	require.ErrorIs(t, decoded.UnmarshalBinary(future), ErrBloomFilterVersionUnsupported)
+}
+
+func TestProbeFiles(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	const (
+		numBlocks     = 1000
+		blocksPerFile = 50
+		keysPerBlock  = 20
+		rate          = 0.01
+	)
+
+	blockKey := func(blockNum uint64, i int) []byte {
+		return []byte(fmt.Sprintf("address-%d-%d", blockNum, i))
+	}
+
+	opt := Options{
+		Dataset:                Dataset{Path: testPath},
+		FileRollPolicy:         NewLastBlockNumberRollPolicy(blocksPerFile),
+		FileRollOnClose:        true,
+		BloomFalsePositiveRate: rate,
+	}
+
+	// the first file is written without the bloom filter
+	w, err := NewWriter[[]string](opt)
+	require.NoError(t, err)
+
+	for i := uint64(1); i <= numBlocks; i++ {
+		if i == blocksPerFile+1 {
+			require.NoError(t, w.Close(context.Background()))
+
+			opt.BloomKeys = BloomKeysFunc[[]string](func(b Block[[]string]) [][]byte {
+				keys := make([][]byte, 0, len(b.Data))
+				for _, key := range b.Data {
+					keys = append(keys, []byte(key))
+				}
+				return keys
+			})
+
+			w, err = NewWriter[[]string](opt)
+			require.NoError(t, err)
+		}
+
+		data := make([]string, keysPerBlock)
+		for j := range data {
+			data[j] = string(blockKey(i, j))
+		}
+		require.NoError(t, w.Write(context.Background(), Block[[]string]{Number: i, Data: data}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	numFiles := numBlocks / blocksPerFile
+
+	t.Run("present", func(t *testing.T) {
+		for _, blockNum := range []uint64{1, 51, 555, 1000} {
+			files, err := ProbeFiles(context.Background(), opt, blockKey(blockNum, 7))
+			require.NoError(t, err)
+
+			var found bool
+			for _, file := range files {
+				if file.FirstBlockNum <= blockNum && blockNum <= file.LastBlockNum {
+					found = true
+				}
+			}
+			require.True(t, found, blockNum)
+
+			// the file without the bloom filter is always probed
+			require.Equal(t, uint64(1), files[0].FirstBlockNum)
+			require.False(t, files[0].Bloom)
+		}
+	})
+
+	t.Run("false_positive_rate", func(t *testing.T) {
+		const numProbes = 2000
+
+		var falsePositives int
+		for i := 0; i < numProbes; i++ {
+			files, err := ProbeFiles(context.Background(), opt, []byte(fmt.Sprintf("absent-%d", i)))
+			require.NoError(t, err)
+			require.NotEmpty(t, files)
+
+			// the file without the bloom filter
+			falsePositives += len(files) - 1
+		}
+
+		measured := float64(falsePositives) / float64(numProbes*(numFiles-1))
+		t.Logf("target: %g, measured: %g", rate, measured)
+		require.LessOrEqual(t, measured, rate*2)
+	})
+
+	t.Run("missing_filter", func(t *testing.T) {
+		files, err := ProbeFiles(context.Background(), opt, blockKey(555, 0))
+		require.NoError(t, err)
+
+		file := files[len(files)-1]
+		require.True(t, file.Bloom)
+		require.NoError(t, os.Remove(testPath+"/"+file.BloomPath()))
+
+		files, err = ProbeFiles(context.Background(), opt, []byte("absent"))
+		require.NoError(t, err)
+		require.Contains(t, fileRanges(files), [2]uint64{file.FirstBlockNum, file.LastBlockNum})
+	})
+
+	t.Run("reader", func(t *testing.T) {
+		r, err := NewReader[[]string](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		for i := uint64(1); i <= numBlocks; i++ {
+			b, err := r.Read(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, i, b.Number)
+		}
+		_, err = r.Read(context.Background())
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("type_mismatch", func(t *testing.T) {
+		_, err := NewWriter[[]int](opt)
+		require.Error(t, err)
+	})
+}
+
+func fileRanges(files []*File) [][2]uint64 {
+	ranges := make([][2]uint64, 0, len(files))
+	for _, file := range files {
+		ranges = append(ranges, [2]uint64{file.FirstBlockNum, file.LastBlockNum})
+	}
+	return ranges
+}
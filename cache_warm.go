@@ -0,0 +1,189 @@
+package ethwal
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/c2h5oh/datasize"
+)
+
+const defaultWarmWorkers = 4
+
+var (
+	ErrCacheNotConfigured = fmt.Errorf("dataset cache is not configured")
+)
+
+// WarmOptions are the options of WarmCache.
+type WarmOptions struct {
+	// Workers is the number of files downloaded concurrently. Defaults to 4.
+	Workers int
+	// MaxBytes is the maximal number of bytes downloaded, the files that would exceed it are not
+	// downloaded. Zero means unlimited.
+	MaxBytes datasize.ByteSize
+}
+
+// WarmReport summarizes the files of the warmed block range.
+type WarmReport struct {
+	FilesDownloaded int
+	BytesDownloaded uint64
+
+	// FilesSkipped are the files that were already cached.
+	FilesSkipped int
+	BytesSkipped uint64
+
+	// FilesOverBudget are the files that were not downloaded because of WarmOptions.MaxBytes.
+	FilesOverBudget int
+	BytesOverBudget uint64
+
+	FilesFailed int
+	BytesFailed uint64
+}
+
+// WarmCache downloads the files of the block range [from, to] to the cache at Dataset.CachePath, through
+// the same cache the reader uses. The files that are already cached with the same size are skipped, so
+// the interrupted warm-up can be resumed by running it again. The failed files are reported and their
+// errors are returned after all other files are processed.
+func WarmCache(ctx context.Context, opt Options, from, to uint64, warmOpt WarmOptions) (WarmReport, error) {
+	opt = opt.WithDefaults()
+	if opt.Dataset.CachePath == "" {
+		return WarmReport{}, ErrCacheNotConfigured
+	}
+	if isLocalFS(opt.FileSystem) {
+		return WarmReport{}, fmt.Errorf("%w: local file system is not cached", ErrCacheNotConfigured)
+	}
+
+	origin := newReplicaFS(opt)
+	cached, cache, err := newCacheFS(opt, origin)
+	if err != nil {
+		return WarmReport{}, err
+	}
+
+	datasetPath := opt.Dataset.FullPath()
+	originFs := storage.NewPrefixWrapper(origin, datasetPath)
+	cacheFs := storage.NewPrefixWrapper(cache, datasetPath)
+	cachedFs := storage.NewPrefixWrapper(cached, datasetPath)
+
+	// the file index is read from the origin, so that the latest files are warmed
+	fileIndex := NewFileIndex(originFs)
+	err = fileIndex.Load(ctx)
+	if err != nil {
+		return WarmReport{}, fmt.Errorf("failed to load file index: %w", err)
+	}
+
+	var files []*File
+	for _, file := range fileIndex.Files() {
+		if file.LastBlockNum >= from && file.FirstBlockNum <= to {
+			files = append(files, file)
+		}
+	}
+
+	var (
+		report   WarmReport
+		reserved uint64
+		errs     []error
+		mu       sync.Mutex
+	)
+
+	warmFile := func(file *File) {
+		size, err := file.Size(ctx, originFs)
+		if err != nil {
+			mu.Lock()
+			report.FilesFailed++
+			errs = append(errs, fmt.Errorf("file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err))
+			mu.Unlock()
+			return
+		}
+
+		// the cached file with different size is a partial or stale copy
+		cachedSize, err := file.Size(ctx, cacheFs)
+		stale := err == nil
+		if stale && cachedSize == size {
+			mu.Lock()
+			report.FilesSkipped++
+			report.BytesSkipped += uint64(size)
+			mu.Unlock()
+			return
+		}
+
+		mu.Lock()
+		if warmOpt.MaxBytes > 0 && reserved+uint64(size) > uint64(warmOpt.MaxBytes) {
+			report.FilesOverBudget++
+			report.BytesOverBudget += uint64(size)
+			mu.Unlock()
+			return
+		}
+		reserved += uint64(size)
+		mu.Unlock()
+
+		err = warmCacheFile(ctx, cacheFs, cachedFs, file, stale)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			reserved -= uint64(size)
+			report.FilesFailed++
+			report.BytesFailed += uint64(size)
+			errs = append(errs, fmt.Errorf("file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err))
+			return
+		}
+		report.FilesDownloaded++
+		report.BytesDownloaded += uint64(size)
+	}
+
+	filesChan := make(chan *File)
+	var wg sync.WaitGroup
+	for i := 0; i < cmp.Or(warmOpt.Workers, defaultWarmWorkers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range filesChan {
+				warmFile(file)
+			}
+		}()
+	}
+
+feed:
+	for _, file := range files {
+		select {
+		case filesChan <- file:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(filesChan)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return report, ctx.Err()
+	}
+	return report, errors.Join(errs...)
+}
+
+// warmCacheFile downloads the file to the cache, the stale cached copy is removed first.
+func warmCacheFile(ctx context.Context, cacheFs, cachedFs storage.FS, file *File, stale bool) error {
+	if stale {
+		for _, filePath := range []string{file.Path(), file.legacyPath()} {
+			err := cacheFs.Delete(ctx, filePath)
+			if err != nil && !storage.IsNotExist(err) {
+				return fmt.Errorf("failed to remove stale cached file: %w", err)
+			}
+		}
+	}
+
+	rdr, err := file.Open(ctx, cachedFs)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(io.Discard, rdr)
+	if err != nil {
+		_ = rdr.Close()
+		return err
+	}
+	return rdr.Close()
+}
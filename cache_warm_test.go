@@ -0,0 +1,144 @@
+package ethwal
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/c2h5oh/datasize"
+	"github.com/stretchr/testify/require"
+)
+
+// openRecordingFS records the paths opened on the file system.
+type openRecordingFS struct {
+	storage.FS
+
+	mu     sync.Mutex
+	opened map[string]int
+}
+
+func (o *openRecordingFS) Open(ctx context.Context, path string, options *gostorage.ReaderOptions) (*gostorage.File, error) {
+	o.mu.Lock()
+	o.opened[path]++
+	o.mu.Unlock()
+	return o.FS.Open(ctx, path, options)
+}
+
+func (o *openRecordingFS) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.opened = make(map[string]int)
+}
+
+func TestWarmCache(t *testing.T) {
+	origin := &openRecordingFS{FS: gostorage.NewMemoryFS(), opened: make(map[string]int)}
+	opt := Options{
+		Dataset:         Dataset{Path: "ethwal", CachePath: t.TempDir()},
+		FileSystem:      origin,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+
+	w, err := NewWriter[[]int](opt)
+	require.NoError(t, err)
+	for _, b := range generateMixedIntBlocks() {
+		require.NoError(t, w.Write(context.Background(), b))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	fileIndex := NewFileIndex(storage.NewPrefixWrapper(origin, opt.Dataset.FullPath()))
+	require.NoError(t, fileIndex.Load(context.Background()))
+
+	// opened returns the number of origin opens of the files in the block range
+	opened := func(from, to uint64) int {
+		origin.mu.Lock()
+		defer origin.mu.Unlock()
+
+		var n int
+		for _, file := range fileIndex.Files() {
+			if file.LastBlockNum >= from && file.FirstBlockNum <= to {
+				n += origin.opened[path.Join(opt.Dataset.FullPath(), file.Path())]
+			}
+		}
+		return n
+	}
+
+	t.Run("not_configured", func(t *testing.T) {
+		noCacheOpt := opt
+		noCacheOpt.Dataset.CachePath = ""
+
+		_, err := WarmCache(context.Background(), noCacheOpt, 1, 70, WarmOptions{})
+		require.ErrorIs(t, err, ErrCacheNotConfigured)
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		budgetOpt := opt
+		budgetOpt.Dataset.CachePath = t.TempDir()
+
+		size, err := fileIndex.At(0).Size(context.Background(), storage.NewPrefixWrapper(origin, opt.Dataset.FullPath()))
+		require.NoError(t, err)
+
+		report, err := WarmCache(context.Background(), budgetOpt, 1, 20, WarmOptions{Workers: 1, MaxBytes: datasize.ByteSize(size)})
+		require.NoError(t, err)
+		require.Equal(t, 1, report.FilesDownloaded)
+		require.Equal(t, uint64(size), report.BytesDownloaded)
+		require.Equal(t, 1, report.FilesOverBudget)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		cancelOpt := opt
+		cancelOpt.Dataset.CachePath = t.TempDir()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := WarmCache(ctx, cancelOpt, 1, 70, WarmOptions{})
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	report, err := WarmCache(context.Background(), opt, 25, 55, WarmOptions{Workers: 2})
+	require.NoError(t, err)
+	require.Equal(t, 4, report.FilesDownloaded)
+	require.NotZero(t, report.BytesDownloaded)
+	require.Zero(t, report.FilesSkipped)
+	require.Zero(t, report.FilesFailed)
+
+	t.Run("resume", func(t *testing.T) {
+		// the partially downloaded file is downloaded again
+		cachedPath := path.Join(opt.Dataset.CachePath, opt.Dataset.FullPath(), fileIndex.At(2).Path())
+		require.NoError(t, os.Truncate(cachedPath, 3))
+
+		resumed, err := WarmCache(context.Background(), opt, 25, 55, WarmOptions{})
+		require.NoError(t, err)
+		require.Equal(t, 1, resumed.FilesDownloaded)
+		require.Equal(t, 3, resumed.FilesSkipped)
+		require.Equal(t, report.BytesDownloaded, resumed.BytesDownloaded+resumed.BytesSkipped)
+	})
+
+	t.Run("read", func(t *testing.T) {
+		origin.reset()
+
+		r, err := NewReader[[]int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		require.NoError(t, r.Seek(context.Background(), 21))
+		for i := uint64(21); i <= 60; i++ {
+			b, err := r.Read(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, i, b.Number)
+		}
+		require.Zero(t, opened(21, 60))
+
+		// the files out of the warmed range are read from the origin
+		for i := uint64(61); i <= 70; i++ {
+			_, err := r.Read(context.Background())
+			require.NoError(t, err)
+		}
+		require.NotZero(t, opened(61, 70))
+	})
+}
@@ -0,0 +1,448 @@
+package ethwal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+// ChangelogDirectory is the directory of the changefeed of the dataset, see Options.EnableChangefeed.
+const ChangelogDirectory = ".changelog"
+
+// changelogHeadFilePath is the path of the changelog head hint in the dataset directory.
+const changelogHeadFilePath = ChangelogDirectory + "/.head"
+
+// maxChangelogAppendAttempts is the number of times the batch is appended while other producers append theirs.
+const maxChangelogAppendAttempts = 16
+
+var ErrChangelogPruned = fmt.Errorf("changelog pruned")
+
+// ChangeEventType is the type of the dataset mutation described by ChangeEvent.
+type ChangeEventType string
+
+const (
+	// ChangeFileAdded is the file added to the file index, by the writer roll or BackfillGaps.
+	ChangeFileAdded ChangeEventType = "fileAdded"
+	// ChangeFileReplaced is the file rewritten in place, by BackfillGaps or RepairTimestamps, the event carries
+	// its updated file index entry.
+	ChangeFileReplaced ChangeEventType = "fileReplaced"
+	// ChangeFileFlushed is the current file written by Writer.Flush before its roll, the file index entry with
+	// the same first block of the next flush or of the roll, published as ChangeFileAdded, supersedes it.
+	ChangeFileFlushed ChangeEventType = "fileFlushed"
+	// ChangeFilePruned is the file deleted by the writer retention policy, see Options.RetentionPolicy.
+	ChangeFilePruned ChangeEventType = "filePruned"
+	// ChangeFileRemoved is the file deleted by Writer.Rollback, the file of the kept blocks of the file
+	// containing the rollback block is added.
+	ChangeFileRemoved ChangeEventType = "fileRemoved"
+	// ChangeIndexAdvanced is the index flushed up to BlockNum.
+	ChangeIndexAdvanced ChangeEventType = "indexAdvanced"
+	// ChangeIndexSealed is the index sealed below BlockNum, see SealIndexes.
+	ChangeIndexSealed ChangeEventType = "indexSealed"
+	// ChangeIndexPruned is the index pruned below BlockNum, see PruneIndexes.
+	ChangeIndexPruned ChangeEventType = "indexPruned"
+)
+
+// ChangeEvent is the record of the dataset mutation in the changefeed. It's appended after the mutation is
+// durable.
+type ChangeEvent struct {
+	// Seq is the sequence number of the event, the events of the dataset are numbered from 0 without gaps.
+	Seq  uint64          `json:"seq"`
+	Type ChangeEventType `json:"type"`
+	// File is the file index entry of the file events.
+	File *File `json:"file,omitempty"`
+	// Index is the index of the index events.
+	Index IndexName `json:"index,omitempty"`
+	// BlockNum is the block number of the index events.
+	BlockNum uint64 `json:"blockNum,omitempty"`
+}
+
+// changelogBatch is the object of the events appended together, stored at the sequence number of the first.
+type changelogBatch struct {
+	Events []ChangeEvent `json:"events"`
+}
+
+// changelogHead is the hint of the state of the changelog, the batches appended after it was stored are
+// found at its next sequence number.
+type changelogHead struct {
+	NextSeq uint64 `json:"nextSeq"`
+	// FirstSeq is the retention floor, the events below it are pruned.
+	FirstSeq uint64 `json:"firstSeq,omitempty"`
+	// LastFileBlockNum is the last block number of the added files, the files of the file index after it are
+	// added to the changelog when the writer starts.
+	LastFileBlockNum uint64 `json:"lastFileBlockNum,omitempty"`
+}
+
+func (h *changelogHead) apply(events []ChangeEvent) {
+	for _, event := range events {
+		h.NextSeq = max(h.NextSeq, event.Seq+1)
+		if event.Type == ChangeFileAdded && event.File != nil {
+			h.LastFileBlockNum = max(h.LastFileBlockNum, event.File.LastBlockNum)
+		}
+	}
+}
+
+func (h *changelogHead) merge(other changelogHead) {
+	h.NextSeq = max(h.NextSeq, other.NextSeq)
+	h.FirstSeq = max(h.FirstSeq, other.FirstSeq)
+	h.LastFileBlockNum = max(h.LastFileBlockNum, other.LastFileBlockNum)
+}
+
+func changelogBatchPath(seq uint64) string {
+	return path.Join(ChangelogDirectory, fmt.Sprintf("%020d", seq))
+}
+
+// changelog appends the events of the producer to the changelog of the dataset. The events that failed to
+// append are kept and appended before the next ones, so that the events of the producer stay in order.
+type changelog struct {
+	// fs is the file system of the dataset directory
+	fs storage.FS
+
+	mu      sync.Mutex
+	pending []ChangeEvent
+}
+
+func newChangelog(fs storage.FS) *changelog {
+	return &changelog{fs: fs}
+}
+
+// publish appends the pending events and the events.
+func (c *changelog) publish(ctx context.Context, events ...ChangeEvent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending = append(c.pending, events...)
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	err := appendChangelog(ctx, c.fs, c.pending)
+	if err != nil {
+		return fmt.Errorf("failed to append changelog: %w", err)
+	}
+	c.pending = nil
+	return nil
+}
+
+// recoverFiles publishes the files of the file index added after the last added file of the changelog,
+// whose events were lost by the crash of the writer after the file index was saved.
+func (c *changelog) recoverFiles(ctx context.Context, files []*File) error {
+	head, err := readChangelogHead(ctx, c.fs)
+	if err != nil {
+		return err
+	}
+	err = catchUpChangelog(ctx, c.fs, &head)
+	if err != nil {
+		return err
+	}
+
+	var events []ChangeEvent
+	for _, file := range files {
+		if file.LastBlockNum > head.LastFileBlockNum {
+			events = append(events, ChangeEvent{Type: ChangeFileAdded, File: file.clone()})
+		}
+	}
+	return c.publish(ctx, events...)
+}
+
+// appendChangelog appends the events as one batch, they're numbered from the next sequence number of the
+// changelog. The batch is created only if no other batch is stored at its sequence number, otherwise the
+// head is advanced past the other batch and the append is retried.
+func appendChangelog(ctx context.Context, fs storage.FS, events []ChangeEvent) error {
+	head, err := readChangelogHead(ctx, fs)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < maxChangelogAppendAttempts; attempt++ {
+		err = catchUpChangelog(ctx, fs, &head)
+		if err != nil {
+			return err
+		}
+
+		for i := range events {
+			events[i].Seq = head.NextSeq + uint64(i)
+		}
+		data, err := json.Marshal(changelogBatch{Events: events})
+		if err != nil {
+			return fmt.Errorf("failed to encode changelog batch: %w", err)
+		}
+
+		err = storage.CreateIfNotExist(ctx, fs, changelogBatchPath(head.NextSeq), data)
+		if errors.Is(err, storage.ErrPreconditionFailed) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write changelog batch: %w", err)
+		}
+
+		// the head is a hint, the batch is found by the next append even if the head isn't stored
+		head.apply(events)
+		return storeChangelogHead(ctx, fs, head)
+	}
+	return fmt.Errorf("%w: changelog appended by other producers %d times", storage.ErrPreconditionFailed, maxChangelogAppendAttempts)
+}
+
+// catchUpChangelog advances the head past the batches stored after it.
+func catchUpChangelog(ctx context.Context, fs storage.FS, head *changelogHead) error {
+	for {
+		events, err := readChangelogBatch(ctx, fs, head.NextSeq)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		head.apply(events)
+	}
+}
+
+func readChangelogHead(ctx context.Context, fs storage.FS) (changelogHead, error) {
+	file, err := fs.Open(ctx, changelogHeadFilePath, nil)
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return changelogHead{}, nil
+		}
+		return changelogHead{}, fmt.Errorf("failed to open changelog head: %w", err)
+	}
+	defer file.Close()
+
+	var head changelogHead
+	err = json.NewDecoder(file).Decode(&head)
+	if err != nil {
+		return changelogHead{}, fmt.Errorf("failed to decode changelog head: %w", err)
+	}
+	return head, nil
+}
+
+// storeChangelogHead merges the head into the stored head, so that it only moves forward.
+func storeChangelogHead(ctx context.Context, fs storage.FS, head changelogHead) error {
+	err := storage.Update(ctx, fs, changelogHeadFilePath, func(data []byte) ([]byte, error) {
+		merged := head
+		if len(data) > 0 {
+			var stored changelogHead
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return nil, fmt.Errorf("failed to decode changelog head: %w", err)
+			}
+			merged.merge(stored)
+			if merged == stored {
+				return nil, nil
+			}
+		}
+		return json.Marshal(merged)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store changelog head: %w", err)
+	}
+	return nil
+}
+
+// readChangelogBatch returns the events of the batch stored at the sequence number, nil if there is none.
+func readChangelogBatch(ctx context.Context, fs storage.FS, seq uint64) ([]ChangeEvent, error) {
+	file, err := fs.Open(ctx, changelogBatchPath(seq), nil)
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open changelog batch %d: %w", seq, err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read changelog batch %d: %w", seq, err)
+	}
+
+	var batch changelogBatch
+	err = json.Unmarshal(data, &batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode changelog batch %d: %w", seq, err)
+	}
+	for i, event := range batch.Events {
+		if event.Seq != seq+uint64(i) {
+			return nil, fmt.Errorf("changelog batch %d: event %d has sequence number %d", seq, i, event.Seq)
+		}
+	}
+	return batch.Events, nil
+}
+
+// listChangelogBatches returns the sorted sequence numbers of the stored batches.
+func listChangelogBatches(ctx context.Context, fs storage.FS) ([]uint64, error) {
+	var seqs []uint64
+	err := fs.Walk(ctx, ChangelogDirectory+"/", func(objectPath string) error {
+		seq, err := strconv.ParseUint(path.Base(objectPath), 10, 64)
+		if err != nil {
+			// not a batch
+			return nil
+		}
+		seqs = append(seqs, seq)
+		return nil
+	})
+	if err != nil && !storage.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list changelog: %w", err)
+	}
+	slices.Sort(seqs)
+	return seqs, nil
+}
+
+// PruneChangelog deletes the batches of the changelog whose events are all below beforeSeq and records the
+// retention floor, the readers behind it fail with ErrChangelogPruned. The batch with the events on both
+// sides of beforeSeq is kept.
+func PruneChangelog(ctx context.Context, opt Options, beforeSeq uint64) error {
+	opt = opt.WithDefaults()
+	fs := opt.withObjectClass(storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()), ObjectClassMeta)
+
+	head, err := readChangelogHead(ctx, fs)
+	if err != nil {
+		return fmt.Errorf("PruneChangelog: %w", err)
+	}
+	err = catchUpChangelog(ctx, fs, &head)
+	if err != nil {
+		return fmt.Errorf("PruneChangelog: %w", err)
+	}
+
+	seqs, err := listChangelogBatches(ctx, fs)
+	if err != nil {
+		return fmt.Errorf("PruneChangelog: %w", err)
+	}
+
+	// the batch ends where the next one starts
+	var pruned []uint64
+	firstSeq := head.NextSeq
+	for i, seq := range seqs {
+		end := head.NextSeq
+		if i+1 < len(seqs) {
+			end = seqs[i+1]
+		}
+		if end > beforeSeq {
+			firstSeq = seq
+			break
+		}
+		pruned = append(pruned, seq)
+	}
+	if firstSeq <= head.FirstSeq {
+		return nil
+	}
+
+	// the floor is recorded first, so that the readers don't mistake the deleted batches for the end
+	head.FirstSeq = firstSeq
+	err = storeChangelogHead(ctx, fs, head)
+	if err != nil {
+		return fmt.Errorf("PruneChangelog: %w", err)
+	}
+
+	for _, seq := range pruned {
+		err = fs.Delete(ctx, changelogBatchPath(seq))
+		if err != nil && !storage.IsNotExist(err) {
+			return fmt.Errorf("PruneChangelog: failed to delete changelog batch %d: %w", seq, err)
+		}
+	}
+	return nil
+}
+
+// ChangefeedReader reads the events of the changelog of the dataset in order from the cursor, so that the
+// external systems can mirror the dataset without listing it.
+type ChangefeedReader struct {
+	fs storage.FS
+
+	cursor uint64
+	// batchSeq is the sequence number of the batch with the cursor, valid once located
+	batchSeq uint64
+	located  bool
+}
+
+// NewChangefeedReader returns the reader of the changelog of the dataset from the sequence number of the
+// next event to read, 0 reads the changelog from the start.
+func NewChangefeedReader(opt Options, cursor uint64) (*ChangefeedReader, error) {
+	opt = opt.WithDefaults()
+	if opt.Dataset.Path == "" {
+		return nil, fmt.Errorf("path cannot be empty")
+	}
+
+	fs := opt.withObjectClass(storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()), ObjectClassMeta)
+	return &ChangefeedReader{fs: fs, cursor: cursor}, nil
+}
+
+// Cursor returns the sequence number of the next event, the consumer stores it to resume the reader.
+func (r *ChangefeedReader) Cursor() uint64 {
+	return r.cursor
+}
+
+// Poll returns the events appended since the last poll in order, none if there are no new events. It fails
+// with ErrChangelogPruned if the events at the cursor were pruned, the consumer has to resync the dataset.
+func (r *ChangefeedReader) Poll(ctx context.Context) ([]ChangeEvent, error) {
+	if !r.located {
+		err := r.locate(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var result []ChangeEvent
+	for {
+		events, err := readChangelogBatch(ctx, r.fs, r.batchSeq)
+		if err != nil {
+			return nil, err
+		}
+		if len(events) == 0 {
+			break
+		}
+
+		for _, event := range events {
+			if event.Seq >= r.cursor {
+				result = append(result, event)
+			}
+		}
+		r.cursor = max(r.cursor, events[len(events)-1].Seq+1)
+		r.batchSeq = events[len(events)-1].Seq + 1
+	}
+
+	if len(result) == 0 {
+		err := r.checkPruned(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// locate finds the batch with the cursor.
+func (r *ChangefeedReader) locate(ctx context.Context) error {
+	err := r.checkPruned(ctx)
+	if err != nil {
+		return err
+	}
+
+	seqs, err := listChangelogBatches(ctx, r.fs)
+	if err != nil {
+		return err
+	}
+
+	// the last batch starting at or before the cursor, the batch at the cursor if no batch is stored yet
+	r.batchSeq = r.cursor
+	if i, found := slices.BinarySearch(seqs, r.cursor); found {
+		r.batchSeq = seqs[i]
+	} else if i > 0 {
+		r.batchSeq = seqs[i-1]
+	}
+	r.located = true
+	return nil
+}
+
+func (r *ChangefeedReader) checkPruned(ctx context.Context) error {
+	head, err := readChangelogHead(ctx, r.fs)
+	if err != nil {
+		return err
+	}
+	if r.cursor < head.FirstSeq {
+		return fmt.Errorf("%w: cursor %d is below %d", ErrChangelogPruned, r.cursor, head.FirstSeq)
+	}
+	return nil
+}
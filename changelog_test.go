@@ -0,0 +1,247 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/local"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+// changefeedMirror is the state of the dataset reconstructed by the consumer of the changefeed.
+type changefeedMirror struct {
+	files   map[uint64]*File
+	indexes map[IndexName]uint64
+	sealed  map[IndexName]uint64
+	pruned  map[IndexName]uint64
+	seqs    []uint64
+}
+
+func newChangefeedMirror() *changefeedMirror {
+	return &changefeedMirror{
+		files:   make(map[uint64]*File),
+		indexes: make(map[IndexName]uint64),
+		sealed:  make(map[IndexName]uint64),
+		pruned:  make(map[IndexName]uint64),
+	}
+}
+
+func (m *changefeedMirror) poll(t *testing.T, r *ChangefeedReader) {
+	events, err := r.Poll(context.Background())
+	require.NoError(t, err)
+
+	for _, event := range events {
+		m.seqs = append(m.seqs, event.Seq)
+		switch event.Type {
+		case ChangeFileAdded:
+			require.NotContains(t, m.files, event.File.FirstBlockNum)
+			m.files[event.File.FirstBlockNum] = event.File
+		case ChangeFileReplaced:
+			require.Contains(t, m.files, event.File.FirstBlockNum)
+			m.files[event.File.FirstBlockNum] = event.File
+		case ChangeIndexAdvanced:
+			m.indexes[event.Index] = max(m.indexes[event.Index], event.BlockNum)
+		case ChangeIndexSealed:
+			m.sealed[event.Index] = event.BlockNum
+		case ChangeIndexPruned:
+			m.pruned[event.Index] = event.BlockNum
+		default:
+			t.Fatalf("unexpected event %s", event.Type)
+		}
+	}
+}
+
+func TestChangefeed(t *testing.T) {
+	fs := gostorage.NewMemoryFS()
+	opt := Options{
+		Dataset:          Dataset{Path: "ethwal"},
+		FileSystem:       fs,
+		FileRollPolicy:   NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose:  true,
+		BlockDigest:      CanonicalBlockDigest[[]int],
+		EnableChangefeed: true,
+	}
+	indexerOpt := IndexerOptions[[]int]{
+		Dataset:          opt.Dataset,
+		FileSystem:       fs,
+		Indexes:          generateMixedIntIndexes(),
+		EnableChangefeed: true,
+	}
+
+	block := func(blockNum uint64) Block[[]int] {
+		return Block[[]int]{Number: blockNum, TS: 1000 + blockNum, Data: []int{int(blockNum)}}
+	}
+
+	// write writes the blocks except the skipped ones
+	write := func(t *testing.T, opt Options, from, to uint64, skip func(blockNum uint64) bool) {
+		indexer, err := NewIndexer(context.Background(), indexerOpt)
+		require.NoError(t, err)
+
+		w, err := NewWriter[[]int](opt)
+		require.NoError(t, err)
+
+		wi, err := NewWriterWithIndexer(w, indexer)
+		require.NoError(t, err)
+		for blockNum := from; blockNum <= to; blockNum++ {
+			if skip == nil || !skip(blockNum) {
+				require.NoError(t, wi.Write(context.Background(), block(blockNum)))
+			}
+		}
+		require.NoError(t, wi.Close(context.Background()))
+	}
+
+	r, err := NewChangefeedReader(opt, 0)
+	require.NoError(t, err)
+	mirror := newChangefeedMirror()
+
+	// nothing appended yet
+	mirror.poll(t, r)
+	require.Empty(t, mirror.seqs)
+
+	write(t, opt, 1, 30, func(blockNum uint64) bool {
+		return blockNum >= 14 && blockNum <= 16
+	})
+	mirror.poll(t, r)
+	require.Len(t, mirror.files, 3)
+
+	// the writer crashed after the file index was saved, its events are appended by the next writer
+	noChangefeed := opt
+	noChangefeed.EnableChangefeed = false
+	write(t, noChangefeed, 31, 45, nil)
+	mirror.poll(t, r)
+	require.Len(t, mirror.files, 3)
+
+	write(t, opt, 46, 50, nil)
+	mirror.poll(t, r)
+	require.Len(t, mirror.files, 6)
+
+	// the backfilled file is replaced
+	err = BackfillGaps(context.Background(), opt, []BlockRange{{From: 14, To: 16}}, func(ctx context.Context, blockNum uint64) (Block[[]int], error) {
+		return block(blockNum), nil
+	}, BackfillOptions[[]int]{})
+	require.NoError(t, err)
+
+	require.NoError(t, SealIndexes(context.Background(), indexerOpt, 21))
+	require.NoError(t, PruneIndexes(context.Background(), indexerOpt, 11))
+	mirror.poll(t, r)
+
+	// the mirror matches the dataset
+	fileIndex := NewFileIndex(storage.NewPrefixWrapper(fs, opt.Dataset.FullPath()))
+	require.NoError(t, fileIndex.Load(context.Background()))
+	require.Len(t, mirror.files, len(fileIndex.Files()))
+	for _, file := range fileIndex.Files() {
+		require.Equal(t, file.clone(), mirror.files[file.FirstBlockNum].clone())
+	}
+
+	indexFs := storage.NewPrefixWrapper(fs, path.Join(opt.Dataset.FullPath(), IndexesDirectory)+"/")
+	for name, index := range indexerOpt.Indexes {
+		blockNum, err := index.LastBlockNumIndexed(context.Background(), indexFs)
+		require.NoError(t, err)
+		require.Equal(t, uint64(50), blockNum)
+		require.Equal(t, blockNum, mirror.indexes[name], name)
+		require.Equal(t, uint64(21), mirror.sealed[name], name)
+		require.Equal(t, uint64(11), mirror.pruned[name], name)
+	}
+
+	// the sequence numbers have no gaps
+	for i, seq := range mirror.seqs {
+		require.Equal(t, uint64(i), seq)
+	}
+	require.Equal(t, uint64(len(mirror.seqs)), r.Cursor())
+
+	// the reader resumed from the cursor gets only the new events
+	resumed, err := NewChangefeedReader(opt, r.Cursor()-2)
+	require.NoError(t, err)
+	events, err := resumed.Poll(context.Background())
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, r.Cursor()-2, events[0].Seq)
+}
+
+func TestPruneChangelog(t *testing.T) {
+	opt := Options{Dataset: Dataset{Path: "ethwal"}, FileSystem: gostorage.NewMemoryFS()}
+	fs := storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath())
+
+	// the batches 0-1, 2-4 and 5
+	for _, size := range []int{2, 3, 1} {
+		require.NoError(t, appendChangelog(context.Background(), fs, make([]ChangeEvent, size)))
+	}
+
+	r, err := NewChangefeedReader(opt, 3)
+	require.NoError(t, err)
+	events, err := r.Poll(context.Background())
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	// the batch with the events on both sides of the floor is kept
+	require.NoError(t, PruneChangelog(context.Background(), opt, 3))
+	seqs, err := listChangelogBatches(context.Background(), fs)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 5}, seqs)
+
+	behind, err := NewChangefeedReader(opt, 1)
+	require.NoError(t, err)
+	_, err = behind.Poll(context.Background())
+	require.ErrorIs(t, err, ErrChangelogPruned)
+
+	kept, err := NewChangefeedReader(opt, 2)
+	require.NoError(t, err)
+	events, err = kept.Poll(context.Background())
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+
+	// the sequence continues after the pruned batches
+	require.NoError(t, PruneChangelog(context.Background(), opt, 6))
+	require.NoError(t, appendChangelog(context.Background(), fs, make([]ChangeEvent, 1)))
+	events, err = r.Poll(context.Background())
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, uint64(6), events[0].Seq)
+}
+
+func TestAppendChangelog_Concurrent(t *testing.T) {
+	dir := t.TempDir()
+	fs := storage.NewPrefixWrapper(local.NewLocalFS(dir), "ethwal/")
+
+	const (
+		producers = 4
+		appends   = 10
+	)
+
+	var wg sync.WaitGroup
+	errs := make([]error, producers)
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < appends && errs[p] == nil; i++ {
+				errs[p] = appendChangelog(context.Background(), fs, []ChangeEvent{
+					{Type: ChangeIndexAdvanced, Index: IndexName(fmt.Sprintf("producer-%d", p)), BlockNum: uint64(i)},
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	r, err := NewChangefeedReader(Options{Dataset: Dataset{Path: "ethwal"}, FileSystem: local.NewLocalFS(dir)}, 0)
+	require.NoError(t, err)
+	events, err := r.Poll(context.Background())
+	require.NoError(t, err)
+	require.Len(t, events, producers*appends)
+
+	// the events of each producer are in order
+	next := make(map[IndexName]uint64)
+	for i, event := range events {
+		require.Equal(t, uint64(i), event.Seq)
+		require.Equal(t, next[event.Index], event.BlockNum)
+		next[event.Index]++
+	}
+}
@@ -0,0 +1,61 @@
+package ethwal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+)
+
+var ErrChecksumMismatch = fmt.Errorf("file checksum mismatch")
+
+// recordChecksum records the size and the sha-256 checksum of the compressed file contents.
+func (f *File) recordChecksum(data []byte) {
+	checksum := sha256.Sum256(data)
+	f.ContentSize = uint64(len(data))
+	f.Checksum = checksum[:]
+}
+
+// checksumReader hashes the file contents as they're read and fails with ErrChecksumMismatch instead of
+// io.EOF if the contents don't match the size and the checksum recorded in the file index. The mismatch is
+// kept, so that it's reported as is by the decoders that don't wrap the errors of the underlying reader,
+// e.g. the zstd decompressor.
+type checksumReader struct {
+	io.ReadCloser
+	file *File
+
+	hash     hash.Hash
+	size     uint64
+	mismatch error
+}
+
+// newChecksumReader returns the reader verifying the checksum of the file, the file must have the checksum.
+func newChecksumReader(rdr io.ReadCloser, file *File) *checksumReader {
+	return &checksumReader{ReadCloser: rdr, file: file, hash: sha256.New()}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.hash.Write(p[:n])
+	c.size += uint64(n)
+	if err == io.EOF {
+		if c.size != c.file.ContentSize {
+			c.mismatch = fmt.Errorf("%w: %d bytes, expected %d", ErrChecksumMismatch, c.size, c.file.ContentSize)
+		} else if !bytes.Equal(c.hash.Sum(nil), c.file.Checksum) {
+			c.mismatch = fmt.Errorf("%w: sha256 %x, expected %x", ErrChecksumMismatch, c.hash.Sum(nil), c.file.Checksum)
+		}
+		if c.mismatch != nil {
+			return n, c.mismatch
+		}
+	}
+	return n, err
+}
+
+// decodeErr returns the checksum mismatch in place of the decoding error it caused.
+func (c *checksumReader) decodeErr(err error) error {
+	if c != nil && c.mismatch != nil {
+		return c.mismatch
+	}
+	return err
+}
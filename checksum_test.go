@@ -0,0 +1,90 @@
+package ethwal
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader_VerifyChecksumOnRead(t *testing.T) {
+	readAll := func(t *testing.T, opt Options) ([]Block[[]int], error) {
+		r, err := NewReader[[]int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		var blocks []Block[[]int]
+		for {
+			b, err := r.Read(context.Background())
+			if err == io.EOF {
+				return blocks, nil
+			}
+			if err != nil {
+				return blocks, err
+			}
+			blocks = append(blocks, b)
+		}
+	}
+
+	for _, compressed := range []bool{false, true} {
+		opt := Options{
+			Dataset:              Dataset{Path: "ethwal"},
+			FileSystem:           gostorage.NewMemoryFS(),
+			FileRollPolicy:       NewLastBlockNumberRollPolicy(10),
+			FileRollOnClose:      true,
+			VerifyChecksumOnRead: true,
+		}
+		if compressed {
+			opt.NewCompressor = NewZSTDCompressor
+			opt.NewDecompressor = NewZSTDDecompressor
+		}
+
+		w, err := NewWriter[[]int](opt)
+		require.NoError(t, err)
+		for _, b := range generateMixedIntBlocks() {
+			require.NoError(t, w.Write(context.Background(), b))
+		}
+		require.NoError(t, w.Close(context.Background()))
+
+		fs := storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath())
+		files, err := ListFiles(context.Background(), fs)
+		require.NoError(t, err)
+		for _, file := range files {
+			size, err := file.Size(context.Background(), fs)
+			require.NoError(t, err)
+			require.Equal(t, uint64(size), file.ContentSize)
+			require.Len(t, file.Checksum, 32)
+		}
+
+		blocks, err := readAll(t, opt)
+		require.NoError(t, err)
+		require.Equal(t, generateMixedIntBlocks(), blocks)
+
+		// the file that doesn't match its checksum fails once it's read to the end
+		files[2].Checksum[0] ^= 0xff
+		require.NoError(t, NewFileIndexFromFiles(fs, files).Save(context.Background()))
+
+		blocks, err = readAll(t, opt)
+		require.ErrorIs(t, err, ErrChecksumMismatch)
+		require.Equal(t, files[2].LastBlockNum, blocks[len(blocks)-1].Number)
+
+		noVerify := opt
+		noVerify.VerifyChecksumOnRead = false
+		blocks, err = readAll(t, noVerify)
+		require.NoError(t, err)
+		require.Equal(t, generateMixedIntBlocks(), blocks)
+
+		// the files written before the checksums were recorded are read as they are
+		for _, file := range files {
+			file.ContentSize, file.Checksum = 0, nil
+		}
+		require.NoError(t, NewFileIndexFromFiles(fs, files).Save(context.Background()))
+
+		blocks, err = readAll(t, opt)
+		require.NoError(t, err)
+		require.Equal(t, generateMixedIntBlocks(), blocks)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const checkpointInterval = 1000
+
+// checkpoint keeps track of the input byte offset up to which all blocks are durably written.
+type checkpoint struct {
+	path string
+
+	pending       []checkpointEntry
+	linesTracked  uint64
+	durableOffset uint64
+}
+
+type checkpointEntry struct {
+	offset   uint64
+	blockNum uint64
+}
+
+func (c *checkpoint) load() (uint64, error) {
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	offset, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid checkpoint file %s: %w", c.path, err)
+	}
+
+	c.durableOffset = offset
+	return offset, nil
+}
+
+// track records the input offset after the block and periodically saves the offset
+// of the last durably written block.
+func (c *checkpoint) track(offset uint64, blockNum uint64, durableBlockNum uint64) error {
+	c.pending = append(c.pending, checkpointEntry{offset: offset, blockNum: blockNum})
+	c.linesTracked++
+	if c.linesTracked%checkpointInterval != 0 && blockNum != durableBlockNum {
+		return nil
+	}
+
+	var i int
+	for i < len(c.pending) && c.pending[i].blockNum <= durableBlockNum {
+		i++
+	}
+	if i == 0 {
+		return nil
+	}
+
+	durableOffset := c.pending[i-1].offset
+	c.pending = c.pending[i:]
+	if durableOffset == c.durableOffset {
+		return nil
+	}
+
+	c.durableOffset = durableOffset
+	return c.save()
+}
+
+func (c *checkpoint) save() error {
+	tmpPath := filepath.Join(filepath.Dir(c.path), fmt.Sprintf(".%s.tmp", filepath.Base(c.path)))
+	err := os.WriteFile(tmpPath, []byte(strconv.FormatUint(c.durableOffset, 10)), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, c.path)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/0xsequence/ethwal"
+	"github.com/0xsequence/ethwal/internal/toolconfig"
+	"github.com/c2h5oh/datasize"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+// runConfig runs the app with the args and returns the config of the dataset and the config the writer is
+// created with.
+func runConfig(t *testing.T, args ...string) (ethwal.OptionsConfig, ethwal.OptionsConfig) {
+	var config, writerConfig ethwal.OptionsConfig
+	app := cli.App{
+		Flags: []cli.Flag{ConfigFlag, DatasetPathFlag, DatasetNameFlag, DatasetVersion, EncoderFlag, CompressorFlag,
+			GoogleCloudBucket, S3BucketFlag, S3EndpointFlag, CachePathFlag, PresetFlag},
+		Action: func(c *cli.Context) error {
+			var err error
+			config, err = datasetConfig(c)
+			writerConfig = toolconfig.WithCodec(c, config, EncoderFlag, CompressorFlag)
+			return err
+		},
+	}
+	require.NoError(t, app.Run(append([]string{"ethwalcat"}, args...)))
+	return config, writerConfig
+}
+
+func TestDatasetConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`
+name: blocks
+version: v1
+path: data
+encoding: json
+compression: none
+fileSize: 16MB
+`), 0644))
+
+	t.Run("config", func(t *testing.T) {
+		config, writerConfig := runConfig(t, "--config", configPath)
+		require.Equal(t, ethwal.OptionsConfig{Name: "blocks", Version: "v1", Path: "data", Encoding: "json", Compression: "none", FileSize: 16 * datasize.MB}, config)
+		require.Equal(t, config, writerConfig)
+	})
+
+	t.Run("flags_override", func(t *testing.T) {
+		config, writerConfig := runConfig(t, "--config", configPath, "--path", "other", "--encoder", "cbor")
+		require.Equal(t, "other", config.Path)
+		require.Equal(t, "blocks", config.Name)
+		require.Equal(t, "cbor", writerConfig.Encoding)
+		// the default of the flag not set doesn't override the config
+		require.Equal(t, "none", writerConfig.Compression)
+	})
+
+	t.Run("flag_defaults", func(t *testing.T) {
+		config, writerConfig := runConfig(t, "--path", "data")
+		require.Equal(t, ethwal.OptionsConfig{Path: "data"}, config)
+		require.Equal(t, "cbor", writerConfig.Encoding)
+		require.Equal(t, "zstd", writerConfig.Compression)
+	})
+
+	t.Run("preset", func(t *testing.T) {
+		_, writerConfig := runConfig(t, "--path", "data", "--preset", "archival", "--encoder", "json")
+		require.Equal(t, "archival", writerConfig.Preset)
+		require.Empty(t, writerConfig.Encoding)
+
+		_, err := writerConfig.NewOptions()
+		require.NoError(t, err)
+	})
+
+	t.Run("unknown_encoder", func(t *testing.T) {
+		_, writerConfig := runConfig(t, "--path", "data", "--encoder", "protobuf")
+		_, err := writerConfig.NewOptions()
+		require.ErrorContains(t, err, `unknown encoding "protobuf", supported: cbor, json`)
+	})
+}
@@ -2,30 +2,34 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"cmp"
 	"errors"
 	"fmt"
 	"io"
-	"math/big"
+	"math"
 	"os"
-	"strings"
 
-	"github.com/0xsequence/ethkit/go-ethereum/common"
 	"github.com/0xsequence/ethwal"
-	"github.com/0xsequence/ethwal/storage"
-	"github.com/0xsequence/ethwal/storage/gcloud"
+	"github.com/0xsequence/ethwal/blockexpr"
+	"github.com/0xsequence/ethwal/internal/toolconfig"
+	"github.com/0xsequence/ethwal/storage/s3"
+	"github.com/c2h5oh/datasize"
 	"github.com/urfave/cli/v2"
 )
 
 var ModeFlag = &cli.StringFlag{
 	Name:  "mode",
-	Usage: "mode to run in read/write",
+	Usage: "mode to run in read/write/warm/transcode",
+}
+
+var ConfigFlag = &cli.StringFlag{
+	Name:  "config",
+	Usage: "dataset options config file, yaml or json, see ethwal.OptionsConfig, the flags set override it",
 }
 
 var DatasetPathFlag = &cli.StringFlag{
-	Name:     "path",
-	Usage:    "path to read",
-	Required: true,
+	Name:  "path",
+	Usage: "path to read, required unless set by --config",
 }
 
 var DatasetNameFlag = &cli.StringFlag{
@@ -87,48 +91,125 @@ var GoogleCloudBucket = &cli.StringFlag{
 	Usage: "google cloud bucket",
 }
 
-func encoder(context *cli.Context) (ethwal.NewEncoderFunc, error) {
-	switch context.String(EncoderFlag.Name) {
-	case "cbor":
-		return ethwal.NewCBOREncoder, nil
-	case "json":
-		return ethwal.NewJSONEncoder, nil
-	default:
-		return nil, fmt.Errorf("unknown encoder: %s", context.String(EncoderFlag.Name))
-	}
+var S3BucketFlag = &cli.StringFlag{
+	Name:  "s3-bucket",
+	Usage: "s3 bucket, with the default aws credentials",
+}
+
+var S3EndpointFlag = &cli.StringFlag{
+	Name:  "s3-endpoint",
+	Usage: "endpoint of the s3-compatible service, e.g. minio",
+}
+
+var ResumeFlag = &cli.BoolFlag{
+	Name:  "resume",
+	Usage: "skip input blocks that are already durably written to the dataset (write mode)",
+}
+
+var InputFlag = &cli.StringFlag{
+	Name:  "input",
+	Usage: "input file to read blocks from instead of stdin (write mode)",
+}
+
+var CheckpointFlag = &cli.StringFlag{
+	Name:  "checkpoint",
+	Usage: "file to store input byte offset of durably written blocks, requires --input (write mode)",
+}
+
+var CachePathFlag = &cli.StringFlag{
+	Name:  "cache-path",
+	Usage: "local directory to cache the dataset files in (read/warm mode)",
+}
+
+var WorkersFlag = &cli.IntFlag{
+	Name:  "workers",
+	Usage: "number of files downloaded concurrently (warm mode)",
+	Value: 4,
+}
+
+var MaxBytesFlag = &cli.StringFlag{
+	Name:  "max-bytes",
+	Usage: "maximal size of the downloaded files, e.g. 10GB, unlimited if empty (warm mode)",
+}
+
+var LegacyCBORHeuristicsFlag = &cli.BoolFlag{
+	Name:  "legacy-cbor-heuristics",
+	Usage: "decode untagged byte strings that parse as decimal numbers as decimal strings (read mode)",
+}
+
+var WhereFlag = &cli.StringFlag{
+	Name:  "where",
+	Usage: "read only the blocks matching the expression, e.g. \"len(data.transactions) > 50\", see the blockexpr package",
+}
+
+var OutputFlag = &cli.StringFlag{
+	Name:  "output",
+	Usage: "output format ndjson/csv (read mode)",
+	Value: "ndjson",
+}
+
+var ColumnsFlag = &cli.StringFlag{
+	Name:  "columns",
+	Usage: "comma separated columns to output, e.g. \"number,ts,hash,data.miner\", whole blocks if empty (read mode)",
+}
+
+var PresetFlag = &cli.StringFlag{
+	Name:  "preset",
+	Usage: "dataset preset archival/realtime, overrides the codec, compression and file roll flags (of the destination in transcode mode)",
+}
+
+var HexAsBytesFlag = &cli.BoolFlag{
+	Name:  "hex-as-bytes",
+	Usage: "write the lowercase 0x-prefixed hex strings as cbor byte strings, as text if false (write/transcode mode)",
+	Value: true,
 }
 
-func decoder(context *cli.Context) (ethwal.NewDecoderFunc, error) {
-	switch context.String(DecoderFlag.Name) {
-	case "cbor":
-		return ethwal.NewCBORDecoder, nil
-	case "json":
-		return ethwal.NewJSONDecoder, nil
-	default:
-		return nil, fmt.Errorf("unknown decoder: %s", context.String(DecoderFlag.Name))
+var DestPathFlag = &cli.StringFlag{
+	Name:  "dest-path",
+	Usage: "path of the dataset to write with the encoder and the compressor, read from --path with the decoder and the decompressor (transcode mode)",
+}
+
+// datasetOptions returns the options of the dataset of the config, the file system of the s3 bucket is created
+// with the default aws credentials.
+func datasetOptions(c *cli.Context, config ethwal.OptionsConfig, opts ...ethwal.Option) (ethwal.Options, error) {
+	if config.S3Bucket != "" {
+		s3Opt, err := s3FileSystem(c, config.S3Bucket, config.S3Endpoint)
+		if err != nil {
+			return ethwal.Options{}, err
+		}
+		opts = append(opts, s3Opt)
 	}
+	return config.NewOptions(opts...)
 }
 
-func compressor(context *cli.Context) (ethwal.NewCompressorFunc, error) {
-	switch context.String(CompressorFlag.Name) {
-	case "zstd":
-		return ethwal.NewZSTDCompressor, nil
-	case "none":
-		return nil, nil
-	default:
-		return nil, fmt.Errorf("unknown compressor: %s", context.String(CompressorFlag.Name))
+// s3FileSystem returns the option of the s3 bucket file system, with the default aws credentials.
+func s3FileSystem(c *cli.Context, bucket, endpoint string) (ethwal.Option, error) {
+	var options []s3.Option
+	if endpoint != "" {
+		options = append(options, s3.WithEndpoint(endpoint))
+	}
+
+	fs, err := s3.NewDefaultS3FS(c.Context, bucket, options...)
+	if err != nil {
+		return nil, err
 	}
+	return ethwal.WithFileSystem(fs), nil
 }
 
-func decompressor(context *cli.Context) (ethwal.NewDecompressorFunc, error) {
-	switch context.String(DecompressorFlag.Name) {
-	case "zstd":
-		return ethwal.NewZSTDDecompressor, nil
-	case "none":
-		return nil, nil
-	default:
-		return nil, fmt.Errorf("unknown decompressor: %s", context.String(DecompressorFlag.Name))
+// writerOptions returns the options of the dataset of the config written with the codec and the compression of
+// the flags, the files roll at 8 MB if neither the preset nor the config sets the file size.
+func writerOptions(c *cli.Context, config ethwal.OptionsConfig) (ethwal.Options, error) {
+	config = toolconfig.WithCodec(c, config, EncoderFlag, CompressorFlag)
+	if config.Preset == "" {
+		config.FileSize = cmp.Or(config.FileSize, 8*datasize.MB)
+		config.FileRollOnClose = config.FileRollOnClose || c.Bool(FileRollOnCloseFlag.Name)
 	}
+	return datasetOptions(c, config)
+}
+
+// isCBOR reports whether the dataset of the config is encoded with CBOR, the presets are.
+func isCBOR(config ethwal.OptionsConfig) bool {
+	return config.Preset != "" || config.CBORPreset != "" || config.Encoding == ethwal.ManifestEncodingCBOR
 }
 
 func main() {
@@ -137,6 +218,7 @@ func main() {
 		Usage: "tool to manage ethwal files",
 		Flags: []cli.Flag{
 			ModeFlag,
+			ConfigFlag,
 			DatasetPathFlag,
 			DatasetNameFlag,
 			DatasetVersion,
@@ -148,35 +230,64 @@ func main() {
 			ToBlockNumFlag,
 			FileRollOnCloseFlag,
 			GoogleCloudBucket,
+			S3BucketFlag,
+			S3EndpointFlag,
+			ResumeFlag,
+			InputFlag,
+			CheckpointFlag,
+			LegacyCBORHeuristicsFlag,
+			CachePathFlag,
+			WorkersFlag,
+			MaxBytesFlag,
+			PresetFlag,
+			WhereFlag,
+			OutputFlag,
+			ColumnsFlag,
+			HexAsBytesFlag,
+			DestPathFlag,
 		},
 		Action: func(c *cli.Context) error {
+			config, err := datasetConfig(c)
+			if err != nil {
+				return err
+			}
+
 			switch c.String(ModeFlag.Name) {
 			case "read":
-				dec, err := decoder(c)
-				if err != nil {
-					return err
+				var where *blockexpr.Expr
+				if expr := c.String(WhereFlag.Name); expr != "" {
+					var err error
+					where, err = blockexpr.Compile(expr)
+					if err != nil {
+						var syntaxErr *blockexpr.SyntaxError
+						if errors.As(err, &syntaxErr) {
+							return fmt.Errorf("invalid --where expression: %w\n%s", err, syntaxErr.Context())
+						}
+						return err
+					}
 				}
 
-				decomp, err := decompressor(c)
+				// the mistyped path fails instead of reading the empty dataset
+				config = toolconfig.WithCodec(c, config, DecoderFlag, DecompressorFlag)
+				config.OpenExisting = true
+
+				// cbor deserializes into map[interface{}]interface{} which can not be serialized into json
+				var codec *ethwal.ValueCodec
+				if isCBOR(config) {
+					codec = &ethwal.ValueCodec{LegacyHeuristics: c.Bool(LegacyCBORHeuristicsFlag.Name)}
+				}
+
+				out, err := newFormatter(os.Stdout, c.String(OutputFlag.Name), parseColumns(c.String(ColumnsFlag.Name)), codec)
 				if err != nil {
 					return err
 				}
 
-				var fs storage.FS
-				if bucket := c.String(GoogleCloudBucket.Name); bucket != "" {
-					fs = gcloud.NewGCloudFS(bucket, nil)
+				options, err := datasetOptions(c, config)
+				if err != nil {
+					return err
 				}
 
-				r, err := ethwal.NewReader[any](ethwal.Options{
-					Dataset: ethwal.Dataset{
-						Name:    c.String(DatasetNameFlag.Name),
-						Version: c.String(DatasetVersion.Name),
-						Path:    c.String(DatasetPathFlag.Name),
-					},
-					FileSystem:      fs,
-					NewDecoder:      dec,
-					NewDecompressor: decomp,
-				})
+				r, err := ethwal.NewReader[any](options)
 				if err != nil {
 					return err
 				}
@@ -196,17 +307,12 @@ func main() {
 						break
 					}
 
-					// cbor deserializes into map[interface{}]interface{} which can not be serialized into json
-					if c.String(DecoderFlag.Name) == "cbor" {
-						b.Data = normalizeDataFromCBOR(b.Data)
-					}
-
-					data, err := json.Marshal(b)
-					if err != nil {
-						return err
+					// the blocks are filtered before the conversion and serialization of the data
+					if where != nil && !blockexpr.Match(where, b) {
+						continue
 					}
 
-					_, err = fmt.Fprintln(os.Stdout, string(data))
+					err = out.Format(b)
 					if err != nil {
 						return err
 					}
@@ -216,60 +322,96 @@ func main() {
 					return err
 				}
 
+				err = out.Flush()
+				if err != nil {
+					return err
+				}
+
 				err = r.Close()
 				if err != nil {
 					return err
 				}
 			case "write":
-				enc, err := encoder(c)
+				options, err := writerOptions(c, config)
 				if err != nil {
 					return err
 				}
 
-				compres, err := compressor(c)
+				w, err := ethwal.NewWriter[any](options)
 				if err != nil {
 					return err
 				}
 
-				var fs storage.FS
-				if bucket := c.String(GoogleCloudBucket.Name); bucket != "" {
-					fs = gcloud.NewGCloudFS(bucket, nil)
+				var input io.Reader = os.Stdin
+				var inputOffset uint64
+				var cp *checkpoint
+				if inputPath := c.String(InputFlag.Name); inputPath != "" {
+					inputFile, err := os.Open(inputPath)
+					if err != nil {
+						return err
+					}
+					defer inputFile.Close()
+					input = inputFile
+
+					if checkpointPath := c.String(CheckpointFlag.Name); checkpointPath != "" {
+						cp = &checkpoint{path: checkpointPath}
+						if c.Bool(ResumeFlag.Name) {
+							inputOffset, err = cp.load()
+							if err != nil {
+								return err
+							}
+
+							_, err = inputFile.Seek(int64(inputOffset), io.SeekStart)
+							if err != nil {
+								return err
+							}
+						}
+					}
+				} else if c.String(CheckpointFlag.Name) != "" {
+					return fmt.Errorf("--%s requires --%s", CheckpointFlag.Name, InputFlag.Name)
+				}
+
+				var skipReader *ethwal.SkipReader
+				if c.Bool(ResumeFlag.Name) {
+					skipReader = ethwal.SkipUntilBlock(input, w.DurableBlockNum())
+					input = skipReader
 				}
 
-				w, err := ethwal.NewWriter[any](ethwal.Options{
-					Dataset: ethwal.Dataset{
-						Name:    c.String(DatasetNameFlag.Name),
-						Version: c.String(DatasetVersion.Name),
-						Path:    c.String(DatasetPathFlag.Name),
-					},
-					FileSystem:      fs,
-					NewEncoder:      enc,
-					NewCompressor:   compres,
-					FileRollPolicy:  ethwal.NewFileSizeRollPolicy(uint64(8 << 20)), // 8 MB
-					FileRollOnClose: c.Bool(FileRollOnCloseFlag.Name),
-				})
-				if err != nil {
-					return err
+				// currentOffset returns the offset in the input file after the last consumed line
+				var linesWritten, inputRead uint64
+				currentOffset := func() uint64 {
+					if skipReader != nil {
+						return inputOffset + skipReader.SkippedBytes() + inputRead
+					}
+					return inputOffset + inputRead
 				}
 
+				codec := ethwal.ValueCodec{KeepHexStrings: !c.Bool(HexAsBytesFlag.Name)}
+				toCBOR := isCBOR(toolconfig.WithCodec(c, config, EncoderFlag, CompressorFlag))
+
 				line := ""
-				in := bufio.NewReader(os.Stdin)
+				in := bufio.NewReader(input)
 				for line, err = in.ReadString(byte('\n')); err == nil; line, err = in.ReadString(byte('\n')) {
 					var b ethwal.Block[any]
-					err = json.Unmarshal([]byte(line), &b)
+					b, err = decodeJSONBlock([]byte(line))
 					if err != nil {
 						return err
 					}
-
-					// cbor needs to have hashes represented as byte slices
-					if c.String(EncoderFlag.Name) == "cbor" {
-						b.Data = normalizeDataToCBOR(b.Data)
-					}
+					b.Data = convertData(b.Data, false, toCBOR, codec)
 
 					err = w.Write(c.Context, b)
 					if err != nil {
 						return err
 					}
+					linesWritten++
+
+					inputRead += uint64(len(line))
+					if cp != nil {
+						err = cp.track(currentOffset(), b.Number, w.DurableBlockNum())
+						if err != nil {
+							return err
+						}
+					}
 				}
 
 				if err != nil && !errors.Is(err, io.EOF) {
@@ -280,6 +422,82 @@ func main() {
 				if err != nil {
 					return err
 				}
+
+				if cp != nil {
+					err = cp.track(currentOffset(), w.AcceptedBlockNum(), w.DurableBlockNum())
+					if err != nil {
+						return err
+					}
+				}
+
+				if skipReader != nil {
+					_, _ = fmt.Fprintf(os.Stderr, "skipped %d lines, written %d lines\n", skipReader.SkippedLines(), linesWritten)
+				}
+			case "transcode":
+				destPath := c.String(DestPathFlag.Name)
+				if destPath == "" {
+					return fmt.Errorf("--%s is required in transcode mode", DestPathFlag.Name)
+				}
+
+				// the source is read with the decoder flags, the preset is of the destination
+				srcConfig := config
+				srcConfig.Preset = ""
+				srcConfig = toolconfig.WithCodec(c, srcConfig, DecoderFlag, DecompressorFlag)
+				srcConfig.OpenExisting = true
+				src, err := datasetOptions(c, srcConfig)
+				if err != nil {
+					return err
+				}
+
+				dstConfig := config
+				dstConfig.Path = destPath
+				dst, err := writerOptions(c, dstConfig)
+				if err != nil {
+					return err
+				}
+
+				codec := ethwal.ValueCodec{
+					LegacyHeuristics: c.Bool(LegacyCBORHeuristicsFlag.Name),
+					KeepHexStrings:   !c.Bool(HexAsBytesFlag.Name),
+				}
+				written, err := transcode(c.Context, src, dst, c.Uint64(FromBlockNumFlag.Name), c.Uint64(ToBlockNumFlag.Name),
+					isCBOR(srcConfig), isCBOR(toolconfig.WithCodec(c, dstConfig, EncoderFlag, CompressorFlag)), codec)
+				_, _ = fmt.Fprintf(os.Stderr, "transcoded %d blocks\n", written)
+				if err != nil {
+					return err
+				}
+			case "warm":
+				options, err := datasetOptions(c, config)
+				if err != nil {
+					return err
+				}
+
+				var maxBytes datasize.ByteSize
+				if value := c.String(MaxBytesFlag.Name); value != "" {
+					err := maxBytes.UnmarshalText([]byte(value))
+					if err != nil {
+						return fmt.Errorf("invalid --%s: %w", MaxBytesFlag.Name, err)
+					}
+				}
+
+				var toBlockNumber = c.Uint64(ToBlockNumFlag.Name)
+				if toBlockNumber == 0 {
+					toBlockNumber = math.MaxUint64
+				}
+
+				report, err := ethwal.WarmCache(c.Context, options, c.Uint64(FromBlockNumFlag.Name), toBlockNumber, ethwal.WarmOptions{
+					Workers:  c.Int(WorkersFlag.Name),
+					MaxBytes: maxBytes,
+				})
+
+				_, _ = fmt.Fprintf(os.Stderr, "downloaded %d files (%s), skipped %d cached files (%s), %d files over budget (%s), %d files failed\n",
+					report.FilesDownloaded, datasize.ByteSize(report.BytesDownloaded).HR(),
+					report.FilesSkipped, datasize.ByteSize(report.BytesSkipped).HR(),
+					report.FilesOverBudget, datasize.ByteSize(report.BytesOverBudget).HR(),
+					report.FilesFailed)
+				if err != nil {
+					return err
+				}
 			default:
 				return fmt.Errorf("unknown mode: %s", c.String(ModeFlag.Name))
 			}
@@ -292,30 +510,3 @@ func main() {
 		_, _ = fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
 	}
 }
-
-func normalizeDataFromCBOR(data any) any {
-	if m, ok := data.(map[any]any); ok {
-		var mr = make(map[string]any)
-		for k, v := range m {
-			mr[k.(string)] = normalizeDataFromCBOR(v)
-		}
-		return mr
-	} else if arr, ok := data.([]any); ok {
-		for i, v := range arr {
-			arr[i] = normalizeDataFromCBOR(v)
-		}
-	} else if b, ok := data.([]byte); ok {
-		if i, ok := big.NewInt(0).SetString(strings.ReplaceAll(string(b), "\"", ""), 10); ok {
-			return i.String()
-		}
-		return fmt.Sprintf("0x%s", common.Bytes2Hex(b))
-	}
-	return data
-}
-
-func normalizeDataToCBOR(data any) any {
-	if b, ok := data.(string); ok && strings.HasPrefix(b, "0x") {
-		return common.Hex2Bytes(b)
-	}
-	return nil
-}
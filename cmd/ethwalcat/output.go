@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/0xsequence/ethwal"
+)
+
+// formatter writes the blocks to the output, one record per block. The records are buffered until Flush.
+type formatter interface {
+	Format(b ethwal.Block[any]) error
+	Flush() error
+}
+
+// newFormatter creates the formatter of the output format, ndjson or csv, writing the columns of the blocks.
+// The ndjson formatter writes the whole blocks if no columns are given, the csv formatter writes the number,
+// the timestamp and the hash. The block data is normalized with the codec if it's set, the data of the
+// selected columns only.
+func newFormatter(out io.Writer, format string, columns []string, codec *ethwal.ValueCodec) (formatter, error) {
+	cols := make([]column, 0, len(columns))
+	for _, text := range columns {
+		col, err := parseColumn(text)
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, col)
+	}
+
+	switch format {
+	case "ndjson", "json":
+		return &ndjsonFormatter{out: bufio.NewWriter(out), columns: cols, codec: codec}, nil
+	case "csv":
+		if len(cols) == 0 {
+			cols = []column{{name: "number", root: columnNumber}, {name: "ts", root: columnTS}, {name: "hash", root: columnHash}}
+		}
+		return &csvFormatter{out: csv.NewWriter(out), columns: cols, codec: codec}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// parseColumns splits the comma separated columns.
+func parseColumns(text string) []string {
+	if text == "" {
+		return nil
+	}
+
+	var columns []string
+	for _, column := range strings.Split(text, ",") {
+		columns = append(columns, strings.TrimSpace(column))
+	}
+	return columns
+}
+
+type columnRoot int
+
+const (
+	columnNumber columnRoot = iota
+	columnTS
+	columnHash
+	columnData
+	columnMeta
+)
+
+var columnRoots = map[string]columnRoot{
+	"number":    columnNumber,
+	"blocknum":  columnNumber,
+	"ts":        columnTS,
+	"blockts":   columnTS,
+	"hash":      columnHash,
+	"blockhash": columnHash,
+	"data":      columnData,
+	"blockdata": columnData,
+	"meta":      columnMeta,
+}
+
+// column is the block field or the value within the block data selected by the dotted path, the list
+// elements are selected by their index.
+type column struct {
+	name string
+	root columnRoot
+	path []string
+}
+
+func parseColumn(text string) (column, error) {
+	segments := strings.Split(text, ".")
+
+	root, ok := columnRoots[strings.ToLower(segments[0])]
+	if !ok {
+		return column{}, fmt.Errorf("unknown column %q, the columns are number, ts, hash, data and meta", segments[0])
+	}
+
+	switch root {
+	case columnNumber, columnTS, columnHash:
+		if len(segments) > 1 {
+			return column{}, fmt.Errorf("column %q has no fields", segments[0])
+		}
+	case columnMeta:
+		if len(segments) > 2 {
+			return column{}, fmt.Errorf("meta column must be meta or meta.<key>")
+		}
+	}
+	return column{name: text, root: root, path: segments[1:]}, nil
+}
+
+// value returns the value of the column in the block, false if the block doesn't have it.
+func (c column) value(b ethwal.Block[any], codec *ethwal.ValueCodec) (any, bool) {
+	switch c.root {
+	case columnNumber:
+		return b.Number, true
+	case columnTS:
+		return b.TS, true
+	case columnHash:
+		return b.Hash.Hex(), true
+	case columnMeta:
+		if len(c.path) == 0 {
+			return b.Meta, b.Meta != nil
+		}
+		value, ok := b.Meta[c.path[0]]
+		return value, ok
+	default:
+		value, ok := resolvePath(b.Data, c.path)
+		if !ok {
+			return nil, false
+		}
+		if codec != nil {
+			value = codec.FromCBOR(value)
+		}
+		return value, true
+	}
+}
+
+// resolvePath returns the value at the path within the decoded data, the maps decoded from CBOR are keyed
+// by any value.
+func resolvePath(value any, path []string) (any, bool) {
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]any:
+			next, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case map[any]any:
+			next, ok := v[key]
+			if !ok {
+				// the keys that aren't strings are matched by their text, as normalized by the codec
+				for k, n := range v {
+					if fmt.Sprint(k) == key {
+						next, ok = n, true
+						break
+					}
+				}
+				if !ok {
+					return nil, false
+				}
+			}
+			value = next
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// ndjsonFormatter writes the blocks as JSON lines, the selected columns are written in their order.
+type ndjsonFormatter struct {
+	out     *bufio.Writer
+	columns []column
+	codec   *ethwal.ValueCodec
+}
+
+func (f *ndjsonFormatter) Format(b ethwal.Block[any]) error {
+	if len(f.columns) == 0 {
+		// cbor deserializes into map[interface{}]interface{} which can not be serialized into json
+		if f.codec != nil {
+			b.Data = f.codec.FromCBOR(b.Data)
+		}
+
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		_, _ = f.out.Write(data)
+		return f.out.WriteByte('\n')
+	}
+
+	_ = f.out.WriteByte('{')
+	for i, col := range f.columns {
+		if i > 0 {
+			_ = f.out.WriteByte(',')
+		}
+
+		key, err := json.Marshal(col.name)
+		if err != nil {
+			return err
+		}
+		_, _ = f.out.Write(key)
+		_ = f.out.WriteByte(':')
+
+		// the missing value is null, so that every line has all columns
+		value, _ := col.value(b, f.codec)
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("column %s: %w", col.name, err)
+		}
+		_, _ = f.out.Write(data)
+	}
+	_, err := f.out.WriteString("}\n")
+	return err
+}
+
+func (f *ndjsonFormatter) Flush() error {
+	return f.out.Flush()
+}
+
+// csvFormatter writes the selected columns of the blocks as CSV rows after the header row.
+type csvFormatter struct {
+	out     *csv.Writer
+	columns []column
+	codec   *ethwal.ValueCodec
+
+	record        []string
+	headerWritten bool
+}
+
+func (f *csvFormatter) Format(b ethwal.Block[any]) error {
+	if !f.headerWritten {
+		header := make([]string, 0, len(f.columns))
+		for _, col := range f.columns {
+			header = append(header, col.name)
+		}
+		err := f.out.Write(header)
+		if err != nil {
+			return err
+		}
+		f.headerWritten = true
+	}
+
+	f.record = f.record[:0]
+	for _, col := range f.columns {
+		value, ok := col.value(b, f.codec)
+		if !ok {
+			f.record = append(f.record, "")
+			continue
+		}
+
+		cell, err := csvCell(value)
+		if err != nil {
+			return fmt.Errorf("column %s: %w", col.name, err)
+		}
+		f.record = append(f.record, cell)
+	}
+	return f.out.Write(f.record)
+}
+
+func (f *csvFormatter) Flush() error {
+	f.out.Flush()
+	return f.out.Error()
+}
+
+// csvCell returns the text of the value, the lists and the objects are written as JSON.
+func csvCell(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/0xsequence/ethwal"
+	"github.com/stretchr/testify/require"
+)
+
+// testBlocks returns the blocks with the data decoded from CBOR, the second one has no miner and one log.
+func testBlocks() []ethwal.Block[any] {
+	return []ethwal.Block[any]{
+		{
+			Number: 1,
+			TS:     100,
+			Hash:   common.BytesToHash([]byte{0x01}),
+			Data: map[any]any{
+				"miner": []byte{0xaa, 0xbb},
+				"extra": "a,\"quoted\"\nvalue",
+				"logs": []any{
+					map[any]any{"address": []byte{0x01}, "topics": []any{"t0", "t1"}},
+					map[any]any{"address": []byte{0x02}, "topics": []any{}},
+				},
+				uint64(7): true,
+			},
+			Meta: map[string]string{"source": "rpc"},
+		},
+		{
+			Number: 2,
+			TS:     200,
+			Hash:   common.BytesToHash([]byte{0x02}),
+			Data: map[any]any{
+				"logs": []any{map[any]any{"address": []byte{0x03}}},
+			},
+		},
+	}
+}
+
+func formatBlocks(t *testing.T, format string, columns []string) string {
+	var buf bytes.Buffer
+	out, err := newFormatter(&buf, format, columns, &ethwal.ValueCodec{})
+	require.NoError(t, err)
+	for _, b := range testBlocks() {
+		require.NoError(t, out.Format(b))
+	}
+	require.NoError(t, out.Flush())
+	return buf.String()
+}
+
+func TestFormatter_CSV(t *testing.T) {
+	output := formatBlocks(t, "csv", parseColumns("number,ts,hash,data.miner,data.logs.0.address,data.logs.1.topics,data.extra,data.7,meta.source"))
+
+	records, err := csv.NewReader(bytes.NewReader([]byte(output))).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, [][]string{
+		{"number", "ts", "hash", "data.miner", "data.logs.0.address", "data.logs.1.topics", "data.extra", "data.7", "meta.source"},
+		{"1", "100", common.BytesToHash([]byte{0x01}).Hex(), "0xaabb", "0x01", "[]", "a,\"quoted\"\nvalue", "true", "rpc"},
+		// the missing fields are empty
+		{"2", "200", common.BytesToHash([]byte{0x02}).Hex(), "", "0x03", "", "", "", ""},
+	}, records)
+
+	// the default columns
+	records, err = csv.NewReader(bytes.NewReader([]byte(formatBlocks(t, "csv", nil)))).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, []string{"number", "ts", "hash"}, records[0])
+	require.Len(t, records, 3)
+}
+
+func TestFormatter_NDJSON(t *testing.T) {
+	output := formatBlocks(t, "ndjson", parseColumns("number, data.logs.0, data.logs.5.address, meta"))
+	require.Equal(t,
+		`{"number":1,"data.logs.0":{"address":"0x01","topics":["t0","t1"]},"data.logs.5.address":null,"meta":{"source":"rpc"}}`+"\n"+
+			`{"number":2,"data.logs.0":{"address":"0x03"},"data.logs.5.address":null,"meta":null}`+"\n",
+		output)
+
+	// the whole blocks are written without the columns
+	output = formatBlocks(t, "ndjson", nil)
+	require.Contains(t, output, `"blockNum":1`)
+	require.Contains(t, output, `"miner":"0xaabb"`)
+}
+
+func TestParseColumn(t *testing.T) {
+	for _, text := range []string{"number.value", "hash.x", "meta.a.b", "unknown"} {
+		_, err := parseColumn(text)
+		require.Error(t, err, text)
+	}
+
+	_, err := newFormatter(&bytes.Buffer{}, "xml", nil, nil)
+	require.Error(t, err)
+}
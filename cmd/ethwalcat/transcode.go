@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/0xsequence/ethwal"
+)
+
+// decodeJSONBlock decodes the block of the JSON line, the numbers of the data are kept as json.Number, so that
+// the large integers aren't rounded to float64.
+func decodeJSONBlock(line []byte) (ethwal.Block[any], error) {
+	var b ethwal.Block[any]
+	err := ethwal.NewJSONNumberDecoder(bytes.NewReader(line)).Decode(&b)
+	return b, err
+}
+
+// convertData converts the block data decoded from JSON or CBOR to the representation of the encoding it's
+// written with, the data of the same encoding is kept as is.
+func convertData(data any, fromCBOR, toCBOR bool, codec ethwal.ValueCodec) any {
+	switch {
+	case !fromCBOR && toCBOR:
+		// cbor needs to have hashes and numbers represented as tagged binary values
+		return codec.ToCBOR(data)
+	case fromCBOR && !toCBOR:
+		return codec.FromCBOR(data)
+	default:
+		return data
+	}
+}
+
+// transcode reads the blocks of the source dataset from the block up to the block, 0 for all, and writes them
+// to the destination dataset with its encoder and compressor, the last file is rolled. It returns the number of
+// the blocks written.
+func transcode(ctx context.Context, src, dst ethwal.Options, from, to uint64, fromCBOR, toCBOR bool, codec ethwal.ValueCodec) (uint64, error) {
+	// the json numbers are decoded as they're written
+	if !fromCBOR {
+		src.NewDecoder = ethwal.NewJSONNumberDecoder
+	}
+
+	r, err := ethwal.NewReader[any](src)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	if from > 0 {
+		err = r.Seek(ctx, from)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	w, err := ethwal.NewWriter[any](dst)
+	if err != nil {
+		return 0, err
+	}
+
+	var written uint64
+	for {
+		b, err := r.Read(ctx)
+		if errors.Is(err, io.EOF) || (err == nil && to != 0 && b.Number >= to) {
+			break
+		}
+		if err != nil {
+			_ = w.Close(ctx)
+			return written, err
+		}
+
+		b.Data = convertData(b.Data, fromCBOR, toCBOR, codec)
+		err = w.Write(ctx, b)
+		if err != nil {
+			_ = w.Close(ctx)
+			return written, err
+		}
+		written++
+	}
+
+	// the destination has all blocks written, whatever the roll on close
+	err = w.RollFile(ctx)
+	if err != nil {
+		_ = w.Close(ctx)
+		return written, err
+	}
+	return written, w.Close(ctx)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/0xsequence/ethwal"
+	"github.com/0xsequence/ethwal/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// testLines are the JSON lines of the blocks with the nested maps and arrays, the numbers and the hex strings.
+var testLines = []string{
+	`{"blockNum":1,"blockHash":"0x0000000000000000000000000000000000000000000000000000000000000001","blockData":{"miner":"0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2","gasUsed":21000,"baseFee":1.5,"logs":[{"address":"0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2","topics":["0x28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef"],"data":"0x0102"}]},"blockTS":100}`,
+	`{"blockNum":2,"blockHash":"0x0000000000000000000000000000000000000000000000000000000000000002","blockData":{"nonce":18446744073709551615,"refund":-7,"extra":"0xABC","value":"1000","empty":{},"list":[1,[2,"x"],null,true]},"blockTS":200}`,
+	`{"blockNum":3,"blockHash":"0x0000000000000000000000000000000000000000000000000000000000000003","blockData":null,"blockTS":300}`,
+}
+
+func writeTestDataset(t *testing.T, opt ethwal.Options, toCBOR bool, codec ethwal.ValueCodec) {
+	w, err := ethwal.NewWriter[any](opt)
+	require.NoError(t, err)
+	for _, line := range testLines {
+		b, err := decodeJSONBlock([]byte(line))
+		require.NoError(t, err)
+		b.Data = convertData(b.Data, false, toCBOR, codec)
+		require.NoError(t, w.Write(context.Background(), b))
+	}
+	require.NoError(t, w.RollFile(context.Background()))
+	require.NoError(t, w.Close(context.Background()))
+}
+
+// readTestDataset returns the blocks of the dataset with the data in the JSON representation.
+func readTestDataset(t *testing.T, opt ethwal.Options, fromCBOR bool) []ethwal.Block[any] {
+	if !fromCBOR {
+		opt.NewDecoder = ethwal.NewJSONNumberDecoder
+	}
+	r, err := ethwal.NewReader[any](opt)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var blocks []ethwal.Block[any]
+	for {
+		b, err := r.Read(context.Background())
+		if errors.Is(err, io.EOF) {
+			return blocks
+		}
+		require.NoError(t, err)
+		b.Data = convertData(b.Data, fromCBOR, false, ethwal.ValueCodec{})
+		blocks = append(blocks, b)
+	}
+}
+
+// requireSameData compares the data of the blocks with the data of the test lines as JSON text, so that the
+// numbers are compared exactly.
+func requireSameData(t *testing.T, blocks []ethwal.Block[any]) {
+	require.Len(t, blocks, len(testLines))
+	for i, line := range testLines {
+		var expected struct {
+			Data json.RawMessage `json:"blockData"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(line), &expected))
+
+		expectedData, err := json.Marshal(mustDecodeJSON(t, expected.Data))
+		require.NoError(t, err)
+		data, err := json.Marshal(blocks[i].Data)
+		require.NoError(t, err)
+		require.Equal(t, string(expectedData), string(data), "block %d", blocks[i].Number)
+	}
+}
+
+func mustDecodeJSON(t *testing.T, data []byte) any {
+	var value any
+	require.NoError(t, ethwal.NewJSONNumberDecoder(bytes.NewReader(data)).Decode(&value))
+	return value
+}
+
+func testDatasetOptions(path string, encoding string) ethwal.Options {
+	opt := ethwal.Options{
+		Dataset:         ethwal.Dataset{Path: path},
+		FileSystem:      memory.NewMemoryFS(),
+		NewCompressor:   ethwal.NewZSTDCompressor,
+		NewDecompressor: ethwal.NewZSTDDecompressor,
+	}
+	if encoding == "json" {
+		opt.NewEncoder, opt.NewDecoder = ethwal.NewJSONEncoder, ethwal.NewJSONDecoder
+		opt.NewCompressor, opt.NewDecompressor = nil, nil
+	}
+	return opt
+}
+
+func TestWrite_JSONToCBORRoundTrip(t *testing.T) {
+	t.Run("hex_as_bytes", func(t *testing.T) {
+		opt := testDatasetOptions("ethwal", "cbor")
+		writeTestDataset(t, opt, true, ethwal.ValueCodec{})
+		requireSameData(t, readTestDataset(t, opt, true))
+	})
+
+	t.Run("hex_as_text", func(t *testing.T) {
+		opt := testDatasetOptions("ethwal", "cbor")
+		writeTestDataset(t, opt, true, ethwal.ValueCodec{KeepHexStrings: true})
+
+		r, err := ethwal.NewReader[any](opt)
+		require.NoError(t, err)
+		defer r.Close()
+		b, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2", b.Data.(map[any]any)["miner"])
+
+		requireSameData(t, readTestDataset(t, opt, true))
+	})
+}
+
+func TestTranscode(t *testing.T) {
+	ctx := context.Background()
+
+	src := testDatasetOptions("src", "json")
+	writeTestDataset(t, src, false, ethwal.ValueCodec{})
+
+	// json to cbor and back
+	dst := testDatasetOptions("dst", "cbor")
+	written, err := transcode(ctx, src, dst, 0, 0, false, true, ethwal.ValueCodec{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(testLines)), written)
+
+	back := testDatasetOptions("back", "json")
+	_, err = transcode(ctx, dst, back, 0, 0, true, false, ethwal.ValueCodec{})
+	require.NoError(t, err)
+
+	srcBlocks, dstBlocks, backBlocks := readTestDataset(t, src, false), readTestDataset(t, dst, true), readTestDataset(t, back, false)
+	requireSameData(t, srcBlocks)
+	for i := range srcBlocks {
+		for _, blocks := range [][]ethwal.Block[any]{dstBlocks, backBlocks} {
+			require.Equal(t, srcBlocks[i].Number, blocks[i].Number)
+			require.Equal(t, srcBlocks[i].Hash, blocks[i].Hash)
+			require.Equal(t, srcBlocks[i].TS, blocks[i].TS)
+		}
+	}
+	requireSameData(t, dstBlocks)
+	requireSameData(t, backBlocks)
+
+	// the block range
+	part := testDatasetOptions("part", "cbor")
+	written, err = transcode(ctx, src, part, 2, 3, false, true, ethwal.ValueCodec{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), written)
+}
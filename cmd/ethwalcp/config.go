@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/0xsequence/ethwal"
+	"github.com/0xsequence/ethwal/internal/toolconfig"
+	"github.com/urfave/cli/v2"
+)
+
+// datasetConfig returns the config of the source or the destination dataset, the config file of the config
+// flag overridden by the path and the bucket flags set.
+func datasetConfig(c *cli.Context, configFlag, pathFlag, gcsBucketFlag, s3BucketFlag, s3EndpointFlag *cli.StringFlag) (ethwal.OptionsConfig, error) {
+	return toolconfig.DatasetConfig(c, toolconfig.DatasetFlags{
+		Config:            configFlag,
+		Path:              pathFlag,
+		GoogleCloudBucket: gcsBucketFlag,
+		S3Bucket:          s3BucketFlag,
+		S3Endpoint:        s3EndpointFlag,
+	})
+}
+
+// datasetPath returns the path of the dataset of the config, with its name and version if they're set.
+func datasetPath(config ethwal.OptionsConfig) string {
+	if config.Path == "" || (config.Name == "" && config.Version == "") {
+		return config.Path
+	}
+	return ethwal.Dataset{Name: config.Name, Version: config.Version, Path: config.Path}.FullPath()
+}
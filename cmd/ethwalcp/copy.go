@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/0xsequence/ethwal"
+	"github.com/0xsequence/ethwal/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// fileIndexCheckpointInterval is the number of copied files after which the destination file index is saved,
+// so that the interrupted copy doesn't need to check the existence of the copied files on resume.
+const fileIndexCheckpointInterval = 10_000
+
+// resumeVerifyInterval is the interval of the already indexed files which sizes are checked with --resume-verify.
+const resumeVerifyInterval = 100
+
+// progressInterval is the interval of the progress output.
+const progressInterval = 10 * time.Second
+
+type copyOptions struct {
+	Workers int
+	// ResumeVerify spot-checks sizes of the files that are already in the destination file index.
+	ResumeVerify bool
+	// Verify compares the sizes of all files that are already in the destination with the source before they're
+	// skipped, the files that differ are copied again.
+	Verify bool
+	// VerifyDigest compares the sha256 digests of the files too, the files are read from both file systems.
+	VerifyDigest bool
+	// DryRun prints the files that would be copied without writing to the destination.
+	DryRun bool
+	// Dedupe skips the upload of the files that are already stored in the destination storage.
+	Dedupe *dedupeTarget
+}
+
+// copyProgress counts the files and the bytes for the progress output. The total is the number of the source
+// files listed so far.
+type copyProgress struct {
+	start time.Time
+
+	total  atomic.Int64
+	done   atomic.Int64
+	copied atomic.Int64
+	bytes  atomic.Int64
+}
+
+func (p *copyProgress) String() string {
+	elapsed := time.Since(p.start).Seconds()
+	return fmt.Sprintf("Progress: %d/%d files, %d copied, %.2f MB/s", p.done.Load(), p.total.Load(), p.copied.Load(),
+		float64(p.bytes.Load())/elapsed/1e6)
+}
+
+// report prints the progress every progressInterval until done is closed.
+func (p *copyProgress) report(done <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fmt.Println(p)
+		case <-done:
+			return
+		}
+	}
+}
+
+// dedupeTarget is the dedupe index of the destination storage and the destination dataset path in it.
+type dedupeTarget struct {
+	Index *ethwal.DedupeIndex
+	// Prefix is the path of the destination dataset in the file system of the index.
+	Prefix string
+}
+
+type fileRange [2]uint64
+
+func newFileRange(file *ethwal.File) fileRange {
+	return fileRange{file.FirstBlockNum, file.LastBlockNum}
+}
+
+// destinationIndex keeps the destination file index, the copied files are merged into it.
+type destinationIndex struct {
+	fs storage.FS
+
+	mu       sync.Mutex
+	files    map[fileRange]*ethwal.File
+	unsaved  int
+	modified bool
+}
+
+// loadDestinationIndex loads the destination file index if it exists.
+func loadDestinationIndex(ctx context.Context, fs storage.FS) (*destinationIndex, error) {
+	idx := &destinationIndex{
+		fs:    fs,
+		files: make(map[fileRange]*ethwal.File),
+	}
+
+	_, err := fs.Attributes(ctx, ethwal.FileIndexFileName, nil)
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return idx, nil
+		}
+		return nil, err
+	}
+
+	err = ethwal.NewFileIndex(fs).Stream(ctx, func(file *ethwal.File) error {
+		idx.files[newFileRange(file)] = file
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (d *destinationIndex) contains(file *ethwal.File) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.files[newFileRange(file)]
+	return ok
+}
+
+// add adds the copied file and saves the index every fileIndexCheckpointInterval files.
+func (d *destinationIndex) add(ctx context.Context, file *ethwal.File) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.files[newFileRange(file)]; ok {
+		return nil
+	}
+	// the file is copied as is, its checksum and digest root hold for the destination
+	d.files[newFileRange(file)] = file.Clone()
+	d.modified = true
+
+	d.unsaved++
+	if d.unsaved < fileIndexCheckpointInterval {
+		return nil
+	}
+	return d.save(ctx)
+}
+
+// Save saves the index if it was modified or doesn't exist yet.
+func (d *destinationIndex) Save(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.save(ctx)
+}
+
+func (d *destinationIndex) save(ctx context.Context) error {
+	if !d.modified && len(d.files) > 0 {
+		return nil
+	}
+
+	files := make([]*ethwal.File, 0, len(d.files))
+	for _, file := range d.files {
+		files = append(files, file)
+	}
+
+	err := ethwal.NewFileIndexFromFiles(d.fs, files).Save(ctx)
+	if err != nil {
+		return err
+	}
+
+	d.unsaved = 0
+	d.modified = false
+	return nil
+}
+
+// copyDataset copies the files from the source to the destination. The files that are in the destination
+// file index are skipped without checking their existence, the copied files are merged into the destination
+// file index, so the files that exist only in the destination are kept.
+func copyDataset(ctx context.Context, srcFs storage.FS, dstFs storage.FS, opt copyOptions) error {
+	dstIndex, err := loadDestinationIndex(ctx, dstFs)
+	if err != nil {
+		return fmt.Errorf("unable to load destination file index: %w", err)
+	}
+
+	progress := &copyProgress{start: time.Now()}
+	progressDone := make(chan struct{})
+	go progress.report(progressDone)
+	defer func() {
+		close(progressDone)
+		fmt.Println(progress)
+	}()
+
+	errorGroup, gCtx := errgroup.WithContext(ctx)
+
+	var filesChan = make(chan *ethwal.File, opt.Workers)
+	errorGroup.Go(func() error {
+		defer close(filesChan)
+
+		var indexed int
+		err := ethwal.NewFileIndex(srcFs).Stream(gCtx, func(file *ethwal.File) error {
+			progress.total.Add(1)
+			if dstIndex.contains(file) {
+				indexed++
+				if !opt.Verify && (!opt.ResumeVerify || indexed%resumeVerifyInterval != 0) {
+					fmt.Printf("File[%d-%d]: %s already indexed, skipping\n", file.FirstBlockNum, file.LastBlockNum, file.Path())
+					progress.done.Add(1)
+					return nil
+				}
+			}
+
+			select {
+			case filesChan <- file:
+				return nil
+			case <-gCtx.Done():
+				return gCtx.Err()
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("unable to list ethwal files: %w", err)
+		}
+		return nil
+	})
+
+	for i := 0; i < opt.Workers; i++ {
+		errorGroup.Go(func() error {
+			for file := range filesChan {
+				copied, err := copyFile(gCtx, srcFs, dstFs, dstIndex, opt, progress, file)
+				if err != nil {
+					return err
+				}
+				if !copied {
+					fmt.Printf("File[%d-%d]: %s already exists, skipping\n", file.FirstBlockNum, file.LastBlockNum, file.Path())
+				}
+				progress.done.Add(1)
+
+				if opt.DryRun {
+					continue
+				}
+				err = dstIndex.add(gCtx, file)
+				if err != nil {
+					return fmt.Errorf("unable to save file index: %w", err)
+				}
+			}
+			return nil
+		})
+	}
+
+	if err := errorGroup.Wait(); err != nil {
+		if opt.DryRun {
+			return fmt.Errorf("error listing files: %w", err)
+		}
+
+		// keep the progress for the resume
+		_ = dstIndex.Save(ctx)
+		if opt.Dedupe != nil {
+			_ = opt.Dedupe.Index.Save(ctx)
+		}
+		return fmt.Errorf("error copying files: %w", err)
+	}
+
+	if opt.DryRun {
+		return nil
+	}
+
+	if opt.Dedupe != nil {
+		err = opt.Dedupe.Index.Save(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to save dedupe index: %w", err)
+		}
+	}
+
+	// blocks may reference offloaded data, the blobs are copied before the file index
+	err = copyBlobs(ctx, srcFs, dstFs, opt.Workers)
+	if err != nil {
+		return fmt.Errorf("unable to copy blobs: %w", err)
+	}
+
+	err = dstIndex.Save(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to save file index: %w", err)
+	}
+	return nil
+}
+
+// copyFile copies the file if it isn't stored completely in the destination, see needsCopy. With the dedupe
+// index, the file which content is already stored in the destination storage is copied within the storage
+// instead of uploaded. The file is printed only with DryRun.
+func copyFile(ctx context.Context, srcFs storage.FS, dstFs storage.FS, dstIndex *destinationIndex, opt copyOptions, progress *copyProgress, file *ethwal.File) (bool, error) {
+	copyNeeded, err := needsCopy(ctx, srcFs, dstFs, dstIndex, opt, file)
+	if err != nil || !copyNeeded {
+		return false, err
+	}
+	progress.copied.Add(1)
+
+	if opt.DryRun {
+		fmt.Printf("Would copy file[%d-%d]: %s\n", file.FirstBlockNum, file.LastBlockNum, file.Path())
+		return true, nil
+	}
+
+	var digest string
+	var deduplicated bool
+	dedupe := opt.Dedupe
+	if dedupe != nil {
+		digest, err = ethwal.ObjectDigest(ctx, srcFs, file.Path())
+		if err != nil {
+			return false, fmt.Errorf("unable to digest source file: %w", err)
+		}
+
+		deduplicated, err = dedupe.Index.CopyDeduplicated(ctx, digest, dedupe.Prefix+file.Path())
+		if err != nil {
+			return false, fmt.Errorf("unable to copy deduplicated file: %w", err)
+		}
+	}
+
+	if deduplicated {
+		fmt.Printf("File[%d-%d]: %s already stored, copied within destination\n", file.FirstBlockNum, file.LastBlockNum, file.Path())
+	} else {
+		fmt.Printf("Copying file[%d-%d]: %s\n", file.FirstBlockNum, file.LastBlockNum, file.Path())
+		err = uploadFile(ctx, srcFs, dstFs, progress, file)
+		if err != nil {
+			return false, err
+		}
+
+		if dedupe != nil {
+			dedupe.Index.Record(digest, dedupe.Prefix+file.Path())
+		}
+	}
+
+	if file.Bloom {
+		err = copySidecar(ctx, srcFs, dstFs, file.BloomPath())
+		if err != nil {
+			return false, fmt.Errorf("unable to copy bloom filter: %w", err)
+		}
+	}
+
+	// the block digests are copied as is, so that the audits validate against the digests of the source writer
+	if file.DigestRoot != nil {
+		err = copySidecar(ctx, srcFs, dstFs, file.DigestsPath())
+		if err != nil {
+			return false, fmt.Errorf("unable to copy block digests: %w", err)
+		}
+	}
+	return true, nil
+}
+
+// needsCopy returns true if the file doesn't exist in the destination or it failed the verification. The files
+// in the destination index reach the workers only to be verified, the files that exist are verified with Verify.
+func needsCopy(ctx context.Context, srcFs storage.FS, dstFs storage.FS, dstIndex *destinationIndex, opt copyOptions, file *ethwal.File) (bool, error) {
+	if !dstIndex.contains(file) {
+		if !file.Exist(ctx, dstFs) {
+			return true, nil
+		}
+		if !opt.Verify {
+			return false, nil
+		}
+	}
+
+	verified, err := verifyFile(ctx, srcFs, dstFs, file, opt.VerifyDigest)
+	if err != nil {
+		return false, err
+	}
+	if !verified {
+		fmt.Printf("File[%d-%d]: %s failed verification, copying again\n", file.FirstBlockNum, file.LastBlockNum, file.Path())
+	}
+	return !verified, nil
+}
+
+// verifyFile returns true if the destination file has the size of the source file, and the digest with digest.
+func verifyFile(ctx context.Context, srcFs storage.FS, dstFs storage.FS, file *ethwal.File, digest bool) (bool, error) {
+	srcSize, err := file.Size(ctx, srcFs)
+	if err != nil {
+		return false, fmt.Errorf("unable to verify source file: %w", err)
+	}
+
+	dstSize, err := file.Size(ctx, dstFs)
+	if err != nil || srcSize != dstSize {
+		return false, nil
+	}
+	if !digest {
+		return true, nil
+	}
+
+	srcDigest, err := ethwal.ObjectDigest(ctx, srcFs, file.Path())
+	if err != nil {
+		return false, fmt.Errorf("unable to digest source file: %w", err)
+	}
+
+	dstDigest, err := ethwal.ObjectDigest(ctx, dstFs, file.Path())
+	if err != nil {
+		return false, nil
+	}
+	return srcDigest == dstDigest, nil
+}
+
+// uploadFile copies the file data from the source to the destination.
+func uploadFile(ctx context.Context, srcFs storage.FS, dstFs storage.FS, progress *copyProgress, file *ethwal.File) error {
+	srcFile, err := file.Open(ctx, srcFs)
+	if err != nil {
+		return fmt.Errorf("unable to open source file: %w", err)
+	}
+	defer srcFile.Close()
+
+	n, err := writeStaged(ctx, dstFs, file.Path(), srcFile)
+	if err != nil {
+		return fmt.Errorf("unable to copy file: %w", err)
+	}
+	progress.bytes.Add(n)
+	return nil
+}
+
+// writeStaged writes the object to the staging path and moves it to the path once it's complete, so that
+// the interrupted copy never leaves the partial object at the path. The staging object is deleted if the
+// write fails.
+func writeStaged(ctx context.Context, fs storage.FS, path string, src io.Reader) (int64, error) {
+	stagingPath := path + ethwal.StagingFileSuffix
+
+	dst, err := fs.Create(ctx, stagingPath, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		_ = dst.Close()
+		_ = fs.Delete(ctx, stagingPath)
+		return 0, err
+	}
+
+	err = dst.Close()
+	if err != nil {
+		_ = fs.Delete(ctx, stagingPath)
+		return 0, err
+	}
+	return n, storage.Rename(ctx, fs, stagingPath, path)
+}
+
+// copySidecar copies the object stored next to the file, like the bloom filter, the missing object is
+// skipped as the readers treat the file as containing any key and the audits report the missing digests.
+func copySidecar(ctx context.Context, srcFs storage.FS, dstFs storage.FS, path string) error {
+	srcFile, err := srcFs.Open(ctx, path, nil)
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer srcFile.Close()
+
+	_, err = writeStaged(ctx, dstFs, path, srcFile)
+	return err
+}
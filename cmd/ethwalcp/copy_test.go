@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/0xsequence/ethwal"
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/local"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+// countingFS counts the Attributes calls.
+type countingFS struct {
+	storage.FS
+	attributes atomic.Int64
+}
+
+func (c *countingFS) Attributes(ctx context.Context, path string, options *gostorage.ReaderOptions) (*gostorage.Attributes, error) {
+	c.attributes.Add(1)
+	return c.FS.Attributes(ctx, path, options)
+}
+
+const testNumberOfBlocks = 100
+
+// setupSourceDataset writes the dataset with one file per block.
+func setupSourceDataset(t *testing.T) (string, []*ethwal.File) {
+	srcPath := t.TempDir()
+
+	w, err := ethwal.NewWriter[int](ethwal.Options{
+		Dataset:         ethwal.Dataset{Path: srcPath},
+		FileRollPolicy:  ethwal.NewLastBlockNumberRollPolicy(1),
+		FileRollOnClose: true,
+	})
+	require.NoError(t, err)
+	for i := 1; i <= testNumberOfBlocks; i++ {
+		require.NoError(t, w.Write(context.Background(), ethwal.Block[int]{Number: uint64(i), Data: i}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	files, err := ethwal.ListFiles(context.Background(), local.NewLocalFS(srcPath))
+	require.NoError(t, err)
+	require.Len(t, files, testNumberOfBlocks)
+	return srcPath, files
+}
+
+// copyFiles copies the files to the destination without updating the file index.
+func copyFiles(t *testing.T, srcFs, dstFs storage.FS, files []*ethwal.File) {
+	for _, file := range files {
+		src, err := file.Open(context.Background(), srcFs)
+		require.NoError(t, err)
+		dst, err := file.Create(context.Background(), dstFs)
+		require.NoError(t, err)
+		_, err = io.Copy(dst, src)
+		require.NoError(t, err)
+		require.NoError(t, dst.Close())
+		require.NoError(t, src.Close())
+	}
+}
+
+func readBlockNums(t *testing.T, datasetPath string) []uint64 {
+	r, err := ethwal.NewReader[int](ethwal.Options{Dataset: ethwal.Dataset{Path: datasetPath}})
+	require.NoError(t, err)
+	defer r.Close()
+
+	var blockNums []uint64
+	for {
+		b, err := r.Read(context.Background())
+		if errors.Is(err, io.EOF) {
+			return blockNums
+		}
+		require.NoError(t, err)
+		blockNums = append(blockNums, b.Number)
+	}
+}
+
+func TestCopyDataset_Checksums(t *testing.T) {
+	srcPath, files := setupSourceDataset(t)
+	dstPath := t.TempDir()
+	dstFs := local.NewLocalFS(dstPath)
+
+	require.NoError(t, copyDataset(context.Background(), local.NewLocalFS(srcPath), dstFs, copyOptions{Workers: 4}))
+
+	// the destination file index keeps the checksums of the source files
+	dstFiles, err := ethwal.ListFiles(context.Background(), dstFs)
+	require.NoError(t, err)
+	require.Len(t, dstFiles, len(files))
+	for i, file := range files {
+		require.NotZero(t, file.ContentSize)
+		require.NotEmpty(t, file.Checksum)
+		require.Equal(t, file.ContentSize, dstFiles[i].ContentSize)
+		require.Equal(t, file.Checksum, dstFiles[i].Checksum)
+	}
+
+	// the copied files are verified against them
+	r, err := ethwal.NewReader[int](ethwal.Options{Dataset: ethwal.Dataset{Path: dstPath}, VerifyChecksumOnRead: true})
+	require.NoError(t, err)
+	defer r.Close()
+	for i := 1; i <= testNumberOfBlocks; i++ {
+		_, err := r.Read(context.Background())
+		require.NoError(t, err)
+	}
+}
+
+func TestCopyDataset_Resume(t *testing.T) {
+	srcPath, files := setupSourceDataset(t)
+	srcFs := local.NewLocalFS(srcPath)
+
+	var expected []uint64
+	for i := uint64(1); i <= testNumberOfBlocks; i++ {
+		expected = append(expected, i)
+	}
+
+	t.Run("indexed", func(t *testing.T) {
+		dstPath := t.TempDir()
+		dstFs := local.NewLocalFS(dstPath)
+
+		// the first half was copied and indexed, the destination has the file that isn't in the source
+		extra := &ethwal.File{FirstBlockNum: 1000, LastBlockNum: 1000}
+		copyFiles(t, srcFs, dstFs, files[:testNumberOfBlocks/2])
+		extraFile, err := extra.Create(context.Background(), dstFs)
+		require.NoError(t, err)
+		require.NoError(t, extraFile.Close())
+		require.NoError(t, ethwal.NewFileIndexFromFiles(dstFs, append([]*ethwal.File{extra}, files[:testNumberOfBlocks/2]...)).Save(context.Background()))
+
+		countingDstFs := &countingFS{FS: dstFs}
+		require.NoError(t, copyDataset(context.Background(), srcFs, countingDstFs, copyOptions{Workers: 4}))
+
+		// the existence is checked only for the remaining files, at the new and the legacy path,
+		// plus the file index and its last entry
+		remaining := int64(testNumberOfBlocks - testNumberOfBlocks/2)
+		require.LessOrEqual(t, countingDstFs.attributes.Load(), remaining*2+2)
+
+		dstFiles, err := ethwal.ListFiles(context.Background(), dstFs)
+		require.NoError(t, err)
+		require.Len(t, dstFiles, testNumberOfBlocks+1)
+		require.Equal(t, extra.FirstBlockNum, dstFiles[len(dstFiles)-1].FirstBlockNum)
+	})
+
+	t.Run("not_indexed", func(t *testing.T) {
+		dstPath := t.TempDir()
+		dstFs := local.NewLocalFS(dstPath)
+
+		// the first half was copied, but the copy was interrupted before the file index was saved
+		copyFiles(t, srcFs, dstFs, files[:testNumberOfBlocks/2])
+
+		require.NoError(t, copyDataset(context.Background(), srcFs, dstFs, copyOptions{Workers: 4}))
+		require.Equal(t, expected, readBlockNums(t, dstPath))
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		dstPath := t.TempDir()
+		dstFs := local.NewLocalFS(dstPath)
+
+		require.NoError(t, copyDataset(context.Background(), srcFs, dstFs, copyOptions{Workers: 4}))
+
+		// the file that is indexed but was not copied completely
+		truncated := files[resumeVerifyInterval-1]
+		require.NoError(t, os.Truncate(path.Join(dstPath, truncated.Path()), 1))
+
+		require.NoError(t, copyDataset(context.Background(), srcFs, dstFs, copyOptions{Workers: 4}))
+		size, err := truncated.Size(context.Background(), dstFs)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), size)
+
+		require.NoError(t, copyDataset(context.Background(), srcFs, dstFs, copyOptions{Workers: 4, ResumeVerify: true}))
+		require.Equal(t, expected, readBlockNums(t, dstPath))
+	})
+
+	t.Run("verify_all", func(t *testing.T) {
+		dstPath := t.TempDir()
+		dstFs := local.NewLocalFS(dstPath)
+
+		// the file that was not copied completely, either indexed or not
+		copyFiles(t, srcFs, dstFs, files[:testNumberOfBlocks/2])
+		require.NoError(t, ethwal.NewFileIndexFromFiles(dstFs, files[:testNumberOfBlocks/4]).Save(context.Background()))
+		for _, file := range []*ethwal.File{files[1], files[testNumberOfBlocks/2-1]} {
+			require.NoError(t, os.Truncate(path.Join(dstPath, file.Path()), 1))
+		}
+
+		require.NoError(t, copyDataset(context.Background(), srcFs, dstFs, copyOptions{Workers: 4, Verify: true, VerifyDigest: true}))
+		require.Equal(t, expected, readBlockNums(t, dstPath))
+		for _, file := range files {
+			digest, err := ethwal.ObjectDigest(context.Background(), dstFs, file.Path())
+			require.NoError(t, err)
+			srcDigest, err := ethwal.ObjectDigest(context.Background(), srcFs, file.Path())
+			require.NoError(t, err)
+			require.Equal(t, srcDigest, digest)
+
+			// the staged copies are finalized
+			_, err = os.Stat(path.Join(dstPath, file.Path()+ethwal.StagingFileSuffix))
+			require.True(t, os.IsNotExist(err))
+		}
+	})
+
+	t.Run("dry_run", func(t *testing.T) {
+		dstPath := t.TempDir()
+		dstFs := local.NewLocalFS(dstPath)
+
+		require.NoError(t, copyDataset(context.Background(), srcFs, dstFs, copyOptions{Workers: 4, DryRun: true}))
+
+		entries, err := os.ReadDir(dstPath)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+}
+
+// archiveFS counts the uploaded bytes per path, the copies within the archive are not uploads.
+type archiveFS struct {
+	storage.FS
+
+	mu       sync.Mutex
+	uploaded map[string]int64
+}
+
+type countingWriter struct {
+	io.WriteCloser
+	count func(n int)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.count(n)
+	return n, err
+}
+
+func (a *archiveFS) Create(ctx context.Context, path string, options *gostorage.WriterOptions) (io.WriteCloser, error) {
+	file, err := a.FS.Create(ctx, path, options)
+	if err != nil {
+		return nil, err
+	}
+	return &countingWriter{WriteCloser: file, count: func(n int) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.uploaded[path] += int64(n)
+	}}, nil
+}
+
+func (a *archiveFS) Copy(ctx context.Context, srcPath, dstPath string) error {
+	return storage.Copy(ctx, a.FS, srcPath, dstPath)
+}
+
+// uploadedFiles returns the bytes uploaded as the data files of the dataset under the prefix, the files are
+// uploaded to their staging paths.
+func (a *archiveFS) uploadedFiles(prefix string, files []*ethwal.File) int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var uploaded int64
+	for _, file := range files {
+		uploaded += a.uploaded[prefix+file.Path()] + a.uploaded[prefix+file.Path()+ethwal.StagingFileSuffix]
+	}
+	return uploaded
+}
+
+// setupOverlappingDataset writes the dataset with one file per block, the files of the first shared blocks
+// are identical to the files of setupSourceDataset.
+func setupOverlappingDataset(t *testing.T, shared int) (string, []*ethwal.File) {
+	srcPath := t.TempDir()
+
+	w, err := ethwal.NewWriter[int](ethwal.Options{
+		Dataset:         ethwal.Dataset{Path: srcPath},
+		FileRollPolicy:  ethwal.NewLastBlockNumberRollPolicy(1),
+		FileRollOnClose: true,
+	})
+	require.NoError(t, err)
+	for i := 1; i <= testNumberOfBlocks; i++ {
+		data := i
+		if i > shared {
+			data = -i
+		}
+		require.NoError(t, w.Write(context.Background(), ethwal.Block[int]{Number: uint64(i), Data: data}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	files, err := ethwal.ListFiles(context.Background(), local.NewLocalFS(srcPath))
+	require.NoError(t, err)
+	return srcPath, files
+}
+
+func filesSize(t *testing.T, fs storage.FS, files []*ethwal.File) int64 {
+	var size int64
+	for _, file := range files {
+		fileSize, err := file.Size(context.Background(), fs)
+		require.NoError(t, err)
+		size += fileSize
+	}
+	return size
+}
+
+func copyToArchive(t *testing.T, archive *archiveFS, srcPath string, prefix string) {
+	index, err := ethwal.LoadDedupeIndex(context.Background(), archive, "dedupe")
+	require.NoError(t, err)
+
+	err = copyDataset(context.Background(), local.NewLocalFS(srcPath), storage.NewPrefixWrapper(archive, prefix), copyOptions{
+		Workers: 4,
+		Dedupe:  &dedupeTarget{Index: index, Prefix: prefix},
+	})
+	require.NoError(t, err)
+}
+
+func TestCopyDataset_Dedupe(t *testing.T) {
+	const shared = testNumberOfBlocks * 8 / 10
+
+	firstPath, firstFiles := setupSourceDataset(t)
+	secondPath, secondFiles := setupOverlappingDataset(t, shared)
+
+	t.Run("sequential", func(t *testing.T) {
+		archive := &archiveFS{FS: gostorage.NewMemoryFS(), uploaded: make(map[string]int64)}
+
+		copyToArchive(t, archive, firstPath, "archive/first/")
+		require.Equal(t, filesSize(t, local.NewLocalFS(firstPath), firstFiles), archive.uploadedFiles("archive/first/", firstFiles))
+
+		// only the files that differ from the first dataset are uploaded
+		copyToArchive(t, archive, secondPath, "archive/second/")
+		require.Equal(t, filesSize(t, local.NewLocalFS(secondPath), secondFiles[shared:]), archive.uploadedFiles("archive/second/", secondFiles))
+
+		// the copies of the deduplicated files are readable
+		for _, prefix := range []string{"archive/first/", "archive/second/"} {
+			files, err := ethwal.ListFiles(context.Background(), storage.NewPrefixWrapper(archive, prefix))
+			require.NoError(t, err)
+			require.Len(t, files, testNumberOfBlocks)
+		}
+		r, err := ethwal.NewReader[int](ethwal.Options{Dataset: ethwal.Dataset{Path: "archive/second"}, FileSystem: archive})
+		require.NoError(t, err)
+		defer r.Close()
+		for i := 1; i <= testNumberOfBlocks; i++ {
+			b, err := r.Read(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), b.Number)
+		}
+	})
+
+	t.Run("concurrent_jobs", func(t *testing.T) {
+		archive := &archiveFS{FS: gostorage.NewMemoryFS(), uploaded: make(map[string]int64)}
+
+		// the concurrent jobs upload the shared files each, their manifest entries are merged
+		var wg sync.WaitGroup
+		for prefix, srcPath := range map[string]string{"archive/first/": firstPath, "archive/second/": secondPath} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				copyToArchive(t, archive, srcPath, prefix)
+			}()
+		}
+		wg.Wait()
+
+		index, err := ethwal.LoadDedupeIndex(context.Background(), archive, "dedupe")
+		require.NoError(t, err)
+		require.Equal(t, testNumberOfBlocks+testNumberOfBlocks-shared, index.Len())
+
+		// the next job finds all files in the merged manifest
+		copyToArchive(t, archive, secondPath, "archive/third/")
+		require.Zero(t, archive.uploadedFiles("archive/third/", secondFiles))
+	})
+}
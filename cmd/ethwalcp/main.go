@@ -1,22 +1,34 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"os"
+	"path/filepath"
 
+	"github.com/0xsequence/ethkit/go-ethereum/common"
 	"github.com/0xsequence/ethwal"
 	"github.com/0xsequence/ethwal/storage"
 	"github.com/0xsequence/ethwal/storage/gcloud"
 	"github.com/0xsequence/ethwal/storage/local"
+	"github.com/0xsequence/ethwal/storage/s3"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/sync/errgroup"
 )
 
+var SourceConfigFlag = &cli.StringFlag{
+	Name:  "config",
+	Usage: "source dataset options config file, yaml or json, see ethwal.OptionsConfig, the src flags set override it",
+}
+
+var DestinationConfigFlag = &cli.StringFlag{
+	Name:  "dst-config",
+	Usage: "destination dataset options config file, yaml or json, the dst flags set override it",
+}
+
 var SourceDatasetPathFlag = &cli.StringFlag{
-	Name:     "src-path",
-	Usage:    "source path to read",
-	Required: true,
+	Name:  "src-path",
+	Usage: "source path to read, required unless set by --config",
 }
 
 var SourceGoogleCloudBucket = &cli.StringFlag{
@@ -25,9 +37,8 @@ var SourceGoogleCloudBucket = &cli.StringFlag{
 }
 
 var DestinationDatasetPathFlag = &cli.StringFlag{
-	Name:     "dst-path",
-	Usage:    "destination path to write",
-	Required: true,
+	Name:  "dst-path",
+	Usage: "destination path to write, required unless set by --dst-config",
 }
 
 var DestinationGoogleCloudBucket = &cli.StringFlag{
@@ -35,107 +46,191 @@ var DestinationGoogleCloudBucket = &cli.StringFlag{
 	Usage: "estination google cloud bucket",
 }
 
+var SourceS3Bucket = &cli.StringFlag{
+	Name:  "src-s3-bucket",
+	Usage: "source s3 bucket, with the default aws credentials",
+}
+
+var SourceS3Endpoint = &cli.StringFlag{
+	Name:  "src-s3-endpoint",
+	Usage: "endpoint of the source s3-compatible service, e.g. minio",
+}
+
+var DestinationS3Bucket = &cli.StringFlag{
+	Name:  "dst-s3-bucket",
+	Usage: "destination s3 bucket, with the default aws credentials",
+}
+
+var DestinationS3Endpoint = &cli.StringFlag{
+	Name:  "dst-s3-endpoint",
+	Usage: "endpoint of the destination s3-compatible service, e.g. minio",
+}
+
 var ConcurrentWorkers = &cli.IntFlag{
 	Name:  "workers",
 	Usage: "number of concurrent workers",
 	Value: 10,
 }
 
+var ResumeVerify = &cli.BoolFlag{
+	Name:  "resume-verify",
+	Usage: "spot-check sizes of the files already present in the destination file index",
+}
+
+var Verify = &cli.BoolFlag{
+	Name:  "verify",
+	Usage: "compare sizes of all files already present in the destination, the files that differ are copied again",
+}
+
+var VerifyDigest = &cli.BoolFlag{
+	Name:  "verify-digest",
+	Usage: "compare sha256 digests of the files too, implies --verify",
+}
+
+var DryRun = &cli.BoolFlag{
+	Name:  "dry-run",
+	Usage: "print the files that would be copied without writing to the destination",
+}
+
+var DedupeIndexPath = &cli.StringFlag{
+	Name:  "dedupe-index",
+	Usage: "path of the dedupe index in the destination bucket, the files already stored in the bucket are copied within it instead of uploaded",
+}
+
+// copyBlobs copies the blobs that don't exist in the destination.
+func copyBlobs(ctx context.Context, srcFs storage.FS, dstFs storage.FS, workers int) error {
+	srcBlobs := ethwal.NewFSBlobStore(srcFs)
+	dstBlobs := ethwal.NewFSBlobStore(dstFs)
+
+	errorGroup, gCtx := errgroup.WithContext(ctx)
+	errorGroup.SetLimit(workers)
+
+	err := srcBlobs.Walk(gCtx, func(hash common.Hash) error {
+		errorGroup.Go(func() error {
+			data, err := srcBlobs.Get(gCtx, hash)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Copying blob: %s\n", hash)
+			return dstBlobs.Put(gCtx, hash, data)
+		})
+		return nil
+	})
+	if err != nil {
+		_ = errorGroup.Wait()
+		return err
+	}
+	return errorGroup.Wait()
+}
+
+// bucketFS returns the file system of the google cloud or the s3 bucket of the config, nil if no bucket is set.
+func bucketFS(c *cli.Context, config ethwal.OptionsConfig) (storage.FS, error) {
+	if config.GoogleCloudBucket != "" {
+		return gcloud.NewGCloudFS(config.GoogleCloudBucket, nil), nil
+	}
+	if config.S3Bucket != "" {
+		var options []s3.Option
+		if config.S3Endpoint != "" {
+			options = append(options, s3.WithEndpoint(config.S3Endpoint))
+		}
+		return s3.NewDefaultS3FS(c.Context, config.S3Bucket, options...)
+	}
+	return nil, nil
+}
+
 func main() {
 	app := cli.App{
 		Name:  "ethwalcp",
 		Usage: "tool to copy ethwal",
 		Flags: []cli.Flag{
+			SourceConfigFlag,
+			DestinationConfigFlag,
 			SourceDatasetPathFlag,
 			SourceGoogleCloudBucket,
 			DestinationDatasetPathFlag,
 			DestinationGoogleCloudBucket,
+			SourceS3Bucket,
+			SourceS3Endpoint,
+			DestinationS3Bucket,
+			DestinationS3Endpoint,
 			ConcurrentWorkers,
+			ResumeVerify,
+			Verify,
+			VerifyDigest,
+			DryRun,
+			DedupeIndexPath,
 		},
 		Action: func(c *cli.Context) error {
-			var srcFs storage.FS = local.NewLocalFS(c.String(SourceDatasetPathFlag.Name))
-			if bucket := c.String(SourceGoogleCloudBucket.Name); bucket != "" {
-				srcFs = gcloud.NewGCloudFS(bucket, nil)
-				srcFs = storage.NewPrefixWrapper(srcFs, c.String(SourceDatasetPathFlag.Name))
+			srcConfig, err := datasetConfig(c, SourceConfigFlag, SourceDatasetPathFlag, SourceGoogleCloudBucket, SourceS3Bucket, SourceS3Endpoint)
+			if err != nil {
+				return err
 			}
-
-			var dstFs storage.FS = local.NewLocalFS(c.String(DestinationDatasetPathFlag.Name))
-			if bucket := c.String(DestinationGoogleCloudBucket.Name); bucket != "" {
-				dstFs = gcloud.NewGCloudFS(bucket, nil)
-				dstFs = storage.NewPrefixWrapper(dstFs, c.String(DestinationDatasetPathFlag.Name))
+			dstConfig, err := datasetConfig(c, DestinationConfigFlag, DestinationDatasetPathFlag, DestinationGoogleCloudBucket, DestinationS3Bucket, DestinationS3Endpoint)
+			if err != nil {
+				return err
+			}
+			srcPath, dstPath := datasetPath(srcConfig), datasetPath(dstConfig)
+			if srcPath == "" || dstPath == "" {
+				return fmt.Errorf("the source and the destination paths are required")
 			}
 
-			errorGroup, gCtx := errgroup.WithContext(c.Context)
+			var srcFs storage.FS = local.NewLocalFS(srcPath)
+			srcBucketFs, err := bucketFS(c, srcConfig)
+			if err != nil {
+				return err
+			}
+			if srcBucketFs != nil {
+				srcFs = storage.NewPrefixWrapper(srcBucketFs, srcPath)
+			}
 
-			fileList, err := ethwal.ListFiles(c.Context, srcFs)
+			var dstFs storage.FS = local.NewLocalFS(dstPath)
+			// the root of the destination storage, the dedupe index references the files of all datasets in it
+			var dstRootFs storage.FS = local.NewLocalFS("")
+			var dstPrefix string
+			dstBucketFs, err := bucketFS(c, dstConfig)
 			if err != nil {
-				return fmt.Errorf("unable to list ethwal files: %w", err)
+				return err
+			}
+			if dstBucketFs != nil {
+				dstRootFs = dstBucketFs
+				dstPrefix = dstPath
+				dstFs = storage.NewPrefixWrapper(dstRootFs, dstPrefix)
 			}
 
-			var filesChan = make(chan *ethwal.File, c.Int(ConcurrentWorkers.Name))
-			errorGroup.Go(func() error {
-				defer close(filesChan)
-				for _, file := range fileList {
-					select {
-					case filesChan <- file:
-					case <-gCtx.Done():
-						return gCtx.Err()
+			var dedupe *dedupeTarget
+			if indexPath := c.String(DedupeIndexPath.Name); indexPath != "" {
+				if dstBucketFs == nil {
+					if indexPath, err = filepath.Abs(indexPath); err != nil {
+						return err
 					}
-				}
-				return nil
-			})
-
-			for i := 0; i < c.Int(ConcurrentWorkers.Name); i++ {
-				errorGroup.Go(func() error {
-					for file := range filesChan {
-						if file.Exist(gCtx, dstFs) {
-							fmt.Printf("File[%d-%d]: %s already exists, skipping\n", file.FirstBlockNum, file.LastBlockNum, file.Path())
-							continue
-						}
-
-						fmt.Printf("Copying file[%d-%d]: %s\n", file.FirstBlockNum, file.LastBlockNum, file.Path())
-						srcFile, err := file.Open(gCtx, srcFs)
-						if err != nil {
-							return fmt.Errorf("unable to open source file: %w", err)
-						}
-						closer := srcFile.Close
-
-						dstFile, err := file.Create(gCtx, dstFs)
-						if err != nil {
-							_ = closer()
-							return fmt.Errorf("unable to create destination file: %w", err)
-						}
-						closer = func() error {
-							if err := srcFile.Close(); err != nil {
-								_ = dstFile.Close()
-								return err
-							}
-							return dstFile.Close()
-						}
-
-						_, err = io.Copy(dstFile, srcFile)
-						if err != nil {
-							_ = closer()
-							return fmt.Errorf("unable to copy file: %w", err)
-						}
-
-						err = closer()
-						if err != nil {
-							return fmt.Errorf("unable to close file: %w", err)
-						}
+					if dstPrefix, err = filepath.Abs(dstPath); err != nil {
+						return err
 					}
-					return nil
-				})
-			}
+					dstPrefix += string(os.PathSeparator)
+				}
 
-			if err := errorGroup.Wait(); err != nil {
-				return fmt.Errorf("error copying files: %w", err)
+				index, err := ethwal.LoadDedupeIndex(c.Context, dstRootFs, indexPath)
+				if err != nil {
+					return fmt.Errorf("unable to load dedupe index: %w", err)
+				}
+				dedupe = &dedupeTarget{Index: index, Prefix: dstPrefix}
 			}
 
-			fileIndexFile := ethwal.NewFileIndexFromFiles(dstFs, fileList)
-			err = fileIndexFile.Save(gCtx)
+			err = copyDataset(c.Context, srcFs, dstFs, copyOptions{
+				Workers:      c.Int(ConcurrentWorkers.Name),
+				ResumeVerify: c.Bool(ResumeVerify.Name),
+				Verify:       c.Bool(Verify.Name) || c.Bool(VerifyDigest.Name),
+				VerifyDigest: c.Bool(VerifyDigest.Name),
+				DryRun:       c.Bool(DryRun.Name),
+				Dedupe:       dedupe,
+			})
 			if err != nil {
-				return fmt.Errorf("unable to save file index: %w", err)
+				return err
+			}
+			if c.Bool(DryRun.Name) {
+				fmt.Println("Dry run complete")
+				return nil
 			}
 
 			fmt.Println("Copying complete")
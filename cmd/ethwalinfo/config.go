@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/0xsequence/ethwal"
+	"github.com/0xsequence/ethwal/internal/toolconfig"
+	"github.com/urfave/cli/v2"
+)
+
+// datasetConfig returns the config of the dataset, the config file of --config overridden by the dataset
+// flags set.
+func datasetConfig(c *cli.Context) (ethwal.OptionsConfig, error) {
+	return toolconfig.DatasetConfig(c, toolconfig.DatasetFlags{
+		Config:            ConfigFlag,
+		Path:              DatasetPathFlag,
+		Name:              DatasetNameFlag,
+		Version:           DatasetVersion,
+		GoogleCloudBucket: GoogleCloudBucket,
+		S3Bucket:          S3Bucket,
+		S3Endpoint:        S3Endpoint,
+	})
+}
@@ -4,18 +4,27 @@ import (
 	"cmp"
 	"fmt"
 	"os"
+	"path"
+	"slices"
+	"strings"
 
 	"github.com/0xsequence/ethwal"
+	"github.com/0xsequence/ethwal/internal/toolconfig"
 	"github.com/0xsequence/ethwal/storage"
 	"github.com/0xsequence/ethwal/storage/gcloud"
 	"github.com/0xsequence/ethwal/storage/local"
+	"github.com/0xsequence/ethwal/storage/s3"
 	"github.com/urfave/cli/v2"
 )
 
+var ConfigFlag = &cli.StringFlag{
+	Name:  "config",
+	Usage: "dataset options config file, yaml or json, see ethwal.OptionsConfig, the flags set override it",
+}
+
 var DatasetPathFlag = &cli.StringFlag{
-	Name:     "path",
-	Usage:    "path to read",
-	Required: true,
+	Name:  "path",
+	Usage: "path to read, required unless set by --config",
 }
 
 var DatasetNameFlag = &cli.StringFlag{
@@ -35,51 +44,279 @@ var GoogleCloudBucket = &cli.StringFlag{
 	Usage: "google cloud bucket",
 }
 
+var S3Bucket = &cli.StringFlag{
+	Name:  "s3-bucket",
+	Usage: "s3 bucket, with the default aws credentials",
+}
+
+var S3Endpoint = &cli.StringFlag{
+	Name:  "s3-endpoint",
+	Usage: "endpoint of the s3-compatible service, e.g. minio",
+}
+
+var DecoderFlag = &cli.StringFlag{
+	Name:  "decoder",
+	Usage: "decoder to use (cbor, json)",
+	Value: "cbor",
+}
+
+var DecompressorFlag = &cli.StringFlag{
+	Name:  "decompressor",
+	Usage: "decompressor to use (zstd, none)",
+	Value: "zstd",
+}
+
+var VerifyLevelFlag = &cli.StringFlag{
+	Name:  "level",
+	Usage: "verification level (file-index, files), the files are checked against their recorded sizes and checksums",
+	Value: "files",
+}
+
+var IndexFlag = &cli.StringSliceFlag{
+	Name:  "index",
+	Usage: "name of the index, all indexes of the dataset if not set",
+}
+
+func fileSystem(c *cli.Context, config ethwal.OptionsConfig) (storage.FS, error) {
+	if config.GoogleCloudBucket != "" {
+		return gcloud.NewGCloudFS(config.GoogleCloudBucket, nil), nil
+	}
+	if config.S3Bucket != "" {
+		var options []s3.Option
+		if config.S3Endpoint != "" {
+			options = append(options, s3.WithEndpoint(config.S3Endpoint))
+		}
+		return s3.NewDefaultS3FS(c.Context, config.S3Bucket, options...)
+	}
+	return local.NewLocalFS("./"), nil
+}
+
+func dataset(config ethwal.OptionsConfig) ethwal.Dataset {
+	return ethwal.Dataset{
+		Name:    config.Name,
+		Version: config.Version,
+		Path:    config.Path,
+	}
+}
+
+func verifyOptions(c *cli.Context) (ethwal.Options, ethwal.VerifyLevel, error) {
+	config, err := datasetConfig(c)
+	if err != nil {
+		return ethwal.Options{}, 0, err
+	}
+	config = toolconfig.WithCodec(c, config, DecoderFlag, DecompressorFlag)
+
+	// the config of the s3 bucket requires its file system
+	var opts []ethwal.Option
+	if config.S3Bucket != "" {
+		fs, err := fileSystem(c, config)
+		if err != nil {
+			return ethwal.Options{}, 0, err
+		}
+		opts = append(opts, ethwal.WithFileSystem(fs))
+	}
+
+	opt, err := config.NewOptions(opts...)
+	if err != nil {
+		return ethwal.Options{}, 0, err
+	}
+
+	for _, level := range []ethwal.VerifyLevel{ethwal.VerifyFileIndex, ethwal.VerifyFiles} {
+		if level.String() == c.String(VerifyLevelFlag.Name) {
+			return opt, level, nil
+		}
+	}
+	return ethwal.Options{}, 0, fmt.Errorf("unknown verification level: %s", c.String(VerifyLevelFlag.Name))
+}
+
+// indexNames returns the names of the indexes that have indexed blocks, the file system is mounted to
+// the indexes directory.
+func indexNames(c *cli.Context, fs storage.FS) ([]ethwal.IndexName, error) {
+	var names []ethwal.IndexName
+	for _, name := range c.StringSlice(IndexFlag.Name) {
+		names = append(names, ethwal.IndexName(name))
+	}
+	if len(names) > 0 {
+		return names, nil
+	}
+
+	err := fs.Walk(c.Context, "", func(objectPath string) error {
+		if strings.HasSuffix(objectPath, "/indexed") {
+			names = append(names, ethwal.IndexName(path.Dir(objectPath)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list indexes: %w", err)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
 func main() {
 	app := cli.App{
 		Name:  "ethwalinfo",
 		Usage: "tool to view ethwal",
 		Flags: []cli.Flag{
+			ConfigFlag,
 			DatasetPathFlag,
 			DatasetNameFlag,
 			DatasetVersion,
 			GoogleCloudBucket,
+			S3Bucket,
+			S3Endpoint,
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "verify",
+				Usage: "verify the integrity of the dataset files",
+				Flags: []cli.Flag{
+					DecoderFlag,
+					DecompressorFlag,
+					VerifyLevelFlag,
+				},
+				Action: func(c *cli.Context) error {
+					opt, level, err := verifyOptions(c)
+					if err != nil {
+						return err
+					}
+
+					report, err := ethwal.VerifyDataset[any](c.Context, opt, level)
+					if err != nil {
+						return err
+					}
+
+					for _, problem := range report.Problems {
+						fmt.Println(problem)
+					}
+					fmt.Println("Files:", report.Files)
+					fmt.Println("Blocks:", report.Blocks)
+					fmt.Println("Problems:", len(report.Problems))
+					if !report.OK() {
+						return fmt.Errorf("dataset verification failed")
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "index-stats",
+				Usage: "show the number of values, the sizes and the block coverage of the indexes",
+				Flags: []cli.Flag{
+					IndexFlag,
+				},
+				Action: func(c *cli.Context) error {
+					config, err := datasetConfig(c)
+					if err != nil {
+						return err
+					}
+
+					rootFs, err := fileSystem(c, config)
+					if err != nil {
+						return err
+					}
+
+					// mount fs to indexes directory
+					fs := storage.NewPrefixWrapper(rootFs, fmt.Sprintf("%s/", path.Join(dataset(config).FullPath(), ethwal.IndexesDirectory)))
+
+					names, err := indexNames(c, fs)
+					if err != nil {
+						return err
+					}
+					if len(names) == 0 {
+						fmt.Println("Indexes: -")
+						return nil
+					}
+
+					for _, name := range names {
+						index := ethwal.NewIndex[any](name, nil)
+						report, err := index.IndexStats(c.Context, fs)
+						if err != nil {
+							return err
+						}
+
+						fmt.Println("Index:", report.Index)
+						fmt.Println("  Values:", report.Values)
+						fmt.Println("  Bytes:", report.Bytes)
+						fmt.Println("  Block range:", report.RetentionFloor, "-", report.LastBlockNumIndexed)
+						if report.SealedBlockNum > 0 {
+							fmt.Println("  Sealed before:", report.SealedBlockNum)
+						} else {
+							fmt.Println("  Sealed before: -")
+						}
+						fmt.Println("  Largest values:")
+						for _, value := range report.Largest {
+							fmt.Printf("    %s: %d bytes, %d positions\n", value.Value, value.Bytes, value.Cardinality)
+						}
+					}
+					return nil
+				},
+			},
 		},
 		Action: func(c *cli.Context) error {
-			var fs storage.FS = local.NewLocalFS("./")
-			if bucket := c.String(GoogleCloudBucket.Name); bucket != "" {
-				fs = gcloud.NewGCloudFS(bucket, nil)
+			config, err := datasetConfig(c)
+			if err != nil {
+				return err
+			}
+			if config.Path == "" {
+				return fmt.Errorf("--%s or the path of --%s is required", DatasetPathFlag.Name, ConfigFlag.Name)
 			}
+			dataset := dataset(config)
 
-			dataset := ethwal.Dataset{
-				Name:    c.String(DatasetNameFlag.Name),
-				Version: c.String(DatasetVersion.Name),
-				Path:    c.String(DatasetPathFlag.Name),
+			rootFs, err := fileSystem(c, config)
+			if err != nil {
+				return err
 			}
 
 			// mount fs to dataset path
-			fs = storage.NewPrefixWrapper(fs, dataset.FullPath())
+			fs := storage.NewPrefixWrapper(rootFs, dataset.FullPath())
 
-			walFiles, err := ethwal.ListFiles(c.Context, fs)
+			fileIndex := ethwal.NewFileIndex(fs)
+			err = fileIndex.Load(c.Context)
 			if err != nil {
 				return err
 			}
 
 			fmt.Println("Dataset:", cmp.Or(dataset.Name, "-"))
 			fmt.Println("Version:", cmp.Or(dataset.Version, "-"))
-			if c.String(GoogleCloudBucket.Name) != "" {
+			if config.GoogleCloudBucket != "" {
 				fmt.Println("Filesystem:", "Google Cloud")
-				fmt.Println("Bucket:", c.String(GoogleCloudBucket.Name))
+				fmt.Println("Bucket:", config.GoogleCloudBucket)
+			} else if config.S3Bucket != "" {
+				fmt.Println("Filesystem:", "S3")
+				fmt.Println("Bucket:", config.S3Bucket)
 			} else {
 				fmt.Println("Filesystem: local")
 			}
 			fmt.Println("Path:", dataset.Path)
-			fmt.Println("Number of files:", len(walFiles))
-			if len(walFiles) > 0 {
-				fmt.Println("Block range:", walFiles[0].FirstBlockNum, "-", walFiles[len(walFiles)-1].LastBlockNum)
+			fmt.Println("Number of files:", len(fileIndex.Files()))
+			if len(fileIndex.Files()) > 0 {
+				first, last := fileIndex.BlockRange()
+				fmt.Println("Block range:", first, "-", last)
 			} else {
 				fmt.Println("Block range: -")
 			}
+			fmt.Println("Number of blocks:", fileIndex.NumBlocks())
+
+			manifest, err := ethwal.ReadDatasetManifest(c.Context, ethwal.Options{Dataset: dataset, FileSystem: rootFs})
+			if err != nil {
+				return err
+			}
+			if manifest != nil {
+				fmt.Println("Manifest:")
+				fmt.Println("  Dataset:", cmp.Or(manifest.Name, "-"))
+				fmt.Println("  Version:", cmp.Or(manifest.Version, "-"))
+				fmt.Println("  Encoding:", cmp.Or(manifest.Encoding, "custom"))
+				fmt.Println("  Compression:", cmp.Or(manifest.Compression, "custom"))
+				fmt.Println("  First block:", manifest.FirstBlockNum)
+			} else {
+				fmt.Println("Manifest: -")
+			}
+
+			gaps := fileIndex.Gaps()
+			fmt.Println("Gaps:", len(gaps))
+			for _, gap := range gaps {
+				fmt.Printf("  %d - %d\n", gap.From, gap.To)
+			}
 
 			return nil
 		},
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/0xsequence/ethwal"
+	"github.com/0xsequence/ethwal/monitor"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the monitor, read from the YAML file.
+type Config struct {
+	Listen   string          `yaml:"listen"`
+	Interval time.Duration   `yaml:"interval"`
+	Datasets []DatasetConfig `yaml:"datasets"`
+}
+
+// DatasetConfig is the configuration of the dataset watched by the monitor.
+type DatasetConfig struct {
+	// Label is the dataset label of the metrics, defaults to the dataset full path.
+	Label             string   `yaml:"label"`
+	Name              string   `yaml:"name"`
+	Version           string   `yaml:"version"`
+	Path              string   `yaml:"path"`
+	GoogleCloudBucket string   `yaml:"googleCloudBucket"`
+	Preset            string   `yaml:"preset"`
+	Decoder           string   `yaml:"decoder"`
+	Decompressor      string   `yaml:"decompressor"`
+	Indexes           []string `yaml:"indexes"`
+
+	MaxHeadAge      time.Duration `yaml:"maxHeadAge"`
+	MaxHeartbeatAge time.Duration `yaml:"maxHeartbeatAge"`
+	MaxIndexLag     uint64        `yaml:"maxIndexLag"`
+	VerifyInterval  time.Duration `yaml:"verifyInterval"`
+}
+
+func readConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var config Config
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return config, nil
+}
+
+func codec(name string) (ethwal.Option, error) {
+	switch cmp.Or(name, "cbor") {
+	case "cbor":
+		return ethwal.WithCBOR(), nil
+	case "json":
+		return ethwal.WithJSON(), nil
+	default:
+		return nil, fmt.Errorf("unknown codec: %s", name)
+	}
+}
+
+func compression(name string) (ethwal.Option, error) {
+	switch cmp.Or(name, "zstd") {
+	case "zstd":
+		return ethwal.WithZSTD(), nil
+	case "none":
+		return ethwal.WithoutCompression(), nil
+	default:
+		return nil, fmt.Errorf("unknown compression: %s", name)
+	}
+}
+
+// dataset returns the monitored dataset, the decoder and decompressor are used if no preset is set.
+func (c DatasetConfig) dataset() (monitor.Dataset, error) {
+	var opts []ethwal.Option
+	switch c.Preset {
+	case "archival":
+		opts = append(opts, ethwal.ArchivalDataset(c.Name, c.Version, c.Path))
+	case "realtime":
+		opts = append(opts, ethwal.RealtimeDataset(c.Name, c.Version, c.Path))
+	case "":
+		codecOpt, err := codec(c.Decoder)
+		if err != nil {
+			return monitor.Dataset{}, err
+		}
+
+		compressionOpt, err := compression(c.Decompressor)
+		if err != nil {
+			return monitor.Dataset{}, err
+		}
+		opts = append(opts, ethwal.WithDataset(c.Name, c.Version, c.Path), codecOpt, compressionOpt)
+	default:
+		return monitor.Dataset{}, fmt.Errorf("unknown preset: %s", c.Preset)
+	}
+
+	if c.GoogleCloudBucket != "" {
+		opts = append(opts, ethwal.WithGCS(c.GoogleCloudBucket))
+	}
+
+	options, err := ethwal.NewOptions(opts...)
+	if err != nil {
+		return monitor.Dataset{}, err
+	}
+
+	indexes := make([]ethwal.IndexName, 0, len(c.Indexes))
+	for _, name := range c.Indexes {
+		indexes = append(indexes, ethwal.IndexName(name))
+	}
+
+	return monitor.Dataset{
+		Name:    c.Label,
+		Options: options,
+		Indexes: indexes,
+		Thresholds: monitor.Thresholds{
+			MaxHeadAge:      c.MaxHeadAge,
+			MaxHeartbeatAge: c.MaxHeartbeatAge,
+			MaxIndexLag:     c.MaxIndexLag,
+		},
+		VerifyInterval: c.VerifyInterval,
+	}, nil
+}
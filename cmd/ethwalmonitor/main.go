@@ -0,0 +1,221 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/0xsequence/ethwal/monitor"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/errgroup"
+)
+
+var ConfigFlag = &cli.StringFlag{
+	Name:  "config",
+	Usage: "YAML file with the datasets to watch",
+}
+
+var ListenFlag = &cli.StringFlag{
+	Name:  "listen",
+	Usage: "address to serve /metrics and /healthz on",
+	Value: ":9090",
+}
+
+var IntervalFlag = &cli.DurationFlag{
+	Name:  "interval",
+	Usage: "poll interval of the datasets",
+}
+
+var DatasetPathFlag = &cli.StringFlag{
+	Name:  "path",
+	Usage: "path of the dataset to watch, in addition to the datasets of the config",
+}
+
+var DatasetLabelFlag = &cli.StringFlag{
+	Name:  "label",
+	Usage: "dataset label of the metrics",
+}
+
+var DatasetNameFlag = &cli.StringFlag{
+	Name:  "name",
+	Usage: "name of the dataset",
+}
+
+var DatasetVersion = &cli.StringFlag{
+	Name:  "version",
+	Usage: "version of the dataset",
+}
+
+var GoogleCloudBucket = &cli.StringFlag{
+	Name:  "google-cloud-bucket",
+	Usage: "google cloud bucket",
+}
+
+var PresetFlag = &cli.StringFlag{
+	Name:  "preset",
+	Usage: "dataset preset (archival, realtime), overrides the decoder and decompressor",
+}
+
+var DecoderFlag = &cli.StringFlag{
+	Name:  "decoder",
+	Usage: "decoder to use",
+	Value: "cbor",
+}
+
+var DecompressorFlag = &cli.StringFlag{
+	Name:  "decompressor",
+	Usage: "decompressor to use",
+	Value: "zstd",
+}
+
+var IndexFlag = &cli.StringSliceFlag{
+	Name:  "index",
+	Usage: "index whose lag is exported, can be repeated",
+}
+
+var MaxHeadAgeFlag = &cli.DurationFlag{
+	Name:  "max-head-age",
+	Usage: "head block age the dataset is stale after",
+}
+
+var MaxHeartbeatAgeFlag = &cli.DurationFlag{
+	Name:  "max-heartbeat-age",
+	Usage: "age of the last update the dataset is stale after",
+}
+
+var MaxIndexLagFlag = &cli.Uint64Flag{
+	Name:  "max-index-lag",
+	Usage: "number of blocks any index can be behind the head",
+}
+
+var VerifyIntervalFlag = &cli.DurationFlag{
+	Name:  "verify-interval",
+	Usage: "interval of the dataset invariants check, disabled if zero",
+}
+
+func config(c *cli.Context) (Config, error) {
+	var config Config
+	if path := c.String(ConfigFlag.Name); path != "" {
+		var err error
+		config, err = readConfig(path)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	if c.IsSet(ListenFlag.Name) || config.Listen == "" {
+		config.Listen = c.String(ListenFlag.Name)
+	}
+	config.Interval = cmp.Or(c.Duration(IntervalFlag.Name), config.Interval)
+
+	if path := c.String(DatasetPathFlag.Name); path != "" {
+		config.Datasets = append(config.Datasets, DatasetConfig{
+			Label:             c.String(DatasetLabelFlag.Name),
+			Name:              c.String(DatasetNameFlag.Name),
+			Version:           c.String(DatasetVersion.Name),
+			Path:              path,
+			GoogleCloudBucket: c.String(GoogleCloudBucket.Name),
+			Preset:            c.String(PresetFlag.Name),
+			Decoder:           c.String(DecoderFlag.Name),
+			Decompressor:      c.String(DecompressorFlag.Name),
+			Indexes:           c.StringSlice(IndexFlag.Name),
+			MaxHeadAge:        c.Duration(MaxHeadAgeFlag.Name),
+			MaxHeartbeatAge:   c.Duration(MaxHeartbeatAgeFlag.Name),
+			MaxIndexLag:       c.Uint64(MaxIndexLagFlag.Name),
+			VerifyInterval:    c.Duration(VerifyIntervalFlag.Name),
+		})
+	}
+
+	if len(config.Datasets) == 0 {
+		return Config{}, fmt.Errorf("no datasets to watch, set --config or --path")
+	}
+	return config, nil
+}
+
+func main() {
+	app := cli.App{
+		Name:  "ethwalmonitor",
+		Usage: "exports freshness and completeness gauges of the datasets",
+		Flags: []cli.Flag{
+			ConfigFlag,
+			ListenFlag,
+			IntervalFlag,
+			DatasetPathFlag,
+			DatasetLabelFlag,
+			DatasetNameFlag,
+			DatasetVersion,
+			GoogleCloudBucket,
+			PresetFlag,
+			DecoderFlag,
+			DecompressorFlag,
+			IndexFlag,
+			MaxHeadAgeFlag,
+			MaxHeartbeatAgeFlag,
+			MaxIndexLagFlag,
+			VerifyIntervalFlag,
+		},
+		Action: func(c *cli.Context) error {
+			config, err := config(c)
+			if err != nil {
+				return err
+			}
+
+			opt := monitor.Options{Interval: config.Interval}
+			for i, datasetConfig := range config.Datasets {
+				dataset, err := datasetConfig.dataset()
+				if err != nil {
+					return fmt.Errorf("dataset %d: %w", i, err)
+				}
+				opt.Datasets = append(opt.Datasets, dataset)
+			}
+
+			poller, err := monitor.NewPoller(opt)
+			if err != nil {
+				return err
+			}
+
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", poller.MetricsHandler())
+			mux.Handle("/healthz", poller.HealthHandler())
+			server := &http.Server{Addr: config.Listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+			ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			errGrp, gCtx := errgroup.WithContext(ctx)
+			errGrp.Go(func() error {
+				err := poller.Run(gCtx)
+				if errors.Is(err, context.Canceled) {
+					return nil
+				}
+				return err
+			})
+			errGrp.Go(func() error {
+				log.Println("serving /metrics and /healthz on", config.Listen)
+				err := server.ListenAndServe()
+				if errors.Is(err, http.ErrServerClosed) {
+					return nil
+				}
+				return err
+			})
+			errGrp.Go(func() error {
+				<-gCtx.Done()
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				return server.Shutdown(shutdownCtx)
+			})
+			return errGrp.Wait()
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"plugin"
+	"strings"
+
+	"github.com/0xsequence/ethwal"
+	"github.com/urfave/cli/v2"
+)
+
+// PluginSymbolName is the name of the symbol the plugin needs to export. The symbol must be
+// of type func(ethwal.Block[any]) (ethwal.Block[any], bool, error).
+const PluginSymbolName = "Replay"
+
+var SourceDatasetPathFlag = &cli.StringFlag{
+	Name:     "src-path",
+	Usage:    "source path to read",
+	Required: true,
+}
+
+var SourceDatasetNameFlag = &cli.StringFlag{
+	Name:  "src-name",
+	Usage: "name of the source dataset",
+}
+
+var SourceDatasetVersionFlag = &cli.StringFlag{
+	Name:  "src-version",
+	Usage: "version of the source dataset",
+}
+
+var SourceGoogleCloudBucket = &cli.StringFlag{
+	Name:  "src-google-cloud-bucket",
+	Usage: "source google cloud bucket",
+}
+
+var DestinationDatasetPathFlag = &cli.StringFlag{
+	Name:     "dst-path",
+	Usage:    "destination path to write",
+	Required: true,
+}
+
+var DestinationDatasetNameFlag = &cli.StringFlag{
+	Name:  "dst-name",
+	Usage: "name of the destination dataset",
+}
+
+var DestinationDatasetVersionFlag = &cli.StringFlag{
+	Name:  "dst-version",
+	Usage: "version of the destination dataset",
+}
+
+var DestinationGoogleCloudBucket = &cli.StringFlag{
+	Name:  "dst-google-cloud-bucket",
+	Usage: "destination google cloud bucket",
+}
+
+var FromBlockNumFlag = &cli.Uint64Flag{
+	Name:  "from",
+	Usage: "block number to start replaying from",
+	Value: 0,
+}
+
+var ToBlockNumFlag = &cli.Uint64Flag{
+	Name:  "to",
+	Usage: "block number to stop replaying at (inclusive), 0 replays all blocks",
+	Value: 0,
+}
+
+var WorkersFlag = &cli.IntFlag{
+	Name:  "workers",
+	Usage: "number of concurrent transform workers",
+	Value: 4,
+}
+
+var PluginFlag = &cli.StringFlag{
+	Name:  "plugin",
+	Usage: fmt.Sprintf("path to go plugin exporting %s func(ethwal.Block[any]) (ethwal.Block[any], bool, error)", PluginSymbolName),
+}
+
+var TransformFlag = &cli.StringFlag{
+	Name:  "transform",
+	Usage: "built-in transform: identity or field path of block data e.g. .logs.0.address",
+	Value: "identity",
+}
+
+func main() {
+	app := cli.App{
+		Name:  "ethwalreplay",
+		Usage: "tool to replay ethwal block range through a transform",
+		Flags: []cli.Flag{
+			SourceDatasetPathFlag,
+			SourceDatasetNameFlag,
+			SourceDatasetVersionFlag,
+			SourceGoogleCloudBucket,
+			DestinationDatasetPathFlag,
+			DestinationDatasetNameFlag,
+			DestinationDatasetVersionFlag,
+			DestinationGoogleCloudBucket,
+			FromBlockNumFlag,
+			ToBlockNumFlag,
+			WorkersFlag,
+			PluginFlag,
+			TransformFlag,
+		},
+		Action: func(c *cli.Context) error {
+			fn, err := replayFunc(c)
+			if err != nil {
+				return err
+			}
+
+			srcOpts := []ethwal.Option{
+				ethwal.WithDataset(c.String(SourceDatasetNameFlag.Name), c.String(SourceDatasetVersionFlag.Name), c.String(SourceDatasetPathFlag.Name)),
+				ethwal.WithCBOR(),
+				ethwal.WithZSTD(),
+			}
+			if bucket := c.String(SourceGoogleCloudBucket.Name); bucket != "" {
+				srcOpts = append(srcOpts, ethwal.WithGCS(bucket))
+			}
+
+			src, err := ethwal.NewOptions(srcOpts...)
+			if err != nil {
+				return fmt.Errorf("source: %w", err)
+			}
+
+			dstOpts := []ethwal.Option{
+				ethwal.ArchivalDataset(c.String(DestinationDatasetNameFlag.Name), c.String(DestinationDatasetVersionFlag.Name), c.String(DestinationDatasetPathFlag.Name)),
+			}
+			if bucket := c.String(DestinationGoogleCloudBucket.Name); bucket != "" {
+				dstOpts = append(dstOpts, ethwal.WithGCS(bucket))
+			}
+
+			dst, err := ethwal.NewOptions(dstOpts...)
+			if err != nil {
+				return fmt.Errorf("destination: %w", err)
+			}
+
+			var replayed uint64
+			err = ethwal.Replay(c.Context, src, dst, c.Uint64(FromBlockNumFlag.Name), c.Uint64(ToBlockNumFlag.Name), fn, ethwal.ReplayOptions{
+				Workers: c.Int(WorkersFlag.Name),
+				OnProgress: func(blockNum uint64) {
+					replayed++
+					if replayed%10000 == 0 {
+						fmt.Printf("Replayed block %d\n", blockNum)
+					}
+				},
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Replay complete, %d blocks processed\n", replayed)
+			return nil
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+	}
+}
+
+func replayFunc(c *cli.Context) (ethwal.ReplayFunc[any, any], error) {
+	if pluginPath := c.String(PluginFlag.Name); pluginPath != "" {
+		p, err := plugin.Open(pluginPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open plugin: %w", err)
+		}
+
+		sym, err := p.Lookup(PluginSymbolName)
+		if err != nil {
+			return nil, fmt.Errorf("unable to lookup plugin symbol: %w", err)
+		}
+
+		switch fn := sym.(type) {
+		case func(ethwal.Block[any]) (ethwal.Block[any], bool, error):
+			return fn, nil
+		case *func(ethwal.Block[any]) (ethwal.Block[any], bool, error):
+			return *fn, nil
+		default:
+			return nil, fmt.Errorf("plugin symbol %s has unexpected type %T", PluginSymbolName, sym)
+		}
+	}
+
+	transform := c.String(TransformFlag.Name)
+	switch {
+	case transform == "identity":
+		return func(block ethwal.Block[any]) (ethwal.Block[any], bool, error) {
+			return block, true, nil
+		}, nil
+	case strings.HasPrefix(transform, "."):
+		fieldPath := strings.Split(strings.TrimPrefix(transform, "."), ".")
+		return func(block ethwal.Block[any]) (ethwal.Block[any], bool, error) {
+			data, ok := selectField(block.Data, fieldPath)
+			if !ok {
+				return ethwal.Block[any]{}, false, nil
+			}
+			block.Data = data
+			return block, true, nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown transform: %s", transform)
+	}
+}
+
+// selectField returns value at the field path, the path elements are map keys or slice indexes
+func selectField(data any, fieldPath []string) (any, bool) {
+	for _, field := range fieldPath {
+		if field == "" {
+			continue
+		}
+
+		switch v := data.(type) {
+		case map[any]any:
+			value, ok := v[field]
+			if !ok {
+				return nil, false
+			}
+			data = value
+		case map[string]any:
+			value, ok := v[field]
+			if !ok {
+				return nil, false
+			}
+			data = value
+		case []any:
+			var index int
+			if _, err := fmt.Sscanf(field, "%d", &index); err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			data = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return data, true
+}
@@ -0,0 +1,204 @@
+package ethwal
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// CBOR tags used by ValueCodec to mark the type of Ethereum values.
+const (
+	CBORTagHash    uint64 = 61000
+	CBORTagAddress uint64 = 61001
+	CBORTagBigInt  uint64 = 61002
+)
+
+// ValueCodec maps generic block data between JSON-friendly and CBOR-friendly representations.
+//
+// The JSON representation uses strings: hashes, addresses and byte strings are 0x-prefixed
+// lowercase hex, integers are decimal strings. The CBOR representation stores them as binary
+// values with explicit tags, so that the mapping is lossless in both directions. Strings that
+// are not in the canonical form (e.g. checksummed addresses, decimals with leading zeros) are
+// kept as text.
+type ValueCodec struct {
+	// LegacyHeuristics enables decoding of untagged data written before the tags were introduced. A byte
+	// string that parses as a decimal number is decoded as a decimal string.
+	LegacyHeuristics bool
+	// KeepHexStrings keeps the 0x-prefixed strings as text instead of converting them to the byte strings,
+	// e.g. for the payloads whose hex strings aren't binary values.
+	KeepHexStrings bool
+}
+
+// ToCBOR converts JSON decoded value into CBOR-friendly representation. The json.Number of the decoder with
+// UseNumber is converted to the integer if it fits int64 or uint64, so that the large integers aren't rounded
+// to float64.
+func (c ValueCodec) ToCBOR(data any) any {
+	switch v := data.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for key, value := range v {
+			m[key] = c.ToCBOR(value)
+		}
+		return m
+	case []any:
+		arr := make([]any, len(v))
+		for i, value := range v {
+			arr[i] = c.ToCBOR(value)
+		}
+		return arr
+	case string:
+		if c.KeepHexStrings && strings.HasPrefix(v, "0x") {
+			return v
+		}
+		return stringToCBOR(v)
+	case json.Number:
+		return numberToCBOR(v)
+	case common.Hash:
+		return cbor.Tag{Number: CBORTagHash, Content: v.Bytes()}
+	case common.Address:
+		return cbor.Tag{Number: CBORTagAddress, Content: v.Bytes()}
+	case *big.Int:
+		if v == nil {
+			return nil
+		}
+		return cbor.Tag{Number: CBORTagBigInt, Content: v}
+	default:
+		return data
+	}
+}
+
+// FromCBOR converts CBOR decoded value into JSON-friendly representation.
+func (c ValueCodec) FromCBOR(data any) any {
+	switch v := data.(type) {
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = c.FromCBOR(value)
+		}
+		return m
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for key, value := range v {
+			m[key] = c.FromCBOR(value)
+		}
+		return m
+	case []any:
+		arr := make([]any, len(v))
+		for i, value := range v {
+			arr[i] = c.FromCBOR(value)
+		}
+		return arr
+	case cbor.Tag:
+		return c.tagFromCBOR(v)
+	case big.Int:
+		return v.String()
+	case []byte:
+		if c.LegacyHeuristics {
+			if i, ok := new(big.Int).SetString(strings.ReplaceAll(string(v), "\"", ""), 10); ok {
+				return i.String()
+			}
+		}
+		return encodeHex(v)
+	default:
+		return data
+	}
+}
+
+func (c ValueCodec) tagFromCBOR(tag cbor.Tag) any {
+	switch tag.Number {
+	case CBORTagHash, CBORTagAddress:
+		if b, ok := tag.Content.([]byte); ok {
+			return encodeHex(b)
+		}
+	case CBORTagBigInt:
+		switch i := tag.Content.(type) {
+		case uint64:
+			return new(big.Int).SetUint64(i).String()
+		case int64:
+			return big.NewInt(i).String()
+		case big.Int:
+			return i.String()
+		case *big.Int:
+			return i.String()
+		}
+	}
+	return cbor.Tag{Number: tag.Number, Content: c.FromCBOR(tag.Content)}
+}
+
+func stringToCBOR(s string) any {
+	if strings.HasPrefix(s, "0x") {
+		b, ok := canonicalHexToBytes(s)
+		if !ok {
+			return s
+		}
+
+		switch len(b) {
+		case common.HashLength:
+			return cbor.Tag{Number: CBORTagHash, Content: b}
+		case common.AddressLength:
+			return cbor.Tag{Number: CBORTagAddress, Content: b}
+		default:
+			return b
+		}
+	}
+
+	if isCanonicalDecimal(s) {
+		i, ok := new(big.Int).SetString(s, 10)
+		if ok {
+			return cbor.Tag{Number: CBORTagBigInt, Content: i}
+		}
+	}
+	return s
+}
+
+func numberToCBOR(n json.Number) any {
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	if u, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+		return u
+	}
+	if f, err := n.Float64(); err == nil {
+		return f
+	}
+	return n.String()
+}
+
+// canonicalHexToBytes decodes 0x-prefixed lowercase hex string with even number of digits.
+func canonicalHexToBytes(s string) ([]byte, bool) {
+	digits := s[2:]
+	if len(digits)%2 != 0 || strings.ToLower(digits) != digits {
+		return nil, false
+	}
+
+	b, err := hex.DecodeString(digits)
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// isCanonicalDecimal returns true if the string is a decimal integer without leading zeros.
+func isCanonicalDecimal(s string) bool {
+	digits := strings.TrimPrefix(s, "-")
+	if len(digits) == 0 || (len(digits) > 1 && digits[0] == '0') || (s[0] == '-' && digits == "0") {
+		return false
+	}
+
+	for _, d := range digits {
+		if d < '0' || d > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeHex(b []byte) string {
+	return "0x" + hex.EncodeToString(b)
+}
@@ -0,0 +1,133 @@
+package ethwal
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueCodec_RoundTrip(t *testing.T) {
+	maxUint256 := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+	testCases := []struct {
+		name  string
+		value any
+	}{
+		{name: "hash", value: "0x28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef"},
+		{name: "numeric-looking-hash", value: encodeHex([]byte("12345678901234567890123456789012"))},
+		{name: "address", value: "0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2"},
+		{name: "checksummed-address", value: "0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2"},
+		{name: "bytes", value: "0x0102030405"},
+		{name: "empty-bytes", value: "0x"},
+		{name: "numeric-looking-bytes", value: encodeHex([]byte("12345"))},
+		{name: "odd-hex", value: "0x123"},
+		{name: "zero", value: "0"},
+		{name: "small-int", value: "42"},
+		{name: "negative-int", value: "-42"},
+		{name: "uint64-max", value: "18446744073709551615"},
+		{name: "uint256-max", value: maxUint256.String()},
+		{name: "leading-zeros", value: "007"},
+		{name: "text", value: "transfer"},
+		{name: "number", value: float64(1.5)},
+		{name: "bool", value: true},
+		{name: "null", value: nil},
+		{
+			name: "nested",
+			value: map[string]any{
+				"amount": maxUint256.String(),
+				"logs": []any{
+					map[string]any{
+						"address": "0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2",
+						"topics":  []any{"0x28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef"},
+						"data":    "0x",
+					},
+				},
+			},
+		},
+	}
+
+	codec := ValueCodec{}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, NewCBOREncoder(&buf).Encode(codec.ToCBOR(tc.value)))
+
+			var decoded any
+			require.NoError(t, NewCBORDecoder(&buf).Decode(&decoded))
+			require.Equal(t, tc.value, codec.FromCBOR(decoded))
+		})
+	}
+}
+
+func TestValueCodec_TypedValues(t *testing.T) {
+	hash := common.HexToHash("0x28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef")
+	address := common.HexToAddress("0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2")
+	amount, _ := new(big.Int).SetString("115792089237316195423570985008687907853269984665640564039457584007913129639935", 10)
+
+	codec := ValueCodec{}
+
+	var buf bytes.Buffer
+	require.NoError(t, NewCBOREncoder(&buf).Encode(codec.ToCBOR([]any{hash, address, amount, big.NewInt(1)})))
+
+	var decoded any
+	require.NoError(t, NewCBORDecoder(&buf).Decode(&decoded))
+
+	data, err := json.Marshal(codec.FromCBOR(decoded))
+	require.NoError(t, err)
+	require.JSONEq(t, `[
+		"0x28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef",
+		"0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2",
+		"115792089237316195423570985008687907853269984665640564039457584007913129639935",
+		"1"
+	]`, string(data))
+}
+
+func TestValueCodec_LegacyHeuristics(t *testing.T) {
+	// data written before tags were introduced
+	var buf bytes.Buffer
+	require.NoError(t, NewCBOREncoder(&buf).Encode(map[string]any{
+		"amount": []byte("1000"),
+		"hash":   common.Hex2Bytes("28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef"),
+	}))
+
+	var decoded any
+	require.NoError(t, NewCBORDecoder(bytes.NewReader(buf.Bytes())).Decode(&decoded))
+
+	require.Equal(t, map[string]any{
+		"amount": "1000",
+		"hash":   "0x28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef",
+	}, ValueCodec{LegacyHeuristics: true}.FromCBOR(decoded))
+
+	require.Equal(t, map[string]any{
+		"amount": encodeHex([]byte("1000")),
+		"hash":   "0x28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef28f55a4df523b3ef",
+	}, ValueCodec{}.FromCBOR(decoded))
+}
+
+func TestValueCodec_JSONNumbers(t *testing.T) {
+	// the keys are sorted as json.Marshal sorts them, the numbers are compared as text
+	input := `{"float":1.5,"hex":"0x0102","negative":-42,"small":42,"uint64":18446744073709551615}`
+
+	dec := json.NewDecoder(bytes.NewReader([]byte(input)))
+	dec.UseNumber()
+	var value any
+	require.NoError(t, dec.Decode(&value))
+
+	for _, codec := range []ValueCodec{{}, {KeepHexStrings: true}} {
+		var buf bytes.Buffer
+		require.NoError(t, NewCBOREncoder(&buf).Encode(codec.ToCBOR(value)))
+
+		var decoded any
+		require.NoError(t, NewCBORDecoder(&buf).Decode(&decoded))
+		hex, _ := decoded.(map[any]any)["hex"].(string)
+		require.Equal(t, codec.KeepHexStrings, hex == "0x0102")
+
+		data, err := json.Marshal(ValueCodec{}.FromCBOR(decoded))
+		require.NoError(t, err)
+		require.Equal(t, input, string(data))
+	}
+}
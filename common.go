@@ -11,12 +11,14 @@ import (
 	"io"
 	"os"
 	"path"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/0xsequence/ethkit/go-ethereum/common"
 	"github.com/0xsequence/ethwal/storage"
 	"github.com/0xsequence/ethwal/storage/local"
 	"github.com/c2h5oh/datasize"
@@ -58,57 +60,341 @@ func buildETHWALPath(name, version, rootPath string) string {
 }
 
 const (
-	defaultFileSize        = 8 * datasize.MB
-	defaultPrefetchTimeout = 30 * time.Second
+	defaultFileSize         = 8 * datasize.MB
+	defaultPrefetchTimeout  = 30 * time.Second
+	defaultPrefetchDepth    = 1
+	defaultTailPollInterval = time.Second
+
+	defaultFileWrittenQueueSize = 16
 )
 
 type Options struct {
 	Dataset Dataset
 
+	// FileSystem is the storage of the dataset. The file system is owned by the caller, readers and writers
+	// never close it.
 	FileSystem storage.FS
+	// OpenExisting makes NewReader and NewWriter fail with ErrDatasetNotExist if the dataset has neither the
+	// file index nor the schema metadata, instead of creating the dataset directory on the local file system
+	// and opening the empty dataset, e.g. for the tools pointed at a mistyped path. The legacy datasets without
+	// the file index aren't opened.
+	OpenExisting bool
+	// ReplicaFileSystems are the ordered replicas of FileSystem. Readers retry the reads that fail with
+	// other error than not-exist against the replicas. Writes go to FileSystem only.
+	ReplicaFileSystems []storage.FS
+	// ReplicaFailureThreshold is the number of consecutive failed reads after which the file system is
+	// tried after the others for ReplicaCooldown. Defaults to 3.
+	ReplicaFailureThreshold int
+	// ReplicaCooldown defaults to 1 minute.
+	ReplicaCooldown time.Duration
+	// OnReplicaAccess is called after each read attempt. The source is 0 for FileSystem and i for
+	// ReplicaFileSystems[i-1].
+	OnReplicaAccess func(source int, err error)
+
+	// ObjectMetadata is attached to all objects written by the writer, together with the object class
+	// and the dataset name and version labels.
+	ObjectMetadata ObjectAttributes
+	// ObjectClassMetadata overrides ObjectMetadata for the object class.
+	ObjectClassMetadata map[ObjectClass]ObjectAttributes
 
 	NewCompressor   NewCompressorFunc
 	NewDecompressor NewDecompressorFunc
 
 	NewEncoder NewEncoderFunc
 	NewDecoder NewDecoderFunc
+	// CBORPreset is the name of the registered CBOR preset, see RegisterCBORPreset, that sets NewEncoder
+	// and NewDecoder if they are nil. The writer records it in the dataset schema metadata, readers without
+	// the preset and decoder use the decoder of the recorded preset.
+	CBORPreset string
+	// JSONFieldAliases are the legacy names of the block fields, keyed by the canonical JSON field names, e.g.
+	// "blockNum", used by the reader to decode the JSON datasets written with different field names. The
+	// blocks without any canonical field are decoded with the builtin legacy names "hash", "number",
+	// "timestamp" and "data". CBOR datasets are not affected.
+	JSONFieldAliases map[string]string
 
 	FileRollPolicy  FileRollPolicy
 	FileRollOnClose bool
+	// RetentionPolicy makes the writer prune the files past the retention after it rolls the file, see
+	// FileIndex.Prune. The files are kept if nil.
+	RetentionPolicy RetentionPolicy
+	// BatchRollCheckInterval is the number of blocks written by Writer.WriteBatch between the checks of
+	// FileRollPolicy. Zero checks the policy only before the batch, so that the batch is written to one file.
+	BatchRollCheckInterval int
+	// StrictSequence makes the writer refuse the blocks less than or equal to the last accepted block with
+	// ErrNonMonotonicBlock and the blocks skipping the block numbers with ErrBlockGap, instead of skipping
+	// them silently. The first block of the empty dataset may be any block. The gaps are allowed under the
+	// no-gap writer, see NewWriterNoGap, that fills them.
+	StrictSequence bool
 
 	FilePrefetchTimeout time.Duration
+	// DisablePrefetch disables the background prefetch of the next files by the reader.
+	DisablePrefetch bool
+	// PrefetchDepth is the number of the files the reader prefetches ahead of the current file. Defaults to 1.
+	PrefetchDepth int
+	// PrefetchMaxBytes bounds the total size of the files prefetched ahead, the next file is prefetched
+	// regardless of its size. Unbounded if zero.
+	PrefetchMaxBytes datasize.ByteSize
+	// SkipCorruptFiles makes the reader skip the files it can't read, e.g. the zero-length files with
+	// ErrEmptyFile, instead of failing. The files are reported in ReaderStats.CorruptFiles either way.
+	SkipCorruptFiles bool
+	// VerifyChecksumOnRead makes the reader verify the checksums of the files recorded by the writer, the file
+	// that doesn't match fails with ErrChecksumMismatch once it's read to the end. The files without the
+	// checksum are read as they are.
+	VerifyChecksumOnRead bool
+	// IOScheduler prioritizes the foreground reads of the reader over the background prefetch. Readers
+	// sharing the scheduler share the priority. Defaults to a new scheduler per reader.
+	IOScheduler *IOScheduler
+
+	// EnableChangefeed makes the writer, BackfillGaps and RepairTimestamps append the events of the files
+	// they add or replace to the changelog of the dataset, see ChangefeedReader. The writer adds the files of
+	// the file index missing in the changelog on start, e.g. after the crash or the first time it's enabled.
+	EnableChangefeed bool
+
+	// EnableAccounting counts the storage operations and bytes per object class, see ClassifyObjectPath.
+	// The counters are available through Reader.Accounting and Writer.Accounting.
+	EnableAccounting bool
+	// Accounting is the accounting the counters are added to if EnableAccounting is set, so that it can be
+	// shared by several readers and writers. Defaults to a new accounting classified by ClassifyObjectPath.
+	Accounting *storage.Accounting
+
+	// Hooks are the callbacks of the writer for the metrics, see Hooks.
+	Hooks Hooks
+	// OnFileWritten is called by the writer after the rolled file and the updated file index are saved with the
+	// stored size of the file and the duration of the roll, use it for the metrics of the rolled files. It isn't
+	// called for the current file written by Writer.Flush.
+	OnFileWritten func(ctx context.Context, file *File, stats FileStats)
+	// OnFileWrittenAsync makes the writer call OnFileWritten from a background goroutine through
+	// a bounded queue. The writer blocks if the queue is full.
+	OnFileWrittenAsync bool
+	// OnIndexFlushed is called by the writer with indexer after the indexes are flushed with the block number they're
+	// flushed up to, the duration of the flush and the estimated size of the flushed updates, use it for the metrics
+	// of the index flushes, see IndexerOptions.OnIndexFlushed.
+	OnIndexFlushed func(ctx context.Context, stats IndexFlushStats)
+	// IndexerCatchUpLimit is the maximal number of blocks NewWriterWithIndexer indexes to catch up the indexer
+	// behind the writer, it fails with ErrIndexerCatchUpLimit if the indexer is further behind. Unlimited if zero.
+	IndexerCatchUpLimit uint64
+	// OnIndexerCatchUp is called by NewWriterWithIndexer after the caught-up indexes are flushed up to blockNum,
+	// the catch-up is done once blockNum reaches targetBlockNum.
+	OnIndexerCatchUp func(ctx context.Context, blockNum, targetBlockNum uint64)
+
+	// ReadRepair makes the reader copy the files it reads from a fallback location, the legacy path or
+	// the replicas, to their canonical path on FileSystem in the background, see RepairLayout. The files
+	// stored only on the replicas are readable only with ReadRepair.
+	ReadRepair bool
+	// OnReadRepair is called after the reader repaired the file, err is set if the repair failed.
+	OnReadRepair func(file *File, source RepairSource, err error)
+
+	// OnGap is called by readers whenever the returned block number skips over missing blocks. The
+	// missing block range is (fromExclusive, toExclusive).
+	OnGap func(fromExclusive, toExclusive uint64)
+
+	// LocalJournalPath is the path of the local file the writer appends every accepted block to. The journal
+	// is truncated after each roll or flush and replayed on writer startup, so blocks that were not rolled yet
+	// survive a process crash.
+	LocalJournalPath string
+	// LocalJournalSyncInterval is the minimal interval between journal fsyncs. Defaults to 100ms.
+	LocalJournalSyncInterval time.Duration
+
+	// TailFlushInterval enables the writer to store the blocks that are not rolled yet to the .tail object
+	// at most once per interval, so that followers can read them before the file is rolled.
+	TailFlushInterval time.Duration
+	// FollowTail makes the reader check for newly rolled files and read the .tail object once all rolled
+	// files are read. The reader returns io.EOF if there are no new blocks, so that the caller can retry. The
+	// seek past the loaded files checks for newly rolled files too.
+	FollowTail bool
+	// TailMode makes Read wait for the new blocks instead of returning io.EOF, the reader reloads the file
+	// index every TailPollInterval and reads the newly rolled files, and the .tail object with FollowTail.
+	// Read returns once the context is done or the reader is closed.
+	TailMode bool
+	// TailPollInterval is the interval of the file index reloads of the reader in TailMode and of
+	// Reader.WaitForBlock. Defaults to 1s.
+	TailPollInterval time.Duration
+
+	// TrackPresence makes the writer store the numbers of all examined blocks, see Writer.MarkExamined
+	// and BlockExamined.
+	TrackPresence bool
+
+	// BlobThreshold makes the writer store the block data larger than the threshold in the blob store and
+	// write the reference instead. Disabled if zero.
+	BlobThreshold datasize.ByteSize
+	// BlobStore is the store of the offloaded block data. Defaults to the store on the dataset file system.
+	BlobStore BlobStore
+	// ResolveBlobs makes the reader fetch and decode the offloaded block data. If disabled, the reader
+	// returns blocks with the Blob reference and without the data.
+	ResolveBlobs bool
+
+	// InstanceID identifies the reader or writer instance in errors and hooks. If empty, a random
+	// id is generated.
+	InstanceID string
+
+	// SchemaVersion is the payload schema version of the block data. The writer records it in the dataset
+	// metadata and in every file it writes, it can only be bumped. Readers with schema version or upgrades,
+	// see NewReaderWithUpgrades, upgrade the blocks of files written under older versions and refuse
+	// files written under newer versions. Zero disables versioning.
+	SchemaVersion int
+
+	// BloomKeys makes the writer store the bloom filter of the keys of every file it writes, so that
+	// ProbeFiles can skip the files that don't contain the key. It must be BloomKeysFunc[T] of the
+	// writer block data type. Disabled if nil.
+	BloomKeys any
+	// BloomFalsePositiveRate is the target false-positive rate of the bloom filters. Defaults to 0.01.
+	BloomFalsePositiveRate float64
+
+	// BlockDigest makes the writer record the digest of every block next to the file and the Merkle root
+	// of the digests in the file index, so that AuditBlock can prove the block is what the writer wrote.
+	// It must be BlockDigestFunc[T] of the writer block data type, e.g. CanonicalBlockDigest[T]. Disabled
+	// if nil.
+	BlockDigest any
+
+	// MaxBlockMetaKeys is the maximal number of Block.Meta keys, the writer refuses larger meta with
+	// ErrBlockMetaTooLarge. Defaults to 16.
+	MaxBlockMetaKeys int
+	// MaxBlockMetaBytes is the maximal total size of Block.Meta keys and values. Defaults to 1KB.
+	MaxBlockMetaBytes datasize.ByteSize
+
+	// DecodeAhead makes the reader decode up to DecodeAhead blocks of the current file ahead of Read in
+	// a background goroutine. Disabled if zero.
+	DecodeAhead int
+
+	// ApplyPatches enables substitution of patched blocks stored by WritePatch on read. Defaults to true.
+	ApplyPatches *bool
+}
+
+// Hooks are the callbacks of the writer for the metrics, e.g. the Prometheus counters of the blocks written and
+// the failed rolls. The hooks are called after the writer releases its lock, so that the slow metrics sink doesn't
+// block the writes of the other goroutines. The nil hooks are skipped. The rolled files are reported to
+// Options.OnFileWritten and the index flushes to Options.OnIndexFlushed.
+type Hooks struct {
+	// OnBlockWritten is called after the block is written to the current file with the size of its encoded data.
+	OnBlockWritten func(blockNum uint64, bytes int)
+	// OnFileRollError is called when the roll of the file fails.
+	OnFileRollError func(err error)
 }
 
 func (o Options) WithDefaults() Options {
 	o.FileSystem = cmp.Or(o.FileSystem, storage.FS(local.NewLocalFS("")))
+	o.ReplicaFailureThreshold = cmp.Or(o.ReplicaFailureThreshold, defaultReplicaFailureThreshold)
+	o.ReplicaCooldown = cmp.Or(o.ReplicaCooldown, defaultReplicaCooldown)
 	o.FilePrefetchTimeout = cmp.Or(o.FilePrefetchTimeout, defaultPrefetchTimeout)
+	o.PrefetchDepth = cmp.Or(o.PrefetchDepth, defaultPrefetchDepth)
 	o.FileRollPolicy = cmp.Or(o.FileRollPolicy, NewFileSizeRollPolicy(uint64(defaultFileSize)))
+	if preset, err := LookupCBORPreset(o.CBORPreset); err == nil {
+		if o.NewEncoder == nil {
+			o.NewEncoder = preset.NewEncoder()
+		}
+		if o.NewDecoder == nil {
+			o.NewDecoder = preset.NewDecoder()
+		}
+	}
 	if o.NewEncoder == nil {
 		o.NewEncoder = NewCBOREncoder
 	}
 	if o.NewDecoder == nil {
 		o.NewDecoder = NewCBORDecoder
 	}
+	o.BloomFalsePositiveRate = cmp.Or(o.BloomFalsePositiveRate, defaultBloomFalsePositiveRate)
+	o.MaxBlockMetaKeys = cmp.Or(o.MaxBlockMetaKeys, defaultMaxBlockMetaKeys)
+	o.MaxBlockMetaBytes = cmp.Or(o.MaxBlockMetaBytes, datasize.ByteSize(defaultMaxBlockMetaBytes))
+	o.LocalJournalSyncInterval = cmp.Or(o.LocalJournalSyncInterval, defaultLocalJournalSyncInterval)
+	o.TailPollInterval = cmp.Or(o.TailPollInterval, defaultTailPollInterval)
+	if o.ApplyPatches == nil {
+		applyPatches := true
+		o.ApplyPatches = &applyPatches
+	}
 	return o
 }
 
 const FileIndexFileName = ".fileIndex"
+
+// StagingFileSuffix is the suffix of the ethwal file while it's written, the writer moves the complete
+// file to its path before the file is added to the file index.
+const StagingFileSuffix = ".tmp"
 const NumberOfDirectoriesPerLevel = 1000 // since there are 3 levels the maximal number of directories is 1000^3 = 1_000_000_000
 
 var (
 	ErrFileNotExist = fmt.Errorf("file does not exist")
+	ErrEmptyFile    = fmt.Errorf("file is empty")
+	// ErrOverlappingRange is returned by FileIndex.AddFile if the file overlaps the file of the index.
+	ErrOverlappingRange = fmt.Errorf("file block range overlaps")
+	// ErrOutOfOrder is returned by FileIndex.AddFile if the first block of the file is after its last block.
+	ErrOutOfOrder = fmt.Errorf("file block range is out of order")
 )
 
+// FileError is the error of the reader opening or decoding the file, Path is the path of the file relative to
+// the dataset it was opened at, the legacy one for the files stored with the legacy layout.
+type FileError struct {
+	Path          string
+	FirstBlockNum uint64
+	LastBlockNum  uint64
+	Err           error
+}
+
+func newFileError(file *File, err error) *FileError {
+	return &FileError{Path: file.openedPath(), FirstBlockNum: file.FirstBlockNum, LastBlockNum: file.LastBlockNum, Err: err}
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("file[%d-%d] %s: %s", e.FirstBlockNum, e.LastBlockNum, e.Path, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
 type File struct {
 	FirstBlockNum uint64 `json:"firstBlockNum" cbor:"0,keyasint"`
 	LastBlockNum  uint64 `json:"lastBlockNum" cbor:"1,keyasint"`
-
+	// SchemaVersion is the payload schema version the file was written under, see Options.SchemaVersion.
+	SchemaVersion int `json:"schemaVersion,omitempty" cbor:"2,keyasint,omitempty"`
+	// Bloom reports whether the bloom filter of the file is stored at BloomPath, see Options.BloomKeys.
+	Bloom bool `json:"bloom,omitempty" cbor:"3,keyasint,omitempty"`
+	// DigestRoot is the Merkle root of the block digests stored at DigestsPath, see Options.BlockDigest.
+	DigestRoot *common.Hash `json:"digestRoot,omitempty" cbor:"4,keyasint,omitempty"`
+	// ContentSize is the size of the file contents, zero for the files written before the checksums were
+	// recorded.
+	ContentSize uint64 `json:"size,omitempty" cbor:"5,keyasint,omitempty"`
+	// Checksum is the sha-256 of the compressed file contents, nil for the files written before the checksums
+	// were recorded, see Options.VerifyChecksumOnRead.
+	Checksum []byte `json:"checksum,omitempty" cbor:"6,keyasint,omitempty"`
+
+	// prefetchBuffer is never modified, the readers returned by Open keep reading it once it's released
 	prefetchBuffer []byte
+	// prefetchRefs is the number of the prefetches holding prefetchBuffer, see ReleasePrefetch
+	prefetchRefs   int
 	prefetchCtx    context.Context
+	prefetchCancel context.CancelFunc
+
+	// path is the path the file was last opened at, Path or legacyPath
+	path string
 
 	mu sync.Mutex
 }
 
+// Clone returns the copy of the fields of the file stored in the file index, e.g. to list the copied file in the
+// file index of another dataset. The prefetched data and the opened path aren't copied.
+func (f *File) Clone() *File {
+	clone := &File{
+		FirstBlockNum: f.FirstBlockNum,
+		LastBlockNum:  f.LastBlockNum,
+		SchemaVersion: f.SchemaVersion,
+		Bloom:         f.Bloom,
+		ContentSize:   f.ContentSize,
+		Checksum:      bytes.Clone(f.Checksum),
+	}
+	if f.DigestRoot != nil {
+		digestRoot := *f.DigestRoot
+		clone.DigestRoot = &digestRoot
+	}
+	return clone
+}
+
+// clone returns the copy of the file with its opened path, without its prefetched data.
+func (f *File) clone() *File {
+	clone := f.Clone()
+	clone.path = f.openedPath()
+	return clone
+}
+
 // Path returns the path to the file
 //
 // The directory structure:
@@ -157,58 +443,119 @@ func (f *File) Create(ctx context.Context, fs storage.FS) (io.WriteCloser, error
 }
 
 func (f *File) Open(ctx context.Context, fs storage.FS) (io.ReadCloser, error) {
-	prefetchedRdr := f.prefetched()
-	if prefetchedRdr != nil {
-		return prefetchedRdr, nil
+	return f.openScheduled(ctx, fs, nil)
+}
+
+// openScheduled opens the file with its reads marked as the foreground reads of the scheduler.
+func (f *File) openScheduled(ctx context.Context, fs storage.FS, scheduler *IOScheduler) (io.ReadCloser, error) {
+	prefetchBuffer := f.prefetched(scheduler)
+	if prefetchBuffer != nil {
+		return io.NopCloser(bytes.NewReader(prefetchBuffer)), nil
+	}
+
+	rdr, err := f.open(ctx, fs)
+	if err != nil {
+		return nil, err
 	}
-	return f.open(ctx, fs)
+	return scheduler.foreground(rdr), nil
 }
 
+// Prefetch reads the file into memory for the following Opens, the read fails with the context error once
+// the context is done. The file is read once, the prefetched data is shared by all Opens and held until each
+// successful Prefetch is released by ReleasePrefetch or the data is dropped by PrefetchClear.
 func (f *File) Prefetch(ctx context.Context, fs storage.FS) error {
+	_, err := f.prefetch(ctx, fs, nil)
+	return err
+}
+
+// prefetch reads the file in chunks yielding to the foreground reads of the scheduler, it reports whether
+// the prefetch holds the prefetched data and must be released. The prefetch in progress is canceled by
+// PrefetchClear.
+func (f *File) prefetch(ctx context.Context, fs storage.FS, scheduler *IOScheduler) (bool, error) {
 	f.mu.Lock()
 	// check if is already prefetched
 	if f.prefetchBuffer != nil {
+		f.prefetchRefs++
 		f.mu.Unlock()
-		return nil
+		return true, nil
 	}
-	// check if prefetch is in progress
+	// check if prefetch is in progress, the lock is released so that the prefetch can complete
 	if f.prefetchCtx != nil {
 		prefetchCtx := f.prefetchCtx
-		<-prefetchCtx.Done()
 		f.mu.Unlock()
-		return nil
+		<-prefetchCtx.Done()
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.prefetchBuffer == nil {
+			return false, nil
+		}
+		f.prefetchRefs++
+		return true, nil
 	}
 
 	// prepare prefetch context
 	prefetchCtx, cancelPrefetch := context.WithCancel(ctx)
-	defer cancelPrefetch()
 
 	// set prefetch context
-	f.prefetchCtx = prefetchCtx
+	f.prefetchCtx, f.prefetchCancel = prefetchCtx, cancelPrefetch
 	f.mu.Unlock()
 
-	rdr, err := f.open(ctx, fs)
+	defer func() {
+		f.mu.Lock()
+		f.prefetchCtx, f.prefetchCancel = nil, nil
+		f.mu.Unlock()
+		cancelPrefetch()
+	}()
+
+	rdr, err := f.open(prefetchCtx, fs)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	buff, err := io.ReadAll(rdr)
+	buff, err := scheduler.readAll(prefetchCtx, rdr)
 	if err != nil {
 		_ = rdr.Close()
-		return err
+		return false, err
 	}
 
 	f.mu.Lock()
-	f.prefetchBuffer = buff
+	// the buffer of the prefetch canceled by PrefetchClear is dropped
+	acquired := prefetchCtx.Err() == nil
+	if acquired {
+		f.prefetchBuffer = buff
+		f.prefetchRefs = 1
+	}
 	f.mu.Unlock()
-	return rdr.Close()
+	return acquired, rdr.Close()
+}
+
+// ReleasePrefetch releases the prefetched data held by the successful Prefetch, the data is dropped once
+// all prefetches are released.
+func (f *File) ReleasePrefetch() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.prefetchRefs == 0 {
+		return
+	}
+	f.prefetchRefs--
+	if f.prefetchRefs == 0 {
+		f.prefetchBuffer = nil
+	}
 }
 
+// PrefetchClear drops the prefetched data regardless of the prefetches holding it and cancels the prefetch
+// in progress. The readers already returned by Open keep reading the dropped data.
 func (f *File) PrefetchClear() {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	f.prefetchBuffer = nil
+	f.prefetchRefs = 0
+	if f.prefetchCancel != nil {
+		f.prefetchCancel()
+	}
 }
 
 func (f *File) Exist(ctx context.Context, fs storage.FS) bool {
@@ -217,12 +564,28 @@ func (f *File) Exist(ctx context.Context, fs storage.FS) bool {
 	return f.exist(ctx, fs) || f.existLegacy(ctx, fs)
 }
 
+// Size returns the size of the file stored on the file system.
+func (f *File) Size(ctx context.Context, fs storage.FS) (int64, error) {
+	attrs, err := fs.Attributes(ctx, f.Path(), nil)
+	if err != nil && storage.IsNotExist(err) {
+		attrs, err = fs.Attributes(ctx, f.legacyPath(), nil)
+	}
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return 0, ErrFileNotExist
+		}
+		return 0, err
+	}
+	return attrs.Size, nil
+}
+
 func (f *File) legacyPath() string {
 	return fmt.Sprintf("%d_%d.wal", f.FirstBlockNum, f.LastBlockNum)
 }
 
 func (f *File) open(ctx context.Context, fs storage.FS) (io.ReadCloser, error) {
 	if f.exist(ctx, fs) {
+		f.setOpenedPath(f.Path())
 		return fs.Open(ctx, f.Path(), nil)
 	}
 
@@ -233,32 +596,45 @@ func (f *File) open(ctx context.Context, fs storage.FS) (io.ReadCloser, error) {
 	if err != nil {
 		return nil, err
 	}
+	f.setOpenedPath(f.legacyPath())
 	return file, nil
 }
 
-func (f *File) prefetched() io.ReadCloser {
+// openedPath returns the path the file was last opened at, Path if it wasn't opened.
+func (f *File) openedPath() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.path == "" {
+		return f.Path()
+	}
+	return f.path
+}
+
+func (f *File) setOpenedPath(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.path = path
+}
+
+// prefetched returns the prefetched data of the file without releasing it, waiting for the prefetch in
+// progress. The data must not be modified.
+func (f *File) prefetched(scheduler *IOScheduler) []byte {
 	f.mu.Lock()
 	prefetchCtx := f.prefetchCtx
 	prefetchBuffer := f.prefetchBuffer
-	f.prefetchBuffer = nil
 	f.mu.Unlock()
 
 	if prefetchBuffer != nil {
 		// already prefetched
-		rdr := io.NopCloser(bytes.NewReader(prefetchBuffer))
-		return rdr
+		return prefetchBuffer
 	} else if prefetchCtx != nil {
 		// prefetch in progress
-		<-prefetchCtx.Done()
+		scheduler.waitPrefetch(prefetchCtx.Done())
 
 		f.mu.Lock()
 		defer f.mu.Unlock()
-		// check if prefetch was successful
-		if f.prefetchBuffer != nil {
-			rdr := io.NopCloser(bytes.NewReader(f.prefetchBuffer))
-			f.prefetchBuffer = nil
-			return rdr
-		}
+		// the prefetch may have failed
+		return f.prefetchBuffer
 	}
 	// no prefetch
 	return nil
@@ -296,6 +672,14 @@ type FileIndex struct {
 	fs storage.FS
 
 	files []*File
+	// prunedBefore is the block after the last pruned file, see Prune
+	prunedBefore uint64
+}
+
+// fileIndexMetadata is the metadata section of the file index, it's written only if any field is set, so
+// that the file index of the datasets without the metadata doesn't change.
+type fileIndexMetadata struct {
+	PrunedBefore uint64 `cbor:"0,keyasint,omitempty"`
 }
 
 func NewFileIndex(fs storage.FS) *FileIndex {
@@ -313,17 +697,47 @@ func NewFileIndexFromFiles(fs storage.FS, files []*File) *FileIndex {
 	}
 }
 
+// Files returns the files of the index in the block number order. The slice and the files are shared with the
+// index and must not be modified, the files are added with AddFile. Reader.FileIndex returns the copy of the
+// index of the reader.
 func (fi *FileIndex) Files() []*File {
 	return fi.files
 }
 
+// AddFile inserts the file to the index in the block number order, so that the files filling the gaps
+// between the files can be added. It returns ErrOverlappingRange if the file overlaps any file of the index
+// and ErrOutOfOrder if its block range is invalid.
 func (fi *FileIndex) AddFile(file *File) error {
-	_, _, err := fi.FindFile(file.FirstBlockNum)
-	if err == nil {
-		return fmt.Errorf("file already exist: block %d", file.FirstBlockNum)
+	if file.FirstBlockNum > file.LastBlockNum {
+		return fmt.Errorf("%w: file[%d-%d]", ErrOutOfOrder, file.FirstBlockNum, file.LastBlockNum)
 	}
 
-	fi.files = append(fi.files, file)
+	// the file overlaps the index only if it overlaps the first file ending at or after its first block
+	i := sort.Search(len(fi.files), func(i int) bool {
+		return file.FirstBlockNum <= fi.files[i].LastBlockNum
+	})
+	if i < len(fi.files) && fi.files[i].FirstBlockNum <= file.LastBlockNum {
+		return fmt.Errorf("%w: file[%d-%d] overlaps file[%d-%d]", ErrOverlappingRange,
+			file.FirstBlockNum, file.LastBlockNum, fi.files[i].FirstBlockNum, fi.files[i].LastBlockNum)
+	}
+
+	fi.files = slices.Insert(fi.files, i, file)
+	return nil
+}
+
+// replaceLastFile replaces the last file of the index with the file extending it, see Writer.Flush.
+func (fi *FileIndex) replaceLastFile(file *File) error {
+	if len(fi.files) == 0 {
+		return fmt.Errorf("%w: file[%d-%d] replaces no file", ErrOutOfOrder, file.FirstBlockNum, file.LastBlockNum)
+	}
+
+	last := fi.files[len(fi.files)-1]
+	if file.FirstBlockNum != last.FirstBlockNum || file.LastBlockNum < last.LastBlockNum {
+		return fmt.Errorf("%w: file[%d-%d] doesn't extend file[%d-%d]", ErrOutOfOrder,
+			file.FirstBlockNum, file.LastBlockNum, last.FirstBlockNum, last.LastBlockNum)
+	}
+
+	fi.files[len(fi.files)-1] = file
 	return nil
 }
 
@@ -344,6 +758,70 @@ func (fi *FileIndex) FindFile(blockNum uint64) (*File, int, error) {
 	return fi.files[i], i, nil
 }
 
+// BlockRange returns the first block of the first file and the last block of the last file, zeros if the
+// index has no files.
+func (fi *FileIndex) BlockRange() (first, last uint64) {
+	if len(fi.files) == 0 {
+		return 0, 0
+	}
+	return fi.files[0].FirstBlockNum, fi.files[len(fi.files)-1].LastBlockNum
+}
+
+// NumBlocks returns the number of the blocks within the block ranges of the files, the blocks skipped by
+// the writer within the file range are counted.
+func (fi *FileIndex) NumBlocks() uint64 {
+	var blocks uint64
+	for _, file := range fi.files {
+		blocks += file.LastBlockNum - file.FirstBlockNum + 1
+	}
+	return blocks
+}
+
+// Gaps returns the block ranges between the consecutive files that no file covers. The blocks before the
+// first file are not a gap, the dataset may start at any block.
+func (fi *FileIndex) Gaps() []BlockRange {
+	var gaps []BlockRange
+	for i := 1; i < len(fi.files); i++ {
+		prev, file := fi.files[i-1], fi.files[i]
+		if file.FirstBlockNum > prev.LastBlockNum+1 {
+			gaps = append(gaps, BlockRange{From: prev.LastBlockNum + 1, To: file.FirstBlockNum - 1})
+		}
+	}
+	return gaps
+}
+
+// Contains reports whether the block is within the block range of any file.
+func (fi *FileIndex) Contains(blockNum uint64) bool {
+	file, _, err := fi.FindFile(blockNum)
+	return err == nil && file.FirstBlockNum <= blockNum
+}
+
+// gaps returns block ranges within (fromExclusive, toExclusive) that are not covered by any file.
+// The ranges are returned as exclusive bounds.
+func (fi *FileIndex) gaps(fromExclusive, toExclusive uint64) [][2]uint64 {
+	var gaps [][2]uint64
+
+	next := fromExclusive + 1
+	_, index, err := fi.FindFile(next)
+	if err == nil {
+		for ; index < len(fi.files) && next < toExclusive; index++ {
+			file := fi.files[index]
+			if file.FirstBlockNum >= toExclusive {
+				break
+			}
+			if file.FirstBlockNum > next {
+				gaps = append(gaps, [2]uint64{next - 1, file.FirstBlockNum})
+			}
+			next = max(next, file.LastBlockNum+1)
+		}
+	}
+
+	if next < toExclusive {
+		gaps = append(gaps, [2]uint64{next - 1, toExclusive})
+	}
+	return gaps
+}
+
 func (fi *FileIndex) IsLoaded() bool {
 	return fi.files != nil
 }
@@ -359,32 +837,39 @@ func (fi *FileIndex) Save(ctx context.Context) error {
 		return err
 	}
 
-	comp := NewZSTDCompressor(indexFile)
-	enc := NewCBOREncoder(comp)
-
-	// close all resources
-	closeAll := func() error {
-		if err := comp.Close(); err != nil {
+	// encode all files
+	var buf bytes.Buffer
+	enc := NewCBOREncoder(&buf)
+	for _, file := range fi.files {
+		err = enc.Encode(file)
+		if err != nil {
 			_ = indexFile.Close()
 			return err
 		}
-		return indexFile.Close()
 	}
 
-	// write all files
-	for _, file := range fi.files {
-		err = enc.Encode(file)
+	sections := []containerSection{{Type: containerSectionFiles, Data: buf.Bytes()}}
+	if fi.prunedBefore > 0 {
+		var metadata bytes.Buffer
+		err = NewCBOREncoder(&metadata).Encode(fileIndexMetadata{PrunedBefore: fi.prunedBefore})
 		if err != nil {
-			_ = closeAll()
+			_ = indexFile.Close()
 			return err
 		}
+		sections = append(sections, containerSection{Type: containerSectionMetadata, Data: metadata.Bytes()})
 	}
-	return closeAll()
+
+	err = writeContainer(indexFile, containerFlagCompressed, sections...)
+	if err != nil {
+		_ = indexFile.Close()
+		return err
+	}
+	return indexFile.Close()
 }
 
 func (fi *FileIndex) loadFiles(ctx context.Context) error {
 	// check if file index exists, if not migrate all existing ethwal files to the file index
-	indexFile, openErr := fi.fs.Open(context.Background(), FileIndexFileName, nil)
+	indexFile, openErr := fi.fs.Open(ctx, FileIndexFileName, nil)
 	if openErr != nil && strings.Contains(openErr.Error(), "not exist") {
 		// migrate all existing ethwal files to the file index
 		migrationErr := migrateToFileIndex(ctx, fi.fs)
@@ -393,7 +878,7 @@ func (fi *FileIndex) loadFiles(ctx context.Context) error {
 		}
 
 		// open file index
-		indexFile, openErr = fi.fs.Open(context.Background(), FileIndexFileName, nil)
+		indexFile, openErr = fi.fs.Open(ctx, FileIndexFileName, nil)
 		if openErr != nil && strings.Contains(openErr.Error(), "not exist") {
 			// no files exist, so we return an empty list
 			fi.files = []*File{}
@@ -416,31 +901,133 @@ func (fi *FileIndex) loadFiles(ctx context.Context) error {
 
 func (fi *FileIndex) readFiles(ctx context.Context, rdr io.Reader) ([]*File, error) {
 	var files []*File
-	decomp := NewZSTDDecompressor(rdr)
-	dec := NewCBORDecoder(decomp)
+	err := fi.streamFiles(ctx, rdr, func(file *File) error {
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
 
-	for {
-		var file File
-		err := dec.Decode(&file)
+// Stream decodes the file index and calls fn for each file in the same order as Load, without keeping
+// the files in memory. If the file index doesn't exist yet, it's loaded (migrated) first. The iteration
+// stops at the first error returned by fn.
+func (fi *FileIndex) Stream(ctx context.Context, fn func(*File) error) error {
+	if fi.IsLoaded() {
+		for _, file := range fi.files {
+			if err := fn(file); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	indexFile, err := fi.fs.Open(ctx, FileIndexFileName, nil)
+	if err != nil && strings.Contains(err.Error(), "not exist") {
+		// file index needs to be migrated
+		migrated := NewFileIndex(fi.fs)
+		if err := migrated.Load(ctx); err != nil {
+			return err
+		}
+		return migrated.Stream(ctx, fn)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = fi.streamFiles(ctx, indexFile, fn)
+	if err != nil {
+		_ = indexFile.Close()
+		return err
+	}
+	return indexFile.Close()
+}
+
+func (fi *FileIndex) streamFiles(ctx context.Context, rdr io.Reader, fn func(*File) error) (err error) {
+	// the decompressor doesn't wrap the error of the reader canceled by the context
+	defer func() {
+		if err != nil && ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+			err = fmt.Errorf("%w: %w", ctx.Err(), err)
+		}
+	}()
+
+	container, err := openContainer(&contextReader{ctx: ctx, r: rdr})
+	if err != nil {
+		return fmt.Errorf("failed to open file index: %w", err)
+	}
+
+	// the last file is held back until the next one is decoded, so it can be checked for existence
+	var last *File
+	decodeFiles := func(r io.Reader) error {
+		dec := NewCBORDecoder(r)
+		for {
+			var file File
+			err := dec.Decode(&file)
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				return err
+			}
+
+			if last != nil {
+				if err := fn(last); err != nil {
+					return err
+				}
+			}
+			last = &file
+		}
+	}
+
+	// legacy file index without header
+	if container.Version == 0 {
+		err = decodeFiles(container.Legacy())
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
+			_ = container.Close()
+			return err
+		}
+	}
+
+	for container.Version > 0 {
+		sectionType, section, err := container.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			_ = container.Close()
+			return err
+		}
+
+		switch sectionType {
+		case containerSectionFiles:
+			err = decodeFiles(section)
+			if err != nil {
+				_ = container.Close()
+				return err
+			}
+		case containerSectionMetadata:
+			var metadata fileIndexMetadata
+			err = NewCBORDecoder(section).Decode(&metadata)
+			if err != nil {
+				_ = container.Close()
+				return fmt.Errorf("failed to decode file index metadata: %w", err)
 			}
-			_ = decomp.Close()
-			return nil, err
+			fi.prunedBefore = metadata.PrunedBefore
 		}
-		files = append(files, &file)
 	}
 
-	// remove last file if it does not exist, it may be incomplete due to crash
-	if len(files) != 0 && !files[len(files)-1].Exist(ctx, fi.fs) {
-		files = files[:len(files)-1]
+	if err := container.Close(); err != nil {
+		return err
 	}
 
-	if err := decomp.Close(); err != nil {
-		return nil, err
+	// skip last file if it does not exist, it may be incomplete due to crash
+	if last != nil && last.Exist(ctx, fi.fs) {
+		return fn(last)
 	}
-	return files, nil
+	// the existence check canceled by the context doesn't skip the file
+	return ctx.Err()
 }
 
 // migrateToFileIndex migrates all ethwal files to the file index
@@ -500,3 +1087,17 @@ func (f *funcCloser) Close() error {
 	}
 	return nil
 }
+
+// contextReader is the reader failing with the context error once the context is done, the context is
+// checked before each read.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
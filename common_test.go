@@ -1,13 +1,23 @@
 package ethwal
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"runtime"
+	"slices"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/0xsequence/ethwal/storage"
 	"github.com/0xsequence/ethwal/storage/local"
+	"github.com/0xsequence/ethwal/storage/memory"
+	gostorage "github.com/Shopify/go-storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -137,7 +147,7 @@ func TestFile_Prefetch(t *testing.T) {
 		assert.Nil(t, file.prefetchBuffer)
 	})
 
-	t.Run("WhenExistClearByOpen", func(t *testing.T) {
+	t.Run("WhenExistKeptByOpen", func(t *testing.T) {
 		// setup
 		file := setupTestFile(t)
 		defer teardownTestFile(t)
@@ -150,7 +160,7 @@ func TestFile_Prefetch(t *testing.T) {
 
 		assert.NotNil(t, file.prefetchBuffer)
 
-		// get prefetch buffer
+		// hold the prefetch buffer twice
 		err = file.Prefetch(context.Background(), fs)
 		require.NoError(t, err)
 		assert.NotNil(t, file.prefetchBuffer)
@@ -160,7 +170,78 @@ func TestFile_Prefetch(t *testing.T) {
 		require.NoError(t, err)
 		assert.NotNil(t, f)
 
+		// the buffer is kept until all prefetches are released
+		assert.NotNil(t, file.prefetchBuffer)
+		file.ReleasePrefetch()
+		assert.NotNil(t, file.prefetchBuffer)
+		file.ReleasePrefetch()
+		assert.Nil(t, file.prefetchBuffer)
+		file.ReleasePrefetch()
+	})
+
+	t.Run("SharedByConcurrentReaders", func(t *testing.T) {
+		fs := &openRecordingFS{FS: gostorage.NewMemoryFS(), opened: make(map[string]int)}
+		file := &File{FirstBlockNum: 1, LastBlockNum: 10}
+		data := bytes.Repeat([]byte("ethwal"), 16*1024)
+		w, err := file.Create(context.Background(), fs)
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		// both readers prefetch the file and read it concurrently before releasing it
+		var wg, prefetched sync.WaitGroup
+		prefetched.Add(2)
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, file.Prefetch(context.Background(), fs))
+				defer file.ReleasePrefetch()
+				prefetched.Done()
+				prefetched.Wait()
+
+				rdr, err := file.Open(context.Background(), fs)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer rdr.Close()
+				read, err := io.ReadAll(rdr)
+				assert.NoError(t, err)
+				assert.Equal(t, data, read)
+			}()
+		}
+		wg.Wait()
+
+		require.Equal(t, 1, fs.opened[file.Path()])
+		require.Nil(t, file.prefetchBuffer)
+	})
+
+	t.Run("ClearWhileReading", func(t *testing.T) {
+		// setup
+		file := setupTestFile(t)
+		defer teardownTestFile(t)
+
+		// test
+		fs := local.NewLocalFS(testRoot)
+		require.NoError(t, file.Prefetch(context.Background(), fs))
+
+		f, err := file.Open(context.Background(), fs)
+		require.NoError(t, err)
+		defer f.Close()
+
+		// the opened reader keeps reading the cleared buffer
+		file.PrefetchClear()
 		assert.Nil(t, file.prefetchBuffer)
+		read, err := io.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, "hello world", string(read))
+
+		// the released prefetch doesn't release the next one
+		file.ReleasePrefetch()
+		require.NoError(t, file.Prefetch(context.Background(), fs))
+		assert.NotNil(t, file.prefetchBuffer)
+		file.PrefetchClear()
 	})
 
 	t.Run("WhenNotExist", func(t *testing.T) {
@@ -238,14 +319,83 @@ func TestFileIndex_AddFile(t *testing.T) {
 		LastBlockNum:  50070,
 	}
 	err = fi.AddFile(file)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrOverlappingRange)
 
 	file = &File{
 		FirstBlockNum: 0,
 		LastBlockNum:  50070,
 	}
 	err = fi.AddFile(file)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrOverlappingRange)
+	// the file filling the gap is inserted in the block number order
+	fi = NewFileIndexFromFiles(nil, []*File{
+		{FirstBlockNum: 1, LastBlockNum: 10},
+		{FirstBlockNum: 21, LastBlockNum: 30},
+	})
+	file = &File{
+		FirstBlockNum: 11,
+		LastBlockNum:  20,
+	}
+	err = fi.AddFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, file, fi.At(1))
+
+	file = &File{
+		FirstBlockNum: 5,
+		LastBlockNum:  12,
+	}
+	err = fi.AddFile(file)
+	require.ErrorIs(t, err, ErrOverlappingRange)
+}
+
+func TestFileIndex_AddFile_Ranges(t *testing.T) {
+	testCases := []struct {
+		name  string
+		first uint64
+		last  uint64
+		err   error
+		at    int
+	}{
+		{name: "gap", first: 51, last: 60, at: 1},
+		{name: "adjacent_front", first: 61, last: 70, at: 1},
+		{name: "before_first", first: 1, last: 10, at: 0},
+		{name: "after_last", first: 101, last: 110, at: 2},
+		{name: "overlap_front", first: 60, last: 75, err: ErrOverlappingRange},
+		{name: "overlap_back", first: 40, last: 55, err: ErrOverlappingRange},
+		{name: "contained", first: 75, last: 80, err: ErrOverlappingRange},
+		{name: "containing", first: 45, last: 95, err: ErrOverlappingRange},
+		{name: "spanning_gap", first: 50, last: 61, err: ErrOverlappingRange},
+		{name: "duplicate", first: 71, last: 100, err: ErrOverlappingRange},
+		{name: "out_of_order", first: 56, last: 55, err: ErrOutOfOrder},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// the files 11-50 and 71-100
+			fi := NewFileIndexFromFiles(nil, []*File{
+				{FirstBlockNum: 11, LastBlockNum: 50},
+				{FirstBlockNum: 71, LastBlockNum: 100},
+			})
+
+			file := &File{FirstBlockNum: tc.first, LastBlockNum: tc.last}
+			err := fi.AddFile(file)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Same(t, file, fi.At(tc.at))
+
+			// the files stay sorted and FindFile finds the added file
+			require.True(t, slices.IsSortedFunc(fi.Files(), func(a, b *File) int {
+				return cmp.Compare(a.FirstBlockNum, b.FirstBlockNum)
+			}))
+			found, index, err := fi.FindFile(tc.last)
+			require.NoError(t, err)
+			require.Same(t, file, found)
+			require.Equal(t, tc.at, index)
+		})
+	}
 }
 
 func TestFileIndex_At(t *testing.T) {
@@ -299,6 +449,119 @@ func TestFileIndex_FindFile(t *testing.T) {
 	require.ErrorIs(t, err, ErrFileNotExist)
 }
 
+func TestFileIndex_Coverage(t *testing.T) {
+	testCases := []struct {
+		name      string
+		files     []*File
+		first     uint64
+		last      uint64
+		numBlocks uint64
+		gaps      []BlockRange
+		contains  []uint64
+		missing   []uint64
+	}{
+		{
+			name:    "empty",
+			missing: []uint64{0, 1},
+		},
+		{
+			name:      "single_file",
+			files:     []*File{{FirstBlockNum: 0, LastBlockNum: 9}},
+			first:     0,
+			last:      9,
+			numBlocks: 10,
+			contains:  []uint64{0, 9},
+			missing:   []uint64{10},
+		},
+		{
+			name: "contiguous",
+			files: []*File{
+				{FirstBlockNum: 1, LastBlockNum: 10},
+				{FirstBlockNum: 11, LastBlockNum: 20},
+				{FirstBlockNum: 21, LastBlockNum: 21},
+			},
+			first:     1,
+			last:      21,
+			numBlocks: 21,
+			contains:  []uint64{1, 10, 11, 21},
+			missing:   []uint64{0, 22},
+		},
+		{
+			name: "starts_above_zero",
+			files: []*File{
+				{FirstBlockNum: 1000, LastBlockNum: 1099},
+				{FirstBlockNum: 1100, LastBlockNum: 1199},
+			},
+			first:     1000,
+			last:      1199,
+			numBlocks: 200,
+			contains:  []uint64{1000, 1199},
+			missing:   []uint64{0, 999, 1200},
+		},
+		{
+			name: "gaps",
+			files: []*File{
+				{FirstBlockNum: 21, LastBlockNum: 30},
+				{FirstBlockNum: 1, LastBlockNum: 10},
+				{FirstBlockNum: 32, LastBlockNum: 40},
+				{FirstBlockNum: 41, LastBlockNum: 50},
+			},
+			first:     1,
+			last:      50,
+			numBlocks: 39,
+			gaps:      []BlockRange{{From: 11, To: 20}, {From: 31, To: 31}},
+			contains:  []uint64{1, 10, 21, 32, 50},
+			missing:   []uint64{11, 20, 31, 51},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fi := NewFileIndexFromFiles(nil, tc.files)
+
+			first, last := fi.BlockRange()
+			require.Equal(t, tc.first, first)
+			require.Equal(t, tc.last, last)
+			require.Equal(t, tc.numBlocks, fi.NumBlocks())
+			require.Equal(t, tc.gaps, fi.Gaps())
+			for _, blockNum := range tc.contains {
+				require.True(t, fi.Contains(blockNum), blockNum)
+			}
+			for _, blockNum := range tc.missing {
+				require.False(t, fi.Contains(blockNum), blockNum)
+			}
+		})
+	}
+
+	t.Run("legacy_files", func(t *testing.T) {
+		fs := memory.NewMemoryFS()
+		for _, file := range []*File{{FirstBlockNum: 101, LastBlockNum: 200}, {FirstBlockNum: 301, LastBlockNum: 400}} {
+			w, err := fs.Create(context.Background(), file.legacyPath(), nil)
+			require.NoError(t, err)
+			_, err = w.Write([]byte{0x01})
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+		}
+
+		fi := NewFileIndex(fs)
+		require.NoError(t, fi.Load(context.Background()))
+
+		first, last := fi.BlockRange()
+		require.Equal(t, uint64(101), first)
+		require.Equal(t, uint64(400), last)
+		require.Equal(t, uint64(200), fi.NumBlocks())
+		require.Equal(t, []BlockRange{{From: 201, To: 300}}, fi.Gaps())
+		require.True(t, fi.Contains(150))
+		require.False(t, fi.Contains(250))
+
+		// the file index is migrated and the files are found at their legacy paths
+		_, err := fs.Attributes(context.Background(), FileIndexFileName, nil)
+		require.NoError(t, err)
+		require.True(t, fi.Files()[0].Exist(context.Background(), fs))
+		require.False(t, (&File{FirstBlockNum: 201, LastBlockNum: 300}).Exist(context.Background(), fs))
+	})
+}
+
 func TestFileIndex_Save(t *testing.T) {
 	file := setupTestFile(t)
 	defer teardownTestFile(t)
@@ -312,6 +575,205 @@ func TestFileIndex_Save(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestFileIndex_Stream(t *testing.T) {
+	file := setupTestFile(t)
+	defer teardownTestFile(t)
+
+	fs := local.NewLocalFS(testRoot)
+
+	// the last file doesn't exist, it's skipped by both Load and Stream
+	files := []*File{
+		{FirstBlockNum: 0, LastBlockNum: 0},
+		file,
+		{FirstBlockNum: 50, LastBlockNum: 99},
+	}
+	err := NewFileIndexFromFiles(fs, files).Save(context.Background())
+	require.NoError(t, err)
+
+	loaded := NewFileIndex(fs)
+	err = loaded.Load(context.Background())
+	require.NoError(t, err)
+	require.Len(t, loaded.Files(), 2)
+
+	var streamed []*File
+	err = NewFileIndex(fs).Stream(context.Background(), func(file *File) error {
+		streamed = append(streamed, file)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, loaded.Files(), streamed)
+
+	// iteration stops at the first error
+	var count int
+	err = NewFileIndex(fs).Stream(context.Background(), func(file *File) error {
+		count++
+		return fmt.Errorf("stop")
+	})
+	require.EqualError(t, err, "stop")
+	require.Equal(t, 1, count)
+}
+
+// hangingFS blocks the operations of the paths until the context is done and reads the opened files slowly.
+type hangingFS struct {
+	storage.FS
+
+	hangOpen       string
+	hangAttributes string
+	hangWalk       bool
+	slowReads      bool
+}
+
+func (h *hangingFS) Open(ctx context.Context, path string, options *gostorage.ReaderOptions) (*gostorage.File, error) {
+	if path == h.hangOpen {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	file, err := h.FS.Open(ctx, path, options)
+	if err != nil || !h.slowReads {
+		return file, err
+	}
+	return &gostorage.File{ReadCloser: &slowReadCloser{ReadCloser: file.ReadCloser}, Attributes: file.Attributes}, nil
+}
+
+func (h *hangingFS) Attributes(ctx context.Context, path string, options *gostorage.ReaderOptions) (*gostorage.Attributes, error) {
+	if path == h.hangAttributes {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return h.FS.Attributes(ctx, path, options)
+}
+
+func (h *hangingFS) Walk(ctx context.Context, path string, fn gostorage.WalkFn) error {
+	if h.hangWalk {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return h.FS.Walk(ctx, path, fn)
+}
+
+// slowReadCloser reads a few bytes per read.
+type slowReadCloser struct {
+	io.ReadCloser
+}
+
+func (s *slowReadCloser) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return s.ReadCloser.Read(p[:min(len(p), 16)])
+}
+
+func TestFileIndex_LoadCanceled(t *testing.T) {
+	fs := gostorage.NewMemoryFS()
+	files := []*File{{FirstBlockNum: 1, LastBlockNum: 10}, {FirstBlockNum: 11, LastBlockNum: 20}}
+	for _, file := range files {
+		w, err := file.Create(context.Background(), fs)
+		require.NoError(t, err)
+		_, err = w.Write(make([]byte, 64*1024))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+	require.NoError(t, NewFileIndexFromFiles(fs, files).Save(context.Background()))
+
+	// canceled returns the error of the operation canceled by the context timeout and checks it returns promptly
+	canceled := func(t *testing.T, fn func(ctx context.Context) error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err := fn(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Less(t, time.Since(start), time.Second)
+	}
+
+	t.Run("open", func(t *testing.T) {
+		canceled(t, NewFileIndex(&hangingFS{FS: fs, hangOpen: FileIndexFileName}).Load)
+	})
+
+	t.Run("migrate", func(t *testing.T) {
+		canceled(t, NewFileIndex(&hangingFS{FS: gostorage.NewMemoryFS(), hangWalk: true}).Load)
+	})
+
+	// the last file isn't skipped as if it didn't exist
+	t.Run("last_file_exist", func(t *testing.T) {
+		canceled(t, NewFileIndex(&hangingFS{FS: fs, hangAttributes: files[1].Path()}).Load)
+	})
+
+	t.Run("prefetch", func(t *testing.T) {
+		file := &File{FirstBlockNum: 1, LastBlockNum: 10}
+		canceled(t, func(ctx context.Context) error {
+			return file.Prefetch(ctx, &hangingFS{FS: fs, slowReads: true})
+		})
+		require.Nil(t, file.prefetchBuffer)
+
+		// the prefetch completes with the context not canceled
+		require.NoError(t, file.Prefetch(context.Background(), fs))
+		require.Len(t, file.prefetchBuffer, 64*1024)
+	})
+}
+
+func setupBenchFileIndex(b *testing.B, numFiles uint64) storage.FS {
+	fs := local.NewLocalFS(b.TempDir())
+
+	files := make([]*File, 0, numFiles)
+	for i := uint64(0); i < numFiles; i++ {
+		files = append(files, &File{FirstBlockNum: i * 50, LastBlockNum: i*50 + 49})
+	}
+
+	// the last file needs to exist
+	lastFile, err := files[len(files)-1].Create(context.Background(), fs)
+	require.NoError(b, err)
+	require.NoError(b, lastFile.Close())
+
+	require.NoError(b, NewFileIndexFromFiles(fs, files).Save(context.Background()))
+	return fs
+}
+
+// reportLiveHeap reports the heap retained at the time of the call.
+func reportLiveHeap(b *testing.B) {
+	runtime.GC()
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	b.ReportMetric(float64(stats.HeapAlloc), "live-heap-B")
+}
+
+func BenchmarkFileIndex_Load(b *testing.B) {
+	fs := setupBenchFileIndex(b, 1_000_000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fi := NewFileIndex(fs)
+		err := fi.Load(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		reportLiveHeap(b)
+		runtime.KeepAlive(fi)
+	}
+}
+
+func BenchmarkFileIndex_Stream(b *testing.B) {
+	fs := setupBenchFileIndex(b, 1_000_000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var count int
+		err := NewFileIndex(fs).Stream(context.Background(), func(file *File) error {
+			// live heap in the middle of iteration
+			if count++; count == 500_000 {
+				reportLiveHeap(b)
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkFindInFileIndex(b *testing.B) {
 	benchCase := []struct {
 		NumFiles uint64
@@ -1,6 +1,7 @@
 package ethwal
 
 import (
+	"fmt"
 	"io"
 
 	"github.com/DataDog/zstd"
@@ -18,10 +19,60 @@ type NewCompressorFunc func(w io.Writer) Compressor
 
 type NewDecompressorFunc func(r io.Reader) Decompressor
 
+// ErrFlushNotSupported is returned by Writer.Flush if the compressor can't end the stream without closing it.
+var ErrFlushNotSupported = fmt.Errorf("compressor doesn't support flush")
+
+// flushableCompressor is the compressor that ends the data compressed so far without closing the stream,
+// see Writer.Flush.
+type flushableCompressor interface {
+	// flushEnd flushes the compressed data and returns the bytes ending the stream after it, the stream
+	// continues without them.
+	flushEnd() ([]byte, error)
+}
+
+// zstdEmptyLastBlock is the empty raw last block of the zstd frame, it ends the flushed frame written
+// without the content size and the checksum.
+var zstdEmptyLastBlock = []byte{0x01, 0x00, 0x00}
+
+type zstdCompressor struct {
+	*zstd.Writer
+}
+
+func (z zstdCompressor) flushEnd() ([]byte, error) {
+	err := z.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return zstdEmptyLastBlock, nil
+}
+
 func NewZSTDCompressor(w io.Writer) Compressor {
-	return zstd.NewWriterLevel(w, zstd.BestSpeed)
+	return zstdCompressor{Writer: zstd.NewWriterLevel(w, zstd.BestSpeed)}
 }
 
 func NewZSTDDecompressor(r io.Reader) Decompressor {
 	return zstd.NewReader(r)
 }
+
+// NewZSTDCompressorWithDict returns the zstd compressor constructor that compresses with the dictionary, e.g.
+// the one of TrainDictionary. The small files and the flushed blocks compress better with the dictionary of
+// the data they're similar to, the files are decompressed by NewZSTDDecompressorWithDict of the same dictionary.
+func NewZSTDCompressorWithDict(dict []byte) NewCompressorFunc {
+	if len(dict) == 0 {
+		dict = nil
+	}
+	return func(w io.Writer) Compressor {
+		return zstdCompressor{Writer: zstd.NewWriterLevelDict(w, zstd.BestSpeed, dict)}
+	}
+}
+
+// NewZSTDDecompressorWithDict returns the zstd decompressor constructor that decompresses with the dictionary,
+// the files compressed without the dictionary are decompressed too.
+func NewZSTDDecompressorWithDict(dict []byte) NewDecompressorFunc {
+	if len(dict) == 0 {
+		dict = nil
+	}
+	return func(r io.Reader) Decompressor {
+		return zstd.NewReaderDict(r, dict)
+	}
+}
@@ -0,0 +1,510 @@
+// Package conformance generates the deterministic reference datasets and the manifest describing them, so
+// that other implementations of ethwal can verify their path layout, codecs, compression, file index and
+// index files against the Go implementation.
+//
+// The reference vectors are committed in testdata, they are regenerated and compared by the tests:
+//
+//	go test ./conformance -update
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/0xsequence/ethwal"
+	"github.com/0xsequence/ethwal/storage/local"
+)
+
+const (
+	// Seed is the seed of the generated block data.
+	Seed = 20240601
+	// NumBlocks is the number of blocks in each dataset, starting at block 1.
+	NumBlocks = 32
+	// BlocksPerFile is the number of blocks in each ethwal file.
+	BlocksPerFile = 8
+
+	// ManifestFileName is the name of the manifest in the vectors root directory.
+	ManifestFileName = "manifest.json"
+
+	firstBlockTS = 1_700_000_000
+	blockTime    = 12
+)
+
+// Index names and values of the reference datasets.
+const (
+	// IndexParity indexes positions of the even and odd values.
+	IndexParity = "parity"
+	// IndexMarked indexes every fifth block with ethwal.IndexAllDataIndexes.
+	IndexMarked = "marked"
+
+	ValueEven = "even"
+	ValueOdd  = "odd"
+	ValueTrue = "true"
+)
+
+// Manifest describes the reference datasets.
+type Manifest struct {
+	Seed          int64            `json:"seed"`
+	NumBlocks     uint64           `json:"numBlocks"`
+	BlocksPerFile uint64           `json:"blocksPerFile"`
+	Datasets      []DatasetVectors `json:"datasets"`
+}
+
+// DatasetVectors describes a dataset written with one codec and compression.
+type DatasetVectors struct {
+	// Name is the directory of the dataset relative to the vectors root.
+	Name        string `json:"name"`
+	Encoding    string `json:"encoding"`
+	Compression string `json:"compression"`
+
+	Files     []FileVector   `json:"files"`
+	FileIndex ObjectVector   `json:"fileIndex"`
+	Blocks    []BlockVector  `json:"blocks"`
+	Queries   []QueryVector  `json:"queries"`
+	Objects   []ObjectVector `json:"objects"`
+}
+
+// FileVector is an ethwal file and its block range.
+type FileVector struct {
+	FirstBlockNum uint64 `json:"firstBlockNum"`
+	LastBlockNum  uint64 `json:"lastBlockNum"`
+	Path          string `json:"path"`
+}
+
+// BlockVector is a block of the dataset. The digest is the sha-256 of the block encoded with the dataset
+// encoding, before compression.
+type BlockVector struct {
+	Number uint64      `json:"number"`
+	Hash   common.Hash `json:"hash"`
+	TS     uint64      `json:"ts"`
+	Data   []uint64    `json:"data"`
+	Digest string      `json:"digest"`
+}
+
+// QueryVector is a filter query and the positions it matches. A data index of 65535 matches all the
+// data of the block.
+type QueryVector struct {
+	Name    string          `json:"name"`
+	Results []QueryPosition `json:"results"`
+}
+
+// QueryPosition is a single position matched by a query.
+type QueryPosition struct {
+	BlockNum  uint64 `json:"blockNum"`
+	DataIndex uint16 `json:"dataIndex"`
+}
+
+// ObjectVector is a stored object, the path is relative to the dataset directory.
+type ObjectVector struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type datasetConfig struct {
+	name        string
+	encoding    string
+	compression string
+
+	newEncoder      ethwal.NewEncoderFunc
+	newCompressor   ethwal.NewCompressorFunc
+	newDecompressor ethwal.NewDecompressorFunc
+}
+
+var datasetConfigs = []datasetConfig{
+	{name: "cbor-zstd", encoding: "cbor", compression: "zstd", newEncoder: ethwal.NewCBOREncoder, newCompressor: ethwal.NewZSTDCompressor, newDecompressor: ethwal.NewZSTDDecompressor},
+	{name: "cbor", encoding: "cbor", compression: "none", newEncoder: ethwal.NewCBOREncoder},
+	{name: "json-zstd", encoding: "json", compression: "zstd", newEncoder: ethwal.NewJSONEncoder, newCompressor: ethwal.NewZSTDCompressor, newDecompressor: ethwal.NewZSTDDecompressor},
+	{name: "json", encoding: "json", compression: "none", newEncoder: ethwal.NewJSONEncoder},
+}
+
+// Blocks returns the blocks of the reference datasets.
+func Blocks() []ethwal.Block[[]uint64] {
+	rnd := rand.New(rand.NewSource(Seed))
+
+	blocks := make([]ethwal.Block[[]uint64], 0, NumBlocks)
+	for i := uint64(1); i <= NumBlocks; i++ {
+		var hash common.Hash
+		_, _ = rnd.Read(hash[:])
+
+		data := make([]uint64, rnd.Intn(4))
+		for j := range data {
+			data[j] = uint64(rnd.Intn(1000))
+		}
+
+		blocks = append(blocks, ethwal.Block[[]uint64]{
+			Hash:   hash,
+			Number: i,
+			TS:     firstBlockTS + i*blockTime,
+			Data:   data,
+		})
+	}
+	return blocks
+}
+
+// Indexes returns the indexes of the reference datasets.
+func Indexes() ethwal.Indexes[[]uint64] {
+	return ethwal.Indexes[[]uint64]{
+		IndexParity: ethwal.NewIndex[[]uint64](IndexParity, indexParity),
+		IndexMarked: ethwal.NewIndex[[]uint64](IndexMarked, indexMarked),
+	}
+}
+
+func indexParity(block ethwal.Block[[]uint64]) (bool, map[ethwal.IndexedValue][]ethwal.Position, error) {
+	if len(block.Data) == 0 {
+		return false, nil, nil
+	}
+
+	indexValueMap := make(map[ethwal.IndexedValue][]ethwal.Position)
+	for i, value := range block.Data {
+		if value%2 == 0 {
+			indexValueMap[ValueEven] = append(indexValueMap[ValueEven], ethwal.OrdinalPosition(i))
+		} else {
+			indexValueMap[ValueOdd] = append(indexValueMap[ValueOdd], ethwal.OrdinalPosition(i))
+		}
+	}
+	return true, indexValueMap, nil
+}
+
+func indexMarked(block ethwal.Block[[]uint64]) (bool, map[ethwal.IndexedValue][]ethwal.Position, error) {
+	if block.Number%5 != 0 {
+		return false, nil, nil
+	}
+	return true, map[ethwal.IndexedValue][]ethwal.Position{ValueTrue: ethwal.Ordinals(ethwal.IndexAllDataIndexes)}, nil
+}
+
+// queries are the canonical filter queries of the reference datasets. And intersects the positions, not
+// the blocks, so the even and odd values of the same block don't match.
+var queries = []struct {
+	name  string
+	build func(fb ethwal.FilterBuilder) ethwal.Filter
+}{
+	{name: "parity=even", build: func(fb ethwal.FilterBuilder) ethwal.Filter {
+		return fb.Eq(IndexParity, ValueEven)
+	}},
+	{name: "parity=odd", build: func(fb ethwal.FilterBuilder) ethwal.Filter {
+		return fb.Eq(IndexParity, ValueOdd)
+	}},
+	{name: "marked=true", build: func(fb ethwal.FilterBuilder) ethwal.Filter {
+		return fb.Eq(IndexMarked, ValueTrue)
+	}},
+	{name: "parity=even AND parity=odd", build: func(fb ethwal.FilterBuilder) ethwal.Filter {
+		return fb.And(fb.Eq(IndexParity, ValueEven), fb.Eq(IndexParity, ValueOdd))
+	}},
+	{name: "parity=odd OR marked=true", build: func(fb ethwal.FilterBuilder) ethwal.Filter {
+		return fb.Or(fb.Eq(IndexParity, ValueOdd), fb.Eq(IndexMarked, ValueTrue))
+	}},
+	{name: "NOT parity=even", build: func(fb ethwal.FilterBuilder) ethwal.Filter {
+		return fb.Not(fb.Eq(IndexParity, ValueEven))
+	}},
+	{name: "parity=odd AND blocks 10-20", build: func(fb ethwal.FilterBuilder) ethwal.Filter {
+		return fb.And(fb.Eq(IndexParity, ValueOdd), fb.BlockRange(10, 20))
+	}},
+}
+
+// Generate writes the reference datasets to the root directory and returns the manifest. The manifest is
+// not written, see WriteManifest.
+func Generate(ctx context.Context, root string) (*Manifest, error) {
+	manifest := &Manifest{
+		Seed:          Seed,
+		NumBlocks:     NumBlocks,
+		BlocksPerFile: BlocksPerFile,
+	}
+
+	for _, cfg := range datasetConfigs {
+		vectors, err := generateDataset(ctx, root, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("conformance: failed to generate %s dataset: %w", cfg.name, err)
+		}
+		manifest.Datasets = append(manifest.Datasets, *vectors)
+	}
+	return manifest, nil
+}
+
+func generateDataset(ctx context.Context, root string, cfg datasetConfig) (*DatasetVectors, error) {
+	dataset := ethwal.Dataset{Path: filepath.Join(root, cfg.name)}
+	fs := local.NewLocalFS(dataset.FullPath())
+
+	w, err := ethwal.NewWriter[[]uint64](ethwal.Options{
+		Dataset:         dataset,
+		NewCompressor:   cfg.newCompressor,
+		NewDecompressor: cfg.newDecompressor,
+		NewEncoder:      cfg.newEncoder,
+		FileRollPolicy:  ethwal.NewLastBlockNumberRollPolicy(BlocksPerFile),
+		FileRollOnClose: true,
+		InstanceID:      "conformance",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	indexer, err := ethwal.NewIndexer(ctx, ethwal.IndexerOptions[[]uint64]{
+		Dataset:    dataset,
+		Indexes:    Indexes(),
+		InstanceID: "conformance",
+	})
+	if err != nil {
+		_ = w.Close(ctx)
+		return nil, err
+	}
+
+	vectors := &DatasetVectors{
+		Name:        cfg.name,
+		Encoding:    cfg.encoding,
+		Compression: cfg.compression,
+	}
+
+	for _, block := range Blocks() {
+		err = w.Write(ctx, block)
+		if err != nil {
+			_ = w.Close(ctx)
+			return nil, err
+		}
+
+		err = indexer.Index(ctx, block)
+		if err != nil {
+			_ = w.Close(ctx)
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		err = cfg.newEncoder(&buf).Encode(block)
+		if err != nil {
+			_ = w.Close(ctx)
+			return nil, err
+		}
+
+		digest := sha256.Sum256(buf.Bytes())
+		vectors.Blocks = append(vectors.Blocks, BlockVector{
+			Number: block.Number,
+			Hash:   block.Hash,
+			TS:     block.TS,
+			Data:   block.Data,
+			Digest: hex.EncodeToString(digest[:]),
+		})
+	}
+
+	err = w.Close(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = indexer.Close(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ethwal.ListFiles(ctx, fs)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		vectors.Files = append(vectors.Files, FileVector{
+			FirstBlockNum: file.FirstBlockNum,
+			LastBlockNum:  file.LastBlockNum,
+			Path:          file.Path(),
+		})
+	}
+
+	fb, err := ethwal.NewFilterBuilder(ethwal.FilterBuilderOptions[[]uint64]{
+		Dataset: dataset,
+		Indexes: Indexes(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, query := range queries {
+		results := []QueryPosition{}
+		iter := query.build(fb).Eval(ctx)
+		for iter.HasNext() {
+			blockNum, dataIndex := iter.Next()
+			results = append(results, QueryPosition{BlockNum: blockNum, DataIndex: dataIndex})
+		}
+		vectors.Queries = append(vectors.Queries, QueryVector{Name: query.name, Results: results})
+	}
+
+	vectors.Objects, err = listObjects(dataset.FullPath())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, object := range vectors.Objects {
+		if object.Path == ethwal.FileIndexFileName {
+			vectors.FileIndex = object
+		}
+	}
+	return vectors, nil
+}
+
+// listObjects lists all objects stored in the directory sorted by path.
+func listObjects(root string) ([]ObjectVector, error) {
+	var objects []ObjectVector
+	err := filepath.WalkDir(root, func(filePath string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+
+		digest := sha256.Sum256(data)
+		objects = append(objects, ObjectVector{
+			Path:   filepath.ToSlash(relPath),
+			Size:   int64(len(data)),
+			SHA256: hex.EncodeToString(digest[:]),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Path < objects[j].Path
+	})
+	return objects, nil
+}
+
+// Verify checks that the datasets in the root directory match the manifest. The objects are compared
+// byte by byte through their digests, the blocks and the query results are read with ethwal.
+func Verify(ctx context.Context, root string, manifest *Manifest) error {
+	for _, vectors := range manifest.Datasets {
+		err := verifyDataset(ctx, root, vectors)
+		if err != nil {
+			return fmt.Errorf("conformance: %s dataset: %w", vectors.Name, err)
+		}
+	}
+	return nil
+}
+
+func verifyDataset(ctx context.Context, root string, vectors DatasetVectors) error {
+	cfg, err := findDatasetConfig(vectors.Name)
+	if err != nil {
+		return err
+	}
+
+	dataset := ethwal.Dataset{Path: filepath.Join(root, vectors.Name)}
+
+	objects, err := listObjects(dataset.FullPath())
+	if err != nil {
+		return err
+	}
+	if len(objects) != len(vectors.Objects) {
+		return fmt.Errorf("expected %d objects, got %d", len(vectors.Objects), len(objects))
+	}
+	for i, object := range objects {
+		if object != vectors.Objects[i] {
+			return fmt.Errorf("object %s: expected %+v, got %+v", vectors.Objects[i].Path, vectors.Objects[i], object)
+		}
+	}
+
+	decoder := ethwal.NewCBORDecoder
+	if cfg.encoding == "json" {
+		decoder = ethwal.NewJSONDecoder
+	}
+
+	r, err := ethwal.NewReader[[]uint64](ethwal.Options{
+		Dataset:         dataset,
+		NewDecompressor: cfg.newDecompressor,
+		NewDecoder:      decoder,
+	})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, expected := range vectors.Blocks {
+		block, err := r.Read(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read block %d: %w", expected.Number, err)
+		}
+
+		if block.Number != expected.Number || block.Hash != expected.Hash || block.TS != expected.TS || !slices.Equal(block.Data, expected.Data) {
+			return fmt.Errorf("block %d doesn't match", expected.Number)
+		}
+	}
+
+	_, err = r.Read(ctx)
+	if !errors.Is(err, io.EOF) {
+		return fmt.Errorf("expected end of dataset after %d blocks: %w", len(vectors.Blocks), err)
+	}
+
+	fb, err := ethwal.NewFilterBuilder(ethwal.FilterBuilderOptions[[]uint64]{
+		Dataset: dataset,
+		Indexes: Indexes(),
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, query := range queries {
+		iter := query.build(fb).Eval(ctx)
+		for j, expected := range vectors.Queries[i].Results {
+			if !iter.HasNext() {
+				return fmt.Errorf("query %s: expected %d results, got %d", query.name, len(vectors.Queries[i].Results), j)
+			}
+
+			blockNum, dataIndex := iter.Next()
+			if blockNum != expected.BlockNum || dataIndex != expected.DataIndex {
+				return fmt.Errorf("query %s: result %d doesn't match", query.name, j)
+			}
+		}
+		if iter.HasNext() {
+			return fmt.Errorf("query %s: more than %d results", query.name, len(vectors.Queries[i].Results))
+		}
+	}
+	return nil
+}
+
+func findDatasetConfig(name string) (datasetConfig, error) {
+	for _, cfg := range datasetConfigs {
+		if cfg.name == name {
+			return cfg, nil
+		}
+	}
+	return datasetConfig{}, fmt.Errorf("unknown dataset: %q", name)
+}
+
+// WriteManifest writes the manifest to the vectors root directory.
+func WriteManifest(root string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(root, ManifestFileName), append(data, '\n'), 0644)
+}
+
+// ReadManifest reads the manifest from the vectors root directory.
+func ReadManifest(root string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(root, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
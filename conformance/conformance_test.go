@@ -0,0 +1,74 @@
+package conformance
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const vectorsPath = "testdata"
+
+var update = flag.Bool("update", false, "regenerate the reference vectors")
+
+func TestVectors(t *testing.T) {
+	ctx := context.Background()
+
+	if *update {
+		require.NoError(t, os.RemoveAll(vectorsPath))
+		manifest, err := Generate(ctx, vectorsPath)
+		require.NoError(t, err)
+		require.NoError(t, WriteManifest(vectorsPath, manifest))
+	}
+
+	expected, err := ReadManifest(vectorsPath)
+	require.NoError(t, err)
+
+	t.Run("regenerate", func(t *testing.T) {
+		root := t.TempDir()
+
+		manifest, err := Generate(ctx, root)
+		require.NoError(t, err)
+		require.Equal(t, expected, manifest, "format drift, regenerate the vectors with -update if intended")
+
+		require.NoError(t, Verify(ctx, root, expected))
+	})
+
+	t.Run("committed", func(t *testing.T) {
+		require.NoError(t, Verify(ctx, vectorsPath, expected))
+	})
+
+	t.Run("coverage", func(t *testing.T) {
+		encodings := map[string]bool{}
+		compressions := map[string]bool{}
+		for _, dataset := range expected.Datasets {
+			encodings[dataset.Encoding] = true
+			compressions[dataset.Compression] = true
+
+			require.Len(t, dataset.Files, NumBlocks/BlocksPerFile)
+			require.Len(t, dataset.Blocks, NumBlocks)
+			require.NotEmpty(t, dataset.FileIndex.SHA256)
+
+			var indexObjects int
+			for _, object := range dataset.Objects {
+				if filepath.Dir(object.Path) != "." && object.Path[:len(".indexes")] == ".indexes" {
+					indexObjects++
+				}
+			}
+			require.NotZero(t, indexObjects)
+
+			var matchingQueries int
+			for _, query := range dataset.Queries {
+				if len(query.Results) > 0 {
+					matchingQueries++
+				}
+			}
+			require.GreaterOrEqual(t, matchingQueries, 4)
+		}
+		require.Len(t, encodings, 2)
+		require.Len(t, compressions, 2)
+	})
+}
@@ -0,0 +1,181 @@
+package ethwal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The container is a versioned envelope of index files and the file index.
+//
+// The layout:
+//
+//	magic "EWAL" (4 bytes) | version (1 byte) | flags (1 byte) | body
+//
+// The body is zstd compressed if containerFlagCompressed is set and consists of sections:
+//
+//	type (1 byte) | length (uint64) | data
+//
+// Readers skip unknown section types, so new sections can be added without bumping the version. The files
+// written before the container was introduced (version 0) are raw zstd streams, they are detected by the zstd
+// frame magic.
+const (
+	containerVersion uint8 = 1
+
+	containerHeaderSize        = 6
+	containerSectionHeaderSize = 9
+)
+
+const (
+	// containerFlagCompressed marks zstd compressed body.
+	containerFlagCompressed uint8 = 1 << 0
+	// containerFlagPositional marks index files of the positions of a PositionFormat other than the ordinal
+	// positions, the format name is stored in the metadata section.
+	containerFlagPositional uint8 = 1 << 1
+)
+
+type containerSectionType uint8
+
+const (
+	containerSectionMetadata containerSectionType = 1
+	containerSectionBitmap   containerSectionType = 2
+	containerSectionFiles    containerSectionType = 3
+)
+
+var (
+	containerMagic = [4]byte{'E', 'W', 'A', 'L'}
+	zstdFrameMagic = [4]byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+var (
+	ErrUnsupportedFormatVersion = fmt.Errorf("unsupported format version")
+	ErrUnknownFormat            = fmt.Errorf("unknown format")
+)
+
+type containerSection struct {
+	Type containerSectionType
+	Data []byte
+}
+
+// writeContainer writes the container with the current version.
+func writeContainer(w io.Writer, flags uint8, sections ...containerSection) error {
+	header := append(containerMagic[:], containerVersion, flags)
+	_, err := w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	body := io.WriteCloser(nopWriteCloser{Writer: w})
+	if flags&containerFlagCompressed != 0 {
+		body = NewZSTDCompressor(w)
+	}
+
+	for _, section := range sections {
+		var sectionHeader [containerSectionHeaderSize]byte
+		sectionHeader[0] = byte(section.Type)
+		binary.BigEndian.PutUint64(sectionHeader[1:], uint64(len(section.Data)))
+
+		_, err = body.Write(sectionHeader[:])
+		if err != nil {
+			_ = body.Close()
+			return err
+		}
+
+		_, err = body.Write(section.Data)
+		if err != nil {
+			_ = body.Close()
+			return err
+		}
+	}
+	return body.Close()
+}
+
+// containerReader reads the container sections one by one.
+type containerReader struct {
+	Version uint8
+	Flags   uint8
+
+	body    io.Reader
+	closer  io.Closer
+	section *io.LimitedReader
+}
+
+// openContainer reads the container header. The version 0 containers have no sections, their decompressed
+// content is available through Legacy.
+func openContainer(r io.Reader) (*containerReader, error) {
+	rdr := bufio.NewReader(r)
+
+	magic, err := rdr.Peek(len(containerMagic))
+	if errors.Is(err, io.EOF) && len(magic) == 0 {
+		// empty legacy file
+		return &containerReader{Version: 0, body: rdr}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnknownFormat, err)
+	}
+
+	switch {
+	case bytes.Equal(magic, zstdFrameMagic[:]):
+		decomp := NewZSTDDecompressor(rdr)
+		return &containerReader{Version: 0, Flags: containerFlagCompressed, body: decomp, closer: decomp}, nil
+	case bytes.Equal(magic, containerMagic[:]):
+	default:
+		return nil, ErrUnknownFormat
+	}
+
+	var header [containerHeaderSize]byte
+	_, err = io.ReadFull(rdr, header[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read container header: %w", err)
+	}
+
+	c := &containerReader{Version: header[4], Flags: header[5], body: rdr}
+	if c.Version > containerVersion {
+		return nil, fmt.Errorf("%w: %d, the highest supported version is %d", ErrUnsupportedFormatVersion, c.Version, containerVersion)
+	}
+
+	if c.Flags&containerFlagCompressed != 0 {
+		decomp := NewZSTDDecompressor(rdr)
+		c.body = decomp
+		c.closer = decomp
+	}
+	return c, nil
+}
+
+// Legacy returns the content of version 0 container.
+func (c *containerReader) Legacy() io.Reader {
+	return c.body
+}
+
+// Next returns the next section. It returns io.EOF if there are no more sections.
+func (c *containerReader) Next() (containerSectionType, io.Reader, error) {
+	// skip unread data of the previous section
+	if c.section != nil {
+		_, err := io.Copy(io.Discard, c.section)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	var sectionHeader [containerSectionHeaderSize]byte
+	_, err := io.ReadFull(c.body, sectionHeader[:])
+	if errors.Is(err, io.EOF) {
+		return 0, nil, io.EOF
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read section header: %w", err)
+	}
+
+	c.section = &io.LimitedReader{R: c.body, N: int64(binary.BigEndian.Uint64(sectionHeader[1:]))}
+	return containerSectionType(sectionHeader[0]), c.section, nil
+}
+
+func (c *containerReader) Close() error {
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
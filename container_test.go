@@ -0,0 +1,168 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage/local"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/stretchr/testify/require"
+)
+
+func writeLegacyIndexFile(t *testing.T, root string, indexName IndexName, value IndexedValue, bmap *roaring64.Bitmap) {
+	filePath := path.Join(root, indexPath(string(indexName), string(value)))
+	require.NoError(t, os.MkdirAll(path.Dir(filePath), 0755))
+
+	data, err := bmap.MarshalBinary()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	comp := NewZSTDCompressor(&buf)
+	_, err = comp.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, comp.Close())
+	require.NoError(t, os.WriteFile(filePath, buf.Bytes(), 0644))
+}
+
+func TestIndexFile_Versions(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(indexTestDir)
+	}()
+
+	fs := local.NewLocalFS(indexTestDir)
+
+	bmap := roaring64.New()
+	bmap.Add(uint64(NewIndexCompoundID(10, 0)))
+	bmap.Add(uint64(NewIndexCompoundID(20, 1)))
+
+	t.Run("legacy", func(t *testing.T) {
+		writeLegacyIndexFile(t, indexTestDir, "all", "legacy", bmap)
+
+		indexFile, err := NewIndexFile(fs, "all", "legacy")
+		require.NoError(t, err)
+
+		got, err := indexFile.Read(context.Background())
+		require.NoError(t, err)
+		require.True(t, bmap.Equals(got))
+
+		metadata, err := indexFile.Metadata(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, IndexFileMetadata{Cardinality: 2, MaxBlockNum: 20}, metadata)
+	})
+
+	t.Run("v1", func(t *testing.T) {
+		indexFile, err := NewIndexFile(fs, "all", "v1")
+		require.NoError(t, err)
+		require.NoError(t, indexFile.Write(context.Background(), bmap))
+
+		data, err := os.ReadFile(path.Join(indexTestDir, indexPath("all", "v1")))
+		require.NoError(t, err)
+		require.Equal(t, containerMagic[:], data[:4])
+		require.Equal(t, containerVersion, data[4])
+
+		got, err := indexFile.Read(context.Background())
+		require.NoError(t, err)
+		require.True(t, bmap.Equals(got))
+
+		metadata, err := indexFile.Metadata(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, IndexFileMetadata{Cardinality: 2, MaxBlockNum: 20}, metadata)
+	})
+
+	t.Run("future_version", func(t *testing.T) {
+		filePath := path.Join(indexTestDir, indexPath("all", "future"))
+		require.NoError(t, os.MkdirAll(path.Dir(filePath), 0755))
+
+		header := append(containerMagic[:], containerVersion+1, 0)
+		require.NoError(t, os.WriteFile(filePath, header, 0644))
+
+		indexFile, err := NewIndexFile(fs, "all", "future")
+		require.NoError(t, err)
+
+		_, err = indexFile.Read(context.Background())
+		require.ErrorIs(t, err, ErrUnsupportedFormatVersion)
+	})
+
+	t.Run("unknown_format", func(t *testing.T) {
+		filePath := path.Join(indexTestDir, indexPath("all", "unknown"))
+		require.NoError(t, os.MkdirAll(path.Dir(filePath), 0755))
+		require.NoError(t, os.WriteFile(filePath, []byte("garbage"), 0644))
+
+		indexFile, err := NewIndexFile(fs, "all", "unknown")
+		require.NoError(t, err)
+
+		_, err = indexFile.Read(context.Background())
+		require.ErrorIs(t, err, ErrUnknownFormat)
+	})
+}
+
+func TestContainer_SkipUnknownSection(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeContainer(&buf, containerFlagCompressed,
+		containerSection{Type: 0xff, Data: []byte("from the future")},
+		containerSection{Type: containerSectionFiles, Data: []byte("files")},
+	)
+	require.NoError(t, err)
+
+	container, err := openContainer(&buf)
+	require.NoError(t, err)
+	defer container.Close()
+
+	sectionType, _, err := container.Next()
+	require.NoError(t, err)
+	require.Equal(t, containerSectionType(0xff), sectionType)
+
+	sectionType, section, err := container.Next()
+	require.NoError(t, err)
+	require.Equal(t, containerSectionFiles, sectionType)
+
+	data, err := io.ReadAll(section)
+	require.NoError(t, err)
+	require.Equal(t, []byte("files"), data)
+}
+
+func TestFileIndex_Versions(t *testing.T) {
+	file := setupTestFile(t)
+	defer teardownTestFile(t)
+
+	fs := local.NewLocalFS(testRoot)
+
+	t.Run("legacy", func(t *testing.T) {
+		var buf bytes.Buffer
+		comp := NewZSTDCompressor(&buf)
+		require.NoError(t, NewCBOREncoder(comp).Encode(file))
+		require.NoError(t, comp.Close())
+		require.NoError(t, os.WriteFile(path.Join(testRoot, FileIndexFileName), buf.Bytes(), 0644))
+
+		fi := NewFileIndex(fs)
+		require.NoError(t, fi.Load(context.Background()))
+		require.Len(t, fi.Files(), 1)
+		require.Equal(t, file.FirstBlockNum, fi.Files()[0].FirstBlockNum)
+		require.Equal(t, file.LastBlockNum, fi.Files()[0].LastBlockNum)
+	})
+
+	t.Run("v1", func(t *testing.T) {
+		require.NoError(t, NewFileIndexFromFiles(fs, []*File{file}).Save(context.Background()))
+
+		data, err := os.ReadFile(path.Join(testRoot, FileIndexFileName))
+		require.NoError(t, err)
+		require.Equal(t, containerMagic[:], data[:4])
+
+		fi := NewFileIndex(fs)
+		require.NoError(t, fi.Load(context.Background()))
+		require.Len(t, fi.Files(), 1)
+		require.Equal(t, file.LastBlockNum, fi.Files()[0].LastBlockNum)
+	})
+
+	t.Run("future_version", func(t *testing.T) {
+		header := append(containerMagic[:], containerVersion+1, 0)
+		require.NoError(t, os.WriteFile(path.Join(testRoot, FileIndexFileName), header, 0644))
+
+		fi := NewFileIndex(fs)
+		require.ErrorIs(t, fi.Load(context.Background()), ErrUnsupportedFormatVersion)
+	})
+}
@@ -0,0 +1,270 @@
+package ethwal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+// dedupeSegmentSuffix is the suffix of the dedupe index segments.
+const dedupeSegmentSuffix = ".json"
+
+// dedupeCompactSegments is the number of segments above which Save compacts the dedupe index.
+const dedupeCompactSegments = 64
+
+// DedupeIndex maps the content digests to the objects stored in the destination storage, so that the
+// identical objects copied by different jobs, e.g. the files of the overlapping datasets, are uploaded
+// once and copied within the storage afterwards.
+//
+// The index is stored under its path as segments, every Save writes a new segment with the entries
+// recorded since the previous Save, so that the jobs updating the index concurrently never overwrite
+// each other's entries. The entries of all segments are merged on Load and Save. The index is only a
+// hint: the entry of the object that no longer exists makes the copy fall back to the upload.
+type DedupeIndex struct {
+	fs   storage.FS
+	path string
+
+	mu       sync.Mutex
+	objects  map[string]string
+	recorded map[string]string
+	segments map[string]bool
+}
+
+type dedupeSegment struct {
+	// Objects maps the hex encoded sha-256 digests to the object paths.
+	Objects map[string]string `json:"objects"`
+}
+
+// LoadDedupeIndex loads the dedupe index stored under the path of the file system, the object paths of
+// the index are the paths of the file system. The index that doesn't exist yet is empty.
+func LoadDedupeIndex(ctx context.Context, fs storage.FS, indexPath string) (*DedupeIndex, error) {
+	d := &DedupeIndex{
+		fs:       fs,
+		path:     strings.TrimSuffix(indexPath, "/"),
+		objects:  make(map[string]string),
+		recorded: make(map[string]string),
+		segments: make(map[string]bool),
+	}
+
+	err := d.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Lookup returns the path of the object with the digest.
+func (d *DedupeIndex) Lookup(digest string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	objectPath, ok := d.objects[digest]
+	return objectPath, ok
+}
+
+// Record records the object with the digest, it's stored by the next Save.
+func (d *DedupeIndex) Record(digest string, objectPath string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.objects[digest]; ok {
+		return
+	}
+	d.objects[digest] = objectPath
+	d.recorded[digest] = objectPath
+}
+
+// Len returns the number of the objects in the index.
+func (d *DedupeIndex) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.objects)
+}
+
+// Save stores the recorded objects as a new segment and merges the segments saved by the other jobs
+// since the index was loaded. The index is compacted into a single segment once it has more than 64
+// segments, only the segments that were merged are deleted.
+func (d *DedupeIndex) Save(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.recorded) > 0 {
+		segmentPath, err := d.writeSegment(ctx, d.recorded)
+		if err != nil {
+			return err
+		}
+		d.segments[segmentPath] = true
+		d.recorded = make(map[string]string)
+	}
+
+	err := d.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(d.segments) <= dedupeCompactSegments {
+		return nil
+	}
+	return d.compact(ctx)
+}
+
+// load merges the segments that weren't read yet, the entries recorded first are kept.
+func (d *DedupeIndex) load(ctx context.Context) error {
+	var segmentPaths []string
+	err := d.fs.Walk(ctx, d.path+"/", func(objectPath string) error {
+		if strings.HasSuffix(objectPath, dedupeSegmentSuffix) && !d.segments[objectPath] {
+			segmentPaths = append(segmentPaths, objectPath)
+		}
+		return nil
+	})
+	if err != nil && !storage.IsNotExist(err) {
+		return fmt.Errorf("failed to list dedupe index: %w", err)
+	}
+	sort.Strings(segmentPaths)
+
+	for _, segmentPath := range segmentPaths {
+		segment, err := d.readSegment(ctx, segmentPath)
+		if err != nil {
+			// the segment was deleted by the compaction of the other job, its entries are in the new segment
+			if storage.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("failed to read dedupe index segment %s: %w", segmentPath, err)
+		}
+
+		for digest, objectPath := range segment.Objects {
+			if _, ok := d.objects[digest]; !ok {
+				d.objects[digest] = objectPath
+			}
+		}
+		d.segments[segmentPath] = true
+	}
+	return nil
+}
+
+// compact writes all entries as a single segment and deletes the merged segments.
+func (d *DedupeIndex) compact(ctx context.Context) error {
+	segmentPath, err := d.writeSegment(ctx, d.objects)
+	if err != nil {
+		return err
+	}
+
+	merged := d.segments
+	d.segments = map[string]bool{segmentPath: true}
+	for mergedPath := range merged {
+		if mergedPath == segmentPath {
+			continue
+		}
+
+		err = d.fs.Delete(ctx, mergedPath)
+		if err != nil && !storage.IsNotExist(err) {
+			return fmt.Errorf("failed to delete dedupe index segment %s: %w", mergedPath, err)
+		}
+	}
+	return nil
+}
+
+func (d *DedupeIndex) readSegment(ctx context.Context, segmentPath string) (dedupeSegment, error) {
+	file, err := d.fs.Open(ctx, segmentPath, nil)
+	if err != nil {
+		return dedupeSegment{}, err
+	}
+	defer file.Close()
+
+	var segment dedupeSegment
+	err = json.NewDecoder(file).Decode(&segment)
+	if err != nil {
+		return dedupeSegment{}, err
+	}
+	return segment, nil
+}
+
+// writeSegment writes the segment under the unique name, so that it never replaces the segment of the
+// other job. The names sort by the time they were written.
+func (d *DedupeIndex) writeSegment(ctx context.Context, objects map[string]string) (string, error) {
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	segmentPath := path.Join(d.path, fmt.Sprintf("%020d-%s%s", time.Now().UnixNano(), hex.EncodeToString(id[:]), dedupeSegmentSuffix))
+
+	data, err := json.Marshal(dedupeSegment{Objects: maps.Clone(objects)})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode dedupe index segment: %w", err)
+	}
+
+	file, err := d.fs.Create(ctx, segmentPath, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create dedupe index segment: %w", err)
+	}
+
+	_, err = file.Write(data)
+	if err != nil {
+		_ = file.Close()
+		return "", fmt.Errorf("failed to write dedupe index segment: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to close dedupe index segment: %w", err)
+	}
+	return segmentPath, nil
+}
+
+// ObjectDigest returns the hex encoded sha-256 digest of the object, the object is streamed.
+func ObjectDigest(ctx context.Context, fs storage.FS, objectPath string) (string, error) {
+	file, err := fs.Open(ctx, objectPath, nil)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// CopyDeduplicated stores the object with the digest at dstPath by copying the object of the dedupe index
+// within the storage, see storage.Copier. It returns false if the index has no object with the digest or
+// the object no longer exists, the caller uploads the object then and records it.
+func (d *DedupeIndex) CopyDeduplicated(ctx context.Context, digest string, dstPath string) (bool, error) {
+	srcPath, ok := d.Lookup(digest)
+	if !ok {
+		return false, nil
+	}
+
+	var err error
+	if srcPath == dstPath {
+		_, err = d.fs.Attributes(ctx, srcPath, nil)
+	} else {
+		err = storage.Copy(ctx, d.fs, srcPath, dstPath)
+	}
+	if err != nil {
+		if storage.IsNotExist(err) {
+			d.forget(digest, srcPath)
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to copy %s to %s: %w", srcPath, dstPath, err)
+	}
+	return true, nil
+}
+
+// forget removes the entry of the object that no longer exists, so that the uploaded object replaces it.
+func (d *DedupeIndex) forget(digest string, objectPath string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.objects[digest] == objectPath {
+		delete(d.objects, digest)
+	}
+}
@@ -0,0 +1,183 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+func writeDedupeTestObject(t *testing.T, fs storage.FS, objectPath string, data string) string {
+	file, err := fs.Create(context.Background(), objectPath, nil)
+	require.NoError(t, err)
+	_, err = file.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	digest, err := ObjectDigest(context.Background(), fs, objectPath)
+	require.NoError(t, err)
+	return digest
+}
+
+func dedupeSegments(t *testing.T, fs storage.FS) []string {
+	var segments []string
+	require.NoError(t, fs.Walk(context.Background(), "dedupe/", func(objectPath string) error {
+		segments = append(segments, objectPath)
+		return nil
+	}))
+	return segments
+}
+
+func TestDedupeIndex(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("save_load", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+		digest := writeDedupeTestObject(t, fs, "a/1", "one")
+
+		index, err := LoadDedupeIndex(ctx, fs, "dedupe")
+		require.NoError(t, err)
+		require.Zero(t, index.Len())
+
+		index.Record(digest, "a/1")
+		// the first recorded object is kept
+		index.Record(digest, "b/1")
+		require.NoError(t, index.Save(ctx))
+		require.NoError(t, index.Save(ctx))
+		require.Len(t, dedupeSegments(t, fs), 1)
+
+		loaded, err := LoadDedupeIndex(ctx, fs, "dedupe")
+		require.NoError(t, err)
+		objectPath, ok := loaded.Lookup(digest)
+		require.True(t, ok)
+		require.Equal(t, "a/1", objectPath)
+
+		copied, err := loaded.CopyDeduplicated(ctx, digest, "b/1")
+		require.NoError(t, err)
+		require.True(t, copied)
+		require.Equal(t, digest, writeDedupeTestObject(t, fs, "c/1", "one"))
+
+		copied, err = loaded.CopyDeduplicated(ctx, "unknown", "b/2")
+		require.NoError(t, err)
+		require.False(t, copied)
+	})
+
+	t.Run("concurrent_jobs", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+
+		first, err := LoadDedupeIndex(ctx, fs, "dedupe")
+		require.NoError(t, err)
+		second, err := LoadDedupeIndex(ctx, fs, "dedupe")
+		require.NoError(t, err)
+
+		first.Record("shared", "a/shared")
+		first.Record("first", "a/first")
+		second.Record("shared", "b/shared")
+		second.Record("second", "b/second")
+
+		require.NoError(t, first.Save(ctx))
+		require.NoError(t, second.Save(ctx))
+
+		// the second job merged the entries of the first one on save
+		objectPath, ok := second.Lookup("first")
+		require.True(t, ok)
+		require.Equal(t, "a/first", objectPath)
+
+		// the first job merges the entries of the second one on the next save
+		_, ok = first.Lookup("second")
+		require.False(t, ok)
+		require.NoError(t, first.Save(ctx))
+		_, ok = first.Lookup("second")
+		require.True(t, ok)
+
+		loaded, err := LoadDedupeIndex(ctx, fs, "dedupe")
+		require.NoError(t, err)
+		require.Equal(t, 3, loaded.Len())
+		objectPath, _ = loaded.Lookup("shared")
+		require.Contains(t, []string{"a/shared", "b/shared"}, objectPath)
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+
+		for i := 0; i <= dedupeCompactSegments; i++ {
+			index, err := LoadDedupeIndex(ctx, fs, "dedupe")
+			require.NoError(t, err)
+			index.Record(fmt.Sprintf("digest-%d", i), fmt.Sprintf("a/%d", i))
+			require.NoError(t, index.Save(ctx))
+		}
+
+		segments := dedupeSegments(t, fs)
+		require.Len(t, segments, 1)
+		require.True(t, strings.HasSuffix(segments[0], dedupeSegmentSuffix))
+
+		loaded, err := LoadDedupeIndex(ctx, fs, "dedupe")
+		require.NoError(t, err)
+		require.Equal(t, dedupeCompactSegments+1, loaded.Len())
+	})
+
+	t.Run("stale_object", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+		digest := writeDedupeTestObject(t, fs, "a/1", "one")
+
+		index, err := LoadDedupeIndex(ctx, fs, "dedupe")
+		require.NoError(t, err)
+		index.Record(digest, "a/1")
+		require.NoError(t, fs.Delete(ctx, "a/1"))
+
+		// the object no longer exists, the caller uploads it and records the new path
+		copied, err := index.CopyDeduplicated(ctx, digest, "b/1")
+		require.NoError(t, err)
+		require.False(t, copied)
+
+		index.Record(digest, "b/1")
+		objectPath, _ := index.Lookup(digest)
+		require.Equal(t, "b/1", objectPath)
+	})
+}
+
+func TestSnapshot_Dedupe(t *testing.T) {
+	src := gostorage.NewMemoryFS()
+	dst := &createdPathsFS{FS: gostorage.NewMemoryFS()}
+
+	index, err := LoadDedupeIndex(context.Background(), dst, "dedupe")
+	require.NoError(t, err)
+
+	// the datasets with the same blocks have the same objects
+	var manifests []SnapshotManifest
+	for _, datasetPath := range []string{"first", "second"} {
+		opt := Options{
+			Dataset:        Dataset{Path: datasetPath},
+			FileSystem:     src,
+			FileRollPolicy: NewLastBlockNumberRollPolicy(10),
+		}
+
+		w, err := NewWriter[[]int](opt)
+		require.NoError(t, err)
+		for _, b := range generateMixedIntBlocks()[:30] {
+			require.NoError(t, w.Write(context.Background(), b))
+		}
+		require.NoError(t, w.Close(context.Background()))
+
+		dst.created = nil
+		manifest, err := Snapshot[[]int](context.Background(), opt, dst, SnapshotOptions{Dedupe: index})
+		require.NoError(t, err)
+		manifests = append(manifests, manifest)
+	}
+
+	// the second snapshot stored only its manifest and the dedupe index didn't change
+	require.Equal(t, []string{manifests[1].Path()}, dst.created)
+	require.Len(t, manifests[1].Objects, len(manifests[0].Objects))
+
+	loaded, err := LoadDedupeIndex(context.Background(), dst, "dedupe")
+	require.NoError(t, err)
+	for _, object := range manifests[1].Objects {
+		objectPath, ok := loaded.Lookup(object.Digest)
+		require.True(t, ok)
+		require.Equal(t, snapshotObjectPath(object.Digest), objectPath)
+	}
+}
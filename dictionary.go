@@ -0,0 +1,224 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+const DatasetDictionaryFileName = ".dict"
+
+// DefaultDictionarySize is the maximum size of the dictionary of TrainDictionary, the default dictionary size
+// of the zstd cli.
+const DefaultDictionarySize = 112640
+
+var (
+	ErrDictionaryExists  = fmt.Errorf("dataset dictionary already exists")
+	ErrDictionaryMissing = fmt.Errorf("dataset dictionary is missing")
+	ErrNoSampleBlocks    = fmt.Errorf("no blocks to sample")
+)
+
+// TrainDictionary samples up to sampleBlocks blocks of the files spread over the dataset and returns the zstd
+// dictionary of their encoded content, at most DefaultDictionarySize bytes. The dictionary is the raw content
+// one, the blocks of the dataset repeat the addresses, the topics and the field names of the sampled ones, so
+// that the blocks compressed with it reference them instead of their own earlier content. The dataset is read
+// with the options, see WriteDictionary to store the dictionary in the dataset.
+func TrainDictionary(ctx context.Context, opt Options, sampleBlocks int) ([]byte, error) {
+	if sampleBlocks <= 0 {
+		return nil, fmt.Errorf("sample blocks must be positive, got %d", sampleBlocks)
+	}
+
+	opt = opt.WithDefaults()
+	fs := storage.NewPrefixWrapper(newReplicaFS(opt), opt.Dataset.FullPath())
+
+	fileIndex := NewFileIndex(fs)
+	err := fileIndex.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file index: %w", err)
+	}
+
+	// the files compressed with the dictionary are decompressed with it
+	manifest, err := readDatasetManifest(ctx, fs)
+	if err != nil {
+		return nil, err
+	}
+	dict, err := loadDatasetDictionary(ctx, fs, manifest)
+	if err != nil {
+		return nil, err
+	}
+	useDatasetDictionary(&opt, dict)
+
+	// the blocks are sampled as they're encoded, whatever the schema version of the file
+	opt.SchemaVersion = 0
+
+	files := fileIndex.Files()
+	numFiles := min(len(files), sampleBlocks)
+	if numFiles == 0 {
+		return nil, ErrNoSampleBlocks
+	}
+	blocksPerFile := (sampleBlocks + numFiles - 1) / numFiles
+
+	var (
+		samples []byte
+		sampled int
+	)
+	for i := 0; i < numFiles && sampled < sampleBlocks && len(samples) < DefaultDictionarySize; i++ {
+		file := files[i*len(files)/numFiles]
+
+		var fileSampled int
+		err = decodeFile(ctx, opt, fs, file, func(b Block[RawData]) error {
+			var buf bytes.Buffer
+			err := opt.NewEncoder(&buf).Encode(b)
+			if err != nil {
+				return fmt.Errorf("failed to encode block %d: %w", b.Number, err)
+			}
+
+			samples = append(samples, buf.Bytes()...)
+			sampled++
+			fileSampled++
+			if fileSampled == blocksPerFile || sampled == sampleBlocks || len(samples) >= DefaultDictionarySize {
+				return io.EOF
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err)
+		}
+	}
+	if len(samples) == 0 {
+		return nil, ErrNoSampleBlocks
+	}
+	return samples[:min(len(samples), DefaultDictionarySize)], nil
+}
+
+// WriteDictionary stores the dictionary in the dataset and marks it in the dataset manifest. The writers and
+// the readers opened after compress and decompress the files with it, unless they're set up with the compressor
+// or the decompressor other than NewZSTDCompressor or NewZSTDDecompressor, the files written before are
+// decompressed with it as well. The dictionary can't be replaced, the files compressed with it can't be read
+// without it, ErrDictionaryExists is returned if the dataset has the other one. The manifest of the dataset
+// without it is recorded with the options, the writers open at the same time keep writing without the
+// dictionary.
+func WriteDictionary(ctx context.Context, opt Options, dict []byte) error {
+	if len(dict) == 0 {
+		return fmt.Errorf("dictionary is empty")
+	}
+
+	opt = opt.WithDefaults()
+	fs := storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath())
+
+	current, err := readDatasetDictionary(ctx, fs)
+	if err != nil {
+		return err
+	}
+	if current != nil && !bytes.Equal(current, dict) {
+		return ErrDictionaryExists
+	}
+
+	// the dictionary is written before the manifest marks it, the one that failed to be marked is retried
+	if current == nil {
+		err = writeDatasetDictionary(ctx, fs, dict)
+		if err != nil {
+			return err
+		}
+	}
+
+	manifest, err := readDatasetManifest(ctx, fs)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		fileIndex := NewFileIndex(fs)
+		err = fileIndex.Load(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to load file index: %w", err)
+		}
+
+		var firstBlockNum uint64
+		if files := fileIndex.Files(); len(files) > 0 {
+			firstBlockNum = files[0].FirstBlockNum
+		}
+		m := newDatasetManifest(opt, firstBlockNum)
+		manifest = &m
+	}
+	if manifest.Dictionary {
+		return nil
+	}
+
+	manifest.Dictionary = true
+	return writeDatasetManifest(ctx, fs, *manifest)
+}
+
+func writeDatasetDictionary(ctx context.Context, fs storage.FS, dict []byte) error {
+	file, err := fs.Create(ctx, DatasetDictionaryFileName, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create dataset dictionary: %w", err)
+	}
+
+	_, err = file.Write(dict)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write dataset dictionary: %w", err)
+	}
+	return file.Close()
+}
+
+// ReadDictionary returns the dictionary of the dataset, or nil if the dataset doesn't have it.
+func ReadDictionary(ctx context.Context, opt Options) ([]byte, error) {
+	opt = opt.WithDefaults()
+	return readDatasetDictionary(ctx, storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()))
+}
+
+// loadDatasetDictionary returns the dictionary of the dataset of the manifest, or nil if the dataset doesn't have
+// it. The datasets without the manifest don't have it.
+func loadDatasetDictionary(ctx context.Context, fs storage.FS, manifest *DatasetManifest) ([]byte, error) {
+	if manifest == nil || !manifest.Dictionary {
+		return nil, nil
+	}
+
+	dict, err := readDatasetDictionary(ctx, fs)
+	if err != nil {
+		return nil, err
+	}
+	if dict == nil {
+		return nil, ErrDictionaryMissing
+	}
+	return dict, nil
+}
+
+func readDatasetDictionary(ctx context.Context, fs storage.FS) ([]byte, error) {
+	file, err := fs.Open(ctx, DatasetDictionaryFileName, nil)
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open dataset dictionary: %w", err)
+	}
+	defer file.Close()
+
+	dict, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dataset dictionary: %w", err)
+	}
+	if len(dict) == 0 {
+		return nil, nil
+	}
+	return dict, nil
+}
+
+// useDatasetDictionary replaces the zstd compressor and decompressor of the options with the ones of the
+// dataset dictionary, the custom ones are kept.
+func useDatasetDictionary(opt *Options, dict []byte) {
+	if dict == nil {
+		return
+	}
+	if opt.NewCompressor != nil && sameFunc(opt.NewCompressor, NewZSTDCompressor) {
+		opt.NewCompressor = NewZSTDCompressorWithDict(dict)
+	}
+	if opt.NewDecompressor != nil && sameFunc(opt.NewDecompressor, NewZSTDDecompressor) {
+		opt.NewDecompressor = NewZSTDDecompressorWithDict(dict)
+	}
+}
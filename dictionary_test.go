@@ -0,0 +1,164 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+type testDictLog struct {
+	Address string   `cbor:"0,keyasint"`
+	Topics  []string `cbor:"1,keyasint"`
+	Data    string   `cbor:"2,keyasint"`
+}
+
+// testDictBlock returns the block of the logs of the few contracts and events, as the blocks of the chain.
+func testDictBlock(blockNum uint64) Block[[]testDictLog] {
+	logs := make([]testDictLog, 3)
+	for i := range logs {
+		n := blockNum*7 + uint64(i)*13
+		logs[i] = testDictLog{
+			Address: fmt.Sprintf("0x%040x", 0xa0b86991c6218b36+n%5),
+			Topics: []string{
+				fmt.Sprintf("0x%064x", 0xddf252ad1be2c89b+n%3),
+				fmt.Sprintf("0x%064x", 0x9a1c5f2e00b0d4e1+n%11),
+			},
+			Data: fmt.Sprintf("0x%064x", n*1000003),
+		}
+	}
+	return Block[[]testDictLog]{Number: blockNum, Data: logs}
+}
+
+func TestDictionary(t *testing.T) {
+	ctx := context.Background()
+	opt := Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      memory.NewMemoryFS(),
+		NewCompressor:   NewZSTDCompressor,
+		NewDecompressor: NewZSTDDecompressor,
+	}
+
+	writeBlocks := func(t *testing.T, from, to uint64) {
+		w, err := NewWriter[[]testDictLog](opt)
+		require.NoError(t, err)
+		for blockNum := from; blockNum <= to; blockNum++ {
+			require.NoError(t, w.Write(ctx, testDictBlock(blockNum)))
+			if blockNum%10 == 0 {
+				require.NoError(t, w.RollFile(ctx))
+			}
+		}
+		require.NoError(t, w.Close(ctx))
+	}
+	writeBlocks(t, 1, 40)
+
+	dict, err := ReadDictionary(ctx, opt)
+	require.NoError(t, err)
+	require.Nil(t, dict)
+
+	dict, err = TrainDictionary(ctx, opt, 20)
+	require.NoError(t, err)
+	require.NotEmpty(t, dict)
+	require.LessOrEqual(t, len(dict), DefaultDictionarySize)
+
+	require.NoError(t, WriteDictionary(ctx, opt, dict))
+	require.NoError(t, WriteDictionary(ctx, opt, dict))
+	require.ErrorIs(t, WriteDictionary(ctx, opt, []byte("other")), ErrDictionaryExists)
+
+	stored, err := ReadDictionary(ctx, opt)
+	require.NoError(t, err)
+	require.Equal(t, dict, stored)
+
+	// the files written after are compressed with the dictionary
+	writeBlocks(t, 41, 50)
+
+	fs := storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath())
+	fileIndex := NewFileIndex(fs)
+	require.NoError(t, fileIndex.Load(ctx))
+	file, _, err := fileIndex.FindFile(50)
+	require.NoError(t, err)
+
+	rdr, err := file.Open(ctx, fs)
+	require.NoError(t, err)
+	defer rdr.Close()
+	compressed, err := io.ReadAll(rdr)
+	require.NoError(t, err)
+
+	_, err = io.ReadAll(NewZSTDDecompressor(bytes.NewReader(compressed)))
+	require.Error(t, err)
+	_, err = io.ReadAll(NewZSTDDecompressorWithDict(dict)(bytes.NewReader(compressed)))
+	require.NoError(t, err)
+
+	// the reader decompresses the files written before and after the dictionary with it
+	r, err := NewReader[[]testDictLog](opt)
+	require.NoError(t, err)
+	defer r.Close()
+	for blockNum := uint64(1); blockNum <= 50; blockNum++ {
+		b, err := r.Read(ctx)
+		require.NoError(t, err)
+		require.Equal(t, testDictBlock(blockNum).Data, b.Data)
+	}
+}
+
+func TestTrainDictionary_Empty(t *testing.T) {
+	opt := Options{Dataset: Dataset{Path: "ethwal"}, FileSystem: memory.NewMemoryFS()}
+
+	_, err := TrainDictionary(context.Background(), opt, 10)
+	require.ErrorIs(t, err, ErrNoSampleBlocks)
+
+	_, err = TrainDictionary(context.Background(), opt, 0)
+	require.Error(t, err)
+}
+
+func BenchmarkZSTDDictionary(b *testing.B) {
+	ctx := context.Background()
+	opt := Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      memory.NewMemoryFS(),
+		NewCompressor:   NewZSTDCompressor,
+		NewDecompressor: NewZSTDDecompressor,
+	}
+
+	w, err := NewWriter[[]testDictLog](opt)
+	require.NoError(b, err)
+	for blockNum := uint64(1); blockNum <= 1000; blockNum++ {
+		require.NoError(b, w.Write(ctx, testDictBlock(blockNum)))
+		if blockNum%100 == 0 {
+			require.NoError(b, w.RollFile(ctx))
+		}
+	}
+	require.NoError(b, w.Close(ctx))
+
+	dict, err := TrainDictionary(ctx, opt, 500)
+	require.NoError(b, err)
+
+	// the flushed block is compressed on its own, as the small file
+	var encoded bytes.Buffer
+	require.NoError(b, NewCBOREncoder(&encoded).Encode(testDictBlock(5000)))
+
+	for _, bm := range []struct {
+		name          string
+		newCompressor NewCompressorFunc
+	}{
+		{name: "none", newCompressor: NewZSTDCompressor},
+		{name: "dict", newCompressor: NewZSTDCompressorWithDict(dict)},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			var compressed bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				compressed.Reset()
+				comp := bm.newCompressor(&compressed)
+				_, err := comp.Write(encoded.Bytes())
+				require.NoError(b, err)
+				require.NoError(b, comp.Close())
+			}
+			b.ReportMetric(float64(encoded.Len()), "raw-B/block")
+			b.ReportMetric(float64(compressed.Len()), "compressed-B/block")
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package ethwal
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// BlockDigestFileSuffix is the suffix of the block digests object stored next to the ethwal file.
+const BlockDigestFileSuffix = ".digests"
+
+const blockDigestsVersion = 1
+
+var (
+	ErrBlockDigestMismatch     = fmt.Errorf("block digest mismatch")
+	ErrBlockDigestMissing      = fmt.Errorf("block digest is not recorded")
+	ErrFileDigestRootMismatch  = fmt.Errorf("file digest root mismatch")
+	ErrBlockDigestsInvalid     = fmt.Errorf("block digests don't match the file digest root")
+	ErrBlockDigestsUnsupported = fmt.Errorf("block digests version is not supported")
+)
+
+// BlockDigestFunc returns the digest of the block recorded by the writer, see Options.BlockDigest.
+type BlockDigestFunc[T any] func(b Block[T]) [32]byte
+
+var canonicalDigestEncMode, _ = cbor.CanonicalEncOptions().EncMode()
+
+// CanonicalBlockDigest is the sha-256 of the canonical CBOR encoding of the block without the blob
+// reference, so that the digest doesn't depend on the encoding of the dataset and the offloading of the
+// data. The blocks that can't be encoded have zero digest.
+func CanonicalBlockDigest[T any](b Block[T]) [32]byte {
+	b.Blob = nil
+
+	data, err := canonicalDigestEncMode.Marshal(b)
+	if err != nil {
+		return [32]byte{}
+	}
+	return sha256.Sum256(data)
+}
+
+// blockDigestFunc returns the block digest function of the options, see Options.BlockDigest.
+func blockDigestFunc[T any](opt Options) (BlockDigestFunc[T], error) {
+	switch fn := opt.BlockDigest.(type) {
+	case nil:
+		return nil, nil
+	case BlockDigestFunc[T]:
+		return fn, nil
+	case func(b Block[T]) [32]byte:
+		return fn, nil
+	default:
+		return nil, fmt.Errorf("block digest function %T doesn't match the block type %T", opt.BlockDigest, Block[T]{})
+	}
+}
+
+// DigestsPath returns the path to the block digests of the file.
+func (f *File) DigestsPath() string {
+	return f.Path() + BlockDigestFileSuffix
+}
+
+// blockDigests are the digests of the blocks of the file in the file order, the leaves of the Merkle tree
+// which root is stored in File.DigestRoot.
+type blockDigests struct {
+	Version   int        `cbor:"0,keyasint"`
+	BlockNums []uint64   `cbor:"1,keyasint"`
+	Digests   [][32]byte `cbor:"2,keyasint"`
+}
+
+func (d *blockDigests) add(blockNum uint64, digest [32]byte) {
+	d.BlockNums = append(d.BlockNums, blockNum)
+	d.Digests = append(d.Digests, digest)
+}
+
+func (d *blockDigests) root() common.Hash {
+	return common.Hash(merkleRoot(d.Digests))
+}
+
+func writeBlockDigests(ctx context.Context, fs storage.FS, file *File, digests *blockDigests) error {
+	w, err := fs.Create(ctx, file.DigestsPath(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create block digests: %w", err)
+	}
+
+	err = NewCBOREncoder(w).Encode(blockDigests{Version: blockDigestsVersion, BlockNums: digests.BlockNums, Digests: digests.Digests})
+	if err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed to write block digests: %w", err)
+	}
+	return w.Close()
+}
+
+// readBlockDigests reads the block digests of the file and checks them against the file digest root.
+func readBlockDigests(ctx context.Context, fs storage.FS, file *File) (*blockDigests, error) {
+	if file.DigestRoot == nil {
+		return nil, ErrBlockDigestMissing
+	}
+
+	r, err := fs.Open(ctx, file.DigestsPath(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open block digests: %w", err)
+	}
+	defer r.Close()
+
+	var digests blockDigests
+	err = NewCBORDecoder(r).Decode(&digests)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode block digests: %w", err)
+	}
+	if digests.Version > blockDigestsVersion {
+		return nil, fmt.Errorf("%w: %d", ErrBlockDigestsUnsupported, digests.Version)
+	}
+	if len(digests.BlockNums) != len(digests.Digests) || digests.root() != *file.DigestRoot {
+		return nil, ErrBlockDigestsInvalid
+	}
+	return &digests, nil
+}
+
+// BlockAudit is the result of the successful AuditBlock.
+type BlockAudit struct {
+	BlockNum uint64
+	File     *File
+	// Digest is the digest of the stored block, equal to the digest recorded by the writer.
+	Digest [32]byte
+	// Root is the digest root of the file.
+	Root common.Hash
+	// Proof connects the digest to the root.
+	Proof MerkleProof
+}
+
+// AuditBlock recomputes the digest of the stored block with Options.BlockDigest and verifies it against
+// the digest recorded by the writer and the Merkle path to the file digest root. It returns
+// ErrBlockDigestMismatch if the block changed since it was written and ErrBlockDigestMissing if the file
+// was written without the digests. The patches are not applied.
+func AuditBlock[T any](ctx context.Context, opt Options, blockNum uint64) (BlockAudit, error) {
+	opt = opt.WithDefaults()
+	blockDigest, err := blockDigestFunc[T](opt)
+	if err != nil {
+		return BlockAudit{}, err
+	}
+	if blockDigest == nil {
+		return BlockAudit{}, fmt.Errorf("block digest function is not set")
+	}
+
+	fs := storage.NewPrefixWrapper(newReplicaFS(opt), opt.Dataset.FullPath())
+	fileIndex := NewFileIndex(fs)
+	err = fileIndex.Load(ctx)
+	if err != nil {
+		return BlockAudit{}, fmt.Errorf("failed to load file index: %w", err)
+	}
+
+	file, _, err := fileIndex.FindFile(blockNum)
+	if err != nil {
+		return BlockAudit{}, err
+	}
+
+	digests, err := readBlockDigests(ctx, fs, file)
+	if err != nil {
+		return BlockAudit{}, fmt.Errorf("file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err)
+	}
+
+	index := -1
+	for i, n := range digests.BlockNums {
+		if n == blockNum {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return BlockAudit{}, fmt.Errorf("%w: block %d", ErrBlockDigestMissing, blockNum)
+	}
+
+	var (
+		digest [32]byte
+		found  bool
+	)
+	blobs := cmp.Or(opt.BlobStore, NewFSBlobStore(fs))
+	err = decodeFile(ctx, opt, fs, file, func(b Block[T]) error {
+		if b.Number != blockNum {
+			return nil
+		}
+
+		b, err := resolveBlob(ctx, opt, blobs, b)
+		if err != nil {
+			return err
+		}
+		digest, found = blockDigest(b), true
+		return io.EOF
+	})
+	if err != nil && !errors.Is(err, io.EOF) {
+		return BlockAudit{}, fmt.Errorf("file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err)
+	}
+	if !found {
+		return BlockAudit{}, fmt.Errorf("%w: block %d is not stored", ErrBlockDigestMismatch, blockNum)
+	}
+
+	proof := merkleProof(digests.Digests, index)
+	if digest != digests.Digests[index] || !proof.Verify(*file.DigestRoot, digest) {
+		return BlockAudit{}, fmt.Errorf("%w: block %d", ErrBlockDigestMismatch, blockNum)
+	}
+
+	return BlockAudit{
+		BlockNum: blockNum,
+		File:     file,
+		Digest:   digest,
+		Root:     *file.DigestRoot,
+		Proof:    proof,
+	}, nil
+}
+
+// AuditFile recomputes the digests of the stored blocks of the file with Options.BlockDigest and checks
+// that their Merkle root is the file digest root. It returns ErrFileDigestRootMismatch if any block
+// changed since it was written.
+func AuditFile[T any](ctx context.Context, opt Options, file *File) error {
+	opt = opt.WithDefaults()
+	blockDigest, err := blockDigestFunc[T](opt)
+	if err != nil {
+		return err
+	}
+	if blockDigest == nil {
+		return fmt.Errorf("block digest function is not set")
+	}
+	if file.DigestRoot == nil {
+		return fmt.Errorf("file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, ErrBlockDigestMissing)
+	}
+
+	fs := storage.NewPrefixWrapper(newReplicaFS(opt), opt.Dataset.FullPath())
+	blobs := cmp.Or(opt.BlobStore, NewFSBlobStore(fs))
+
+	var digests blockDigests
+	err = decodeFile(ctx, opt, fs, file, func(b Block[T]) error {
+		b, err := resolveBlob(ctx, opt, blobs, b)
+		if err != nil {
+			return err
+		}
+		digests.add(b.Number, blockDigest(b))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err)
+	}
+
+	if digests.root() != *file.DigestRoot {
+		return fmt.Errorf("file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, ErrFileDigestRootMismatch)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+func writeDigestDataset(t *testing.T) (Options, []*File) {
+	opt := Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      gostorage.NewMemoryFS(),
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+		BlockDigest:     BlockDigestFunc[[]int](CanonicalBlockDigest[[]int]),
+	}
+
+	w, err := NewWriter[[]int](opt)
+	require.NoError(t, err)
+	for _, b := range generateMixedIntBlocks() {
+		require.NoError(t, w.Write(context.Background(), b))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	fileIndex := NewFileIndex(storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()))
+	require.NoError(t, fileIndex.Load(context.Background()))
+	return opt, fileIndex.Files()
+}
+
+// mutateBlock rewrites the file with the block data changed, bypassing the writer.
+func mutateBlock(t *testing.T, opt Options, file *File, blockNum uint64) {
+	opt = opt.WithDefaults()
+	fs := storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath())
+
+	var buf bytes.Buffer
+	encoder := opt.NewEncoder(&buf)
+	err := decodeFile(context.Background(), opt, fs, file, func(b Block[[]int]) error {
+		if b.Number == blockNum {
+			b.Data = append(b.Data, 1)
+		}
+		return encoder.Encode(b)
+	})
+	require.NoError(t, err)
+
+	w, err := file.Create(context.Background(), fs)
+	require.NoError(t, err)
+	_, err = w.Write(buf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+}
+
+func TestAuditBlock(t *testing.T) {
+	opt, files := writeDigestDataset(t)
+	require.Len(t, files, 7)
+
+	for _, file := range files {
+		require.NotNil(t, file.DigestRoot)
+		require.NoError(t, AuditFile[[]int](context.Background(), opt, file))
+	}
+
+	for _, b := range generateMixedIntBlocks() {
+		audit, err := AuditBlock[[]int](context.Background(), opt, b.Number)
+		require.NoError(t, err)
+		require.Equal(t, b.Number, audit.BlockNum)
+		require.Equal(t, CanonicalBlockDigest(b), audit.Digest)
+		require.True(t, audit.Proof.Verify(audit.Root, audit.Digest))
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		opt := opt
+		opt.FileSystem = gostorage.NewMemoryFS()
+		opt.BlockDigest = nil
+
+		w, err := NewWriter[[]int](opt)
+		require.NoError(t, err)
+		require.NoError(t, w.Write(context.Background(), Block[[]int]{Number: 1}))
+		require.NoError(t, w.Close(context.Background()))
+
+		opt.BlockDigest = BlockDigestFunc[[]int](CanonicalBlockDigest[[]int])
+		_, err = AuditBlock[[]int](context.Background(), opt, 1)
+		require.ErrorIs(t, err, ErrBlockDigestMissing)
+	})
+}
+
+func TestAuditBlock_Mutation(t *testing.T) {
+	// the blocks at the start, the middle and the end of the file 21-30
+	for _, mutated := range []uint64{21, 25, 30} {
+		opt, files := writeDigestDataset(t)
+		file := files[2]
+		require.Equal(t, uint64(21), file.FirstBlockNum)
+
+		mutateBlock(t, opt, file, mutated)
+
+		for blockNum := file.FirstBlockNum; blockNum <= file.LastBlockNum; blockNum++ {
+			_, err := AuditBlock[[]int](context.Background(), opt, blockNum)
+			if blockNum == mutated {
+				require.ErrorIs(t, err, ErrBlockDigestMismatch)
+			} else {
+				require.NoError(t, err)
+			}
+		}
+
+		require.ErrorIs(t, AuditFile[[]int](context.Background(), opt, file), ErrFileDigestRootMismatch)
+		require.NoError(t, AuditFile[[]int](context.Background(), opt, files[1]))
+	}
+}
+
+func TestReplay_PreserveDigests(t *testing.T) {
+	src, srcFiles := writeDigestDataset(t)
+
+	// transcode to json with the different file size
+	dst := Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      gostorage.NewMemoryFS(),
+		NewEncoder:      NewJSONEncoder,
+		NewDecoder:      NewJSONDecoder,
+		FileRollPolicy:  NewFileSizeRollPolicy(64),
+		FileRollOnClose: true,
+	}
+
+	err := Replay(context.Background(), src, dst, 0, 0, func(b Block[[]int]) (Block[[]int], bool, error) {
+		return b, true, nil
+	}, ReplayOptions{PreserveDigests: true})
+	require.NoError(t, err)
+
+	dstIndex := NewFileIndex(storage.NewPrefixWrapper(dst.FileSystem, dst.Dataset.FullPath()))
+	require.NoError(t, dstIndex.Load(context.Background()))
+	dstFiles := dstIndex.Files()
+	require.Len(t, dstFiles, len(srcFiles))
+	for i, file := range dstFiles {
+		require.Equal(t, srcFiles[i].FirstBlockNum, file.FirstBlockNum)
+		require.Equal(t, srcFiles[i].LastBlockNum, file.LastBlockNum)
+		require.Equal(t, srcFiles[i].DigestRoot, file.DigestRoot)
+	}
+
+	dst.BlockDigest = BlockDigestFunc[[]int](CanonicalBlockDigest[[]int])
+	for _, b := range generateMixedIntBlocks() {
+		_, err := AuditBlock[[]int](context.Background(), dst, b.Number)
+		require.NoError(t, err)
+	}
+}
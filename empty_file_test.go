@@ -0,0 +1,217 @@
+package ethwal
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+// discardCompressor emits nothing, the buffer of the file stays empty.
+type discardCompressor struct{}
+
+func (discardCompressor) Write(p []byte) (int, error) { return len(p), nil }
+func (discardCompressor) Close() error                { return nil }
+
+func emptyFileTestBlock(blockNum uint64) Block[int] {
+	return Block[int]{Hash: common.BytesToHash([]byte{byte(blockNum)}), Number: blockNum, TS: blockNum, Data: int(blockNum)}
+}
+
+// requireNoEmptyFiles checks that the files of the file index exist and aren't empty.
+func requireNoEmptyFiles(t *testing.T, fs storage.FS, numFiles int) {
+	fileIndex := NewFileIndex(fs)
+	require.NoError(t, fileIndex.Load(context.Background()))
+	require.Len(t, fileIndex.Files(), numFiles)
+
+	var dataObjects int
+	require.NoError(t, fs.Walk(context.Background(), "", func(objectPath string) error {
+		if ClassifyObjectPath(objectPath) != AccountingClassData {
+			return nil
+		}
+		dataObjects++
+
+		attrs, err := fs.Attributes(context.Background(), objectPath, nil)
+		require.NoError(t, err)
+		require.NotZero(t, attrs.Size, objectPath)
+		return nil
+	}))
+	require.Equal(t, numFiles, dataObjects)
+}
+
+func TestWriter_EmptyFile(t *testing.T) {
+	newOptions := func(fs storage.FS) Options {
+		return Options{
+			Dataset:        Dataset{Path: "ethwal"},
+			FileSystem:     fs,
+			FileRollPolicy: NewLastBlockNumberRollPolicy(10),
+		}
+	}
+
+	t.Run("roll", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+		w, err := NewWriter[int](newOptions(fs))
+		require.NoError(t, err)
+
+		// the forced rolls of the empty buffer are skipped
+		require.NoError(t, w.RollFile(context.Background()))
+		for blockNum := uint64(1); blockNum <= 10; blockNum++ {
+			require.NoError(t, w.Write(context.Background(), emptyFileTestBlock(blockNum)))
+		}
+		require.NoError(t, w.RollFile(context.Background()))
+		require.NoError(t, w.RollFile(context.Background()))
+		require.NoError(t, w.Write(context.Background(), emptyFileTestBlock(11)))
+		require.NoError(t, w.RollFile(context.Background()))
+		require.NoError(t, w.RollFile(context.Background()))
+		require.NoError(t, w.Close(context.Background()))
+
+		requireNoEmptyFiles(t, storage.NewPrefixWrapper(fs, "ethwal/"), 2)
+	})
+
+	t.Run("roll_on_close", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+		opt := newOptions(fs)
+		opt.FileRollOnClose = true
+
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+		for blockNum := uint64(1); blockNum <= 10; blockNum++ {
+			require.NoError(t, w.Write(context.Background(), emptyFileTestBlock(blockNum)))
+		}
+		require.NoError(t, w.RollFile(context.Background()))
+		require.NoError(t, w.Close(context.Background()))
+
+		requireNoEmptyFiles(t, storage.NewPrefixWrapper(fs, "ethwal/"), 1)
+	})
+
+	t.Run("empty_buffer", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+		opt := newOptions(fs)
+		opt.NewCompressor = func(w io.Writer) Compressor { return discardCompressor{} }
+		opt.NewDecompressor = NewZSTDDecompressor
+
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+		for blockNum := uint64(1); blockNum <= 5; blockNum++ {
+			require.NoError(t, w.Write(context.Background(), emptyFileTestBlock(blockNum)))
+		}
+		require.ErrorIs(t, w.RollFile(context.Background()), ErrEmptyFile)
+
+		requireNoEmptyFiles(t, storage.NewPrefixWrapper(fs, "ethwal/"), 0)
+	})
+}
+
+func TestReader_EmptyFile(t *testing.T) {
+	testCases := []struct {
+		name    string
+		options Options
+	}{
+		{
+			name:    "cbor",
+			options: Options{},
+		},
+		{
+			name:    "cbor_zstd",
+			options: Options{NewCompressor: NewZSTDCompressor, NewDecompressor: NewZSTDDecompressor},
+		},
+		{
+			name:    "json",
+			options: Options{NewEncoder: NewJSONEncoder, NewDecoder: NewJSONDecoder},
+		},
+		{
+			name: "json_zstd",
+			options: Options{
+				NewEncoder:      NewJSONEncoder,
+				NewDecoder:      NewJSONDecoder,
+				NewCompressor:   NewZSTDCompressor,
+				NewDecompressor: NewZSTDDecompressor,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := gostorage.NewMemoryFS()
+			opt := tc.options
+			opt.Dataset = Dataset{Path: "ethwal"}
+			opt.FileSystem = fs
+			opt.FileRollPolicy = NewLastBlockNumberRollPolicy(10)
+			opt.FileRollOnClose = true
+
+			w, err := NewWriter[int](opt)
+			require.NoError(t, err)
+			for blockNum := uint64(1); blockNum <= 30; blockNum++ {
+				require.NoError(t, w.Write(context.Background(), emptyFileTestBlock(blockNum)))
+			}
+			require.NoError(t, w.Close(context.Background()))
+			require.NoError(t, CheckInvariants[int](context.Background(), opt))
+
+			// truncate the middle file
+			emptyFile := &File{FirstBlockNum: 11, LastBlockNum: 20}
+			fw, err := emptyFile.Create(context.Background(), storage.NewPrefixWrapper(fs, "ethwal/"))
+			require.NoError(t, err)
+			require.NoError(t, fw.Close())
+
+			err = CheckInvariants[int](context.Background(), opt)
+			require.ErrorIs(t, err, ErrInvariantViolated)
+			require.ErrorIs(t, err, ErrEmptyFile)
+
+			readAll := func(opt Options) ([]uint64, ReaderStats, error) {
+				r, err := NewReader[int](opt)
+				require.NoError(t, err)
+				defer r.Close()
+
+				var blockNums []uint64
+				for {
+					b, err := r.Read(context.Background())
+					if err == io.EOF {
+						return blockNums, r.Stats(), nil
+					}
+					if err != nil {
+						return blockNums, r.Stats(), err
+					}
+					blockNums = append(blockNums, b.Number)
+				}
+			}
+
+			corruptFiles := []CorruptFile{{FirstBlockNum: 11, LastBlockNum: 20, Err: ErrEmptyFile}}
+
+			t.Run("strict", func(t *testing.T) {
+				blockNums, stats, err := readAll(opt)
+				require.ErrorIs(t, err, ErrEmptyFile)
+				require.Len(t, blockNums, 10)
+				require.Equal(t, corruptFiles, stats.CorruptFiles)
+			})
+
+			t.Run("skip", func(t *testing.T) {
+				skipOpt := opt
+				skipOpt.SkipCorruptFiles = true
+
+				blockNums, stats, err := readAll(skipOpt)
+				require.NoError(t, err)
+				require.Len(t, blockNums, 20)
+				require.Equal(t, uint64(10), blockNums[9])
+				require.Equal(t, uint64(21), blockNums[10])
+				require.Equal(t, corruptFiles, stats.CorruptFiles)
+			})
+
+			t.Run("skip_seek", func(t *testing.T) {
+				skipOpt := opt
+				skipOpt.SkipCorruptFiles = true
+
+				r, err := NewReader[int](skipOpt)
+				require.NoError(t, err)
+				defer r.Close()
+
+				require.NoError(t, r.Seek(context.Background(), 15))
+				b, err := r.Read(context.Background())
+				require.NoError(t, err)
+				require.Equal(t, uint64(21), b.Number)
+				require.Equal(t, corruptFiles, r.Stats().CorruptFiles)
+			})
+		})
+	}
+}
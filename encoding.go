@@ -1,9 +1,13 @@
 package ethwal
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"sync"
 
+	"github.com/0xsequence/ethkit/go-ethereum/common"
 	"github.com/fxamacker/cbor/v2"
 )
 
@@ -26,6 +30,20 @@ func NewJSONDecoder(r io.Reader) Decoder {
 	return json.NewDecoder(r)
 }
 
+// NewJSONNumberDecoder returns the JSON decoder that decodes the numbers of the untyped data as json.Number,
+// so that the integers larger than 2^53 aren't rounded to float64, see ValueCodec.ToCBOR.
+func NewJSONNumberDecoder(r io.Reader) Decoder {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return jsonNumberDecoder{Decoder: dec}
+}
+
+// jsonNumberDecoder marks the decoder of NewJSONNumberDecoder, the decoder renaming the block fields keeps
+// decoding the numbers as json.Number.
+type jsonNumberDecoder struct {
+	*json.Decoder
+}
+
 func NewCBOREncoder(w io.Writer) Encoder {
 	return cbor.NewEncoder(w)
 }
@@ -37,3 +55,145 @@ func NewCBORDecoder(r io.Reader) Decoder {
 	mode, _ := opt.DecMode()
 	return mode.NewDecoder(r)
 }
+
+// NewCBOREncoderWithOptions returns the CBOR encoder constructor with the encoding options. The encoders
+// of invalid options return the error on Encode.
+func NewCBOREncoderWithOptions(opts cbor.EncOptions) NewEncoderFunc {
+	mode, err := opts.EncMode()
+	return func(w io.Writer) Encoder {
+		if err != nil {
+			return errCodec{err: fmt.Errorf("invalid cbor encoding options: %w", err)}
+		}
+		return mode.NewEncoder(w)
+	}
+}
+
+// NewCBORDecoderWithOptions returns the CBOR decoder constructor with the decoding options. The decoders
+// of invalid options return the error on Decode.
+func NewCBORDecoderWithOptions(opts cbor.DecOptions) NewDecoderFunc {
+	mode, err := opts.DecMode()
+	return func(r io.Reader) Decoder {
+		if err != nil {
+			return errCodec{err: fmt.Errorf("invalid cbor decoding options: %w", err)}
+		}
+		return mode.NewDecoder(r)
+	}
+}
+
+// errCodec is the encoder and decoder that always fails.
+type errCodec struct {
+	err error
+}
+
+func (c errCodec) Encode(any) error {
+	return c.err
+}
+
+func (c errCodec) Decode(any) error {
+	return c.err
+}
+
+// Names of the built-in CBOR presets.
+const (
+	// CBORDefault is the encoding of NewCBOREncoder and NewCBORDecoder.
+	CBORDefault = "default"
+	// CBORCanonical is the deterministic encoding of RFC 7049 canonical CBOR, the map keys are sorted, so
+	// that the semantically equal blocks are encoded to identical bytes.
+	CBORCanonical = "canonical"
+)
+
+var ErrCBORPresetUnknown = fmt.Errorf("cbor preset is not registered")
+
+// CBORPreset is the named set of the CBOR encoding and decoding options, see Options.CBORPreset.
+type CBORPreset struct {
+	EncOptions cbor.EncOptions
+	DecOptions cbor.DecOptions
+}
+
+// NewEncoder returns the encoder constructor of the preset.
+func (p CBORPreset) NewEncoder() NewEncoderFunc {
+	return NewCBOREncoderWithOptions(p.EncOptions)
+}
+
+// NewDecoder returns the decoder constructor of the preset.
+func (p CBORPreset) NewDecoder() NewDecoderFunc {
+	return NewCBORDecoderWithOptions(p.DecOptions)
+}
+
+var (
+	cborPresets = map[string]CBORPreset{
+		CBORDefault: {
+			DecOptions: cbor.DecOptions{MaxNestedLevels: 256},
+		},
+		CBORCanonical: {
+			EncOptions: cbor.CanonicalEncOptions(),
+			DecOptions: cbor.DecOptions{MaxNestedLevels: 256},
+		},
+	}
+	cborPresetsMu sync.RWMutex
+)
+
+// RegisterCBORPreset registers the CBOR preset under the name. The options are validated and the
+// registered presets can't be replaced.
+func RegisterCBORPreset(name string, preset CBORPreset) error {
+	if name == "" {
+		return fmt.Errorf("cbor preset name cannot be empty")
+	}
+	if _, err := preset.EncOptions.EncMode(); err != nil {
+		return fmt.Errorf("invalid cbor preset %q encoding options: %w", name, err)
+	}
+	if _, err := preset.DecOptions.DecMode(); err != nil {
+		return fmt.Errorf("invalid cbor preset %q decoding options: %w", name, err)
+	}
+
+	cborPresetsMu.Lock()
+	defer cborPresetsMu.Unlock()
+	if _, ok := cborPresets[name]; ok {
+		return fmt.Errorf("cbor preset %q is already registered", name)
+	}
+	cborPresets[name] = preset
+	return nil
+}
+
+// LookupCBORPreset returns the CBOR preset registered under the name.
+func LookupCBORPreset(name string) (CBORPreset, error) {
+	cborPresetsMu.RLock()
+	defer cborPresetsMu.RUnlock()
+
+	preset, ok := cborPresets[name]
+	if !ok {
+		return CBORPreset{}, fmt.Errorf("%w: %q", ErrCBORPresetUnknown, name)
+	}
+	return preset, nil
+}
+
+// validateCodecRoundTrip encodes and, if decode is set, decodes the probe block with the encoder and decoder
+// of the options, so that the unsupported encoding options are found before any block is written.
+func validateCodecRoundTrip[T any](opt Options, decode bool) error {
+	probe := Block[T]{
+		Hash:   common.BytesToHash([]byte("probe")),
+		Number: 1,
+		TS:     1,
+		Meta:   map[string]string{"probe": "true"},
+	}
+
+	var buf bytes.Buffer
+	err := opt.NewEncoder(&buf).Encode(probe)
+	if err != nil {
+		return fmt.Errorf("failed to encode probe block: %w", err)
+	}
+	if !decode {
+		return nil
+	}
+
+	var decoded Block[T]
+	err = opt.NewDecoder(&buf).Decode(&decoded)
+	if err != nil {
+		return fmt.Errorf("failed to decode probe block: %w", err)
+	}
+
+	if decoded.Hash != probe.Hash || decoded.Number != probe.Number || decoded.TS != probe.TS || decoded.Meta["probe"] != "true" {
+		return fmt.Errorf("probe block doesn't round-trip the encoding")
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCBORCanonical_Deterministic(t *testing.T) {
+	preset, err := LookupCBORPreset(CBORCanonical)
+	require.NoError(t, err)
+
+	// the same payload built in different key order
+	forward := make(map[string]any)
+	backward := make(map[string]any)
+	for i := 0; i < 64; i++ {
+		forward[fmt.Sprintf("key-%d", i)] = map[string]any{"value": i, "nested": []any{i, fmt.Sprint(i)}}
+	}
+	for i := 63; i >= 0; i-- {
+		backward[fmt.Sprintf("key-%d", i)] = map[string]any{"nested": []any{i, fmt.Sprint(i)}, "value": i}
+	}
+
+	encode := func(newEncoder NewEncoderFunc, data map[string]any) []byte {
+		var buf bytes.Buffer
+		block := Block[map[string]any]{Number: 1, Data: data, Meta: map[string]string{"b": "1", "a": "2"}}
+		require.NoError(t, newEncoder(&buf).Encode(block))
+		return buf.Bytes()
+	}
+
+	expected := encode(preset.NewEncoder(), forward)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, expected, encode(preset.NewEncoder(), forward))
+		require.Equal(t, expected, encode(preset.NewEncoder(), backward))
+	}
+
+	// the default encoding doesn't sort the map keys
+	var differs bool
+	for i := 0; i < 10 && !differs; i++ {
+		differs = !bytes.Equal(encode(NewCBOREncoder, forward), encode(NewCBOREncoder, backward))
+	}
+	require.True(t, differs)
+}
+
+func TestCBORPreset_CrossRead(t *testing.T) {
+	writeDataset := func(t *testing.T, preset string) Options {
+		opt := Options{
+			Dataset:         Dataset{Path: "ethwal"},
+			FileSystem:      gostorage.NewMemoryFS(),
+			CBORPreset:      preset,
+			FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+			FileRollOnClose: true,
+		}
+
+		w, err := NewWriter[[]int](opt)
+		require.NoError(t, err)
+		for _, b := range generateMixedIntBlocks() {
+			require.NoError(t, w.Write(context.Background(), b))
+		}
+		require.NoError(t, w.Close(context.Background()))
+		return opt
+	}
+
+	readDataset := func(t *testing.T, opt Options) {
+		r, err := NewReader[[]int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		for _, expected := range generateMixedIntBlocks() {
+			b, err := r.Read(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, expected.Number, b.Number)
+			require.Equal(t, expected.Hash, b.Hash)
+			require.ElementsMatch(t, expected.Data, b.Data)
+		}
+		_, err = r.Read(context.Background())
+		require.ErrorIs(t, err, io.EOF)
+	}
+
+	for _, writePreset := range []string{"", CBORDefault, CBORCanonical} {
+		for _, readPreset := range []string{"", CBORDefault, CBORCanonical} {
+			t.Run(fmt.Sprintf("write_%s_read_%s", writePreset, readPreset), func(t *testing.T) {
+				opt := writeDataset(t, writePreset)
+
+				recorded, err := DatasetCBORPreset(context.Background(), opt)
+				require.NoError(t, err)
+				require.Equal(t, writePreset, recorded)
+
+				opt.CBORPreset = readPreset
+				readDataset(t, opt)
+			})
+		}
+	}
+}
+
+func TestCBORPreset_Writer(t *testing.T) {
+	const (
+		bytesPresetName        = "test-string-to-byte-string"
+		bytesAllowedPresetName = "test-string-to-byte-string-allowed"
+	)
+	if _, err := LookupCBORPreset(bytesPresetName); err != nil {
+		require.NoError(t, RegisterCBORPreset(bytesPresetName, CBORPreset{
+			EncOptions: cbor.EncOptions{String: cbor.StringToByteString},
+		}))
+		require.NoError(t, RegisterCBORPreset(bytesAllowedPresetName, CBORPreset{
+			EncOptions: cbor.EncOptions{String: cbor.StringToByteString},
+			DecOptions: cbor.DecOptions{ByteStringToString: cbor.ByteStringToStringAllowed},
+		}))
+	}
+
+	opt := Options{
+		Dataset:    Dataset{Path: "ethwal"},
+		FileSystem: gostorage.NewMemoryFS(),
+	}
+
+	t.Run("register", func(t *testing.T) {
+		require.Error(t, RegisterCBORPreset(CBORCanonical, CBORPreset{}))
+		require.Error(t, RegisterCBORPreset("", CBORPreset{}))
+		require.Error(t, RegisterCBORPreset("test-invalid", CBORPreset{EncOptions: cbor.EncOptions{Sort: cbor.SortMode(100)}}))
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		opt := opt
+		opt.CBORPreset = "unknown"
+		_, err := NewWriter[int](opt)
+		require.ErrorIs(t, err, ErrCBORPresetUnknown)
+	})
+
+	t.Run("round_trip", func(t *testing.T) {
+		opt := opt
+		opt.CBORPreset = bytesPresetName
+
+		// the byte strings don't decode into the strings
+		_, err := NewWriter[string](opt)
+		require.ErrorContains(t, err, "failed to decode probe block")
+
+		opt.CBORPreset = bytesAllowedPresetName
+		w, err := NewWriter[string](opt)
+		require.NoError(t, err)
+		require.NoError(t, w.Close(context.Background()))
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		opt := opt
+		opt.FileSystem = gostorage.NewMemoryFS()
+		opt.CBORPreset = CBORCanonical
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+		require.NoError(t, w.Close(context.Background()))
+
+		opt.CBORPreset = CBORDefault
+		_, err = NewWriter[int](opt)
+		require.ErrorIs(t, err, ErrCBORPresetMismatch)
+
+		// the writer without the preset keeps the recorded one
+		opt.CBORPreset = ""
+		w, err = NewWriter[int](opt)
+		require.NoError(t, err)
+		require.NoError(t, w.Close(context.Background()))
+
+		preset, err := DatasetCBORPreset(context.Background(), opt)
+		require.NoError(t, err)
+		require.Equal(t, CBORCanonical, preset)
+	})
+}
+
+func TestBlock_Parent(t *testing.T) {
+	parent := common.HexToHash("0x01")
+	withParent := Block[[]int]{Hash: common.HexToHash("0x02"), Number: 2, TS: 3, Data: []int{1}, Parent: &parent}
+	withoutParent := Block[[]int]{Hash: common.HexToHash("0x02"), Number: 2, TS: 3, Data: []int{1}}
+
+	t.Run("json", func(t *testing.T) {
+		data, err := json.Marshal(withParent)
+		require.NoError(t, err)
+		require.Contains(t, string(data), `"parentHash":"`+parent.Hex()+`"`)
+		require.Contains(t, string(data), `"blockNum":2`)
+
+		var decoded Block[[]int]
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		require.Equal(t, withParent, decoded)
+
+		// the blocks without the parent are encoded as before
+		data, err = json.Marshal(withoutParent)
+		require.NoError(t, err)
+		require.NotContains(t, string(data), "parentHash")
+	})
+
+	t.Run("cbor", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, NewCBOREncoder(&buf).Encode(withParent))
+
+		var fields map[any]any
+		require.NoError(t, cbor.Unmarshal(buf.Bytes(), &fields))
+		require.Equal(t, parent.Bytes(), fields[uint64(0)])
+
+		var decoded Block[[]int]
+		require.NoError(t, NewCBORDecoder(&buf).Decode(&decoded))
+		require.Equal(t, withParent, decoded)
+
+		buf.Reset()
+		require.NoError(t, NewCBOREncoder(&buf).Encode(withoutParent))
+		fields = nil
+		require.NoError(t, cbor.Unmarshal(buf.Bytes(), &fields))
+		require.NotContains(t, fields, uint64(0))
+	})
+
+	t.Run("legacy_json", func(t *testing.T) {
+		// the block written before the parent was stored
+		data := `{"blockHash":"` + withoutParent.Hash.Hex() + `","blockNum":2,"blockTS":3,"blockData":[1]}`
+
+		var decoded Block[[]int]
+		require.NoError(t, NewJSONDecoder(bytes.NewReader([]byte(data))).Decode(&decoded))
+		require.Equal(t, withoutParent, decoded)
+		require.Equal(t, common.Hash{}, decoded.ParentHash())
+	})
+
+	t.Run("parent_hash", func(t *testing.T) {
+		require.Equal(t, parent, withParent.ParentHash())
+
+		// the parent of the block data is used without the parent of the block
+		chained := chainedTestBlock(5)
+		require.Equal(t, chained.Data.Parent, chained.ParentHash())
+
+		other := common.HexToHash("0x03")
+		chained.Parent = &other
+		require.Equal(t, other, chained.ParentHash())
+	})
+}
@@ -0,0 +1,52 @@
+package ethwal_test
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/0xsequence/ethwal"
+)
+
+// Publisher publishes messages to a message broker e.g. Google Pub/Sub or Kafka.
+type Publisher interface {
+	Publish(ctx context.Context, topic string, data []byte) error
+}
+
+type fileWrittenMessage struct {
+	FirstBlockNum uint64 `json:"firstBlockNum"`
+	LastBlockNum  uint64 `json:"lastBlockNum"`
+	Path          string `json:"path"`
+	NumBlocks     uint64 `json:"numBlocks"`
+	Size          uint64 `json:"size"`
+}
+
+func ExampleOptions_onFileWritten() {
+	var publisher Publisher // e.g. pubsub client wrapper
+
+	w, err := ethwal.NewWriter[any](ethwal.Options{
+		Dataset: ethwal.Dataset{
+			Name: "event-logs",
+			Path: "data",
+		},
+		OnFileWritten: func(ctx context.Context, file *ethwal.File, stats ethwal.FileStats) {
+			data, _ := json.Marshal(fileWrittenMessage{
+				FirstBlockNum: file.FirstBlockNum,
+				LastBlockNum:  file.LastBlockNum,
+				Path:          stats.Path,
+				NumBlocks:     stats.NumBlocks,
+				Size:          stats.Size,
+			})
+
+			err := publisher.Publish(ctx, "ethwal-file-written", data)
+			if err != nil {
+				log.Default().Println("failed to publish file written message", "err", err)
+			}
+		},
+		OnFileWrittenAsync: true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer w.Close(context.Background())
+}
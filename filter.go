@@ -4,7 +4,9 @@ import (
 	"cmp"
 	"context"
 	"fmt"
+	"math"
 	"path"
+	"slices"
 
 	"github.com/0xsequence/ethwal/storage"
 	"github.com/0xsequence/ethwal/storage/local"
@@ -19,6 +21,8 @@ type FilterIterator interface {
 	HasNext() bool
 	Next() (uint64, uint16)
 	Peek() (uint64, uint16)
+	// AdvanceIfNeeded skips the entries of blocks lower than blockNum.
+	AdvanceIfNeeded(blockNum uint64)
 	Bitmap() *roaring64.Bitmap
 }
 
@@ -26,6 +30,28 @@ type FilterBuilder interface {
 	And(filters ...Filter) Filter
 	Or(filters ...Filter) Filter
 	Eq(index string, key string) Filter
+	// EqBytes returns the positions of the binary key of the index, see IndexedValueBytes.
+	EqBytes(index string, key []byte) Filter
+	// Not returns the positions of the indexes of the filter that aren't matched by it, e.g. the logs not emitted
+	// by the contract. The universe of the index is its IndexedValueAll, the filter without indexes, e.g.
+	// BlockRange, is negated against the universe of all indexes.
+	Not(filter Filter) Filter
+	// BlockRange returns all positions of the blocks from, to inclusive, to be intersected with the other
+	// filters by And.
+	BlockRange(from, to uint64) Filter
+	// Snapshot captures the high-water marks of all indexes.
+	Snapshot(ctx context.Context) (FilterSnapshot, error)
+	// WithSnapshot returns the filter builder which filters only blocks that were indexed at the time
+	// the snapshot was taken, so that the results are stable regardless of concurrent flushes.
+	WithSnapshot(snapshot FilterSnapshot) FilterBuilder
+}
+
+// FilterSnapshot is a point-in-time view of the indexes. It can be serialized to pin the same view
+// across requests, e.g. in a paginated API.
+type FilterSnapshot struct {
+	// Indexes maps index names to their last indexed block numbers. The indexes that are not in
+	// the snapshot have no blocks.
+	Indexes map[IndexName]uint64 `json:"indexes" cbor:"0,keyasint"`
 }
 
 type FilterBuilderOptions[T any] struct {
@@ -45,6 +71,10 @@ type filterBuilder[T any] struct {
 
 	indexes map[IndexName]Index[T]
 	fs      storage.FS
+
+	retentionFloor uint64
+
+	snapshot *FilterSnapshot
 }
 
 func NewFilterBuilder[T any](opt FilterBuilderOptions[T]) (FilterBuilder, error) {
@@ -54,14 +84,121 @@ func NewFilterBuilder[T any](opt FilterBuilderOptions[T]) (FilterBuilder, error)
 	// mount indexes directory
 	fs := storage.NewPrefixWrapper(opt.FileSystem, fmt.Sprintf("%s/", path.Join(opt.Dataset.FullPath(), IndexesDirectory)))
 
+	// load retention floor, blocks below it are pruned
+	retentionFloor, err := IndexRetentionFloor(context.Background(), fs)
+	if err != nil {
+		return nil, err
+	}
+
 	return &filterBuilder[T]{
-		indexes: opt.Indexes,
-		fs:      fs,
+		indexes:        opt.Indexes,
+		fs:             fs,
+		retentionFloor: retentionFloor,
 	}, nil
 }
 
+func (c *filterBuilder[T]) Snapshot(ctx context.Context) (FilterSnapshot, error) {
+	snapshot := FilterSnapshot{Indexes: make(map[IndexName]uint64, len(c.indexes))}
+	for name, idx := range c.indexes {
+		// read directly, the cached value may be stale
+		lastBlockNum, err := idx.readLastBlockNumIndexed(ctx, c.fs)
+		if err != nil {
+			return FilterSnapshot{}, fmt.Errorf("failed to snapshot index %s: %w", name, err)
+		}
+
+		// snapshot can't see more than the builder it's taken from
+		if c.snapshot != nil {
+			lastBlockNum = min(lastBlockNum, c.snapshot.Indexes[name])
+		}
+		snapshot.Indexes[name] = lastBlockNum
+	}
+	return snapshot, nil
+}
+
+func (c *filterBuilder[T]) WithSnapshot(snapshot FilterSnapshot) FilterBuilder {
+	return &filterBuilder[T]{
+		indexes:        c.indexes,
+		fs:             c.fs,
+		retentionFloor: c.retentionFloor,
+		snapshot:       &snapshot,
+	}
+}
+
 type filter struct {
 	resultSet func(ctx context.Context) *roaring64.Bitmap
+	// indexes are the indexes the filter reads, the universe of Not
+	indexes []IndexName
+	// lastIndexed returns the last block number indexed by the indexes the filter reads
+	lastIndexed func(ctx context.Context) (uint64, error)
+}
+
+// indexedFilter is implemented by the filters of the filter builder, the filter evaluated before the indexes
+// advanced past its last indexed block number misses the blocks indexed since.
+type indexedFilter interface {
+	lastBlockNumIndexed(ctx context.Context) (uint64, error)
+}
+
+func (c *filter) lastBlockNumIndexed(ctx context.Context) (uint64, error) {
+	if c.lastIndexed == nil {
+		return 0, nil
+	}
+	return c.lastIndexed(ctx)
+}
+
+// lastBlockNumIndexed returns the lowest last block number indexed by the indexes, by all indexes of the builder
+// if none, clamped to the snapshot.
+func (c *filterBuilder[T]) lastBlockNumIndexed(indexes []IndexName) func(ctx context.Context) (uint64, error) {
+	if len(indexes) == 0 {
+		for name := range c.indexes {
+			indexes = append(indexes, name)
+		}
+	}
+
+	return func(ctx context.Context) (uint64, error) {
+		lastBlockNum := uint64(MaxSupportedBlockNum)
+		for _, name := range indexes {
+			// the index the builder doesn't have has no blocks
+			idx, ok := c.indexes[name]
+			if !ok {
+				return 0, nil
+			}
+
+			// read directly, the cached value may be stale
+			indexed, err := idx.readLastBlockNumIndexed(ctx, c.fs)
+			if err != nil {
+				return 0, fmt.Errorf("failed to read last block indexed of index %s: %w", name, err)
+			}
+			if c.snapshot != nil {
+				indexed = min(indexed, c.snapshot.Indexes[name])
+			}
+			lastBlockNum = min(lastBlockNum, indexed)
+		}
+		if len(indexes) == 0 {
+			return 0, nil
+		}
+		return lastBlockNum, nil
+	}
+}
+
+// filterIndexes returns the indexes read by the filters, nil if some filter isn't built by the filter builder.
+func filterIndexes(filters ...Filter) []IndexName {
+	var indexes []IndexName
+	for _, f := range filters {
+		if f == nil {
+			continue
+		}
+
+		bf, ok := f.(*filter)
+		if !ok {
+			return nil
+		}
+		for _, index := range bf.indexes {
+			if !slices.Contains(indexes, index) {
+				indexes = append(indexes, index)
+			}
+		}
+	}
+	return indexes
 }
 
 func (c *filter) Eval(ctx context.Context) FilterIterator {
@@ -70,10 +207,17 @@ func (c *filter) Eval(ctx context.Context) FilterIterator {
 			return roaring64.New()
 		}
 	}
-	return newFilterIterator(c.resultSet(ctx))
+
+	// the And and Or of no filters have no result set
+	bmap := c.resultSet(ctx)
+	if bmap == nil {
+		bmap = roaring64.New()
+	}
+	return newFilterIterator(bmap)
 }
 
 func (c *filterBuilder[T]) And(filters ...Filter) Filter {
+	indexes := filterIndexes(filters...)
 	return &filter{
 		resultSet: func(ctx context.Context) *roaring64.Bitmap {
 			var bmap *roaring64.Bitmap
@@ -91,10 +235,13 @@ func (c *filterBuilder[T]) And(filters ...Filter) Filter {
 			}
 			return bmap
 		},
+		indexes:     indexes,
+		lastIndexed: c.lastBlockNumIndexed(indexes),
 	}
 }
 
 func (c *filterBuilder[T]) Or(filters ...Filter) Filter {
+	indexes := filterIndexes(filters...)
 	return &filter{
 		resultSet: func(ctx context.Context) *roaring64.Bitmap {
 			var bmap *roaring64.Bitmap
@@ -112,29 +259,107 @@ func (c *filterBuilder[T]) Or(filters ...Filter) Filter {
 			}
 			return bmap
 		},
+		indexes:     indexes,
+		lastIndexed: c.lastBlockNumIndexed(indexes),
 	}
 }
 
 func (c *filterBuilder[T]) Eq(index string, key string) Filter {
+	index_ := IndexName(index).Normalize()
+	return &filter{
+		resultSet: func(ctx context.Context) *roaring64.Bitmap {
+			return c.fetch(ctx, index_, IndexedValue(key))
+		},
+		indexes:     []IndexName{index_},
+		lastIndexed: c.lastBlockNumIndexed([]IndexName{index_}),
+	}
+}
+
+func (c *filterBuilder[T]) EqBytes(index string, key []byte) Filter {
+	return c.Eq(index, string(IndexedValueBytes(key)))
+}
 
+func (c *filterBuilder[T]) Not(f Filter) Filter {
+	indexes := filterIndexes(f)
 	return &filter{
 		resultSet: func(ctx context.Context) *roaring64.Bitmap {
-			// fetch the index file and include it in the result set
-			index_ := IndexName(index).Normalize()
-			idx, ok := c.indexes[index_]
-			if !ok {
-				return roaring64.New()
+			universeIndexes := indexes
+			if len(universeIndexes) == 0 {
+				for name := range c.indexes {
+					universeIndexes = append(universeIndexes, name)
+				}
 			}
 
-			bitmap, err := idx.Fetch(ctx, c.fs, IndexedValue(key))
-			if err != nil {
-				return roaring64.New()
+			bmap := roaring64.New()
+			for _, index := range universeIndexes {
+				bmap.Or(c.fetch(ctx, index, IndexedValueAll))
 			}
-			return bitmap
+			if f != nil {
+				bmap.AndNot(f.Eval(ctx).Bitmap())
+			}
+			return bmap
 		},
+		indexes:     indexes,
+		lastIndexed: c.lastBlockNumIndexed(indexes),
 	}
 }
 
+func (c *filterBuilder[T]) BlockRange(from, to uint64) Filter {
+	to = min(to, MaxSupportedBlockNum)
+	return &filter{
+		resultSet: func(ctx context.Context) *roaring64.Bitmap {
+			bmap := roaring64.New()
+			if from > to {
+				return bmap
+			}
+
+			// the range end is exclusive, the last position of the last block is added separately
+			last := uint64(NewIndexCompoundID(to, math.MaxUint16))
+			bmap.AddRange(uint64(NewIndexCompoundID(from, 0)), last)
+			bmap.Add(last)
+			return bmap
+		},
+	}
+}
+
+// fetch returns the positions of the value of the index clamped to the retention floor and the snapshot.
+func (c *filterBuilder[T]) fetch(ctx context.Context, index IndexName, value IndexedValue) *roaring64.Bitmap {
+	// fetch the index file and include it in the result set
+	idx, ok := c.indexes[index]
+	if !ok {
+		return roaring64.New()
+	}
+
+	lastBlockNum := uint64(MaxSupportedBlockNum)
+	if c.snapshot != nil {
+		var ok bool
+		lastBlockNum, ok = c.snapshot.Indexes[index]
+		if !ok {
+			return roaring64.New()
+		}
+	}
+
+	// the mutable index file isn't read if the snapshot is sealed
+	bitmap, err := idx.fetch(ctx, c.fs, value, lastBlockNum)
+	if err != nil {
+		return roaring64.New()
+	}
+
+	// clamp results to the retention floor
+	if c.retentionFloor > 0 {
+		bitmap.RemoveRange(0, uint64(NewIndexCompoundID(c.retentionFloor, 0)))
+	}
+
+	// clamp results to the snapshot
+	if c.snapshot != nil {
+		if lastBlockNum < MaxSupportedBlockNum {
+			bitmap.RemoveRange(uint64(NewIndexCompoundID(lastBlockNum+1, 0)), math.MaxUint64)
+			bitmap.Remove(math.MaxUint64)
+		}
+	}
+	return bitmap
+}
+
 type filterIterator struct {
 	iter   roaring64.IntPeekable64
 	bitmap *roaring64.Bitmap
@@ -162,6 +387,10 @@ func (f *filterIterator) Peek() (uint64, uint16) {
 	return IndexCompoundID(val).Split()
 }
 
+func (f *filterIterator) AdvanceIfNeeded(blockNum uint64) {
+	f.iter.AdvanceIfNeeded(advanceTarget(blockNum))
+}
+
 func (f *filterIterator) Bitmap() *roaring64.Bitmap {
 	return f.bitmap
 }
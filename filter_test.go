@@ -2,14 +2,18 @@ package ethwal
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math"
 	"os"
+	"path"
 	"testing"
 
 	"github.com/0xsequence/ethkit/go-ethereum/common"
 	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/memory"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var (
@@ -147,33 +151,33 @@ func generateIntIndexes() Indexes[[]int] {
 	return indexes
 }
 
-func indexOddEvenBlocks(block Block[[]int]) (toIndex bool, indexValueMap map[IndexedValue][]uint16, err error) {
+func indexOddEvenBlocks(block Block[[]int]) (toIndex bool, indexValueMap map[IndexedValue][]Position, err error) {
 	if len(block.Data) == 0 {
 		return false, nil, nil
 	}
 
 	toIndex = true
-	indexValueMap = make(map[IndexedValue][]uint16)
-	indexValueMap["even"] = []uint16{}
-	indexValueMap["odd"] = []uint16{}
+	indexValueMap = make(map[IndexedValue][]Position)
+	indexValueMap["even"] = []Position{}
+	indexValueMap["odd"] = []Position{}
 	for i, data := range block.Data {
 		if data%2 == 0 {
-			indexValueMap["even"] = append(indexValueMap["even"], uint16(i))
+			indexValueMap["even"] = append(indexValueMap["even"], OrdinalPosition(i))
 		} else {
-			indexValueMap["odd"] = append(indexValueMap["odd"], uint16(i))
+			indexValueMap["odd"] = append(indexValueMap["odd"], OrdinalPosition(i))
 		}
 	}
 
 	return
 }
 
-func indexOnlyEvenBlocks(block Block[[]int]) (toIndex bool, indexValueMap map[IndexedValue][]uint16, err error) {
+func indexOnlyEvenBlocks(block Block[[]int]) (toIndex bool, indexValueMap map[IndexedValue][]Position, err error) {
 	if len(block.Data) == 0 {
 		return false, nil, nil
 	}
 
 	toIndex = true
-	indexValueMap = make(map[IndexedValue][]uint16)
+	indexValueMap = make(map[IndexedValue][]Position)
 	for _, data := range block.Data {
 		if data%2 != 0 {
 			toIndex = false
@@ -182,18 +186,18 @@ func indexOnlyEvenBlocks(block Block[[]int]) (toIndex bool, indexValueMap map[In
 	}
 
 	if toIndex {
-		indexValueMap["true"] = []uint16{math.MaxUint16}
+		indexValueMap["true"] = Ordinals(math.MaxUint16)
 	}
 
 	return
 }
-func indexOnlyOddBlocks(block Block[[]int]) (toIndex bool, indexValueMap map[IndexedValue][]uint16, err error) {
+func indexOnlyOddBlocks(block Block[[]int]) (toIndex bool, indexValueMap map[IndexedValue][]Position, err error) {
 	if len(block.Data) == 0 {
 		return false, nil, nil
 	}
 
 	toIndex = true
-	indexValueMap = make(map[IndexedValue][]uint16)
+	indexValueMap = make(map[IndexedValue][]Position)
 	for _, data := range block.Data {
 		if data%2 == 0 {
 			toIndex = false
@@ -202,13 +206,13 @@ func indexOnlyOddBlocks(block Block[[]int]) (toIndex bool, indexValueMap map[Ind
 	}
 
 	if toIndex {
-		indexValueMap["true"] = []uint16{math.MaxUint16}
+		indexValueMap["true"] = Ordinals(math.MaxUint16)
 	}
 
 	return
 }
 
-func indexBlock(block Block[[]int]) (toIndex bool, indexValueMap map[IndexedValue][]uint16, err error) {
+func indexBlock(block Block[[]int]) (toIndex bool, indexValueMap map[IndexedValue][]Position, err error) {
 	if len(block.Data) == 0 {
 		return false, nil, nil
 	}
@@ -218,36 +222,36 @@ func indexBlock(block Block[[]int]) (toIndex bool, indexValueMap map[IndexedValu
 	}
 
 	toIndex = true
-	indexValueMap = make(map[IndexedValue][]uint16)
+	indexValueMap = make(map[IndexedValue][]Position)
 	for i, data := range block.Data {
 		dataStr := IndexedValue(fmt.Sprintf("%d", data))
 		if _, ok := indexValueMap[dataStr]; !ok {
-			indexValueMap[dataStr] = []uint16{}
+			indexValueMap[dataStr] = []Position{}
 		}
-		indexValueMap[dataStr] = append(indexValueMap[dataStr], uint16(i))
+		indexValueMap[dataStr] = append(indexValueMap[dataStr], OrdinalPosition(i))
 	}
 
 	return
 }
 
-func indexAll(block Block[[]int]) (toIndex bool, indexValueMap map[IndexedValue][]uint16, err error) {
+func indexAll(block Block[[]int]) (toIndex bool, indexValueMap map[IndexedValue][]Position, err error) {
 	if len(block.Data) == 0 {
 		return false, nil, nil
 	}
 
 	toIndex = true
-	indexValueMap = make(map[IndexedValue][]uint16)
+	indexValueMap = make(map[IndexedValue][]Position)
 	for _, data := range block.Data {
 		dataStr := IndexedValue(fmt.Sprintf("%d", data))
 		if _, ok := indexValueMap[dataStr]; !ok {
-			indexValueMap[dataStr] = []uint16{math.MaxUint16}
+			indexValueMap[dataStr] = Ordinals(math.MaxUint16)
 		}
 	}
 
 	return
 }
 
-func indexNone(block Block[[]int]) (toIndex bool, indexValueMap map[IndexedValue][]uint16, err error) {
+func indexNone(block Block[[]int]) (toIndex bool, indexValueMap map[IndexedValue][]Position, err error) {
 	return false, nil, nil
 }
 
@@ -403,3 +407,249 @@ func TestLowestIndexedBlockNum(t *testing.T) {
 	lowestBlockIndexed = indexer.BlockNum()
 	assert.Equal(t, uint64(99), lowestBlockIndexed)
 }
+
+func TestFilterBuilder_Snapshot(t *testing.T) {
+	defer cleanupIndexMockData()()
+
+	blocks := generateMixedIntBlocks()
+	indexes := generateMixedIntIndexes()
+
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+		Dataset: Dataset{Path: indexTestDir},
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+
+	indexBlocks := func(blocks []Block[[]int]) {
+		for _, block := range blocks {
+			require.NoError(t, indexer.Index(context.Background(), block))
+		}
+		require.NoError(t, indexer.Flush(context.Background()))
+	}
+
+	blockNums := func(result FilterIterator) []uint64 {
+		var blockNums []uint64
+		for result.HasNext() {
+			blockNum, _ := result.Next()
+			if len(blockNums) == 0 || blockNums[len(blockNums)-1] != blockNum {
+				blockNums = append(blockNums, blockNum)
+			}
+		}
+		return blockNums
+	}
+
+	indexBlocks(blocks[:30])
+
+	f, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset: Dataset{Path: indexTestDir},
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+
+	snapshot, err := f.Snapshot(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, uint64(30), snapshot.Indexes["odd_even"])
+
+	expected := blockNums(f.Eq("odd_even", "even").Eval(context.Background()))
+	require.NotEmpty(t, expected)
+
+	indexBlocks(blocks[30:])
+
+	// snapshot survives serialization
+	data, err := json.Marshal(snapshot)
+	require.NoError(t, err)
+
+	var restored FilterSnapshot
+	require.NoError(t, json.Unmarshal(data, &restored))
+
+	sf := f.WithSnapshot(restored)
+	require.Equal(t, expected, blockNums(sf.Eq("odd_even", "even").Eval(context.Background())))
+	require.Equal(t, expected, blockNums(sf.Or(sf.Eq("odd_even", "even"), sf.Eq("odd_even", "none")).Eval(context.Background())))
+
+	// snapshot of the snapshot builder is the same
+	snapshot2, err := sf.Snapshot(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, snapshot, snapshot2)
+
+	// fresh query sees the new blocks
+	fresh := blockNums(f.Eq("odd_even", "even").Eval(context.Background()))
+	require.Greater(t, len(fresh), len(expected))
+	require.Equal(t, expected, fresh[:len(expected)])
+
+	// unknown index in the snapshot has no blocks
+	require.True(t, sf.WithSnapshot(FilterSnapshot{}).Eq("odd_even", "even").Eval(context.Background()).Bitmap().IsEmpty())
+}
+
+func TestFilterBuilder_Not(t *testing.T) {
+	_, indexes, _, cleanup, err := setupMockData(generateMixedIntIndexes, generateMixedIntBlocks)
+	require.NoError(t, err)
+	defer cleanup()
+
+	f, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset: Dataset{Path: indexTestDir},
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+
+	// the positions of the values of the index "all", the blocks from 50
+	var expected []uint64
+	for _, b := range generateMixedIntBlocks() {
+		for i, data := range b.Data {
+			if b.Number >= 50 && data != 121 {
+				expected = append(expected, uint64(NewIndexCompoundID(b.Number, uint16(i))))
+			}
+		}
+	}
+	require.Equal(t, expected, f.Not(f.Eq("all", "121")).Eval(context.Background()).Bitmap().ToArray())
+
+	// the universe is the index of the filter
+	require.Equal(t, f.Eq("all", string(IndexedValueAll)).Eval(context.Background()).Bitmap().ToArray(),
+		f.Not(f.Eq("all", "1000")).Eval(context.Background()).Bitmap().ToArray())
+	require.True(t, f.Not(nil).Eval(context.Background()).Bitmap().Contains(uint64(NewIndexCompoundID(1, IndexAllDataIndexes))))
+	require.ElementsMatch(t, f.Eq("odd_even", "even").Eval(context.Background()).Bitmap().ToArray(),
+		f.Not(f.Eq("odd_even", "odd")).Eval(context.Background()).Bitmap().ToArray())
+
+	// the double negation is the filter
+	require.Equal(t, f.Eq("all", "121").Eval(context.Background()).Bitmap().ToArray(),
+		f.Not(f.Not(f.Eq("all", "121"))).Eval(context.Background()).Bitmap().ToArray())
+
+	// the odd values other than 121
+	result := f.And(f.Eq("odd_even", "odd"), f.Not(f.Eq("all", "121"))).Eval(context.Background()).Bitmap()
+	require.False(t, result.IsEmpty())
+	require.False(t, result.Intersects(f.Eq("all", "121").Eval(context.Background()).Bitmap()))
+	require.True(t, result.Intersects(f.Eq("all", "123").Eval(context.Background()).Bitmap()))
+}
+
+func TestFilterBuilder_BlockRange(t *testing.T) {
+	_, indexes, _, cleanup, err := setupMockData(generateMixedIntIndexes, generateMixedIntBlocks)
+	require.NoError(t, err)
+	defer cleanup()
+
+	f, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset: Dataset{Path: indexTestDir},
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+
+	blockNums := func(filter Filter) []uint64 {
+		var blockNums []uint64
+		result := filter.Eval(context.Background())
+		for result.HasNext() {
+			blockNum, _ := result.Next()
+			if len(blockNums) == 0 || blockNums[len(blockNums)-1] != blockNum {
+				blockNums = append(blockNums, blockNum)
+			}
+		}
+		return blockNums
+	}
+
+	require.Equal(t, []uint64{21, 22, 23}, blockNums(f.And(f.Eq("only_odd", "true"), f.BlockRange(10, 23))))
+	require.Equal(t, []uint64{41, 42}, blockNums(f.And(f.Eq("odd_even", "even"), f.BlockRange(21, 42))))
+
+	// the positions within the blocks are kept
+	inRange := f.And(f.Eq("all", "121"), f.BlockRange(51, 60)).Eval(context.Background()).Bitmap()
+	all := f.Eq("all", "121").Eval(context.Background()).Bitmap()
+	for _, id := range all.ToArray() {
+		blockNum := IndexCompoundID(id).BlockNumber()
+		require.Equal(t, blockNum <= 60, inRange.Contains(id))
+	}
+
+	// the blocks outside of the range
+	require.Equal(t, []uint64{61, 62, 63, 64, 65, 66, 67, 68, 69, 70},
+		blockNums(f.And(f.Eq("all", "121"), f.Not(f.BlockRange(0, 60)))))
+
+	require.Empty(t, blockNums(f.BlockRange(10, 9)))
+	require.Equal(t, uint64(math.MaxUint16)+1, f.BlockRange(MaxSupportedBlockNum, math.MaxUint64).Eval(context.Background()).Bitmap().GetCardinality())
+}
+
+func TestFilterBuilder_EqBytes(t *testing.T) {
+	ctx := context.Background()
+
+	// the keys with the path separator, the NUL byte and the invalid UTF-8
+	keys := [][]byte{{0xc0, '/', 0x00}, {0xff, 0xfe}, {}}
+	indexKeys := func(block Block[[]int]) (bool, map[IndexedValue][]Position, error) {
+		indexValueMap := make(map[IndexedValue][]Position)
+		for i, v := range block.Data {
+			key := IndexedValueBytes(keys[v%len(keys)])
+			indexValueMap[key] = append(indexValueMap[key], Ordinals(uint16(i))...)
+		}
+		// the text value of the same bytes is the other value
+		indexValueMap[IndexedValue(keys[1])] = Ordinals(IndexAllDataIndexes)
+		return true, indexValueMap, nil
+	}
+
+	indexes := Indexes[[]int]{"key": NewIndex[[]int]("key", indexKeys)}
+	indexerOpt := IndexerOptions[[]int]{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      memory.NewMemoryFS(),
+		Indexes:         indexes,
+		MaxPendingBytes: 256,
+		PendingMode:     IndexerPendingModeSpill,
+		SpillPath:       t.TempDir(),
+	}
+	indexer, err := NewIndexer(ctx, indexerOpt)
+	require.NoError(t, err)
+	for blockNum := uint64(1); blockNum <= 30; blockNum++ {
+		require.NoError(t, indexer.Index(ctx, Block[[]int]{Number: blockNum, Data: []int{int(blockNum), int(blockNum) + 1}}))
+	}
+	// the binary values are read back from the spill files
+	require.Greater(t, indexer.Stats().SpillCount, uint64(0))
+	require.NoError(t, indexer.Flush(ctx))
+	require.NoError(t, indexer.Close(ctx))
+
+	expected := func(key int) []uint64 {
+		var positions []uint64
+		for blockNum := uint64(1); blockNum <= 30; blockNum++ {
+			for i, v := range []int{int(blockNum), int(blockNum) + 1} {
+				if v%len(keys) == key {
+					positions = append(positions, uint64(NewIndexCompoundID(blockNum, uint16(i))))
+				}
+			}
+		}
+		return positions
+	}
+	requireKeys := func(t *testing.T) {
+		fb, err := NewFilterBuilder(FilterBuilderOptions[[]int]{Dataset: indexerOpt.Dataset, FileSystem: indexerOpt.FileSystem, Indexes: indexes})
+		require.NoError(t, err)
+		for i, key := range keys {
+			require.Equal(t, expected(i), fb.EqBytes("key", key).Eval(ctx).Bitmap().ToArray(), "key %x", key)
+		}
+		require.Len(t, fb.Eq("key", string(keys[1])).Eval(ctx).Bitmap().ToArray(), 30)
+	}
+
+	requireKeys(t)
+
+	// the sealed positions of the binary values
+	require.NoError(t, SealIndexes(ctx, indexerOpt, 15))
+	requireKeys(t)
+
+	index := indexes["key"]
+	report, err := index.IndexStats(ctx, storage.NewPrefixWrapper(indexerOpt.FileSystem, fmt.Sprintf("%s/", path.Join(indexerOpt.Dataset.FullPath(), IndexesDirectory))))
+	require.NoError(t, err)
+	require.Equal(t, len(keys)+1, report.Values)
+	for _, value := range report.Largest {
+		require.NotContains(t, value.Value.String(), "/")
+	}
+}
+
+func TestIndexPath_Bytes(t *testing.T) {
+	// the paths of the text values are kept
+	require.Equal(t, "all/000644/000648/000539/0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2.idx", indexPath("all", "0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2"))
+
+	// the binary value is named by the hash of its bytes
+	value := IndexedValueBytes([]byte{0xc0, '/', 0x00})
+	filePath := indexPath("all", string(value))
+	require.Equal(t, "all/000981/000041/000136/c1b1d25ab04880f56ad78ebe55d40d2181c12bf720cb1da00e8195d1.idx", filePath)
+	require.Equal(t, "0xc02f00", value.String())
+	require.Equal(t, []byte{0xc0, '/', 0x00}, value.Bytes())
+
+	fileValue, ok := indexFileValue("all", filePath)
+	require.True(t, ok)
+	require.True(t, fileValue.IsBytes())
+	require.Equal(t, value.fileKey(), fileValue)
+	require.Equal(t, filePath, indexPath("all", string(fileValue)))
+
+	textValue, ok := indexFileValue("all", indexPath("all", "0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2"))
+	require.True(t, ok)
+	require.Equal(t, IndexedValue("0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2"), textValue)
+}
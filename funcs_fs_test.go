@@ -0,0 +1,225 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// mapObjects are the objects of the func file system, as stored by the embedding system.
+type mapObjects struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	modTime map[string]time.Time
+}
+
+type mapObjectWriter struct {
+	bytes.Buffer
+	objects *mapObjects
+	path    string
+}
+
+func (w *mapObjectWriter) Close() error {
+	w.objects.mu.Lock()
+	defer w.objects.mu.Unlock()
+	w.objects.objects[w.path] = bytes.Clone(w.Bytes())
+	w.objects.modTime[w.path] = time.Now()
+	return nil
+}
+
+// newMapFS creates the func file system of the map objects.
+func newMapFS() (storage.FS, *mapObjects) {
+	objects := &mapObjects{objects: make(map[string][]byte), modTime: make(map[string]time.Time)}
+
+	open := func(ctx context.Context, path string) (io.ReadCloser, error) {
+		objects.mu.Lock()
+		defer objects.mu.Unlock()
+		data, ok := objects.objects[path]
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	create := func(ctx context.Context, path string) (io.WriteCloser, error) {
+		return &mapObjectWriter{objects: objects, path: path}, nil
+	}
+	stat := func(ctx context.Context, path string) (int64, time.Time, error) {
+		objects.mu.Lock()
+		defer objects.mu.Unlock()
+		data, ok := objects.objects[path]
+		if !ok {
+			return 0, time.Time{}, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+		}
+		return int64(len(data)), objects.modTime[path], nil
+	}
+	deleteObject := func(ctx context.Context, path string) error {
+		objects.mu.Lock()
+		defer objects.mu.Unlock()
+		if _, ok := objects.objects[path]; !ok {
+			return fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+		}
+		delete(objects.objects, path)
+		delete(objects.modTime, path)
+		return nil
+	}
+	walk := func(ctx context.Context, prefix string, fn func(path string) error) error {
+		objects.mu.Lock()
+		var paths []string
+		for path := range objects.objects {
+			if strings.HasPrefix(path, prefix) {
+				paths = append(paths, path)
+			}
+		}
+		objects.mu.Unlock()
+
+		slices.Sort(paths)
+		for _, path := range paths {
+			if err := fn(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return storage.FSFromFuncs(open, create, stat, deleteObject, walk), objects
+}
+
+// writeAndReadFuncFS writes and indexes the blocks on the file system and reads the blocks selected by the index.
+func writeAndReadFuncFS(t *testing.T, writeFs, readFs storage.FS) error {
+	dataset := Dataset{Name: "int-wal", Version: defaultDatasetVersion, Path: "ethwal"}
+	indexes := generateMixedIntIndexes()
+	opt := Options{
+		Dataset:         dataset,
+		FileSystem:      writeFs,
+		NewCompressor:   NewZSTDCompressor,
+		NewDecompressor: NewZSTDDecompressor,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{Dataset: dataset, FileSystem: writeFs, Indexes: indexes})
+	if err != nil {
+		return err
+	}
+
+	w, err := NewWriter[[]int](opt)
+	if err != nil {
+		return err
+	}
+	w, err = NewWriterWithIndexer(w, indexer)
+	if err != nil {
+		return err
+	}
+
+	blocks := generateMixedIntBlocks()
+	for _, b := range blocks {
+		if err := w.Write(context.Background(), b); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(context.Background()); err != nil {
+		return err
+	}
+
+	opt.FileSystem = readFs
+	r, err := NewReader[[]int](opt)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var read int
+	for {
+		_, err := r.Read(context.Background())
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		read++
+	}
+	require.Equal(t, len(blocks), read)
+
+	fb, err := NewFilterBuilder(FilterBuilderOptions[[]int]{Dataset: dataset, FileSystem: readFs, Indexes: indexes})
+	if err != nil {
+		return err
+	}
+
+	fr, err := NewReader[[]int](opt)
+	if err != nil {
+		return err
+	}
+	fr, err = NewReaderWithFilter(fr, fb.Eq("only_even", "true"))
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+
+	var filtered int
+	for {
+		b, err := fr.Read(context.Background())
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for _, i := range b.Data {
+			require.Equal(t, 0, i%2)
+		}
+		filtered++
+	}
+	require.NotZero(t, filtered)
+	return nil
+}
+
+func TestFSFromFuncs(t *testing.T) {
+	t.Run("write_index_read", func(t *testing.T) {
+		fs, objects := newMapFS()
+		require.NoError(t, writeAndReadFuncFS(t, fs, fs))
+		require.Contains(t, objects.objects, "ethwal/int-wal/"+defaultDatasetVersion+"/"+FileIndexFileName)
+
+		files, err := ListFiles(context.Background(), storage.NewPrefixWrapper(fs, "ethwal/int-wal/"+defaultDatasetVersion+"/"))
+		require.NoError(t, err)
+		require.NotEmpty(t, files)
+	})
+
+	// the reader only opens and stats
+	t.Run("minimal", func(t *testing.T) {
+		writeFs, objects := newMapFS()
+		readFs := storage.FSFromFuncs(
+			func(ctx context.Context, path string) (io.ReadCloser, error) {
+				return writeFs.Open(ctx, path, nil)
+			},
+			nil,
+			func(ctx context.Context, path string) (int64, time.Time, error) {
+				attrs, err := writeFs.Attributes(ctx, path, nil)
+				if err != nil {
+					return 0, time.Time{}, err
+				}
+				return attrs.Size, attrs.ModTime, nil
+			},
+			nil,
+			nil,
+		)
+		require.NoError(t, writeAndReadFuncFS(t, writeFs, readFs))
+		require.NotEmpty(t, objects.objects)
+	})
+
+	t.Run("not_implemented", func(t *testing.T) {
+		_, err := NewWriter[int](Options{Dataset: Dataset{Path: "ethwal"}, FileSystem: storage.FSFromFuncs(nil, nil, nil, nil, nil)})
+		require.ErrorIs(t, err, storage.ErrNotImplemented)
+	})
+}
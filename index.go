@@ -5,27 +5,133 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"math"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 
 	"github.com/0xsequence/ethwal/storage"
 	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/sync/errgroup"
 )
 
+const indexRetentionFilePath = ".retention"
+
 // IndexAllDataIndexes is a special position that indicates that all data indexes should be indexed.
 const IndexAllDataIndexes = math.MaxUint16
 
+// defaultMaxStoreConcurrency is the number of the index files written concurrently by Index.Store.
+const defaultMaxStoreConcurrency = 8
+
+var ErrPositionFormatMismatch = fmt.Errorf("index position format mismatch")
+
+// ErrReservedIndexedValue is returned by Index.IndexBlock if the index function returns IndexedValueAll, the
+// value reserved for the universe of the index.
+var ErrReservedIndexedValue = fmt.Errorf("reserved indexed value")
+
+// ErrRetryableIndex is wrapped by the errors of the index functions that may succeed later, e.g. the lookup
+// of the external service timed out. The indexer doesn't advance the index past the failed block, the later
+// blocks fail with ErrRetryableIndex until the block is indexed again. The index functions skip the block
+// permanently by returning false, the other errors fail the block.
+var ErrRetryableIndex = fmt.Errorf("retryable index failure")
+
+// IndexStoreError is returned by Index.Store if the index files of some values failed to be written. The
+// values stored are removed from the update, so the retry of the update writes the failed values only.
+type IndexStoreError struct {
+	Index IndexName
+	// Values are the errors of the values that failed to be stored.
+	Values map[IndexedValue]error
+}
+
+func (e *IndexStoreError) Error() string {
+	values := e.values()
+
+	const maxListed = 3
+	var listed []string
+	for _, value := range values[:min(len(values), maxListed)] {
+		listed = append(listed, fmt.Sprintf("%s: %s", value, e.Values[value]))
+	}
+	if len(values) > maxListed {
+		listed = append(listed, fmt.Sprintf("and %d more", len(values)-maxListed))
+	}
+	return fmt.Sprintf("index %s: failed to store %d values: %s", e.Index, len(values), strings.Join(listed, "; "))
+}
+
+// Unwrap returns the errors of the values in the value order.
+func (e *IndexStoreError) Unwrap() []error {
+	var errs []error
+	for _, value := range e.values() {
+		errs = append(errs, e.Values[value])
+	}
+	return errs
+}
+
+func (e *IndexStoreError) values() []IndexedValue {
+	values := make([]IndexedValue, 0, len(e.Values))
+	for value := range e.Values {
+		values = append(values, value)
+	}
+	slices.Sort(values)
+	return values
+}
+
 // IndexFunction is a function that indexes a block.
 //
 // The function should return true if the block should be indexed, and false otherwise.
 // The function should return an error if the indexing fails.
 // The function should return a map of index values to positions in the block.
-type IndexFunction[T any] func(block Block[T]) (toIndex bool, indexValueMap map[IndexedValue][]uint16, err error)
+type IndexFunction[T any] func(block Block[T]) (toIndex bool, indexValueMap map[IndexedValue][]Position, err error)
+
+// IndexFunctionWithContext is IndexFunction receiving the context of Indexer.Index, e.g. for the index of the
+// values looked up in the external service.
+type IndexFunctionWithContext[T any] func(ctx context.Context, block Block[T]) (toIndex bool, indexValueMap map[IndexedValue][]Position, err error)
+
+// Position is the location of the indexed value within the block data, e.g. the transaction or the topic of
+// the log. It's stored in the index next to the block number in its compact form, the compact form
+// IndexAllDataIndexes is the whole block.
+type Position interface {
+	Compact() uint16
+}
+
+// OrdinalPosition is the position of the element of the slice block data, the position of the indexes
+// written before the positions were typed.
+type OrdinalPosition uint16
+
+func (p OrdinalPosition) Compact() uint16 {
+	return uint16(p)
+}
+
+// Ordinals returns the ordinal positions.
+func Ordinals(ordinals ...uint16) []Position {
+	positions := make([]Position, len(ordinals))
+	for i, ordinal := range ordinals {
+		positions[i] = OrdinalPosition(ordinal)
+	}
+	return positions
+}
+
+// PositionFormat decodes the positions of the index from their compact form. The name is stored in the index
+// files, the index read with a different format fails with ErrPositionFormatMismatch.
+type PositionFormat struct {
+	Name   string
+	Decode func(compact uint16) Position
+}
+
+// OrdinalPositions is the format of the OrdinalPosition, the default format of the indexes. Its name is empty,
+// so the index files written before the positions were typed are read with it.
+var OrdinalPositions = PositionFormat{
+	Decode: func(compact uint16) Position {
+		return OrdinalPosition(compact)
+	},
+}
 
 // IndexCompoundID is a compound ID for an index. It is a combination of the block number and the index within the block.
+// The block number occupies the upper 48 bits, so only block numbers up to MaxSupportedBlockNum can be represented.
 type IndexCompoundID uint64
 
 func NewIndexCompoundID(blockNum uint64, dataIndex uint16) IndexCompoundID {
@@ -51,17 +157,94 @@ func (i IndexName) Normalize() IndexName {
 	return IndexName(strings.ToLower(string(i)))
 }
 
-// IndexedValue is the indexed value of an index.
+// IndexedValue is the indexed value of an index, the text value or the binary one of IndexedValueBytes.
 type IndexedValue string
 
+const (
+	// indexedValueBytesPrefix marks the binary values of IndexedValueBytes, the text values don't start with
+	// the control bytes of the prefixes.
+	indexedValueBytesPrefix = "\x00"
+	// indexedValueHashPrefix marks the binary values known by the hash of their bytes only, the values of the
+	// index files named by the hash, see indexFileValue.
+	indexedValueHashPrefix = "\x01"
+)
+
+// newIndexValueDecoder decodes the CBOR holding the indexed values, the binary values are the text strings of
+// arbitrary bytes.
+var newIndexValueDecoder = NewCBORDecoderWithOptions(cbor.DecOptions{MaxNestedLevels: 256, UTF8: cbor.UTF8DecodeInvalid})
+
+// IndexedValueBytes returns the binary indexed value of the key, e.g. the bytes of common.Address or
+// common.Hash, so that the keys aren't hex encoded and normalized by the index functions. The index file of
+// the binary value is named by the hex of the hash of its bytes, the arbitrary bytes are safe in the paths.
+func IndexedValueBytes(key []byte) IndexedValue {
+	return IndexedValue(indexedValueBytesPrefix + string(key))
+}
+
+// IsBytes reports whether the value is the binary one of IndexedValueBytes.
+func (v IndexedValue) IsBytes() bool {
+	return strings.HasPrefix(string(v), indexedValueBytesPrefix) || v.isHash()
+}
+
+// Bytes returns the key of the binary value or the bytes of the text one. The value read back from the index
+// file names, e.g. of IndexStatsReport, holds the hash of the key only, its hash is returned.
+func (v IndexedValue) Bytes() []byte {
+	if v.IsBytes() {
+		return []byte(v[1:])
+	}
+	return []byte(v)
+}
+
+// String returns the text value as is and the binary one hex encoded.
+func (v IndexedValue) String() string {
+	switch {
+	case v.isHash():
+		return "sha224:" + hex.EncodeToString(v.Bytes())
+	case v.IsBytes():
+		return "0x" + hex.EncodeToString(v.Bytes())
+	default:
+		return string(v)
+	}
+}
+
+func (v IndexedValue) isHash() bool {
+	return strings.HasPrefix(string(v), indexedValueHashPrefix)
+}
+
+// fileKey returns the value the index files and the segments know the value by, the hash of the binary one.
+func (v IndexedValue) fileKey() IndexedValue {
+	if v.IsBytes() && !v.isHash() {
+		hash := sha256.Sum224(v.Bytes())
+		return IndexedValue(indexedValueHashPrefix + string(hash[:]))
+	}
+	return v
+}
+
+// IndexedValueAll is the reserved value of every index holding the positions of all its values, the universe
+// of FilterBuilder.Not. The blocks indexed by the versions without it are not in the universe. The index
+// function returning it fails the block with ErrReservedIndexedValue.
+const IndexedValueAll IndexedValue = "_all"
+
 // IndexUpdate is a map of indexed values and their corresponding bitmaps.
+//
+// The bitmaps contain IndexCompoundIDs, so the positions within the block are keyed by the block number and
+// the same value indexed in multiple blocks keeps the positions of each block.
 type IndexUpdate struct {
 	Data         map[IndexedValue]*roaring64.Bitmap
 	LastBlockNum uint64
 }
 
+// Merge merges the update into u. The bitmaps of the same value are united, the values that are only in
+// the update are copied, so u never shares bitmaps with the update. LastBlockNum is the highest of both,
+// merging an older update doesn't move it backwards.
 func (u *IndexUpdate) Merge(update *IndexUpdate) {
+	if update == nil {
+		return
+	}
+
 	for indexValue, bm := range update.Data {
+		if u.Data == nil {
+			u.Data = make(map[IndexedValue]*roaring64.Bitmap)
+		}
 		if _, ok := u.Data[indexValue]; !ok {
 			u.Data[indexValue] = roaring64.New()
 		}
@@ -78,16 +261,37 @@ type Indexes[T any] map[IndexName]Index[T]
 
 // Index is an index struct.
 type Index[T any] struct {
-	name      IndexName
-	indexFunc IndexFunction[T]
+	name           IndexName
+	indexFunc      IndexFunctionWithContext[T]
+	positionFormat PositionFormat
 
 	numBlocksIndexed *atomic.Uint64
+	segments         *indexSegmentCache
 }
 
 func NewIndex[T any](name IndexName, indexFunc IndexFunction[T]) Index[T] {
+	return NewIndexWithPositions(name, OrdinalPositions, indexFunc)
+}
+
+// NewIndexWithContext creates the index of the function receiving the context, see IndexFunctionWithContext.
+func NewIndexWithContext[T any](name IndexName, indexFunc IndexFunctionWithContext[T]) Index[T] {
+	return newIndex(name, OrdinalPositions, indexFunc)
+}
+
+// NewIndexWithPositions creates the index of the positions of the format, e.g. the nested positions of the
+// logs and their topics.
+func NewIndexWithPositions[T any](name IndexName, format PositionFormat, indexFunc IndexFunction[T]) Index[T] {
+	return newIndex(name, format, func(_ context.Context, block Block[T]) (bool, map[IndexedValue][]Position, error) {
+		return indexFunc(block)
+	})
+}
+
+func newIndex[T any](name IndexName, format PositionFormat, indexFunc IndexFunctionWithContext[T]) Index[T] {
 	return Index[T]{
-		name:      name.Normalize(),
-		indexFunc: indexFunc,
+		name:           name.Normalize(),
+		indexFunc:      indexFunc,
+		positionFormat: format,
+		segments:       &indexSegmentCache{},
 	}
 }
 
@@ -95,16 +299,46 @@ func (i *Index[T]) Name() IndexName {
 	return i.name
 }
 
+// PositionFormat returns the format of the positions of the index.
+func (i *Index[T]) PositionFormat() PositionFormat {
+	return i.positionFormat
+}
+
+func (i *Index[T]) newIndexFile(fs storage.FS, indexValue IndexedValue) *IndexFile {
+	return &IndexFile{fs: fs, path: indexPath(string(i.name), string(indexValue)), positionFormat: i.positionFormat.Name}
+}
+
+// checkPositionFormat checks that the positions stored with the format can be read by the index.
+func (i *Index[T]) checkPositionFormat(format string) error {
+	if format != i.positionFormat.Name {
+		return fmt.Errorf("%w: index %s has positions %q, expected %q", ErrPositionFormatMismatch, i.name, format, i.positionFormat.Name)
+	}
+	return nil
+}
+
+// Fetch returns the positions of the value, the union of the sealed segment, the mutable index file and its
+// delta files.
 func (i *Index[T]) Fetch(ctx context.Context, fs storage.FS, indexValue IndexedValue) (*roaring64.Bitmap, error) {
-	file, err := NewIndexFile(fs, i.name, indexValue)
+	return i.fetch(ctx, fs, indexValue, MaxSupportedBlockNum)
+}
+
+// fetch returns the positions of the value, the mutable index file isn't read if all blocks up to
+// toBlockNum are sealed.
+func (i *Index[T]) fetch(ctx context.Context, fs storage.FS, indexValue IndexedValue, toBlockNum uint64) (*roaring64.Bitmap, error) {
+	bmap, sealBlockNum, err := i.fetchSealed(ctx, fs, indexValue)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open IndexBlock file: %w", err)
+		return nil, err
 	}
-	bmap, err := file.Read(ctx)
+	if toBlockNum < sealBlockNum {
+		return bmap, nil
+	}
+
+	mutable, _, err := i.readIndexValue(ctx, fs, indexValue)
 	if err != nil {
 		return nil, err
 	}
 
+	bmap.Or(mutable)
 	return bmap, nil
 }
 
@@ -118,13 +352,16 @@ func (i *Index[T]) IndexBlock(ctx context.Context, fs storage.FS, block Block[T]
 		return nil, nil
 	}
 
-	toIndex, indexValueMap, err := i.indexFunc(block)
+	toIndex, indexValueMap, err := i.indexFunc(ctx, block)
 	if err != nil {
 		return nil, fmt.Errorf("failed to IndexBlock block: %w", err)
 	}
 	if !toIndex {
 		return &IndexUpdate{LastBlockNum: block.Number}, nil
 	}
+	if _, ok := indexValueMap[IndexedValueAll]; ok {
+		return nil, fmt.Errorf("block %d: %w: %s", block.Number, ErrReservedIndexedValue, IndexedValueAll)
+	}
 
 	indexValueCompoundMap := make(map[IndexedValue][]IndexCompoundID)
 	for indexValue, positions := range indexValueMap {
@@ -132,7 +369,7 @@ func (i *Index[T]) IndexBlock(ctx context.Context, fs storage.FS, block Block[T]
 			indexValueCompoundMap[indexValue] = make([]IndexCompoundID, 0)
 		}
 		for _, pos := range positions {
-			indexValueCompoundMap[indexValue] = append(indexValueCompoundMap[indexValue], NewIndexCompoundID(block.Number, pos))
+			indexValueCompoundMap[indexValue] = append(indexValueCompoundMap[indexValue], NewIndexCompoundID(block.Number, pos.Compact()))
 		}
 	}
 
@@ -140,6 +377,7 @@ func (i *Index[T]) IndexBlock(ctx context.Context, fs storage.FS, block Block[T]
 		Data:         make(map[IndexedValue]*roaring64.Bitmap),
 		LastBlockNum: block.Number,
 	}
+	all := roaring64.New()
 	for indexValue, indexIDs := range indexValueCompoundMap {
 		bm, ok := indexUpdate.Data[indexValue]
 		if !ok {
@@ -150,11 +388,27 @@ func (i *Index[T]) IndexBlock(ctx context.Context, fs storage.FS, block Block[T]
 		for _, indexID := range indexIDs {
 			bm.Add(uint64(indexID))
 		}
+		all.Or(bm)
+	}
+
+	// the universe of the index, the positions of all values
+	if !all.IsEmpty() {
+		indexUpdate.Data[IndexedValueAll] = all
 	}
 	return indexUpdate, nil
 }
 
+// Store merges the bitmaps of the update into the index files of the values, up to 8 files are written
+// concurrently, and then stores the last block number indexed. The failures of the values are returned as
+// IndexStoreError once all values are written, the last block number indexed isn't stored then.
 func (i *Index[T]) Store(ctx context.Context, fs storage.FS, indexUpdate *IndexUpdate) error {
+	return i.store(ctx, fs, indexUpdate, make(chan struct{}, defaultMaxStoreConcurrency), 0)
+}
+
+// store is Store writing the index files concurrently up to the capacity of the semaphore, it's shared by the
+// indexes flushed together. If maxDeltas is set the bitmaps are written to the delta files of the values, see
+// IndexerOptions.MaxIndexDeltas.
+func (i *Index[T]) store(ctx context.Context, fs storage.FS, indexUpdate *IndexUpdate, sem chan struct{}, maxDeltas int) error {
 	lastBlockNumIndexed, err := i.LastBlockNumIndexed(ctx, fs)
 	if err != nil {
 		return fmt.Errorf("failed to get number of blocks indexed: %w", err)
@@ -163,27 +417,47 @@ func (i *Index[T]) Store(ctx context.Context, fs storage.FS, indexUpdate *IndexU
 		return nil
 	}
 
+	var (
+		mu     sync.Mutex
+		stored []IndexedValue
+		failed = make(map[IndexedValue]error)
+	)
+
+	// the values are written to distinct index files, the failed values don't stop the others
+	var errGrp errgroup.Group
 	for indexValue, bmUpdate := range indexUpdate.Data {
 		if bmUpdate.IsEmpty() {
 			continue
 		}
 
-		file, err := NewIndexFile(fs, i.name, indexValue)
-		if err != nil {
-			return fmt.Errorf("failed to open or create IndexBlock file: %w", err)
-		}
-
-		bmap, err := file.Read(ctx)
-		if err != nil {
-			return err
-		}
-
-		bmap.Or(bmUpdate)
+		sem <- struct{}{}
+		errGrp.Go(func() error {
+			defer func() { <-sem }()
+
+			err := ctx.Err()
+			if err == nil && maxDeltas > 0 {
+				err = i.storeValueDelta(ctx, fs, indexValue, bmUpdate, maxDeltas)
+			} else if err == nil {
+				err = i.storeValue(ctx, fs, indexValue, bmUpdate)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed[indexValue] = err
+			} else {
+				stored = append(stored, indexValue)
+			}
+			return nil
+		})
+	}
+	_ = errGrp.Wait()
 
-		err = file.Write(ctx, bmap)
-		if err != nil {
-			return err
-		}
+	for _, indexValue := range stored {
+		delete(indexUpdate.Data, indexValue)
+	}
+	if len(failed) > 0 {
+		return &IndexStoreError{Index: i.name, Values: failed}
 	}
 
 	err = i.storeLastBlockNumIndexed(ctx, fs, indexUpdate.LastBlockNum)
@@ -194,11 +468,52 @@ func (i *Index[T]) Store(ctx context.Context, fs storage.FS, indexUpdate *IndexU
 	return nil
 }
 
+// storeValue merges the bitmap into the index file of the value.
+func (i *Index[T]) storeValue(ctx context.Context, fs storage.FS, indexValue IndexedValue, bmUpdate *roaring64.Bitmap) error {
+	file := i.newIndexFile(fs, indexValue)
+	bmap, err := i.readIndexFile(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	bmap.Or(bmUpdate)
+	return file.Write(ctx, bmap)
+}
+
+// readIndexFile reads the bitmap of the index file written with the position format of the index.
+func (i *Index[T]) readIndexFile(ctx context.Context, file *IndexFile) (*roaring64.Bitmap, error) {
+	bmap, metadata, err := file.read(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	// the missing file has no format
+	if bmap.IsEmpty() {
+		return bmap, nil
+	}
+	if err := i.checkPositionFormat(metadata.PositionFormat); err != nil {
+		return nil, err
+	}
+	return bmap, nil
+}
+
 func (i *Index[T]) LastBlockNumIndexed(ctx context.Context, fs storage.FS) (uint64, error) {
 	if i.numBlocksIndexed != nil {
 		return i.numBlocksIndexed.Load(), nil
 	}
 
+	numBlocksIndexed, err := i.readLastBlockNumIndexed(ctx, fs)
+	if err != nil {
+		return 0, err
+	}
+
+	i.numBlocksIndexed = &atomic.Uint64{}
+	i.numBlocksIndexed.Store(numBlocksIndexed)
+
+	return numBlocksIndexed, nil
+}
+
+// readLastBlockNumIndexed reads the last block number indexed from the storage, bypassing the cached value.
+func (i *Index[T]) readLastBlockNumIndexed(ctx context.Context, fs storage.FS) (uint64, error) {
 	file, err := fs.Open(ctx, indexedBlockNumFilePath(string(i.name)), nil)
 	if err != nil {
 		// file doesn't exist
@@ -216,10 +531,6 @@ func (i *Index[T]) LastBlockNumIndexed(ctx context.Context, fs storage.FS) (uint
 	if err != nil {
 		return 0, fmt.Errorf("failed to unmarshal bitmap: %w", err)
 	}
-
-	i.numBlocksIndexed = &atomic.Uint64{}
-	i.numBlocksIndexed.Store(numBlocksIndexed)
-
 	return numBlocksIndexed, nil
 }
 
@@ -234,25 +545,77 @@ func (i *Index[T]) storeLastBlockNumIndexed(ctx context.Context, fs storage.FS,
 		return nil
 	}
 
-	file, err := fs.Create(ctx, indexedBlockNumFilePath(string(i.name)), nil)
+	// the marker only moves forward, even if another indexer stores it concurrently
+	stored := numBlocksIndexed
+	err = storage.Update(ctx, fs, indexedBlockNumFilePath(string(i.name)), func(data []byte) ([]byte, error) {
+		if len(data) == 8 && binary.BigEndian.Uint64(data) >= numBlocksIndexed {
+			stored = binary.BigEndian.Uint64(data)
+			return nil, nil
+		}
+		stored = numBlocksIndexed
+		return binary.BigEndian.AppendUint64(nil, numBlocksIndexed), nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to open IndexBlock file: %w", err)
+		return fmt.Errorf("failed to write IndexBlock file: %w", err)
+	}
+
+	if i.numBlocksIndexed == nil {
+		i.numBlocksIndexed = &atomic.Uint64{}
 	}
+	i.numBlocksIndexed.Store(stored)
+	return nil
+}
 
-	err = binary.Write(file, binary.BigEndian, numBlocksIndexed)
+// Prune removes all positions of blocks lower than beforeBlockNum from the mutable index files. The index
+// files that become empty are deleted. The sealed positions are kept, the filters clamp them to the
+// retention floor.
+func (i *Index[T]) Prune(ctx context.Context, fs storage.FS, beforeBlockNum uint64) error {
+	// the delta files are merged into the index files trimmed below
+	err := i.compactAll(ctx, fs)
 	if err != nil {
-		return fmt.Errorf("failed to write IndexBlock file: %w", err)
+		return err
 	}
 
-	err = file.Close()
+	files, err := i.indexFiles(ctx, fs)
 	if err != nil {
-		return fmt.Errorf("failed to close IndexBlock file: %w", err)
+		return err
 	}
+	return i.trimIndexFiles(ctx, fs, files, trimBefore(beforeBlockNum))
+}
 
-	if i.numBlocksIndexed == nil {
-		i.numBlocksIndexed = &atomic.Uint64{}
+// IndexRetentionFloor returns the block number below which the indexes were pruned.
+func IndexRetentionFloor(ctx context.Context, fs storage.FS) (uint64, error) {
+	file, err := fs.Open(ctx, indexRetentionFilePath, nil)
+	if err != nil {
+		// file doesn't exist
+		return 0, nil
+	}
+	defer file.Close()
+
+	var retentionFloor uint64
+	err = binary.Read(file, binary.BigEndian, &retentionFloor)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read retention floor: %w", err)
+	}
+	return retentionFloor, nil
+}
+
+func storeIndexRetentionFloor(ctx context.Context, fs storage.FS, retentionFloor uint64) error {
+	file, err := fs.Create(ctx, indexRetentionFilePath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to open retention floor file: %w", err)
+	}
+
+	err = binary.Write(file, binary.BigEndian, retentionFloor)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write retention floor file: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close retention floor file: %w", err)
 	}
-	i.numBlocksIndexed.Store(numBlocksIndexed)
 	return nil
 }
 
@@ -260,13 +623,26 @@ func indexedBlockNumFilePath(index string) string {
 	return fmt.Sprintf("%s/%s", index, "indexed")
 }
 
+// indexPath returns the path of the index file of the value. The text value names its file, the binary one,
+// see IndexedValueBytes, is named by the hex of the hash of its bytes.
 func indexPath(index string, indexValue string) string {
-	hash := sha256.Sum224([]byte(indexValue))
+	var (
+		hash [sha256.Size224]byte
+		name = indexValue
+	)
+	switch value := IndexedValue(indexValue).fileKey(); {
+	case value.isHash():
+		copy(hash[:], value.Bytes())
+		name = hex.EncodeToString(hash[:])
+	default:
+		hash = sha256.Sum224([]byte(indexValue))
+	}
+
 	return fmt.Sprintf("%s/%06d/%06d/%06d/%s",
 		index,
 		binary.BigEndian.Uint64(hash[0:8])%NumberOfDirectoriesPerLevel,   // level0
 		binary.BigEndian.Uint64(hash[8:16])%NumberOfDirectoriesPerLevel,  // level1
 		binary.BigEndian.Uint64(hash[16:24])%NumberOfDirectoriesPerLevel, // level2
-		fmt.Sprintf("%s.idx", indexValue),                                // filename
+		fmt.Sprintf("%s.idx", name),                                      // filename
 	)
 }
@@ -0,0 +1,190 @@
+package ethwal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+)
+
+// The delta files of the index file store the positions of the value added by the flushes since the index
+// file was last written, so that the flush of the hot value doesn't rewrite its whole index file:
+//
+//	-- .indexes
+//		|-- topic0
+//		|   |-- 000563
+//		|   |   |-- 000256
+//		|   |   |   |-- 000124
+//		|   |   |   |   |-- 0xddf2.idx       <- index file
+//		|   |   |   |   |-- 0xddf2.idx.00001 <- delta file
+//		|   |   |   |   |-- 0xddf2.idx.00002 <- delta file
+//
+// The delta files have the format of the index file. The positions of the value are the union of the index
+// file and its delta files, Index.Compact merges the delta files into the index file.
+
+// indexDeltaPath returns the path of the delta file of the index file.
+func indexDeltaPath(indexFilePath string, delta int) string {
+	return fmt.Sprintf("%s.%05d", indexFilePath, delta)
+}
+
+// indexDeltaBase returns the path of the index file of the delta file path and the delta number.
+func indexDeltaBase(objectPath string) (string, int, bool) {
+	base, suffix := path.Base(objectPath), path.Ext(objectPath)
+	if len(suffix) != 6 || !strings.HasSuffix(strings.TrimSuffix(base, suffix), ".idx") {
+		return "", 0, false
+	}
+
+	delta, err := strconv.Atoi(suffix[1:])
+	if err != nil || delta <= 0 {
+		return "", 0, false
+	}
+	return strings.TrimSuffix(objectPath, suffix), delta, true
+}
+
+// isIndexObject reports whether the object is the index file or its delta file.
+func isIndexObject(objectPath string) bool {
+	_, _, isDelta := indexDeltaBase(objectPath)
+	return isDelta || strings.HasSuffix(objectPath, ".idx")
+}
+
+// indexDeltas returns the delta numbers of the index file in the ascending order, the file systems that
+// don't list objects have no delta files.
+func indexDeltas(ctx context.Context, fs storage.FS, indexFilePath string) ([]int, error) {
+	var deltas []int
+	err := fs.Walk(ctx, path.Dir(indexFilePath)+"/", func(objectPath string) error {
+		if base, delta, ok := indexDeltaBase(objectPath); ok && base == indexFilePath {
+			deltas = append(deltas, delta)
+		}
+		return nil
+	})
+	if errors.Is(err, storage.ErrNotImplemented) {
+		return nil, nil
+	}
+	if err != nil && !storage.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list index delta files: %w", err)
+	}
+
+	slices.Sort(deltas)
+	return deltas, nil
+}
+
+// readIndexValue reads the positions of the value from the index file and its delta files, it returns the
+// delta numbers read.
+func (i *Index[T]) readIndexValue(ctx context.Context, fs storage.FS, indexValue IndexedValue) (*roaring64.Bitmap, []int, error) {
+	file := i.newIndexFile(fs, indexValue)
+	bmap, err := i.readIndexFile(ctx, file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deltas, err := indexDeltas(ctx, fs, file.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, delta := range deltas {
+		deltaBmap, err := i.readIndexFile(ctx, &IndexFile{fs: fs, path: indexDeltaPath(file.path, delta), positionFormat: i.positionFormat.Name})
+		if err != nil {
+			return nil, nil, err
+		}
+		bmap.Or(deltaBmap)
+	}
+	return bmap, deltas, nil
+}
+
+// storeValueDelta writes the bitmap to the next delta file of the value, the delta files are compacted
+// once there are more than maxDeltas.
+func (i *Index[T]) storeValueDelta(ctx context.Context, fs storage.FS, indexValue IndexedValue, bmUpdate *roaring64.Bitmap, maxDeltas int) error {
+	file := i.newIndexFile(fs, indexValue)
+	deltas, err := indexDeltas(ctx, fs, file.path)
+	if err != nil {
+		return err
+	}
+
+	next := 1
+	if len(deltas) > 0 {
+		next = deltas[len(deltas)-1] + 1
+	}
+
+	err = (&IndexFile{fs: fs, path: indexDeltaPath(file.path, next), positionFormat: i.positionFormat.Name}).Write(ctx, bmUpdate)
+	if err != nil {
+		return err
+	}
+
+	if len(deltas)+1 > maxDeltas {
+		return i.Compact(ctx, fs, indexValue)
+	}
+	return nil
+}
+
+// Compact merges the delta files of the value into its index file and deletes them. The index file is
+// written before the delta files are deleted, so the interrupted compaction loses no positions.
+func (i *Index[T]) Compact(ctx context.Context, fs storage.FS, indexValue IndexedValue) error {
+	bmap, deltas, err := i.readIndexValue(ctx, fs, indexValue)
+	if err != nil {
+		return err
+	}
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	file := i.newIndexFile(fs, indexValue)
+	err = file.Write(ctx, bmap)
+	if err != nil {
+		return err
+	}
+
+	for _, delta := range deltas {
+		err = fs.Delete(ctx, indexDeltaPath(file.path, delta))
+		if err != nil && !storage.IsNotExist(err) {
+			return fmt.Errorf("failed to delete index delta file: %w", err)
+		}
+	}
+	return nil
+}
+
+// compactAll compacts the delta files of all values of the index.
+func (i *Index[T]) compactAll(ctx context.Context, fs storage.FS) error {
+	values := make(map[IndexedValue]struct{})
+	err := fs.Walk(ctx, fmt.Sprintf("%s/", i.name), func(objectPath string) error {
+		base, _, ok := indexDeltaBase(objectPath)
+		if !ok {
+			return nil
+		}
+		if value, ok := indexFileValue(i.name, base); ok {
+			values[value] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil && !storage.IsNotExist(err) {
+		return fmt.Errorf("failed to list index delta files: %w", err)
+	}
+
+	for value := range values {
+		err = i.Compact(ctx, fs, value)
+		if err != nil {
+			return fmt.Errorf("failed to compact index %s value %s: %w", i.name, value, err)
+		}
+	}
+	return nil
+}
+
+// Compact merges the delta files of all indexes into their index files, see IndexerOptions.MaxIndexDeltas.
+// The pending updates aren't flushed.
+func (i *Indexer[T]) Compact(ctx context.Context) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, idx := range i.indexes {
+		err := idx.compactAll(ctx, i.fs)
+		if err != nil {
+			return i.instance.wrapError(fmt.Errorf("Indexer.Compact: %w", err))
+		}
+	}
+	return nil
+}
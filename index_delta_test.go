@@ -0,0 +1,170 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexDeltaBase(t *testing.T) {
+	base, delta, ok := indexDeltaBase("values/000001/000002/000003/13.idx.00012")
+	require.True(t, ok)
+	require.Equal(t, "values/000001/000002/000003/13.idx", base)
+	require.Equal(t, 12, delta)
+
+	for _, objectPath := range []string{
+		"values/000001/000002/000003/13.idx",
+		"values/000001/000002/000003/13.idx.tmp",
+		"values/000001/000002/000003/13.idx.00000",
+		"values/000001/000002/000003/13.idx.123",
+		"values/000001/000002/000003/13.00001",
+		"values/indexed",
+	} {
+		_, _, ok := indexDeltaBase(objectPath)
+		require.False(t, ok, objectPath)
+	}
+	require.True(t, isIndexObject("values/000001/000002/000003/13.idx"))
+	require.True(t, isIndexObject("values/000001/000002/000003/13.idx.00001"))
+	require.False(t, isIndexObject("values/indexed"))
+}
+
+func TestIndex_Deltas(t *testing.T) {
+	fs := gostorage.NewMemoryFS()
+	idx := NewIndex[[]int]("values", nil)
+
+	// update returns the update of the value positions of the blocks
+	update := func(from, to uint64) *IndexUpdate {
+		bmap := roaring64.New()
+		for blockNum := from; blockNum <= to; blockNum++ {
+			bmap.Add(uint64(NewIndexCompoundID(blockNum, 0)))
+		}
+		return &IndexUpdate{Data: map[IndexedValue]*roaring64.Bitmap{"13": bmap}, LastBlockNum: to}
+	}
+	deltas := func() []int {
+		deltas, err := indexDeltas(context.Background(), fs, idx.newIndexFile(fs, "13").path)
+		require.NoError(t, err)
+		return deltas
+	}
+	fetch := func(toBlockNum uint64) {
+		t.Helper()
+
+		bmap, err := idx.Fetch(context.Background(), fs, "13")
+		require.NoError(t, err)
+		require.Equal(t, uint64(toBlockNum), bmap.GetCardinality())
+		require.Equal(t, uint64(NewIndexCompoundID(toBlockNum, 0)), bmap.Maximum())
+	}
+
+	// the index file written without the delta files
+	require.NoError(t, idx.store(context.Background(), fs, update(1, 10), make(chan struct{}, 1), 0))
+	require.Empty(t, deltas())
+	fetch(10)
+
+	// the index file and the delta files
+	for i := uint64(1); i <= 4; i++ {
+		require.NoError(t, idx.store(context.Background(), fs, update(i*10+1, i*10+10), make(chan struct{}, 1), 5))
+		require.Len(t, deltas(), int(i))
+		fetch(i*10 + 10)
+	}
+	require.Equal(t, []int{1, 2, 3, 4}, deltas())
+
+	// the base index file isn't rewritten by the delta flushes
+	base, err := idx.newIndexFile(fs, "13").Metadata(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), base.MaxBlockNum)
+
+	// the compaction merges the delta files into the index file
+	require.NoError(t, idx.Compact(context.Background(), fs, "13"))
+	require.Empty(t, deltas())
+	fetch(50)
+
+	// the value with more delta files than the limit is compacted by the flush
+	for i := uint64(5); i <= 7; i++ {
+		require.NoError(t, idx.store(context.Background(), fs, update(i*10+1, i*10+10), make(chan struct{}, 1), 2))
+	}
+	require.Empty(t, deltas())
+	fetch(80)
+
+	// the seal and the prune merge the delta files first
+	require.NoError(t, idx.store(context.Background(), fs, update(81, 90), make(chan struct{}, 1), 5))
+	require.NoError(t, idx.store(context.Background(), fs, update(91, 100), make(chan struct{}, 1), 5))
+	require.Len(t, deltas(), 2)
+	require.NoError(t, idx.Seal(context.Background(), fs, 51))
+	require.Empty(t, deltas())
+	fetch(100)
+
+	require.NoError(t, idx.store(context.Background(), fs, update(101, 110), make(chan struct{}, 1), 5))
+	require.NoError(t, idx.Prune(context.Background(), fs, 96))
+	require.Empty(t, deltas())
+	mutable, err := idx.newIndexFile(fs, "13").Read(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, uint64(NewIndexCompoundID(96, 0)), mutable.Minimum())
+	require.Equal(t, uint64(NewIndexCompoundID(110, 0)), mutable.Maximum())
+}
+
+func TestIndexer_MaxIndexDeltas(t *testing.T) {
+	fs := gostorage.NewMemoryFS()
+	opt := IndexerOptions[[]int]{
+		Dataset:        Dataset{Path: "ethwal"},
+		FileSystem:     fs,
+		Indexes:        generateMixedIntIndexes(),
+		MaxIndexDeltas: 3,
+	}
+	indexFs := storage.NewPrefixWrapper(fs, fmt.Sprintf("%s/", path.Join(opt.Dataset.FullPath(), IndexesDirectory)))
+
+	// the same blocks indexed by the indexer rewriting the index files
+	expectedOpt := opt
+	expectedOpt.Dataset.Path = "expected"
+	expectedOpt.MaxIndexDeltas = 0
+	expectedFs := storage.NewPrefixWrapper(fs, fmt.Sprintf("%s/", path.Join(expectedOpt.Dataset.FullPath(), IndexesDirectory)))
+
+	countDeltas := func() int {
+		var n int
+		require.NoError(t, fs.Walk(context.Background(), opt.Dataset.FullPath(), func(objectPath string) error {
+			if _, _, ok := indexDeltaBase(objectPath); ok {
+				n++
+			}
+			return nil
+		}))
+		return n
+	}
+
+	indexer, err := NewIndexer(context.Background(), opt)
+	require.NoError(t, err)
+	expectedIndexer, err := NewIndexer(context.Background(), expectedOpt)
+	require.NoError(t, err)
+	for _, block := range generateMixedIntBlocks() {
+		require.NoError(t, indexer.Index(context.Background(), block))
+		require.NoError(t, indexer.Flush(context.Background()))
+		require.NoError(t, expectedIndexer.Index(context.Background(), block))
+		require.NoError(t, expectedIndexer.Flush(context.Background()))
+	}
+	require.NoError(t, expectedIndexer.Close(context.Background()))
+
+	fetchAll := func() {
+		t.Helper()
+
+		for name, idx := range opt.Indexes {
+			for _, value := range []IndexedValue{"true", "false", "even", "odd", "1", "2", "13", "100"} {
+				expected, err := idx.Fetch(context.Background(), expectedFs, value)
+				require.NoError(t, err)
+				bmap, err := idx.Fetch(context.Background(), indexFs, value)
+				require.NoError(t, err)
+				require.Equal(t, expected.ToArray(), bmap.ToArray(), "%s/%s", name, value)
+			}
+		}
+	}
+
+	require.Greater(t, countDeltas(), 0)
+	fetchAll()
+
+	require.NoError(t, indexer.Compact(context.Background()))
+	require.Zero(t, countDeltas())
+	fetchAll()
+	require.NoError(t, indexer.Close(context.Background()))
+}
@@ -1,7 +1,9 @@
 package ethwal
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 
@@ -12,6 +14,8 @@ import (
 type IndexFile struct {
 	fs   storage.FS
 	path string
+	// positionFormat is the name of the position format stored with the bitmap, see PositionFormat
+	positionFormat string
 }
 
 func NewIndexFile(fs storage.FS, indexName IndexName, value IndexedValue) (*IndexFile, error) {
@@ -19,43 +23,148 @@ func NewIndexFile(fs storage.FS, indexName IndexName, value IndexedValue) (*Inde
 	return &IndexFile{fs: fs, path: path}, nil
 }
 
+// IndexFileMetadata is the metadata stored in the index file header.
+type IndexFileMetadata struct {
+	// Cardinality is the number of positions in the bitmap.
+	Cardinality uint64 `cbor:"0,keyasint"`
+	// MaxBlockNum is the highest block number in the bitmap.
+	MaxBlockNum uint64 `cbor:"1,keyasint"`
+	// PositionFormat is the name of the format of the positions, empty for the ordinal positions.
+	PositionFormat string `cbor:"2,keyasint,omitempty"`
+}
+
+func newIndexFileMetadata(bmap *roaring64.Bitmap, positionFormat string) IndexFileMetadata {
+	metadata := IndexFileMetadata{PositionFormat: positionFormat}
+	if !bmap.IsEmpty() {
+		metadata.Cardinality = bmap.GetCardinality()
+		metadata.MaxBlockNum = IndexCompoundID(bmap.Maximum()).BlockNumber()
+	}
+	return metadata
+}
+
 func (i *IndexFile) Read(ctx context.Context) (*roaring64.Bitmap, error) {
+	bmap, _, err := i.read(ctx, true)
+	return bmap, err
+}
+
+// Metadata returns the index file metadata without reading the bitmap if possible.
+func (i *IndexFile) Metadata(ctx context.Context) (IndexFileMetadata, error) {
+	_, metadata, err := i.read(ctx, false)
+	return metadata, err
+}
+
+func (i *IndexFile) read(ctx context.Context, withBitmap bool) (*roaring64.Bitmap, IndexFileMetadata, error) {
 	file, err := i.fs.Open(ctx, i.path, nil)
 	if err != nil {
 		// TODO: decide if we should report an error or just create a new roaring bitmap...
 		// with this approach we are not reporting an error if the file does not exist
 		// and we just write the new bitmap when write is called...
 		// return nil, fmt.Errorf("failed to open IndexBlock file: %w", err)
-		return roaring64.New(), nil
+		return roaring64.New(), IndexFileMetadata{}, nil
 	}
 	defer file.Close()
 
-	decomp := NewZSTDDecompressor(file)
-	defer decomp.Close()
-
-	buf, err := io.ReadAll(decomp)
+	container, err := openContainer(file)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read IndexBlock file: %w", err)
+		return nil, IndexFileMetadata{}, fmt.Errorf("failed to open IndexBlock file: %w", err)
 	}
-	bmap := roaring64.New()
-	err = bmap.UnmarshalBinary(buf)
+	defer container.Close()
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal bitmap: %w", err)
+	// legacy index file without header
+	if container.Version == 0 {
+		bmap, err := unmarshalBitmap(container.Legacy())
+		if err != nil {
+			return nil, IndexFileMetadata{}, err
+		}
+		return bmap, newIndexFileMetadata(bmap, ""), nil
 	}
-	return bmap, nil
+
+	var bmap *roaring64.Bitmap
+	var metadata IndexFileMetadata
+	for {
+		sectionType, section, err := container.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, IndexFileMetadata{}, fmt.Errorf("failed to read IndexBlock file: %w", err)
+		}
+
+		switch sectionType {
+		case containerSectionMetadata:
+			err = NewCBORDecoder(section).Decode(&metadata)
+			if err != nil {
+				return nil, IndexFileMetadata{}, fmt.Errorf("failed to decode IndexBlock metadata: %w", err)
+			}
+			if !withBitmap {
+				return nil, metadata, nil
+			}
+		case containerSectionBitmap:
+			bmap, err = unmarshalBitmap(section)
+			if err != nil {
+				return nil, IndexFileMetadata{}, err
+			}
+		}
+	}
+
+	if bmap == nil {
+		return nil, IndexFileMetadata{}, fmt.Errorf("failed to read IndexBlock file: bitmap section missing")
+	}
+	return bmap, metadata, nil
 }
 
 func (i *IndexFile) Write(ctx context.Context, bmap *roaring64.Bitmap) error {
+	var metadata bytes.Buffer
+	err := NewCBOREncoder(&metadata).Encode(newIndexFileMetadata(bmap, i.positionFormat))
+	if err != nil {
+		return fmt.Errorf("failed to encode IndexBlock metadata: %w", err)
+	}
+
+	data, err := bmap.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to marshal bitmap: %w", err)
+	}
+
 	file, err := i.fs.Create(ctx, i.path, nil)
 	if err != nil {
 		return fmt.Errorf("failed to open IndexBlock file: %w", err)
 	}
-	defer file.Close()
 
-	comp := NewZSTDCompressor(file)
-	defer comp.Close()
+	// the files of the typed positions are marked, the ordinal position files are unchanged
+	flags := containerFlagCompressed
+	if i.positionFormat != "" {
+		flags |= containerFlagPositional
+	}
+
+	err = writeContainer(file, flags,
+		containerSection{Type: containerSectionMetadata, Data: metadata.Bytes()},
+		containerSection{Type: containerSectionBitmap, Data: data},
+	)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write IndexBlock file: %w", err)
+	}
+	return file.Close()
+}
 
-	_, err = bmap.WriteTo(comp)
-	return err
+func unmarshalBitmap(r io.Reader) (*roaring64.Bitmap, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IndexBlock file: %w", err)
+	}
+
+	bmap := roaring64.New()
+	err = bmap.UnmarshalBinary(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal bitmap: %w", err)
+	}
+	return bmap, nil
+}
+
+func (i *IndexFile) Delete(ctx context.Context) error {
+	err := i.fs.Delete(ctx, i.path)
+	if err != nil && !storage.IsNotExist(err) {
+		return fmt.Errorf("failed to delete IndexBlock file: %w", err)
+	}
+	return nil
 }
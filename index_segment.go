@@ -0,0 +1,518 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+)
+
+// The sealed index data, the positions of the blocks lower than the seal point, is stored in one immutable
+// segment per index with the bitmaps of all values followed by the value dictionary. The seal file of the
+// index points to the current segment and its dictionary, the newer positions are stored in the mutable
+// index files.
+const (
+	indexSealFileName        = "sealed"
+	indexSegmentsDirectory   = "segments"
+	indexSegmentMagic        = "EWIS"
+	indexSegmentVersion      = 1
+	indexSealRefreshInterval = time.Minute
+)
+
+// maxCachedIndexSegmentSize is the size of the segments that are read and cached whole, the values of
+// larger segments are read with ranged reads.
+var maxCachedIndexSegmentSize int64 = 1 << 20
+
+var (
+	ErrIndexSegmentInvalid = fmt.Errorf("index segment is invalid")
+)
+
+// indexSeal is the seal point of the index and its segment.
+type indexSeal struct {
+	// BlockNum is the seal point, the positions of the blocks lower than BlockNum are in the segment.
+	BlockNum uint64 `cbor:"0,keyasint"`
+	// PrevBlockNum is the seal point of the previous compaction, the mutable index files still store the
+	// positions between the previous and the current seal point.
+	PrevBlockNum uint64 `cbor:"1,keyasint"`
+	Segment      string `cbor:"2,keyasint"`
+	Size         int64  `cbor:"3,keyasint"`
+	DictOffset   int64  `cbor:"4,keyasint"`
+	DictLength   int64  `cbor:"5,keyasint"`
+	// PositionFormat is the name of the format of the sealed positions, see PositionFormat.
+	PositionFormat string `cbor:"6,keyasint,omitempty"`
+}
+
+// indexSegmentEntry is the position of the value bitmap in the segment.
+type indexSegmentEntry struct {
+	Offset int64 `cbor:"0,keyasint"`
+	Length int64 `cbor:"1,keyasint"`
+}
+
+func indexSealFilePath(index string) string {
+	return fmt.Sprintf("%s/%s", index, indexSealFileName)
+}
+
+func indexSegmentPath(index string, sealBlockNum uint64) string {
+	return fmt.Sprintf("%s/%s/%020d.seg", index, indexSegmentsDirectory, sealBlockNum)
+}
+
+// readIndexSeal returns the seal of the index, or nil if the index isn't sealed.
+func readIndexSeal(ctx context.Context, fs storage.FS, index IndexName) (*indexSeal, error) {
+	file, err := fs.Open(ctx, indexSealFilePath(string(index)), nil)
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open index seal: %w", err)
+	}
+	defer file.Close()
+
+	var seal indexSeal
+	err = NewCBORDecoder(file).Decode(&seal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode index seal: %w", err)
+	}
+	return &seal, nil
+}
+
+func writeIndexSeal(ctx context.Context, fs storage.FS, index IndexName, seal indexSeal) error {
+	file, err := fs.Create(ctx, indexSealFilePath(string(index)), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create index seal: %w", err)
+	}
+
+	err = NewCBOREncoder(file).Encode(seal)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to encode index seal: %w", err)
+	}
+	return file.Close()
+}
+
+// indexSegment is the opened segment with the loaded dictionary.
+type indexSegment struct {
+	seal indexSeal
+	dict map[IndexedValue]indexSegmentEntry
+	// data is the whole segment if it isn't larger than maxCachedIndexSegmentSize
+	data []byte
+}
+
+// openIndexSegment reads the dictionary of the segment, the whole segment is read if it's small enough
+// or if all is set.
+func openIndexSegment(ctx context.Context, fs storage.FS, seal indexSeal, all bool) (*indexSegment, error) {
+	segment := &indexSegment{seal: seal}
+
+	var dict []byte
+	if all || seal.Size <= maxCachedIndexSegmentSize {
+		file, err := fs.Open(ctx, seal.Segment, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		segment.data, err = io.ReadAll(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index segment: %w", err)
+		}
+		if int64(len(segment.data)) != seal.Size || !bytes.HasPrefix(segment.data, []byte(indexSegmentMagic)) {
+			return nil, fmt.Errorf("%w: %s", ErrIndexSegmentInvalid, seal.Segment)
+		}
+		if seal.DictOffset+seal.DictLength > seal.Size {
+			return nil, fmt.Errorf("%w: %s: dictionary out of range", ErrIndexSegmentInvalid, seal.Segment)
+		}
+		dict = segment.data[seal.DictOffset : seal.DictOffset+seal.DictLength]
+	} else {
+		var err error
+		dict, err = readIndexSegmentRange(ctx, fs, seal.Segment, seal.DictOffset, seal.DictLength)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := newIndexValueDecoder(bytes.NewReader(dict)).Decode(&segment.dict)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: failed to decode dictionary: %v", ErrIndexSegmentInvalid, seal.Segment, err)
+	}
+	return segment, nil
+}
+
+func readIndexSegmentRange(ctx context.Context, fs storage.FS, segmentPath string, offset, length int64) ([]byte, error) {
+	r, err := storage.OpenRange(ctx, fs, segmentPath, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index segment: %w", err)
+	}
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("%w: %s: range %d+%d is truncated", ErrIndexSegmentInvalid, segmentPath, offset, length)
+	}
+	return data, nil
+}
+
+// read returns the sealed positions of the value.
+func (s *indexSegment) read(ctx context.Context, fs storage.FS, value IndexedValue) (*roaring64.Bitmap, error) {
+	entry, ok := s.dict[value.fileKey()]
+	if !ok {
+		return roaring64.New(), nil
+	}
+
+	var data []byte
+	if s.data != nil {
+		if entry.Offset+entry.Length > int64(len(s.data)) {
+			return nil, fmt.Errorf("%w: %s: value %s out of range", ErrIndexSegmentInvalid, s.seal.Segment, value)
+		}
+		data = s.data[entry.Offset : entry.Offset+entry.Length]
+	} else {
+		var err error
+		data, err = readIndexSegmentRange(ctx, fs, s.seal.Segment, entry.Offset, entry.Length)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return unmarshalBitmap(bytes.NewReader(data))
+}
+
+// writeIndexSegment writes the segment of the bitmaps and returns its seal.
+func writeIndexSegment(ctx context.Context, fs storage.FS, index IndexName, sealBlockNum uint64, bitmaps map[IndexedValue]*roaring64.Bitmap) (indexSeal, error) {
+	values := make([]IndexedValue, 0, len(bitmaps))
+	for value := range bitmaps {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	var buf bytes.Buffer
+	buf.WriteString(indexSegmentMagic)
+	buf.WriteByte(indexSegmentVersion)
+
+	dict := make(map[IndexedValue]indexSegmentEntry, len(values))
+	for _, value := range values {
+		data, err := bitmaps[value].MarshalBinary()
+		if err != nil {
+			return indexSeal{}, fmt.Errorf("failed to marshal bitmap: %w", err)
+		}
+		dict[value.fileKey()] = indexSegmentEntry{Offset: int64(buf.Len()), Length: int64(len(data))}
+		buf.Write(data)
+	}
+
+	seal := indexSeal{BlockNum: sealBlockNum, Segment: indexSegmentPath(string(index), sealBlockNum), DictOffset: int64(buf.Len())}
+	err := NewCBOREncoder(&buf).Encode(dict)
+	if err != nil {
+		return indexSeal{}, fmt.Errorf("failed to encode index segment dictionary: %w", err)
+	}
+	seal.Size = int64(buf.Len())
+	seal.DictLength = seal.Size - seal.DictOffset
+
+	file, err := fs.Create(ctx, seal.Segment, nil)
+	if err != nil {
+		return indexSeal{}, fmt.Errorf("failed to create index segment: %w", err)
+	}
+	_, err = file.Write(buf.Bytes())
+	if err != nil {
+		_ = file.Close()
+		return indexSeal{}, fmt.Errorf("failed to write index segment: %w", err)
+	}
+	err = file.Close()
+	if err != nil {
+		return indexSeal{}, fmt.Errorf("failed to write index segment: %w", err)
+	}
+	return seal, nil
+}
+
+// indexSegmentCache caches the segment of the index, it's shared by all copies of the index. The seal is
+// re-read after indexSealRefreshInterval or once the cached segment is compacted away.
+type indexSegmentCache struct {
+	mu       sync.Mutex
+	segment  *indexSegment
+	loadedAt time.Time
+}
+
+func (c *indexSegmentCache) load(ctx context.Context, fs storage.FS, index IndexName, reload bool) (*indexSegment, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !reload && !c.loadedAt.IsZero() && time.Since(c.loadedAt) < indexSealRefreshInterval {
+		return c.segment, nil
+	}
+
+	seal, err := readIndexSeal(ctx, fs, index)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case seal == nil:
+		c.segment = nil
+	case c.segment == nil || c.segment.seal != *seal:
+		segment, err := openIndexSegment(ctx, fs, *seal, false)
+		if err != nil {
+			return nil, err
+		}
+		c.segment = segment
+	}
+	c.loadedAt = time.Now()
+	return c.segment, nil
+}
+
+func (c *indexSegmentCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loadedAt = time.Time{}
+}
+
+// fetchSealed returns the sealed positions of the value and the seal point.
+func (i *Index[T]) fetchSealed(ctx context.Context, fs storage.FS, indexValue IndexedValue) (*roaring64.Bitmap, uint64, error) {
+	segments := i.segments
+	if segments == nil {
+		segments = &indexSegmentCache{}
+	}
+
+	for attempt := 0; ; attempt++ {
+		segment, err := segments.load(ctx, fs, i.name, attempt > 0)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to load index segment: %w", err)
+		}
+		if segment == nil {
+			return roaring64.New(), 0, nil
+		}
+
+		bmap, err := segment.read(ctx, fs, indexValue)
+		if storage.IsNotExist(err) && attempt == 0 {
+			// the segment was compacted away
+			continue
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read index segment: %w", err)
+		}
+		if err := i.checkPositionFormat(segment.seal.PositionFormat); err != nil {
+			return nil, 0, err
+		}
+		return bmap, segment.seal.BlockNum, nil
+	}
+}
+
+// Seal moves the positions of the blocks lower than beforeBlockNum into the immutable segment of the
+// index. The seal point can't pass the last indexed block and it only advances. The previous segment is
+// merged into the new one and the positions sealed by the previous compaction are removed from the
+// mutable index files, so that the readers with the previous seal cached keep seeing all positions.
+func (i *Index[T]) Seal(ctx context.Context, fs storage.FS, beforeBlockNum uint64) error {
+	lastBlockNumIndexed, err := i.readLastBlockNumIndexed(ctx, fs)
+	if err != nil {
+		return err
+	}
+	sealBlockNum := min(beforeBlockNum, lastBlockNumIndexed+1)
+
+	current, err := readIndexSeal(ctx, fs, i.name)
+	if err != nil {
+		return err
+	}
+
+	var currentBlockNum uint64
+	if current != nil {
+		currentBlockNum = current.BlockNum
+	}
+	if sealBlockNum <= currentBlockNum {
+		return nil
+	}
+
+	// the previously sealed positions
+	bitmaps := make(map[IndexedValue]*roaring64.Bitmap)
+	if current != nil {
+		if err := i.checkPositionFormat(current.PositionFormat); err != nil {
+			return err
+		}
+
+		segment, err := openIndexSegment(ctx, fs, *current, true)
+		if err != nil {
+			return fmt.Errorf("failed to open index segment: %w", err)
+		}
+		for value := range segment.dict {
+			bitmaps[value], err = segment.read(ctx, fs, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// the mutable positions below the new seal point, the delta files are merged into the index files first
+	err = i.compactAll(ctx, fs)
+	if err != nil {
+		return err
+	}
+	files, err := i.indexFiles(ctx, fs)
+	if err != nil {
+		return err
+	}
+	for indexFilePath, value := range files {
+		bmap, err := i.readIndexFile(ctx, &IndexFile{fs: fs, path: indexFilePath, positionFormat: i.positionFormat.Name})
+		if err != nil {
+			return err
+		}
+
+		bmap.RemoveRange(uint64(NewIndexCompoundID(sealBlockNum, 0)), math.MaxUint64)
+		bmap.Remove(math.MaxUint64)
+		if bmap.IsEmpty() {
+			continue
+		}
+
+		if sealed, ok := bitmaps[value]; ok {
+			sealed.Or(bmap)
+		} else {
+			bitmaps[value] = bmap
+		}
+	}
+
+	// the segment is written before the seal, so that the seal always points to the complete segment
+	seal, err := writeIndexSegment(ctx, fs, i.name, sealBlockNum, bitmaps)
+	if err != nil {
+		return err
+	}
+	seal.PrevBlockNum = currentBlockNum
+	seal.PositionFormat = i.positionFormat.Name
+
+	err = writeIndexSeal(ctx, fs, i.name, seal)
+	if err != nil {
+		return err
+	}
+	if i.segments != nil {
+		i.segments.invalidate()
+	}
+
+	// the readers of the previous segment reload the seal once it's missing
+	if current != nil && current.Segment != seal.Segment {
+		err = fs.Delete(ctx, current.Segment)
+		if err != nil && !storage.IsNotExist(err) {
+			return fmt.Errorf("failed to delete index segment: %w", err)
+		}
+	}
+
+	// the readers with the previous seal cached still read the positions above it from the mutable files
+	if current != nil {
+		err = i.trimIndexFiles(ctx, fs, files, trimBefore(current.BlockNum))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexFiles returns the paths of the mutable index files and their values.
+func (i *Index[T]) indexFiles(ctx context.Context, fs storage.FS) (map[string]IndexedValue, error) {
+	files := make(map[string]IndexedValue)
+	err := fs.Walk(ctx, fmt.Sprintf("%s/", i.name), func(filePath string) error {
+		if value, ok := indexFileValue(i.name, filePath); ok {
+			files[filePath] = value
+		}
+		return nil
+	})
+	if err != nil && !storage.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list index files: %w", err)
+	}
+	return files, nil
+}
+
+// indexFileValue returns the value of the mutable index file path, see indexPath.
+func indexFileValue(index IndexName, filePath string) (IndexedValue, bool) {
+	if !strings.HasSuffix(filePath, ".idx") {
+		return "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(filePath, string(index)+"/"), "/", 4)
+	if len(parts) != 4 {
+		return "", false
+	}
+
+	name := strings.TrimSuffix(parts[3], ".idx")
+	if value := IndexedValue(name); indexPath(string(index), string(value)) == path.Clean(filePath) {
+		return value, true
+	}
+
+	// the file of the binary value is named by the hash of its bytes
+	hash, err := hex.DecodeString(name)
+	if err != nil || len(hash) != sha256.Size224 {
+		return "", false
+	}
+	value := IndexedValue(indexedValueHashPrefix + string(hash))
+	if indexPath(string(index), string(value)) != path.Clean(filePath) {
+		return "", false
+	}
+	return value, true
+}
+
+// trimIndexFiles removes the positions from the bitmaps of the index files with trim. The index files that
+// become empty are deleted.
+func (i *Index[T]) trimIndexFiles(ctx context.Context, fs storage.FS, files map[string]IndexedValue, trim func(bmap *roaring64.Bitmap)) error {
+	for indexFilePath := range files {
+		file := &IndexFile{fs: fs, path: indexFilePath, positionFormat: i.positionFormat.Name}
+
+		bmap, err := i.readIndexFile(ctx, file)
+		if err != nil {
+			return err
+		}
+
+		cardinality := bmap.GetCardinality()
+		trim(bmap)
+		if bmap.GetCardinality() == cardinality {
+			continue
+		}
+
+		if bmap.IsEmpty() {
+			err = file.Delete(ctx)
+		} else {
+			err = file.Write(ctx, bmap)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trimBefore returns the trim of the positions of the blocks lower than beforeBlockNum.
+func trimBefore(beforeBlockNum uint64) func(bmap *roaring64.Bitmap) {
+	return func(bmap *roaring64.Bitmap) {
+		bmap.RemoveRange(0, uint64(NewIndexCompoundID(beforeBlockNum, 0)))
+	}
+}
+
+// SealIndexes compacts the positions of the blocks lower than beforeBlockNum of all indexes into
+// the immutable segments, see Index.Seal. Re-running it advances the seal point.
+func SealIndexes[T any](ctx context.Context, opt IndexerOptions[T], beforeBlockNum uint64) error {
+	// apply default options on uninitialized fields
+	opt = opt.WithDefaults()
+
+	// mount indexes directory
+	fs := storage.NewPrefixWrapper(opt.FileSystem, fmt.Sprintf("%s/", path.Join(opt.Dataset.FullPath(), IndexesDirectory)))
+	fs = opt.withObjectClass(fs, ObjectClassIndex)
+
+	for _, index := range opt.Indexes {
+		err := index.Seal(ctx, fs, beforeBlockNum)
+		if err != nil {
+			return fmt.Errorf("SealIndexes: failed to seal index %s: %w", index.Name(), err)
+		}
+	}
+
+	if changes := opt.changelog(); changes != nil {
+		err := changes.publish(ctx, indexEvents(opt.Indexes, ChangeIndexSealed, func(IndexName) (uint64, bool) {
+			return beforeBlockNum, true
+		})...)
+		if err != nil {
+			return fmt.Errorf("SealIndexes: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+// rangeRecordingFS records the paths opened and read by ranges on the file system.
+type rangeRecordingFS struct {
+	storage.FS
+
+	mu     sync.Mutex
+	opened map[string]int
+	ranges int
+}
+
+func (r *rangeRecordingFS) Open(ctx context.Context, path string, options *gostorage.ReaderOptions) (*gostorage.File, error) {
+	r.mu.Lock()
+	r.opened[path]++
+	r.mu.Unlock()
+	return r.FS.Open(ctx, path, options)
+}
+
+func (r *rangeRecordingFS) OpenRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	r.mu.Lock()
+	r.opened[path]++
+	r.ranges++
+	r.mu.Unlock()
+
+	file, err := r.FS.Open(ctx, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data[offset : offset+length])), nil
+}
+
+func (r *rangeRecordingFS) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.opened = make(map[string]int)
+	r.ranges = 0
+}
+
+func (r *rangeRecordingFS) opens() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var opens int
+	for _, n := range r.opened {
+		opens += n
+	}
+	return opens
+}
+
+func generateSealIndexes() Indexes[[]int] {
+	indexes := generateMixedIntIndexes()
+	indexes["every"] = NewIndex[[]int]("every", indexAll)
+	return indexes
+}
+
+// indexSealTestDataset indexes the blocks up to toBlockNum.
+func indexSealTestDataset(t *testing.T, fs storage.FS, fromBlockNum, toBlockNum uint64) {
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+		Dataset:    Dataset{Path: "ethwal"},
+		FileSystem: fs,
+		Indexes:    generateSealIndexes(),
+	})
+	require.NoError(t, err)
+
+	for _, b := range generateMixedIntBlocks() {
+		if b.Number >= fromBlockNum && b.Number <= toBlockNum {
+			require.NoError(t, indexer.Index(context.Background(), b))
+		}
+	}
+	require.NoError(t, indexer.Close(context.Background()))
+}
+
+// querySealTestDataset returns the results of all values of all indexes.
+func querySealTestDataset(t *testing.T, fs storage.FS, snapshot *FilterSnapshot) map[string][]uint64 {
+	f, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset:    Dataset{Path: "ethwal"},
+		FileSystem: fs,
+		Indexes:    generateSealIndexes(),
+	})
+	require.NoError(t, err)
+	if snapshot != nil {
+		f = f.WithSnapshot(*snapshot)
+	}
+
+	results := make(map[string][]uint64)
+	for _, value := range sealTestValues() {
+		for name := range generateSealIndexes() {
+			bmap := f.Eq(string(name), value).Eval(context.Background()).Bitmap()
+			results[fmt.Sprintf("%s=%s", name, value)] = bmap.ToArray()
+		}
+	}
+	return results
+}
+
+func sealTestValues() []string {
+	values := []string{"true", "odd", "even", "none"}
+	for _, b := range generateMixedIntBlocks() {
+		for _, data := range b.Data {
+			values = append(values, fmt.Sprint(data))
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+func TestSealIndexes(t *testing.T) {
+	reference := gostorage.NewMemoryFS()
+	indexSealTestDataset(t, reference, 1, 70)
+	expected := querySealTestDataset(t, reference, nil)
+
+	fs := gostorage.NewMemoryFS()
+	indexSealTestDataset(t, fs, 1, 40)
+	indexerOpt := IndexerOptions[[]int]{
+		Dataset:    Dataset{Path: "ethwal"},
+		FileSystem: fs,
+		Indexes:    generateSealIndexes(),
+	}
+	indexFs := storage.NewPrefixWrapper(fs, "ethwal/"+IndexesDirectory+"/")
+
+	// the seal point can't pass the last indexed block
+	require.NoError(t, SealIndexes(context.Background(), indexerOpt, 1000))
+	seal, err := readIndexSeal(context.Background(), indexFs, "every")
+	require.NoError(t, err)
+	require.Equal(t, uint64(41), seal.BlockNum)
+
+	indexSealTestDataset(t, fs, 41, 70)
+	require.Equal(t, expected, querySealTestDataset(t, fs, nil))
+
+	// the seal point only advances
+	require.NoError(t, SealIndexes(context.Background(), indexerOpt, 20))
+	seal, err = readIndexSeal(context.Background(), indexFs, "every")
+	require.NoError(t, err)
+	require.Equal(t, uint64(41), seal.BlockNum)
+
+	require.NoError(t, SealIndexes(context.Background(), indexerOpt, 61))
+	require.Equal(t, expected, querySealTestDataset(t, fs, nil))
+
+	previous := seal
+	seal, err = readIndexSeal(context.Background(), indexFs, "every")
+	require.NoError(t, err)
+	require.Equal(t, uint64(61), seal.BlockNum)
+	require.Equal(t, uint64(41), seal.PrevBlockNum)
+
+	// the previous segment is removed and the mutable files keep the positions above the previous seal
+	_, err = indexFs.Open(context.Background(), previous.Segment, nil)
+	require.True(t, storage.IsNotExist(err))
+
+	index := generateSealIndexes()["every"]
+	files, err := index.indexFiles(context.Background(), indexFs)
+	require.NoError(t, err)
+	for filePath := range files {
+		bmap, err := (&IndexFile{fs: indexFs, path: filePath}).Read(context.Background())
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, IndexCompoundID(bmap.Minimum()).BlockNumber(), uint64(41))
+	}
+
+	// the filters of the previous seal reload it once the segment is missing
+	cached := generateSealIndexes()
+	f, err := NewFilterBuilder(FilterBuilderOptions[[]int]{Dataset: Dataset{Path: "ethwal"}, FileSystem: fs, Indexes: cached})
+	require.NoError(t, err)
+	before := f.Eq("every", "2").Eval(context.Background()).Bitmap().ToArray()
+
+	require.NoError(t, SealIndexes(context.Background(), indexerOpt, 71))
+	require.Equal(t, before, f.Eq("every", "2").Eval(context.Background()).Bitmap().ToArray())
+	require.Equal(t, expected, querySealTestDataset(t, fs, nil))
+}
+
+func TestSealIndexes_ObjectOperations(t *testing.T) {
+	fs := &rangeRecordingFS{FS: gostorage.NewMemoryFS(), opened: make(map[string]int)}
+	indexSealTestDataset(t, fs, 1, 70)
+
+	snapshot, err := NewFilterBuilder(FilterBuilderOptions[[]int]{Dataset: Dataset{Path: "ethwal"}, FileSystem: fs, Indexes: generateSealIndexes()})
+	require.NoError(t, err)
+	fsnapshot, err := snapshot.Snapshot(context.Background())
+	require.NoError(t, err)
+
+	fs.reset()
+	expected := querySealTestDataset(t, fs, &fsnapshot)
+	numValues := len(sealTestValues())
+	numIndexes := len(generateSealIndexes())
+	// every value is probed in the mutable files
+	require.GreaterOrEqual(t, fs.opens(), numValues*numIndexes)
+
+	require.NoError(t, SealIndexes(context.Background(), IndexerOptions[[]int]{
+		Dataset:    Dataset{Path: "ethwal"},
+		FileSystem: fs,
+		Indexes:    generateSealIndexes(),
+	}, 71))
+
+	t.Run("cached_segment", func(t *testing.T) {
+		fs.reset()
+		require.Equal(t, expected, querySealTestDataset(t, fs, &fsnapshot))
+
+		// the retention floor, the seal and the segment of every index
+		require.Equal(t, 1+2*numIndexes, fs.opens())
+		require.Zero(t, fs.ranges)
+	})
+
+	t.Run("ranged_reads", func(t *testing.T) {
+		defer func(size int64) { maxCachedIndexSegmentSize = size }(maxCachedIndexSegmentSize)
+		maxCachedIndexSegmentSize = 0
+
+		fs.reset()
+		require.Equal(t, expected, querySealTestDataset(t, fs, &fsnapshot))
+
+		// the values are read from the single segment object of every index
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		require.Len(t, fs.opened, 1+2*numIndexes)
+		require.Greater(t, fs.ranges, numIndexes)
+	})
+}
@@ -0,0 +1,153 @@
+package ethwal
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+// indexStatsTopN is the number of the largest values listed in IndexStatsReport.Largest.
+const indexStatsTopN = 10
+
+// IndexValueStats are the statistics of the indexed value.
+type IndexValueStats struct {
+	Value IndexedValue
+	// Bytes is the size of the index file of the value, its delta files and its sealed bitmap.
+	Bytes int64
+	// Cardinality is the number of the positions of the value.
+	Cardinality uint64
+}
+
+// IndexStatsReport are the statistics of the index returned by Index.IndexStats.
+type IndexStatsReport struct {
+	Index IndexName
+	// Values is the number of the distinct indexed values, mutable or sealed, without IndexedValueAll.
+	Values int
+	// Bytes is the total size of the index files, their delta files and the sealed segment.
+	Bytes int64
+	// Largest are the values with the largest bitmaps by their size, the largest first.
+	Largest []IndexValueStats
+	// LastBlockNumIndexed is the last block number indexed, the index covers the blocks from RetentionFloor up
+	// to it.
+	LastBlockNumIndexed uint64
+	// RetentionFloor is the block number below which the indexes were pruned, see Index.Prune.
+	RetentionFloor uint64
+	// SealedBlockNum is the seal point, the positions of the blocks lower than it are in the sealed segment,
+	// zero if the index isn't sealed.
+	SealedBlockNum uint64
+}
+
+// IndexStats walks the index files of the index and returns its statistics, the bitmaps are read only for
+// the largest values. The file system must list the objects, the stats of the file system that doesn't fail
+// with the error wrapping storage.ErrNotImplemented.
+func (i *Index[T]) IndexStats(ctx context.Context, fs storage.FS) (IndexStatsReport, error) {
+	report := IndexStatsReport{Index: i.name}
+
+	valueBytes := make(map[IndexedValue]int64)
+	err := fs.Walk(ctx, fmt.Sprintf("%s/", i.name), func(objectPath string) error {
+		if !isIndexObject(objectPath) {
+			return nil
+		}
+
+		indexFilePath := objectPath
+		if base, _, ok := indexDeltaBase(objectPath); ok {
+			indexFilePath = base
+		}
+		value, ok := indexFileValue(i.name, indexFilePath)
+		if !ok {
+			return nil
+		}
+
+		attrs, err := fs.Attributes(ctx, objectPath, nil)
+		if err != nil {
+			// the delta file compacted during the walk
+			if storage.IsNotExist(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to stat index file: %w", err)
+		}
+		valueBytes[value] += attrs.Size
+		report.Bytes += attrs.Size
+		return nil
+	})
+	if errors.Is(err, storage.ErrNotImplemented) {
+		return IndexStatsReport{}, fmt.Errorf("index %s: index stats require the file system that lists the objects: %w", i.name, err)
+	}
+	if err != nil && !storage.IsNotExist(err) {
+		return IndexStatsReport{}, fmt.Errorf("index %s: failed to list index files: %w", i.name, err)
+	}
+
+	seal, err := readIndexSeal(ctx, fs, i.name)
+	if err != nil {
+		return IndexStatsReport{}, err
+	}
+	if seal != nil {
+		segment, err := openIndexSegment(ctx, fs, *seal, false)
+		if err != nil {
+			return IndexStatsReport{}, err
+		}
+		for value, entry := range segment.dict {
+			valueBytes[value] += entry.Length
+		}
+		report.Bytes += seal.Size
+		report.SealedBlockNum = seal.BlockNum
+	}
+	// the universe isn't the indexed value, its bytes are counted in the total only
+	delete(valueBytes, IndexedValueAll)
+	report.Values = len(valueBytes)
+
+	// only the bitmaps of the largest values are read
+	for value, bytes := range valueBytes {
+		report.Largest = append(report.Largest, IndexValueStats{Value: value, Bytes: bytes})
+	}
+	slices.SortFunc(report.Largest, func(a, b IndexValueStats) int {
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), cmp.Compare(a.Value, b.Value))
+	})
+	report.Largest = report.Largest[:min(len(report.Largest), indexStatsTopN)]
+
+	for j := range report.Largest {
+		bmap, err := i.Fetch(ctx, fs, report.Largest[j].Value)
+		if err != nil {
+			return IndexStatsReport{}, err
+		}
+		report.Largest[j].Cardinality = bmap.GetCardinality()
+	}
+
+	report.LastBlockNumIndexed, err = i.readLastBlockNumIndexed(ctx, fs)
+	if err != nil {
+		return IndexStatsReport{}, err
+	}
+	report.RetentionFloor, err = IndexRetentionFloor(ctx, fs)
+	if err != nil {
+		return IndexStatsReport{}, err
+	}
+	return report, nil
+}
+
+// IndexStats returns the statistics of all indexes of the indexer in the index name order, see
+// Index.IndexStats. The pending updates aren't flushed.
+func (i *Indexer[T]) IndexStats(ctx context.Context) ([]IndexStatsReport, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	names := make([]IndexName, 0, len(i.indexes))
+	for name := range i.indexes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	reports := make([]IndexStatsReport, 0, len(names))
+	for _, name := range names {
+		idx := i.indexes[name]
+		report, err := idx.IndexStats(ctx, i.fs)
+		if err != nil {
+			return nil, i.instance.wrapError(fmt.Errorf("Indexer.IndexStats: %w", err))
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
@@ -0,0 +1,91 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexStats(t *testing.T) {
+	fs := gostorage.NewMemoryFS()
+	indexSealTestDataset(t, fs, 1, 70)
+	indexFs := storage.NewPrefixWrapper(fs, "ethwal/"+IndexesDirectory+"/")
+
+	distinct := make(map[string]struct{})
+	for _, b := range generateMixedIntBlocks() {
+		for _, data := range b.Data {
+			distinct[fmt.Sprint(data)] = struct{}{}
+		}
+	}
+
+	index := generateSealIndexes()["every"]
+
+	requireStats := func(t *testing.T, report IndexStatsReport) {
+		require.Equal(t, IndexName("every"), report.Index)
+		require.Equal(t, len(distinct), report.Values)
+		require.Len(t, report.Largest, indexStatsTopN)
+		require.Equal(t, uint64(70), report.LastBlockNumIndexed)
+
+		var bytes int64
+		for j, value := range report.Largest {
+			if j > 0 {
+				require.GreaterOrEqual(t, report.Largest[j-1].Bytes, value.Bytes)
+			}
+			bytes += value.Bytes
+
+			bmap, err := index.Fetch(context.Background(), indexFs, value.Value)
+			require.NoError(t, err)
+			require.Equal(t, bmap.GetCardinality(), value.Cardinality)
+			require.NotZero(t, value.Cardinality)
+		}
+		require.Less(t, bytes, report.Bytes)
+	}
+
+	t.Run("mutable", func(t *testing.T) {
+		report, err := index.IndexStats(context.Background(), indexFs)
+		require.NoError(t, err)
+		requireStats(t, report)
+		require.Zero(t, report.SealedBlockNum)
+	})
+
+	t.Run("sealed", func(t *testing.T) {
+		require.NoError(t, SealIndexes(context.Background(), IndexerOptions[[]int]{
+			Dataset:    Dataset{Path: "ethwal"},
+			FileSystem: fs,
+			Indexes:    generateSealIndexes(),
+		}, 41))
+
+		report, err := index.IndexStats(context.Background(), indexFs)
+		require.NoError(t, err)
+		requireStats(t, report)
+		require.Equal(t, uint64(41), report.SealedBlockNum)
+	})
+
+	t.Run("indexer", func(t *testing.T) {
+		indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+			Dataset:    Dataset{Path: "ethwal"},
+			FileSystem: fs,
+			Indexes:    generateSealIndexes(),
+		})
+		require.NoError(t, err)
+		defer indexer.Close(context.Background())
+
+		reports, err := indexer.IndexStats(context.Background())
+		require.NoError(t, err)
+		require.Len(t, reports, len(generateSealIndexes()))
+		require.Equal(t, IndexName("all"), reports[0].Index)
+		require.Equal(t, IndexName("every"), reports[1].Index)
+		require.Equal(t, IndexName("odd_even"), reports[2].Index)
+		require.Equal(t, 2, reports[2].Values)
+		requireStats(t, reports[1])
+	})
+
+	t.Run("no_walk", func(t *testing.T) {
+		_, err := index.IndexStats(context.Background(), storage.FSFromFuncs(nil, nil, nil, nil, nil))
+		require.ErrorIs(t, err, storage.ErrNotImplemented)
+	})
+}
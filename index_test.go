@@ -0,0 +1,292 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexUpdate_Merge(t *testing.T) {
+	bitmapOf := func(ids ...IndexCompoundID) *roaring64.Bitmap {
+		bm := roaring64.New()
+		for _, id := range ids {
+			bm.Add(uint64(id))
+		}
+		return bm
+	}
+
+	t.Run("overlapping_values", func(t *testing.T) {
+		u := &IndexUpdate{
+			Data:         map[IndexedValue]*roaring64.Bitmap{"a": bitmapOf(NewIndexCompoundID(1, 0), NewIndexCompoundID(1, 2))},
+			LastBlockNum: 1,
+		}
+		update := &IndexUpdate{
+			Data:         map[IndexedValue]*roaring64.Bitmap{"a": bitmapOf(NewIndexCompoundID(2, 0), NewIndexCompoundID(2, 1))},
+			LastBlockNum: 2,
+		}
+
+		u.Merge(update)
+		require.Equal(t, uint64(2), u.LastBlockNum)
+		require.Equal(t, []uint64{
+			uint64(NewIndexCompoundID(1, 0)),
+			uint64(NewIndexCompoundID(1, 2)),
+			uint64(NewIndexCompoundID(2, 0)),
+			uint64(NewIndexCompoundID(2, 1)),
+		}, u.Data["a"].ToArray())
+	})
+
+	t.Run("disjoint_values", func(t *testing.T) {
+		u := &IndexUpdate{
+			Data:         map[IndexedValue]*roaring64.Bitmap{"a": bitmapOf(NewIndexCompoundID(1, 0))},
+			LastBlockNum: 1,
+		}
+		update := &IndexUpdate{
+			Data:         map[IndexedValue]*roaring64.Bitmap{"b": bitmapOf(NewIndexCompoundID(2, 3))},
+			LastBlockNum: 2,
+		}
+
+		u.Merge(update)
+		require.Len(t, u.Data, 2)
+		require.Equal(t, []uint64{uint64(NewIndexCompoundID(1, 0))}, u.Data["a"].ToArray())
+		require.Equal(t, []uint64{uint64(NewIndexCompoundID(2, 3))}, u.Data["b"].ToArray())
+
+		// merged bitmaps are not shared with the update
+		u.Data["b"].Add(uint64(NewIndexCompoundID(3, 0)))
+		require.Equal(t, uint64(1), update.Data["b"].GetCardinality())
+	})
+
+	t.Run("last_block_num_regression", func(t *testing.T) {
+		u := &IndexUpdate{LastBlockNum: 10}
+		u.Merge(&IndexUpdate{
+			Data:         map[IndexedValue]*roaring64.Bitmap{"a": bitmapOf(NewIndexCompoundID(5, 0))},
+			LastBlockNum: 5,
+		})
+
+		require.Equal(t, uint64(10), u.LastBlockNum)
+		require.Equal(t, []uint64{uint64(NewIndexCompoundID(5, 0))}, u.Data["a"].ToArray())
+	})
+
+	t.Run("nil_update", func(t *testing.T) {
+		u := &IndexUpdate{LastBlockNum: 10}
+		u.Merge(nil)
+		require.Equal(t, uint64(10), u.LastBlockNum)
+		require.Nil(t, u.Data)
+	})
+}
+
+// logTopicPosition is the nested position of the topic of the log, the log occupies the upper 12 bits.
+type logTopicPosition struct {
+	Log   uint16
+	Topic uint16
+}
+
+func (p logTopicPosition) Compact() uint16 {
+	return p.Log<<4 | p.Topic
+}
+
+var logTopicPositions = PositionFormat{
+	Name: "log-topic/v1",
+	Decode: func(compact uint16) Position {
+		return logTopicPosition{Log: compact >> 4, Topic: compact & 0xF}
+	},
+}
+
+type testPositionLog struct {
+	Topics []string `json:"topics"`
+}
+
+type testPositionReceipt struct {
+	Logs []testPositionLog `json:"logs"`
+}
+
+func testPositionBlock(blockNum uint64) Block[testPositionReceipt] {
+	var receipt testPositionReceipt
+	for log := uint64(0); log < blockNum%3+1; log++ {
+		receipt.Logs = append(receipt.Logs, testPositionLog{
+			Topics: []string{"transfer", fmt.Sprintf("from-%d", (blockNum+log)%4), fmt.Sprintf("to-%d", log)},
+		})
+	}
+	return Block[testPositionReceipt]{Number: blockNum, Data: receipt}
+}
+
+func indexLogTopics(block Block[testPositionReceipt]) (bool, map[IndexedValue][]Position, error) {
+	indexValueMap := make(map[IndexedValue][]Position)
+	for i, log := range block.Data.Logs {
+		for j, topic := range log.Topics {
+			indexValueMap[IndexedValue(topic)] = append(indexValueMap[IndexedValue(topic)], logTopicPosition{Log: uint16(i), Topic: uint16(j)})
+		}
+	}
+	return true, indexValueMap, nil
+}
+
+// projectLogTopics keeps the matched topics of the matched logs.
+func projectLogTopics(data testPositionReceipt, positions []Position) (testPositionReceipt, error) {
+	var projected testPositionReceipt
+	logs := make(map[uint16]int)
+	for _, position := range positions {
+		p, ok := position.(logTopicPosition)
+		if !ok {
+			return testPositionReceipt{}, fmt.Errorf("unexpected position %T", position)
+		}
+
+		i, ok := logs[p.Log]
+		if !ok {
+			i = len(projected.Logs)
+			logs[p.Log] = i
+			projected.Logs = append(projected.Logs, testPositionLog{})
+		}
+		projected.Logs[i].Topics = append(projected.Logs[i].Topics, data.Logs[p.Log].Topics[p.Topic])
+	}
+	return projected, nil
+}
+
+func TestIndex_ReservedValue(t *testing.T) {
+	ctx := context.Background()
+	fs := gostorage.NewMemoryFS()
+	index := NewIndex[[]int]("reserved", func(block Block[[]int]) (bool, map[IndexedValue][]Position, error) {
+		if block.Number == 2 {
+			return true, map[IndexedValue][]Position{IndexedValueAll: Ordinals(0)}, nil
+		}
+		return true, map[IndexedValue][]Position{"value": Ordinals(0)}, nil
+	})
+
+	update, err := index.IndexBlock(ctx, fs, Block[[]int]{Number: 1, Data: []int{1}})
+	require.NoError(t, err)
+	require.NoError(t, index.Store(ctx, fs, update))
+
+	// the value of the universe isn't overwritten by the value of the index function
+	_, err = index.IndexBlock(ctx, fs, Block[[]int]{Number: 2, Data: []int{2}})
+	require.ErrorIs(t, err, ErrReservedIndexedValue)
+
+	bmap, err := index.Fetch(ctx, fs, IndexedValueAll)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{uint64(NewIndexCompoundID(1, 0))}, bmap.ToArray())
+}
+
+func TestIndexPositions(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("ordinal", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+		index := NewIndex[[]int]("ordinal", func(block Block[[]int]) (bool, map[IndexedValue][]Position, error) {
+			return true, map[IndexedValue][]Position{"value": Ordinals(0, 2)}, nil
+		})
+
+		update, err := index.IndexBlock(ctx, fs, Block[[]int]{Number: 5, Data: []int{1, 2, 3}})
+		require.NoError(t, err)
+		require.NoError(t, index.Store(ctx, fs, update))
+
+		bmap, err := index.Fetch(ctx, fs, "value")
+		require.NoError(t, err)
+		require.Equal(t, []uint64{uint64(NewIndexCompoundID(5, 0)), uint64(NewIndexCompoundID(5, 2))}, bmap.ToArray())
+
+		// the index file is stored as before the positions were typed
+		legacy := gostorage.NewMemoryFS()
+		require.NoError(t, (&IndexFile{fs: legacy, path: indexPath("ordinal", "value")}).Write(ctx, bmap))
+		legacyData, err := readObject(ctx, legacy, indexPath("ordinal", "value"))
+		require.NoError(t, err)
+		data, err := readObject(ctx, fs, indexPath("ordinal", "value"))
+		require.NoError(t, err)
+		require.Equal(t, legacyData, data)
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		opt := Options{
+			Dataset:         Dataset{Path: "ethwal"},
+			FileSystem:      gostorage.NewMemoryFS(),
+			FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+			FileRollOnClose: true,
+		}
+		indexes := Indexes[testPositionReceipt]{
+			"topic": NewIndexWithPositions[testPositionReceipt]("topic", logTopicPositions, indexLogTopics),
+		}
+		indexerOpt := IndexerOptions[testPositionReceipt]{Dataset: opt.Dataset, FileSystem: opt.FileSystem, Indexes: indexes}
+
+		indexer, err := NewIndexer(ctx, indexerOpt)
+		require.NoError(t, err)
+		w, err := NewWriter[testPositionReceipt](opt)
+		require.NoError(t, err)
+		w, err = NewWriterWithIndexer(w, indexer)
+		require.NoError(t, err)
+		for blockNum := uint64(1); blockNum <= 30; blockNum++ {
+			require.NoError(t, w.Write(ctx, testPositionBlock(blockNum)))
+		}
+		require.NoError(t, w.Close(ctx))
+
+		// the positions of the sealed segment and the mutable index files
+		require.NoError(t, SealIndexes(ctx, indexerOpt, 15))
+
+		fb, err := NewFilterBuilder(FilterBuilderOptions[testPositionReceipt]{Dataset: opt.Dataset, FileSystem: opt.FileSystem, Indexes: indexes})
+		require.NoError(t, err)
+
+		var positions []logTopicPosition
+		it := fb.Eq("topic", "from-1").Eval(ctx)
+		for it.HasNext() {
+			blockNum, compact := it.Next()
+			if blockNum == 10 || blockNum == 20 {
+				positions = append(positions, logTopicPositions.Decode(compact).(logTopicPosition))
+			}
+		}
+		// block 10 has log 0 with from-2 and log 1 with from-3, block 20 logs from-0 to from-2
+		require.Equal(t, []logTopicPosition{{Log: 1, Topic: 1}}, positions)
+
+		r, err := NewReader[testPositionReceipt](opt)
+		require.NoError(t, err)
+		r, err = NewReaderWithFilterProjection[testPositionReceipt](r, fb.Or(fb.Eq("topic", "from-1"), fb.Eq("topic", "to-2")), logTopicPositions, projectLogTopics)
+		require.NoError(t, err)
+
+		var blocksRead int
+		for {
+			b, err := r.Read(ctx)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			blocksRead++
+
+			var expected testPositionReceipt
+			for _, log := range testPositionBlock(b.Number).Data.Logs {
+				var topics []string
+				for _, topic := range log.Topics {
+					if topic == "from-1" || topic == "to-2" {
+						topics = append(topics, topic)
+					}
+				}
+				if len(topics) > 0 {
+					expected.Logs = append(expected.Logs, testPositionLog{Topics: topics})
+				}
+			}
+			require.Equal(t, expected, b.Data, "block %d", b.Number)
+		}
+		require.Greater(t, blocksRead, 10)
+		require.NoError(t, r.Close())
+
+		// the index read with another position format fails
+		indexFs := gostorage.NewMemoryFS()
+		ordinal := NewIndex[testPositionReceipt]("topic", nil)
+		nested := NewIndexWithPositions[testPositionReceipt]("topic", logTopicPositions, indexLogTopics)
+		update, err := nested.IndexBlock(ctx, indexFs, testPositionBlock(1))
+		require.NoError(t, err)
+		require.NoError(t, nested.Store(ctx, indexFs, update))
+		_, err = ordinal.Fetch(ctx, indexFs, "transfer")
+		require.ErrorIs(t, err, ErrPositionFormatMismatch)
+
+		require.NoError(t, nested.Seal(ctx, indexFs, 2))
+		_, err = ordinal.Fetch(ctx, indexFs, "transfer")
+		require.ErrorIs(t, err, ErrPositionFormatMismatch)
+
+		// the block data that isn't a slice can't be filtered without the projection
+		r, err = NewReader[testPositionReceipt](opt)
+		require.NoError(t, err)
+		r, err = NewReaderWithFilter[testPositionReceipt](r, fb.Eq("topic", "from-1"))
+		require.NoError(t, err)
+		_, err = r.Read(ctx)
+		require.ErrorIs(t, err, ErrProjectionRequired)
+		require.NoError(t, r.Close())
+	})
+}
@@ -3,10 +3,18 @@ package ethwal
 import (
 	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"math"
+	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/0xsequence/ethwal/storage"
 	"github.com/0xsequence/ethwal/storage/local"
@@ -17,57 +25,253 @@ import (
 
 const IndexesDirectory = ".indexes"
 
+// IndexerPendingMode defines what the Indexer does when pending index updates exceed
+// IndexerOptions.MaxPendingBytes.
+type IndexerPendingMode int
+
+const (
+	// IndexerPendingModeFlush flushes pending index updates to the file system as soon as
+	// the estimated size of pending updates crosses the limit.
+	IndexerPendingModeFlush IndexerPendingMode = iota
+	// IndexerPendingModeSpill serializes the largest pending bitmaps to a local scratch
+	// directory and merges them back at flush time.
+	IndexerPendingModeSpill
+)
+
 type IndexerOptions[T any] struct {
 	Dataset    Dataset
 	FileSystem storage.FS
 
 	Indexes Indexes[T]
+
+	// MaxPendingBytes is the maximal estimated size of pending index updates kept in memory
+	// between flushes. Zero means unlimited.
+	MaxPendingBytes datasize.ByteSize
+	// PendingMode defines how MaxPendingBytes is enforced.
+	PendingMode IndexerPendingMode
+	// SpillPath is the local scratch directory used by IndexerPendingModeSpill. If empty,
+	// a temporary directory is created.
+	SpillPath string
+
+	// InstanceID identifies the indexer instance in errors. If empty, a random id is generated.
+	InstanceID string
+
+	// LeaseTTL enables the single indexer of the indexes. The indexer takes the lease of the indexes on start,
+	// refreshes it every third of LeaseTTL and releases it on Close. NewIndexer fails with IndexerLockedError
+	// while another indexer holds the live lease, the flush fails with ErrIndexerLeaseLost once the lease is
+	// taken over or expires. Zero disables the lease.
+	LeaseTTL time.Duration
+
+	// ObjectMetadata is attached to all index files, see Options.ObjectMetadata.
+	ObjectMetadata ObjectAttributes
+	// ObjectClassMetadata overrides ObjectMetadata for the object class.
+	ObjectClassMetadata map[ObjectClass]ObjectAttributes
+
+	// EnableChangefeed makes the indexer, SealIndexes and PruneIndexes append the events of the indexes to
+	// the changelog of the dataset, see Options.EnableChangefeed.
+	EnableChangefeed bool
+
+	// EnableAccounting counts the storage operations and bytes of the indexer, see Options.EnableAccounting.
+	EnableAccounting bool
+	// Accounting is the accounting the counters are added to, see Options.Accounting.
+	Accounting *storage.Accounting
+
+	// MaxStoreConcurrency is the number of the index files written concurrently by the flush, the limit is shared
+	// by all indexes. Defaults to 8.
+	MaxStoreConcurrency int
+	// OnIndexFlushed is called after the pending index updates are flushed, it's called once the lock of the
+	// indexer is released. NewWriterWithIndexer sets it to the writer Options.OnIndexFlushed if it's nil.
+	OnIndexFlushed func(ctx context.Context, stats IndexFlushStats)
+
+	// MaxIndexDeltas makes the flush write the positions of the value to the new delta file of its index file
+	// instead of rewriting the whole index file, once the value has more delta files they're merged into the
+	// index file, see Indexer.Compact. Zero rewrites the index file on every flush. The readers of the
+	// versions without the delta files don't read them.
+	MaxIndexDeltas int
+}
+
+// IndexFlushStats are the statistics of the flush of the indexer passed to the OnIndexFlushed callbacks.
+type IndexFlushStats struct {
+	// BlockNum is the block number the indexes are flushed up to, see Indexer.FlushedBlockNum.
+	BlockNum uint64
+	// Took is the duration of the flush.
+	Took time.Duration
+	// Size is the estimated size of the flushed index updates.
+	Size datasize.ByteSize
+}
+
+// IndexerStats contains Indexer memory usage statistics.
+type IndexerStats struct {
+	PendingBytes   datasize.ByteSize
+	SpilledBytes   datasize.ByteSize
+	SpillCount     uint64
+	AutoFlushCount uint64
 }
 
 func (o IndexerOptions[T]) WithDefaults() IndexerOptions[T] {
 	o.FileSystem = cmp.Or(o.FileSystem, storage.FS(local.NewLocalFS("")))
+	o.MaxStoreConcurrency = cmp.Or(o.MaxStoreConcurrency, defaultMaxStoreConcurrency)
 	return o
 }
 
+// changelog returns the changelog of the dataset, nil unless EnableChangefeed is set.
+func (o IndexerOptions[T]) changelog() *changelog {
+	if !o.EnableChangefeed {
+		return nil
+	}
+	return newChangelog(o.withObjectClass(storage.NewPrefixWrapper(o.FileSystem, o.Dataset.FullPath()), ObjectClassMeta))
+}
+
+// indexEvents returns the events of the type of the indexes sorted by name.
+func indexEvents[T any](indexes Indexes[T], typ ChangeEventType, blockNum func(name IndexName) (uint64, bool)) []ChangeEvent {
+	var events []ChangeEvent
+	for name := range indexes {
+		if n, ok := blockNum(name); ok {
+			events = append(events, ChangeEvent{Type: typ, Index: name, BlockNum: n})
+		}
+	}
+	slices.SortFunc(events, func(a, b ChangeEvent) int {
+		return cmp.Compare(a.Index, b.Index)
+	})
+	return events
+}
+
 type Indexer[T any] struct {
+	instance Instance
+
 	indexes      map[IndexName]Index[T]
 	indexUpdates map[IndexName]*IndexUpdate
 	fs           storage.FS
 
+	flushedBlockNums map[IndexName]uint64
+	// retryBlockNums are the blocks the indexes failed to index with ErrRetryableIndex.
+	retryBlockNums map[IndexName]uint64
+
+	maxPendingBytes datasize.ByteSize
+	pendingMode     IndexerPendingMode
+	spill           *indexSpill
+
+	accounting *storage.Accounting
+
+	lease *indexerLease
+
+	changelog *changelog
+
+	autoFlushCount uint64
+
+	storeConcurrency int
+	maxIndexDeltas   int
+
+	onIndexFlushed func(ctx context.Context, stats IndexFlushStats)
+	// hookCalls are the calls of the hooks made once the lock is released, see callHooks
+	hookCalls []func()
+
+	closed bool
+
 	mu sync.Mutex
 }
 
 func NewIndexer[T any](ctx context.Context, opt IndexerOptions[T]) (*Indexer[T], error) {
 	// apply default options on uninitialized fields
-	opt = opt.WithDefaults()
+	opt = opt.WithDefaults().withAccounting()
+
+	// create instance identity
+	instance := newInstance(opt.InstanceID, opt.Dataset)
 
 	// mount indexes directory
 	fs := storage.NewPrefixWrapper(opt.FileSystem, fmt.Sprintf("%s/", path.Join(opt.Dataset.FullPath(), IndexesDirectory)))
+	fs = opt.withObjectClass(fs, ObjectClassIndex)
 
 	// populate indexUpdates with last block number indexed
 	indexMaps := make(map[IndexName]*IndexUpdate)
+	flushedBlockNums := make(map[IndexName]uint64)
 	for _, index := range opt.Indexes {
 		lastBlockNum, err := index.LastBlockNumIndexed(ctx, fs)
 		if err != nil {
-			return nil, fmt.Errorf("Indexer.NewIndexer: failed to get last block number indexed for %s: %w", index.Name(), err)
+			return nil, instance.wrapError(fmt.Errorf("Indexer.NewIndexer: failed to get last block number indexed for %s: %w", index.Name(), err))
 		}
 
 		indexMaps[index.name] = &IndexUpdate{Data: make(map[IndexedValue]*roaring64.Bitmap), LastBlockNum: lastBlockNum}
+		flushedBlockNums[index.name] = lastBlockNum
+	}
+
+	var lease *indexerLease
+	if opt.LeaseTTL > 0 {
+		var err error
+		lease, err = acquireIndexerLease(ctx, fs, instance.ID, opt.LeaseTTL)
+		if err != nil {
+			return nil, instance.wrapError(fmt.Errorf("Indexer.NewIndexer: failed to acquire lease: %w", err))
+		}
+	}
+
+	var spill *indexSpill
+	if opt.MaxPendingBytes > 0 && opt.PendingMode == IndexerPendingModeSpill {
+		var err error
+		spill, err = newIndexSpill(opt.SpillPath)
+		if err != nil {
+			if lease != nil {
+				_ = lease.release(ctx)
+			}
+			return nil, instance.wrapError(fmt.Errorf("Indexer.NewIndexer: failed to create spill directory: %w", err))
+		}
 	}
 
 	return &Indexer[T]{
-		indexes:      opt.Indexes,
-		indexUpdates: indexMaps,
-		fs:           fs,
+		instance:         instance,
+		indexes:          opt.Indexes,
+		indexUpdates:     indexMaps,
+		fs:               fs,
+		flushedBlockNums: flushedBlockNums,
+		retryBlockNums:   make(map[IndexName]uint64),
+		maxPendingBytes:  opt.MaxPendingBytes,
+		pendingMode:      opt.PendingMode,
+		spill:            spill,
+		accounting:       opt.Accounting,
+		lease:            lease,
+		changelog:        opt.changelog(),
+		storeConcurrency: opt.MaxStoreConcurrency,
+		maxIndexDeltas:   opt.MaxIndexDeltas,
+		onIndexFlushed:   opt.OnIndexFlushed,
 	}, nil
 }
 
 func (i *Indexer[T]) Index(ctx context.Context, block Block[T]) error {
+	defer i.callHooks()
+	return i.instance.wrapError(i.index(ctx, block))
+}
+
+func (i *Indexer[T]) index(ctx context.Context, block Block[T]) error {
+	if err := validateBlockNum(block.Number); err != nil {
+		return fmt.Errorf("Indexer.Index: %w", err)
+	}
+
+	// the index doesn't skip the block that failed with the retryable error
+	i.mu.Lock()
+	for name, retryBlockNum := range i.retryBlockNums {
+		if block.Number > retryBlockNum {
+			i.mu.Unlock()
+			return fmt.Errorf("Indexer.Index: %w: index %s must index block %d before block %d", ErrRetryableIndex, name, retryBlockNum, block.Number)
+		}
+	}
+	i.mu.Unlock()
+
 	for _, index := range i.indexes {
 		bmUpdate, err := index.IndexBlock(ctx, i.fs, block)
+		if errors.Is(err, ErrRetryableIndex) {
+			i.mu.Lock()
+			i.retryBlockNums[index.name] = block.Number
+			i.mu.Unlock()
+		}
 		if err != nil {
 			return err
 		}
+
+		i.mu.Lock()
+		if retryBlockNum, ok := i.retryBlockNums[index.name]; ok && retryBlockNum == block.Number {
+			delete(i.retryBlockNums, index.name)
+		}
+		i.mu.Unlock()
+
 		if bmUpdate == nil {
 			continue
 		}
@@ -79,28 +283,65 @@ func (i *Indexer[T]) Index(ctx context.Context, block Block[T]) error {
 		i.mu.Unlock()
 	}
 
-	return nil
+	return i.enforcePendingLimit(ctx)
 }
 
 func (i *Indexer[T]) EstimatedBatchSize() datasize.ByteSize {
 	i.mu.Lock()
 	defer i.mu.Unlock()
+	return i.estimatedBatchSize()
+}
 
-	var size datasize.ByteSize = 0
-	for _, indexUpdate := range i.indexUpdates {
-		for _, bm := range indexUpdate.Data {
-			size += datasize.ByteSize(bm.GetSizeInBytes())
-		}
+// Stats returns the current memory usage statistics of the Indexer.
+func (i *Indexer[T]) Stats() IndexerStats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	stats := IndexerStats{
+		PendingBytes:   i.estimatedBatchSize(),
+		AutoFlushCount: i.autoFlushCount,
 	}
-	return size
+	if i.spill != nil {
+		stats.SpilledBytes = i.spill.spilledBytes
+		stats.SpillCount = i.spill.spillCount
+	}
+	return stats
 }
 
 func (i *Indexer[T]) Flush(ctx context.Context) error {
+	defer i.callHooks()
 	i.mu.Lock()
 	defer i.mu.Unlock()
+	return i.instance.wrapError(i.flush(ctx))
+}
 
-	errGrp, gCtx := errgroup.WithContext(ctx)
+func (i *Indexer[T]) flush(ctx context.Context) error {
+	// the indexer that lost its lease doesn't write to the indexes of the next one
+	if i.lease != nil {
+		if err := i.lease.check(); err != nil {
+			return fmt.Errorf("Indexer.Flush: %w", err)
+		}
+	}
+
+	// merge spilled bitmaps back into pending updates
+	start := time.Now()
+	if i.spill != nil {
+		err := i.spill.restore(i.indexUpdates)
+		if err != nil {
+			return fmt.Errorf("Indexer.Flush: failed to restore spilled indexes: %w", err)
+		}
+	}
+	size := i.estimatedBatchSize()
 
+	var (
+		errGrp errgroup.Group
+		errsMu sync.Mutex
+		errs   = make(map[IndexName]error)
+		// the index files of all indexes are written up to storeConcurrency at once
+		storeSem = make(chan struct{}, i.storeConcurrency)
+	)
+
+	// the indexes that failed don't stop the others, so the retry stores the failed values only
 	for name, indexUpdate := range i.indexUpdates {
 		idx, ok := i.indexes[name]
 		if !ok {
@@ -108,22 +349,127 @@ func (i *Indexer[T]) Flush(ctx context.Context) error {
 		}
 
 		errGrp.Go(func() error {
-			err := idx.Store(gCtx, i.fs, indexUpdate)
+			err := idx.store(ctx, i.fs, indexUpdate, storeSem, i.maxIndexDeltas)
 			if err != nil {
-				return err
+				// the IndexStoreError names the index
+				var storeErr *IndexStoreError
+				if !errors.As(err, &storeErr) {
+					err = fmt.Errorf("index %s: %w", name, err)
+				}
+
+				errsMu.Lock()
+				errs[name] = err
+				errsMu.Unlock()
 			}
 			return nil
 		})
 	}
+	_ = errGrp.Wait()
 
-	err := errGrp.Wait()
-	if err != nil {
-		return fmt.Errorf("Indexer.Flush: failed to flush indexes: %w", err)
+	if len(errs) > 0 {
+		names := make([]IndexName, 0, len(errs))
+		for name := range errs {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		var flushErrs []error
+		for _, name := range names {
+			flushErrs = append(flushErrs, errs[name])
+		}
+		return fmt.Errorf("Indexer.Flush: failed to flush indexes: %w", errors.Join(flushErrs...))
 	}
 
 	// clear indexUpdates
+	flushedBlockNums := maps.Clone(i.flushedBlockNums)
 	for _, index := range i.indexes {
 		i.indexUpdates[index.name].Data = make(map[IndexedValue]*roaring64.Bitmap)
+		i.flushedBlockNums[index.name] = i.indexUpdates[index.name].LastBlockNum
+	}
+
+	// the advanced indexes are durable, the events that failed to append are retried by the next flush
+	if i.changelog != nil {
+		err := i.changelog.publish(ctx, indexEvents(i.indexes, ChangeIndexAdvanced, func(name IndexName) (uint64, bool) {
+			return i.flushedBlockNums[name], i.flushedBlockNums[name] > flushedBlockNums[name]
+		})...)
+		if err != nil {
+			return fmt.Errorf("Indexer.Flush: %w", err)
+		}
+	}
+
+	// remove spill files, the data is already stored
+	if i.spill != nil {
+		err := i.spill.clear()
+		if err != nil {
+			return fmt.Errorf("Indexer.Flush: failed to clear spilled indexes: %w", err)
+		}
+	}
+
+	if onIndexFlushed := i.onIndexFlushed; onIndexFlushed != nil {
+		stats := IndexFlushStats{BlockNum: i.flushedBlockNum(), Took: time.Since(start), Size: size}
+		i.hookCalls = append(i.hookCalls, func() { onIndexFlushed(ctx, stats) })
+	}
+	return nil
+}
+
+// callHooks calls the queued hooks, it's deferred by the methods before they take the lock, so that the hooks
+// are called once it's released.
+func (i *Indexer[T]) callHooks() {
+	i.mu.Lock()
+	calls := i.hookCalls
+	i.hookCalls = nil
+	i.mu.Unlock()
+
+	for _, call := range calls {
+		call()
+	}
+}
+
+// useOnIndexFlushed sets the OnIndexFlushed callback of the indexer without its own one.
+func (i *Indexer[T]) useOnIndexFlushed(onIndexFlushed func(ctx context.Context, stats IndexFlushStats)) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.onIndexFlushed == nil {
+		i.onIndexFlushed = onIndexFlushed
+	}
+}
+
+func (i *Indexer[T]) estimatedBatchSize() datasize.ByteSize {
+	var size datasize.ByteSize = 0
+	for _, indexUpdate := range i.indexUpdates {
+		for _, bm := range indexUpdate.Data {
+			size += datasize.ByteSize(bm.GetSizeInBytes())
+		}
+	}
+	return size
+}
+
+// enforcePendingLimit flushes or spills pending index updates if they exceed MaxPendingBytes.
+func (i *Indexer[T]) enforcePendingLimit(ctx context.Context) error {
+	if i.maxPendingBytes == 0 {
+		return nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.estimatedBatchSize() < i.maxPendingBytes {
+		return nil
+	}
+
+	switch i.pendingMode {
+	case IndexerPendingModeSpill:
+		// spill the largest bitmaps until pending size is below half of the limit, the rest is the hot set
+		err := i.spill.spill(i.indexUpdates, i.estimatedBatchSize()-i.maxPendingBytes/2)
+		if err != nil {
+			return fmt.Errorf("Indexer.Index: failed to spill indexes: %w", err)
+		}
+	default:
+		err := i.flush(ctx)
+		if err != nil {
+			return err
+		}
+		i.autoFlushCount++
 	}
 	return nil
 }
@@ -147,6 +493,264 @@ func (i *Indexer[T]) BlockNum() uint64 {
 	return lowestBlockNum
 }
 
+// FlushedBlockNum returns the lowest block number persisted by all indexes. If no blocks have been
+// flushed, it returns 0.
+func (i *Indexer[T]) FlushedBlockNum() uint64 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.flushedBlockNum()
+}
+
+func (i *Indexer[T]) flushedBlockNum() uint64 {
+	var lowestBlockNum uint64 = math.MaxUint64
+	for _, blockNum := range i.flushedBlockNums {
+		if blockNum < lowestBlockNum {
+			lowestBlockNum = blockNum
+		}
+	}
+
+	if lowestBlockNum == math.MaxUint64 {
+		return 0
+	}
+	return lowestBlockNum
+}
+
+// Accounting returns the storage accounting of the indexer, or nil if IndexerOptions.EnableAccounting isn't set.
+func (i *Indexer[T]) Accounting() *storage.Accounting {
+	return i.accounting
+}
+
+// ID returns the identity of the indexer instance.
+func (i *Indexer[T]) ID() Instance {
+	return i.instance
+}
+
+// Close flushes the pending index updates, removes the spill directory and releases the lease. It's safe
+// to call Close multiple times.
 func (i *Indexer[T]) Close(ctx context.Context) error {
-	return i.Flush(ctx)
+	defer i.callHooks()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.closed {
+		return nil
+	}
+	i.closed = true
+
+	err := i.flush(ctx)
+	if i.spill != nil {
+		err = errors.Join(err, i.spill.close())
+	}
+	if i.lease != nil {
+		err = errors.Join(err, i.lease.release(ctx))
+	}
+	return i.instance.wrapError(err)
+}
+
+// PruneIndexes removes all positions of blocks lower than beforeBlockNum from all indexes and records
+// the retention floor, so that filters don't return blocks that are no longer stored.
+func PruneIndexes[T any](ctx context.Context, opt IndexerOptions[T], beforeBlockNum uint64) error {
+	// apply default options on uninitialized fields
+	opt = opt.WithDefaults()
+
+	// mount indexes directory
+	fs := storage.NewPrefixWrapper(opt.FileSystem, fmt.Sprintf("%s/", path.Join(opt.Dataset.FullPath(), IndexesDirectory)))
+	fs = opt.withObjectClass(fs, ObjectClassIndex)
+
+	retentionFloor, err := IndexRetentionFloor(ctx, fs)
+	if err != nil {
+		return fmt.Errorf("PruneIndexes: %w", err)
+	}
+	if beforeBlockNum <= retentionFloor {
+		return nil
+	}
+
+	for _, index := range opt.Indexes {
+		err := index.Prune(ctx, fs, beforeBlockNum)
+		if err != nil {
+			return fmt.Errorf("PruneIndexes: failed to prune index %s: %w", index.Name(), err)
+		}
+	}
+
+	err = storeIndexRetentionFloor(ctx, fs, beforeBlockNum)
+	if err != nil {
+		return fmt.Errorf("PruneIndexes: %w", err)
+	}
+
+	if changes := opt.changelog(); changes != nil {
+		err = changes.publish(ctx, indexEvents(opt.Indexes, ChangeIndexPruned, func(IndexName) (uint64, bool) {
+			return beforeBlockNum, true
+		})...)
+		if err != nil {
+			return fmt.Errorf("PruneIndexes: %w", err)
+		}
+	}
+	return nil
+}
+
+// indexSpill stores pending index bitmaps in a local scratch directory.
+type indexSpill struct {
+	dir        string
+	removeDir  bool
+	files      []string
+	fileSeqNum uint64
+
+	spilledBytes datasize.ByteSize
+	spillCount   uint64
+}
+
+type indexSpillEntry struct {
+	Index  IndexName    `cbor:"0,keyasint"`
+	Value  IndexedValue `cbor:"1,keyasint"`
+	Bitmap []byte       `cbor:"2,keyasint"`
+}
+
+func newIndexSpill(dir string) (*indexSpill, error) {
+	var removeDir bool
+	if dir == "" {
+		tmpDir, err := os.MkdirTemp("", "ethwal-index-spill-")
+		if err != nil {
+			return nil, err
+		}
+		dir, removeDir = tmpDir, true
+	} else {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &indexSpill{dir: dir, removeDir: removeDir}, nil
+}
+
+// spill writes the largest pending bitmaps to a new spill file until at least bytesToSpill is freed.
+func (s *indexSpill) spill(indexUpdates map[IndexName]*IndexUpdate, bytesToSpill datasize.ByteSize) error {
+	type candidate struct {
+		index IndexName
+		value IndexedValue
+		size  datasize.ByteSize
+	}
+
+	var candidates []candidate
+	for name, indexUpdate := range indexUpdates {
+		for value, bm := range indexUpdate.Data {
+			candidates = append(candidates, candidate{index: name, value: value, size: datasize.ByteSize(bm.GetSizeInBytes())})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].size > candidates[j].size
+	})
+
+	s.fileSeqNum++
+	filePath := filepath.Join(s.dir, fmt.Sprintf("%06d.spill", s.fileSeqNum))
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, filePath)
+
+	comp := NewZSTDCompressor(file)
+	enc := NewCBOREncoder(comp)
+
+	var spilled datasize.ByteSize
+	for _, c := range candidates {
+		if spilled >= bytesToSpill {
+			break
+		}
+
+		bm := indexUpdates[c.index].Data[c.value]
+		data, err := bm.MarshalBinary()
+		if err != nil {
+			_ = comp.Close()
+			_ = file.Close()
+			return err
+		}
+
+		err = enc.Encode(indexSpillEntry{Index: c.index, Value: c.value, Bitmap: data})
+		if err != nil {
+			_ = comp.Close()
+			_ = file.Close()
+			return err
+		}
+
+		delete(indexUpdates[c.index].Data, c.value)
+		spilled += c.size
+	}
+
+	if err := comp.Close(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	s.spilledBytes += spilled
+	s.spillCount++
+	return nil
+}
+
+// restore merges all spilled bitmaps back into pending updates.
+func (s *indexSpill) restore(indexUpdates map[IndexName]*IndexUpdate) error {
+	for _, filePath := range s.files {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+
+		decomp := NewZSTDDecompressor(file)
+		dec := newIndexValueDecoder(decomp)
+		for {
+			var entry indexSpillEntry
+			err = dec.Decode(&entry)
+			if err != nil {
+				break
+			}
+
+			indexUpdate, ok := indexUpdates[entry.Index]
+			if !ok {
+				continue
+			}
+
+			bm := roaring64.New()
+			err = bm.UnmarshalBinary(entry.Bitmap)
+			if err != nil {
+				break
+			}
+
+			if _, ok := indexUpdate.Data[entry.Value]; !ok {
+				indexUpdate.Data[entry.Value] = roaring64.New()
+			}
+			indexUpdate.Data[entry.Value].Or(bm)
+		}
+
+		_ = decomp.Close()
+		_ = file.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+	return nil
+}
+
+// clear removes all spill files.
+func (s *indexSpill) clear() error {
+	for _, filePath := range s.files {
+		err := os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	s.files = nil
+	s.spilledBytes = 0
+	return nil
+}
+
+func (s *indexSpill) close() error {
+	if err := s.clear(); err != nil {
+		return err
+	}
+	if s.removeDir {
+		return os.RemoveAll(s.dir)
+	}
+	return nil
 }
@@ -0,0 +1,185 @@
+package ethwal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+var (
+	ErrIndexerLocked    = fmt.Errorf("indexer is locked")
+	ErrIndexerLeaseLost = fmt.Errorf("indexer lease lost")
+)
+
+// indexerLeaseFilePath is the path of the lease object in the indexes directory.
+const indexerLeaseFilePath = ".lease"
+
+// IndexerLockedError is returned by NewIndexer if another indexer holds the live lease of the indexes.
+type IndexerLockedError struct {
+	// Holder is the instance id of the indexer holding the lease.
+	Holder string
+	// ExpiresAt is the time the lease expires unless the holder refreshes it.
+	ExpiresAt time.Time
+}
+
+func (e *IndexerLockedError) Error() string {
+	return fmt.Sprintf("%s: held by %s until %s", ErrIndexerLocked, e.Holder, e.ExpiresAt.Format(time.RFC3339))
+}
+
+func (e *IndexerLockedError) Unwrap() error {
+	return ErrIndexerLocked
+}
+
+// indexerLeaseRecord is the content of the lease object, the expired record is free to be taken.
+type indexerLeaseRecord struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// indexerLease is the lease of the indexes held by the indexer, it's refreshed in the background every third
+// of its ttl until it's released.
+type indexerLease struct {
+	fs     storage.FS
+	holder string
+	ttl    time.Duration
+
+	mu        sync.Mutex
+	expiresAt time.Time
+	err       error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// acquireIndexerLease takes the lease of the indexes for the holder, it fails with IndexerLockedError if
+// another holder's lease hasn't expired.
+func acquireIndexerLease(ctx context.Context, fs storage.FS, holder string, ttl time.Duration) (*indexerLease, error) {
+	l := &indexerLease{
+		fs:     fs,
+		holder: holder,
+		ttl:    ttl,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	expiresAt, err := l.update(ctx, func(record indexerLeaseRecord, now time.Time) error {
+		if record.Holder != holder && now.Before(record.ExpiresAt) {
+			return &IndexerLockedError{Holder: record.Holder, ExpiresAt: record.ExpiresAt}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	l.expiresAt = expiresAt
+
+	go l.refreshLoop()
+	return l, nil
+}
+
+// update replaces the lease object with the holder's record expiring in ttl, if check allows it.
+func (l *indexerLease) update(ctx context.Context, check func(record indexerLeaseRecord, now time.Time) error) (time.Time, error) {
+	var expiresAt time.Time
+	err := storage.Update(ctx, l.fs, indexerLeaseFilePath, func(data []byte) ([]byte, error) {
+		var record indexerLeaseRecord
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &record); err != nil {
+				return nil, fmt.Errorf("failed to decode indexer lease: %w", err)
+			}
+		}
+
+		now := time.Now()
+		if err := check(record, now); err != nil {
+			return nil, err
+		}
+
+		expiresAt = now.Add(l.ttl)
+		return json.Marshal(indexerLeaseRecord{Holder: l.holder, ExpiresAt: expiresAt})
+	})
+	return expiresAt, err
+}
+
+// refresh extends the lease, it fails with ErrIndexerLeaseLost if another holder took it over.
+func (l *indexerLease) refresh(ctx context.Context) error {
+	expiresAt, err := l.update(ctx, func(record indexerLeaseRecord, now time.Time) error {
+		if record.Holder != l.holder {
+			return fmt.Errorf("%w: taken over by %s", ErrIndexerLeaseLost, record.Holder)
+		}
+		return nil
+	})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		// the lease that failed to refresh is still held until it expires, unless it was taken over
+		if l.err == nil && errors.Is(err, ErrIndexerLeaseLost) {
+			l.err = err
+		}
+		return err
+	}
+	if l.err == nil {
+		l.expiresAt = expiresAt
+	}
+	return nil
+}
+
+func (l *indexerLease) refreshLoop() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(max(l.ttl/3, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), l.ttl)
+			_ = l.refresh(ctx)
+			cancel()
+		}
+	}
+}
+
+// check returns the error if the lease was lost, taken over or expired without the refresh.
+func (l *indexerLease) check() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+	if time.Now().After(l.expiresAt) {
+		return fmt.Errorf("%w: expired at %s", ErrIndexerLeaseLost, l.expiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// stopRefresh stops the background refresh, the lease expires after its ttl.
+func (l *indexerLease) stopRefresh() {
+	select {
+	case <-l.stop:
+	default:
+		close(l.stop)
+	}
+	<-l.done
+}
+
+// release stops the refresh and expires the lease if it's still held, so the next indexer doesn't wait for
+// the expiry.
+func (l *indexerLease) release(ctx context.Context) error {
+	l.stopRefresh()
+
+	return storage.Update(ctx, l.fs, indexerLeaseFilePath, func(data []byte) ([]byte, error) {
+		var record indexerLeaseRecord
+		if err := json.Unmarshal(data, &record); err != nil || record.Holder != l.holder {
+			return nil, nil
+		}
+		return json.Marshal(indexerLeaseRecord{Holder: l.holder})
+	})
+}
@@ -0,0 +1,188 @@
+package ethwal
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/local"
+	"github.com/0xsequence/ethwal/storage/memory"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexer_Lease(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(indexTestDir)
+	}()
+
+	newOptions := func(name, instanceID string, ttl time.Duration) IndexerOptions[[]int] {
+		return IndexerOptions[[]int]{
+			Dataset:    Dataset{Path: path.Join(indexTestDir, name)},
+			Indexes:    generateMixedIntIndexes(),
+			InstanceID: instanceID,
+			LeaseTTL:   ttl,
+		}
+	}
+
+	t.Run("contention", func(t *testing.T) {
+		a, err := NewIndexer(context.Background(), newOptions("contention", "a", time.Minute))
+		require.NoError(t, err)
+
+		// the second indexer fails fast with the holder of the lease
+		started := time.Now()
+		_, err = NewIndexer(context.Background(), newOptions("contention", "b", time.Minute))
+		require.ErrorIs(t, err, ErrIndexerLocked)
+		require.Less(t, time.Since(started), time.Second)
+
+		var lockedErr *IndexerLockedError
+		require.ErrorAs(t, err, &lockedErr)
+		require.Equal(t, "a", lockedErr.Holder)
+		require.True(t, lockedErr.ExpiresAt.After(time.Now()))
+
+		for _, block := range generateMixedIntBlocks() {
+			require.NoError(t, a.Index(context.Background(), block))
+		}
+		require.NoError(t, a.Close(context.Background()))
+
+		// the released lease is taken without waiting for the expiry
+		b, err := NewIndexer(context.Background(), newOptions("contention", "b", time.Minute))
+		require.NoError(t, err)
+		require.NoError(t, b.Close(context.Background()))
+	})
+
+	t.Run("takeover_after_expiry", func(t *testing.T) {
+		const ttl = 300 * time.Millisecond
+
+		a, err := NewIndexer(context.Background(), newOptions("takeover", "a", ttl))
+		require.NoError(t, err)
+
+		// the stalled indexer doesn't refresh its lease
+		a.lease.stopRefresh()
+
+		_, err = NewIndexer(context.Background(), newOptions("takeover", "b", ttl))
+		require.ErrorIs(t, err, ErrIndexerLocked)
+
+		var b *Indexer[[]int]
+		require.Eventually(t, func() bool {
+			b, err = NewIndexer(context.Background(), newOptions("takeover", "b", ttl))
+			return err == nil
+		}, 10*ttl, ttl/10)
+
+		// the indexer that lost the lease doesn't flush
+		require.NoError(t, a.Index(context.Background(), generateMixedIntBlocks()[0]))
+		require.ErrorIs(t, a.Flush(context.Background()), ErrIndexerLeaseLost)
+		require.ErrorIs(t, a.Close(context.Background()), ErrIndexerLeaseLost)
+
+		// the lease is refreshed by the new holder past its ttl
+		time.Sleep(2 * ttl)
+		require.NoError(t, b.Index(context.Background(), generateMixedIntBlocks()[0]))
+		require.NoError(t, b.Flush(context.Background()))
+		require.NoError(t, b.Close(context.Background()))
+	})
+}
+
+// interleavedFS runs the competing write of the marker before the conditional write of the local file system,
+// or after the unconditional write of the file systems without the conditional writes.
+type interleavedFS struct {
+	storage.FS
+	compete func()
+}
+
+func (f *interleavedFS) interleave() {
+	if compete := f.compete; compete != nil {
+		f.compete = nil
+		compete()
+	}
+}
+
+func (f *interleavedFS) ReadVersion(ctx context.Context, path string) ([]byte, int64, error) {
+	return storage.ReadVersion(ctx, f.FS, path)
+}
+
+func (f *interleavedFS) CreateIfVersion(ctx context.Context, path string, data []byte, version int64, options *gostorage.WriterOptions) error {
+	f.interleave()
+	return storage.CreateIfVersion(ctx, f.FS, path, data, version, options)
+}
+
+func (f *interleavedFS) Create(ctx context.Context, path string, options *gostorage.WriterOptions) (io.WriteCloser, error) {
+	file, err := f.FS.Create(ctx, path, options)
+	if err != nil {
+		return nil, err
+	}
+	return &interleavedWriter{WriteCloser: file, fs: f}, nil
+}
+
+type interleavedWriter struct {
+	io.WriteCloser
+	fs *interleavedFS
+}
+
+func (w *interleavedWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	w.fs.interleave()
+	return nil
+}
+
+func TestIndex_StoreLastBlockNumIndexedInterleaved(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(indexTestDir)
+	}()
+
+	testCases := []struct {
+		name string
+		fs   storage.FS
+	}{
+		{name: "local", fs: local.NewLocalFS(path.Join(indexTestDir, "interleaved"))},
+		{name: "memory", fs: gostorage.NewMemoryFS()},
+		{name: "ethwal_memory", fs: memory.NewMemoryFS()},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &interleavedFS{FS: tc.fs}
+			slow := NewIndex[[]int]("all", indexAll)
+			fast := NewIndex[[]int]("all", indexAll)
+
+			require.NoError(t, slow.storeLastBlockNumIndexed(context.Background(), fs, 10))
+
+			// the fast indexer moves the marker to 200 while the slow one stores 100
+			fs.compete = func() {
+				require.NoError(t, fast.storeLastBlockNumIndexed(context.Background(), fs, 200))
+			}
+			require.NoError(t, slow.storeLastBlockNumIndexed(context.Background(), fs, 100))
+			require.Nil(t, fs.compete)
+
+			stored, err := slow.readLastBlockNumIndexed(context.Background(), fs)
+			require.NoError(t, err)
+			require.Equal(t, uint64(200), stored)
+
+			lastBlockNum, err := slow.LastBlockNumIndexed(context.Background(), fs)
+			require.NoError(t, err)
+			require.Equal(t, uint64(200), lastBlockNum)
+
+			// the stale marker is never written over the newer one
+			stale := NewIndex[[]int]("all", indexAll)
+			require.NoError(t, stale.storeLastBlockNumIndexed(context.Background(), fs, 150))
+			data, err := storageReadAll(fs, indexedBlockNumFilePath("all"))
+			require.NoError(t, err)
+			require.Equal(t, uint64(200), binary.BigEndian.Uint64(data))
+		})
+	}
+}
+
+func storageReadAll(fs storage.FS, path string) ([]byte, error) {
+	file, err := fs.Open(context.Background(), path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
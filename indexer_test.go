@@ -0,0 +1,496 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/memory"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/c2h5oh/datasize"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexer_MaxPendingBytes(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(indexTestDir)
+	}()
+
+	blocks := generateMixedIntBlocks()
+
+	indexBlocks := func(t *testing.T, opts IndexerOptions[[]int]) *Indexer[[]int] {
+		indexer, err := NewIndexer(context.Background(), opts)
+		require.NoError(t, err)
+
+		for _, block := range blocks {
+			err := indexer.Index(context.Background(), block)
+			require.NoError(t, err)
+		}
+
+		err = indexer.Close(context.Background())
+		require.NoError(t, err)
+		return indexer
+	}
+
+	fetchAll := func(t *testing.T, indexer *Indexer[[]int]) map[string][]uint64 {
+		values := []IndexedValue{"true", "false"}
+		for _, block := range blocks {
+			for _, value := range block.Data {
+				values = append(values, IndexedValue(fmt.Sprintf("%d", value)))
+			}
+		}
+
+		results := make(map[string][]uint64)
+		for name, idx := range indexer.indexes {
+			for _, value := range values {
+				bm, err := idx.Fetch(context.Background(), indexer.fs, value)
+				require.NoError(t, err)
+				results[fmt.Sprintf("%s/%s", name, value)] = bm.ToArray()
+			}
+		}
+		return results
+	}
+
+	expectedIndexer := indexBlocks(t, IndexerOptions[[]int]{
+		Dataset: Dataset{Path: path.Join(indexTestDir, "unconstrained")},
+		Indexes: generateMixedIntIndexes(),
+	})
+	expected := fetchAll(t, expectedIndexer)
+	require.NotEmpty(t, expected)
+
+	t.Run("flush", func(t *testing.T) {
+		indexer := indexBlocks(t, IndexerOptions[[]int]{
+			Dataset:         Dataset{Path: path.Join(indexTestDir, "flush")},
+			Indexes:         generateMixedIntIndexes(),
+			MaxPendingBytes: 64,
+			PendingMode:     IndexerPendingModeFlush,
+		})
+
+		stats := indexer.Stats()
+		require.Greater(t, stats.AutoFlushCount, uint64(0))
+		require.Equal(t, uint64(0), stats.SpillCount)
+		require.Equal(t, expected, fetchAll(t, indexer))
+	})
+
+	t.Run("spill", func(t *testing.T) {
+		spillPath := path.Join(indexTestDir, "spill-scratch")
+		indexer := indexBlocks(t, IndexerOptions[[]int]{
+			Dataset:         Dataset{Path: path.Join(indexTestDir, "spill")},
+			Indexes:         generateMixedIntIndexes(),
+			MaxPendingBytes: 64,
+			PendingMode:     IndexerPendingModeSpill,
+			SpillPath:       spillPath,
+		})
+
+		stats := indexer.Stats()
+		require.Greater(t, stats.SpillCount, uint64(0))
+		require.Equal(t, uint64(0), stats.AutoFlushCount)
+		require.Equal(t, uint64(0), uint64(stats.PendingBytes))
+		require.Equal(t, uint64(0), uint64(stats.SpilledBytes))
+		require.Equal(t, expected, fetchAll(t, indexer))
+
+		entries, err := os.ReadDir(spillPath)
+		require.NoError(t, err)
+		require.Len(t, entries, 0)
+	})
+}
+
+func TestIndexer_MaxPendingBytes_HighCardinality(t *testing.T) {
+	const (
+		numBlocks      = 80
+		valuesPerBlock = 20
+		maxPending     = 4 * datasize.KB
+	)
+
+	// every block has the values no other block has
+	blocks := make([]Block[[]int], 0, numBlocks)
+	for blockNum := uint64(1); blockNum <= numBlocks; blockNum++ {
+		data := make([]int, valuesPerBlock)
+		for i := range data {
+			data[i] = int(blockNum)*valuesPerBlock + i
+		}
+		blocks = append(blocks, Block[[]int]{Number: blockNum, Data: data})
+	}
+
+	indexBlocks := func(t *testing.T, maxPendingBytes datasize.ByteSize) (*Indexer[[]int], datasize.ByteSize) {
+		indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+			Dataset:         Dataset{Path: "ethwal"},
+			FileSystem:      memory.NewMemoryFS(),
+			Indexes:         Indexes[[]int]{"all": NewIndex[[]int]("all", indexBlock)},
+			MaxPendingBytes: maxPendingBytes,
+		})
+		require.NoError(t, err)
+
+		var peak datasize.ByteSize
+		for _, block := range blocks {
+			require.NoError(t, indexer.Index(context.Background(), block))
+			peak = max(peak, indexer.Stats().PendingBytes)
+		}
+		require.NoError(t, indexer.Flush(context.Background()))
+		return indexer, peak
+	}
+
+	fetchAll := func(t *testing.T, indexer *Indexer[[]int]) map[IndexedValue][]uint64 {
+		idx := indexer.indexes["all"]
+		results := make(map[IndexedValue][]uint64)
+		for _, block := range blocks {
+			for _, value := range block.Data {
+				indexValue := IndexedValue(fmt.Sprintf("%d", value))
+				bm, err := idx.Fetch(context.Background(), indexer.fs, indexValue)
+				require.NoError(t, err)
+				results[indexValue] = bm.ToArray()
+			}
+		}
+		return results
+	}
+
+	unconstrained, unconstrainedPeak := indexBlocks(t, 0)
+	require.Greater(t, unconstrainedPeak, maxPending)
+
+	// the pending updates are flushed by the Index call that crosses the limit, so they're below it in between
+	indexer, peak := indexBlocks(t, maxPending)
+	require.Less(t, peak, maxPending)
+	require.Greater(t, indexer.Stats().AutoFlushCount, uint64(0))
+	require.Equal(t, uint64(0), unconstrained.Stats().AutoFlushCount)
+	require.Equal(t, fetchAll(t, unconstrained), fetchAll(t, indexer))
+}
+
+// failingIndexFS fails the writes of the index file of the value and tracks the concurrent index file reads
+// of the index, or of all indexes if it's empty.
+type failingIndexFS struct {
+	storage.FS
+
+	mu          sync.Mutex
+	index       IndexName
+	failValue   IndexedValue
+	created     []string
+	reads       int
+	maxReads    int
+	readLatency time.Duration
+}
+
+func (f *failingIndexFS) Open(ctx context.Context, path string, options *gostorage.ReaderOptions) (*gostorage.File, error) {
+	if (f.index == "" || strings.Contains(path, "/"+string(f.index)+"/")) && strings.HasSuffix(path, ".idx") {
+		f.mu.Lock()
+		f.reads++
+		f.maxReads = max(f.maxReads, f.reads)
+		f.mu.Unlock()
+
+		time.Sleep(f.readLatency)
+
+		f.mu.Lock()
+		f.reads--
+		f.mu.Unlock()
+	}
+	return f.FS.Open(ctx, path, options)
+}
+
+func (f *failingIndexFS) Create(ctx context.Context, path string, options *gostorage.WriterOptions) (io.WriteCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failValue != "" && strings.Contains(path, "/"+string(f.index)+"/") && strings.HasSuffix(path, "/"+string(f.failValue)+".idx") {
+		return nil, fmt.Errorf("create failed: %s", path)
+	}
+	f.created = append(f.created, path)
+	return f.FS.Create(ctx, path, options)
+}
+
+func TestIndexer_FlushSharedStoreConcurrency(t *testing.T) {
+	fs := &failingIndexFS{FS: gostorage.NewMemoryFS(), readLatency: time.Millisecond}
+
+	indexValues := func(offset int) IndexFunction[[]int] {
+		return func(block Block[[]int]) (bool, map[IndexedValue][]Position, error) {
+			indexValueMap := make(map[IndexedValue][]Position)
+			for i, value := range block.Data {
+				indexValueMap[IndexedValue(fmt.Sprintf("%d", value+offset))] = []Position{OrdinalPosition(i)}
+			}
+			return true, indexValueMap, nil
+		}
+	}
+	opt := IndexerOptions[[]int]{
+		Dataset:    Dataset{Path: "ethwal"},
+		FileSystem: fs,
+		Indexes: Indexes[[]int]{
+			"first":  NewIndex[[]int]("first", indexValues(0)),
+			"second": NewIndex[[]int]("second", indexValues(1000)),
+			"third":  NewIndex[[]int]("third", indexValues(2000)),
+		},
+		MaxStoreConcurrency: 4,
+	}
+
+	indexer, err := NewIndexer(context.Background(), opt)
+	require.NoError(t, err)
+	for blockNum := uint64(1); blockNum <= 5; blockNum++ {
+		var data []int
+		for value := 0; value < 8; value++ {
+			data = append(data, int(blockNum)*10+value)
+		}
+		require.NoError(t, indexer.Index(context.Background(), Block[[]int]{Number: blockNum, Data: data}))
+	}
+	require.NoError(t, indexer.Flush(context.Background()))
+
+	// the limit is shared by the indexes flushed together
+	require.Greater(t, fs.maxReads, 1)
+	require.LessOrEqual(t, fs.maxReads, 4)
+	require.Equal(t, uint64(5), indexer.FlushedBlockNum())
+}
+
+func TestIndexer_FlushPartialFailure(t *testing.T) {
+	fs := &failingIndexFS{FS: gostorage.NewMemoryFS(), index: "values", failValue: "13", readLatency: time.Millisecond}
+
+	indexValues := func(block Block[[]int]) (bool, map[IndexedValue][]Position, error) {
+		indexValueMap := make(map[IndexedValue][]Position)
+		for i, value := range block.Data {
+			indexValue := IndexedValue(fmt.Sprintf("%d", value))
+			indexValueMap[indexValue] = append(indexValueMap[indexValue], OrdinalPosition(i))
+		}
+		return true, indexValueMap, nil
+	}
+	opt := IndexerOptions[[]int]{
+		Dataset:    Dataset{Path: "ethwal"},
+		FileSystem: fs,
+		Indexes: Indexes[[]int]{
+			"values":   NewIndex[[]int]("values", indexValues),
+			"odd_even": NewIndex[[]int]("odd_even", indexOddEvenBlocks),
+		},
+		MaxStoreConcurrency: 4,
+	}
+
+	indexer, err := NewIndexer(context.Background(), opt)
+	require.NoError(t, err)
+	for blockNum := uint64(1); blockNum <= 5; blockNum++ {
+		var data []int
+		for value := 0; value < 8; value++ {
+			data = append(data, int(blockNum)*10+value)
+		}
+		require.NoError(t, indexer.Index(context.Background(), Block[[]int]{Number: blockNum, Data: data}))
+	}
+
+	// the failed value is reported, the other values and indexes are stored
+	err = indexer.Flush(context.Background())
+	require.Error(t, err)
+	var storeErr *IndexStoreError
+	require.ErrorAs(t, err, &storeErr)
+	require.Equal(t, IndexName("values"), storeErr.Index)
+	require.Len(t, storeErr.Values, 1)
+	require.Contains(t, storeErr.Values, IndexedValue("13"))
+	require.Contains(t, err.Error(), "index values: failed to store 1 values: 13:")
+
+	// the index files were written concurrently up to the limit
+	require.Greater(t, fs.maxReads, 1)
+	require.LessOrEqual(t, fs.maxReads, 4)
+
+	// the last block indexed is stored only for the index without failures
+	indexFs := storage.NewPrefixWrapper(fs.FS, fmt.Sprintf("%s/", path.Join(opt.Dataset.FullPath(), IndexesDirectory)))
+	readIndexed := func(name IndexName) uint64 {
+		idx := opt.Indexes[name]
+		blockNum, err := idx.readLastBlockNumIndexed(context.Background(), indexFs)
+		require.NoError(t, err)
+		return blockNum
+	}
+	require.Zero(t, readIndexed("values"))
+	require.Equal(t, uint64(5), readIndexed("odd_even"))
+	require.Zero(t, indexer.FlushedBlockNum())
+
+	// the retry writes the failed value only
+	fs.mu.Lock()
+	fs.failValue = ""
+	fs.created = nil
+	fs.mu.Unlock()
+
+	require.NoError(t, indexer.Flush(context.Background()))
+	var createdIndexFiles []string
+	for _, created := range fs.created {
+		if strings.HasSuffix(created, ".idx") {
+			createdIndexFiles = append(createdIndexFiles, path.Base(created))
+		}
+	}
+	require.Equal(t, []string{"13.idx"}, createdIndexFiles)
+	require.Equal(t, uint64(5), readIndexed("values"))
+	require.Equal(t, uint64(5), indexer.FlushedBlockNum())
+
+	for _, value := range []IndexedValue{"13", "14", "57"} {
+		idx := opt.Indexes["values"]
+		bm, err := idx.Fetch(context.Background(), indexFs, value)
+		require.NoError(t, err)
+		require.False(t, bm.IsEmpty(), value)
+	}
+	require.NoError(t, indexer.Close(context.Background()))
+}
+
+func TestPruneIndexes(t *testing.T) {
+	_, indexes, _, cleanup, err := setupMockData(generateIntIndexes, generateIntBlocks)
+	require.NoError(t, err)
+	defer cleanup()
+
+	err = PruneIndexes(context.Background(), IndexerOptions[[]int]{
+		Dataset: Dataset{Path: indexTestDir},
+		Indexes: indexes,
+	}, 50)
+	require.NoError(t, err)
+
+	// value 10 is only in blocks 9 and 10, its index file is deleted
+	_, err = os.Stat(path.Join(indexTestDir, IndexesDirectory, indexPath("all", "10")))
+	require.True(t, os.IsNotExist(err))
+
+	blocks := func(result FilterIterator) []uint64 {
+		var blockNums []uint64
+		for result.HasNext() {
+			blockNum, _ := result.Next()
+			blockNums = append(blockNums, blockNum)
+		}
+		return blockNums
+	}
+
+	f, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset: Dataset{Path: indexTestDir},
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+
+	result := f.Eq("all", "10").Eval(context.Background())
+	require.True(t, result.Bitmap().IsEmpty())
+
+	// value 50 is in blocks 49 and 50, only block 50 is retained
+	result = f.Eq("all", "50").Eval(context.Background())
+	require.Equal(t, []uint64{50}, blocks(result))
+
+	result = f.Eq("all", "60").Eval(context.Background())
+	require.Equal(t, []uint64{59, 60}, blocks(result))
+
+	// lower boundary doesn't move the retention floor back
+	err = PruneIndexes(context.Background(), IndexerOptions[[]int]{
+		Dataset: Dataset{Path: indexTestDir},
+		Indexes: indexes,
+	}, 10)
+	require.NoError(t, err)
+
+	f, err = NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset: Dataset{Path: indexTestDir},
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+
+	result = f.Eq("all", "50").Eval(context.Background())
+	require.Equal(t, []uint64{50}, blocks(result))
+}
+
+func TestIndexer_BlockNumBoundary(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(indexTestDir)
+	}()
+
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+		Dataset: Dataset{Path: indexTestDir},
+		Indexes: generateIntIndexes(),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, indexer.Index(context.Background(), Block[[]int]{Number: MaxSupportedBlockNum - 1, Data: []int{1}}))
+	require.NoError(t, indexer.Index(context.Background(), Block[[]int]{Number: MaxSupportedBlockNum, Data: []int{1}}))
+	require.ErrorIs(t, indexer.Index(context.Background(), Block[[]int]{Number: MaxSupportedBlockNum + 1, Data: []int{1}}), ErrBlockNumOutOfRange)
+	require.NoError(t, indexer.Flush(context.Background()))
+	require.Equal(t, MaxSupportedBlockNum, indexer.BlockNum())
+
+	f, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset: Dataset{Path: indexTestDir},
+		Indexes: generateIntIndexes(),
+	})
+	require.NoError(t, err)
+
+	result := f.Eq("all", "1").Eval(context.Background())
+	blockNum, _ := result.Next()
+	require.Equal(t, MaxSupportedBlockNum-1, blockNum)
+	blockNum, _ = result.Next()
+	require.Equal(t, MaxSupportedBlockNum, blockNum)
+	require.False(t, result.HasNext())
+}
+
+func FuzzIndexCompoundID(f *testing.F) {
+	f.Add(uint64(0), uint16(0))
+	f.Add(MaxSupportedBlockNum-1, uint16(1))
+	f.Add(MaxSupportedBlockNum, uint16(math.MaxUint16))
+
+	f.Fuzz(func(t *testing.T, blockNum uint64, dataIndex uint16) {
+		if validateBlockNum(blockNum) != nil {
+			return
+		}
+
+		gotBlockNum, gotDataIndex := NewIndexCompoundID(blockNum, dataIndex).Split()
+		require.Equal(t, blockNum, gotBlockNum)
+		require.Equal(t, dataIndex, gotDataIndex)
+	})
+}
+
+func TestIndexer_RetryableIndex(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(indexTestDir)
+	}()
+
+	type lookupKey struct{}
+
+	// the lookup of block 3 fails once
+	var lookups []uint64
+	failures := map[uint64]int{3: 1}
+	indexes := Indexes[[]int]{
+		"lookup": NewIndexWithContext[[]int]("lookup", func(ctx context.Context, block Block[[]int]) (bool, map[IndexedValue][]Position, error) {
+			require.Equal(t, "lookup", ctx.Value(lookupKey{}))
+			lookups = append(lookups, block.Number)
+			if failures[block.Number] > 0 {
+				failures[block.Number]--
+				return false, nil, fmt.Errorf("lookup timed out: %w", ErrRetryableIndex)
+			}
+			return true, map[IndexedValue][]Position{"block": Ordinals(IndexAllDataIndexes)}, nil
+		}),
+		"all": NewIndex[[]int]("all", indexAll),
+	}
+
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+		Dataset: Dataset{Path: indexTestDir},
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+
+	ctx := context.WithValue(context.Background(), lookupKey{}, "lookup")
+	blocks := generateIntBlocks()[1:6]
+	for _, block := range blocks[:2] {
+		require.NoError(t, indexer.Index(ctx, block))
+	}
+
+	require.ErrorIs(t, indexer.Index(ctx, blocks[2]), ErrRetryableIndex)
+	require.Equal(t, uint64(2), indexer.BlockNum())
+
+	// the later blocks aren't indexed before the failed one
+	require.ErrorIs(t, indexer.Index(ctx, blocks[3]), ErrRetryableIndex)
+	require.NoError(t, indexer.Flush(ctx))
+	require.Equal(t, uint64(2), indexer.FlushedBlockNum())
+
+	// the retried block isn't skipped as indexed
+	for _, block := range blocks[2:] {
+		require.NoError(t, indexer.Index(ctx, block))
+	}
+	require.NoError(t, indexer.Close(ctx))
+	require.Equal(t, []uint64{1, 2, 3, 3, 4, 5}, lookups)
+
+	f, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset: Dataset{Path: indexTestDir},
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+	var blockNums []uint64
+	it := f.Eq("lookup", "block").Eval(context.Background())
+	for it.HasNext() {
+		blockNum, _ := it.Next()
+		blockNums = append(blockNums, blockNum)
+	}
+	require.Equal(t, []uint64{1, 2, 3, 4, 5}, blockNums)
+}
@@ -0,0 +1,83 @@
+package ethwal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+)
+
+// Instance identifies a reader, writer or indexer instance and the dataset it operates on.
+type Instance struct {
+	// ID is the unique instance id, provided by Options.InstanceID or generated.
+	ID string
+	// Dataset is the dataset name and version.
+	Dataset string
+	// PathDigest is the short digest of the dataset full path.
+	PathDigest string
+}
+
+func newInstance(id string, dataset Dataset) Instance {
+	if id == "" {
+		var b [8]byte
+		_, _ = rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+	}
+
+	pathDigest := sha256.Sum256([]byte(dataset.FullPath()))
+	return Instance{
+		ID:         id,
+		Dataset:    path.Join(dataset.Name, dataset.Version),
+		PathDigest: hex.EncodeToString(pathDigest[:4]),
+	}
+}
+
+func (i Instance) String() string {
+	return fmt.Sprintf("id=%s dataset=%s path=%s", i.ID, i.Dataset, i.PathDigest)
+}
+
+// wrapError attaches the instance identity to the error. The errors that already carry
+// an instance identity are returned unchanged, so that the innermost identity is preserved.
+// io.EOF is not wrapped as it is used as a sentinel value.
+func (i Instance) wrapError(err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+
+	var instanceErr *InstanceError
+	if errors.As(err, &instanceErr) {
+		return err
+	}
+	return &InstanceError{Instance: i, Err: err}
+}
+
+// InstanceError is an error returned by a reader, writer or indexer instance.
+type InstanceError struct {
+	Instance Instance
+	Err      error
+}
+
+func (e *InstanceError) Error() string {
+	return fmt.Sprintf("ethwal[%s]: %s", e.Instance, e.Err)
+}
+
+func (e *InstanceError) Unwrap() error {
+	return e.Err
+}
+
+type instanceContextKey struct{}
+
+// ContextWithInstance returns a copy of ctx that carries the instance identity.
+func ContextWithInstance(ctx context.Context, instance Instance) context.Context {
+	return context.WithValue(ctx, instanceContextKey{}, instance)
+}
+
+// InstanceFromContext returns the instance identity passed to the hooks.
+func InstanceFromContext(ctx context.Context) (Instance, bool) {
+	instance, ok := ctx.Value(instanceContextKey{}).(Instance)
+	return instance, ok
+}
@@ -0,0 +1,142 @@
+package ethwal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/local"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+// readOnlyFS is a file system that fails to create files.
+type readOnlyFS struct {
+	storage.FS
+}
+
+func (r readOnlyFS) Create(ctx context.Context, path string, options *gostorage.WriterOptions) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("read only file system")
+}
+
+func requireInstanceError(t *testing.T, err error, id string) {
+	t.Helper()
+
+	var instanceErr *InstanceError
+	require.True(t, errors.As(err, &instanceErr), "error %v has no instance identity", err)
+	require.Equal(t, id, instanceErr.Instance.ID)
+}
+
+func TestInstanceError(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	instanceIDs := []string{"instance-a", "instance-b"}
+
+	// instances run concurrently, the group waits for all of them
+	t.Run("group", func(t *testing.T) {
+		for _, id := range instanceIDs {
+			t.Run(id, func(t *testing.T) {
+				t.Parallel()
+
+				datasetPath := path.Join(testPath, id)
+				require.NoError(t, os.MkdirAll(datasetPath, 0755))
+
+				// writer
+				w, err := NewWriter[int](Options{
+					Dataset:    Dataset{Path: datasetPath},
+					FileSystem: readOnlyFS{FS: local.NewLocalFS("")},
+					InstanceID: id,
+				})
+				require.NoError(t, err)
+				require.Equal(t, id, w.ID().ID)
+
+				require.NoError(t, w.Write(context.Background(), Block[int]{Number: 1}))
+				requireInstanceError(t, w.RollFile(context.Background()), id)
+
+				// wrapped writers propagate the innermost identity
+				wng := NewWriterNoGap(w)
+				require.Equal(t, id, wng.ID().ID)
+				requireInstanceError(t, wng.RollFile(context.Background()), id)
+
+				_, err = NewWriterWithIndexer(wng, &Indexer[int]{instance: newInstance("indexer", Dataset{})})
+				requireInstanceError(t, err, id)
+
+				// indexer
+				indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+					Dataset:    Dataset{Path: datasetPath},
+					FileSystem: readOnlyFS{FS: local.NewLocalFS("")},
+					Indexes:    generateMixedIntIndexes(),
+					InstanceID: id + "-indexer",
+				})
+				require.NoError(t, err)
+				require.NoError(t, indexer.Index(context.Background(), generateMixedIntBlocks()[0]))
+				requireInstanceError(t, indexer.Flush(context.Background()), id+"-indexer")
+
+				// reader
+				opt := Options{
+					Dataset:         Dataset{Path: datasetPath},
+					FileRollOnClose: true,
+					InstanceID:      id,
+				}
+
+				lw, err := NewWriter[int](opt)
+				require.NoError(t, err)
+				require.NoError(t, lw.Write(context.Background(), Block[int]{Number: 1}))
+				require.NoError(t, lw.Close(context.Background()))
+
+				// corrupt the data file, so that it can't be decoded
+				require.NoError(t, os.WriteFile(path.Join(datasetPath, (&File{FirstBlockNum: 1, LastBlockNum: 1}).Path()), []byte{0xff, 0xff}, 0644))
+
+				r, err := NewReader[int](opt)
+				require.NoError(t, err)
+				require.Equal(t, id, r.ID().ID)
+
+				_, err = r.Read(context.Background())
+				requireInstanceError(t, err, id)
+
+				rf, err := NewReaderWithFilter(r, &filter{})
+				require.NoError(t, err)
+				require.Equal(t, id, rf.ID().ID)
+			})
+		}
+	})
+}
+
+func TestInstanceError_PreservesInnermostIdentity(t *testing.T) {
+	inner := newInstance("inner", Dataset{Name: "blocks", Version: "v1", Path: "/data"})
+	outer := newInstance("outer", Dataset{Path: "/data"})
+
+	err := outer.wrapError(fmt.Errorf("outer context: %w", inner.wrapError(fmt.Errorf("boom"))))
+	requireInstanceError(t, err, "inner")
+	require.Contains(t, err.Error(), "id=inner dataset=blocks/v1")
+
+	require.Nil(t, inner.wrapError(nil))
+}
+
+func TestInstanceFromContext(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	var hookInstance Instance
+	w, err := NewWriter[int](Options{
+		Dataset:         Dataset{Path: testPath},
+		FileRollOnClose: true,
+		InstanceID:      "writer",
+		OnFileWritten: func(ctx context.Context, file *File, stats FileStats) {
+			hookInstance, _ = InstanceFromContext(ctx)
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, w.Write(context.Background(), Block[int]{Number: 1}))
+	require.NoError(t, w.Close(context.Background()))
+
+	require.Equal(t, w.ID(), hookInstance)
+}
@@ -0,0 +1,68 @@
+// Package toolconfig builds the dataset config of the ethwal tools from the config file and the command line
+// flags, the flags set override the config file.
+package toolconfig
+
+import (
+	"github.com/0xsequence/ethwal"
+	"github.com/urfave/cli/v2"
+)
+
+// DatasetFlags are the flags of the dataset config of the tool, the nil flags aren't read.
+type DatasetFlags struct {
+	Config            *cli.StringFlag
+	Path              *cli.StringFlag
+	Name              *cli.StringFlag
+	Version           *cli.StringFlag
+	GoogleCloudBucket *cli.StringFlag
+	S3Bucket          *cli.StringFlag
+	S3Endpoint        *cli.StringFlag
+	CachePath         *cli.StringFlag
+	Preset            *cli.StringFlag
+}
+
+// DatasetConfig returns the config of the dataset, the config file of the config flag overridden by the dataset
+// flags set.
+func DatasetConfig(c *cli.Context, flags DatasetFlags) (ethwal.OptionsConfig, error) {
+	var config ethwal.OptionsConfig
+	if flags.Config != nil {
+		if path := c.String(flags.Config.Name); path != "" {
+			var err error
+			config, err = ethwal.ReadOptionsConfig(path)
+			if err != nil {
+				return ethwal.OptionsConfig{}, err
+			}
+		}
+	}
+
+	overrideFlag(c, flags.Path, &config.Path)
+	overrideFlag(c, flags.Name, &config.Name)
+	overrideFlag(c, flags.Version, &config.Version)
+	overrideFlag(c, flags.GoogleCloudBucket, &config.GoogleCloudBucket)
+	overrideFlag(c, flags.S3Bucket, &config.S3Bucket)
+	overrideFlag(c, flags.S3Endpoint, &config.S3Endpoint)
+	overrideFlag(c, flags.CachePath, &config.CachePath)
+	overrideFlag(c, flags.Preset, &config.Preset)
+	return config, nil
+}
+
+// overrideFlag sets the value of the config to the value of the flag if it's set.
+func overrideFlag(c *cli.Context, flag *cli.StringFlag, value *string) {
+	if flag != nil && c.IsSet(flag.Name) {
+		*value = c.String(flag.Name)
+	}
+}
+
+// WithCodec returns the config with the codec and the compression of the flags, the flags set override the
+// config and their defaults apply unless the config sets them. The preset sets both, the flags are ignored.
+func WithCodec(c *cli.Context, config ethwal.OptionsConfig, codecFlag, compressionFlag *cli.StringFlag) ethwal.OptionsConfig {
+	if config.Preset != "" {
+		return config
+	}
+	if c.IsSet(codecFlag.Name) || (config.Encoding == "" && config.CBORPreset == "") {
+		config.Encoding, config.CBORPreset = c.String(codecFlag.Name), ""
+	}
+	if c.IsSet(compressionFlag.Name) || config.Compression == "" {
+		config.Compression = c.String(compressionFlag.Name)
+	}
+	return config
+}
@@ -0,0 +1,125 @@
+package ethwal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+var ErrInvariantViolated = fmt.Errorf("dataset invariant violated")
+
+// CheckInvariants checks that the dataset and its indexes are consistent:
+//   - the files in the file index are ordered, don't overlap and exist, including their bloom filters, and
+//     aren't empty
+//   - the indexes don't reach past the last file and don't reference blocks past the last indexed block
+//   - the examined block marks don't reach past the last file
+func CheckInvariants[T any](ctx context.Context, opt Options, indexerOpt ...IndexerOptions[T]) error {
+	opt = opt.WithDefaults()
+	fs := storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath())
+
+	fileIndex := NewFileIndex(fs)
+	err := fileIndex.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load file index: %w", err)
+	}
+
+	var lastBlockNum uint64
+	for i, file := range fileIndex.Files() {
+		if file.FirstBlockNum > file.LastBlockNum {
+			return fmt.Errorf("%w: file[%d-%d] has invalid block range", ErrInvariantViolated, file.FirstBlockNum, file.LastBlockNum)
+		}
+		if i > 0 && file.FirstBlockNum <= lastBlockNum {
+			return fmt.Errorf("%w: file[%d-%d] overlaps the previous file", ErrInvariantViolated, file.FirstBlockNum, file.LastBlockNum)
+		}
+		size, err := file.Size(ctx, fs)
+		if errors.Is(err, ErrFileNotExist) {
+			return fmt.Errorf("%w: file[%d-%d] doesn't exist", ErrInvariantViolated, file.FirstBlockNum, file.LastBlockNum)
+		}
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return fmt.Errorf("%w: file[%d-%d]: %w", ErrInvariantViolated, file.FirstBlockNum, file.LastBlockNum, ErrEmptyFile)
+		}
+		if file.Bloom {
+			_, err = fs.Attributes(ctx, file.BloomPath(), nil)
+			if err != nil {
+				return fmt.Errorf("%w: bloom filter of file[%d-%d] doesn't exist", ErrInvariantViolated, file.FirstBlockNum, file.LastBlockNum)
+			}
+		}
+		if file.DigestRoot != nil {
+			_, err = fs.Attributes(ctx, file.DigestsPath(), nil)
+			if err != nil {
+				return fmt.Errorf("%w: block digests of file[%d-%d] don't exist", ErrInvariantViolated, file.FirstBlockNum, file.LastBlockNum)
+			}
+		}
+		lastBlockNum = file.LastBlockNum
+	}
+
+	for _, iOpt := range indexerOpt {
+		iOpt = iOpt.WithDefaults()
+		indexFs := storage.NewPrefixWrapper(iOpt.FileSystem, fmt.Sprintf("%s/", path.Join(iOpt.Dataset.FullPath(), IndexesDirectory)))
+
+		for _, index := range iOpt.Indexes {
+			err = checkIndexInvariants(ctx, indexFs, index, lastBlockNum)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	presence := newPresenceStore(fs)
+	return snapshotWalk(ctx, fs, PresenceDirectory, func(objectPath string) error {
+		shardFrom, err := strconv.ParseUint(strings.TrimSuffix(path.Base(objectPath), ".idx"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid presence shard %s", ErrInvariantViolated, objectPath)
+		}
+
+		bmap, err := presence.readShard(ctx, shardFrom/presenceShardSize)
+		if err != nil {
+			return err
+		}
+		if !bmap.IsEmpty() && bmap.Maximum() > lastBlockNum {
+			return fmt.Errorf("%w: block %d is marked examined past the last file block %d", ErrInvariantViolated, bmap.Maximum(), lastBlockNum)
+		}
+		return nil
+	})
+}
+
+func checkIndexInvariants[T any](ctx context.Context, fs storage.FS, index Index[T], lastBlockNum uint64) error {
+	lastBlockNumIndexed, err := index.readLastBlockNumIndexed(ctx, fs)
+	if err != nil {
+		return fmt.Errorf("failed to read last block number indexed for %s: %w", index.Name(), err)
+	}
+	if lastBlockNumIndexed > lastBlockNum {
+		return fmt.Errorf("%w: index %s is at block %d past the last file block %d", ErrInvariantViolated, index.Name(), lastBlockNumIndexed, lastBlockNum)
+	}
+
+	seal, err := readIndexSeal(ctx, fs, index.Name())
+	if err != nil {
+		return fmt.Errorf("failed to read seal of %s: %w", index.Name(), err)
+	}
+	if seal != nil && seal.BlockNum > lastBlockNumIndexed+1 {
+		return fmt.Errorf("%w: index %s is sealed at block %d past the last indexed block %d", ErrInvariantViolated, index.Name(), seal.BlockNum, lastBlockNumIndexed)
+	}
+
+	return snapshotWalk(ctx, fs, string(index.Name()), func(objectPath string) error {
+		if !isIndexObject(objectPath) {
+			return nil
+		}
+
+		metadata, err := (&IndexFile{fs: fs, path: objectPath}).Metadata(ctx)
+		if err != nil {
+			return err
+		}
+		if metadata.Cardinality > 0 && metadata.MaxBlockNum > lastBlockNumIndexed {
+			return fmt.Errorf("%w: index file %s references block %d past the last indexed block %d", ErrInvariantViolated, objectPath, metadata.MaxBlockNum, lastBlockNumIndexed)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,236 @@
+package ethwal
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+)
+
+const defaultIOSchedulerChunkSize = 64 * datasize.KB
+
+// IOSchedulerOptions configures the IOScheduler.
+type IOSchedulerOptions struct {
+	// IdleWindow is the time the foreground reads must be idle before the prefetch proceeds. If zero, the
+	// prefetch proceeds whenever no foreground read is in progress.
+	IdleWindow time.Duration
+	// ChunkSize is the size of the prefetch reads, the prefetch yields to the foreground between them.
+	// Defaults to 64KB.
+	ChunkSize datasize.ByteSize
+}
+
+func (o IOSchedulerOptions) WithDefaults() IOSchedulerOptions {
+	o.ChunkSize = cmp.Or(o.ChunkSize, defaultIOSchedulerChunkSize)
+	return o
+}
+
+// IOSchedulerStats contains cumulative IO scheduler statistics.
+type IOSchedulerStats struct {
+	// PrefetchPauses is the number of times the prefetch yielded to the foreground reads.
+	PrefetchPauses uint64
+	// PrefetchPausedTime is the total time the prefetch waited for the foreground reads.
+	PrefetchPausedTime time.Duration
+	// PrefetchedBytes is the total number of bytes read by the prefetch.
+	PrefetchedBytes uint64
+	// ForegroundStallTime is the total time the foreground reads waited for the file being prefetched.
+	ForegroundStallTime time.Duration
+}
+
+// IOScheduler gives the foreground reads of the current file priority over the background prefetch of
+// the next files. The prefetch reads the file in chunks and pauses while a foreground read is in progress
+// or until the foreground is idle for IOSchedulerOptions.IdleWindow, unless the foreground waits for the
+// prefetched file. The scheduler can be shared by the readers competing for the same bandwidth, see
+// Options.IOScheduler.
+type IOScheduler struct {
+	options IOSchedulerOptions
+
+	mu sync.Mutex
+	// active is the number of the foreground reads in progress, waiting is the number of the foreground
+	// reads waiting for the prefetch
+	active         int
+	waiting        int
+	lastForeground time.Time
+	// changed is closed and replaced whenever the foreground state changes
+	changed chan struct{}
+
+	prefetchPauses      atomic.Uint64
+	prefetchPausedTime  atomic.Int64
+	prefetchedBytes     atomic.Uint64
+	foregroundStallTime atomic.Int64
+}
+
+func NewIOScheduler(opt IOSchedulerOptions) *IOScheduler {
+	return &IOScheduler{
+		options: opt.WithDefaults(),
+		changed: make(chan struct{}),
+	}
+}
+
+// Stats returns the scheduler statistics.
+func (s *IOScheduler) Stats() IOSchedulerStats {
+	if s == nil {
+		return IOSchedulerStats{}
+	}
+	return IOSchedulerStats{
+		PrefetchPauses:      s.prefetchPauses.Load(),
+		PrefetchPausedTime:  time.Duration(s.prefetchPausedTime.Load()),
+		PrefetchedBytes:     s.prefetchedBytes.Load(),
+		ForegroundStallTime: time.Duration(s.foregroundStallTime.Load()),
+	}
+}
+
+func (s *IOScheduler) update(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn()
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *IOScheduler) beginForeground() {
+	if s == nil {
+		return
+	}
+	s.update(func() { s.active++ })
+}
+
+func (s *IOScheduler) endForeground() {
+	if s == nil {
+		return
+	}
+	s.update(func() {
+		s.active--
+		s.lastForeground = time.Now()
+	})
+}
+
+// waitPrefetch waits for the prefetch the foreground depends on, the prefetch doesn't yield meanwhile.
+func (s *IOScheduler) waitPrefetch(done <-chan struct{}) {
+	if s == nil {
+		<-done
+		return
+	}
+
+	start := time.Now()
+	s.update(func() { s.waiting++ })
+	<-done
+	s.update(func() { s.waiting-- })
+	s.foregroundStallTime.Add(int64(time.Since(start)))
+}
+
+// yield blocks the prefetch until the foreground allows it to proceed.
+func (s *IOScheduler) yield(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	var pausedAt time.Time
+	for {
+		s.mu.Lock()
+		proceed, wait := s.prefetchAllowed()
+		changed := s.changed
+		s.mu.Unlock()
+
+		if proceed {
+			if !pausedAt.IsZero() {
+				s.prefetchPausedTime.Add(int64(time.Since(pausedAt)))
+			}
+			return nil
+		}
+		if pausedAt.IsZero() {
+			pausedAt = time.Now()
+			s.prefetchPauses.Add(1)
+		}
+
+		err := waitChanged(ctx, changed, wait)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// waitChanged waits for the foreground state change or the timeout if non-zero.
+func waitChanged(ctx context.Context, changed <-chan struct{}, timeout time.Duration) error {
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-changed:
+	case <-timeoutCh:
+	}
+	return nil
+}
+
+// prefetchAllowed reports whether the prefetch can proceed, otherwise it returns the time until the idle
+// window passes, or zero if the foreground read is in progress.
+func (s *IOScheduler) prefetchAllowed() (bool, time.Duration) {
+	if s.waiting > 0 {
+		return true, 0
+	}
+	if s.active > 0 {
+		return false, 0
+	}
+
+	idle := time.Since(s.lastForeground)
+	if idle >= s.options.IdleWindow {
+		return true, 0
+	}
+	return false, s.options.IdleWindow - idle
+}
+
+// readAll reads the prefetched file in chunks, yielding to the foreground before each chunk. The read fails
+// with the context error once the context is done.
+func (s *IOScheduler) readAll(ctx context.Context, r io.Reader) ([]byte, error) {
+	if s == nil {
+		return io.ReadAll(&contextReader{ctx: ctx, r: r})
+	}
+
+	var buf bytes.Buffer
+	for {
+		err := s.yield(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := io.CopyN(&buf, &contextReader{ctx: ctx, r: r}, int64(s.options.ChunkSize))
+		s.prefetchedBytes.Add(uint64(n))
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// foreground marks the reads of r as the foreground reads.
+func (s *IOScheduler) foreground(r io.ReadCloser) io.ReadCloser {
+	if s == nil {
+		return r
+	}
+	return &foregroundReader{ReadCloser: r, scheduler: s}
+}
+
+type foregroundReader struct {
+	io.ReadCloser
+
+	scheduler *IOScheduler
+}
+
+func (f *foregroundReader) Read(p []byte) (int, error) {
+	f.scheduler.beginForeground()
+	defer f.scheduler.endForeground()
+	return f.ReadCloser.Read(p)
+}
@@ -0,0 +1,164 @@
+package ethwal
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/c2h5oh/datasize"
+	"github.com/stretchr/testify/require"
+)
+
+// bandwidthLimitedFS simulates a link of the given bandwidth shared by all reads of the file system.
+type bandwidthLimitedFS struct {
+	storage.FS
+
+	link      sync.Mutex
+	bandwidth int // bytes per second
+}
+
+func (b *bandwidthLimitedFS) Open(ctx context.Context, path string, options *gostorage.ReaderOptions) (*gostorage.File, error) {
+	file, err := b.FS.Open(ctx, path, options)
+	if err != nil {
+		return nil, err
+	}
+	file.ReadCloser = &bandwidthLimitedReader{ReadCloser: file.ReadCloser, fs: b}
+	return file, nil
+}
+
+type bandwidthLimitedReader struct {
+	io.ReadCloser
+
+	fs *bandwidthLimitedFS
+}
+
+func (r *bandwidthLimitedReader) Read(p []byte) (int, error) {
+	// the link transfers up to 16KB at once
+	if len(p) > 16*1024 {
+		p = p[:16*1024]
+	}
+
+	r.fs.link.Lock()
+	defer r.fs.link.Unlock()
+
+	n, err := r.ReadCloser.Read(p)
+	time.Sleep(time.Duration(n) * time.Second / time.Duration(r.fs.bandwidth))
+	return n, err
+}
+
+func TestIOScheduler(t *testing.T) {
+	scheduler := NewIOScheduler(IOSchedulerOptions{IdleWindow: 50 * time.Millisecond})
+
+	yielded := func() chan error {
+		done := make(chan error, 1)
+		go func() { done <- scheduler.yield(context.Background()) }()
+		return done
+	}
+
+	// the prefetch waits for the foreground read and the idle window
+	scheduler.beginForeground()
+	done := yielded()
+	time.Sleep(20 * time.Millisecond)
+	require.Empty(t, done)
+
+	start := time.Now()
+	scheduler.endForeground()
+	require.NoError(t, <-done)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// the prefetch proceeds if the foreground waits for it
+	scheduler.beginForeground()
+	done = yielded()
+	time.Sleep(20 * time.Millisecond)
+	require.Empty(t, done)
+
+	prefetched, waited := make(chan struct{}), make(chan struct{})
+	go func() {
+		scheduler.waitPrefetch(prefetched)
+		close(waited)
+	}()
+	require.NoError(t, <-done)
+	close(prefetched)
+	<-waited
+	scheduler.endForeground()
+
+	// the prefetch stops with the context
+	scheduler.beginForeground()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, scheduler.yield(ctx), context.Canceled)
+	scheduler.endForeground()
+
+	stats := scheduler.Stats()
+	require.Equal(t, uint64(3), stats.PrefetchPauses)
+	require.GreaterOrEqual(t, stats.PrefetchPausedTime, 50*time.Millisecond)
+	require.NotZero(t, stats.ForegroundStallTime)
+}
+
+func TestIOScheduler_Reader(t *testing.T) {
+	const (
+		numFiles      = 6
+		blocksPerFile = 16
+		blockSize     = 16 * 1024
+	)
+
+	memFs := gostorage.NewMemoryFS()
+	w, err := NewWriter[[]byte](Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      memFs,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(blocksPerFile),
+		FileRollOnClose: true,
+	})
+	require.NoError(t, err)
+	for blockNum := uint64(1); blockNum <= numFiles*blocksPerFile; blockNum++ {
+		data := make([]byte, blockSize)
+		_, _ = rand.Read(data)
+		require.NoError(t, w.Write(context.Background(), Block[[]byte]{Number: blockNum, Data: data}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	// scan reads the dataset over the link of 16MB/s processing every block for 2ms, it returns the total
+	// time and the max foreground read latency
+	scan := func(disablePrefetch bool) (time.Duration, time.Duration, IOSchedulerStats) {
+		scheduler := NewIOScheduler(IOSchedulerOptions{ChunkSize: 16 * datasize.KB})
+		r, err := NewReader[[]byte](Options{
+			Dataset:         Dataset{Path: "ethwal"},
+			FileSystem:      &bandwidthLimitedFS{FS: memFs, bandwidth: 16 * 1024 * 1024},
+			DisablePrefetch: disablePrefetch,
+			IOScheduler:     scheduler,
+		})
+		require.NoError(t, err)
+		defer r.Close()
+
+		var maxLatency time.Duration
+		start := time.Now()
+		for {
+			readStart := time.Now()
+			_, err := r.Read(context.Background())
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			maxLatency = max(maxLatency, time.Since(readStart))
+
+			time.Sleep(2 * time.Millisecond)
+		}
+		return time.Since(start), maxLatency, scheduler.Stats()
+	}
+
+	baselineTime, baselineLatency, baselineStats := scan(true)
+	prefetchTime, prefetchLatency, prefetchStats := scan(false)
+
+	require.Zero(t, baselineStats.PrefetchedBytes)
+	require.NotZero(t, prefetchStats.PrefetchedBytes)
+	require.NotZero(t, prefetchStats.PrefetchPauses)
+
+	// the prefetch doesn't slow down the foreground reads and overlaps the IO with the processing
+	require.Less(t, prefetchLatency, 2*baselineLatency)
+	require.Less(t, prefetchTime, baselineTime)
+}
@@ -0,0 +1,111 @@
+package ethwal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// legacyJSONFieldAliases are the block field names of the JSON datasets written by the tools preceding ethwal,
+// keyed by the canonical field names. The reader applies them to the blocks without any canonical field.
+var legacyJSONFieldAliases = map[string]string{
+	"blockHash": "hash",
+	"blockNum":  "number",
+	"blockTS":   "timestamp",
+	"blockData": "data",
+}
+
+// jsonAliasDecoder renames the legacy top level fields of the JSON blocks to the canonical ones, the block
+// data is not touched.
+type jsonAliasDecoder struct {
+	dec *json.Decoder
+
+	// aliases are the configured legacy field names keyed by the canonical field names
+	aliases map[string]string
+	// onLegacy is called when the block is decoded with legacyJSONFieldAliases
+	onLegacy func()
+	// useNumber decodes the numbers as json.Number, see NewJSONNumberDecoder
+	useNumber bool
+}
+
+// newBlockDecoder returns the decoder of the blocks, the JSON decoders rename the fields by
+// Options.JSONFieldAliases and legacyJSONFieldAliases. Other decoders are returned as is.
+func newBlockDecoder(opt Options, r io.Reader, onLegacy func()) Decoder {
+	switch dec := opt.NewDecoder(r).(type) {
+	case *json.Decoder:
+		return &jsonAliasDecoder{dec: dec, aliases: opt.JSONFieldAliases, onLegacy: onLegacy}
+	case jsonNumberDecoder:
+		return &jsonAliasDecoder{dec: dec.Decoder, aliases: opt.JSONFieldAliases, onLegacy: onLegacy, useNumber: true}
+	default:
+		return dec
+	}
+}
+
+func (d *jsonAliasDecoder) Decode(v any) error {
+	var raw json.RawMessage
+	err := d.dec.Decode(&raw)
+	if err != nil {
+		return err
+	}
+
+	data, err := d.rename(raw)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if d.useNumber {
+		dec.UseNumber()
+	}
+	return dec.Decode(v)
+}
+
+// rename returns the block with the aliased fields renamed, or the block as is if there is nothing to rename.
+func (d *jsonAliasDecoder) rename(raw json.RawMessage) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(raw, &fields) != nil {
+		// not an object, decoding of the block reports the error
+		return raw, nil
+	}
+
+	renamed := renameJSONFields(fields, d.aliases)
+
+	legacy := false
+	if !hasAnyJSONField(fields, legacyJSONFieldAliases) {
+		legacy = renameJSONFields(fields, legacyJSONFieldAliases)
+	}
+
+	if !renamed && !legacy {
+		return raw, nil
+	}
+	if legacy && d.onLegacy != nil {
+		d.onLegacy()
+	}
+	return json.Marshal(fields)
+}
+
+// renameJSONFields renames the legacy fields whose canonical fields are absent, it reports whether any
+// field was renamed.
+func renameJSONFields(fields map[string]json.RawMessage, aliases map[string]string) bool {
+	renamed := false
+	for canonical, legacy := range aliases {
+		if _, ok := fields[canonical]; ok {
+			continue
+		}
+		if value, ok := fields[legacy]; ok {
+			fields[canonical] = value
+			delete(fields, legacy)
+			renamed = true
+		}
+	}
+	return renamed
+}
+
+// hasAnyJSONField reports whether any canonical field of the aliases is present.
+func hasAnyJSONField(fields map[string]json.RawMessage, aliases map[string]string) bool {
+	for canonical := range aliases {
+		if _, ok := fields[canonical]; ok {
+			return true
+		}
+	}
+	return false
+}
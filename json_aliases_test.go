@@ -0,0 +1,181 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+type legacyJSONBlock struct {
+	Hash      common.Hash    `json:"hash"`
+	Number    uint64         `json:"number"`
+	Timestamp uint64         `json:"timestamp"`
+	Data      map[string]int `json:"data"`
+}
+
+type customJSONBlock struct {
+	Hash   common.Hash    `json:"h"`
+	Number uint64         `json:"n"`
+	TS     uint64         `json:"ts"`
+	Data   map[string]int `json:"blockData"`
+}
+
+// jsonAliasTestData has keys matching the block field names, they must not be renamed.
+func jsonAliasTestData(blockNum uint64) map[string]int {
+	return map[string]int{"number": int(blockNum) * 2, "hash": 1, "blockNum": 3}
+}
+
+func jsonAliasTestBlock(blockNum uint64) Block[map[string]int] {
+	return Block[map[string]int]{
+		Hash:   common.BytesToHash([]byte{byte(blockNum)}),
+		Number: blockNum,
+		TS:     blockNum * 12,
+		Data:   jsonAliasTestData(blockNum),
+	}
+}
+
+// writeJSONFixture writes the files of the blocks encoded by the encode function and the file index.
+func writeJSONFixture(t *testing.T, fs storage.FS, fileRanges [][2]uint64, encode func(b Block[map[string]int]) any) {
+	var files []*File
+	for _, fileRange := range fileRanges {
+		file := &File{FirstBlockNum: fileRange[0], LastBlockNum: fileRange[1]}
+
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for blockNum := fileRange[0]; blockNum <= fileRange[1]; blockNum++ {
+			require.NoError(t, enc.Encode(encode(jsonAliasTestBlock(blockNum))))
+		}
+
+		w, err := file.Create(context.Background(), fs)
+		require.NoError(t, err)
+		_, err = w.Write(buf.Bytes())
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		files = append(files, file)
+	}
+	require.NoError(t, NewFileIndexFromFiles(fs, files).Save(context.Background()))
+}
+
+func encodeLegacyJSONBlock(b Block[map[string]int]) any {
+	return legacyJSONBlock{Hash: b.Hash, Number: b.Number, Timestamp: b.TS, Data: b.Data}
+}
+
+func encodeCanonicalJSONBlock(b Block[map[string]int]) any {
+	return b
+}
+
+// readJSONFixture reads all blocks and returns them with the log output of the reader.
+func readJSONFixture(t *testing.T, opt Options) ([]Block[map[string]int], string) {
+	var logs bytes.Buffer
+	defer func(w io.Writer) { log.SetOutput(w) }(log.Writer())
+	log.SetOutput(&logs)
+
+	r, err := NewReader[map[string]int](opt)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var blocks []Block[map[string]int]
+	for {
+		b, err := r.Read(context.Background())
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		blocks = append(blocks, b)
+	}
+	return blocks, logs.String()
+}
+
+func requireJSONAliasTestBlocks(t *testing.T, blocks []Block[map[string]int], from, to uint64) {
+	require.Len(t, blocks, int(to-from+1))
+	for i, b := range blocks {
+		require.Equal(t, jsonAliasTestBlock(from+uint64(i)), b)
+	}
+}
+
+func TestJSONFieldAliases(t *testing.T) {
+	newOptions := func(fs storage.FS) Options {
+		return Options{
+			Dataset:    Dataset{Path: "ethwal"},
+			FileSystem: fs,
+			NewEncoder: NewJSONEncoder,
+			NewDecoder: NewJSONDecoder,
+		}
+	}
+
+	t.Run("legacy", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+		writeJSONFixture(t, storage.NewPrefixWrapper(fs, "ethwal/"), [][2]uint64{{1, 5}, {6, 10}}, encodeLegacyJSONBlock)
+
+		blocks, logs := readJSONFixture(t, newOptions(fs))
+		requireJSONAliasTestBlocks(t, blocks, 1, 10)
+		require.Equal(t, 1, strings.Count(logs, "legacy json field names"))
+
+		// the warning fires once per reader
+		_, logs = readJSONFixture(t, newOptions(fs))
+		require.Equal(t, 1, strings.Count(logs, "legacy json field names"))
+	})
+
+	t.Run("mixed", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+		prefixFs := storage.NewPrefixWrapper(fs, "ethwal/")
+		writeJSONFixture(t, prefixFs, [][2]uint64{{1, 10}}, func(b Block[map[string]int]) any {
+			if b.Number%2 == 0 {
+				return encodeLegacyJSONBlock(b)
+			}
+			return encodeCanonicalJSONBlock(b)
+		})
+
+		blocks, logs := readJSONFixture(t, newOptions(fs))
+		requireJSONAliasTestBlocks(t, blocks, 1, 10)
+		require.Equal(t, 1, strings.Count(logs, "legacy json field names"))
+	})
+
+	t.Run("canonical", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+		writeJSONFixture(t, storage.NewPrefixWrapper(fs, "ethwal/"), [][2]uint64{{1, 5}, {6, 10}}, encodeCanonicalJSONBlock)
+
+		blocks, logs := readJSONFixture(t, newOptions(fs))
+		requireJSONAliasTestBlocks(t, blocks, 1, 10)
+		require.Empty(t, logs)
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+		writeJSONFixture(t, storage.NewPrefixWrapper(fs, "ethwal/"), [][2]uint64{{1, 10}}, func(b Block[map[string]int]) any {
+			return customJSONBlock{Hash: b.Hash, Number: b.Number, TS: b.TS, Data: b.Data}
+		})
+
+		opt := newOptions(fs)
+		opt.JSONFieldAliases = map[string]string{"blockHash": "h", "blockNum": "n", "blockTS": "ts"}
+		blocks, logs := readJSONFixture(t, opt)
+		requireJSONAliasTestBlocks(t, blocks, 1, 10)
+		require.Empty(t, logs)
+	})
+
+	t.Run("cbor", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+		opt := Options{Dataset: Dataset{Path: "ethwal"}, FileSystem: fs, FileRollOnClose: true}
+		w, err := NewWriter[map[string]int](opt)
+		require.NoError(t, err)
+		for blockNum := uint64(1); blockNum <= 10; blockNum++ {
+			require.NoError(t, w.Write(context.Background(), jsonAliasTestBlock(blockNum)))
+		}
+		require.NoError(t, w.Close(context.Background()))
+
+		opt.JSONFieldAliases = map[string]string{"blockNum": "number"}
+		blocks, logs := readJSONFixture(t, opt)
+		requireJSONAliasTestBlocks(t, blocks, 1, 10)
+		require.Empty(t, logs)
+	})
+}
@@ -0,0 +1,169 @@
+package ethwal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+const DatasetManifestFileName = ".manifest"
+
+// The encodings and the compressions of the dataset manifest. The custom encoders and compressors are not
+// recorded.
+const (
+	ManifestEncodingCBOR    = "cbor"
+	ManifestEncodingJSON    = "json"
+	ManifestCompressionZSTD = "zstd"
+	ManifestCompressionNone = "none"
+)
+
+var ErrManifestMismatch = fmt.Errorf("options don't match the dataset manifest")
+
+// DatasetManifest describes how the dataset is written, it's stored in DatasetManifestFileName by the writer
+// once it writes the first file. The readers without the decoder or the decompressor use the ones of the
+// manifest, the datasets without the manifest are read with the options as they are.
+type DatasetManifest struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	// Encoding is ManifestEncodingCBOR or ManifestEncodingJSON, empty for the custom encoder.
+	Encoding string `json:"encoding,omitempty"`
+	// Compression is ManifestCompressionZSTD or ManifestCompressionNone, empty for the custom compressor.
+	Compression string `json:"compression,omitempty"`
+	// FirstBlockNum is the first block number of the first file of the dataset.
+	FirstBlockNum uint64 `json:"firstBlockNum"`
+	// Dictionary is set if the dataset has the compression dictionary, see WriteDictionary.
+	Dictionary bool `json:"dictionary,omitempty"`
+}
+
+// ReadDatasetManifest returns the manifest of the dataset, or nil if the dataset doesn't have it.
+func ReadDatasetManifest(ctx context.Context, opt Options) (*DatasetManifest, error) {
+	opt = opt.WithDefaults()
+	return readDatasetManifest(ctx, storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()))
+}
+
+func readDatasetManifest(ctx context.Context, fs storage.FS) (*DatasetManifest, error) {
+	file, err := fs.Open(ctx, DatasetManifestFileName, nil)
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open dataset manifest: %w", err)
+	}
+	defer file.Close()
+
+	var manifest DatasetManifest
+	err = json.NewDecoder(file).Decode(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode dataset manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+func writeDatasetManifest(ctx context.Context, fs storage.FS, manifest DatasetManifest) error {
+	file, err := fs.Create(ctx, DatasetManifestFileName, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create dataset manifest: %w", err)
+	}
+
+	err = json.NewEncoder(file).Encode(manifest)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to encode dataset manifest: %w", err)
+	}
+	return file.Close()
+}
+
+// newDatasetManifest returns the manifest of the dataset written with the options.
+func newDatasetManifest(opt Options, firstBlockNum uint64) DatasetManifest {
+	return DatasetManifest{
+		Name:          opt.Dataset.Name,
+		Version:       opt.Dataset.Version,
+		Encoding:      encoderEncoding(opt),
+		Compression:   compressorCompression(opt.NewCompressor),
+		FirstBlockNum: firstBlockNum,
+	}
+}
+
+// checkWriter returns ErrManifestMismatch if the writer of the options encodes or compresses the files
+// differently than the manifest.
+func (m *DatasetManifest) checkWriter(opt Options) error {
+	return m.check(encoderEncoding(opt), compressorCompression(opt.NewCompressor))
+}
+
+// configureReader sets the decoder and the decompressor of the manifest, unless they're set. The set ones
+// that don't match the manifest fail with ErrManifestMismatch.
+func (m *DatasetManifest) configureReader(opt *Options, setDecoder bool) error {
+	if setDecoder {
+		// the cbor decoder is the default, so are the decoders of the cbor presets
+		if m.Encoding == ManifestEncodingJSON {
+			opt.NewDecoder = NewJSONDecoder
+		}
+	}
+	if opt.NewDecompressor == nil && m.Compression == ManifestCompressionZSTD {
+		opt.NewDecompressor = NewZSTDDecompressor
+	}
+	return m.check(decoderEncoding(*opt), decompressorCompression(opt.NewDecompressor))
+}
+
+func (m *DatasetManifest) check(encoding, compression string) error {
+	if encoding != "" && m.Encoding != "" && encoding != m.Encoding {
+		return fmt.Errorf("%w: encoding %s, dataset encoding %s", ErrManifestMismatch, encoding, m.Encoding)
+	}
+	if compression != "" && m.Compression != "" && compression != m.Compression {
+		return fmt.Errorf("%w: compression %s, dataset compression %s", ErrManifestMismatch, compression, m.Compression)
+	}
+	return nil
+}
+
+func encoderEncoding(opt Options) string {
+	switch {
+	case opt.CBORPreset != "", sameFunc(opt.NewEncoder, NewCBOREncoder):
+		return ManifestEncodingCBOR
+	case sameFunc(opt.NewEncoder, NewJSONEncoder):
+		return ManifestEncodingJSON
+	default:
+		return ""
+	}
+}
+
+func decoderEncoding(opt Options) string {
+	switch {
+	case opt.CBORPreset != "", sameFunc(opt.NewDecoder, NewCBORDecoder):
+		return ManifestEncodingCBOR
+	case sameFunc(opt.NewDecoder, NewJSONDecoder), sameFunc(opt.NewDecoder, NewJSONNumberDecoder):
+		return ManifestEncodingJSON
+	default:
+		return ""
+	}
+}
+
+func compressorCompression(newCompressor NewCompressorFunc) string {
+	switch {
+	case newCompressor == nil:
+		return ManifestCompressionNone
+	case sameFunc(newCompressor, NewZSTDCompressor), sameFunc(newCompressor, NewZSTDCompressorWithDict(nil)):
+		return ManifestCompressionZSTD
+	default:
+		return ""
+	}
+}
+
+func decompressorCompression(newDecompressor NewDecompressorFunc) string {
+	switch {
+	case newDecompressor == nil:
+		return ManifestCompressionNone
+	case sameFunc(newDecompressor, NewZSTDDecompressor), sameFunc(newDecompressor, NewZSTDDecompressorWithDict(nil)):
+		return ManifestCompressionZSTD
+	default:
+		return ""
+	}
+}
+
+// sameFunc reports whether the functions are the same top-level function, the closures of the same function
+// literal are the same.
+func sameFunc[F any](a, b F) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
@@ -0,0 +1,80 @@
+package ethwal
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatasetManifest(t *testing.T) {
+	fs := gostorage.NewMemoryFS()
+	dataset := Dataset{Name: "blocks", Version: "v1", Path: "ethwal"}
+
+	readAll := func(t *testing.T, opt Options) []Block[[]int] {
+		r, err := NewReader[[]int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		var blocks []Block[[]int]
+		for {
+			b, err := r.Read(context.Background())
+			if err == io.EOF {
+				return blocks
+			}
+			require.NoError(t, err)
+			blocks = append(blocks, b)
+		}
+	}
+
+	w, err := NewWriter[[]int](Options{
+		Dataset:         dataset,
+		FileSystem:      fs,
+		NewEncoder:      NewJSONEncoder,
+		NewCompressor:   NewZSTDCompressor,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(20),
+		FileRollOnClose: true,
+	})
+	require.NoError(t, err)
+
+	// the manifest is recorded with the first file
+	manifest, err := ReadDatasetManifest(context.Background(), Options{Dataset: dataset, FileSystem: fs})
+	require.NoError(t, err)
+	require.Nil(t, manifest)
+
+	blocks := generateMixedIntBlocks()[10:40]
+	for _, b := range blocks {
+		require.NoError(t, w.Write(context.Background(), b))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	manifest, err = ReadDatasetManifest(context.Background(), Options{Dataset: dataset, FileSystem: fs})
+	require.NoError(t, err)
+	require.Equal(t, &DatasetManifest{
+		Name:          "blocks",
+		Version:       "v1",
+		Encoding:      ManifestEncodingJSON,
+		Compression:   ManifestCompressionZSTD,
+		FirstBlockNum: 1,
+	}, manifest)
+
+	// the reader without the decoder and the decompressor uses the ones of the manifest
+	require.Equal(t, blocks, readAll(t, Options{Dataset: dataset, FileSystem: fs}))
+	require.Equal(t, blocks, readAll(t, Options{Dataset: dataset, FileSystem: fs, NewDecoder: NewJSONDecoder, NewDecompressor: NewZSTDDecompressor}))
+
+	// the conflicting options fail
+	_, err = NewReader[[]int](Options{Dataset: dataset, FileSystem: fs, NewDecoder: NewCBORDecoder})
+	require.ErrorIs(t, err, ErrManifestMismatch)
+	_, err = NewWriter[[]int](Options{Dataset: dataset, FileSystem: fs, NewCompressor: NewZSTDCompressor})
+	require.ErrorIs(t, err, ErrManifestMismatch)
+	_, err = NewWriter[[]int](Options{Dataset: dataset, FileSystem: fs, NewEncoder: NewJSONEncoder})
+	require.ErrorIs(t, err, ErrManifestMismatch)
+
+	// the dataset without the manifest is read with the options as they are
+	require.NoError(t, fs.Delete(context.Background(), dataset.FullPath()+DatasetManifestFileName))
+	_, err = NewReader[[]int](Options{Dataset: dataset, FileSystem: fs, NewDecoder: NewCBORDecoder})
+	require.NoError(t, err)
+	require.Equal(t, blocks, readAll(t, Options{Dataset: dataset, FileSystem: fs, NewDecoder: NewJSONDecoder, NewDecompressor: NewZSTDDecompressor}))
+}
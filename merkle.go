@@ -0,0 +1,101 @@
+package ethwal
+
+import (
+	"crypto/sha256"
+	"math/bits"
+)
+
+// The Merkle tree of the block digests follows RFC 6962, the leaf and the node hashes are prefixed with
+// distinct bytes, so that a node can't be presented as a leaf.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleProof is the audit path of the leaf in the Merkle tree of the block digests of the file.
+type MerkleProof struct {
+	// Index is the position of the leaf in the tree.
+	Index int
+	// Size is the number of the leaves of the tree.
+	Size int
+	// Path are the sibling hashes from the leaf to the root.
+	Path [][32]byte
+}
+
+// Verify reports whether the proof connects the leaf digest to the root.
+func (p MerkleProof) Verify(root [32]byte, digest [32]byte) bool {
+	if p.Index < 0 || p.Index >= p.Size {
+		return false
+	}
+
+	fn, sn := uint64(p.Index), uint64(p.Size-1)
+	hash := merkleLeafHash(digest)
+	for _, sibling := range p.Path {
+		if sn == 0 {
+			return false
+		}
+
+		if fn&1 == 1 || fn == sn {
+			hash = merkleNodeHash(sibling, hash)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			hash = merkleNodeHash(hash, sibling)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && hash == root
+}
+
+// merkleRoot returns the root of the Merkle tree of the digests.
+func merkleRoot(digests [][32]byte) [32]byte {
+	switch len(digests) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return merkleLeafHash(digests[0])
+	}
+
+	k := merkleSplit(len(digests))
+	return merkleNodeHash(merkleRoot(digests[:k]), merkleRoot(digests[k:]))
+}
+
+// merkleProof returns the audit path of the digest at index.
+func merkleProof(digests [][32]byte, index int) MerkleProof {
+	return MerkleProof{Index: index, Size: len(digests), Path: merklePath(digests, index)}
+}
+
+func merklePath(digests [][32]byte, index int) [][32]byte {
+	if len(digests) <= 1 {
+		return nil
+	}
+
+	k := merkleSplit(len(digests))
+	if index < k {
+		return append(merklePath(digests[:k], index), merkleRoot(digests[k:]))
+	}
+	return append(merklePath(digests[k:], index-k), merkleRoot(digests[:k]))
+}
+
+// merkleSplit returns the largest power of two smaller than n.
+func merkleSplit(n int) int {
+	return 1 << (bits.Len(uint(n-1)) - 1)
+}
+
+func merkleLeafHash(digest [32]byte) [32]byte {
+	var data [1 + 32]byte
+	data[0] = merkleLeafPrefix
+	copy(data[1:], digest[:])
+	return sha256.Sum256(data[:])
+}
+
+func merkleNodeHash(left, right [32]byte) [32]byte {
+	var data [1 + 32 + 32]byte
+	data[0] = merkleNodePrefix
+	copy(data[1:], left[:])
+	copy(data[33:], right[:])
+	return sha256.Sum256(data[:])
+}
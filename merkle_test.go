@@ -0,0 +1,62 @@
+package ethwal
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func merkleTestDigests(n int) [][32]byte {
+	digests := make([][32]byte, n)
+	for i := range digests {
+		digests[i] = sha256.Sum256(binary.BigEndian.AppendUint64(nil, uint64(i)))
+	}
+	return digests
+}
+
+func TestMerkleRoot(t *testing.T) {
+	digests := merkleTestDigests(3)
+
+	require.Equal(t, sha256.Sum256(nil), merkleRoot(nil))
+	require.Equal(t, merkleLeafHash(digests[0]), merkleRoot(digests[:1]))
+	require.Equal(t, merkleNodeHash(merkleLeafHash(digests[0]), merkleLeafHash(digests[1])), merkleRoot(digests[:2]))
+	require.Equal(t,
+		merkleNodeHash(merkleNodeHash(merkleLeafHash(digests[0]), merkleLeafHash(digests[1])), merkleLeafHash(digests[2])),
+		merkleRoot(digests),
+	)
+
+	// the leaf can't be presented as a node
+	require.NotEqual(t, merkleRoot(digests[:2]), merkleRoot([][32]byte{merkleRoot(digests[:2])}))
+}
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 40; n++ {
+		digests := merkleTestDigests(n)
+		root := merkleRoot(digests)
+
+		for i := range digests {
+			proof := merkleProof(digests, i)
+			require.True(t, proof.Verify(root, digests[i]), "size %d index %d", n, i)
+
+			// other leaf
+			other := sha256.Sum256([]byte("other"))
+			require.False(t, proof.Verify(root, other), "size %d index %d", n, i)
+
+			// other position
+			if n > 1 {
+				moved := proof
+				moved.Index = (i + 1) % n
+				require.False(t, moved.Verify(root, digests[i]), "size %d index %d", n, i)
+			}
+
+			// truncated path
+			if len(proof.Path) > 0 {
+				truncated := proof
+				truncated.Path = proof.Path[:len(proof.Path)-1]
+				require.False(t, truncated.Verify(root, digests[i]), "size %d index %d", n, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0xsequence/ethwal"
+)
+
+// metric is the gauge family written in the Prometheus text format.
+type metric struct {
+	name    string
+	help    string
+	samples []sample
+}
+
+type sample struct {
+	labels [][2]string
+	value  float64
+}
+
+func (m *metric) add(value float64, labels ...[2]string) {
+	m.samples = append(m.samples, sample{labels: labels, value: value})
+}
+
+func (m *metric) writeTo(w io.Writer) {
+	if len(m.samples) == 0 {
+		return
+	}
+
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+	for _, s := range m.samples {
+		labels := make([]string, 0, len(s.labels))
+		for _, label := range s.labels {
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, label[0], labelValueEscaper.Replace(label[1])))
+		}
+		_, _ = fmt.Fprintf(w, "%s{%s} %s\n", m.name, strings.Join(labels, ","), strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+// labelValueEscaper escapes the label values of the text format.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// MetricsHandler returns http.Handler that serves the gauges of the datasets in the Prometheus text format.
+// The ages and the staleness gauges are computed at the scrape time. The staleness gauge of each configured
+// check is 1 while the check fails, so the alerting rule is ethwal_stale == 1.
+func (p *Poller) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := p.now()
+
+		up := &metric{name: "ethwal_up", help: "Whether the last poll of the dataset succeeded."}
+		polled := &metric{name: "ethwal_poll_timestamp_seconds", help: "Time of the last successful poll of the dataset."}
+		head := &metric{name: "ethwal_head_block", help: "Last block number stored in the dataset, including the tail."}
+		headAge := &metric{name: "ethwal_head_block_age_seconds", help: "Age of the head block by its timestamp."}
+		heartbeatAge := &metric{name: "ethwal_heartbeat_age_seconds", help: "Age of the last update of the file index or the tail."}
+		indexLag := &metric{name: "ethwal_index_lag_blocks", help: "Number of blocks the index is behind the head."}
+		gaps := &metric{name: "ethwal_gap_count", help: "Number of block ranges between the files not covered by any file."}
+		files := &metric{name: "ethwal_file_count", help: "Number of files of the dataset."}
+		growth := &metric{name: "ethwal_file_growth_rate", help: "Files added per second between the last two polls."}
+		verified := &metric{name: "ethwal_verification_ok", help: "Whether the last verification of the dataset passed."}
+		verifiedAt := &metric{name: "ethwal_verification_timestamp_seconds", help: "Time of the last verification of the dataset."}
+		stale := &metric{name: "ethwal_stale", help: "Whether the staleness check of the dataset fails."}
+
+		for _, state := range p.States() {
+			dataset := [2]string{"dataset", state.Name}
+
+			up.add(boolValue(state.Err == nil), dataset)
+			if !state.PolledAt.IsZero() {
+				polled.add(float64(state.PolledAt.Unix()), dataset)
+				head.add(float64(state.HeadBlockNum), dataset)
+				files.add(float64(state.Status.FileCount), dataset)
+				gaps.add(float64(state.Status.GapCount), dataset)
+				growth.add(state.FileGrowthRate, dataset)
+
+				indexes := make([]ethwal.IndexName, 0, len(state.Status.Indexes))
+				lags := state.IndexLag()
+				for name := range lags {
+					indexes = append(indexes, name)
+				}
+				sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+				for _, name := range indexes {
+					indexLag.add(float64(lags[name]), dataset, [2]string{"index", string(name)})
+				}
+			}
+			if !state.HeadBlockTime.IsZero() {
+				headAge.add(now.Sub(state.HeadBlockTime).Seconds(), dataset)
+			}
+			if !state.Status.UpdatedAt.IsZero() {
+				heartbeatAge.add(now.Sub(state.Status.UpdatedAt).Seconds(), dataset)
+			}
+			if !state.VerifiedAt.IsZero() {
+				verified.add(boolValue(state.VerifyErr == nil), dataset)
+				verifiedAt.add(float64(state.VerifiedAt.Unix()), dataset)
+			}
+
+			failed := make(map[string]bool)
+			for _, check := range state.Stale(now) {
+				failed[check] = true
+			}
+			for _, check := range configuredChecks(state.Thresholds) {
+				stale.add(boolValue(failed[check]), dataset, [2]string{"check", check})
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range []*metric{up, polled, head, headAge, heartbeatAge, indexLag, gaps, files, growth, verified, verifiedAt, stale} {
+			m.writeTo(w)
+		}
+	})
+}
+
+func configuredChecks(t Thresholds) []string {
+	var checks []string
+	if t.MaxHeadAge > 0 {
+		checks = append(checks, CheckHeadAge)
+	}
+	if t.MaxHeartbeatAge > 0 {
+		checks = append(checks, CheckHeartbeatAge)
+	}
+	if t.MaxIndexLag > 0 {
+		checks = append(checks, CheckIndexLag)
+	}
+	return checks
+}
+
+// Health is the summary of the datasets served by HealthHandler.
+type Health struct {
+	Healthy  bool            `json:"healthy"`
+	Datasets []DatasetHealth `json:"datasets"`
+}
+
+// DatasetHealth is the health of the dataset.
+type DatasetHealth struct {
+	Name         string    `json:"name"`
+	Healthy      bool      `json:"healthy"`
+	HeadBlockNum uint64    `json:"headBlockNum"`
+	PolledAt     time.Time `json:"polledAt"`
+	Stale        []string  `json:"stale,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	VerifyError  string    `json:"verifyError,omitempty"`
+}
+
+// Health returns the health of the datasets at the time.
+func (p *Poller) Health() Health {
+	now := p.now()
+
+	health := Health{Healthy: true}
+	for _, state := range p.States() {
+		dataset := DatasetHealth{
+			Name:         state.Name,
+			Healthy:      state.Healthy(now),
+			HeadBlockNum: state.HeadBlockNum,
+			PolledAt:     state.PolledAt,
+			Stale:        state.Stale(now),
+		}
+		if state.Err != nil {
+			dataset.Error = state.Err.Error()
+		}
+		if state.VerifyErr != nil {
+			dataset.VerifyError = state.VerifyErr.Error()
+		}
+
+		health.Healthy = health.Healthy && dataset.Healthy
+		health.Datasets = append(health.Datasets, dataset)
+	}
+	return health
+}
+
+// HealthHandler returns http.Handler that serves Health as JSON. It responds with
+// http.StatusServiceUnavailable if any dataset isn't healthy.
+func (p *Poller) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health := p.Health()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(health)
+	})
+}
@@ -0,0 +1,269 @@
+// Package monitor polls the status of the datasets and exports their freshness and completeness as the
+// Prometheus gauges, so that the ingesters don't have to embed the metrics.
+package monitor
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/0xsequence/ethwal"
+	"golang.org/x/sync/errgroup"
+)
+
+const defaultInterval = 30 * time.Second
+
+const (
+	// CheckHeadAge is the staleness check of the age of the head block, see Thresholds.MaxHeadAge.
+	CheckHeadAge = "head_age"
+	// CheckHeartbeatAge is the staleness check of the age of the last update, see Thresholds.MaxHeartbeatAge.
+	CheckHeartbeatAge = "heartbeat_age"
+	// CheckIndexLag is the staleness check of the index lag, see Thresholds.MaxIndexLag.
+	CheckIndexLag = "index_lag"
+)
+
+// Thresholds are the staleness thresholds of the dataset, the zero thresholds aren't checked.
+type Thresholds struct {
+	// MaxHeadAge is the maximal age of the head block, by its timestamp.
+	MaxHeadAge time.Duration
+	// MaxHeartbeatAge is the maximal age of the last update of the file index or the tail.
+	MaxHeartbeatAge time.Duration
+	// MaxIndexLag is the maximal number of blocks any index is behind the head.
+	MaxIndexLag uint64
+}
+
+// Dataset is the dataset watched by the Poller.
+type Dataset struct {
+	// Name labels the metrics of the dataset. Defaults to the dataset full path.
+	Name string
+	// Options are the options of the dataset, the decoder and decompressor are used to read the head block.
+	Options ethwal.Options
+	// Indexes are the names of the indexes of the dataset whose lag is exported.
+	Indexes []ethwal.IndexName
+	// Thresholds are the staleness thresholds of the dataset.
+	Thresholds Thresholds
+	// VerifyInterval is the interval of CheckInvariants of the dataset and its indexes, it reads the
+	// attributes of every file, so it's run less often than the poll. Zero disables the verification.
+	VerifyInterval time.Duration
+}
+
+func (d Dataset) name() string {
+	return cmp.Or(d.Name, d.Options.Dataset.FullPath())
+}
+
+func (d Dataset) indexerOptions() ethwal.IndexerOptions[any] {
+	indexes := make(ethwal.Indexes[any], len(d.Indexes))
+	for _, name := range d.Indexes {
+		indexes[name] = ethwal.NewIndex[any](name, nil)
+	}
+	return ethwal.IndexerOptions[any]{
+		Dataset:    d.Options.Dataset,
+		FileSystem: d.Options.FileSystem,
+		Indexes:    indexes,
+	}
+}
+
+// Options are the options of the Poller.
+type Options struct {
+	Datasets []Dataset
+	// Interval is the interval of the polls by Run. Defaults to 30 seconds.
+	Interval time.Duration
+}
+
+func (o Options) WithDefaults() Options {
+	o.Interval = cmp.Or(o.Interval, defaultInterval)
+	return o
+}
+
+// DatasetState is the state of the dataset as of its last poll.
+type DatasetState struct {
+	Name       string
+	Thresholds Thresholds
+
+	// Status is the status of the last successful poll.
+	Status ethwal.Status
+	// HeadBlockNum is the last block number stored in the dataset, including the tail.
+	HeadBlockNum uint64
+	// HeadBlockTime is the timestamp of the head block, zero if the dataset is empty.
+	HeadBlockTime time.Time
+	// FileGrowthRate is the number of the files added per second between the last two successful polls.
+	FileGrowthRate float64
+
+	// PolledAt is the time of the last successful poll.
+	PolledAt time.Time
+	// Err is the error of the last poll, nil if it succeeded.
+	Err error
+
+	// VerifiedAt is the time of the last verification, zero if the dataset wasn't verified.
+	VerifiedAt time.Time
+	// VerifyErr is the error of the last verification, nil if it passed.
+	VerifyErr error
+}
+
+// IndexLag returns the number of blocks each index is behind the head.
+func (s DatasetState) IndexLag() map[ethwal.IndexName]uint64 {
+	lag := make(map[ethwal.IndexName]uint64, len(s.Status.Indexes))
+	for name, blockNum := range s.Status.Indexes {
+		lag[name] = s.HeadBlockNum - min(blockNum, s.HeadBlockNum)
+	}
+	return lag
+}
+
+// Stale returns the staleness checks that fail at the time, sorted. The dataset that was never polled
+// successfully fails all of its checks.
+func (s DatasetState) Stale(now time.Time) []string {
+	var stale []string
+	if s.Thresholds.MaxHeadAge > 0 && (s.HeadBlockTime.IsZero() || now.Sub(s.HeadBlockTime) > s.Thresholds.MaxHeadAge) {
+		stale = append(stale, CheckHeadAge)
+	}
+	if s.Thresholds.MaxHeartbeatAge > 0 && (s.Status.UpdatedAt.IsZero() || now.Sub(s.Status.UpdatedAt) > s.Thresholds.MaxHeartbeatAge) {
+		stale = append(stale, CheckHeartbeatAge)
+	}
+	if s.Thresholds.MaxIndexLag > 0 {
+		for _, lag := range s.IndexLag() {
+			if lag > s.Thresholds.MaxIndexLag {
+				stale = append(stale, CheckIndexLag)
+				break
+			}
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// Healthy reports whether the last poll and verification succeeded and no staleness check fails.
+func (s DatasetState) Healthy(now time.Time) bool {
+	return s.Err == nil && s.VerifyErr == nil && len(s.Stale(now)) == 0
+}
+
+// Poller polls the status of the datasets with the cheap DatasetStatus, the head block is read only when
+// the head changes. It can be used in-process or by the ethwalmonitor binary.
+type Poller struct {
+	options Options
+	now     func() time.Time
+
+	mu     sync.Mutex
+	states map[string]*DatasetState
+}
+
+// NewPoller returns the poller of the datasets, their names must be unique.
+func NewPoller(opt Options) (*Poller, error) {
+	opt = opt.WithDefaults()
+
+	states := make(map[string]*DatasetState, len(opt.Datasets))
+	for i, dataset := range opt.Datasets {
+		if dataset.Options.Dataset.Path == "" {
+			return nil, fmt.Errorf("dataset %d: path cannot be empty", i)
+		}
+
+		name := dataset.name()
+		if _, ok := states[name]; ok {
+			return nil, fmt.Errorf("dataset %s: name is not unique", name)
+		}
+		states[name] = &DatasetState{Name: name, Thresholds: dataset.Thresholds}
+	}
+
+	return &Poller{options: opt, now: time.Now, states: states}, nil
+}
+
+// Run polls the datasets every interval until the context is canceled.
+func (p *Poller) Run(ctx context.Context) error {
+	ticker := time.NewTicker(p.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		// the failed polls are recorded in the states
+		_ = p.Poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll polls all datasets once and returns their errors. The errors are recorded in the states as well.
+func (p *Poller) Poll(ctx context.Context) error {
+	errs := make([]error, len(p.options.Datasets))
+
+	var errGrp errgroup.Group
+	for i, dataset := range p.options.Datasets {
+		errGrp.Go(func() error {
+			errs[i] = p.poll(ctx, dataset)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("dataset %s: %w", dataset.name(), errs[i])
+			}
+			return nil
+		})
+	}
+	_ = errGrp.Wait()
+	return errors.Join(errs...)
+}
+
+func (p *Poller) poll(ctx context.Context, dataset Dataset) error {
+	p.mu.Lock()
+	prev := *p.states[dataset.name()]
+	p.mu.Unlock()
+
+	next := prev
+	next.Err = p.pollStatus(ctx, dataset, &next)
+
+	now := p.now()
+	if dataset.VerifyInterval > 0 && now.Sub(prev.VerifiedAt) >= dataset.VerifyInterval {
+		next.VerifyErr = ethwal.CheckInvariants[any](ctx, dataset.Options, dataset.indexerOptions())
+		next.VerifiedAt = now
+	}
+
+	p.mu.Lock()
+	*p.states[dataset.name()] = next
+	p.mu.Unlock()
+	return errors.Join(next.Err, next.VerifyErr)
+}
+
+func (p *Poller) pollStatus(ctx context.Context, dataset Dataset, state *DatasetState) error {
+	status, err := ethwal.DatasetStatus[any](ctx, dataset.Options, dataset.indexerOptions())
+	if err != nil {
+		return err
+	}
+
+	// the head block is read only when the head moves
+	headBlockNum := max(status.HeadBlockNum, status.TailBlockNum)
+	if headBlockNum != state.HeadBlockNum || state.HeadBlockTime.IsZero() {
+		blockNum, blockTime, err := ethwal.HeadBlockTime(ctx, dataset.Options)
+		if err != nil {
+			return fmt.Errorf("failed to read head block: %w", err)
+		}
+		headBlockNum = max(headBlockNum, blockNum)
+		state.HeadBlockTime = blockTime
+	}
+
+	now := p.now()
+	if !state.PolledAt.IsZero() {
+		if elapsed := now.Sub(state.PolledAt).Seconds(); elapsed > 0 {
+			state.FileGrowthRate = float64(status.FileCount-state.Status.FileCount) / elapsed
+		}
+	}
+
+	state.Status, state.HeadBlockNum, state.PolledAt = status, headBlockNum, now
+	return nil
+}
+
+// States returns the states of the datasets sorted by name.
+func (p *Poller) States() []DatasetState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	states := make([]DatasetState, 0, len(p.states))
+	for _, state := range p.states {
+		states = append(states, *state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
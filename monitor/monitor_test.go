@@ -0,0 +1,218 @@
+package monitor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/ethwal"
+	"github.com/0xsequence/ethwal/storage/local"
+	"github.com/stretchr/testify/require"
+)
+
+func indexAll(block ethwal.Block[int]) (bool, map[ethwal.IndexedValue][]ethwal.Position, error) {
+	return true, map[ethwal.IndexedValue][]ethwal.Position{"all": ethwal.Ordinals(ethwal.IndexAllDataIndexes)}, nil
+}
+
+// fixture is the local dataset written by the test, every block is rolled into its own file once the next
+// block is written, the last block is in the tail.
+type fixture struct {
+	dir     string
+	options ethwal.Options
+	writer  ethwal.Writer[int]
+}
+
+func newFixture(t *testing.T, dir, name string) *fixture {
+	options := ethwal.Options{
+		Dataset:           ethwal.Dataset{Path: name},
+		FileSystem:        local.NewLocalFS(dir),
+		NewCompressor:     ethwal.NewZSTDCompressor,
+		NewDecompressor:   ethwal.NewZSTDDecompressor,
+		FileRollPolicy:    ethwal.NewLastBlockNumberRollPolicy(1),
+		TailFlushInterval: time.Nanosecond,
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, name), 0o755))
+
+	indexer, err := ethwal.NewIndexer(context.Background(), ethwal.IndexerOptions[int]{
+		Dataset:    options.Dataset,
+		FileSystem: options.FileSystem,
+		Indexes:    ethwal.Indexes[int]{"all": ethwal.NewIndex[int]("all", indexAll)},
+	})
+	require.NoError(t, err)
+
+	w, err := ethwal.NewWriter[int](options)
+	require.NoError(t, err)
+
+	wi, err := ethwal.NewWriterWithIndexer(w, indexer)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = wi.Close(context.Background())
+	})
+
+	return &fixture{dir: dir, options: options, writer: wi}
+}
+
+func (f *fixture) write(t *testing.T, from, to uint64, ts time.Time) {
+	for blockNum := from; blockNum <= to; blockNum++ {
+		require.NoError(t, f.writer.Write(context.Background(), ethwal.Block[int]{
+			Number: blockNum,
+			TS:     uint64(ts.Unix()),
+			Data:   int(blockNum),
+		}))
+	}
+}
+
+// age sets the modification time of the file index and the tail, as if they were written d ago.
+func (f *fixture) age(t *testing.T, d time.Duration) {
+	modTime := time.Now().Add(-d)
+	for _, name := range []string{ethwal.FileIndexFileName, ethwal.TailFileName} {
+		err := os.Chtimes(filepath.Join(f.dir, f.options.Dataset.FullPath(), name), modTime, modTime)
+		if !os.IsNotExist(err) {
+			require.NoError(t, err)
+		}
+	}
+}
+
+// scrape returns the samples served by the handler by their name and labels.
+func scrape(t *testing.T, h http.Handler) map[string]float64 {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		require.NoError(t, err)
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func TestPoller(t *testing.T) {
+	dir := t.TempDir()
+
+	thresholds := Thresholds{
+		MaxHeadAge:      time.Minute,
+		MaxHeartbeatAge: time.Minute,
+		MaxIndexLag:     5,
+	}
+
+	active := newFixture(t, dir, "active")
+	active.write(t, 1, 10, time.Now())
+
+	// the stale dataset was last appended an hour ago and its index is behind
+	stale := newFixture(t, dir, "stale")
+	stale.write(t, 1, 20, time.Now().Add(-time.Hour))
+	require.NoError(t, stale.writer.Close(context.Background()))
+	w, err := ethwal.NewWriter[int](stale.options)
+	require.NoError(t, err)
+	stale.writer = w
+	stale.write(t, 21, 30, time.Now().Add(-time.Hour))
+	require.NoError(t, w.Close(context.Background()))
+	stale.age(t, time.Hour)
+
+	p, err := NewPoller(Options{
+		Datasets: []Dataset{
+			{Name: "active", Options: active.options, Indexes: []ethwal.IndexName{"all"}, Thresholds: thresholds},
+			{Name: "stale", Options: stale.options, Indexes: []ethwal.IndexName{"all"}, Thresholds: thresholds, VerifyInterval: time.Hour},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, p.Poll(context.Background()))
+
+	samples := scrape(t, p.MetricsHandler())
+	require.Equal(t, 1.0, samples[`ethwal_up{dataset="active"}`])
+	require.Equal(t, 10.0, samples[`ethwal_head_block{dataset="active"}`])
+	require.Equal(t, 30.0, samples[`ethwal_head_block{dataset="stale"}`])
+	require.Equal(t, 9.0, samples[`ethwal_file_count{dataset="active"}`])
+	require.Equal(t, 0.0, samples[`ethwal_gap_count{dataset="stale"}`])
+	require.Equal(t, 0.0, samples[`ethwal_index_lag_blocks{dataset="active",index="all"}`])
+	require.Equal(t, 10.0, samples[`ethwal_index_lag_blocks{dataset="stale",index="all"}`])
+	require.Less(t, samples[`ethwal_head_block_age_seconds{dataset="active"}`], 60.0)
+	require.GreaterOrEqual(t, samples[`ethwal_head_block_age_seconds{dataset="stale"}`], 3600.0)
+	require.GreaterOrEqual(t, samples[`ethwal_heartbeat_age_seconds{dataset="stale"}`], 3600.0)
+	require.Equal(t, 1.0, samples[`ethwal_verification_ok{dataset="stale"}`])
+	require.NotContains(t, samples, `ethwal_verification_ok{dataset="active"}`)
+
+	for _, check := range []string{CheckHeadAge, CheckHeartbeatAge, CheckIndexLag} {
+		require.Equal(t, 0.0, samples[fmt.Sprintf(`ethwal_stale{dataset="active",check="%s"}`, check)], check)
+		require.Equal(t, 1.0, samples[fmt.Sprintf(`ethwal_stale{dataset="stale",check="%s"}`, check)], check)
+	}
+
+	// the active dataset grows
+	active.write(t, 11, 15, time.Now())
+	require.NoError(t, p.Poll(context.Background()))
+
+	samples = scrape(t, p.MetricsHandler())
+	require.Equal(t, 15.0, samples[`ethwal_head_block{dataset="active"}`])
+	require.Equal(t, 14.0, samples[`ethwal_file_count{dataset="active"}`])
+	require.Greater(t, samples[`ethwal_file_growth_rate{dataset="active"}`], 0.0)
+	require.Equal(t, 0.0, samples[`ethwal_file_growth_rate{dataset="stale"}`])
+
+	// the active dataset that stops being appended flips the heartbeat check
+	active.age(t, 2*time.Minute)
+	require.NoError(t, p.Poll(context.Background()))
+
+	samples = scrape(t, p.MetricsHandler())
+	require.Equal(t, 1.0, samples[fmt.Sprintf(`ethwal_stale{dataset="active",check="%s"}`, CheckHeartbeatAge)])
+	require.Equal(t, 0.0, samples[fmt.Sprintf(`ethwal_stale{dataset="active",check="%s"}`, CheckHeadAge)])
+
+	// health
+	rec := httptest.NewRecorder()
+	p.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	var health Health
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&health))
+	require.False(t, health.Healthy)
+	require.Len(t, health.Datasets, 2)
+	require.Equal(t, "active", health.Datasets[0].Name)
+	require.Equal(t, []string{CheckHeartbeatAge}, health.Datasets[0].Stale)
+	require.Equal(t, []string{CheckHeadAge, CheckHeartbeatAge, CheckIndexLag}, health.Datasets[1].Stale)
+}
+
+func TestPoller_Unhealthy(t *testing.T) {
+	p, err := NewPoller(Options{
+		Datasets: []Dataset{{Name: "missing", Options: ethwal.Options{
+			Dataset:    ethwal.Dataset{Path: "missing"},
+			FileSystem: local.NewLocalFS(t.TempDir()),
+		}}},
+	})
+	require.NoError(t, err)
+	require.Error(t, p.Poll(context.Background()))
+
+	samples := scrape(t, p.MetricsHandler())
+	require.Equal(t, 0.0, samples[`ethwal_up{dataset="missing"}`])
+	require.NotContains(t, samples, `ethwal_head_block{dataset="missing"}`)
+
+	rec := httptest.NewRecorder()
+	p.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	var health Health
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&health))
+	require.False(t, health.Healthy)
+	require.NotEmpty(t, health.Datasets[0].Error)
+
+	_, err = NewPoller(Options{Datasets: []Dataset{
+		{Name: "a", Options: ethwal.Options{Dataset: ethwal.Dataset{Path: "a"}}},
+		{Name: "a", Options: ethwal.Options{Dataset: ethwal.Dataset{Path: "b"}}},
+	}})
+	require.Error(t, err)
+}
@@ -0,0 +1,450 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+var (
+	ErrStreamUnknown       = fmt.Errorf("stream is not declared")
+	ErrStreamCodecMismatch = fmt.Errorf("stream codec doesn't match the dataset stream codec")
+)
+
+// StreamData is the block data of the multi-stream dataset, the stream payloads keyed by the stream name.
+// The streams without payload in the block are omitted.
+type StreamData map[string]any
+
+// streamSections are the encoded stream payloads of the block keyed by the stream name. The block spine,
+// the number, hash and timestamp, is stored once for all streams and the sections are decoded only for
+// the streams that are read.
+type streamSections map[string][]byte
+
+// StreamCodec encodes and decodes the payload of the stream of the multi-stream dataset.
+type StreamCodec struct {
+	// Name identifies the codec in the dataset metadata, readers refuse the stream recorded with the codec
+	// of other name.
+	Name string
+
+	Encode func(v any) ([]byte, error)
+	Decode func(data []byte) (any, error)
+}
+
+// NewStreamCodec returns the codec of the stream payload of type T encoded with the encoder and decoder.
+func NewStreamCodec[T any](name string, newEncoder NewEncoderFunc, newDecoder NewDecoderFunc) StreamCodec {
+	return StreamCodec{
+		Name: name,
+		Encode: func(v any) ([]byte, error) {
+			payload, ok := v.(T)
+			if !ok {
+				return nil, fmt.Errorf("stream payload %T doesn't match the codec type %T", v, *new(T))
+			}
+
+			var buf bytes.Buffer
+			err := newEncoder(&buf).Encode(payload)
+			if err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+		Decode: func(data []byte) (any, error) {
+			var payload T
+			err := newDecoder(bytes.NewReader(data)).Decode(&payload)
+			if err != nil {
+				return nil, err
+			}
+			return payload, nil
+		},
+	}
+}
+
+// NewCBORStreamCodec returns the CBOR codec of the stream payload of type T.
+func NewCBORStreamCodec[T any]() StreamCodec {
+	return NewStreamCodec[T]("cbor", NewCBOREncoder, NewCBORDecoder)
+}
+
+// NewJSONStreamCodec returns the JSON codec of the stream payload of type T.
+func NewJSONStreamCodec[T any]() StreamCodec {
+	return NewStreamCodec[T]("json", NewJSONEncoder, NewJSONDecoder)
+}
+
+func validateStreams(streams map[string]StreamCodec) error {
+	if len(streams) == 0 {
+		return fmt.Errorf("no streams declared")
+	}
+	for stream, codec := range streams {
+		if stream == "" {
+			return fmt.Errorf("stream name cannot be empty")
+		}
+		if codec.Name == "" || codec.Encode == nil || codec.Decode == nil {
+			return fmt.Errorf("stream %q: codec name, encode and decode functions must be set", stream)
+		}
+	}
+	return nil
+}
+
+// StreamIndexName returns the name of the index of the stream, see NewStreamIndex.
+func StreamIndexName(stream string, name IndexName) IndexName {
+	return IndexName(stream + "/" + string(name)).Normalize()
+}
+
+// NewStreamIndex returns the index of the multi-stream dataset that indexes the payload of the stream,
+// its name is StreamIndexName. The blocks without the stream payload are not indexed.
+func NewStreamIndex[T any](stream string, name IndexName, indexFunc IndexFunction[T]) Index[StreamData] {
+	return NewIndex(StreamIndexName(stream, name), func(block Block[StreamData]) (bool, map[IndexedValue][]Position, error) {
+		v, ok := block.Data[stream]
+		if !ok {
+			return false, nil, nil
+		}
+
+		payload, ok := v.(T)
+		if !ok {
+			return false, nil, fmt.Errorf("stream %q payload %T doesn't match the index type %T", stream, v, *new(T))
+		}
+		return indexFunc(Block[T]{Hash: block.Hash, Number: block.Number, TS: block.TS, Data: payload, Meta: block.Meta, Parent: block.Parent})
+	})
+}
+
+type multiStreamWriter struct {
+	w       Writer[streamSections]
+	streams map[string]StreamCodec
+}
+
+var _ Writer[StreamData] = (*multiStreamWriter)(nil)
+
+// NewMultiStreamWriter creates the writer of the dataset with the named streams that share one block
+// spine. The block data maps the stream names to the payloads, each payload is encoded by the codec of
+// its stream into its own section of the block. All streams of the block are stored in the same file, so
+// either all streams of the file block range are visible to readers or none. The stream names and codecs
+// are recorded in the dataset metadata, streams can be added later but their codecs can't be changed.
+func NewMultiStreamWriter(opt Options, streams map[string]StreamCodec) (Writer[StreamData], error) {
+	err := validateStreams(streams)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := NewWriter[streamSections](opt)
+	if err != nil {
+		return nil, err
+	}
+
+	codecs := make(map[string]string, len(streams))
+	for stream, codec := range streams {
+		codecs[stream] = codec.Name
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), loadIndexFileTimeout)
+	defer cancel()
+
+	opt = w.Options()
+	metaFs := opt.withObjectClass(storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()), ObjectClassMeta)
+	err = recordDatasetStreams(ctx, metaFs, codecs)
+	if err != nil {
+		_ = w.Close(ctx)
+		return nil, w.ID().wrapError(err)
+	}
+
+	return &multiStreamWriter{w: w, streams: streams}, nil
+}
+
+func (m *multiStreamWriter) FileSystem() storage.FS {
+	return m.w.FileSystem()
+}
+
+func (m *multiStreamWriter) Write(ctx context.Context, b Block[StreamData]) error {
+	_, err := m.WriteWithStatus(ctx, b)
+	return err
+}
+
+func (m *multiStreamWriter) WriteWithStatus(ctx context.Context, b Block[StreamData]) (WriteStatus, error) {
+	block, err := m.encode(b)
+	if err != nil {
+		return WriteStatus{}, m.ID().wrapError(err)
+	}
+	return m.w.WriteWithStatus(ctx, block)
+}
+
+func (m *multiStreamWriter) WriteBatch(ctx context.Context, blocks []Block[StreamData]) error {
+	encoded := make([]Block[streamSections], 0, len(blocks))
+	for _, b := range blocks {
+		block, err := m.encode(b)
+		if err != nil {
+			return m.ID().wrapError(err)
+		}
+		encoded = append(encoded, block)
+	}
+	return m.w.WriteBatch(ctx, encoded)
+}
+
+// encode encodes the payloads of the block with the codecs of their streams.
+func (m *multiStreamWriter) encode(b Block[StreamData]) (Block[streamSections], error) {
+	block := Block[streamSections]{Hash: b.Hash, Number: b.Number, TS: b.TS, Meta: b.Meta, Parent: b.Parent}
+	if len(b.Data) > 0 {
+		block.Data = make(streamSections, len(b.Data))
+	}
+
+	for stream, payload := range b.Data {
+		codec, ok := m.streams[stream]
+		if !ok {
+			return Block[streamSections]{}, fmt.Errorf("%w: %q", ErrStreamUnknown, stream)
+		}
+
+		data, err := codec.Encode(payload)
+		if err != nil {
+			return Block[streamSections]{}, fmt.Errorf("failed to encode stream %q of block %d: %w", stream, b.Number, err)
+		}
+		block.Data[stream] = data
+	}
+	return block, nil
+}
+
+func (m *multiStreamWriter) checkSequence(blockNums []uint64) error {
+	return checkSequence(m.w, blockNums)
+}
+
+func (m *multiStreamWriter) allowGaps() {
+	allowGaps(m.w)
+}
+
+func (m *multiStreamWriter) empty() bool {
+	return writerEmpty(m.w)
+}
+
+func (m *multiStreamWriter) WillRollNext() bool {
+	return m.w.WillRollNext()
+}
+
+func (m *multiStreamWriter) BlockNum() uint64 {
+	return m.AcceptedBlockNum()
+}
+
+func (m *multiStreamWriter) AcceptedBlockNum() uint64 {
+	return m.w.AcceptedBlockNum()
+}
+
+func (m *multiStreamWriter) DurableBlockNum() uint64 {
+	return m.w.DurableBlockNum()
+}
+
+func (m *multiStreamWriter) RollFile(ctx context.Context) error {
+	return m.w.RollFile(ctx)
+}
+
+func (m *multiStreamWriter) Flush(ctx context.Context) error {
+	return m.w.Flush(ctx)
+}
+
+func (m *multiStreamWriter) Rollback(ctx context.Context, toBlockNum uint64) error {
+	return m.w.Rollback(ctx, toBlockNum)
+}
+
+func (m *multiStreamWriter) ReconfigureRollPolicy(ctx context.Context, p FileRollPolicy, mode RolloverMode) error {
+	return m.w.ReconfigureRollPolicy(ctx, p, mode)
+}
+
+func (m *multiStreamWriter) MarkExamined(ctx context.Context, from, to uint64) error {
+	return m.w.MarkExamined(ctx, from, to)
+}
+
+func (m *multiStreamWriter) Close(ctx context.Context) error {
+	return m.w.Close(ctx)
+}
+
+func (m *multiStreamWriter) Options() Options {
+	return m.w.Options()
+}
+
+func (m *multiStreamWriter) Accounting() *storage.Accounting {
+	return m.w.Accounting()
+}
+
+func (m *multiStreamWriter) SetOptions(opt Options) {
+	m.w.SetOptions(opt)
+}
+
+func (m *multiStreamWriter) ID() Instance {
+	return m.w.ID()
+}
+
+// streamReader reads the streams of the multi-stream dataset, only the sections of the read streams
+// are decoded.
+type streamReader[T any] struct {
+	r      Reader[streamSections]
+	decode func(sections streamSections) (T, error)
+}
+
+var _ Reader[StreamData] = (*streamReader[StreamData])(nil)
+
+// NewStreamReader creates the reader of the single stream of the multi-stream dataset, see
+// NewMultiStreamWriter. The block data is the stream payload decoded by the codec, or the zero value if
+// the block has no payload of the stream. It returns ErrStreamUnknown if the stream is not recorded in
+// the dataset metadata and ErrStreamCodecMismatch if it's recorded with other codec.
+func NewStreamReader[T any](opt Options, stream string, codec StreamCodec) (Reader[T], error) {
+	err := checkDatasetStreams(opt, map[string]StreamCodec{stream: codec})
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewReader[streamSections](opt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamReader[T]{r: r, decode: func(sections streamSections) (T, error) {
+		var payload T
+		data, ok := sections[stream]
+		if !ok {
+			return payload, nil
+		}
+
+		v, err := codec.Decode(data)
+		if err != nil {
+			return payload, fmt.Errorf("failed to decode stream %q: %w", stream, err)
+		}
+		payload, ok = v.(T)
+		if !ok {
+			return payload, fmt.Errorf("stream %q payload %T doesn't match the reader type %T", stream, v, payload)
+		}
+		return payload, nil
+	}}, nil
+}
+
+// NewMultiStreamReader creates the reader of the joined view of the streams of the multi-stream dataset,
+// see NewMultiStreamWriter. The streams that are not declared are not decoded and omitted from the
+// block data.
+func NewMultiStreamReader(opt Options, streams map[string]StreamCodec) (Reader[StreamData], error) {
+	err := validateStreams(streams)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkDatasetStreams(opt, streams)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewReader[streamSections](opt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamReader[StreamData]{r: r, decode: func(sections streamSections) (StreamData, error) {
+		data := make(StreamData, len(streams))
+		for stream, codec := range streams {
+			section, ok := sections[stream]
+			if !ok {
+				continue
+			}
+
+			v, err := codec.Decode(section)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode stream %q: %w", stream, err)
+			}
+			data[stream] = v
+		}
+		return data, nil
+	}}, nil
+}
+
+// checkDatasetStreams checks that the streams are recorded in the dataset metadata with the same codecs.
+func checkDatasetStreams(opt Options, streams map[string]StreamCodec) error {
+	ctx, cancel := context.WithTimeout(context.Background(), loadIndexFileTimeout)
+	defer cancel()
+
+	recorded, err := DatasetStreams(ctx, opt)
+	if err != nil {
+		return err
+	}
+
+	for stream, codec := range streams {
+		name, ok := recorded[stream]
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrStreamUnknown, stream)
+		}
+		if name != codec.Name {
+			return fmt.Errorf("%w: stream %q codec %q != %q", ErrStreamCodecMismatch, stream, codec.Name, name)
+		}
+	}
+	return nil
+}
+
+func (s *streamReader[T]) FileNum() int {
+	return s.r.FileNum()
+}
+
+func (s *streamReader[T]) FileIndex() *FileIndex {
+	return s.r.FileIndex()
+}
+
+func (s *streamReader[T]) Read(ctx context.Context) (Block[T], error) {
+	block, _, err := s.ReadWithLocation(ctx)
+	return block, err
+}
+
+func (s *streamReader[T]) ReadWithLocation(ctx context.Context) (Block[T], BlockLocation, error) {
+	block, loc, err := s.r.ReadWithLocation(ctx)
+	if err != nil {
+		return Block[T]{}, loc, err
+	}
+
+	b, err := s.decodeBlock(block)
+	return b, loc, err
+}
+
+func (s *streamReader[T]) ReadAtLocation(ctx context.Context, loc BlockLocation) (Block[T], error) {
+	block, err := s.r.ReadAtLocation(ctx, loc)
+	if err != nil {
+		return Block[T]{}, err
+	}
+	return s.decodeBlock(block)
+}
+
+func (s *streamReader[T]) decodeBlock(block Block[streamSections]) (Block[T], error) {
+	data, err := s.decode(block.Data)
+	if err != nil {
+		return Block[T]{}, s.ID().wrapError(fmt.Errorf("block %d: %w", block.Number, err))
+	}
+	return Block[T]{Hash: block.Hash, Number: block.Number, TS: block.TS, Data: data, Blob: block.Blob, Meta: block.Meta, Parent: block.Parent}, nil
+}
+
+func (s *streamReader[T]) Seek(ctx context.Context, blockNum uint64) error {
+	return s.r.Seek(ctx, blockNum)
+}
+
+func (s *streamReader[T]) BlockNum() uint64 {
+	return s.r.BlockNum()
+}
+
+func (s *streamReader[T]) Options() Options {
+	return s.r.Options()
+}
+
+func (s *streamReader[T]) Accounting() *storage.Accounting {
+	return s.r.Accounting()
+}
+
+func (s *streamReader[T]) Stats() ReaderStats {
+	return s.r.Stats()
+}
+
+func (s *streamReader[T]) BlockExamined(ctx context.Context, blockNum uint64) (bool, error) {
+	return s.r.BlockExamined(ctx, blockNum)
+}
+
+func (s *streamReader[T]) BlockRangeExamined(ctx context.Context, from, to uint64) (bool, error) {
+	return s.r.BlockRangeExamined(ctx, from, to)
+}
+
+func (s *streamReader[T]) WaitForBlock(ctx context.Context, blockNum uint64) error {
+	return s.r.WaitForBlock(ctx, blockNum)
+}
+
+func (s *streamReader[T]) ID() Instance {
+	return s.r.ID()
+}
+
+func (s *streamReader[T]) Close() error {
+	return s.r.Close()
+}
@@ -0,0 +1,270 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+type testTransfer struct {
+	From  string `cbor:"0,keyasint"`
+	To    string `cbor:"1,keyasint"`
+	Value uint64 `cbor:"2,keyasint"`
+}
+
+func testStreams() map[string]StreamCodec {
+	return map[string]StreamCodec{
+		"logs":      NewCBORStreamCodec[[]string](),
+		"transfers": NewCBORStreamCodec[[]testTransfer](),
+		"balances":  NewJSONStreamCodec[map[string]int64](),
+	}
+}
+
+func generateStreamBlock(blockNum uint64) Block[StreamData] {
+	data := StreamData{
+		"logs":     []string{fmt.Sprintf("log-%d", blockNum)},
+		"balances": map[string]int64{"a": int64(blockNum), "b": -int64(blockNum)},
+	}
+	// every third block has no transfers
+	if blockNum%3 != 0 {
+		data["transfers"] = []testTransfer{{From: "a", To: fmt.Sprintf("b%d", blockNum%2), Value: blockNum}}
+	}
+
+	return Block[StreamData]{
+		Hash:   common.BytesToHash([]byte{byte(blockNum)}),
+		Number: blockNum,
+		TS:     blockNum * 12,
+		Data:   data,
+	}
+}
+
+func writeStreamBlocks(t *testing.T, w Writer[StreamData], from, to uint64) {
+	for blockNum := from; blockNum <= to; blockNum++ {
+		require.NoError(t, w.Write(context.Background(), generateStreamBlock(blockNum)))
+	}
+}
+
+func requireStreamBlocks[T any](t *testing.T, r Reader[T], from, to uint64, data func(b Block[StreamData]) T) {
+	for blockNum := from; blockNum <= to; blockNum++ {
+		expected := generateStreamBlock(blockNum)
+
+		b, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, expected.Number, b.Number)
+		require.Equal(t, expected.Hash, b.Hash)
+		require.Equal(t, expected.TS, b.TS)
+		require.Equal(t, data(expected), b.Data)
+	}
+
+	_, err := r.Read(context.Background())
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestMultiStream(t *testing.T) {
+	opt := Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      gostorage.NewMemoryFS(),
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+
+	w, err := NewMultiStreamWriter(opt, testStreams())
+	require.NoError(t, err)
+	writeStreamBlocks(t, w, 1, 25)
+
+	err = w.Write(context.Background(), Block[StreamData]{Number: 26, Data: StreamData{"traces": []string{}}})
+	require.ErrorIs(t, err, ErrStreamUnknown)
+	err = w.Write(context.Background(), Block[StreamData]{Number: 26, Data: StreamData{"logs": []int{1}}})
+	require.ErrorContains(t, err, "doesn't match the codec type")
+	require.NoError(t, w.Close(context.Background()))
+
+	streams, err := DatasetStreams(context.Background(), opt)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"logs": "cbor", "transfers": "cbor", "balances": "json"}, streams)
+
+	t.Run("single_stream", func(t *testing.T) {
+		r, err := NewStreamReader[[]testTransfer](opt, "transfers", NewCBORStreamCodec[[]testTransfer]())
+		require.NoError(t, err)
+		defer r.Close()
+
+		requireStreamBlocks(t, r, 1, 25, func(b Block[StreamData]) []testTransfer {
+			transfers, _ := b.Data["transfers"].([]testTransfer)
+			return transfers
+		})
+	})
+
+	t.Run("joined", func(t *testing.T) {
+		r, err := NewMultiStreamReader(opt, testStreams())
+		require.NoError(t, err)
+		defer r.Close()
+
+		requireStreamBlocks(t, r, 1, 25, func(b Block[StreamData]) StreamData {
+			return b.Data
+		})
+
+		require.NoError(t, r.Seek(context.Background(), 12))
+		b, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, generateStreamBlock(12).Data, b.Data)
+	})
+
+	t.Run("joined_subset", func(t *testing.T) {
+		r, err := NewMultiStreamReader(opt, map[string]StreamCodec{"logs": NewCBORStreamCodec[[]string]()})
+		require.NoError(t, err)
+		defer r.Close()
+
+		requireStreamBlocks(t, r, 1, 25, func(b Block[StreamData]) StreamData {
+			return StreamData{"logs": b.Data["logs"]}
+		})
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := NewStreamReader[[]string](opt, "traces", NewCBORStreamCodec[[]string]())
+		require.ErrorIs(t, err, ErrStreamUnknown)
+	})
+
+	t.Run("codec_mismatch", func(t *testing.T) {
+		_, err := NewStreamReader[[]string](opt, "logs", NewJSONStreamCodec[[]string]())
+		require.ErrorIs(t, err, ErrStreamCodecMismatch)
+
+		streams := testStreams()
+		streams["logs"] = NewJSONStreamCodec[[]string]()
+		_, err = NewMultiStreamWriter(opt, streams)
+		require.ErrorIs(t, err, ErrStreamCodecMismatch)
+	})
+
+	t.Run("add_stream", func(t *testing.T) {
+		streams := testStreams()
+		streams["traces"] = NewCBORStreamCodec[[]string]()
+		w, err := NewMultiStreamWriter(opt, streams)
+		require.NoError(t, err)
+
+		b := generateStreamBlock(26)
+		b.Data["traces"] = []string{"trace"}
+		require.NoError(t, w.Write(context.Background(), b))
+		require.NoError(t, w.Close(context.Background()))
+
+		r, err := NewStreamReader[[]string](opt, "traces", NewCBORStreamCodec[[]string]())
+		require.NoError(t, err)
+		defer r.Close()
+
+		requireStreamBlocks(t, r, 1, 26, func(b Block[StreamData]) []string {
+			if b.Number == 26 {
+				return []string{"trace"}
+			}
+			return nil
+		})
+	})
+}
+
+func TestMultiStream_CrashRecovery(t *testing.T) {
+	opt := Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      gostorage.NewMemoryFS(),
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+
+	// the writer crashes with the blocks 21-25 not rolled
+	w, err := NewMultiStreamWriter(opt, testStreams())
+	require.NoError(t, err)
+	writeStreamBlocks(t, w, 1, 25)
+	require.Equal(t, uint64(20), w.DurableBlockNum())
+
+	// all streams end at the same block
+	for stream, codec := range testStreams() {
+		r, err := NewMultiStreamReader(opt, map[string]StreamCodec{stream: codec})
+		require.NoError(t, err)
+		requireStreamBlocks(t, r, 1, 20, func(b Block[StreamData]) StreamData {
+			if _, ok := b.Data[stream]; !ok {
+				return StreamData{}
+			}
+			return StreamData{stream: b.Data[stream]}
+		})
+		require.NoError(t, r.Close())
+	}
+
+	// the ingestion resumes from the durable block of all streams
+	w, err = NewMultiStreamWriter(opt, testStreams())
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), w.AcceptedBlockNum())
+	writeStreamBlocks(t, w, 21, 30)
+	require.NoError(t, w.Close(context.Background()))
+
+	r, err := NewMultiStreamReader(opt, testStreams())
+	require.NoError(t, err)
+	defer r.Close()
+
+	requireStreamBlocks(t, r, 1, 30, func(b Block[StreamData]) StreamData {
+		return b.Data
+	})
+}
+
+func TestMultiStream_StreamIndex(t *testing.T) {
+	opt := Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      gostorage.NewMemoryFS(),
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+
+	indexes := Indexes[StreamData]{}
+	for _, index := range []Index[StreamData]{
+		NewStreamIndex("transfers", "to", func(b Block[[]testTransfer]) (bool, map[IndexedValue][]Position, error) {
+			values := make(map[IndexedValue][]Position)
+			for i, transfer := range b.Data {
+				values[IndexedValue(transfer.To)] = append(values[IndexedValue(transfer.To)], OrdinalPosition(i))
+			}
+			return true, values, nil
+		}),
+		NewStreamIndex("logs", "count", func(b Block[[]string]) (bool, map[IndexedValue][]Position, error) {
+			return true, map[IndexedValue][]Position{IndexedValue(fmt.Sprint(len(b.Data))): Ordinals(0)}, nil
+		}),
+	} {
+		indexes[index.Name()] = index
+	}
+
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[StreamData]{
+		Dataset:    opt.Dataset,
+		FileSystem: opt.FileSystem,
+		Indexes:    indexes,
+	})
+	require.NoError(t, err)
+
+	w, err := NewMultiStreamWriter(opt, testStreams())
+	require.NoError(t, err)
+	w, err = NewWriterWithIndexer(w, indexer)
+	require.NoError(t, err)
+	writeStreamBlocks(t, w, 1, 30)
+	require.NoError(t, w.Close(context.Background()))
+
+	f, err := NewFilterBuilder(FilterBuilderOptions[StreamData]{
+		Dataset:    opt.Dataset,
+		FileSystem: opt.FileSystem,
+		Indexes:    indexes,
+	})
+	require.NoError(t, err)
+
+	var blockNums []uint64
+	it := f.Eq(string(StreamIndexName("transfers", "to")), "b1").Eval(context.Background())
+	for it.HasNext() {
+		blockNum, _ := it.Next()
+		blockNums = append(blockNums, blockNum)
+	}
+
+	var expected []uint64
+	for blockNum := uint64(1); blockNum <= 30; blockNum++ {
+		if blockNum%3 != 0 && blockNum%2 == 1 {
+			expected = append(expected, blockNum)
+		}
+	}
+	require.Equal(t, expected, blockNums)
+
+	it = f.Eq(string(StreamIndexName("logs", "count")), "1").Eval(context.Background())
+	require.Equal(t, uint64(30), it.Bitmap().GetCardinality())
+}
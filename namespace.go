@@ -0,0 +1,331 @@
+package ethwal
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+const (
+	defaultDeleteMaxObjects = 10000
+	defaultDeleteWorkers    = 8
+)
+
+var (
+	ErrDeleteTooManyObjects = fmt.Errorf("dataset has more objects than allowed to delete")
+	ErrDatasetNotSealed     = fmt.Errorf("dataset has blocks that are not rolled")
+	ErrDatasetNotExist      = fmt.Errorf("dataset does not exist")
+)
+
+// DatasetInfo describes the dataset found by ListDatasets.
+type DatasetInfo struct {
+	// Dataset is the dataset with Path set to its full path, Name and Version are not known.
+	Dataset Dataset
+	// ModTime is the last modification time of the dataset file index or schema metadata.
+	ModTime time.Time
+}
+
+// DeleteOptions are the options of DeleteDataset.
+type DeleteOptions struct {
+	// DryRun lists the objects that would be deleted without deleting them.
+	DryRun bool
+	// RequireSealed refuses to delete the dataset with the blocks stored in the tail beyond the last
+	// rolled file, which indicates the writer still ingests to it, see Options.TailFlushInterval.
+	RequireSealed bool
+	// MaxObjects is the maximal number of objects deleted, the deletion of larger datasets is refused
+	// unless Force is set. It guards against deleting a wrong prefix. Defaults to 10000.
+	MaxObjects int
+	// Force deletes the dataset regardless of MaxObjects.
+	Force bool
+	// Workers is the number of objects deleted concurrently. Defaults to 8.
+	Workers int
+}
+
+func (o DeleteOptions) WithDefaults() DeleteOptions {
+	o.MaxObjects = cmp.Or(o.MaxObjects, defaultDeleteMaxObjects)
+	o.Workers = cmp.Or(o.Workers, defaultDeleteWorkers)
+	return o
+}
+
+// DeleteReport summarizes the deletion of the dataset.
+type DeleteReport struct {
+	Dataset Dataset
+	// Objects are the paths of the dataset objects on the file system.
+	Objects []string
+
+	ObjectsDeleted int
+	ObjectsFailed  int
+}
+
+// ListDatasets returns the datasets stored under the root path, sorted by path. The dataset is any
+// directory with the file index or the schema metadata.
+func ListDatasets(ctx context.Context, fs storage.FS, rootPath string) ([]DatasetInfo, error) {
+	rootPath = datasetPrefix(rootPath)
+
+	var markers []string
+	err := fs.Walk(ctx, rootPath, func(objectPath string) error {
+		if isDatasetMarker(path.Base(objectPath)) {
+			markers = append(markers, objectPath)
+		}
+		return nil
+	})
+	if err != nil && !storage.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list %s: %w", rootPath, err)
+	}
+
+	datasets := make(map[string]*DatasetInfo)
+	for _, marker := range markers {
+		// the dataset at the file system root has no path
+		datasetPath := path.Dir(marker)
+		if datasetPath == "." {
+			continue
+		}
+
+		attrs, err := fs.Attributes(ctx, marker, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read attributes of %s: %w", marker, err)
+		}
+
+		info, ok := datasets[datasetPath]
+		if !ok {
+			info = &DatasetInfo{Dataset: Dataset{Path: datasetPath}}
+			datasets[datasetPath] = info
+		}
+		if attrs.ModTime.After(info.ModTime) {
+			info.ModTime = attrs.ModTime
+		}
+	}
+
+	infos := make([]DatasetInfo, 0, len(datasets))
+	for _, info := range datasets {
+		infos = append(infos, *info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Dataset.Path < infos[j].Dataset.Path
+	})
+	return infos, nil
+}
+
+// DeleteDataset deletes all objects under the dataset path: the files, the indexes and the metadata.
+// The cache at Dataset.CachePath is not touched and the objects of the datasets nested under the dataset
+// path are kept. The file index and the schema metadata are deleted last and only if all other objects
+// are deleted, so that the interrupted deletion is listed by ListDatasets and can be run again.
+func DeleteDataset(ctx context.Context, fs storage.FS, dataset Dataset, deleteOpt DeleteOptions) (DeleteReport, error) {
+	deleteOpt = deleteOpt.WithDefaults()
+
+	report := DeleteReport{Dataset: dataset}
+	if dataset.Path == "" {
+		return report, fmt.Errorf("path cannot be empty")
+	}
+
+	datasetPath := dataset.FullPath()
+	objects, err := listDatasetObjects(ctx, fs, datasetPath)
+	if err != nil {
+		return report, err
+	}
+	report.Objects = objects
+
+	if len(objects) > deleteOpt.MaxObjects && !deleteOpt.Force {
+		return report, fmt.Errorf("%w: %s has %d objects, max %d", ErrDeleteTooManyObjects, datasetPath, len(objects), deleteOpt.MaxObjects)
+	}
+
+	if deleteOpt.RequireSealed {
+		err = checkDatasetSealed(ctx, storage.NewPrefixWrapper(fs, datasetPath))
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if deleteOpt.DryRun {
+		return report, nil
+	}
+
+	var (
+		data    []string
+		markers []string
+	)
+	for _, objectPath := range objects {
+		if isDatasetMarker(strings.TrimPrefix(objectPath, datasetPath)) {
+			markers = append(markers, objectPath)
+		} else {
+			data = append(data, objectPath)
+		}
+	}
+
+	err = deleteObjects(ctx, fs, data, deleteOpt.Workers, &report)
+	if err != nil {
+		return report, err
+	}
+	return report, deleteObjects(ctx, fs, markers, deleteOpt.Workers, &report)
+}
+
+// DeleteDatasetsMatching deletes the datasets listed by ListDatasets under the root path for which
+// the predicate returns true, e.g. the datasets older than a given age. The datasets are deleted one by
+// one with DeleteDataset, the failed ones are reported and their errors are returned after all other
+// datasets are processed.
+func DeleteDatasetsMatching(ctx context.Context, fs storage.FS, rootPath string, predicate func(DatasetInfo) bool, deleteOpt DeleteOptions) ([]DeleteReport, error) {
+	infos, err := ListDatasets(ctx, fs, rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		reports []DeleteReport
+		errs    []error
+	)
+	for _, info := range infos {
+		if !predicate(info) {
+			continue
+		}
+
+		report, err := DeleteDataset(ctx, fs, info.Dataset, deleteOpt)
+		reports = append(reports, report)
+		if err != nil {
+			if ctx.Err() != nil {
+				return reports, ctx.Err()
+			}
+			errs = append(errs, fmt.Errorf("dataset %s: %w", info.Dataset.Path, err))
+		}
+	}
+	return reports, errors.Join(errs...)
+}
+
+// listDatasetObjects returns the objects under the dataset path excluding the nested datasets.
+func listDatasetObjects(ctx context.Context, fs storage.FS, datasetPath string) ([]string, error) {
+	var objects []string
+	err := fs.Walk(ctx, datasetPath, func(objectPath string) error {
+		objects = append(objects, objectPath)
+		return nil
+	})
+	if err != nil && !storage.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list %s: %w", datasetPath, err)
+	}
+
+	var nested []string
+	for _, objectPath := range objects {
+		dir := path.Dir(strings.TrimPrefix(objectPath, datasetPath))
+		if dir != "." && isDatasetMarker(path.Base(objectPath)) {
+			nested = append(nested, datasetPath+dir+"/")
+		}
+	}
+
+	var datasetObjects []string
+	for _, objectPath := range objects {
+		isNested := false
+		for _, nestedPath := range nested {
+			if strings.HasPrefix(objectPath, nestedPath) {
+				isNested = true
+				break
+			}
+		}
+		if !isNested {
+			datasetObjects = append(datasetObjects, objectPath)
+		}
+	}
+	sort.Strings(datasetObjects)
+	return datasetObjects, nil
+}
+
+// checkDatasetSealed checks that the tail has no blocks beyond the last rolled file.
+func checkDatasetSealed(ctx context.Context, fs storage.FS) error {
+	tailLastBlockNum, ok, err := readTailLastBlockNum(ctx, fs)
+	if err != nil || !ok {
+		return err
+	}
+
+	fileIndex := NewFileIndex(fs)
+	err = fileIndex.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load file index: %w", err)
+	}
+
+	var lastBlockNum uint64
+	if files := fileIndex.Files(); len(files) > 0 {
+		lastBlockNum = files[len(files)-1].LastBlockNum
+	}
+	if tailLastBlockNum > lastBlockNum {
+		return fmt.Errorf("%w: tail ends at %d, last file at %d", ErrDatasetNotSealed, tailLastBlockNum, lastBlockNum)
+	}
+	return nil
+}
+
+// deleteObjects deletes the objects with the workers, the missing objects are counted as deleted.
+func deleteObjects(ctx context.Context, fs storage.FS, objects []string, workers int, report *DeleteReport) error {
+	var (
+		errs []error
+		mu   sync.Mutex
+	)
+
+	objectsChan := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for objectPath := range objectsChan {
+				err := fs.Delete(ctx, objectPath)
+
+				mu.Lock()
+				if err != nil && !storage.IsNotExist(err) {
+					report.ObjectsFailed++
+					errs = append(errs, fmt.Errorf("failed to delete %s: %w", objectPath, err))
+				} else {
+					report.ObjectsDeleted++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, objectPath := range objects {
+		select {
+		case objectsChan <- objectPath:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(objectsChan)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.Join(errs...)
+}
+
+func isDatasetMarker(name string) bool {
+	return name == FileIndexFileName || name == DatasetSchemaFileName
+}
+
+// checkDatasetExists returns ErrDatasetNotExist if the dataset mounted at the file system has neither the
+// file index nor the schema metadata.
+func checkDatasetExists(ctx context.Context, fs storage.FS, datasetPath string) error {
+	for _, marker := range []string{FileIndexFileName, DatasetSchemaFileName} {
+		_, err := fs.Attributes(ctx, marker, nil)
+		if err == nil {
+			return nil
+		}
+		if !storage.IsNotExist(err) {
+			return fmt.Errorf("failed to read attributes of %s: %w", marker, err)
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrDatasetNotExist, datasetPath)
+}
+
+// datasetPrefix returns the path with the trailing separator, so that it matches only the objects of
+// the directory.
+func datasetPrefix(p string) string {
+	if p == "" || strings.HasSuffix(p, "/") {
+		return p
+	}
+	return p + "/"
+}
@@ -0,0 +1,212 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+// writeNamespaceTestDataset writes the mixed int blocks with the indexes to the dataset.
+func writeNamespaceTestDataset(t *testing.T, fs storage.FS, datasetPath string) {
+	opt := Options{
+		Dataset:         Dataset{Path: datasetPath},
+		FileSystem:      fs,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+		Dataset:    opt.Dataset,
+		FileSystem: fs,
+		Indexes:    generateMixedIntIndexes(),
+	})
+	require.NoError(t, err)
+
+	w, err := NewWriter[[]int](opt)
+	require.NoError(t, err)
+	w, err = NewWriterWithIndexer(w, indexer)
+	require.NoError(t, err)
+
+	for _, b := range generateMixedIntBlocks() {
+		require.NoError(t, w.Write(context.Background(), b))
+	}
+	require.NoError(t, w.Close(context.Background()))
+}
+
+// requireNamespaceTestDataset checks that all blocks and indexes of the dataset are readable.
+func requireNamespaceTestDataset(t *testing.T, fs storage.FS, datasetPath string) {
+	r, err := NewReader[[]int](Options{Dataset: Dataset{Path: datasetPath}, FileSystem: fs})
+	require.NoError(t, err)
+	defer r.Close()
+
+	for _, expected := range generateMixedIntBlocks() {
+		b, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, expected.Number, b.Number)
+		require.Equal(t, expected.Data, b.Data)
+	}
+	_, err = r.Read(context.Background())
+	require.ErrorIs(t, err, io.EOF)
+
+	f, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset:    Dataset{Path: datasetPath},
+		FileSystem: fs,
+		Indexes:    generateMixedIntIndexes(),
+	})
+	require.NoError(t, err)
+
+	// the "all" index covers the blocks from 50 with data
+	var (
+		expected []uint64
+		filters  []Filter
+	)
+	for _, b := range generateMixedIntBlocks() {
+		if b.Number < 50 || len(b.Data) == 0 {
+			continue
+		}
+		expected = append(expected, b.Number)
+		for _, data := range b.Data {
+			filters = append(filters, f.Eq("all", fmt.Sprint(data)))
+		}
+	}
+
+	var blockNums []uint64
+	it := f.Or(filters...).Eval(context.Background())
+	for it.HasNext() {
+		blockNum, _ := it.Next()
+		if len(blockNums) == 0 || blockNums[len(blockNums)-1] != blockNum {
+			blockNums = append(blockNums, blockNum)
+		}
+	}
+	require.Equal(t, expected, blockNums)
+}
+
+func countObjects(t *testing.T, fs storage.FS, prefix string) int {
+	var count int
+	require.NoError(t, fs.Walk(context.Background(), prefix, func(string) error {
+		count++
+		return nil
+	}))
+	return count
+}
+
+func TestDeleteDatasetsMatching(t *testing.T) {
+	fs := gostorage.NewMemoryFS()
+	writeNamespaceTestDataset(t, fs, "ci/run-1")
+	writeNamespaceTestDataset(t, fs, "ci/run-2")
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	writeNamespaceTestDataset(t, fs, "ci/run-3")
+	// the datasets sharing the path prefix with the root path
+	writeNamespaceTestDataset(t, fs, "ci-keep/run-1")
+	writeNamespaceTestDataset(t, fs, "ci/run-10")
+
+	infos, err := ListDatasets(context.Background(), fs, "ci")
+	require.NoError(t, err)
+
+	var paths []string
+	for _, info := range infos {
+		paths = append(paths, info.Dataset.Path)
+	}
+	require.Equal(t, []string{"ci/run-1", "ci/run-10", "ci/run-2", "ci/run-3"}, paths)
+
+	olderThanCutoff := func(info DatasetInfo) bool {
+		return info.ModTime.Before(cutoff)
+	}
+
+	t.Run("dry_run", func(t *testing.T) {
+		reports, err := DeleteDatasetsMatching(context.Background(), fs, "ci", olderThanCutoff, DeleteOptions{DryRun: true})
+		require.NoError(t, err)
+		require.Len(t, reports, 2)
+		for _, report := range reports {
+			require.Len(t, report.Objects, countObjects(t, fs, report.Dataset.FullPath()))
+			require.Zero(t, report.ObjectsDeleted)
+		}
+		requireNamespaceTestDataset(t, fs, "ci/run-1")
+	})
+
+	t.Run("max_objects", func(t *testing.T) {
+		_, err := DeleteDatasetsMatching(context.Background(), fs, "ci", olderThanCutoff, DeleteOptions{MaxObjects: 5})
+		require.ErrorIs(t, err, ErrDeleteTooManyObjects)
+		requireNamespaceTestDataset(t, fs, "ci/run-1")
+		requireNamespaceTestDataset(t, fs, "ci/run-2")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		reports, err := DeleteDatasetsMatching(context.Background(), fs, "ci", olderThanCutoff, DeleteOptions{})
+		require.NoError(t, err)
+		require.Len(t, reports, 2)
+		for _, report := range reports {
+			require.NotZero(t, report.ObjectsDeleted)
+			require.Equal(t, len(report.Objects), report.ObjectsDeleted)
+			require.Zero(t, countObjects(t, fs, report.Dataset.FullPath()))
+		}
+
+		infos, err := ListDatasets(context.Background(), fs, "")
+		require.NoError(t, err)
+		require.Len(t, infos, 3)
+
+		for _, datasetPath := range []string{"ci/run-3", "ci/run-10", "ci-keep/run-1"} {
+			requireNamespaceTestDataset(t, fs, datasetPath)
+		}
+	})
+}
+
+func TestDeleteDataset(t *testing.T) {
+	t.Run("nested", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+		writeNamespaceTestDataset(t, fs, "ci/parent")
+		writeNamespaceTestDataset(t, fs, "ci/parent/child")
+
+		report, err := DeleteDataset(context.Background(), fs, Dataset{Path: "ci/parent"}, DeleteOptions{})
+		require.NoError(t, err)
+		for _, objectPath := range report.Objects {
+			require.False(t, strings.HasPrefix(objectPath, "ci/parent/child/"))
+		}
+		require.Equal(t, countObjects(t, fs, "ci/parent/child/"), countObjects(t, fs, "ci/"))
+		requireNamespaceTestDataset(t, fs, "ci/parent/child")
+	})
+
+	t.Run("require_sealed", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+		opt := Options{
+			Dataset:           Dataset{Path: "ci/live"},
+			FileSystem:        fs,
+			FileRollPolicy:    NewLastBlockNumberRollPolicy(10),
+			FileRollOnClose:   true,
+			TailFlushInterval: time.Nanosecond,
+		}
+
+		w, err := NewWriter[[]int](opt)
+		require.NoError(t, err)
+		for _, b := range generateMixedIntBlocks()[:15] {
+			require.NoError(t, w.Write(context.Background(), b))
+		}
+
+		_, err = DeleteDataset(context.Background(), fs, opt.Dataset, DeleteOptions{RequireSealed: true})
+		require.ErrorIs(t, err, ErrDatasetNotSealed)
+
+		// the tail is stale once the blocks are rolled
+		for _, b := range generateMixedIntBlocks()[15:20] {
+			require.NoError(t, w.Write(context.Background(), b))
+		}
+		require.NoError(t, w.Close(context.Background()))
+
+		report, err := DeleteDataset(context.Background(), fs, opt.Dataset, DeleteOptions{RequireSealed: true})
+		require.NoError(t, err)
+		require.NotZero(t, report.ObjectsDeleted)
+		require.Zero(t, countObjects(t, fs, ""))
+	})
+
+	t.Run("empty_path", func(t *testing.T) {
+		_, err := DeleteDataset(context.Background(), gostorage.NewMemoryFS(), Dataset{}, DeleteOptions{})
+		require.Error(t, err)
+	})
+}
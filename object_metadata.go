@@ -0,0 +1,122 @@
+package ethwal
+
+import (
+	"context"
+	"io"
+	"maps"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+)
+
+// ObjectClass is the class of the stored object, it's attached to the object metadata, so that storage
+// lifecycle rules can match on it.
+type ObjectClass string
+
+const (
+	// ObjectClassData are the ethwal files, patches and blobs.
+	ObjectClassData ObjectClass = "data"
+	// ObjectClassIndex are the index files.
+	ObjectClassIndex ObjectClass = "index"
+	// ObjectClassMeta are the file index, the tail and the presence shards.
+	ObjectClassMeta ObjectClass = "meta"
+)
+
+// Object metadata keys set on every object written by ethwal.
+const (
+	ObjectMetadataClass          = "ethwal-object-class"
+	ObjectMetadataDataset        = "ethwal-dataset"
+	ObjectMetadataDatasetVersion = "ethwal-dataset-version"
+)
+
+const defaultObjectContentType = "application/octet-stream"
+
+// ObjectAttributes are the attributes attached to the stored objects. Storage backends that don't support
+// object metadata, like the local file system, ignore them.
+type ObjectAttributes struct {
+	ContentType string
+	Metadata    map[string]string
+}
+
+// objectAttributes returns the attributes of the object class. The class overrides are merged over
+// the common attributes, the ethwal labels can't be overridden.
+func objectAttributes(dataset Dataset, class ObjectClass, common ObjectAttributes, overrides map[ObjectClass]ObjectAttributes) gostorage.Attributes {
+	override := overrides[class]
+
+	metadata := maps.Clone(common.Metadata)
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	maps.Copy(metadata, override.Metadata)
+
+	metadata[ObjectMetadataClass] = string(class)
+	if dataset.Name != "" {
+		metadata[ObjectMetadataDataset] = dataset.Name
+	}
+	if dataset.Version != "" {
+		metadata[ObjectMetadataDatasetVersion] = dataset.Version
+	}
+
+	contentType := defaultObjectContentType
+	if common.ContentType != "" {
+		contentType = common.ContentType
+	}
+	if override.ContentType != "" {
+		contentType = override.ContentType
+	}
+
+	return gostorage.Attributes{
+		ContentType: contentType,
+		Metadata:    metadata,
+	}
+}
+
+// objectMetadataFS attaches the attributes to the created objects that are created without them.
+type objectMetadataFS struct {
+	storage.FS
+
+	attrs gostorage.Attributes
+}
+
+func newObjectMetadataFS(fs storage.FS, attrs gostorage.Attributes) storage.FS {
+	return &objectMetadataFS{FS: fs, attrs: attrs}
+}
+
+func (o *objectMetadataFS) Create(ctx context.Context, path string, options *gostorage.WriterOptions) (io.WriteCloser, error) {
+	return o.FS.Create(ctx, path, o.writerOptions(options))
+}
+
+func (o *objectMetadataFS) ReadVersion(ctx context.Context, path string) ([]byte, int64, error) {
+	return storage.ReadVersion(ctx, o.FS, path)
+}
+
+func (o *objectMetadataFS) CreateIfVersion(ctx context.Context, path string, data []byte, version int64, options *gostorage.WriterOptions) error {
+	return storage.CreateIfVersion(ctx, o.FS, path, data, version, o.writerOptions(options))
+}
+
+func (o *objectMetadataFS) writerOptions(options *gostorage.WriterOptions) *gostorage.WriterOptions {
+	if options == nil {
+		options = &gostorage.WriterOptions{}
+	} else {
+		optionsCopy := *options
+		options = &optionsCopy
+	}
+
+	if options.Attributes.ContentType == "" {
+		options.Attributes.ContentType = o.attrs.ContentType
+	}
+	if options.Attributes.Metadata == nil {
+		options.Attributes.Metadata = maps.Clone(o.attrs.Metadata)
+	}
+	return options
+}
+
+// withObjectClass returns the file system that attaches the object class attributes to the created objects.
+func (o Options) withObjectClass(fs storage.FS, class ObjectClass) storage.FS {
+	return newObjectMetadataFS(fs, objectAttributes(o.Dataset, class, o.ObjectMetadata, o.ObjectClassMetadata))
+}
+
+// withObjectClass returns the file system that attaches the object class attributes to the created objects.
+func (o IndexerOptions[T]) withObjectClass(fs storage.FS, class ObjectClass) storage.FS {
+	return newObjectMetadataFS(fs, objectAttributes(o.Dataset, class, o.ObjectMetadata, o.ObjectClassMetadata))
+}
@@ -0,0 +1,123 @@
+package ethwal
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingFS records the attributes of the created objects.
+type recordingFS struct {
+	storage.FS
+
+	mu      sync.Mutex
+	created map[string]gostorage.Attributes
+}
+
+func (r *recordingFS) Create(ctx context.Context, path string, options *gostorage.WriterOptions) (io.WriteCloser, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var attrs gostorage.Attributes
+	if options != nil {
+		attrs = options.Attributes
+	}
+	r.created[path] = attrs
+	return r.FS.Create(ctx, path, options)
+}
+
+func TestObjectMetadata(t *testing.T) {
+	fs := &recordingFS{FS: gostorage.NewMemoryFS(), created: make(map[string]gostorage.Attributes)}
+	dataset := Dataset{Name: "blocks", Version: "v1", Path: "ethwal"}
+
+	w, err := NewWriter[[]int](Options{
+		Dataset:         dataset,
+		FileSystem:      fs,
+		FileRollOnClose: true,
+		TrackPresence:   true,
+		ObjectMetadata: ObjectAttributes{
+			Metadata: map[string]string{"team": "data"},
+		},
+		ObjectClassMetadata: map[ObjectClass]ObjectAttributes{
+			ObjectClassData: {ContentType: "application/cbor", Metadata: map[string]string{"lifecycle": "coldline"}},
+		},
+	})
+	require.NoError(t, err)
+
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+		Dataset:    dataset,
+		FileSystem: fs,
+		Indexes:    generateIntIndexes(),
+		ObjectMetadata: ObjectAttributes{
+			Metadata: map[string]string{"team": "data"},
+		},
+	})
+	require.NoError(t, err)
+
+	for _, b := range generateMixedIntBlocks()[:10] {
+		require.NoError(t, w.Write(context.Background(), b))
+		require.NoError(t, indexer.Index(context.Background(), b))
+	}
+	require.NoError(t, w.Close(context.Background()))
+	require.NoError(t, indexer.Close(context.Background()))
+
+	expected := map[ObjectClass]gostorage.Attributes{
+		ObjectClassData: {
+			ContentType: "application/cbor",
+			Metadata: map[string]string{
+				ObjectMetadataClass:          "data",
+				ObjectMetadataDataset:        "blocks",
+				ObjectMetadataDatasetVersion: "v1",
+				"team":                       "data",
+				"lifecycle":                  "coldline",
+			},
+		},
+		ObjectClassIndex: {
+			ContentType: defaultObjectContentType,
+			Metadata: map[string]string{
+				ObjectMetadataClass:          "index",
+				ObjectMetadataDataset:        "blocks",
+				ObjectMetadataDatasetVersion: "v1",
+				"team":                       "data",
+			},
+		},
+		ObjectClassMeta: {
+			ContentType: defaultObjectContentType,
+			Metadata: map[string]string{
+				ObjectMetadataClass:          "meta",
+				ObjectMetadataDataset:        "blocks",
+				ObjectMetadataDatasetVersion: "v1",
+				"team":                       "data",
+			},
+		},
+	}
+
+	datasetPath := dataset.FullPath()
+	classes := make(map[ObjectClass]int)
+	for objectPath, attrs := range fs.created {
+		relPath := strings.TrimPrefix(objectPath, datasetPath)
+
+		var class ObjectClass
+		switch {
+		case strings.HasPrefix(relPath, IndexesDirectory+"/"):
+			class = ObjectClassIndex
+		case relPath == FileIndexFileName, relPath == DatasetManifestFileName, strings.HasPrefix(relPath, PresenceDirectory+"/"):
+			class = ObjectClassMeta
+		default:
+			class = ObjectClassData
+		}
+
+		classes[class]++
+		require.Equal(t, expected[class], attrs, objectPath)
+	}
+
+	require.NotZero(t, classes[ObjectClassData])
+	require.NotZero(t, classes[ObjectClassIndex])
+	require.NotZero(t, classes[ObjectClassMeta])
+}
@@ -0,0 +1,426 @@
+package ethwal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/gcloud"
+	"github.com/c2h5oh/datasize"
+)
+
+const (
+	archivalTargetFileSize = 64 * datasize.MB
+	realtimeFileSize       = 1 * datasize.MB
+	realtimeTailInterval   = time.Second
+)
+
+var (
+	ErrInvalidOptions = fmt.Errorf("invalid options")
+)
+
+// Option configures the options built by NewOptions.
+type Option func(b *optionsBuilder) error
+
+type optionsBuilder struct {
+	opt Options
+
+	// set are the option groups with the option that set them, every group can be set once
+	set map[string]string
+	// preset is the name of the preset applying its options
+	preset string
+	// codec is the codec set by WithCBOR, WithCBORPreset or WithJSON
+	codec string
+}
+
+// claim marks the option group as set by the option, the group that is already set is the conflict.
+func (b *optionsBuilder) claim(group, option string) error {
+	if b.preset != "" {
+		option = fmt.Sprintf("%s of %s", option, b.preset)
+	}
+	if prev, ok := b.set[group]; ok {
+		return fmt.Errorf("%s conflicts with %s, both set the %s", option, prev, group)
+	}
+	b.set[group] = option
+	return nil
+}
+
+// NewOptions builds the options from the option functions. Every option validates its inputs, the options
+// setting the same thing, e.g. WithCBOR and WithJSON, conflict, and the result is checked by Options.Validate,
+// so that the configuration mistakes fail here and not on the first read or write. WithDataset is required.
+func NewOptions(opts ...Option) (Options, error) {
+	b := &optionsBuilder{set: make(map[string]string)}
+	for _, opt := range opts {
+		err := opt(b)
+		if err != nil {
+			return Options{}, fmt.Errorf("%w: %w", ErrInvalidOptions, err)
+		}
+	}
+
+	if b.opt.JSONFieldAliases != nil && b.codec != "json" {
+		return Options{}, fmt.Errorf("%w: WithJSONFieldAliases requires WithJSON", ErrInvalidOptions)
+	}
+
+	err := b.opt.Validate()
+	if err != nil {
+		return Options{}, err
+	}
+	return b.opt, nil
+}
+
+// Validate checks that the options are complete and consistent. The zero values defaulted by WithDefaults are
+// valid, the encoder and the compressor must be set together with the decoder and the decompressor.
+func (o Options) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%w: %s", ErrInvalidOptions, fmt.Sprintf(format, args...)))
+	}
+
+	if o.Dataset.Path == "" {
+		invalid("Dataset.Path is empty")
+	}
+	if o.Dataset.CachePath != "" && (o.FileSystem == nil || isLocalFS(o.FileSystem)) {
+		invalid("Dataset.CachePath is ignored by the local file system")
+	}
+	if (o.NewEncoder == nil) != (o.NewDecoder == nil) && o.CBORPreset == "" {
+		invalid("NewEncoder and NewDecoder must be set together")
+	}
+	if (o.NewCompressor == nil) != (o.NewDecompressor == nil) {
+		invalid("NewCompressor and NewDecompressor must be set together")
+	}
+	if o.CBORPreset != "" {
+		if _, err := LookupCBORPreset(o.CBORPreset); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %w", ErrInvalidOptions, err))
+		}
+	}
+	if o.OnFileWrittenAsync && o.OnFileWritten == nil {
+		invalid("OnFileWrittenAsync requires OnFileWritten")
+	}
+	if o.Accounting != nil && !o.EnableAccounting {
+		invalid("Accounting requires EnableAccounting")
+	}
+	if o.LocalJournalSyncInterval != 0 && o.LocalJournalPath == "" {
+		invalid("LocalJournalSyncInterval requires LocalJournalPath")
+	}
+	if o.BloomFalsePositiveRate < 0 || o.BloomFalsePositiveRate >= 1 {
+		invalid("BloomFalsePositiveRate %v is not in [0, 1)", o.BloomFalsePositiveRate)
+	}
+	if o.FilePrefetchTimeout < 0 || o.TailFlushInterval < 0 || o.LocalJournalSyncInterval < 0 || o.TailPollInterval < 0 {
+		invalid("durations must not be negative")
+	}
+	if o.SchemaVersion < 0 || o.DecodeAhead < 0 || o.MaxBlockMetaKeys < 0 || o.PrefetchDepth < 0 {
+		invalid("SchemaVersion, DecodeAhead, MaxBlockMetaKeys and PrefetchDepth must not be negative")
+	}
+	return errors.Join(errs...)
+}
+
+// WithDataset sets the dataset stored at <path>/<name?>/<version?>.
+func WithDataset(name, version, path string) Option {
+	return func(b *optionsBuilder) error {
+		if path == "" {
+			return fmt.Errorf("WithDataset: path is empty")
+		}
+		if strings.Contains(name, "/") || strings.Contains(version, "/") {
+			return fmt.Errorf("WithDataset: name %q and version %q must not contain '/'", name, version)
+		}
+		if err := b.claim("dataset", "WithDataset"); err != nil {
+			return err
+		}
+		b.opt.Dataset.Name, b.opt.Dataset.Version, b.opt.Dataset.Path = name, version, path
+		return nil
+	}
+}
+
+// WithCachePath sets the local directory the files of the remote file system are cached in.
+func WithCachePath(path string) Option {
+	return func(b *optionsBuilder) error {
+		if path == "" {
+			return fmt.Errorf("WithCachePath: path is empty")
+		}
+		if err := b.claim("cache path", "WithCachePath"); err != nil {
+			return err
+		}
+		b.opt.Dataset.CachePath = path
+		return nil
+	}
+}
+
+// WithFileSystem sets the file system of the dataset. Defaults to the local file system.
+func WithFileSystem(fs storage.FS) Option {
+	return func(b *optionsBuilder) error {
+		if fs == nil {
+			return fmt.Errorf("WithFileSystem: file system is nil")
+		}
+		if err := b.claim("file system", "WithFileSystem"); err != nil {
+			return err
+		}
+		b.opt.FileSystem = fs
+		return nil
+	}
+}
+
+// WithGCS sets the Google Cloud Storage bucket as the file system of the dataset, with the default credentials.
+func WithGCS(bucket string) Option {
+	return func(b *optionsBuilder) error {
+		if bucket == "" || strings.Contains(bucket, "/") {
+			return fmt.Errorf("WithGCS: invalid bucket %q", bucket)
+		}
+		if err := b.claim("file system", "WithGCS"); err != nil {
+			return err
+		}
+		b.opt.FileSystem = gcloud.NewGCloudFS(bucket, nil)
+		return nil
+	}
+}
+
+// WithCBOR sets the CBOR encoder and decoder.
+func WithCBOR() Option {
+	return func(b *optionsBuilder) error {
+		if err := b.claim("codec", "WithCBOR"); err != nil {
+			return err
+		}
+		b.opt.NewEncoder, b.opt.NewDecoder = NewCBOREncoder, NewCBORDecoder
+		b.codec = "cbor"
+		return nil
+	}
+}
+
+// WithCBORPreset sets the registered CBOR preset, see RegisterCBORPreset.
+func WithCBORPreset(name string) Option {
+	return func(b *optionsBuilder) error {
+		preset, err := LookupCBORPreset(name)
+		if err != nil {
+			return fmt.Errorf("WithCBORPreset: %w", err)
+		}
+		if err := b.claim("codec", "WithCBORPreset"); err != nil {
+			return err
+		}
+		b.opt.CBORPreset = name
+		b.opt.NewEncoder, b.opt.NewDecoder = preset.NewEncoder(), preset.NewDecoder()
+		b.codec = "cbor"
+		return nil
+	}
+}
+
+// WithJSON sets the JSON encoder and decoder.
+func WithJSON() Option {
+	return func(b *optionsBuilder) error {
+		if err := b.claim("codec", "WithJSON"); err != nil {
+			return err
+		}
+		b.opt.NewEncoder, b.opt.NewDecoder = NewJSONEncoder, NewJSONDecoder
+		b.codec = "json"
+		return nil
+	}
+}
+
+// WithJSONFieldAliases sets the legacy names of the block fields keyed by the canonical JSON field names, see
+// Options.JSONFieldAliases. It requires WithJSON.
+func WithJSONFieldAliases(aliases map[string]string) Option {
+	return func(b *optionsBuilder) error {
+		if len(aliases) == 0 {
+			return fmt.Errorf("WithJSONFieldAliases: no aliases")
+		}
+		for field, alias := range aliases {
+			if _, ok := legacyJSONFieldAliases[field]; !ok {
+				return fmt.Errorf("WithJSONFieldAliases: %q is not a block field", field)
+			}
+			if alias == "" {
+				return fmt.Errorf("WithJSONFieldAliases: alias of %q is empty", field)
+			}
+		}
+		if err := b.claim("json field aliases", "WithJSONFieldAliases"); err != nil {
+			return err
+		}
+		b.opt.JSONFieldAliases = aliases
+		return nil
+	}
+}
+
+// WithZSTD sets the zstd compressor and decompressor.
+func WithZSTD() Option {
+	return func(b *optionsBuilder) error {
+		if err := b.claim("compression", "WithZSTD"); err != nil {
+			return err
+		}
+		b.opt.NewCompressor, b.opt.NewDecompressor = NewZSTDCompressor, NewZSTDDecompressor
+		return nil
+	}
+}
+
+// WithoutCompression stores the files uncompressed.
+func WithoutCompression() Option {
+	return func(b *optionsBuilder) error {
+		if err := b.claim("compression", "WithoutCompression"); err != nil {
+			return err
+		}
+		b.opt.NewCompressor, b.opt.NewDecompressor = nil, nil
+		return nil
+	}
+}
+
+// WithRollPolicy sets the file roll policy of the writer. Defaults to the 8MB file size policy.
+func WithRollPolicy(p FileRollPolicy) Option {
+	return func(b *optionsBuilder) error {
+		if p == nil {
+			return fmt.Errorf("WithRollPolicy: roll policy is nil")
+		}
+		if err := b.claim("roll policy", "WithRollPolicy"); err != nil {
+			return err
+		}
+		b.opt.FileRollPolicy = p
+		return nil
+	}
+}
+
+// WithRollOnClose makes the writer roll the file on close.
+func WithRollOnClose() Option {
+	return func(b *optionsBuilder) error {
+		if err := b.claim("roll on close", "WithRollOnClose"); err != nil {
+			return err
+		}
+		b.opt.FileRollOnClose = true
+		return nil
+	}
+}
+
+// WithOpenExisting makes the reader and writer fail with ErrDatasetNotExist if the dataset doesn't exist, see
+// Options.OpenExisting.
+func WithOpenExisting() Option {
+	return func(b *optionsBuilder) error {
+		b.opt.OpenExisting = true
+		return nil
+	}
+}
+
+// WithTailFollowing makes the writer flush the blocks that are not rolled yet to the tail at most once per
+// interval and the reader follow the tail, see Options.TailFlushInterval and Options.FollowTail.
+func WithTailFollowing(interval time.Duration) Option {
+	return func(b *optionsBuilder) error {
+		if interval <= 0 {
+			return fmt.Errorf("WithTailFollowing: interval %s is not positive", interval)
+		}
+		if err := b.claim("tail", "WithTailFollowing"); err != nil {
+			return err
+		}
+		b.opt.TailFlushInterval, b.opt.FollowTail = interval, true
+		return nil
+	}
+}
+
+// WithTailMode makes the reader wait for the new blocks, reloading the file index every poll interval, see
+// Options.TailMode.
+func WithTailMode(pollInterval time.Duration) Option {
+	return func(b *optionsBuilder) error {
+		if pollInterval <= 0 {
+			return fmt.Errorf("WithTailMode: poll interval %s is not positive", pollInterval)
+		}
+		if err := b.claim("tail mode", "WithTailMode"); err != nil {
+			return err
+		}
+		b.opt.TailMode, b.opt.TailPollInterval = true, pollInterval
+		return nil
+	}
+}
+
+// WithPrefetchTimeout sets the timeout of the reader prefetch. Defaults to 30 seconds.
+func WithPrefetchTimeout(timeout time.Duration) Option {
+	return func(b *optionsBuilder) error {
+		if timeout <= 0 {
+			return fmt.Errorf("WithPrefetchTimeout: timeout %s is not positive", timeout)
+		}
+		if err := b.claim("prefetch timeout", "WithPrefetchTimeout"); err != nil {
+			return err
+		}
+		b.opt.FilePrefetchTimeout = timeout
+		return nil
+	}
+}
+
+// WithPrefetchDepth sets the number of the files the reader prefetches ahead and the bound of their total
+// size, unbounded if zero.
+func WithPrefetchDepth(depth int, maxBytes datasize.ByteSize) Option {
+	return func(b *optionsBuilder) error {
+		if depth <= 0 {
+			return fmt.Errorf("WithPrefetchDepth: depth %d is not positive", depth)
+		}
+		if err := b.claim("prefetch depth", "WithPrefetchDepth"); err != nil {
+			return err
+		}
+		b.opt.PrefetchDepth, b.opt.PrefetchMaxBytes = depth, maxBytes
+		return nil
+	}
+}
+
+// WithAccounting enables the storage accounting, the counters are added to the accounting if it's not nil.
+func WithAccounting(accounting *storage.Accounting) Option {
+	return func(b *optionsBuilder) error {
+		if err := b.claim("accounting", "WithAccounting"); err != nil {
+			return err
+		}
+		b.opt.EnableAccounting, b.opt.Accounting = true, accounting
+		return nil
+	}
+}
+
+// WithSchemaVersion sets the payload schema version of the block data, see Options.SchemaVersion.
+func WithSchemaVersion(version int) Option {
+	return func(b *optionsBuilder) error {
+		if version <= 0 {
+			return fmt.Errorf("WithSchemaVersion: version %d is not positive", version)
+		}
+		if err := b.claim("schema version", "WithSchemaVersion"); err != nil {
+			return err
+		}
+		b.opt.SchemaVersion = version
+		return nil
+	}
+}
+
+// ArchivalDataset is the preset of the dataset written in bulk and read in full: CBOR, zstd, the files
+// rolled at 64MB compressed and on close.
+func ArchivalDataset(name, version, path string) Option {
+	return preset("ArchivalDataset", func() []Option {
+		return []Option{
+			WithDataset(name, version, path),
+			WithCBOR(),
+			WithZSTD(),
+			WithRollPolicy(NewTargetObjectSizeRollPolicy(archivalTargetFileSize)),
+			WithRollOnClose(),
+		}
+	})
+}
+
+// RealtimeDataset is the preset of the dataset followed by the readers while it's written: CBOR, zstd, the
+// files rolled at 1MB and on close, and the tail flushed and followed every second.
+func RealtimeDataset(name, version, path string) Option {
+	return preset("RealtimeDataset", func() []Option {
+		return []Option{
+			WithDataset(name, version, path),
+			WithCBOR(),
+			WithZSTD(),
+			WithRollPolicy(NewFileSizeRollPolicy(uint64(realtimeFileSize))),
+			WithRollOnClose(),
+			WithTailFollowing(realtimeTailInterval),
+		}
+	})
+}
+
+// preset applies the options under the preset name, so that the conflicts name the preset. The options are
+// created on every use, the roll policies must not be shared by the writers.
+func preset(name string, options func() []Option) Option {
+	return func(b *optionsBuilder) error {
+		b.preset = name
+		defer func() { b.preset = "" }()
+
+		for _, opt := range options() {
+			err := opt(b)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
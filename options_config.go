@@ -0,0 +1,195 @@
+package ethwal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ConfigPresetArchival = "archival"
+	ConfigPresetRealtime = "realtime"
+)
+
+var (
+	configEncodings    = []string{ManifestEncodingCBOR, ManifestEncodingJSON}
+	configCompressions = []string{ManifestCompressionZSTD, ManifestCompressionNone}
+	configPresets      = []string{ConfigPresetArchival, ConfigPresetRealtime}
+)
+
+// OptionsConfig is the serializable configuration of the dataset options, e.g. of the config file of the
+// tools. The encoder and the compressor are set by their names, the file system by the bucket, see
+// OptionsConfig.NewOptions. The zero fields are the defaults of NewOptions.
+type OptionsConfig struct {
+	Name    string `json:"name,omitempty" yaml:"name,omitempty"`
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+	Path    string `json:"path,omitempty" yaml:"path,omitempty"`
+	// CachePath is the local directory the files of the bucket are cached in, see Dataset.CachePath.
+	CachePath string `json:"cachePath,omitempty" yaml:"cachePath,omitempty"`
+
+	// GoogleCloudBucket sets the Google Cloud Storage bucket as the file system, with the default credentials.
+	GoogleCloudBucket string `json:"googleCloudBucket,omitempty" yaml:"googleCloudBucket,omitempty"`
+	// S3Bucket is the S3 bucket of the dataset, its file system is set by the caller, see
+	// OptionsConfig.NewOptions.
+	S3Bucket string `json:"s3Bucket,omitempty" yaml:"s3Bucket,omitempty"`
+	// S3Endpoint is the endpoint of the S3-compatible service, e.g. minio.
+	S3Endpoint string `json:"s3Endpoint,omitempty" yaml:"s3Endpoint,omitempty"`
+
+	// Preset is ConfigPresetArchival or ConfigPresetRealtime, see ArchivalDataset and RealtimeDataset. The
+	// preset sets the encoding, the compression and the file rolls.
+	Preset string `json:"preset,omitempty" yaml:"preset,omitempty"`
+	// Encoding is ManifestEncodingCBOR or ManifestEncodingJSON.
+	Encoding string `json:"encoding,omitempty" yaml:"encoding,omitempty"`
+	// CBORPreset is the name of the registered CBOR preset, see RegisterCBORPreset, in place of Encoding.
+	CBORPreset string `json:"cborPreset,omitempty" yaml:"cborPreset,omitempty"`
+	// Compression is ManifestCompressionZSTD or ManifestCompressionNone.
+	Compression string `json:"compression,omitempty" yaml:"compression,omitempty"`
+
+	// FileSize sets the file size roll policy, see NewFileSizeRollPolicy.
+	FileSize datasize.ByteSize `json:"fileSize,omitempty" yaml:"fileSize,omitempty"`
+	// FileBlockInterval sets the block number roll policy, see NewLastBlockNumberRollPolicy.
+	FileBlockInterval uint64 `json:"fileBlockInterval,omitempty" yaml:"fileBlockInterval,omitempty"`
+	// FileMaxAge is the duration of the time based roll policy, e.g. 1h, see time.ParseDuration and
+	// NewTimeBasedRollPolicy. The file is rolled by whichever of FileSize, FileBlockInterval and FileMaxAge set
+	// triggers first, see NewFileSizeOrLastBlockNumberOrTimeRollPolicy.
+	FileMaxAge      string `json:"fileMaxAge,omitempty" yaml:"fileMaxAge,omitempty"`
+	FileRollOnClose bool   `json:"fileRollOnClose,omitempty" yaml:"fileRollOnClose,omitempty"`
+
+	OpenExisting         bool              `json:"openExisting,omitempty" yaml:"openExisting,omitempty"`
+	SchemaVersion        int               `json:"schemaVersion,omitempty" yaml:"schemaVersion,omitempty"`
+	PrefetchDepth        int               `json:"prefetchDepth,omitempty" yaml:"prefetchDepth,omitempty"`
+	PrefetchMaxBytes     datasize.ByteSize `json:"prefetchMaxBytes,omitempty" yaml:"prefetchMaxBytes,omitempty"`
+	SkipCorruptFiles     bool              `json:"skipCorruptFiles,omitempty" yaml:"skipCorruptFiles,omitempty"`
+	VerifyChecksumOnRead bool              `json:"verifyChecksumOnRead,omitempty" yaml:"verifyChecksumOnRead,omitempty"`
+}
+
+// ReadOptionsConfig reads the config file, YAML or JSON. The unknown fields fail, so that the mistyped
+// settings aren't ignored.
+func ReadOptionsConfig(path string) (OptionsConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return OptionsConfig{}, fmt.Errorf("failed to read options config: %w", err)
+	}
+
+	// yaml is a superset of json, the fields have the same names
+	var config OptionsConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return OptionsConfig{}, fmt.Errorf("failed to parse options config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// LoadOptions reads the config file and builds its options, see ReadOptionsConfig and
+// OptionsConfig.NewOptions. The config of the S3 bucket is built by OptionsConfig.NewOptions with the file
+// system of the bucket.
+func LoadOptions(path string) (Options, error) {
+	config, err := ReadOptionsConfig(path)
+	if err != nil {
+		return Options{}, err
+	}
+	return config.NewOptions()
+}
+
+// NewOptions builds the options of the config with NewOptions, the options are added after the ones of the
+// config. The unknown encoding, compression and preset fail with ErrInvalidOptions listing the supported
+// ones, so does the invalid FileMaxAge. The ethwal package doesn't depend on the S3 client, the config of
+// the S3 bucket requires the option setting the file system of the bucket, e.g. WithFileSystem of
+// s3.NewDefaultS3FS.
+func (c OptionsConfig) NewOptions(opts ...Option) (Options, error) {
+	if c.S3Bucket != "" && c.GoogleCloudBucket != "" {
+		return Options{}, fmt.Errorf("%w: both google cloud bucket and s3 bucket are set", ErrInvalidOptions)
+	}
+
+	var configOpts []Option
+	switch c.Preset {
+	case ConfigPresetArchival:
+		configOpts = append(configOpts, ArchivalDataset(c.Name, c.Version, c.Path))
+	case ConfigPresetRealtime:
+		configOpts = append(configOpts, RealtimeDataset(c.Name, c.Version, c.Path))
+	case "":
+		configOpts = append(configOpts, WithDataset(c.Name, c.Version, c.Path))
+	default:
+		return Options{}, unsupportedConfigValue("preset", c.Preset, configPresets)
+	}
+
+	switch c.Encoding {
+	case ManifestEncodingCBOR:
+		configOpts = append(configOpts, WithCBOR())
+	case ManifestEncodingJSON:
+		configOpts = append(configOpts, WithJSON())
+	case "":
+	default:
+		return Options{}, unsupportedConfigValue("encoding", c.Encoding, configEncodings)
+	}
+	if c.CBORPreset != "" {
+		configOpts = append(configOpts, WithCBORPreset(c.CBORPreset))
+	}
+
+	switch c.Compression {
+	case ManifestCompressionZSTD:
+		configOpts = append(configOpts, WithZSTD())
+	case ManifestCompressionNone:
+		configOpts = append(configOpts, WithoutCompression())
+	case "":
+	default:
+		return Options{}, unsupportedConfigValue("compression", c.Compression, configCompressions)
+	}
+
+	if c.GoogleCloudBucket != "" {
+		configOpts = append(configOpts, WithGCS(c.GoogleCloudBucket))
+	}
+	if c.CachePath != "" {
+		configOpts = append(configOpts, WithCachePath(c.CachePath))
+	}
+	var fileMaxAge time.Duration
+	if c.FileMaxAge != "" {
+		var err error
+		fileMaxAge, err = time.ParseDuration(c.FileMaxAge)
+		if err != nil || fileMaxAge <= 0 {
+			return Options{}, fmt.Errorf("%w: invalid file max age %q, expected the positive duration, e.g. 1h", ErrInvalidOptions, c.FileMaxAge)
+		}
+	}
+	switch {
+	case c.FileBlockInterval > 0 || fileMaxAge > 0:
+		configOpts = append(configOpts, WithRollPolicy(NewFileSizeOrLastBlockNumberOrTimeRollPolicy(uint64(c.FileSize), c.FileBlockInterval, fileMaxAge)))
+	case c.FileSize > 0:
+		configOpts = append(configOpts, WithRollPolicy(NewFileSizeRollPolicy(uint64(c.FileSize))))
+	}
+	if c.FileRollOnClose {
+		configOpts = append(configOpts, WithRollOnClose())
+	}
+	if c.OpenExisting {
+		configOpts = append(configOpts, WithOpenExisting())
+	}
+	if c.SchemaVersion > 0 {
+		configOpts = append(configOpts, WithSchemaVersion(c.SchemaVersion))
+	}
+	if c.PrefetchDepth > 0 || c.PrefetchMaxBytes > 0 {
+		configOpts = append(configOpts, WithPrefetchDepth(c.PrefetchDepth, c.PrefetchMaxBytes))
+	}
+
+	opt, err := NewOptions(append(configOpts, opts...)...)
+	if err != nil {
+		return Options{}, err
+	}
+	if c.S3Bucket != "" && opt.FileSystem == nil {
+		return Options{}, fmt.Errorf("%w: s3 bucket %s requires the option setting its file system", ErrInvalidOptions, c.S3Bucket)
+	}
+	opt.SkipCorruptFiles = c.SkipCorruptFiles
+	opt.VerifyChecksumOnRead = c.VerifyChecksumOnRead
+	return opt, nil
+}
+
+func unsupportedConfigValue(field, value string, supported []string) error {
+	return fmt.Errorf("%w: unknown %s %q, supported: %s", ErrInvalidOptions, field, value, strings.Join(supported, ", "))
+}
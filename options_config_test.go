@@ -0,0 +1,146 @@
+package ethwal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage/memory"
+	"github.com/c2h5oh/datasize"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestOptionsConfig_RoundTrip(t *testing.T) {
+	config := OptionsConfig{
+		Name:                 "blocks",
+		Version:              "v1",
+		Path:                 "data",
+		GoogleCloudBucket:    "bucket",
+		CachePath:            "/tmp/cache",
+		Encoding:             ManifestEncodingJSON,
+		Compression:          ManifestCompressionZSTD,
+		FileSize:             16 * datasize.MB,
+		FileRollOnClose:      true,
+		SchemaVersion:        2,
+		PrefetchDepth:        4,
+		PrefetchMaxBytes:     64 * datasize.MB,
+		VerifyChecksumOnRead: true,
+	}
+
+	for name, marshal := range map[string]func(any) ([]byte, error){"json": json.Marshal, "yaml": yaml.Marshal} {
+		t.Run(name, func(t *testing.T) {
+			data, err := marshal(config)
+			require.NoError(t, err)
+
+			path := filepath.Join(t.TempDir(), "config."+name)
+			require.NoError(t, os.WriteFile(path, data, 0644))
+
+			read, err := ReadOptionsConfig(path)
+			require.NoError(t, err)
+			require.Equal(t, config, read)
+
+			opt, err := LoadOptions(path)
+			require.NoError(t, err)
+			require.Equal(t, Dataset{Name: "blocks", Version: "v1", Path: "data", CachePath: "/tmp/cache"}, opt.Dataset)
+			require.NotNil(t, opt.FileSystem)
+			require.True(t, sameFunc(opt.NewEncoder, NewJSONEncoder))
+			require.True(t, sameFunc(opt.NewDecoder, NewJSONDecoder))
+			require.True(t, sameFunc(opt.NewCompressor, NewZSTDCompressor))
+			require.True(t, sameFunc(opt.NewDecompressor, NewZSTDDecompressor))
+			require.Equal(t, NewFileSizeRollPolicy(uint64(16*datasize.MB)), opt.FileRollPolicy)
+			require.True(t, opt.FileRollOnClose)
+			require.Equal(t, 2, opt.SchemaVersion)
+			require.Equal(t, 4, opt.PrefetchDepth)
+			require.Equal(t, 64*datasize.MB, opt.PrefetchMaxBytes)
+			require.True(t, opt.VerifyChecksumOnRead)
+		})
+	}
+}
+
+func TestOptionsConfig_NewOptions(t *testing.T) {
+	writeConfig := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+
+	t.Run("unknown_names", func(t *testing.T) {
+		for _, tc := range []struct {
+			config   OptionsConfig
+			expected string
+		}{
+			{config: OptionsConfig{Path: "data", Encoding: "protobuf"}, expected: `unknown encoding "protobuf", supported: cbor, json`},
+			{config: OptionsConfig{Path: "data", Compression: "gzip"}, expected: `unknown compression "gzip", supported: zstd, none`},
+			{config: OptionsConfig{Path: "data", Preset: "hot"}, expected: `unknown preset "hot", supported: archival, realtime`},
+		} {
+			_, err := tc.config.NewOptions()
+			require.ErrorIs(t, err, ErrInvalidOptions)
+			require.ErrorContains(t, err, tc.expected)
+		}
+	})
+
+	t.Run("unknown_field", func(t *testing.T) {
+		_, err := ReadOptionsConfig(writeConfig(t, "path: data\nencoder: cbor\n"))
+		require.ErrorContains(t, err, "encoder")
+	})
+
+	t.Run("preset", func(t *testing.T) {
+		opt, err := LoadOptions(writeConfig(t, "path: data\npreset: archival\n"))
+		require.NoError(t, err)
+		require.True(t, sameFunc(opt.NewCompressor, NewZSTDCompressor))
+		require.True(t, opt.FileRollOnClose)
+
+		// the preset sets the compression
+		_, err = LoadOptions(writeConfig(t, "path: data\npreset: archival\ncompression: none\n"))
+		require.ErrorIs(t, err, ErrInvalidOptions)
+	})
+
+	t.Run("roll_policies", func(t *testing.T) {
+		opt, err := LoadOptions(writeConfig(t, "path: data\nfileSize: 16MB\nfileBlockInterval: 1000\nfileMaxAge: 1h\n"))
+		require.NoError(t, err)
+		policies, ok := opt.FileRollPolicy.(FileRollPolicies)
+		require.True(t, ok)
+		require.Len(t, policies, 3)
+		require.Equal(t, NewFileSizeRollPolicy(uint64(16*datasize.MB)), policies[0])
+		require.Equal(t, NewLastBlockNumberRollPolicy(1000), policies[1])
+		require.Equal(t, time.Hour, policies[2].(*timeBasedRollPolicy).rollInterval)
+
+		opt, err = LoadOptions(writeConfig(t, "path: data\nfileBlockInterval: 1000\n"))
+		require.NoError(t, err)
+		require.Equal(t, FileRollPolicies{NewLastBlockNumberRollPolicy(1000)}, opt.FileRollPolicy)
+
+		for _, fileMaxAge := range []string{"-1h", "hour", "0s"} {
+			_, err = OptionsConfig{Path: "data", FileMaxAge: fileMaxAge}.NewOptions()
+			require.ErrorIs(t, err, ErrInvalidOptions)
+			require.ErrorContains(t, err, fmt.Sprintf("invalid file max age %q", fileMaxAge))
+		}
+	})
+
+	t.Run("s3", func(t *testing.T) {
+		config := OptionsConfig{Path: "data", S3Bucket: "bucket"}
+		_, err := config.NewOptions()
+		require.ErrorIs(t, err, ErrInvalidOptions)
+
+		fs := memory.NewMemoryFS()
+		opt, err := config.NewOptions(WithFileSystem(fs))
+		require.NoError(t, err)
+		require.Equal(t, fs, opt.FileSystem)
+
+		config.GoogleCloudBucket = "bucket"
+		_, err = config.NewOptions(WithFileSystem(fs))
+		require.ErrorIs(t, err, ErrInvalidOptions)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		config, err := ReadOptionsConfig(writeConfig(t, ""))
+		require.NoError(t, err)
+		require.Equal(t, OptionsConfig{}, config)
+
+		_, err = config.NewOptions()
+		require.ErrorIs(t, err, ErrInvalidOptions)
+	})
+}
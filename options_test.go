@@ -0,0 +1,334 @@
+package ethwal
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/local"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/c2h5oh/datasize"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewOptions(t *testing.T) {
+	fs := gostorage.NewMemoryFS()
+	accounting := storage.NewAccounting(nil)
+	rollPolicy := NewLastBlockNumberRollPolicy(10)
+
+	testCases := []struct {
+		name   string
+		option Option
+		check  func(t *testing.T, opt Options)
+	}{
+		{
+			name:   "dataset",
+			option: WithDataset("blocks", "v1", "ethwal"),
+			check: func(t *testing.T, opt Options) {
+				require.Equal(t, Dataset{Name: "blocks", Version: "v1", Path: "ethwal"}, opt.Dataset)
+			},
+		},
+		{
+			name:   "cache_path",
+			option: WithCachePath("cache"),
+			check: func(t *testing.T, opt Options) {
+				require.Equal(t, "cache", opt.Dataset.CachePath)
+			},
+		},
+		{
+			name:   "file_system",
+			option: WithFileSystem(fs),
+			check: func(t *testing.T, opt Options) {
+				require.Equal(t, fs, opt.FileSystem)
+			},
+		},
+		{
+			name:   "cbor",
+			option: WithCBOR(),
+			check: func(t *testing.T, opt Options) {
+				require.NotNil(t, opt.NewEncoder)
+				require.NotNil(t, opt.NewDecoder)
+			},
+		},
+		{
+			name:   "cbor_preset",
+			option: WithCBORPreset(CBORCanonical),
+			check: func(t *testing.T, opt Options) {
+				require.Equal(t, CBORCanonical, opt.CBORPreset)
+				require.NotNil(t, opt.NewEncoder)
+				require.NotNil(t, opt.NewDecoder)
+			},
+		},
+		{
+			name:   "json",
+			option: WithJSON(),
+			check: func(t *testing.T, opt Options) {
+				require.NotNil(t, opt.NewEncoder)
+				require.NotNil(t, opt.NewDecoder)
+			},
+		},
+		{
+			name:   "zstd",
+			option: WithZSTD(),
+			check: func(t *testing.T, opt Options) {
+				require.NotNil(t, opt.NewCompressor)
+				require.NotNil(t, opt.NewDecompressor)
+			},
+		},
+		{
+			name:   "no_compression",
+			option: WithoutCompression(),
+			check: func(t *testing.T, opt Options) {
+				require.Nil(t, opt.NewCompressor)
+				require.Nil(t, opt.NewDecompressor)
+			},
+		},
+		{
+			name:   "roll_policy",
+			option: WithRollPolicy(rollPolicy),
+			check: func(t *testing.T, opt Options) {
+				require.Equal(t, rollPolicy, opt.FileRollPolicy)
+			},
+		},
+		{
+			name:   "roll_on_close",
+			option: WithRollOnClose(),
+			check: func(t *testing.T, opt Options) {
+				require.True(t, opt.FileRollOnClose)
+			},
+		},
+		{
+			name:   "tail_following",
+			option: WithTailFollowing(time.Second),
+			check: func(t *testing.T, opt Options) {
+				require.Equal(t, time.Second, opt.TailFlushInterval)
+				require.True(t, opt.FollowTail)
+			},
+		},
+		{
+			name:   "tail_mode",
+			option: WithTailMode(100 * time.Millisecond),
+			check: func(t *testing.T, opt Options) {
+				require.True(t, opt.TailMode)
+				require.Equal(t, 100*time.Millisecond, opt.TailPollInterval)
+			},
+		},
+		{
+			name:   "prefetch_timeout",
+			option: WithPrefetchTimeout(time.Minute),
+			check: func(t *testing.T, opt Options) {
+				require.Equal(t, time.Minute, opt.FilePrefetchTimeout)
+			},
+		},
+		{
+			name:   "prefetch_depth",
+			option: WithPrefetchDepth(4, 64*datasize.MB),
+			check: func(t *testing.T, opt Options) {
+				require.Equal(t, 4, opt.PrefetchDepth)
+				require.Equal(t, 64*datasize.MB, opt.PrefetchMaxBytes)
+			},
+		},
+		{
+			name:   "accounting",
+			option: WithAccounting(accounting),
+			check: func(t *testing.T, opt Options) {
+				require.True(t, opt.EnableAccounting)
+				require.Same(t, accounting, opt.Accounting)
+			},
+		},
+		{
+			name:   "schema_version",
+			option: WithSchemaVersion(2),
+			check: func(t *testing.T, opt Options) {
+				require.Equal(t, 2, opt.SchemaVersion)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := []Option{tc.option}
+			if tc.name != "dataset" {
+				opts = append(opts, WithDataset("", "", "ethwal"))
+			}
+			if tc.name == "cache_path" {
+				opts = append(opts, WithFileSystem(fs))
+			}
+
+			opt, err := NewOptions(opts...)
+			require.NoError(t, err)
+			require.NoError(t, opt.Validate())
+			tc.check(t, opt)
+		})
+	}
+
+	t.Run("json_field_aliases", func(t *testing.T) {
+		aliases := map[string]string{"blockNum": "n"}
+		opt, err := NewOptions(WithDataset("", "", "ethwal"), WithJSON(), WithJSONFieldAliases(aliases))
+		require.NoError(t, err)
+		require.Equal(t, aliases, opt.JSONFieldAliases)
+	})
+
+	t.Run("invalid_inputs", func(t *testing.T) {
+		for _, option := range []Option{
+			WithDataset("", "", ""),
+			WithDataset("a/b", "", "ethwal"),
+			WithCachePath(""),
+			WithFileSystem(nil),
+			WithGCS(""),
+			WithGCS("bucket/path"),
+			WithCBORPreset("unknown"),
+			WithJSONFieldAliases(nil),
+			WithJSONFieldAliases(map[string]string{"number": "n"}),
+			WithJSONFieldAliases(map[string]string{"blockNum": ""}),
+			WithRollPolicy(nil),
+			WithTailFollowing(0),
+			WithPrefetchTimeout(-time.Second),
+			WithPrefetchDepth(0, 0),
+			WithSchemaVersion(0),
+		} {
+			_, err := NewOptions(WithDataset("", "", "ethwal"), option)
+			require.ErrorIs(t, err, ErrInvalidOptions)
+		}
+	})
+}
+
+func TestNewOptions_Conflicts(t *testing.T) {
+	testCases := []struct {
+		name    string
+		options []Option
+		err     string
+	}{
+		{
+			name:    "codec",
+			options: []Option{WithDataset("", "", "ethwal"), WithCBOR(), WithJSON()},
+			err:     "WithJSON conflicts with WithCBOR, both set the codec",
+		},
+		{
+			name:    "compression",
+			options: []Option{WithDataset("", "", "ethwal"), WithZSTD(), WithoutCompression()},
+			err:     "WithoutCompression conflicts with WithZSTD, both set the compression",
+		},
+		{
+			name:    "file_system",
+			options: []Option{WithDataset("", "", "ethwal"), WithFileSystem(gostorage.NewMemoryFS()), WithGCS("bucket")},
+			err:     "WithGCS conflicts with WithFileSystem, both set the file system",
+		},
+		{
+			name:    "preset",
+			options: []Option{WithJSON(), ArchivalDataset("blocks", "v1", "ethwal")},
+			err:     "WithCBOR of ArchivalDataset conflicts with WithJSON, both set the codec",
+		},
+		{
+			name:    "presets",
+			options: []Option{ArchivalDataset("blocks", "v1", "ethwal"), RealtimeDataset("blocks", "v1", "ethwal")},
+			err:     "WithDataset of RealtimeDataset conflicts with WithDataset of ArchivalDataset, both set the dataset",
+		},
+		{
+			name:    "json_field_aliases",
+			options: []Option{WithDataset("", "", "ethwal"), WithCBOR(), WithJSONFieldAliases(map[string]string{"blockNum": "n"})},
+			err:     "WithJSONFieldAliases requires WithJSON",
+		},
+		{
+			name:    "cache_path",
+			options: []Option{WithDataset("", "", "ethwal"), WithCachePath("cache")},
+			err:     "Dataset.CachePath is ignored by the local file system",
+		},
+		{
+			name:    "no_dataset",
+			options: []Option{WithCBOR()},
+			err:     "Dataset.Path is empty",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewOptions(tc.options...)
+			require.ErrorIs(t, err, ErrInvalidOptions)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestNewOptions_Presets(t *testing.T) {
+	fs := gostorage.NewMemoryFS()
+
+	for name, preset := range map[string]Option{
+		"archival": ArchivalDataset("blocks", "v1", "ethwal"),
+		"realtime": RealtimeDataset("blocks", "v1", "ethwal"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			opt, err := NewOptions(preset, WithFileSystem(fs))
+			require.NoError(t, err)
+			require.NoError(t, opt.Validate())
+			require.NotNil(t, opt.NewEncoder)
+			require.NotNil(t, opt.NewDecoder)
+			require.NotNil(t, opt.NewCompressor)
+			require.NotNil(t, opt.NewDecompressor)
+			require.NotNil(t, opt.FileRollPolicy)
+			require.True(t, opt.FileRollOnClose)
+
+			// the preset creates new roll policy on every use
+			other, err := NewOptions(preset)
+			require.NoError(t, err)
+			require.NotSame(t, opt.FileRollPolicy, other.FileRollPolicy)
+
+			w, err := NewWriter[int](opt)
+			require.NoError(t, err)
+			for blockNum := uint64(1); blockNum <= 10; blockNum++ {
+				require.NoError(t, w.Write(context.Background(), emptyFileTestBlock(blockNum)))
+			}
+			require.NoError(t, w.Close(context.Background()))
+
+			r, err := NewReader[int](opt)
+			require.NoError(t, err)
+			defer r.Close()
+
+			var blocks int
+			for {
+				_, err := r.Read(context.Background())
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				blocks++
+			}
+			require.Equal(t, 10, blocks)
+		})
+	}
+}
+
+func TestOptions_Validate(t *testing.T) {
+	valid := Options{Dataset: Dataset{Path: "ethwal"}}
+	require.NoError(t, valid.Validate())
+
+	testCases := []struct {
+		name   string
+		modify func(opt *Options)
+	}{
+		{"no_path", func(opt *Options) { opt.Dataset.Path = "" }},
+		{"cache_path_local", func(opt *Options) {
+			opt.Dataset.CachePath = "cache"
+			opt.FileSystem = local.NewLocalFS("")
+		}},
+		{"encoder_without_decoder", func(opt *Options) { opt.NewEncoder = NewJSONEncoder }},
+		{"decompressor_without_compressor", func(opt *Options) { opt.NewDecompressor = NewZSTDDecompressor }},
+		{"unknown_cbor_preset", func(opt *Options) { opt.CBORPreset = "unknown" }},
+		{"async_without_hook", func(opt *Options) { opt.OnFileWrittenAsync = true }},
+		{"accounting_disabled", func(opt *Options) { opt.Accounting = storage.NewAccounting(nil) }},
+		{"journal_interval_without_path", func(opt *Options) { opt.LocalJournalSyncInterval = time.Second }},
+		{"bloom_rate", func(opt *Options) { opt.BloomFalsePositiveRate = 1 }},
+		{"negative_duration", func(opt *Options) { opt.TailFlushInterval = -time.Second }},
+		{"negative_decode_ahead", func(opt *Options) { opt.DecodeAhead = -1 }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opt := valid
+			tc.modify(&opt)
+			require.ErrorIs(t, opt.Validate(), ErrInvalidOptions)
+		})
+	}
+}
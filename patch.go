@@ -0,0 +1,284 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+const PatchesDirectory = ".patches"
+const PatchManifestFileName = ".manifest"
+
+// WritePatch stores a corrected block in the dataset patch area. Readers with Options.ApplyPatches
+// enabled substitute the patched block for the block with the same number decoded from the base file.
+//
+// The base WAL file is not modified.
+func WritePatch[T any](ctx context.Context, opt Options, block Block[T]) error {
+	opt = opt.WithDefaults()
+
+	ps, err := openPatchStore(ctx, opt)
+	if err != nil {
+		return err
+	}
+
+	// the patched block must be already written to the dataset
+	fileIndex := NewFileIndex(storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()))
+	err = fileIndex.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load file index: %w", err)
+	}
+
+	file, _, err := fileIndex.FindFile(block.Number)
+	if err != nil || file.FirstBlockNum > block.Number {
+		return fmt.Errorf("block %d does not exist in dataset", block.Number)
+	}
+
+	return ps.write(ctx, block.Number, block)
+}
+
+// ListPatches returns the sorted block numbers of all patched blocks in the dataset.
+func ListPatches(ctx context.Context, opt Options) ([]uint64, error) {
+	opt = opt.WithDefaults()
+
+	ps, err := openPatchStore(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	return ps.list(), nil
+}
+
+// RemovePatch removes the patch of the block, readers return the block from the base file again.
+func RemovePatch(ctx context.Context, opt Options, blockNum uint64) error {
+	opt = opt.WithDefaults()
+
+	ps, err := openPatchStore(ctx, opt)
+	if err != nil {
+		return err
+	}
+	return ps.remove(ctx, blockNum)
+}
+
+// patchStore keeps one object per patched block and a manifest with the list of patched blocks.
+//
+// The directory structure:
+//
+//	-- ethwal
+//		|-- .patches
+//		|   |-- .manifest
+//		|   |-- 000000000000001234.patch
+//		|   |-- 000000000000005678.patch
+type patchStore struct {
+	options Options
+	fs      storage.FS
+
+	blockNums map[uint64]struct{}
+
+	mu sync.Mutex
+}
+
+func openPatchStore(ctx context.Context, opt Options) (*patchStore, error) {
+	if opt.Dataset.Path == "" {
+		return nil, fmt.Errorf("path cannot be empty")
+	}
+
+	datasetPath := opt.Dataset.FullPath()
+
+	// create dataset directory if it doesn't exist on local FS
+	if isLocalFS(opt.FileSystem) {
+		if _, err := os.Stat(datasetPath); os.IsNotExist(err) {
+			err := os.MkdirAll(datasetPath, 0755)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create ethwal directory")
+			}
+		}
+	}
+
+	ps := newPatchStore(opt.withObjectClass(storage.NewPrefixWrapper(opt.FileSystem, datasetPath), ObjectClassData), opt)
+	err := ps.load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load patch manifest: %w", err)
+	}
+	return ps, nil
+}
+
+// newPatchStore creates patch store on the file system mounted to the dataset path.
+func newPatchStore(fs storage.FS, opt Options) *patchStore {
+	return &patchStore{
+		options:   opt,
+		fs:        storage.NewPrefixWrapper(fs, PatchesDirectory+"/"),
+		blockNums: make(map[uint64]struct{}),
+	}
+}
+
+func (ps *patchStore) load(ctx context.Context) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	file, err := ps.fs.Open(ctx, PatchManifestFileName, nil)
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	decomp := NewZSTDDecompressor(file)
+	defer decomp.Close()
+
+	var blockNums []uint64
+	err = NewCBORDecoder(decomp).Decode(&blockNums)
+	if err != nil {
+		return err
+	}
+
+	ps.blockNums = make(map[uint64]struct{}, len(blockNums))
+	for _, blockNum := range blockNums {
+		ps.blockNums[blockNum] = struct{}{}
+	}
+	return nil
+}
+
+func (ps *patchStore) has(blockNum uint64) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	_, ok := ps.blockNums[blockNum]
+	return ok
+}
+
+func (ps *patchStore) list() []uint64 {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.sortedBlockNums()
+}
+
+func (ps *patchStore) write(ctx context.Context, blockNum uint64, block any) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	file, err := ps.fs.Create(ctx, patchPath(blockNum), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create patch file: %w", err)
+	}
+
+	var wr io.Writer = file
+	closeAll := file.Close
+	if ps.options.NewCompressor != nil {
+		comp := ps.options.NewCompressor(file)
+		wr = comp
+		closeAll = func() error {
+			if err := comp.Close(); err != nil {
+				_ = file.Close()
+				return err
+			}
+			return file.Close()
+		}
+	}
+
+	err = ps.options.NewEncoder(wr).Encode(block)
+	if err != nil {
+		_ = closeAll()
+		return fmt.Errorf("failed to encode patch: %w", err)
+	}
+
+	err = closeAll()
+	if err != nil {
+		return err
+	}
+
+	// update manifest
+	_, existed := ps.blockNums[blockNum]
+	ps.blockNums[blockNum] = struct{}{}
+
+	err = ps.saveManifest(ctx)
+	if err != nil {
+		if !existed {
+			delete(ps.blockNums, blockNum)
+		}
+		return fmt.Errorf("failed to save patch manifest: %w", err)
+	}
+	return nil
+}
+
+func (ps *patchStore) read(ctx context.Context, blockNum uint64, block any) error {
+	file, err := ps.fs.Open(ctx, patchPath(blockNum), nil)
+	if err != nil {
+		return fmt.Errorf("failed to open patch file: %w", err)
+	}
+	defer file.Close()
+
+	var rdr io.ReadCloser = io.NopCloser(file)
+	if ps.options.NewDecompressor != nil {
+		rdr = ps.options.NewDecompressor(file)
+	}
+	defer rdr.Close()
+
+	err = ps.options.NewDecoder(rdr).Decode(block)
+	if err != nil {
+		return fmt.Errorf("failed to decode patch: %w", err)
+	}
+	return nil
+}
+
+func (ps *patchStore) remove(ctx context.Context, blockNum uint64) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if _, ok := ps.blockNums[blockNum]; !ok {
+		return fmt.Errorf("patch for block %d does not exist", blockNum)
+	}
+
+	// update manifest first, so that readers never see a manifest entry without a patch file
+	delete(ps.blockNums, blockNum)
+	err := ps.saveManifest(ctx)
+	if err != nil {
+		ps.blockNums[blockNum] = struct{}{}
+		return fmt.Errorf("failed to save patch manifest: %w", err)
+	}
+
+	err = ps.fs.Delete(ctx, patchPath(blockNum))
+	if err != nil && !storage.IsNotExist(err) {
+		return fmt.Errorf("failed to delete patch file: %w", err)
+	}
+	return nil
+}
+
+func (ps *patchStore) saveManifest(ctx context.Context) error {
+	file, err := ps.fs.Create(ctx, PatchManifestFileName, nil)
+	if err != nil {
+		return err
+	}
+
+	comp := NewZSTDCompressor(file)
+	err = NewCBOREncoder(comp).Encode(ps.sortedBlockNums())
+	if err != nil {
+		_ = comp.Close()
+		_ = file.Close()
+		return err
+	}
+
+	if err := comp.Close(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (ps *patchStore) sortedBlockNums() []uint64 {
+	blockNums := make([]uint64, 0, len(ps.blockNums))
+	for blockNum := range ps.blockNums {
+		blockNums = append(blockNums, blockNum)
+	}
+	slices.Sort(blockNums)
+	return blockNums
+}
+
+func patchPath(blockNum uint64) string {
+	return fmt.Sprintf("%018d.patch", blockNum)
+}
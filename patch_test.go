@@ -0,0 +1,156 @@
+package ethwal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWritePatch(t *testing.T) {
+	indexes := setupReaderWithFilterTest(t)
+	defer teardownReaderWithFilterTest()
+
+	opt := Options{
+		Dataset: Dataset{
+			Path: testPath,
+		},
+		NewCompressor:   NewZSTDCompressor,
+		NewDecompressor: NewZSTDDecompressor,
+		NewEncoder:      NewCBOREncoder,
+		NewDecoder:      NewCBORDecoder,
+	}
+
+	r, err := NewReader[[]int](opt)
+	require.NoError(t, err)
+	baseFile := r.FileIndex().At(0)
+	require.NoError(t, r.Close())
+
+	baseFileData, err := os.ReadFile(path.Join(testPath, baseFile.Path()))
+	require.NoError(t, err)
+
+	patchedBlock := Block[[]int]{
+		Hash:   common.BytesToHash([]byte{0xff}),
+		Number: 10,
+		Data:   []int{1000},
+	}
+
+	err = WritePatch(context.Background(), opt, patchedBlock)
+	require.NoError(t, err)
+
+	err = WritePatch(context.Background(), opt, Block[[]int]{Number: 1000})
+	require.Error(t, err)
+
+	patches, err := ListPatches(context.Background(), opt)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{10}, patches)
+
+	t.Run("sequential", func(t *testing.T) {
+		r, err := NewReader[[]int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		for {
+			block, err := r.Read(context.Background())
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+
+			if block.Number == patchedBlock.Number {
+				require.Equal(t, patchedBlock, block)
+			} else {
+				require.NotEqual(t, patchedBlock.Hash, block.Hash)
+			}
+		}
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		r, err := NewReader[[]int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		err = r.Seek(context.Background(), patchedBlock.Number)
+		require.NoError(t, err)
+
+		block, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, patchedBlock, block)
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		r, err := NewReader[[]int](opt)
+		require.NoError(t, err)
+
+		fb, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+			Dataset: opt.Dataset,
+			Indexes: indexes,
+		})
+		require.NoError(t, err)
+
+		r, err = NewReaderWithFilter[[]int](r, fb.Eq("only_even", "true"))
+		require.NoError(t, err)
+		defer r.Close()
+
+		var found bool
+		for {
+			block, err := r.Read(context.Background())
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+
+			if block.Number == patchedBlock.Number {
+				require.Equal(t, patchedBlock.Data, block.Data)
+				found = true
+			}
+		}
+		require.True(t, found)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		applyPatches := false
+		disabledOpt := opt
+		disabledOpt.ApplyPatches = &applyPatches
+
+		r, err := NewReader[[]int](disabledOpt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		err = r.Seek(context.Background(), patchedBlock.Number)
+		require.NoError(t, err)
+
+		block, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []int{20}, block.Data)
+	})
+
+	// base file remains untouched
+	baseFileDataAfterPatch, err := os.ReadFile(path.Join(testPath, baseFile.Path()))
+	require.NoError(t, err)
+	require.Equal(t, baseFileData, baseFileDataAfterPatch)
+
+	// remove patch
+	err = RemovePatch(context.Background(), opt, patchedBlock.Number)
+	require.NoError(t, err)
+
+	patches, err = ListPatches(context.Background(), opt)
+	require.NoError(t, err)
+	require.Empty(t, patches)
+
+	r, err = NewReader[[]int](opt)
+	require.NoError(t, err)
+	defer r.Close()
+
+	err = r.Seek(context.Background(), patchedBlock.Number)
+	require.NoError(t, err)
+
+	block, err := r.Read(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []int{20}, block.Data)
+}
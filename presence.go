@@ -0,0 +1,208 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+)
+
+const PresenceDirectory = ".presence"
+
+// presenceShardSize is the number of block numbers covered by a single presence shard.
+const presenceShardSize uint64 = 1 << 20
+
+// BlockExamined reports whether the writer with Options.TrackPresence examined the block. In sparse datasets
+// it distinguishes a block without data (examined, not written) from a block that wasn't ingested yet.
+func BlockExamined(ctx context.Context, opt Options, blockNum uint64) (bool, error) {
+	return BlockRangeExamined(ctx, opt, blockNum, blockNum)
+}
+
+// BlockRangeExamined reports whether the writer with Options.TrackPresence examined all blocks in the
+// range [from, to].
+func BlockRangeExamined(ctx context.Context, opt Options, from, to uint64) (bool, error) {
+	opt = opt.WithDefaults()
+
+	ps, err := openPresenceStore(opt)
+	if err != nil {
+		return false, err
+	}
+	return ps.examined(ctx, from, to)
+}
+
+// presenceStore keeps roaring bitmaps of examined block numbers sharded by fixed block ranges.
+//
+// The directory structure:
+//
+//	-- ethwal
+//		|-- .presence
+//		|   |-- 000000000000000000.idx <- blocks 0 - 1048575
+//		|   |-- 000000000001048576.idx <- blocks 1048576 - 2097151
+type presenceStore struct {
+	fs storage.FS
+}
+
+func openPresenceStore(opt Options) (*presenceStore, error) {
+	if opt.Dataset.Path == "" {
+		return nil, fmt.Errorf("path cannot be empty")
+	}
+
+	datasetPath := opt.Dataset.FullPath()
+
+	// create dataset directory if it doesn't exist on local FS
+	if isLocalFS(opt.FileSystem) {
+		if _, err := os.Stat(datasetPath); os.IsNotExist(err) {
+			err := os.MkdirAll(datasetPath, 0755)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create ethwal directory")
+			}
+		}
+	}
+
+	return newPresenceStore(storage.NewPrefixWrapper(opt.FileSystem, datasetPath)), nil
+}
+
+// newPresenceStore creates presence store on the file system mounted to the dataset path.
+func newPresenceStore(fs storage.FS) *presenceStore {
+	return &presenceStore{fs: storage.NewPrefixWrapper(fs, PresenceDirectory+"/")}
+}
+
+// mark merges examined block numbers into the shards.
+func (ps *presenceStore) mark(ctx context.Context, blockNums *roaring64.Bitmap) error {
+	if blockNums.IsEmpty() {
+		return nil
+	}
+
+	for shard := blockNums.Minimum() / presenceShardSize; shard <= blockNums.Maximum()/presenceShardSize; shard++ {
+		shardBlockNums := roaring64.New()
+		shardBlockNums.AddRange(shard*presenceShardSize, (shard+1)*presenceShardSize)
+		shardBlockNums.And(blockNums)
+		if shardBlockNums.IsEmpty() {
+			continue
+		}
+
+		bmap, err := ps.readShard(ctx, shard)
+		if err != nil {
+			return err
+		}
+
+		bmap.Or(shardBlockNums)
+		err = ps.writeShard(ctx, shard, bmap)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// examined reports whether all block numbers in the range [from, to] are marked.
+func (ps *presenceStore) examined(ctx context.Context, from, to uint64) (bool, error) {
+	if from > to {
+		return false, fmt.Errorf("invalid block range: %d > %d", from, to)
+	}
+	if err := validateBlockNum(to); err != nil {
+		return false, err
+	}
+
+	for shard := from / presenceShardSize; shard <= to/presenceShardSize; shard++ {
+		bmap, err := ps.readShard(ctx, shard)
+		if err != nil {
+			return false, err
+		}
+
+		shardFrom := max(from, shard*presenceShardSize)
+		shardTo := min(to, (shard+1)*presenceShardSize-1)
+
+		blockNums := roaring64.New()
+		blockNums.AddRange(shardFrom, shardTo+1)
+		if bmap.AndCardinality(blockNums) != shardTo-shardFrom+1 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// marked returns the marked block numbers in the range [from, to].
+func (ps *presenceStore) marked(ctx context.Context, from, to uint64) (*roaring64.Bitmap, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid block range: %d > %d", from, to)
+	}
+	if err := validateBlockNum(to); err != nil {
+		return nil, err
+	}
+
+	blockNums := roaring64.New()
+	for shard := from / presenceShardSize; shard <= to/presenceShardSize; shard++ {
+		bmap, err := ps.readShard(ctx, shard)
+		if err != nil {
+			return nil, err
+		}
+		blockNums.Or(bmap)
+	}
+
+	blockNums.RemoveRange(0, from)
+	blockNums.RemoveRange(to+1, MaxSupportedBlockNum+1)
+	return blockNums, nil
+}
+
+func (ps *presenceStore) readShard(ctx context.Context, shard uint64) (*roaring64.Bitmap, error) {
+	file, err := ps.fs.Open(ctx, presenceShardPath(shard), nil)
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return roaring64.New(), nil
+		}
+		return nil, fmt.Errorf("failed to open presence shard: %w", err)
+	}
+	defer file.Close()
+
+	container, err := openContainer(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open presence shard: %w", err)
+	}
+	defer container.Close()
+
+	for {
+		sectionType, section, err := container.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to read presence shard: bitmap section missing")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read presence shard: %w", err)
+		}
+
+		if sectionType == containerSectionBitmap {
+			return unmarshalBitmap(section)
+		}
+	}
+}
+
+func (ps *presenceStore) writeShard(ctx context.Context, shard uint64, bmap *roaring64.Bitmap) error {
+	bmap.RunOptimize()
+
+	var data bytes.Buffer
+	_, err := bmap.WriteTo(&data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal presence shard: %w", err)
+	}
+
+	file, err := ps.fs.Create(ctx, presenceShardPath(shard), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create presence shard: %w", err)
+	}
+
+	err = writeContainer(file, containerFlagCompressed, containerSection{Type: containerSectionBitmap, Data: data.Bytes()})
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write presence shard: %w", err)
+	}
+	return file.Close()
+}
+
+func presenceShardPath(shard uint64) string {
+	return fmt.Sprintf("%018d.idx", shard*presenceShardSize)
+}
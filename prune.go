@@ -0,0 +1,104 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+// ErrBlockPruned is returned by Reader.Seek if the block was pruned, see FileIndex.Prune.
+var ErrBlockPruned = fmt.Errorf("block is pruned")
+
+// RetentionPolicy decides the files the writer prunes after it rolls the file, see Options.RetentionPolicy.
+type RetentionPolicy interface {
+	// PruneBefore returns the block number the files ending before are pruned, given the last block of the
+	// rolled file. Zero keeps all files.
+	PruneBefore(lastBlockNum uint64) uint64
+}
+
+// RetentionPolicyFunc is the RetentionPolicy function.
+type RetentionPolicyFunc func(lastBlockNum uint64) uint64
+
+func (f RetentionPolicyFunc) PruneBefore(lastBlockNum uint64) uint64 {
+	return f(lastBlockNum)
+}
+
+// NewKeepLastBlocksRetentionPolicy creates the retention policy keeping the files of the last blocks, the
+// file containing the first kept block is kept whole.
+func NewKeepLastBlocksRetentionPolicy(blocks uint64) RetentionPolicy {
+	return RetentionPolicyFunc(func(lastBlockNum uint64) uint64 {
+		if lastBlockNum < blocks {
+			return 0
+		}
+		return lastBlockNum - blocks + 1
+	})
+}
+
+// PrunedBefore returns the block after the last pruned file, the blocks before it were pruned. Zero if
+// the dataset wasn't pruned.
+func (fi *FileIndex) PrunedBefore() uint64 {
+	return fi.prunedBefore
+}
+
+// Prune deletes the files ending before the block, with their bloom filters and block digests, from the
+// file system and the index and saves the index. The file containing the block is kept. It returns the
+// pruned files.
+//
+// The index is saved once all files are deleted, so the prune that failed halfway is completed by the next
+// one, the files already deleted are skipped. The files stored at the legacy path are deleted by their
+// legacy names. The indexes, the patches and the examined block marks of the pruned blocks are kept.
+func (fi *FileIndex) Prune(ctx context.Context, beforeBlockNum uint64) ([]*File, error) {
+	if beforeBlockNum <= fi.prunedBefore {
+		return nil, nil
+	}
+
+	// the files are ordered by the last block as they don't overlap
+	count, _ := slices.BinarySearchFunc(fi.files, beforeBlockNum, func(file *File, blockNum uint64) int {
+		if file.LastBlockNum < blockNum {
+			return -1
+		}
+		return 1
+	})
+
+	if count == 0 {
+		return nil, nil
+	}
+
+	pruned := slices.Clone(fi.files[:count])
+	for _, file := range pruned {
+		err := deleteFile(ctx, fi.fs, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prune file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err)
+		}
+	}
+
+	fi.files = slices.Delete(fi.files, 0, count)
+	fi.prunedBefore = pruned[count-1].LastBlockNum + 1
+	err := fi.Save(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save file index: %w", err)
+	}
+	return pruned, nil
+}
+
+// deleteFile deletes the file stored at the canonical or the legacy path and its bloom filter and block
+// digests, the objects that don't exist are skipped.
+func deleteFile(ctx context.Context, fs storage.FS, file *File) error {
+	paths := []string{file.Path(), file.legacyPath()}
+	if file.Bloom {
+		paths = append(paths, file.BloomPath())
+	}
+	if file.DigestRoot != nil {
+		paths = append(paths, file.DigestsPath())
+	}
+
+	for _, objectPath := range paths {
+		err := fs.Delete(ctx, objectPath)
+		if err != nil && !storage.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+// failingDeleteFS fails the deletes of the path until it's reset.
+type failingDeleteFS struct {
+	storage.FS
+
+	failPath string
+}
+
+func (f *failingDeleteFS) Delete(ctx context.Context, path string) error {
+	if path == f.failPath {
+		return fmt.Errorf("delete failed: %s", path)
+	}
+	return f.FS.Delete(ctx, path)
+}
+
+func writePruneDataset(t *testing.T, opt Options, to uint64) {
+	w, err := NewWriter[int](opt)
+	require.NoError(t, err)
+	for blockNum := uint64(1); blockNum <= to; blockNum++ {
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: blockNum, TS: blockNum, Data: int(blockNum)}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+}
+
+func pruneTestOptions(fs storage.FS) Options {
+	return Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      fs,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+		BlockDigest:     CanonicalBlockDigest[int],
+		BloomKeys:       BloomKeysFunc[int](func(b Block[int]) [][]byte { return [][]byte{{byte(b.Data)}} }),
+	}
+}
+
+func TestFileIndex_Prune(t *testing.T) {
+	memFs := gostorage.NewMemoryFS()
+	opt := pruneTestOptions(memFs)
+	writePruneDataset(t, opt, 50)
+
+	fs := storage.NewPrefixWrapper(memFs, opt.Dataset.FullPath())
+	fileIndex := NewFileIndex(fs)
+	require.NoError(t, fileIndex.Load(context.Background()))
+	files := fileIndex.Files()
+	require.Len(t, files, 5)
+
+	// the first file is stored at the legacy path
+	data, err := storageReadAll(fs, files[0].Path())
+	require.NoError(t, err)
+	w, err := fs.Create(context.Background(), files[0].legacyPath(), nil)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, fs.Delete(context.Background(), files[0].Path()))
+
+	exists := func(file *File) []bool {
+		var exist []bool
+		for _, objectPath := range []string{file.Path(), file.legacyPath(), file.BloomPath(), file.DigestsPath()} {
+			_, err := fs.Attributes(context.Background(), objectPath, nil)
+			exist = append(exist, err == nil)
+		}
+		return exist
+	}
+	require.Equal(t, []bool{false, true, true, true}, exists(files[0]))
+	require.Equal(t, []bool{true, false, true, true}, exists(files[1]))
+
+	// the delete fails halfway, the index isn't saved
+	failingFs := &failingDeleteFS{FS: fs, failPath: files[1].BloomPath()}
+	failingIndex := NewFileIndex(failingFs)
+	require.NoError(t, failingIndex.Load(context.Background()))
+	_, err = failingIndex.Prune(context.Background(), 25)
+	require.Error(t, err)
+
+	require.NoError(t, fileIndex.Load(context.Background()))
+	require.Len(t, fileIndex.Files(), 5)
+	require.Zero(t, fileIndex.PrunedBefore())
+	require.Equal(t, []bool{false, false, false, false}, exists(files[0]))
+
+	// the prune is completed, the file containing the block is kept
+	pruned, err := fileIndex.Prune(context.Background(), 25)
+	require.NoError(t, err)
+	require.Len(t, pruned, 2)
+	require.Equal(t, uint64(1), pruned[0].FirstBlockNum)
+	require.Equal(t, uint64(11), pruned[1].FirstBlockNum)
+	for _, file := range pruned {
+		require.Equal(t, []bool{false, false, false, false}, exists(file))
+	}
+
+	reloaded := NewFileIndex(fs)
+	require.NoError(t, reloaded.Load(context.Background()))
+	require.Len(t, reloaded.Files(), 3)
+	require.Equal(t, uint64(21), reloaded.Files()[0].FirstBlockNum)
+	require.Equal(t, uint64(21), reloaded.PrunedBefore())
+
+	// the prune before the pruned block and within the first file is a no-op
+	pruned, err = reloaded.Prune(context.Background(), 21)
+	require.NoError(t, err)
+	require.Empty(t, pruned)
+	pruned, err = reloaded.Prune(context.Background(), 30)
+	require.NoError(t, err)
+	require.Empty(t, pruned)
+
+	// the dataset is consistent
+	report, err := VerifyDataset[int](context.Background(), opt, VerifyDigests)
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Problems)
+}
+
+func TestWriter_RetentionPolicy(t *testing.T) {
+	memFs := gostorage.NewMemoryFS()
+	opt := pruneTestOptions(memFs)
+	opt.RetentionPolicy = NewKeepLastBlocksRetentionPolicy(15)
+	opt.EnableChangefeed = true
+	writePruneDataset(t, opt, 50)
+
+	// the files of the last 15 blocks are kept, the file containing block 36 is kept whole
+	fileIndex := NewFileIndex(storage.NewPrefixWrapper(memFs, opt.Dataset.FullPath()))
+	require.NoError(t, fileIndex.Load(context.Background()))
+	require.Len(t, fileIndex.Files(), 2)
+	require.Equal(t, uint64(31), fileIndex.Files()[0].FirstBlockNum)
+	require.Equal(t, uint64(31), fileIndex.PrunedBefore())
+
+	// the pruned files are in the changefeed
+	r, err := NewChangefeedReader(opt, 0)
+	require.NoError(t, err)
+	events, err := r.Poll(context.Background())
+	require.NoError(t, err)
+
+	var pruned []uint64
+	for _, event := range events {
+		if event.Type == ChangeFilePruned {
+			pruned = append(pruned, event.File.FirstBlockNum)
+		}
+	}
+	require.Equal(t, []uint64{1, 11, 21}, pruned)
+
+	t.Run("reader", func(t *testing.T) {
+		rdr, err := NewReader[int](opt)
+		require.NoError(t, err)
+		defer rdr.Close()
+
+		block, err := rdr.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, uint64(31), block.Number)
+
+		require.ErrorIs(t, rdr.Seek(context.Background(), 30), ErrBlockPruned)
+		require.NoError(t, rdr.Seek(context.Background(), 32))
+		block, err = rdr.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, uint64(32), block.Number)
+
+		_, err = NewRangeReader[int](opt, 5, 40)
+		require.ErrorIs(t, err, ErrBlockPruned)
+	})
+}
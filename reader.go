@@ -1,16 +1,19 @@
 package ethwal
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/0xsequence/ethwal/storage/stub"
-	"github.com/fatih/structs"
 
 	"github.com/0xsequence/ethwal/storage"
 	"github.com/0xsequence/ethwal/storage/local"
@@ -20,16 +23,73 @@ const firstFileIndex = 0
 const loadIndexFileTimeout = 30 * time.Second
 
 type Reader[T any] interface {
+	// FileNum returns the number of the files of the loaded file index.
 	FileNum() int
+	// FileIndex returns the copy of the loaded file index, it can be modified without affecting the reader.
 	FileIndex() *FileIndex
 	Read(ctx context.Context) (Block[T], error)
+	// ReadWithLocation reads the next block and returns its location, that can be used to fetch the block
+	// later with ReadAtLocation.
+	ReadWithLocation(ctx context.Context) (Block[T], BlockLocation, error)
+	// ReadAtLocation reads the block at the location without changing the position of the reader.
+	ReadAtLocation(ctx context.Context, loc BlockLocation) (Block[T], error)
 	Seek(ctx context.Context, blockNum uint64) error
 	BlockNum() uint64
+	Options() Options
+	Stats() ReaderStats
+	// Accounting returns the storage accounting of the reader, or nil if Options.EnableAccounting isn't set.
+	Accounting() *storage.Accounting
+	// BlockExamined reports whether the writer with Options.TrackPresence examined the block.
+	BlockExamined(ctx context.Context, blockNum uint64) (bool, error)
+	// BlockRangeExamined reports whether the writer with Options.TrackPresence examined all blocks in
+	// the range [from, to].
+	BlockRangeExamined(ctx context.Context, from, to uint64) (bool, error)
+	// WaitForBlock waits until the block is written, i.e. the rolled file ends at or after the block, or the
+	// .tail object with Options.FollowTail. The file index is reloaded every Options.TailPollInterval and
+	// the position of the reader isn't changed.
+	WaitForBlock(ctx context.Context, blockNum uint64) error
+	// ID returns the identity of the innermost reader instance.
+	ID() Instance
+	// Close releases all resources held by the reader and the readers it wraps. It's safe to call
+	// Close multiple times.
 	Close() error
 }
 
+// BlockLocation is the position of the block record within the dataset.
+type BlockLocation struct {
+	// File is the file that contains the block, it's nil for the blocks read from the tail.
+	File *File
+	// Ordinal is the zero-based position of the block record within the file.
+	Ordinal uint64
+}
+
+var (
+	ErrBlockLocationNotFound = fmt.Errorf("block location not found")
+	// ErrReaderClosed is returned by Read in Options.TailMode and WaitForBlock if the reader is closed while
+	// they wait.
+	ErrReaderClosed = fmt.Errorf("reader is closed")
+)
+
+// ReaderStats contains cumulative reader statistics.
+type ReaderStats struct {
+	// Gaps is the number of times the reader skipped over missing blocks.
+	Gaps uint64
+	// GapBlocks is the total number of missing blocks skipped.
+	GapBlocks uint64
+	// CorruptFiles are the files the reader failed to read, they are skipped if Options.SkipCorruptFiles is set.
+	CorruptFiles []CorruptFile
+}
+
+// CorruptFile is the file the reader failed to read.
+type CorruptFile struct {
+	FirstBlockNum uint64
+	LastBlockNum  uint64
+	Err           error
+}
+
 type reader[T any] struct {
 	options        Options
+	instance       Instance
 	path           string
 	fs             storage.FS
 	useCompression bool
@@ -38,52 +98,114 @@ type reader[T any] struct {
 
 	fileIndex     *FileIndex
 	currFileIndex int
+	// fileOrdinal is the number of records decoded from the current file, locationFile is the file
+	// reported in locations, it's not shared with the file index as it's exposed to the caller
+	fileOrdinal  uint64
+	locationFile *File
+	location     BlockLocation
+	// fileBlockNum is the last block decoded from the current file, fileData is the prefetched data of the
+	// current file, the file is rewound from it on Seek
+	fileBlockNum uint64
+	fileData     []byte
 
 	lastBlockNum uint64
+	blockRead    bool
+
+	decoder     Decoder
+	decodeBlock schemaDecoder[T]
+	upgrades    SchemaUpgrades[T]
+	// ahead decodes the current file in the background if Options.DecodeAhead is set
+	ahead *decodeAhead[T]
+	// checksum verifies the current file if Options.VerifyChecksumOnRead is set and the file has the checksum
+	checksum *checksumReader
+
+	stats ReaderStats
 
-	decoder Decoder
+	patches *patchStore
+
+	tailFs     storage.FS
+	tailBlocks []Block[T]
+
+	presence *presenceStore
+
+	blobs BlobStore
+
+	// repairer copies the files read from a fallback location if Options.ReadRepair is set
+	repairer *layoutRepairer
+
+	prefetcher *filePrefetcher
+
+	legacyJSONWarning sync.Once
+
+	// rangeTo is the last block of the reader created by NewRangeReader, rangeDone is set once it's read
+	rangeTo   *uint64
+	rangeDone bool
+
+	closed bool
+	// done is closed by Close to stop the waiting reads
+	done chan struct{}
 
 	mu sync.Mutex
 }
 
 func NewReader[T any](opt Options) (Reader[T], error) {
+	return NewReaderWithUpgrades[T](opt, nil)
+}
+
+// NewReaderWithUpgrades creates the reader that upgrades the blocks of files written under older payload
+// schema versions to Options.SchemaVersion.
+func NewReaderWithUpgrades[T any](opt Options, upgrades SchemaUpgrades[T]) (Reader[T], error) {
+	// the decoder of the dataset cbor preset is used unless the decoder is set
+	useDatasetPreset := opt.NewDecoder == nil && opt.CBORPreset == ""
+
 	// apply default options on uninitialized fields
-	opt = opt.WithDefaults()
+	opt = opt.WithDefaults().withAccounting()
+	if opt.IOScheduler == nil {
+		opt.IOScheduler = NewIOScheduler(IOSchedulerOptions{})
+	}
+
+	// create instance identity
+	instance := newInstance(opt.InstanceID, opt.Dataset)
 
 	if opt.Dataset.Path == "" {
-		return nil, fmt.Errorf("path cannot be empty")
+		return nil, instance.wrapError(fmt.Errorf("path cannot be empty"))
 	}
 
 	// build dataset path
 	datasetPath := opt.Dataset.FullPath()
 
-	// set file system
-	fs := opt.FileSystem
+	// set file system, reads fail over to the replicas
+	baseFs := newReplicaFS(opt)
+	fs := baseFs
 
-	// create dataset directory if it doesn't exist on local FS
-	if _, ok := opt.FileSystem.(*local.LocalFS); ok {
-		if _, err := os.Stat(datasetPath); os.IsNotExist(err) {
+	// create dataset directory if it doesn't exist on local FS, unless only the existing dataset is opened
+	if isLocalFS(opt.FileSystem) {
+		if _, err := os.Stat(datasetPath); os.IsNotExist(err) && !opt.OpenExisting {
 			err := os.MkdirAll(datasetPath, 0755)
 			if err != nil {
-				return nil, fmt.Errorf("failed to create ethwal directory")
+				return nil, instance.wrapError(fmt.Errorf("failed to create ethwal directory"))
 			}
 		}
 	} else {
 		// add cache wrapper to file system, so that we can cache the files locally
 		if opt.Dataset.CachePath != "" {
-			if _, err := os.Stat(opt.Dataset.CachePath); os.IsNotExist(err) {
-				err := os.MkdirAll(opt.Dataset.CachePath, 0755)
-				if err != nil {
-					return nil, fmt.Errorf("failed to create ethwal cache directory")
-				}
+			var err error
+			fs, _, err = newCacheFS(opt, fs)
+			if err != nil {
+				return nil, instance.wrapError(err)
 			}
-			fs = storage.NewCacheWrapper(fs, local.NewLocalFS(opt.Dataset.CachePath), nil)
 		}
 	}
 
 	// add prefix to file system
 	fs = storage.NewPrefixWrapper(fs, datasetPath)
 
+	// load patches, bypass cache so that the manifest is always up to date
+	var patches *patchStore
+	if *opt.ApplyPatches {
+		patches = newPatchStore(storage.NewPrefixWrapper(baseFs, datasetPath), opt)
+	}
+
 	// create file index
 	fileIndex := NewFileIndex(fs)
 
@@ -91,19 +213,137 @@ func NewReader[T any](opt Options) (Reader[T], error) {
 	ctx, cancel := context.WithTimeout(context.Background(), loadIndexFileTimeout)
 	defer cancel()
 
+	if opt.OpenExisting {
+		err := checkDatasetExists(ctx, storage.NewPrefixWrapper(baseFs, datasetPath), datasetPath)
+		if err != nil {
+			return nil, instance.wrapError(err)
+		}
+	}
+
 	err := fileIndex.Load(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load file index: %w", err)
+		return nil, instance.wrapError(fmt.Errorf("failed to load file index: %w", err))
+	}
+
+	if opt.CBORPreset != "" {
+		_, err = LookupCBORPreset(opt.CBORPreset)
+		if err != nil {
+			return nil, instance.wrapError(err)
+		}
+	}
+
+	if useDatasetPreset {
+		schema, err := readDatasetSchema(ctx, storage.NewPrefixWrapper(baseFs, datasetPath))
+		if err != nil {
+			return nil, instance.wrapError(err)
+		}
+
+		// the datasets of the presets not registered by the reader are decoded with the default decoder
+		if preset, err := LookupCBORPreset(schema.CBORPreset); err == nil {
+			opt.NewDecoder = preset.NewDecoder()
+		}
+	}
+
+	// the decoder and the decompressor of the manifest are used unless they're set
+	manifest, err := readDatasetManifest(ctx, storage.NewPrefixWrapper(baseFs, datasetPath))
+	if err != nil {
+		return nil, instance.wrapError(err)
+	}
+	if manifest != nil {
+		err = manifest.configureReader(&opt, useDatasetPreset)
+		if err != nil {
+			return nil, instance.wrapError(err)
+		}
+	}
+
+	// the files compressed with the dataset dictionary are decompressed with it
+	dict, err := loadDatasetDictionary(ctx, storage.NewPrefixWrapper(baseFs, datasetPath), manifest)
+	if err != nil {
+		return nil, instance.wrapError(err)
+	}
+	useDatasetDictionary(&opt, dict)
+
+	if patches != nil {
+		err = patches.load(ctx)
+		if err != nil {
+			return nil, instance.wrapError(fmt.Errorf("failed to load patch manifest: %w", err))
+		}
+	}
+
+	// read tail and reload file index directly, bypass cache as they are overwritten by the writer
+	tailFs := storage.NewPrefixWrapper(baseFs, datasetPath)
+
+	// read presence directly, bypass cache as the presence shards are overwritten by the writer
+	presence := newPresenceStore(storage.NewPrefixWrapper(baseFs, datasetPath))
+
+	var repairer *layoutRepairer
+	if opt.ReadRepair {
+		repairer = newLayoutRepairer(opt)
 	}
 
 	return &reader[T]{
-		options:   opt,
-		path:      datasetPath,
-		fs:        fs,
-		fileIndex: fileIndex,
+		options:    opt,
+		instance:   instance,
+		tailFs:     tailFs,
+		done:       make(chan struct{}),
+		path:       datasetPath,
+		fs:         fs,
+		fileIndex:  fileIndex,
+		patches:    patches,
+		presence:   presence,
+		blobs:      cmp.Or(opt.BlobStore, NewFSBlobStore(fs)),
+		upgrades:   upgrades,
+		repairer:   repairer,
+		prefetcher: newFilePrefetcher(fs, opt),
+		// block 0 is read first
+		lastBlockNum: NoBlockNum,
 	}, nil
 }
 
+// NewRangeReader creates the reader of the blocks [from, to], Read returns io.EOF once the blocks of the range
+// are read. The reader seeks to the file of from, the files past to are neither opened nor prefetched. The range
+// past the last file is empty, the tail is followed only by the range starting in the rolled files. Seek within
+// the range restarts the reading.
+func NewRangeReader[T any](opt Options, from, to uint64) (Reader[T], error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid block range %d-%d", from, to)
+	}
+
+	rdr, err := NewReader[T](opt)
+	if err != nil {
+		return nil, err
+	}
+
+	r := rdr.(*reader[T])
+	r.rangeTo = &to
+	if from > 0 {
+		err = r.seek(context.Background(), from)
+		if errors.Is(err, io.EOF) {
+			// the range is past the last file or within the gap before the next one
+			r.rangeDone = true
+			return r, nil
+		}
+		if err != nil {
+			_ = r.Close()
+			return nil, r.instance.wrapError(err)
+		}
+	}
+	return r, nil
+}
+
+// newCacheFS wraps the file system with the cache at Dataset.CachePath and returns the cache file system.
+func newCacheFS(opt Options, fs storage.FS) (storage.FS, storage.FS, error) {
+	if _, err := os.Stat(opt.Dataset.CachePath); os.IsNotExist(err) {
+		err := os.MkdirAll(opt.Dataset.CachePath, 0755)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create ethwal cache directory")
+		}
+	}
+
+	cache := local.NewLocalFS(opt.Dataset.CachePath)
+	return storage.NewCacheWrapper(fs, cache, nil), cache, nil
+}
+
 func (r *reader[T]) FileNum() int {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -117,18 +357,118 @@ func (r *reader[T]) FileIndex() *FileIndex {
 
 	newfiles := make([]*File, len(r.fileIndex.Files()))
 	for index, file := range r.fileIndex.Files() {
-		newfiles[index] = &File{
-			FirstBlockNum: file.FirstBlockNum,
-			LastBlockNum:  file.LastBlockNum,
-		}
+		newfiles[index] = file.clone()
 	}
-	return NewFileIndexFromFiles(stub.Stub{}, newfiles)
+	fileIndex := NewFileIndexFromFiles(stub.Stub{}, newfiles)
+	fileIndex.prunedBefore = r.fileIndex.PrunedBefore()
+	return fileIndex
 }
 
 func (r *reader[T]) Read(ctx context.Context) (Block[T], error) {
+	block, _, err := r.ReadWithLocation(ctx)
+	return block, err
+}
+
+func (r *reader[T]) ReadWithLocation(ctx context.Context) (Block[T], BlockLocation, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if r.rangeDone {
+		return Block[T]{}, BlockLocation{}, io.EOF
+	}
+
+	block, err := r.read(ctx)
+	if errors.Is(err, io.EOF) && (r.options.FollowTail || r.options.TailMode) && !r.rangeDone {
+		block, err = r.follow(ctx)
+	}
+	// the reader in tail mode waits for the new blocks instead of returning io.EOF
+	for errors.Is(err, io.EOF) && r.options.TailMode && !r.rangeDone {
+		err = r.waitPoll(ctx)
+		if err == nil {
+			block, err = r.follow(ctx)
+		}
+	}
+	if err == nil && r.rangeTo != nil {
+		if block.Number > *r.rangeTo {
+			r.rangeDone = true
+			return Block[T]{}, BlockLocation{}, io.EOF
+		}
+		r.rangeDone = block.Number == *r.rangeTo
+	}
+	if err == nil && r.options.ResolveBlobs {
+		block, err = resolveBlob(ctx, r.options, r.blobs, block)
+	}
+	if err != nil {
+		return block, BlockLocation{}, r.instance.wrapError(err)
+	}
+	return block, r.location, nil
+}
+
+func (r *reader[T]) ReadAtLocation(ctx context.Context, loc BlockLocation) (Block[T], error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	block, err := r.readAtLocation(ctx, loc)
+	if err == nil && r.options.ResolveBlobs {
+		block, err = resolveBlob(ctx, r.options, r.blobs, block)
+	}
+	return block, r.instance.wrapError(err)
+}
+
+// readAtLocation opens the file of the location and skips the records before the block.
+func (r *reader[T]) readAtLocation(ctx context.Context, loc BlockLocation) (Block[T], error) {
+	if loc.File == nil {
+		return Block[T]{}, fmt.Errorf("%w: no file", ErrBlockLocationNotFound)
+	}
+
+	// the file of the location may be prefetched by the sequential reads
+	file := &File{FirstBlockNum: loc.File.FirstBlockNum, LastBlockNum: loc.File.LastBlockNum, SchemaVersion: loc.File.SchemaVersion, Bloom: loc.File.Bloom, DigestRoot: loc.File.DigestRoot}
+	decodeBlock, err := newSchemaDecoder(r.options, r.upgrades, file.SchemaVersion)
+	if err != nil {
+		return Block[T]{}, err
+	}
+
+	rdr, _, err := r.openFile(ctx, file)
+	if err != nil {
+		return Block[T]{}, newFileError(file, fmt.Errorf("failed to open file: %w", err))
+	}
+	defer rdr.Close()
+
+	rdr, err = nonEmptyReader(rdr)
+	if err != nil {
+		if errors.Is(err, ErrEmptyFile) {
+			r.reportCorruptFile(file, err)
+		}
+		return Block[T]{}, newFileError(file, err)
+	}
+
+	var decmprRdr = io.NopCloser(rdr)
+	if r.options.NewDecompressor != nil {
+		decmprRdr = r.options.NewDecompressor(decmprRdr)
+	}
+	defer decmprRdr.Close()
+
+	decoder := newBlockDecoder(r.options, decmprRdr, r.warnLegacyJSON)
+
+	var block Block[T]
+	for i := uint64(0); i <= loc.Ordinal; i++ {
+		block = Block[T]{}
+		err = decodeBlock(decoder, &block)
+		if errors.Is(err, io.EOF) {
+			return Block[T]{}, fmt.Errorf("%w: file[%d-%d] has %d records", ErrBlockLocationNotFound, file.FirstBlockNum, file.LastBlockNum, i)
+		}
+		if err != nil {
+			return Block[T]{}, newFileError(file, fmt.Errorf("failed to decode file data: %w", err))
+		}
+	}
+
+	if block.Number < file.FirstBlockNum || block.Number > file.LastBlockNum {
+		return Block[T]{}, newFileError(file, fmt.Errorf("block number %d is out of file block %d-%d range", block.Number, file.FirstBlockNum, file.LastBlockNum))
+	}
+	return r.applyPatch(ctx, block)
+}
+
+func (r *reader[T]) read(ctx context.Context) (Block[T], error) {
 	var err error
 	if r.decoder == nil {
 		err = r.readFile(ctx, firstFileIndex)
@@ -138,17 +478,31 @@ func (r *reader[T]) Read(ctx context.Context) (Block[T], error) {
 		if err != nil {
 			return Block[T]{}, fmt.Errorf("failed to read first file: %w", err)
 		}
+		r.prefetchNextFiles(ctx)
 	}
 
 	var block Block[T]
-	for structs.IsZero(block) || block.Number <= r.lastBlockNum {
+	var decoded bool
+	for !decoded || r.isRead(block.Number) {
 		select {
 		case <-ctx.Done():
 			return Block[T]{}, ctx.Err()
 		default:
 		}
 
-		err = r.decoder.Decode(&block)
+		// the skipped block must not leak into the next one, e.g. the keys of map data
+		block = Block[T]{}
+
+		if r.ahead != nil {
+			err = r.ahead.next(ctx, &block)
+		} else {
+			err = r.decodeBlock(r.decoder, &block)
+		}
+		if err == nil {
+			decoded = true
+			r.fileOrdinal++
+			r.fileBlockNum = block.Number
+		}
 		if err != nil {
 			if err == io.EOF {
 				err = r.readNextFile(ctx)
@@ -159,49 +513,46 @@ func (r *reader[T]) Read(ctx context.Context) (Block[T], error) {
 					return Block[T]{}, fmt.Errorf("failed to read next file: %w", err)
 				}
 
-				err = r.decoder.Decode(&block)
-				if err != nil {
-					return Block[T]{}, fmt.Errorf("failed to decode data: %w", err)
-				}
-
-				if !structs.IsZero(block) {
-					r.lastBlockNum = block.Number
-				}
-
-				if !r.isBlockWithin(block) {
-					currentFile := r.fileIndex.At(r.currFileIndex)
-					return Block[T]{}, fmt.Errorf("block number %d is out of file block %d-%d range",
-						block.Number,
-						currentFile.FirstBlockNum,
-						currentFile.LastBlockNum)
-				}
-
-				return block, nil
+				// blocks already returned from the tail are skipped
+				continue
 			}
-			return Block[T]{}, fmt.Errorf("failed to decode file data: %w", err)
+			return Block[T]{}, newFileError(r.locationFile, fmt.Errorf("failed to decode file data: %w", r.checksum.decodeErr(err)))
 		}
 
 		if !r.isBlockWithin(block) {
-			currentFile := r.fileIndex.At(r.currFileIndex)
-			return Block[T]{}, fmt.Errorf("block number %d is out of file block %d-%d range",
+			return Block[T]{}, newFileError(r.locationFile, fmt.Errorf("block number %d is out of file block %d-%d range",
 				block.Number,
-				currentFile.FirstBlockNum,
-				currentFile.LastBlockNum)
+				r.locationFile.FirstBlockNum,
+				r.locationFile.LastBlockNum))
 		}
 	}
 
-	if !structs.IsZero(block) {
-		r.lastBlockNum = block.Number
-	}
-
-	return block, nil
+	r.onBlockRead(block.Number)
+	r.location = BlockLocation{File: r.locationFile, Ordinal: r.fileOrdinal - 1}
+	return r.applyPatch(ctx, block)
 }
 
 func (r *reader[T]) Seek(ctx context.Context, blockNum uint64) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	return r.instance.wrapError(r.seek(ctx, blockNum))
+}
+
+func (r *reader[T]) seek(ctx context.Context, blockNum uint64) error {
+	if prunedBefore := r.fileIndex.PrunedBefore(); blockNum < prunedBefore {
+		return fmt.Errorf("%w: block %d, the files before block %d were pruned", ErrBlockPruned, blockNum, prunedBefore)
+	}
+
 	_, fileIndex, err := r.fileIndex.FindFile(blockNum)
+	if errors.Is(err, ErrFileNotExist) && (r.options.FollowTail || r.options.TailMode) {
+		// the block may be in the files rolled since the file index was loaded
+		_, err = r.addRolledFiles(ctx)
+		if err != nil {
+			return err
+		}
+		_, fileIndex, err = r.fileIndex.FindFile(blockNum)
+	}
 	if err != nil && errors.Is(err, ErrFileNotExist) {
 		return io.EOF
 	}
@@ -210,10 +561,8 @@ func (r *reader[T]) Seek(ctx context.Context, blockNum uint64) error {
 	}
 
 	if r.currFileIndex != fileIndex {
-		// clear prefetched file
-		if r.currFileIndex+1 < len(r.fileIndex.Files()) {
-			r.fileIndex.At(r.currFileIndex + 1).PrefetchClear()
-		}
+		// clear prefetched files
+		r.prefetcher.clear()
 
 		// read file
 		r.currFileIndex = fileIndex
@@ -221,26 +570,106 @@ func (r *reader[T]) Seek(ctx context.Context, blockNum uint64) error {
 		if err != nil {
 			return err
 		}
+		r.prefetchNextFiles(ctx)
+	} else if r.decoder != nil && r.fileOrdinal > 0 && blockNum <= r.fileBlockNum {
+		// the block was already decoded, the current file is read again from the beginning
+		err = r.readFile(ctx, r.currFileIndex)
+		if err != nil {
+			return err
+		}
 	}
 
+	// NoBlockNum for block 0
 	r.lastBlockNum = blockNum - 1
+	r.rangeDone = false
 	return nil
 }
 
 func (r *reader[T]) BlockNum() uint64 {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if r.lastBlockNum == NoBlockNum {
+		return 0
+	}
 	return r.lastBlockNum
 }
 
+func (r *reader[T]) Options() Options {
+	return r.options
+}
+
+func (r *reader[T]) Accounting() *storage.Accounting {
+	return r.options.Accounting
+}
+
+// warnLegacyJSON logs the warning the first time the reader decodes the block with the legacy JSON field names.
+func (r *reader[T]) warnLegacyJSON() {
+	r.legacyJSONWarning.Do(func() {
+		log.Default().Println("decoding blocks with legacy json field names", "instance", r.ID())
+	})
+}
+
+func (r *reader[T]) Stats() ReaderStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.stats
+	stats.CorruptFiles = slices.Clone(r.stats.CorruptFiles)
+	return stats
+}
+
+// reportCorruptFile adds the file to ReaderStats.CorruptFiles unless it's already reported.
+func (r *reader[T]) reportCorruptFile(file *File, err error) {
+	for _, corrupt := range r.stats.CorruptFiles {
+		if corrupt.FirstBlockNum == file.FirstBlockNum && corrupt.LastBlockNum == file.LastBlockNum {
+			return
+		}
+	}
+	r.stats.CorruptFiles = append(r.stats.CorruptFiles, CorruptFile{FirstBlockNum: file.FirstBlockNum, LastBlockNum: file.LastBlockNum, Err: err})
+}
+
+func (r *reader[T]) BlockExamined(ctx context.Context, blockNum uint64) (bool, error) {
+	return r.BlockRangeExamined(ctx, blockNum, blockNum)
+}
+
+func (r *reader[T]) BlockRangeExamined(ctx context.Context, from, to uint64) (bool, error) {
+	examined, err := r.presence.examined(ctx, from, to)
+	return examined, r.instance.wrapError(err)
+}
+
+func (r *reader[T]) ID() Instance {
+	return r.instance
+}
+
 func (r *reader[T]) Close() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+
+	var err error
 	if r.closer != nil {
-		return r.closer.Close()
+		err = r.closer.Close()
+		r.closer = nil
+		r.ahead = nil
 	}
-	return nil
+
+	// release prefetched files
+	r.prefetcher.clear()
+	for _, file := range r.fileIndex.Files() {
+		file.PrefetchClear()
+	}
+	r.fileData = nil
+	r.tailBlocks = nil
+
+	if r.repairer != nil {
+		r.repairer.wait()
+	}
+	return r.instance.wrapError(err)
 }
 
 func (r *reader[T]) readFile(ctx context.Context, index int) error {
@@ -248,14 +677,62 @@ func (r *reader[T]) readFile(ctx context.Context, index int) error {
 		return io.EOF
 	}
 
+	// the files past the range of the range reader are not opened
+	if r.beyondRange(r.fileIndex.At(index).FirstBlockNum) {
+		r.rangeDone = true
+		return io.EOF
+	}
+
 	if r.closer != nil {
 		_ = r.closer.Close()
+		r.closer = nil
+		r.ahead = nil
 	}
 
 	file := r.fileIndex.At(index)
-	rdr, err := file.Open(ctx, r.fs)
+	decodeBlock, err := newSchemaDecoder(r.options, r.upgrades, file.SchemaVersion)
 	if err != nil {
-		return err
+		return newFileError(file, err)
+	}
+
+	// the current file rewound by Seek is read from its prefetched data
+	var data []byte
+	if r.locationFile != nil && r.locationFile.FirstBlockNum == file.FirstBlockNum && r.locationFile.LastBlockNum == file.LastBlockNum {
+		data = r.fileData
+	}
+	r.fileData = nil
+
+	var rdr io.ReadCloser
+	if data != nil {
+		rdr = io.NopCloser(bytes.NewReader(data))
+	} else {
+		rdr, data, err = r.openFile(ctx, file)
+		r.prefetcher.consume(file)
+		if err != nil {
+			return newFileError(file, err)
+		}
+	}
+
+	// the zero-length file is not a valid stream of any codec or compression
+	nonEmptyRdr, err := nonEmptyReader(rdr)
+	if err != nil {
+		_ = rdr.Close()
+		if !errors.Is(err, ErrEmptyFile) {
+			return newFileError(file, err)
+		}
+
+		r.reportCorruptFile(file, err)
+		if !r.options.SkipCorruptFiles {
+			return newFileError(file, err)
+		}
+		r.currFileIndex = index
+		return r.readFile(ctx, index+1)
+	}
+	rdr = nonEmptyRdr
+	r.checksum = nil
+	if r.options.VerifyChecksumOnRead && file.Checksum != nil {
+		r.checksum = newChecksumReader(rdr, file)
+		rdr = r.checksum
 	}
 
 	var decmprRdr = io.NopCloser(rdr)
@@ -263,8 +740,22 @@ func (r *reader[T]) readFile(ctx context.Context, index int) error {
 		decmprRdr = r.options.NewDecompressor(decmprRdr)
 	}
 
+	r.decoder = newBlockDecoder(r.options, decmprRdr, r.warnLegacyJSON)
+	r.decodeBlock = decodeBlock
+
+	var ahead *decodeAhead[T]
+	if r.options.DecodeAhead > 0 {
+		ahead = startDecodeAhead(r.decoder, decodeBlock, r.options.DecodeAhead)
+	}
+	r.ahead = ahead
+
 	r.closer = &funcCloser{
 		CloseFunc: func() error {
+			// the decoder must not be used once the readers are closed
+			if ahead != nil {
+				ahead.close()
+			}
+
 			if err := decmprRdr.Close(); err != nil {
 				_ = rdr.Close()
 				return err
@@ -273,28 +764,259 @@ func (r *reader[T]) readFile(ctx context.Context, index int) error {
 		},
 	}
 
-	r.decoder = r.options.NewDecoder(decmprRdr)
-
 	r.currFileIndex = index
+	r.fileOrdinal = 0
+	r.fileBlockNum = 0
+	r.fileData = data
+	r.locationFile = file.clone()
 	return nil
 }
 
+// nonEmptyReader returns the reader of the whole file or ErrEmptyFile if the file has no data, the first
+// byte is read ahead to tell the empty file apart from the one failing to decode.
+func nonEmptyReader(rdr io.ReadCloser) (io.ReadCloser, error) {
+	var first [1]byte
+	_, err := io.ReadFull(rdr, first[:])
+	if errors.Is(err, io.EOF) {
+		return nil, ErrEmptyFile
+	}
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(first[:]), rdr), rdr}, nil
+}
+
+// openFile opens the file and repairs it in the background if it's stored at a fallback location. The data
+// of the prefetched file is returned too.
+func (r *reader[T]) openFile(ctx context.Context, file *File) (io.ReadCloser, []byte, error) {
+	var (
+		rdr  io.ReadCloser
+		err  error
+		data = file.prefetched(r.options.IOScheduler)
+	)
+	if data != nil {
+		rdr = io.NopCloser(bytes.NewReader(data))
+	} else {
+		rdr, err = file.openScheduled(ctx, r.fs, r.options.IOScheduler)
+	}
+	if r.repairer == nil {
+		return rdr, data, err
+	}
+
+	if errors.Is(err, ErrFileNotExist) {
+		rdr, err = r.repairer.openFallback(ctx, file)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.repairer.repairAsync(ctx, file)
+	return rdr, data, nil
+}
+
 func (r *reader[T]) readNextFile(ctx context.Context) error {
-	defer r.prefetchNextFile(ctx)
+	defer r.prefetchNextFiles(ctx)
 	return r.readFile(ctx, r.currFileIndex+1)
 }
 
-func (r *reader[T]) prefetchNextFile(ctx context.Context) {
-	if r.currFileIndex+1 < len(r.fileIndex.Files()) {
-		go r.prefetchFile(ctx, r.fileIndex.At(r.currFileIndex+1))
+// prefetchNextFiles prefetches up to Options.PrefetchDepth files after the current file.
+func (r *reader[T]) prefetchNextFiles(ctx context.Context) {
+	if r.options.DisablePrefetch {
+		return
 	}
+
+	var files []*File
+	for index := r.currFileIndex + 1; index <= r.currFileIndex+r.options.PrefetchDepth && index < len(r.fileIndex.Files()); index++ {
+		file := r.fileIndex.At(index)
+		if r.beyondRange(file.FirstBlockNum) {
+			break
+		}
+		files = append(files, file)
+	}
+	r.prefetcher.schedule(ctx, files)
 }
 
-func (r *reader[T]) prefetchFile(ctx context.Context, file *File) {
-	pCtx, cancel := context.WithTimeout(ctx, r.options.FilePrefetchTimeout)
-	defer cancel()
+// beyondRange reports whether the block is past the range of the reader created by NewRangeReader.
+func (r *reader[T]) beyondRange(blockNum uint64) bool {
+	return r.rangeTo != nil && blockNum > *r.rangeTo
+}
+
+// waitPoll waits for Options.TailPollInterval with the lock released, so that the reader can be closed.
+func (r *reader[T]) waitPoll(ctx context.Context) error {
+	r.mu.Unlock()
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-r.done:
+	case <-time.After(r.options.TailPollInterval):
+	}
+	r.mu.Lock()
+
+	if r.closed {
+		return ErrReaderClosed
+	}
+	return err
+}
+
+func (r *reader[T]) WaitForBlock(ctx context.Context, blockNum uint64) error {
+	for {
+		written, err := r.blockWritten(ctx, blockNum)
+		if err != nil {
+			return r.instance.wrapError(err)
+		}
+		if written {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return r.instance.wrapError(ctx.Err())
+		case <-r.done:
+			return r.instance.wrapError(ErrReaderClosed)
+		case <-time.After(r.options.TailPollInterval):
+		}
+	}
+}
+
+// blockWritten reports whether the block is stored in the rolled file or in the tail if the reader follows it.
+func (r *reader[T]) blockWritten(ctx context.Context, blockNum uint64) (bool, error) {
+	fileIndex := NewFileIndex(r.tailFs)
+	err := fileIndex.Load(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to reload file index: %w", err)
+	}
+	if _, last := fileIndex.BlockRange(); len(fileIndex.Files()) > 0 && last >= blockNum {
+		return true, nil
+	}
+	if !r.options.FollowTail {
+		return false, nil
+	}
+
+	tailBlockNum, ok, err := readTailLastBlockNum(ctx, r.tailFs)
+	if err != nil {
+		return false, err
+	}
+	return ok && tailBlockNum >= blockNum, nil
+}
+
+// follow checks for newly rolled files and serves blocks from the tail if there are none and the reader
+// follows the tail.
+func (r *reader[T]) follow(ctx context.Context) (Block[T], error) {
+	// rolled files always take precedence over the tail
+	rolled, err := r.addRolledFiles(ctx)
+	if err != nil {
+		return Block[T]{}, err
+	}
+
+	if rolled {
+		r.tailBlocks = nil
+		return r.read(ctx)
+	}
+	if !r.options.FollowTail {
+		return Block[T]{}, io.EOF
+	}
+
+	// reload tail once all tail blocks are read
+	if len(r.tailBlocks) == 0 {
+		r.tailBlocks, err = readTail[T](ctx, r.tailFs, r.options)
+		if err != nil {
+			return Block[T]{}, err
+		}
+	}
+
+	// skip blocks already read or stored in rolled files
+	var rolledBlockNum = NoBlockNum
+	if files := r.fileIndex.Files(); len(files) > 0 {
+		rolledBlockNum = files[len(files)-1].LastBlockNum
+	}
+
+	for len(r.tailBlocks) > 0 {
+		block := r.tailBlocks[0]
+		r.tailBlocks = r.tailBlocks[1:]
+
+		if r.isRead(block.Number) || (rolledBlockNum != NoBlockNum && block.Number <= rolledBlockNum) {
+			continue
+		}
 
-	_ = file.Prefetch(pCtx, r.fs)
+		r.onBlockRead(block.Number)
+		r.location = BlockLocation{}
+		return r.applyPatch(ctx, block)
+	}
+	return Block[T]{}, io.EOF
+}
+
+// addRolledFiles adds the files rolled since the file index was loaded, it's loaded again bypassing cache. It
+// reports whether any file was rolled after the last known file.
+func (r *reader[T]) addRolledFiles(ctx context.Context) (bool, error) {
+	fileIndex := NewFileIndex(r.tailFs)
+	err := fileIndex.Load(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to reload file index: %w", err)
+	}
+
+	r.fileIndex.prunedBefore = max(r.fileIndex.PrunedBefore(), fileIndex.PrunedBefore())
+
+	var lastRolledBlockNum uint64
+	if files := r.fileIndex.Files(); len(files) > 0 {
+		lastRolledBlockNum = files[len(files)-1].LastBlockNum
+	}
+
+	var rolled bool
+	for _, file := range fileIndex.Files() {
+		if known, _, err := r.fileIndex.FindFile(file.FirstBlockNum); err == nil && known.FirstBlockNum <= file.FirstBlockNum {
+			continue
+		}
+
+		// the files backfilled before the current file shift its position
+		if current := r.fileIndex.At(r.currFileIndex); current != nil && file.LastBlockNum < current.FirstBlockNum {
+			r.currFileIndex++
+		}
+
+		err = r.fileIndex.AddFile(file)
+		if err != nil {
+			return false, fmt.Errorf("failed to add rolled file: %w", err)
+		}
+		rolled = rolled || file.FirstBlockNum > lastRolledBlockNum
+	}
+
+	return rolled, nil
+}
+
+// isRead reports whether the block is at or before the last block read or sought past.
+func (r *reader[T]) isRead(blockNum uint64) bool {
+	return r.lastBlockNum != NoBlockNum && blockNum <= r.lastBlockNum
+}
+
+// onBlockRead updates the last block number and reports a gap if blocks were skipped.
+func (r *reader[T]) onBlockRead(blockNum uint64) {
+	if r.blockRead && blockNum > r.lastBlockNum+1 {
+		r.stats.Gaps++
+		r.stats.GapBlocks += blockNum - r.lastBlockNum - 1
+		if r.options.OnGap != nil {
+			r.options.OnGap(r.lastBlockNum, blockNum)
+		}
+	}
+
+	r.lastBlockNum = blockNum
+	r.blockRead = true
+}
+
+// applyPatch substitutes the block with its patched version if it exists.
+func (r *reader[T]) applyPatch(ctx context.Context, block Block[T]) (Block[T], error) {
+	if r.patches == nil || !r.patches.has(block.Number) {
+		return block, nil
+	}
+
+	var patched Block[T]
+	err := r.patches.read(ctx, block.Number, &patched)
+	if err != nil {
+		return Block[T]{}, fmt.Errorf("failed to read patch for block %d: %w", block.Number, err)
+	}
+	return patched, nil
 }
 
 func (r *reader[T]) isBlockWithin(block Block[T]) bool {
@@ -0,0 +1,81 @@
+package ethwal
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// decodedRecord is the result of decoding the file record.
+type decodedRecord[T any] struct {
+	block Block[T]
+	err   error
+}
+
+// decodeAhead decodes the records of the file in the background goroutine into the bounded channel.
+// The records are delivered in the file order, the decoding stops at the first error, which is
+// delivered after all records decoded before it.
+type decodeAhead[T any] struct {
+	records chan decodedRecord[T]
+	// err is the error that stopped the decoding, it's set before records is closed
+	err error
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func startDecodeAhead[T any](decoder Decoder, decodeBlock schemaDecoder[T], size int) *decodeAhead[T] {
+	d := &decodeAhead[T]{
+		records: make(chan decodedRecord[T], size),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(d.done)
+		defer close(d.records)
+
+		for {
+			var block Block[T]
+			err := decodeBlock(decoder, &block)
+			if err != nil {
+				d.err = err
+			}
+
+			select {
+			case d.records <- decodedRecord[T]{block: block, err: err}:
+			case <-d.stop:
+				d.err = io.ErrClosedPipe
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return d
+}
+
+// next returns the next decoded record. Once the decoding stopped, it returns the error that stopped it.
+func (d *decodeAhead[T]) next(ctx context.Context, block *Block[T]) error {
+	select {
+	case record, ok := <-d.records:
+		if !ok {
+			return d.err
+		}
+		*block = record.block
+		return record.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops the goroutine and waits until it exits, so that the decoder is no longer used.
+func (d *decodeAhead[T]) close() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+	<-d.done
+}
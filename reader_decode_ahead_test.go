@@ -0,0 +1,251 @@
+package ethwal
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type decodeAheadTestData struct {
+	Values []uint64
+	Note   string
+}
+
+func writeDecodeAheadDataset(t testing.TB, datasetPath string, numBlocks uint64, blocksPerFile uint64, valuesPerBlock int) Options {
+	opt := Options{
+		Dataset:         Dataset{Path: datasetPath},
+		NewCompressor:   NewZSTDCompressor,
+		NewDecompressor: NewZSTDDecompressor,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(blocksPerFile),
+		FileRollOnClose: true,
+	}
+
+	w, err := NewWriter[decodeAheadTestData](opt)
+	require.NoError(t, err)
+
+	for i := uint64(1); i <= numBlocks; i++ {
+		data := decodeAheadTestData{Values: make([]uint64, valuesPerBlock), Note: fmt.Sprintf("block %d", i)}
+		for j := range data.Values {
+			data.Values[j] = i*uint64(valuesPerBlock) + uint64(j)
+		}
+		require.NoError(t, w.Write(context.Background(), Block[decodeAheadTestData]{Number: i, Data: data}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+	return opt
+}
+
+// readTrace reads the blocks with the operations and returns the trace of the results.
+func readTrace(t *testing.T, opt Options, ops func(r Reader[decodeAheadTestData], read func(n int))) []string {
+	opt.InstanceID = "trace"
+
+	r, err := NewReader[decodeAheadTestData](opt)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var trace []string
+	read := func(n int) {
+		for i := 0; i < n; i++ {
+			b, loc, err := r.ReadWithLocation(context.Background())
+			if err != nil {
+				trace = append(trace, fmt.Sprintf("error: %v", err))
+				return
+			}
+			trace = append(trace, fmt.Sprintf("block %d %v file[%d-%d]#%d", b.Number, b.Data, loc.File.FirstBlockNum, loc.File.LastBlockNum, loc.Ordinal))
+		}
+	}
+
+	ops(r, read)
+	trace = append(trace, fmt.Sprintf("stats %+v", r.Stats()))
+	return trace
+}
+
+func TestReader_DecodeAhead(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	opt := writeDecodeAheadDataset(t, testPath, 1000, 100, 4)
+
+	scenarios := map[string]func(r Reader[decodeAheadTestData], read func(n int)){
+		"all": func(r Reader[decodeAheadTestData], read func(n int)) {
+			read(1001)
+		},
+		"seek": func(r Reader[decodeAheadTestData], read func(n int)) {
+			read(5)
+			require.NoError(t, r.Seek(context.Background(), 450))
+			read(10)
+			require.NoError(t, r.Seek(context.Background(), 480))
+			read(30)
+			require.NoError(t, r.Seek(context.Background(), 120))
+			read(3)
+			require.ErrorIs(t, r.Seek(context.Background(), 2000), io.EOF)
+			read(3)
+		},
+	}
+
+	for name, scenario := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			expected := readTrace(t, opt, scenario)
+
+			for _, size := range []int{1, 16} {
+				aheadOpt := opt
+				aheadOpt.DecodeAhead = size
+				require.Equal(t, expected, readTrace(t, aheadOpt, scenario), size)
+			}
+		})
+	}
+
+	t.Run("invalid_files", func(t *testing.T) {
+		r, err := NewReader[decodeAheadTestData](opt)
+		require.NoError(t, err)
+		fileIndex := r.FileIndex()
+		require.NoError(t, r.Close())
+
+		// the file stores the blocks of the previous file
+		data, err := os.ReadFile(path.Join(testPath, fileIndex.At(1).Path()))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path.Join(testPath, fileIndex.At(2).Path()), data, 0644))
+
+		scenario := func(r Reader[decodeAheadTestData], read func(n int)) {
+			read(1001)
+			read(1)
+		}
+
+		expected := readTrace(t, opt, scenario)
+		require.Contains(t, expected[len(expected)-2], "out of file block 201-300 range")
+
+		for _, size := range []int{1, 16} {
+			aheadOpt := opt
+			aheadOpt.DecodeAhead = size
+			require.Equal(t, expected, readTrace(t, aheadOpt, scenario), size)
+		}
+	})
+}
+
+func TestReader_DecodeAhead_Close(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	opt := writeDecodeAheadDataset(t, testPath, 1000, 500, 4)
+	opt.DecodeAhead = 4
+
+	t.Run("close", func(t *testing.T) {
+		r, err := NewReader[decodeAheadTestData](opt)
+		require.NoError(t, err)
+
+		_, err = r.Read(context.Background())
+		require.NoError(t, err)
+
+		ahead := r.(*reader[decodeAheadTestData]).ahead
+		require.NotNil(t, ahead)
+		require.NoError(t, r.Close())
+
+		select {
+		case <-ahead.done:
+		default:
+			t.Fatal("decode ahead goroutine is running after close")
+		}
+
+		// the closed reader doesn't hang
+		_, _ = r.Read(context.Background())
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		r, err := NewReader[decodeAheadTestData](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		_, err = r.Read(context.Background())
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err = r.Read(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+
+		b, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), b.Number)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		r, err := NewReader[decodeAheadTestData](opt)
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					_, err := r.Read(context.Background())
+					if err != nil {
+						return
+					}
+					if j%10 == 0 {
+						_ = r.Seek(context.Background(), uint64(1+(i*250+j*7)%1000))
+					}
+				}
+			}(i)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = r.Close()
+		}()
+		wg.Wait()
+
+		require.NoError(t, r.Close())
+	})
+}
+
+func BenchmarkReader_DecodeAhead(b *testing.B) {
+	datasetPath := path.Join(b.TempDir(), "ethwal")
+	opt := writeDecodeAheadDataset(b, datasetPath, 20_000, 1_000, 256)
+
+	// consume simulates the processing of the block comparable to the decoding cost
+	consume := func(block Block[decodeAheadTestData]) {
+		var buf [8]byte
+		h := sha256.New()
+		for round := 0; round < 2; round++ {
+			for _, v := range block.Data.Values {
+				buf[0] = byte(v)
+				h.Write(buf[:])
+			}
+		}
+		_ = h.Sum(nil)
+	}
+
+	for _, size := range []int{0, 64} {
+		b.Run(fmt.Sprintf("decode_ahead_%d", size), func(b *testing.B) {
+			benchOpt := opt
+			benchOpt.DecodeAhead = size
+
+			for i := 0; i < b.N; i++ {
+				r, err := NewReader[decodeAheadTestData](benchOpt)
+				require.NoError(b, err)
+
+				for {
+					block, err := r.Read(context.Background())
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					require.NoError(b, err)
+					consume(block)
+				}
+				require.NoError(b, r.Close())
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package ethwal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+// filePrefetcher keeps up to Options.PrefetchDepth files ahead of the reader prefetched, bounded by
+// Options.PrefetchMaxBytes. The prefetched data is held by the files, the prefetcher tracks the files it
+// prefetches and their size, so that its prefetches are released once the reader moves past them. The data
+// of the files prefetched by other readers too is kept until they release it.
+type filePrefetcher struct {
+	fs        storage.FS
+	scheduler *IOScheduler
+	timeout   time.Duration
+	maxBytes  uint64
+
+	mu sync.Mutex
+	// pending are the prefetched files not yet opened by the reader
+	pending map[*File]*pendingPrefetch
+	bytes   uint64
+	// consumed is the last file opened by the reader, the files up to it aren't prefetched
+	consumed *File
+	// generation is increased by clear, so that the files scheduled before aren't prefetched
+	generation uint64
+}
+
+// pendingPrefetch is the prefetch of the file by the prefetcher.
+type pendingPrefetch struct {
+	// size is the size of the file, zero if the prefetch is unbounded
+	size   uint64
+	cancel context.CancelFunc
+	// acquired is set once the prefetch holds the prefetched data of the file
+	acquired bool
+}
+
+// release releases the prefetched data of the file, or cancels the prefetch in progress.
+func (pp *pendingPrefetch) release(file *File) {
+	pp.cancel()
+	if pp.acquired {
+		file.ReleasePrefetch()
+	}
+}
+
+func newFilePrefetcher(fs storage.FS, opt Options) *filePrefetcher {
+	return &filePrefetcher{
+		fs:        fs,
+		scheduler: opt.IOScheduler,
+		timeout:   opt.FilePrefetchTimeout,
+		maxBytes:  opt.PrefetchMaxBytes.Bytes(),
+		pending:   make(map[*File]*pendingPrefetch),
+	}
+}
+
+// schedule prefetches the files, ordered by block number, in the background. The files over the size bound
+// are skipped with the files after them, they are scheduled again once the reader consumes the prefetched
+// ones.
+func (p *filePrefetcher) schedule(ctx context.Context, files []*File) {
+	if len(files) == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	generation := p.generation
+	p.mu.Unlock()
+
+	go func() {
+		for _, file := range files {
+			if !p.reserve(ctx, generation, file) {
+				return
+			}
+		}
+	}()
+}
+
+// reserve starts the prefetch of the file unless it's already pending, it reports whether the next files
+// can be prefetched.
+func (p *filePrefetcher) reserve(ctx context.Context, generation uint64, file *File) bool {
+	p.mu.Lock()
+	_, pending := p.pending[file]
+	unbounded := p.maxBytes == 0 || len(p.pending) == 0
+	p.mu.Unlock()
+	if pending {
+		return true
+	}
+
+	// the size is needed only if the prefetch is bounded
+	var size uint64
+	if !unbounded {
+		fileSize, err := file.Size(ctx, p.fs)
+		if err != nil {
+			return false
+		}
+		size = uint64(fileSize)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.generation != generation {
+		return false
+	}
+	if p.consumed != nil && file.FirstBlockNum <= p.consumed.FirstBlockNum {
+		return true
+	}
+	if _, pending := p.pending[file]; pending {
+		return true
+	}
+	if p.maxBytes != 0 && len(p.pending) > 0 && p.bytes+size > p.maxBytes {
+		return false
+	}
+
+	pCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	entry := &pendingPrefetch{size: size, cancel: cancel}
+	p.pending[file] = entry
+	p.bytes += size
+	go p.prefetch(pCtx, file, entry)
+	return true
+}
+
+func (p *filePrefetcher) prefetch(ctx context.Context, file *File, pending *pendingPrefetch) {
+	acquired, _ := file.prefetch(ctx, p.fs, p.scheduler)
+	if !acquired {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// the prefetch evicted while in progress is released
+	if p.pending[file] != pending {
+		file.ReleasePrefetch()
+		return
+	}
+	pending.acquired = true
+}
+
+// consume releases the prefetch of the file opened by the reader, the reader keeps its data, and evicts the
+// pending files before it.
+func (p *filePrefetcher) consume(file *File) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.consumed = file
+	for pendingFile, pending := range p.pending {
+		if pendingFile.FirstBlockNum > file.FirstBlockNum {
+			continue
+		}
+		pending.release(pendingFile)
+		delete(p.pending, pendingFile)
+		p.bytes -= pending.size
+	}
+}
+
+// clear cancels the prefetches and releases the prefetched files, e.g. on Seek.
+func (p *filePrefetcher) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for file, pending := range p.pending {
+		pending.release(file)
+	}
+	clear(p.pending)
+	p.bytes = 0
+	p.consumed = nil
+	p.generation++
+}
@@ -0,0 +1,159 @@
+package ethwal
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/c2h5oh/datasize"
+	"github.com/stretchr/testify/require"
+)
+
+// latencyFS simulates the link with the latency of the first byte of every opened object.
+type latencyFS struct {
+	storage.FS
+
+	latency time.Duration
+}
+
+func (l *latencyFS) Open(ctx context.Context, path string, options *gostorage.ReaderOptions) (*gostorage.File, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(l.latency):
+	}
+	return l.FS.Open(ctx, path, options)
+}
+
+func setupReaderPrefetchTest(t *testing.T, numFiles, blocksPerFile uint64) storage.FS {
+	memFs := gostorage.NewMemoryFS()
+	w, err := NewWriter[[]byte](Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      memFs,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(blocksPerFile),
+		FileRollOnClose: true,
+	})
+	require.NoError(t, err)
+	for blockNum := uint64(1); blockNum <= numFiles*blocksPerFile; blockNum++ {
+		require.NoError(t, w.Write(context.Background(), Block[[]byte]{Number: blockNum, Data: make([]byte, 1024)}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+	return memFs
+}
+
+// prefetchedFiles returns the number of the files with the prefetched data.
+func prefetchedFiles(r Reader[[]byte]) int {
+	var prefetched int
+	for _, file := range r.(*reader[[]byte]).fileIndex.Files() {
+		file.mu.Lock()
+		if file.prefetchBuffer != nil {
+			prefetched++
+		}
+		file.mu.Unlock()
+	}
+	return prefetched
+}
+
+func TestReader_PrefetchDepth(t *testing.T) {
+	const (
+		numFiles      = 8
+		blocksPerFile = 4
+		latency       = 100 * time.Millisecond
+	)
+
+	memFs := setupReaderPrefetchTest(t, numFiles, blocksPerFile)
+
+	// scan reads the dataset processing every block for 10ms, it returns the max latency of the reads of
+	// the files after the first two, whose prefetch starts with the reading
+	scan := func(t *testing.T, depth int) time.Duration {
+		r, err := NewReader[[]byte](Options{
+			Dataset:       Dataset{Path: "ethwal"},
+			FileSystem:    &latencyFS{FS: memFs, latency: latency},
+			PrefetchDepth: depth,
+		})
+		require.NoError(t, err)
+		defer r.Close()
+
+		var maxLatency time.Duration
+		for blockNum := uint64(1); ; blockNum++ {
+			readStart := time.Now()
+			block, err := r.Read(context.Background())
+			if err == io.EOF {
+				require.Equal(t, uint64(numFiles*blocksPerFile+1), blockNum)
+				break
+			}
+			require.NoError(t, err)
+			require.Equal(t, blockNum, block.Number)
+			if blockNum > 2*blocksPerFile {
+				maxLatency = max(maxLatency, time.Since(readStart))
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+		return maxLatency
+	}
+
+	// the file is processed faster than it's fetched, the reads stall waiting for the next file
+	require.Greater(t, scan(t, 1), latency/2)
+
+	// the files fetched in parallel hide the latency
+	require.Less(t, scan(t, 4), latency/2)
+}
+
+func TestReader_PrefetchMaxBytes(t *testing.T) {
+	memFs := setupReaderPrefetchTest(t, 6, 4)
+
+	open := func(t *testing.T, maxBytes datasize.ByteSize) Reader[[]byte] {
+		r, err := NewReader[[]byte](Options{
+			Dataset:          Dataset{Path: "ethwal"},
+			FileSystem:       memFs,
+			PrefetchDepth:    3,
+			PrefetchMaxBytes: maxBytes,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = r.Close() })
+
+		_, err = r.Read(context.Background())
+		require.NoError(t, err)
+		return r
+	}
+
+	t.Run("unbounded", func(t *testing.T) {
+		r := open(t, 0)
+		require.Eventually(t, func() bool { return prefetchedFiles(r) == 3 }, time.Second, 10*time.Millisecond)
+
+		// the files are evicted as they're consumed
+		for i := 0; i < 4; i++ {
+			_, err := r.Read(context.Background())
+			require.NoError(t, err)
+		}
+		require.Eventually(t, func() bool { return prefetchedFiles(r) == 3 }, time.Second, 10*time.Millisecond)
+		require.Nil(t, r.(*reader[[]byte]).fileIndex.At(1).prefetchBuffer)
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		// the next file is prefetched regardless of the bound
+		r := open(t, 1)
+		require.Eventually(t, func() bool { return prefetchedFiles(r) == 1 }, time.Second, 10*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		require.Equal(t, 1, prefetchedFiles(r))
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		r := open(t, 0)
+		require.Eventually(t, func() bool { return prefetchedFiles(r) == 3 }, time.Second, 10*time.Millisecond)
+
+		// the prefetched files are cleared and the files after the sought one are prefetched
+		require.NoError(t, r.Seek(context.Background(), 21))
+		require.Eventually(t, func() bool { return prefetchedFiles(r) == 0 }, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, r.Seek(context.Background(), 9))
+		require.Eventually(t, func() bool { return prefetchedFiles(r) == 3 }, time.Second, 10*time.Millisecond)
+		for index := 3; index < 6; index++ {
+			require.NotNil(t, r.(*reader[[]byte]).fileIndex.At(index).prefetchBuffer)
+		}
+	})
+}
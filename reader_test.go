@@ -2,15 +2,20 @@ package ethwal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"slices"
 	"testing"
 	"time"
 
 	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/0xsequence/ethwal/storage"
 	"github.com/0xsequence/ethwal/storage/local"
+	"github.com/0xsequence/ethwal/storage/memory"
+	gostorage "github.com/Shopify/go-storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -223,6 +228,57 @@ func TestReader_Read(t *testing.T) {
 	}
 }
 
+func TestReader_OnGap(t *testing.T) {
+	testSetup(t, NewCBOREncoder, nil)
+	defer testTeardown(t)
+
+	var gaps [][2]uint64
+	rdr, err := NewReader[int](Options{
+		Dataset: Dataset{
+			Name:    "int-wal",
+			Path:    testPath,
+			Version: defaultDatasetVersion,
+		},
+		NewDecoder: NewCBORDecoder,
+		OnGap: func(fromExclusive, toExclusive uint64) {
+			gaps = append(gaps, [2]uint64{fromExclusive, toExclusive})
+		},
+	})
+	require.NoError(t, err)
+
+	for _, err = rdr.Read(context.Background()); err == nil; _, err = rdr.Read(context.Background()) {
+	}
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, uint64(12), rdr.BlockNum())
+
+	require.Equal(t, [][2]uint64{{8, 11}}, gaps)
+	require.Equal(t, ReaderStats{Gaps: 1, GapBlocks: 2}, rdr.Stats())
+	require.NoError(t, rdr.Close())
+
+	// contiguous dataset
+	gaps = nil
+	rdr, err = NewReader[int](Options{
+		Dataset: Dataset{
+			Name:    "int-wal",
+			Path:    testPath,
+			Version: defaultDatasetVersion,
+		},
+		NewDecoder: NewCBORDecoder,
+		OnGap: func(fromExclusive, toExclusive uint64) {
+			gaps = append(gaps, [2]uint64{fromExclusive, toExclusive})
+		},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 8; i++ {
+		_, err = rdr.Read(context.Background())
+		require.NoError(t, err)
+	}
+	require.Empty(t, gaps)
+	require.Equal(t, ReaderStats{}, rdr.Stats())
+	require.NoError(t, rdr.Close())
+}
+
 func TestReader_FileNum(t *testing.T) {
 	testSetup(t, NewCBOREncoder, nil)
 	defer testTeardown(t)
@@ -262,6 +318,13 @@ func TestReader_FileIndex(t *testing.T) {
 	require.NotNil(t, fileIndex)
 	assert.Equal(t, 3, len(fileIndex.Files()))
 
+	// the copy is modified without affecting the reader
+	lastBlockNum := fileIndex.At(2).LastBlockNum
+	fileIndex.At(2).LastBlockNum = 0
+	require.NoError(t, fileIndex.AddFile(&File{FirstBlockNum: lastBlockNum + 1, LastBlockNum: lastBlockNum + 10}))
+	assert.Equal(t, 3, rdr.FileNum())
+	assert.Equal(t, lastBlockNum, rdr.FileIndex().At(2).LastBlockNum)
+
 	require.NoError(t, rdr.Close())
 }
 
@@ -358,6 +421,105 @@ func TestReader_Seek(t *testing.T) {
 	require.Equal(t, io.EOF, err)
 }
 
+func TestReader_SeekWithinFile(t *testing.T) {
+	origin := &openRecordingFS{FS: gostorage.NewMemoryFS(), opened: make(map[string]int)}
+	opt := Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      origin,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+
+	w, err := NewWriter[int](opt)
+	require.NoError(t, err)
+	for blockNum := uint64(1); blockNum <= 30; blockNum++ {
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: blockNum, Data: int(blockNum)}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	secondFile := path.Join(opt.Dataset.FullPath(), (&File{FirstBlockNum: 11, LastBlockNum: 20}).Path())
+
+	for _, disablePrefetch := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disable_prefetch_%t", disablePrefetch), func(t *testing.T) {
+			origin.reset()
+
+			seekOpt := opt
+			seekOpt.DisablePrefetch = disablePrefetch
+			rdr, err := NewReader[int](seekOpt)
+			require.NoError(t, err)
+			defer rdr.Close()
+
+			read := func(n int) []uint64 {
+				var blockNums []uint64
+				for i := 0; i < n; i++ {
+					block, err := rdr.Read(context.Background())
+					require.NoError(t, err)
+					blockNums = append(blockNums, block.Number)
+				}
+				return blockNums
+			}
+			seek := func(blockNum uint64) {
+				require.NoError(t, rdr.Seek(context.Background(), blockNum))
+			}
+			opened := func() int {
+				origin.mu.Lock()
+				defer origin.mu.Unlock()
+				return origin.opened[secondFile]
+			}
+			// waitPrefetch waits for the prefetch of the second file to start, so the reader takes its data
+			waitPrefetch := func(opens int) {
+				if !disablePrefetch {
+					require.Eventually(t, func() bool { return opened() == opens }, time.Second, time.Millisecond)
+				}
+			}
+
+			require.Equal(t, []uint64{1, 2, 3, 4, 5}, read(5))
+
+			// backward within the first file
+			seek(3)
+			require.Equal(t, []uint64{3, 4}, read(2))
+
+			// the same block repeatedly
+			seek(3)
+			require.Equal(t, []uint64{3}, read(1))
+			seek(3)
+			seek(3)
+			require.Equal(t, []uint64{3, 4}, read(2))
+
+			// forward within the file and backward before reading
+			seek(8)
+			seek(6)
+			require.Equal(t, []uint64{6, 7, 8}, read(3))
+			seek(8)
+			waitPrefetch(1)
+			require.Equal(t, []uint64{8, 9, 10, 11}, read(4))
+
+			// backward within the second file
+			require.Equal(t, []uint64{12, 13, 14, 15}, read(4))
+			seek(12)
+			require.Equal(t, []uint64{12, 13}, read(2))
+			seek(11)
+			require.Equal(t, []uint64{11}, read(1))
+
+			// backward to the previous file and forward again
+			seek(9)
+			waitPrefetch(2)
+			require.Equal(t, []uint64{9, 10, 11}, read(3))
+			seek(25)
+			require.Equal(t, []uint64{25, 26}, read(2))
+			seek(21)
+			require.Equal(t, []uint64{21}, read(1))
+
+			// the prefetched second file is rewound without opening it again until the reader leaves it
+			if disablePrefetch {
+				require.Equal(t, 4, opened())
+			} else {
+				require.Equal(t, 2, opened())
+			}
+		})
+	}
+}
+
 func Test_ReaderStoragePathSuffix(t *testing.T) {
 	defer testTeardown(t)
 
@@ -464,3 +626,531 @@ func Test_ReaderPrefetch(t *testing.T) {
 
 	assert.NotNil(t, fileIndex.Files()[2].prefetchBuffer) // 5_8.wal file is prefetched
 }
+
+func TestReader_FollowTail(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	opt := Options{
+		Dataset:           Dataset{Path: testPath},
+		NewCompressor:     NewZSTDCompressor,
+		NewDecompressor:   NewZSTDDecompressor,
+		FileRollPolicy:    NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose:   true,
+		TailFlushInterval: time.Nanosecond,
+		FollowTail:        true,
+	}
+
+	w, err := NewWriter[int](opt)
+	require.NoError(t, err)
+
+	r, err := NewReader[int](opt)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var read []uint64
+	follow := func() {
+		for {
+			b, err := r.Read(context.Background())
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			require.NoError(t, err)
+			read = append(read, b.Number)
+		}
+	}
+
+	var expected []uint64
+	write := func(from, to uint64) {
+		for i := from; i <= to; i++ {
+			require.NoError(t, w.Write(context.Background(), Block[int]{Number: i, Data: int(i)}))
+			expected = append(expected, i)
+		}
+	}
+
+	// blocks are served from the tail before the file is rolled
+	write(1, 5)
+	follow()
+	require.Equal(t, expected, read)
+
+	// the roll lands, blocks already read from the tail are not duplicated
+	write(6, 13)
+	follow()
+	require.Equal(t, expected, read)
+
+	// tail doesn't include rolled blocks
+	write(14, 15)
+	require.NoError(t, w.Close(context.Background()))
+	follow()
+	require.Equal(t, expected, read)
+	require.Equal(t, 2, r.FileNum())
+	follow()
+	require.Equal(t, expected, read)
+}
+
+func TestReader_TailMode(t *testing.T) {
+	opt := Options{
+		Dataset:          Dataset{Path: t.TempDir()},
+		FileRollPolicy:   NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose:  true,
+		TailMode:         true,
+		TailPollInterval: 5 * time.Millisecond,
+	}
+
+	// the reader is opened before the dataset has any files
+	r, err := NewReader[int](opt)
+	require.NoError(t, err)
+	defer r.Close()
+
+	write := func(from, to uint64) chan error {
+		done := make(chan error, 1)
+		go func() {
+			w, err := NewWriter[int](opt)
+			if err != nil {
+				done <- err
+				return
+			}
+			for i := from; i <= to; i++ {
+				err = w.Write(context.Background(), Block[int]{Number: i, Data: int(i)})
+				if err != nil {
+					done <- err
+					return
+				}
+				if i%7 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			done <- w.Close(context.Background())
+		}()
+		return done
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// every block is read exactly once while the writer appends
+	written := write(1, 100)
+	var read []uint64
+	for len(read) < 100 {
+		b, err := r.Read(ctx)
+		require.NoError(t, err)
+		read = append(read, b.Number)
+	}
+	require.NoError(t, <-written)
+	for i, blockNum := range read {
+		require.Equal(t, uint64(i+1), blockNum)
+	}
+
+	// the read waits until the context is done
+	readCtx, readCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer readCancel()
+	_, err = r.Read(readCtx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the block is awaited without reading it
+	written = write(101, 110)
+	require.NoError(t, r.WaitForBlock(ctx, 110))
+	require.NoError(t, <-written)
+	require.Equal(t, uint64(100), r.BlockNum())
+
+	b, err := r.Read(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(101), b.Number)
+
+	t.Run("close", func(t *testing.T) {
+		r, err := NewReader[int](opt)
+		require.NoError(t, err)
+		require.NoError(t, r.Seek(context.Background(), 110))
+		_, err = r.Read(context.Background())
+		require.NoError(t, err)
+
+		errs := make(chan error, 2)
+		go func() {
+			_, err := r.Read(context.Background())
+			errs <- err
+		}()
+		go func() {
+			errs <- r.WaitForBlock(context.Background(), 111)
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+		require.NoError(t, r.Close())
+		require.ErrorIs(t, <-errs, ErrReaderClosed)
+		require.ErrorIs(t, <-errs, ErrReaderClosed)
+	})
+}
+
+func TestReader_ReadWithLocation(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	opt := Options{
+		Dataset:         Dataset{Path: testPath},
+		NewCompressor:   NewZSTDCompressor,
+		NewDecompressor: NewZSTDDecompressor,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+
+	w, err := NewWriter[int](opt)
+	require.NoError(t, err)
+	for i := 1; i <= 45; i++ {
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: uint64(i), Data: i * 10}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	r, err := NewReader[int](opt)
+	require.NoError(t, err)
+	defer r.Close()
+
+	// scan and record locations
+	blocks := make(map[uint64]Block[int])
+	locations := make(map[uint64]BlockLocation)
+	for {
+		b, loc, err := r.ReadWithLocation(context.Background())
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		require.NotNil(t, loc.File)
+		require.Equal(t, (b.Number-1)/10*10+1, loc.File.FirstBlockNum)
+		require.Equal(t, (b.Number-1)%10, loc.Ordinal)
+
+		blocks[b.Number] = b
+		locations[b.Number] = loc
+	}
+	require.Len(t, locations, 45)
+
+	// random access
+	for blockNum, loc := range locations {
+		b, err := r.ReadAtLocation(context.Background(), loc)
+		require.NoError(t, err)
+		require.Equal(t, blocks[blockNum], b)
+	}
+
+	// location within the file after seek
+	require.NoError(t, r.Seek(context.Background(), 25))
+	b, loc, err := r.ReadWithLocation(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, uint64(25), b.Number)
+	require.Equal(t, locations[25], loc)
+
+	b, loc, err = r.ReadWithLocation(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, uint64(26), b.Number)
+	require.Equal(t, locations[26], loc)
+
+	// location out of the file
+	_, err = r.ReadAtLocation(context.Background(), BlockLocation{File: locations[45].File, Ordinal: 5})
+	require.ErrorIs(t, err, ErrBlockLocationNotFound)
+	_, err = r.ReadAtLocation(context.Background(), BlockLocation{})
+	require.ErrorIs(t, err, ErrBlockLocationNotFound)
+}
+
+func TestRangeReader(t *testing.T) {
+	fs := gostorage.NewMemoryFS()
+	opt := Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      fs,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+
+	// files 1-10, 11-20, 21-30, 31-50 with blocks 41-50 and 51-60
+	w, err := NewWriter[int](opt)
+	require.NoError(t, err)
+	for blockNum := uint64(1); blockNum <= 60; blockNum++ {
+		if blockNum > 30 && blockNum <= 40 {
+			continue
+		}
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: blockNum, Data: int(blockNum)}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	// readRange returns the blocks of the range and the files opened by the reader
+	readRange := func(t *testing.T, from, to uint64) ([]uint64, []string) {
+		rangeOpt := opt
+		rangeOpt.EnableAccounting = true
+		rangeOpt.Accounting = storage.NewAccounting(func(objectPath string) string { return path.Base(objectPath) })
+
+		r, err := NewRangeReader[int](rangeOpt, from, to)
+		require.NoError(t, err)
+
+		var blockNums []uint64
+		for {
+			b, err := r.Read(context.Background())
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			blockNums = append(blockNums, b.Number)
+		}
+
+		// the reader keeps returning io.EOF
+		_, err = r.Read(context.Background())
+		require.Equal(t, io.EOF, err)
+		require.NoError(t, r.Close())
+
+		var opened []string
+		for name, stats := range r.Accounting().Snapshot() {
+			if ClassifyObjectPath(name) == AccountingClassData && stats.Opens > 0 {
+				opened = append(opened, name)
+			}
+		}
+		slices.Sort(opened)
+		return blockNums, opened
+	}
+
+	blockRange := func(from, to uint64) []uint64 {
+		var blockNums []uint64
+		for blockNum := from; blockNum <= to; blockNum++ {
+			blockNums = append(blockNums, blockNum)
+		}
+		return blockNums
+	}
+
+	fileName := func(from, to uint64) string {
+		return path.Base((&File{FirstBlockNum: from, LastBlockNum: to}).Path())
+	}
+
+	t.Run("within_files", func(t *testing.T) {
+		blockNums, opened := readRange(t, 15, 23)
+		require.Equal(t, blockRange(15, 23), blockNums)
+		require.ElementsMatch(t, []string{fileName(11, 20), fileName(21, 30)}, opened)
+	})
+
+	t.Run("file_boundaries", func(t *testing.T) {
+		blockNums, opened := readRange(t, 11, 20)
+		require.Equal(t, blockRange(11, 20), blockNums)
+		require.ElementsMatch(t, []string{fileName(11, 20)}, opened)
+	})
+
+	t.Run("across_gap", func(t *testing.T) {
+		blockNums, opened := readRange(t, 28, 45)
+		require.Equal(t, append(blockRange(28, 30), blockRange(41, 45)...), blockNums)
+		require.ElementsMatch(t, []string{fileName(21, 30), fileName(31, 50)}, opened)
+	})
+
+	t.Run("within_gap", func(t *testing.T) {
+		blockNums, opened := readRange(t, 32, 38)
+		require.Empty(t, blockNums)
+		require.ElementsMatch(t, []string{fileName(31, 50)}, opened)
+	})
+
+	t.Run("last_file", func(t *testing.T) {
+		blockNums, opened := readRange(t, 55, 80)
+		require.Equal(t, blockRange(55, 60), blockNums)
+		require.ElementsMatch(t, []string{fileName(51, 60)}, opened)
+	})
+
+	t.Run("past_last_file", func(t *testing.T) {
+		blockNums, opened := readRange(t, 70, 80)
+		require.Empty(t, blockNums)
+		require.Empty(t, opened)
+	})
+
+	t.Run("single_block", func(t *testing.T) {
+		blockNums, _ := readRange(t, 1, 1)
+		require.Equal(t, []uint64{1}, blockNums)
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		r, err := NewRangeReader[int](opt, 5, 12)
+		require.NoError(t, err)
+		defer r.Close()
+
+		for blockNum := uint64(5); blockNum <= 12; blockNum++ {
+			b, err := r.Read(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, blockNum, b.Number)
+		}
+		_, err = r.Read(context.Background())
+		require.Equal(t, io.EOF, err)
+
+		require.NoError(t, r.Seek(context.Background(), 7))
+		b, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, uint64(7), b.Number)
+	})
+
+	t.Run("invalid_range", func(t *testing.T) {
+		_, err := NewRangeReader[int](opt, 10, 5)
+		require.Error(t, err)
+	})
+}
+
+func TestReader_OpenExisting(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testRoot)
+	}()
+
+	testCases := []struct {
+		name        string
+		fs          storage.FS
+		datasetPath string
+		// dir is the local directory of the dataset, empty for the memory file system
+		dir string
+	}{
+		{name: "local", fs: local.NewLocalFS(""), datasetPath: path.Join(testRoot, "open-existing"), dir: path.Join(testRoot, "open-existing")},
+		{name: "prefix", fs: storage.NewPrefixWrapper(local.NewLocalFS(""), testRoot+"/"), datasetPath: "open-existing-prefix", dir: path.Join(testRoot, "open-existing-prefix")},
+		{name: "memory", fs: gostorage.NewMemoryFS(), datasetPath: "open-existing"},
+		{name: "ethwal_memory", fs: memory.NewMemoryFS(), datasetPath: "open-existing"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opt := Options{
+				Dataset:         Dataset{Path: tc.datasetPath},
+				FileSystem:      tc.fs,
+				FileRollOnClose: true,
+				OpenExisting:    true,
+			}
+
+			_, err := NewReader[int](opt)
+			require.ErrorIs(t, err, ErrDatasetNotExist)
+
+			_, err = NewWriter[int](opt)
+			require.ErrorIs(t, err, ErrDatasetNotExist)
+
+			// the missing dataset directory isn't created
+			if tc.dir != "" {
+				_, err = os.Stat(tc.dir)
+				require.True(t, os.IsNotExist(err))
+			}
+
+			// the dataset written without the flag is opened
+			writeOpt := opt
+			writeOpt.OpenExisting = false
+			if tc.dir != "" {
+				require.NoError(t, os.MkdirAll(tc.dir, 0755))
+			}
+			w, err := NewWriter[int](writeOpt)
+			require.NoError(t, err)
+			require.NoError(t, w.Write(context.Background(), Block[int]{Number: 1, Data: 1}))
+			require.NoError(t, w.Close(context.Background()))
+
+			r, err := NewReader[int](opt)
+			require.NoError(t, err)
+			b, err := r.Read(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), b.Number)
+			require.NoError(t, r.Close())
+
+			w, err = NewWriter[int](opt)
+			require.NoError(t, err)
+			require.NoError(t, w.Close(context.Background()))
+		})
+	}
+}
+
+func TestReader_FileError(t *testing.T) {
+	ctx := context.Background()
+
+	// the files 1-3, 4-6 and 7-9
+	setup := func(t *testing.T) (Options, storage.FS) {
+		opt := Options{Dataset: Dataset{Path: "ethwal"}, FileSystem: memory.NewMemoryFS()}
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+		for blockNum := uint64(1); blockNum <= 9; blockNum++ {
+			require.NoError(t, w.Write(ctx, Block[int]{Number: blockNum, Data: int(blockNum)}))
+			if blockNum%3 == 0 {
+				require.NoError(t, w.RollFile(ctx))
+			}
+		}
+		require.NoError(t, w.Close(ctx))
+		return opt, storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath())
+	}
+
+	writeFile := func(t *testing.T, fs storage.FS, path string, data []byte) {
+		wr, err := fs.Create(ctx, path, nil)
+		require.NoError(t, err)
+		_, err = wr.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, wr.Close())
+	}
+
+	readFile := func(t *testing.T, fs storage.FS, path string) []byte {
+		rdr, err := fs.Open(ctx, path, nil)
+		require.NoError(t, err)
+		defer rdr.Close()
+		data, err := io.ReadAll(rdr)
+		require.NoError(t, err)
+		return data
+	}
+
+	// readAll reads the blocks up to the error, it returns the block numbers read
+	readAll := func(t *testing.T, opt Options) ([]uint64, error) {
+		r, err := NewReader[int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		var blockNums []uint64
+		for {
+			b, err := r.Read(ctx)
+			if err != nil {
+				return blockNums, err
+			}
+			blockNums = append(blockNums, b.Number)
+		}
+	}
+
+	middle := &File{FirstBlockNum: 4, LastBlockNum: 6}
+
+	t.Run("decode", func(t *testing.T) {
+		opt, fs := setup(t)
+		writeFile(t, fs, middle.Path(), []byte{0xff, 0xff})
+
+		blockNums, err := readAll(t, opt)
+		require.Equal(t, blockRange(1, 3), blockNums)
+
+		var fileErr *FileError
+		require.ErrorAs(t, err, &fileErr)
+		require.Equal(t, middle.Path(), fileErr.Path)
+		require.Equal(t, uint64(4), fileErr.FirstBlockNum)
+		require.Equal(t, uint64(6), fileErr.LastBlockNum)
+		require.Contains(t, err.Error(), "file[4-6] "+middle.Path())
+	})
+
+	t.Run("legacy_path", func(t *testing.T) {
+		opt, fs := setup(t)
+		require.NoError(t, fs.Delete(ctx, middle.Path()))
+		writeFile(t, fs, middle.legacyPath(), []byte{0xff, 0xff})
+
+		_, err := readAll(t, opt)
+		var fileErr *FileError
+		require.ErrorAs(t, err, &fileErr)
+		require.Equal(t, middle.legacyPath(), fileErr.Path)
+		require.Equal(t, uint64(4), fileErr.FirstBlockNum)
+	})
+
+	t.Run("out_of_range", func(t *testing.T) {
+		opt, fs := setup(t)
+		// the middle file has the blocks of the last one
+		writeFile(t, fs, middle.Path(), readFile(t, fs, (&File{FirstBlockNum: 7, LastBlockNum: 9}).Path()))
+
+		_, err := readAll(t, opt)
+		var fileErr *FileError
+		require.ErrorAs(t, err, &fileErr)
+		require.Equal(t, middle.Path(), fileErr.Path)
+		require.Equal(t, uint64(4), fileErr.FirstBlockNum)
+		require.Equal(t, uint64(6), fileErr.LastBlockNum)
+		require.Contains(t, err.Error(), "block number 7 is out of file block 4-6 range")
+	})
+
+	t.Run("read_at_location", func(t *testing.T) {
+		opt, fs := setup(t)
+		writeFile(t, fs, middle.Path(), []byte{0xff, 0xff})
+
+		r, err := NewReader[int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		_, err = r.ReadAtLocation(ctx, BlockLocation{File: middle, Ordinal: 1})
+		var fileErr *FileError
+		require.ErrorAs(t, err, &fileErr)
+		require.Equal(t, middle.Path(), fileErr.Path)
+	})
+}
@@ -2,19 +2,45 @@ package ethwal
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"reflect"
+	"slices"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
 )
 
+var ErrProjectionRequired = fmt.Errorf("filter projection required")
+
+// Projection returns the block data reduced to the positions matched by the filter, e.g. the logs and their
+// topics of the nested positions.
+type Projection[T any] func(data T, positions []Position) (T, error)
+
 type readerWithFilter[T any] struct {
 	lastBlockNum uint64
+	blockRead    bool
 	reader       Reader[T]
 	filter       Filter
-	iterator     FilterIterator
+	// bitmap is the evaluated filter, it's evaluated again once the indexes advanced past bitmapBlockNum, the
+	// last block number indexed when it was evaluated
+	bitmap         *roaring64.Bitmap
+	bitmapBlockNum uint64
+	iterator       FilterIterator
+	constraint     BlockIterator
+
+	positionFormat PositionFormat
+	projection     Projection[T]
+
+	fileIndex *FileIndex
+	stats     ReaderStats
 }
 
 var _ Reader[any] = (*readerWithFilter[any])(nil)
 
+// NewReaderWithFilter creates the reader that reads only the blocks matched by the filter. The slice block
+// data is reduced to the elements at the ordinal positions matched by the filter, the other block data
+// needs the projection, see NewReaderWithFilterProjection.
 func NewReaderWithFilter[T any](reader Reader[T], filter Filter) (Reader[T], error) {
 	return &readerWithFilter[T]{
 		reader: reader,
@@ -22,6 +48,29 @@ func NewReaderWithFilter[T any](reader Reader[T], filter Filter) (Reader[T], err
 	}, nil
 }
 
+// NewReaderWithFilterProjection creates the reader that reads only the blocks matched by the filter and
+// reduces their data with the projection. The positions are decoded with the format of the filtered indexes.
+func NewReaderWithFilterProjection[T any](reader Reader[T], filter Filter, format PositionFormat, projection Projection[T]) (Reader[T], error) {
+	return &readerWithFilter[T]{
+		reader:         reader,
+		filter:         filter,
+		positionFormat: format,
+		projection:     projection,
+	}, nil
+}
+
+// NewReaderWithFilterConstraint creates the reader that reads only the blocks matched by the filter
+// that are also present in the constraint, e.g. an externally supplied allow-list. The constraint is
+// joined with the filter result during iteration. It's consumed forward, so seeking backwards doesn't
+// return the blocks the constraint has already advanced past.
+func NewReaderWithFilterConstraint[T any](reader Reader[T], filter Filter, constraint BlockIterator) (Reader[T], error) {
+	return &readerWithFilter[T]{
+		reader:     reader,
+		filter:     filter,
+		constraint: constraint,
+	}, nil
+}
+
 func (c *readerWithFilter[T]) FileNum() int {
 	return c.reader.FileNum()
 }
@@ -30,40 +79,115 @@ func (c *readerWithFilter[T]) FileIndex() *FileIndex {
 	return c.reader.FileIndex()
 }
 
+// Seek moves the reader to the first block matched by the filter from blockNum, the filter is evaluated again
+// if its indexes advanced since, or if it isn't built by the filter builder, otherwise the seek iterates its
+// result again. The seek past the last matched block makes Read return io.EOF.
 func (c *readerWithFilter[T]) Seek(ctx context.Context, blockNum uint64) error {
-	iter := c.filter.Eval(ctx)
-	for iter.HasNext() {
-		nextBlock, _ := iter.Peek()
-		if nextBlock >= blockNum {
-			break
-		}
-		iter.Next()
+	if _, ok := c.filter.(indexedFilter); !ok || c.indexesAdvanced(ctx) {
+		c.bitmap = nil
 	}
+	c.fileIndex = nil
 
+	iter := c.newIterator(ctx)
+	iter.AdvanceIfNeeded(blockNum)
+	if c.constraint != nil {
+		c.constraint.AdvanceIfNeeded(blockNum)
+	}
 	c.iterator = iter
+
+	// NoBlockNum for block 0, like the reader
+	c.lastBlockNum = blockNum - 1
+	c.blockRead = blockNum > 0
 	return nil
 }
 
 func (c *readerWithFilter[T]) BlockNum() uint64 {
+	if c.lastBlockNum == NoBlockNum {
+		return 0
+	}
 	return c.lastBlockNum
 }
 
+// newIterator returns the iterator of the evaluated filter, the filter is evaluated if it isn't cached.
+func (c *readerWithFilter[T]) newIterator(ctx context.Context) FilterIterator {
+	if c.bitmap == nil {
+		// the last block indexed is read first, the bitmap covers at least its blocks
+		c.bitmapBlockNum = 0
+		if f, ok := c.filter.(indexedFilter); ok {
+			c.bitmapBlockNum, _ = f.lastBlockNumIndexed(ctx)
+		}
+		c.bitmap = c.filter.Eval(ctx).Bitmap()
+	}
+	return newFilterIterator(c.bitmap)
+}
+
+// indexesAdvanced reports whether the indexes of the filter advanced past the evaluated bitmap, the filter not
+// built by the filter builder never advances.
+func (c *readerWithFilter[T]) indexesAdvanced(ctx context.Context) bool {
+	f, ok := c.filter.(indexedFilter)
+	if !ok {
+		return false
+	}
+
+	// the indexes that failed to read are retried by the next call
+	lastBlockNum, err := f.lastBlockNumIndexed(ctx)
+	return err == nil && lastBlockNum > c.bitmapBlockNum
+}
+
+// refreshIterator evaluates the filter again once the indexes advanced past the evaluated bitmap, the iterator
+// continues after the last read block. It reports whether the iterator has more blocks.
+func (c *readerWithFilter[T]) refreshIterator(ctx context.Context) bool {
+	if !c.indexesAdvanced(ctx) {
+		return false
+	}
+
+	c.bitmap = nil
+	c.iterator = c.newIterator(ctx)
+	if c.blockRead {
+		c.iterator.AdvanceIfNeeded(c.lastBlockNum + 1)
+	}
+	return c.iterator.HasNext()
+}
+
+func (c *readerWithFilter[T]) Options() Options {
+	return c.reader.Options()
+}
+
+func (c *readerWithFilter[T]) Accounting() *storage.Accounting {
+	return c.reader.Accounting()
+}
+
+func (c *readerWithFilter[T]) Stats() ReaderStats {
+	stats := c.stats
+	stats.CorruptFiles = c.reader.Stats().CorruptFiles
+	return stats
+}
+
 func (c *readerWithFilter[T]) Read(ctx context.Context) (Block[T], error) {
+	block, _, err := c.ReadWithLocation(ctx)
+	return block, err
+}
+
+// ReadAtLocation reads the block at the location from the underlying reader, the block data is not filtered.
+func (c *readerWithFilter[T]) ReadAtLocation(ctx context.Context, loc BlockLocation) (Block[T], error) {
+	return c.reader.ReadAtLocation(ctx, loc)
+}
+
+func (c *readerWithFilter[T]) ReadWithLocation(ctx context.Context) (Block[T], BlockLocation, error) {
 	// Lazy init iterator
 	if c.iterator == nil {
-		c.iterator = c.filter.Eval(ctx)
+		c.iterator = c.newIterator(ctx)
 	}
 
-	// Check if there are no more blocks to read
-	if !c.iterator.HasNext() {
-		return Block[T]{}, io.EOF
+	// Check if there are no more blocks to read, including the blocks indexed since the filter was evaluated
+	if (!c.iterator.HasNext() && !c.refreshIterator(ctx)) || !c.alignWithConstraint() {
+		return Block[T]{}, BlockLocation{}, io.EOF
 	}
 
 	// Collect all data indexes for the block
 	blockNum, dataIndex := c.iterator.Next()
 	dataIndexes := []uint16{dataIndex}
 
-	doFilter := dataIndex != IndexAllDataIndexes
 	for c.iterator.HasNext() {
 		nextBlockNum, nextDataIndex := c.iterator.Peek()
 		if blockNum != nextBlockNum {
@@ -77,25 +201,112 @@ func (c *readerWithFilter[T]) Read(ctx context.Context) (Block[T], error) {
 	// Seek to the block
 	err := c.reader.Seek(ctx, blockNum)
 	if err != nil {
-		return Block[T]{}, err
+		return Block[T]{}, BlockLocation{}, err
 	}
 
-	block, err := c.reader.Read(ctx)
+	block, loc, err := c.reader.ReadWithLocation(ctx)
 	if err != nil {
-		return Block[T]{}, err
+		return Block[T]{}, BlockLocation{}, err
+	}
+
+	// Filter the block data, unless the whole block is matched
+	if !slices.Contains(dataIndexes, IndexAllDataIndexes) {
+		block.Data, err = c.project(block.Data, dataIndexes)
+		if err != nil {
+			return Block[T]{}, BlockLocation{}, c.reader.ID().wrapError(fmt.Errorf("block %d: %w", blockNum, err))
+		}
 	}
 
-	// Filter the block data
-	if dType := reflect.TypeOf(block.Data); doFilter && (dType.Kind() == reflect.Slice || dType.Kind() == reflect.Array) {
-		newData := reflect.Indirect(reflect.New(dType))
-		for _, dataIndex := range dataIndexes {
-			newData = reflect.Append(newData, reflect.ValueOf(block.Data).Index(int(dataIndex)))
+	c.onBlockRead(blockNum)
+	return block, loc, nil
+}
+
+// project reduces the block data to the positions with the projection, or to the elements of the slice data
+// at the ordinal positions.
+func (c *readerWithFilter[T]) project(data T, dataIndexes []uint16) (T, error) {
+	if c.projection != nil {
+		decode := c.positionFormat.Decode
+		if decode == nil {
+			decode = OrdinalPositions.Decode
+		}
+
+		positions := make([]Position, len(dataIndexes))
+		for i, dataIndex := range dataIndexes {
+			positions[i] = decode(dataIndex)
+		}
+		return c.projection(data, positions)
+	}
+
+	dType := reflect.TypeOf(data)
+	if dType == nil || (dType.Kind() != reflect.Slice && dType.Kind() != reflect.Array) {
+		return data, fmt.Errorf("%w: block data %T isn't a slice", ErrProjectionRequired, data)
+	}
+
+	newData := reflect.Indirect(reflect.New(dType))
+	for _, dataIndex := range dataIndexes {
+		newData = reflect.Append(newData, reflect.ValueOf(data).Index(int(dataIndex)))
+	}
+	return newData.Interface().(T), nil
+}
+
+// alignWithConstraint advances the filter iterator and the constraint to the next block present in both.
+func (c *readerWithFilter[T]) alignWithConstraint() bool {
+	if c.constraint == nil {
+		return true
+	}
+
+	for c.iterator.HasNext() {
+		blockNum, _ := c.iterator.Peek()
+		c.constraint.AdvanceIfNeeded(blockNum)
+		if !c.constraint.HasNext() {
+			return false
+		}
+
+		allowedBlockNum := c.constraint.Peek()
+		if allowedBlockNum == blockNum {
+			return true
+		}
+		c.iterator.AdvanceIfNeeded(allowedBlockNum)
+	}
+	return false
+}
+
+// onBlockRead updates the last block number and reports gaps in the dataset skipped by the filter.
+func (c *readerWithFilter[T]) onBlockRead(blockNum uint64) {
+	if c.blockRead && blockNum > c.lastBlockNum+1 {
+		// the file index is loaded again once it doesn't list the file of the block, rolled after it was loaded
+		if c.fileIndex == nil || !c.fileIndex.Contains(blockNum) {
+			c.fileIndex = c.reader.FileIndex()
+		}
+
+		onGap := c.reader.Options().OnGap
+		for _, gap := range c.fileIndex.gaps(c.lastBlockNum, blockNum) {
+			c.stats.Gaps++
+			c.stats.GapBlocks += gap[1] - gap[0] - 1
+			if onGap != nil {
+				onGap(gap[0], gap[1])
+			}
 		}
-		block.Data = newData.Interface().(T)
 	}
 
 	c.lastBlockNum = blockNum
-	return block, nil
+	c.blockRead = true
+}
+
+func (c *readerWithFilter[T]) BlockExamined(ctx context.Context, blockNum uint64) (bool, error) {
+	return c.reader.BlockExamined(ctx, blockNum)
+}
+
+func (c *readerWithFilter[T]) BlockRangeExamined(ctx context.Context, from, to uint64) (bool, error) {
+	return c.reader.BlockRangeExamined(ctx, from, to)
+}
+
+func (c *readerWithFilter[T]) WaitForBlock(ctx context.Context, blockNum uint64) error {
+	return c.reader.WaitForBlock(ctx, blockNum)
+}
+
+func (c *readerWithFilter[T]) ID() Instance {
+	return c.reader.ID()
 }
 
 func (c *readerWithFilter[T]) Close() error {
@@ -7,6 +7,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/0xsequence/ethwal/storage/memory"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -121,3 +122,433 @@ func TestReaderWithFilter(t *testing.T) {
 
 	_ = r.Close()
 }
+
+func TestReaderWithFilter_NotBlockRange(t *testing.T) {
+	indexes := setupReaderWithFilterTest(t)
+	defer teardownReaderWithFilterTest()
+
+	r, err := NewReader[[]int](Options{
+		Dataset:         Dataset{Path: testPath},
+		NewDecompressor: NewZSTDDecompressor,
+		NewDecoder:      NewCBORDecoder,
+	})
+	require.NoError(t, err)
+
+	fb, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset: Dataset{Path: testPath},
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+
+	r, err = NewReaderWithFilter[[]int](r, fb.And(fb.Not(fb.Eq("all", "121")), fb.BlockRange(51, 55)))
+	require.NoError(t, err)
+
+	var blockNums []uint64
+	for {
+		block, err := r.Read(context.Background())
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		blockNums = append(blockNums, block.Number)
+
+		// the data is trimmed to the values other than 121
+		var expected []int
+		for _, data := range generateMixedIntBlocks()[block.Number-1].Data {
+			if data != 121 {
+				expected = append(expected, data)
+			}
+		}
+		require.Equal(t, expected, block.Data)
+	}
+	require.Equal(t, []uint64{51, 52, 53, 54, 55}, blockNums)
+	require.NoError(t, r.Close())
+}
+
+// evalCountingFilter counts the evaluations of the filter.
+type evalCountingFilter struct {
+	Filter
+	evals int
+}
+
+func (f *evalCountingFilter) Eval(ctx context.Context) FilterIterator {
+	f.evals++
+	return f.Filter.Eval(ctx)
+}
+
+func (f *evalCountingFilter) lastBlockNumIndexed(ctx context.Context) (uint64, error) {
+	return f.Filter.(indexedFilter).lastBlockNumIndexed(ctx)
+}
+
+func TestReaderWithFilter_Seek(t *testing.T) {
+	indexes := setupReaderWithFilterTest(t)
+	defer teardownReaderWithFilterTest()
+
+	fb, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset: Dataset{Path: testPath},
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+
+	// the blocks 21-40 and 51-70
+	filter := &evalCountingFilter{Filter: fb.Eq("only_odd", "true")}
+
+	r, err := NewReader[[]int](Options{
+		Dataset:         Dataset{Path: testPath},
+		NewDecompressor: NewZSTDDecompressor,
+		NewDecoder:      NewCBORDecoder,
+	})
+	require.NoError(t, err)
+
+	r, err = NewReaderWithFilter[[]int](r, filter)
+	require.NoError(t, err)
+	defer r.Close()
+
+	requireRead := func(t *testing.T, blockNum uint64) {
+		block, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, blockNum, block.Number)
+		require.Equal(t, blockNum, r.BlockNum())
+	}
+
+	t.Run("seek_forward", func(t *testing.T) {
+		require.NoError(t, r.Seek(context.Background(), 30))
+		require.Equal(t, uint64(29), r.BlockNum())
+		requireRead(t, 30)
+		requireRead(t, 31)
+
+		// the blocks between aren't matched
+		require.NoError(t, r.Seek(context.Background(), 41))
+		require.Equal(t, uint64(40), r.BlockNum())
+		requireRead(t, 51)
+	})
+
+	t.Run("seek_backward", func(t *testing.T) {
+		requireRead(t, 52)
+		require.NoError(t, r.Seek(context.Background(), 22))
+		require.Equal(t, uint64(21), r.BlockNum())
+		requireRead(t, 22)
+
+		require.NoError(t, r.Seek(context.Background(), 0))
+		require.Equal(t, uint64(0), r.BlockNum())
+		requireRead(t, 21)
+	})
+
+	t.Run("seek_past_end", func(t *testing.T) {
+		for _, blockNum := range []uint64{71, 1000, MaxSupportedBlockNum + 1, NoBlockNum} {
+			require.NoError(t, r.Seek(context.Background(), blockNum))
+			require.Equal(t, blockNum-1, r.BlockNum())
+			_, err := r.Read(context.Background())
+			require.ErrorIs(t, err, io.EOF)
+			_, err = r.Read(context.Background())
+			require.ErrorIs(t, err, io.EOF)
+		}
+	})
+
+	t.Run("interleaved", func(t *testing.T) {
+		require.NoError(t, r.Seek(context.Background(), 70))
+		requireRead(t, 70)
+		_, err := r.Read(context.Background())
+		require.ErrorIs(t, err, io.EOF)
+
+		for _, blockNums := range [][2]uint64{{25, 26}, {60, 61}, {40, 51}, {21, 22}} {
+			require.NoError(t, r.Seek(context.Background(), blockNums[0]))
+			requireRead(t, blockNums[0])
+			requireRead(t, blockNums[1])
+		}
+	})
+
+	// the filter is evaluated once
+	require.Equal(t, 1, filter.evals)
+}
+
+func TestReaderWithFilter_OnGap(t *testing.T) {
+	testSetup(t, NewCBOREncoder, nil)
+	defer testTeardown(t)
+
+	dataset := Dataset{
+		Name:    "int-wal",
+		Path:    testPath,
+		Version: defaultDatasetVersion,
+	}
+
+	indexes := Indexes[int]{
+		"block": NewIndex[int]("block", func(block Block[int]) (bool, map[IndexedValue][]Position, error) {
+			if block.Number != 2 && block.Number != 12 {
+				return false, nil, nil
+			}
+			return true, map[IndexedValue][]Position{"selected": Ordinals(IndexAllDataIndexes)}, nil
+		}),
+	}
+
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[int]{
+		Dataset: dataset,
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+
+	r, err := NewReader[int](Options{
+		Dataset:    dataset,
+		NewDecoder: NewCBORDecoder,
+	})
+	require.NoError(t, err)
+
+	for blk, err := r.Read(context.Background()); err == nil; blk, err = r.Read(context.Background()) {
+		require.NoError(t, indexer.Index(context.Background(), blk))
+	}
+	require.NoError(t, indexer.Flush(context.Background()))
+	require.NoError(t, r.Close())
+
+	var gaps [][2]uint64
+	r, err = NewReader[int](Options{
+		Dataset:    dataset,
+		NewDecoder: NewCBORDecoder,
+		OnGap: func(fromExclusive, toExclusive uint64) {
+			gaps = append(gaps, [2]uint64{fromExclusive, toExclusive})
+		},
+	})
+	require.NoError(t, err)
+
+	fb, err := NewFilterBuilder(FilterBuilderOptions[int]{
+		Dataset: dataset,
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+
+	r, err = NewReaderWithFilter[int](r, fb.Eq("block", "selected"))
+	require.NoError(t, err)
+
+	var blockNums []uint64
+	for {
+		block, err := r.Read(context.Background())
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		blockNums = append(blockNums, block.Number)
+	}
+
+	require.Equal(t, []uint64{2, 12}, blockNums)
+	require.Equal(t, [][2]uint64{{8, 11}}, gaps)
+	require.Equal(t, ReaderStats{Gaps: 1, GapBlocks: 2}, r.Stats())
+	require.NoError(t, r.Close())
+}
+
+func TestReaderWithFilter_IndexAdvanced(t *testing.T) {
+	ctx := context.Background()
+	fs := memory.NewMemoryFS()
+	dataset := Dataset{Path: "ethwal"}
+
+	indexes := Indexes[int]{
+		"even": NewIndex[int]("even", func(block Block[int]) (bool, map[IndexedValue][]Position, error) {
+			if block.Number%2 != 0 {
+				return true, nil, nil
+			}
+			return true, map[IndexedValue][]Position{"true": Ordinals(IndexAllDataIndexes)}, nil
+		}),
+	}
+
+	opt := Options{
+		Dataset:         dataset,
+		FileSystem:      fs,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+	indexer, err := NewIndexer(ctx, IndexerOptions[int]{Dataset: dataset, FileSystem: fs, Indexes: indexes})
+	require.NoError(t, err)
+	w, err := NewWriter[int](opt)
+	require.NoError(t, err)
+	wi, err := NewWriterWithIndexer(w, indexer)
+	require.NoError(t, err)
+	defer wi.Close(ctx)
+
+	write := func(from, to uint64) {
+		for blockNum := from; blockNum <= to; blockNum++ {
+			require.NoError(t, wi.Write(ctx, Block[int]{Number: blockNum, Data: int(blockNum)}))
+		}
+		require.NoError(t, wi.RollFile(ctx))
+	}
+	write(1, 10)
+
+	var gaps [][2]uint64
+	// the reader following the tail loads the files rolled after it was opened
+	r, err := NewReader[int](Options{
+		Dataset:    dataset,
+		FileSystem: fs,
+		FollowTail: true,
+		OnGap: func(fromExclusive, toExclusive uint64) {
+			gaps = append(gaps, [2]uint64{fromExclusive, toExclusive})
+		},
+	})
+	require.NoError(t, err)
+	fb, err := NewFilterBuilder(FilterBuilderOptions[int]{Dataset: dataset, FileSystem: fs, Indexes: indexes})
+	require.NoError(t, err)
+	r, err = NewReaderWithFilter[int](r, fb.Eq("even", "true"))
+	require.NoError(t, err)
+	defer r.Close()
+
+	readAll := func() []uint64 {
+		var blockNums []uint64
+		for {
+			block, err := r.Read(ctx)
+			if errors.Is(err, io.EOF) {
+				return blockNums
+			}
+			require.NoError(t, err)
+			blockNums = append(blockNums, block.Number)
+		}
+	}
+	require.Equal(t, []uint64{2, 4, 6, 8, 10}, readAll())
+
+	// the blocks indexed after the first read are matched, the files rolled after it aren't reported as the gaps
+	write(11, 14)
+	write(15, 24)
+	require.Equal(t, []uint64{12, 14, 16, 18, 20, 22, 24}, readAll())
+	require.Empty(t, gaps)
+
+	// the seek evaluates the filter indexed since the last read
+	write(25, 26)
+	require.NoError(t, r.Seek(ctx, 23))
+	require.Equal(t, []uint64{24, 26}, readAll())
+}
+
+func TestReaderWithFilter_Close(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	w, err := NewWriter[int](Options{
+		Dataset:         Dataset{Path: testPath},
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(2),
+		FileRollOnClose: true,
+	})
+	require.NoError(t, err)
+	for i := uint64(1); i <= 6; i++ {
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: i}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	r, err := NewReader[int](Options{Dataset: Dataset{Path: testPath}})
+	require.NoError(t, err)
+
+	rf, err := NewReaderWithFilter(r, &filter{})
+	require.NoError(t, err)
+
+	// read the first block, so that the file is opened and the next one is prefetched
+	_, err = r.Read(context.Background())
+	require.NoError(t, err)
+	prefetchedFile := r.(*reader[int]).fileIndex.At(1)
+	require.NoError(t, prefetchedFile.Prefetch(context.Background(), r.(*reader[int]).fs))
+	require.NotNil(t, prefetchedFile.prefetchBuffer)
+
+	require.NoError(t, rf.Close())
+	require.Nil(t, r.(*reader[int]).closer)
+	require.Nil(t, prefetchedFile.prefetchBuffer)
+
+	// double close is safe
+	require.NoError(t, rf.Close())
+	require.NoError(t, r.Close())
+}
+
+func TestReaderWithFilterConstraint(t *testing.T) {
+	indexes := setupReaderWithFilterTest(t)
+	defer teardownReaderWithFilterTest()
+
+	fb, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset: Dataset{
+			Path: testPath,
+		},
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+
+	newReader := func(t *testing.T, constraint BlockIterator) Reader[[]int] {
+		r, err := NewReader[[]int](Options{
+			Dataset: Dataset{
+				Path: testPath,
+			},
+			NewDecompressor: NewZSTDDecompressor,
+			NewDecoder:      NewCBORDecoder,
+		})
+		require.NoError(t, err)
+
+		r, err = NewReaderWithFilterConstraint[[]int](r, fb.Eq("only_even", "true"), constraint)
+		require.NoError(t, err)
+		return r
+	}
+
+	readBlockNums := func(t *testing.T, r Reader[[]int]) []uint64 {
+		var blockNums []uint64
+		for {
+			block, err := r.Read(context.Background())
+			if errors.Is(err, io.EOF) {
+				return blockNums
+			}
+			require.NoError(t, err)
+			blockNums = append(blockNums, block.Number)
+		}
+	}
+
+	t.Run("read", func(t *testing.T) {
+		r := newReader(t, NewSliceBlockIterator([]uint64{3, 7, 15, 30, 100}))
+		defer r.Close()
+
+		require.Equal(t, []uint64{3, 7, 15}, readBlockNums(t, r))
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		r := newReader(t, NewSliceBlockIterator([]uint64{3, 7, 15, 30, 100}))
+		defer r.Close()
+
+		require.NoError(t, r.Seek(context.Background(), 5))
+		require.Equal(t, []uint64{7, 15}, readBlockNums(t, r))
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		r := newReader(t, NewSliceBlockIterator(nil))
+		defer r.Close()
+
+		require.Empty(t, readBlockNums(t, r))
+	})
+}
+
+func TestReaderWithFilter_ReadWithLocation(t *testing.T) {
+	indexes := setupReaderWithFilterTest(t)
+	defer teardownReaderWithFilterTest()
+
+	r, err := NewReader[[]int](Options{
+		Dataset: Dataset{
+			Path: testPath,
+		},
+		NewDecompressor: NewZSTDDecompressor,
+		NewDecoder:      NewCBORDecoder,
+	})
+	require.NoError(t, err)
+
+	fb, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset: Dataset{
+			Path: testPath,
+		},
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+
+	r, err = NewReaderWithFilter[[]int](r, fb.Eq("only_odd", "true"))
+	require.NoError(t, err)
+	defer r.Close()
+
+	var blocksRead int
+	for {
+		block, loc, err := r.ReadWithLocation(context.Background())
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		blocksRead++
+
+		fetched, err := r.ReadAtLocation(context.Background(), loc)
+		require.NoError(t, err)
+		require.Equal(t, block, fetched)
+	}
+	require.NotZero(t, blocksRead)
+}
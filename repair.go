@@ -0,0 +1,254 @@
+package ethwal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+// RepairSource is the fallback location of the file missing at its canonical path on Options.FileSystem.
+type RepairSource struct {
+	// Replica is 0 for Options.FileSystem and i for Options.ReplicaFileSystems[i-1].
+	Replica int
+	// Legacy reports whether the file is stored at the legacy path.
+	Legacy bool
+}
+
+func (s RepairSource) String() string {
+	path := "canonical"
+	if s.Legacy {
+		path = "legacy"
+	}
+	return fmt.Sprintf("source %d %s path", s.Replica, path)
+}
+
+// FileRepair is the file copied, or to be copied, to its canonical path.
+type FileRepair struct {
+	File   *File
+	Source RepairSource
+}
+
+// RepairOptions are the options of RepairLayout.
+type RepairOptions struct {
+	// DryRun makes RepairLayout only report the files to repair.
+	DryRun bool
+	// OnProgress is called after each file is checked with the number of checked files.
+	OnProgress func(checked, total int)
+}
+
+// RepairReport summarizes the files checked by RepairLayout.
+type RepairReport struct {
+	FilesChecked int
+	// Repaired are the files copied to their canonical path, or the files to copy in dry run.
+	Repaired []FileRepair
+	// Missing are the files that are not stored at any location.
+	Missing []*File
+}
+
+// RepairLayout copies the files of the dataset that are missing at their canonical path on
+// Options.FileSystem from their legacy path or from the replicas, so that reads no longer need to
+// fall back. The fallback copies are kept. The files that failed to repair are reported in the returned
+// error after all other files are checked.
+func RepairLayout(ctx context.Context, opt Options, repairOpt RepairOptions) (RepairReport, error) {
+	opt = opt.WithDefaults()
+
+	repairer := newLayoutRepairer(opt)
+
+	// the file index is read with fail over, so that the replicas can repair the primary
+	fileIndex := NewFileIndex(storage.NewPrefixWrapper(newReplicaFS(opt), opt.Dataset.FullPath()))
+	err := fileIndex.Load(ctx)
+	if err != nil {
+		return RepairReport{}, fmt.Errorf("failed to load file index: %w", err)
+	}
+
+	var (
+		report RepairReport
+		errs   []error
+	)
+	files := fileIndex.Files()
+	for i, file := range files {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+
+		source, ok, err := repairer.find(ctx, file)
+		switch {
+		case errors.Is(err, ErrFileNotExist):
+			report.Missing = append(report.Missing, file)
+		case err != nil:
+			errs = append(errs, fmt.Errorf("file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err))
+		case ok:
+			if !repairOpt.DryRun {
+				err = repairer.copy(ctx, file, source)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err))
+			} else {
+				report.Repaired = append(report.Repaired, FileRepair{File: file, Source: source})
+			}
+		}
+
+		report.FilesChecked++
+		if repairOpt.OnProgress != nil {
+			repairOpt.OnProgress(i+1, len(files))
+		}
+	}
+	return report, errors.Join(errs...)
+}
+
+// layoutRepairer copies the files stored at a fallback location to their canonical path on the primary
+// file system.
+type layoutRepairer struct {
+	// sources are the dataset file systems, the primary first
+	sources []storage.FS
+	// primary is the dataset file system the repaired files are written to
+	primary storage.FS
+
+	onRepair func(file *File, source RepairSource, err error)
+
+	// checked are the files already checked by the reader
+	checked map[[2]uint64]struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+}
+
+func newLayoutRepairer(opt Options) *layoutRepairer {
+	datasetPath := opt.Dataset.FullPath()
+
+	sources := []storage.FS{storage.NewPrefixWrapper(opt.FileSystem, datasetPath)}
+	for _, replica := range opt.ReplicaFileSystems {
+		sources = append(sources, storage.NewPrefixWrapper(replica, datasetPath))
+	}
+
+	return &layoutRepairer{
+		sources:  sources,
+		primary:  opt.withObjectClass(sources[0], ObjectClassData),
+		onRepair: opt.OnReadRepair,
+		checked:  make(map[[2]uint64]struct{}),
+	}
+}
+
+// find returns the fallback location of the file if it's missing at its canonical path on the primary
+// file system. It returns ErrFileNotExist if the file isn't stored at any location.
+func (l *layoutRepairer) find(ctx context.Context, file *File) (RepairSource, bool, error) {
+	for replica, fs := range l.sources {
+		for _, legacy := range []bool{false, true} {
+			path := file.Path()
+			if legacy {
+				path = file.legacyPath()
+			}
+
+			_, err := fs.Attributes(ctx, path, nil)
+			if storage.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return RepairSource{}, false, err
+			}
+
+			source := RepairSource{Replica: replica, Legacy: legacy}
+			return source, source != RepairSource{}, nil
+		}
+	}
+	return RepairSource{}, false, ErrFileNotExist
+}
+
+func (l *layoutRepairer) open(ctx context.Context, file *File, source RepairSource) (io.ReadCloser, error) {
+	path := file.Path()
+	if source.Legacy {
+		path = file.legacyPath()
+	}
+	return l.sources[source.Replica].Open(ctx, path, nil)
+}
+
+// copy copies the file from the fallback location to its canonical path.
+func (l *layoutRepairer) copy(ctx context.Context, file *File, source RepairSource) error {
+	rdr, err := l.open(ctx, file, source)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	data, err := io.ReadAll(rdr)
+	if err != nil {
+		return err
+	}
+
+	// the file is written in one go, so that a partial copy is never visible at the canonical path
+	wr, err := l.primary.Create(ctx, file.Path(), nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = wr.Write(data)
+	if err != nil {
+		_ = wr.Close()
+		return err
+	}
+	return wr.Close()
+}
+
+// openFallback opens the file stored only at a fallback location the file system of the reader doesn't
+// fall back to, like the replicas.
+func (l *layoutRepairer) openFallback(ctx context.Context, file *File) (io.ReadCloser, error) {
+	source, _, err := l.find(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+
+	rdr, err := l.open(ctx, file, source)
+	if err != nil {
+		return nil, err
+	}
+	if source.Legacy {
+		file.setOpenedPath(file.legacyPath())
+	} else {
+		file.setOpenedPath(file.Path())
+	}
+	return rdr, nil
+}
+
+// repairAsync checks the file in the background once and repairs it if it's stored at a fallback location.
+func (l *layoutRepairer) repairAsync(ctx context.Context, file *File) {
+	key := [2]uint64{file.FirstBlockNum, file.LastBlockNum}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.checked[key]; ok {
+		return
+	}
+	l.checked[key] = struct{}{}
+
+	ctx = context.WithoutCancel(ctx)
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+
+		source, ok, err := l.find(ctx, file)
+		if err == nil && !ok {
+			return
+		}
+		if err == nil {
+			err = l.copy(ctx, file, source)
+		}
+		if err != nil {
+			// the file is checked again next time it's read
+			l.mu.Lock()
+			delete(l.checked, key)
+			l.mu.Unlock()
+		}
+
+		if l.onRepair != nil {
+			l.onRepair(file, source, err)
+		}
+	}()
+}
+
+// wait waits for the background repairs to finish.
+func (l *layoutRepairer) wait() {
+	l.wg.Wait()
+}
@@ -0,0 +1,181 @@
+package ethwal
+
+import (
+	"context"
+	"io"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+// moveObject moves the object between the file systems.
+func moveObject(t *testing.T, from storage.FS, fromPath string, to storage.FS, toPath string) {
+	rdr, err := from.Open(context.Background(), fromPath, nil)
+	require.NoError(t, err)
+	data, err := io.ReadAll(rdr)
+	require.NoError(t, err)
+	require.NoError(t, rdr.Close())
+
+	wr, err := to.Create(context.Background(), toPath, nil)
+	require.NoError(t, err)
+	_, err = wr.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, wr.Close())
+
+	require.NoError(t, from.Delete(context.Background(), fromPath))
+}
+
+// writeBrokenLayoutDataset writes the dataset with files 1 and 3 stored at the legacy path and file 5
+// stored only on the replica.
+func writeBrokenLayoutDataset(t *testing.T) (Options, []*File) {
+	opt := Options{
+		Dataset:            Dataset{Path: "ethwal"},
+		FileSystem:         gostorage.NewMemoryFS(),
+		ReplicaFileSystems: []storage.FS{gostorage.NewMemoryFS()},
+		FileRollPolicy:     NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose:    true,
+	}
+
+	w, err := NewWriter[[]int](opt)
+	require.NoError(t, err)
+	for _, b := range generateMixedIntBlocks() {
+		require.NoError(t, w.Write(context.Background(), b))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	primary := storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath())
+	replica := storage.NewPrefixWrapper(opt.ReplicaFileSystems[0], opt.Dataset.FullPath())
+
+	files, err := ListFiles(context.Background(), primary)
+	require.NoError(t, err)
+	require.Len(t, files, 7)
+
+	moveObject(t, primary, files[1].Path(), primary, files[1].legacyPath())
+	moveObject(t, primary, files[3].Path(), primary, files[3].legacyPath())
+	moveObject(t, primary, files[5].Path(), replica, files[5].Path())
+	return opt, files
+}
+
+// canonicalFiles returns the number of the files stored at the canonical path on the primary file system.
+func canonicalFiles(t *testing.T, opt Options, files []*File) int {
+	var n int
+	for _, file := range files {
+		_, err := opt.FileSystem.Attributes(context.Background(), path.Join(opt.Dataset.FullPath(), file.Path()), nil)
+		if err == nil {
+			n++
+		} else {
+			require.True(t, storage.IsNotExist(err))
+		}
+	}
+	return n
+}
+
+func TestReader_ReadRepair(t *testing.T) {
+	opt, files := writeBrokenLayoutDataset(t)
+
+	// the file stored only on the replica isn't readable without read repair
+	r, err := NewReader[[]int](opt)
+	require.NoError(t, err)
+	require.ErrorIs(t, r.Seek(context.Background(), 51), ErrFileNotExist)
+	require.NoError(t, r.Close())
+
+	var (
+		repairs    = make(map[uint64]RepairSource)
+		repairErrs []error
+		mu         sync.Mutex
+	)
+	opt.ReadRepair = true
+	opt.OnReadRepair = func(file *File, source RepairSource, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			repairErrs = append(repairErrs, err)
+			return
+		}
+		repairs[file.FirstBlockNum] = source
+	}
+
+	r, err = NewReader[[]int](opt)
+	require.NoError(t, err)
+	for i := uint64(1); i <= 70; i++ {
+		b, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, i, b.Number)
+	}
+	_, err = r.Read(context.Background())
+	require.ErrorIs(t, err, io.EOF)
+
+	// close waits for the repairs
+	require.NoError(t, r.Close())
+	require.Empty(t, repairErrs)
+	require.Equal(t, map[uint64]RepairSource{
+		11: {Legacy: true},
+		31: {Legacy: true},
+		51: {Replica: 1},
+	}, repairs)
+	require.Equal(t, 7, canonicalFiles(t, opt, files))
+
+	// the repaired files are read directly
+	opt.ReplicaFileSystems = nil
+	opt.ReadRepair = false
+	r, err = NewReader[[]int](opt)
+	require.NoError(t, err)
+	defer r.Close()
+	for i := uint64(1); i <= 70; i++ {
+		_, err := r.Read(context.Background())
+		require.NoError(t, err)
+	}
+}
+
+func TestRepairLayout(t *testing.T) {
+	opt, files := writeBrokenLayoutDataset(t)
+
+	expected := []FileRepair{
+		{File: files[1], Source: RepairSource{Legacy: true}},
+		{File: files[3], Source: RepairSource{Legacy: true}},
+		{File: files[5], Source: RepairSource{Replica: 1}},
+	}
+
+	t.Run("dry_run", func(t *testing.T) {
+		var progress []int
+		report, err := RepairLayout(context.Background(), opt, RepairOptions{
+			DryRun: true,
+			OnProgress: func(checked, total int) {
+				require.Equal(t, 7, total)
+				progress = append(progress, checked)
+			},
+		})
+		require.NoError(t, err)
+		require.Equal(t, 7, report.FilesChecked)
+		require.Equal(t, expected, report.Repaired)
+		require.Empty(t, report.Missing)
+		require.Equal(t, []int{1, 2, 3, 4, 5, 6, 7}, progress)
+		require.Equal(t, 4, canonicalFiles(t, opt, files))
+	})
+
+	report, err := RepairLayout(context.Background(), opt, RepairOptions{})
+	require.NoError(t, err)
+	require.Equal(t, expected, report.Repaired)
+	require.Equal(t, 7, canonicalFiles(t, opt, files))
+
+	// nothing left to repair
+	report, err = RepairLayout(context.Background(), opt, RepairOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 7, report.FilesChecked)
+	require.Empty(t, report.Repaired)
+
+	t.Run("missing", func(t *testing.T) {
+		primary := storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath())
+		require.NoError(t, primary.Delete(context.Background(), files[4].Path()))
+
+		report, err := RepairLayout(context.Background(), opt, RepairOptions{})
+		require.NoError(t, err)
+		require.Empty(t, report.Repaired)
+		require.Len(t, report.Missing, 1)
+		require.Equal(t, files[4].FirstBlockNum, report.Missing[0].FirstBlockNum)
+	})
+}
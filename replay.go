@@ -0,0 +1,318 @@
+package ethwal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/0xsequence/ethwal/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+const defaultReplayWorkers = 1
+
+// ReplayFunc transforms a source block into a destination block. If the returned bool is false
+// the block is skipped and not written to the destination.
+type ReplayFunc[TIn any, TOut any] func(block Block[TIn]) (Block[TOut], bool, error)
+
+type ReplayOptions struct {
+	// Workers is the number of concurrent transform workers. Defaults to 1.
+	Workers int
+	// OnProgress is called after each source block is processed, in the block number order.
+	OnProgress func(blockNum uint64)
+	// PreserveDigests makes the destination record the block digests of the source files, see
+	// Options.BlockDigest, instead of the digests of the written blocks, and roll the files at the source
+	// file boundaries. The source files replayed as a whole keep their digest roots, so that the audits of
+	// the destination validate against the digests recorded at ingestion. The blocks without the recorded
+	// digest are digested with the destination Options.BlockDigest, or CanonicalBlockDigest if not set.
+	PreserveDigests bool
+}
+
+// Replay reads the source dataset block range [from, to] and writes blocks transformed by fn
+// to the destination dataset. If to is 0, all blocks starting at from are replayed.
+//
+// The transform stage runs with bounded parallelism, destination writes are kept ordered by
+// block number. Block number, hash and timestamp of the source block are preserved.
+func Replay[TIn any, TOut any](ctx context.Context, src Options, dst Options, from, to uint64, fn ReplayFunc[TIn, TOut], opt ReplayOptions) error {
+	if to != 0 && from > to {
+		return fmt.Errorf("replay: invalid block range %d-%d", from, to)
+	}
+
+	workers := max(opt.Workers, defaultReplayWorkers)
+
+	// the transform needs the offloaded data, the destination writer offloads it again
+	src.ResolveBlobs = true
+
+	r, err := NewReader[TIn](src)
+	if err != nil {
+		return fmt.Errorf("replay: failed to create reader: %w", err)
+	}
+	defer r.Close()
+
+	var digests *replayDigests[TOut]
+	if opt.PreserveDigests {
+		digests, err = newReplayDigests[TOut](ctx, src, dst)
+		if err != nil {
+			return fmt.Errorf("replay: %w", err)
+		}
+		dst.BlockDigest = BlockDigestFunc[TOut](digests.digest)
+		dst.FileRollPolicy = digests.rollPolicy
+	}
+
+	w, err := NewWriter[TOut](dst)
+	if err != nil {
+		return fmt.Errorf("replay: failed to create writer: %w", err)
+	}
+
+	if from > 0 {
+		err = r.Seek(ctx, from)
+		if errors.Is(err, io.EOF) {
+			return w.Close(ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("replay: failed to seek to block %d: %w", from, err)
+		}
+	}
+
+	type replayJob struct {
+		seq   uint64
+		block Block[TIn]
+	}
+
+	type replayResult struct {
+		seq      uint64
+		blockNum uint64
+		block    Block[TOut]
+		ok       bool
+	}
+
+	jobs := make(chan replayJob, workers)
+	results := make(chan replayResult, workers)
+
+	// inFlight bounds the number of blocks held by the reorder buffer
+	inFlight := make(chan struct{}, workers*2)
+
+	errGrp, gCtx := errgroup.WithContext(ctx)
+
+	// read source blocks
+	errGrp.Go(func() error {
+		defer close(jobs)
+
+		var seq uint64
+		for {
+			block, err := r.Read(gCtx)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("replay: failed to read block after %d: %w", r.BlockNum(), err)
+			}
+
+			if block.Number < from {
+				continue
+			}
+			if to != 0 && block.Number > to {
+				return nil
+			}
+
+			select {
+			case inFlight <- struct{}{}:
+			case <-gCtx.Done():
+				return gCtx.Err()
+			}
+
+			select {
+			case jobs <- replayJob{seq: seq, block: block}:
+			case <-gCtx.Done():
+				return gCtx.Err()
+			}
+			seq++
+		}
+	})
+
+	// transform blocks
+	workerGrp, wCtx := errgroup.WithContext(gCtx)
+	for i := 0; i < workers; i++ {
+		workerGrp.Go(func() error {
+			for {
+				// the reader may be blocked on inFlight if other worker failed
+				var job replayJob
+				select {
+				case j, ok := <-jobs:
+					if !ok {
+						return nil
+					}
+					job = j
+				case <-wCtx.Done():
+					return wCtx.Err()
+				}
+
+				out, ok, err := fn(job.block)
+				if err != nil {
+					return fmt.Errorf("replay: failed to transform block %d: %w", job.block.Number, err)
+				}
+
+				out.Number = job.block.Number
+				out.Hash = job.block.Hash
+				out.TS = job.block.TS
+
+				select {
+				case results <- replayResult{seq: job.seq, blockNum: job.block.Number, block: out, ok: ok}:
+				case <-wCtx.Done():
+					return wCtx.Err()
+				}
+			}
+		})
+	}
+
+	errGrp.Go(func() error {
+		defer close(results)
+		return workerGrp.Wait()
+	})
+
+	// write blocks in order
+	errGrp.Go(func() error {
+		var nextSeq uint64
+		pending := make(map[uint64]replayResult)
+		for result := range results {
+			pending[result.seq] = result
+
+			for {
+				res, ok := pending[nextSeq]
+				if !ok {
+					break
+				}
+				delete(pending, nextSeq)
+				nextSeq++
+
+				if res.ok {
+					if digests != nil {
+						digests.rollPolicy.nextBlockNum = res.blockNum
+					}
+
+					err := w.Write(gCtx, res.block)
+					if err == nil && digests != nil {
+						err = digests.err
+					}
+					if err != nil {
+						return fmt.Errorf("replay: failed to write block %d: %w", res.blockNum, err)
+					}
+				}
+
+				if opt.OnProgress != nil {
+					opt.OnProgress(res.blockNum)
+				}
+				<-inFlight
+			}
+		}
+		return nil
+	})
+
+	err = errGrp.Wait()
+	if err != nil {
+		_ = w.Close(ctx)
+		return err
+	}
+
+	err = w.Close(ctx)
+	if err != nil {
+		return fmt.Errorf("replay: failed to close writer: %w", err)
+	}
+	return nil
+}
+
+// replayDigests looks up the block digests recorded in the source files for the destination writer.
+type replayDigests[TOut any] struct {
+	ctx      context.Context
+	fs       storage.FS
+	files    []*File
+	fallback BlockDigestFunc[TOut]
+
+	rollPolicy *sourceFileRollPolicy
+
+	// digests are the recorded digests of the current source file by the block number
+	file    *File
+	digests map[uint64][32]byte
+	// err is the error of reading the source digests
+	err error
+}
+
+func newReplayDigests[TOut any](ctx context.Context, src Options, dst Options) (*replayDigests[TOut], error) {
+	fallback, err := blockDigestFunc[TOut](dst)
+	if err != nil {
+		return nil, err
+	}
+	if fallback == nil {
+		fallback = CanonicalBlockDigest[TOut]
+	}
+
+	src = src.WithDefaults()
+	fs := storage.NewPrefixWrapper(newReplicaFS(src), src.Dataset.FullPath())
+	fileIndex := NewFileIndex(fs)
+	err = fileIndex.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load source file index: %w", err)
+	}
+
+	return &replayDigests[TOut]{
+		ctx:        ctx,
+		fs:         fs,
+		files:      fileIndex.Files(),
+		fallback:   fallback,
+		rollPolicy: &sourceFileRollPolicy{files: fileIndex.Files()},
+	}, nil
+}
+
+// digest returns the digest of the block recorded in the source file.
+func (d *replayDigests[TOut]) digest(b Block[TOut]) [32]byte {
+	i := sourceFileOf(d.files, b.Number)
+	if i < len(d.files) && d.files[i] != d.file {
+		d.file, d.digests = d.files[i], make(map[uint64][32]byte)
+
+		digests, err := readBlockDigests(d.ctx, d.fs, d.file)
+		if err != nil && !errors.Is(err, ErrBlockDigestMissing) {
+			d.err = fmt.Errorf("failed to read source block digests of file[%d-%d]: %w", d.file.FirstBlockNum, d.file.LastBlockNum, err)
+		}
+		if err == nil {
+			for j, blockNum := range digests.BlockNums {
+				d.digests[blockNum] = digests.Digests[j]
+			}
+		}
+	}
+
+	if digest, ok := d.digests[b.Number]; ok {
+		return digest
+	}
+	return d.fallback(b)
+}
+
+// sourceFileOf returns the position of the file that may contain the block.
+func sourceFileOf(files []*File, blockNum uint64) int {
+	return sort.Search(len(files), func(i int) bool {
+		return files[i].LastBlockNum >= blockNum
+	})
+}
+
+// sourceFileRollPolicy rolls the file when the next block is in the other source file.
+type sourceFileRollPolicy struct {
+	files []*File
+
+	lastBlockNum uint64
+	nextBlockNum uint64
+}
+
+func (p *sourceFileRollPolicy) ShouldRoll() bool {
+	return p.lastBlockNum != 0 && sourceFileOf(p.files, p.lastBlockNum) != sourceFileOf(p.files, p.nextBlockNum)
+}
+
+func (p *sourceFileRollPolicy) Reset() {}
+
+func (p *sourceFileRollPolicy) onWrite(data []byte) {}
+
+func (p *sourceFileRollPolicy) onBlockProcessed(blockNum uint64) {
+	p.lastBlockNum = blockNum
+}
+
+func (p *sourceFileRollPolicy) onFlush(ctx context.Context) {}
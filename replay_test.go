@@ -0,0 +1,165 @@
+package ethwal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplay(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	src := Options{
+		Dataset: Dataset{
+			Path: path.Join(testPath, "src"),
+		},
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(7),
+		FileRollOnClose: true,
+	}
+
+	dst := Options{
+		Dataset: Dataset{
+			Path: path.Join(testPath, "dst"),
+		},
+		FileRollOnClose: true,
+	}
+
+	w, err := NewWriter[int](src)
+	require.NoError(t, err)
+
+	for i := 1; i <= 50; i++ {
+		err := w.Write(context.Background(), Block[int]{
+			Hash:   common.BytesToHash([]byte{byte(i)}),
+			Number: uint64(i),
+			TS:     uint64(1000 + i),
+			Data:   i,
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	var progress []uint64
+	err = Replay(context.Background(), src, dst, 10, 40, func(block Block[int]) (Block[string], bool, error) {
+		// drop odd blocks
+		if block.Data%2 == 1 {
+			return Block[string]{}, false, nil
+		}
+		return Block[string]{Data: fmt.Sprintf("block-%d", block.Data)}, true, nil
+	}, ReplayOptions{
+		Workers: 4,
+		OnProgress: func(blockNum uint64) {
+			progress = append(progress, blockNum)
+		},
+	})
+	require.NoError(t, err)
+
+	var expectedProgress []uint64
+	for i := uint64(10); i <= 40; i++ {
+		expectedProgress = append(expectedProgress, i)
+	}
+	require.Equal(t, expectedProgress, progress)
+
+	r, err := NewReader[string](dst)
+	require.NoError(t, err)
+	defer r.Close()
+
+	expectedBlockNum := uint64(10)
+	for {
+		block, err := r.Read(context.Background())
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		require.Equal(t, expectedBlockNum, block.Number)
+		require.Equal(t, common.BytesToHash([]byte{byte(expectedBlockNum)}), block.Hash)
+		require.Equal(t, 1000+expectedBlockNum, block.TS)
+		require.Equal(t, fmt.Sprintf("block-%d", expectedBlockNum), block.Data)
+		expectedBlockNum += 2
+	}
+	require.Equal(t, uint64(42), expectedBlockNum)
+}
+
+func TestReplay_TransformError(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	src := Options{
+		Dataset:         Dataset{Path: path.Join(testPath, "src")},
+		FileRollOnClose: true,
+	}
+
+	w, err := NewWriter[int](src)
+	require.NoError(t, err)
+	for i := 1; i <= 10; i++ {
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: uint64(i), Data: i}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	err = Replay(context.Background(), src, Options{Dataset: Dataset{Path: path.Join(testPath, "dst")}}, 0, 0,
+		func(block Block[int]) (Block[int], bool, error) {
+			if block.Number == 5 {
+				return Block[int]{}, false, fmt.Errorf("bad block")
+			}
+			return block, true, nil
+		}, ReplayOptions{Workers: 2})
+	require.ErrorContains(t, err, "block 5")
+}
+
+func TestReplay_TransformErrorMidStream(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	src := Options{
+		Dataset:         Dataset{Path: path.Join(testPath, "src")},
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+
+	w, err := NewWriter[int](src)
+	require.NoError(t, err)
+	for i := 1; i <= 100; i++ {
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: uint64(i), Data: i}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the failed block waits for the blocks after it, so the reader of the source waits for the reorder buffer and
+	// the other worker for the next job when the transform fails
+	transformed := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Replay(context.Background(), src, Options{Dataset: Dataset{Path: path.Join(testPath, "dst")}}, 0, 0,
+			func(block Block[int]) (Block[int], bool, error) {
+				switch block.Number {
+				case 50:
+					<-transformed
+					return Block[int]{}, false, fmt.Errorf("bad block")
+				case 53:
+					close(transformed)
+				}
+				return block, true, nil
+			}, ReplayOptions{Workers: 2})
+	}()
+
+	select {
+	case err := <-errCh:
+		require.ErrorContains(t, err, "block 50")
+	case <-ctx.Done():
+		t.Fatal("replay hangs after the transform failed")
+	}
+}
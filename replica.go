@@ -0,0 +1,206 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+)
+
+const (
+	defaultReplicaFailureThreshold = 3
+	defaultReplicaCooldown         = time.Minute
+)
+
+// replicaFS is the read-only failover across the primary file system and its replicas. The reads
+// that fail with other error than not-exist are retried against the next source. Sources that failed
+// Options.ReplicaFailureThreshold times in a row are tried last for Options.ReplicaCooldown.
+//
+// Writes go to the primary file system only.
+type replicaFS struct {
+	sources []storage.FS
+
+	failureThreshold int
+	cooldown         time.Duration
+	onAccess         func(source int, err error)
+
+	health []replicaHealth
+	now    func() time.Time
+
+	mu sync.Mutex
+}
+
+type replicaHealth struct {
+	consecutiveFailures int
+	unhealthyUntil      time.Time
+}
+
+var _ storage.FS = (*replicaFS)(nil)
+
+// newReplicaFS returns the primary file system if there are no replicas.
+func newReplicaFS(opt Options) storage.FS {
+	if len(opt.ReplicaFileSystems) == 0 {
+		return opt.FileSystem
+	}
+
+	sources := append([]storage.FS{opt.FileSystem}, opt.ReplicaFileSystems...)
+	return &replicaFS{
+		sources:          sources,
+		failureThreshold: opt.ReplicaFailureThreshold,
+		cooldown:         opt.ReplicaCooldown,
+		onAccess:         opt.OnReplicaAccess,
+		health:           make([]replicaHealth, len(sources)),
+		now:              time.Now,
+	}
+}
+
+// order returns the sources in the order they should be tried, healthy sources first.
+func (r *replicaFS) order() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+
+	var healthy, unhealthy []int
+	for i, health := range r.health {
+		if now.Before(health.unhealthyUntil) {
+			unhealthy = append(unhealthy, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (r *replicaFS) report(source int, err error) {
+	if r.onAccess != nil {
+		r.onAccess(source, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	health := &r.health[source]
+	if !isTransientStorageError(err) {
+		health.consecutiveFailures = 0
+		health.unhealthyUntil = time.Time{}
+		return
+	}
+
+	health.consecutiveFailures++
+	if health.consecutiveFailures >= r.failureThreshold {
+		health.unhealthyUntil = r.now().Add(r.cooldown)
+	}
+}
+
+// try calls fn with the sources in the preferred order until it succeeds or fails with not-exist error.
+func (r *replicaFS) try(ctx context.Context, fn func(fs storage.FS) error) error {
+	var errs []error
+	for _, source := range r.order() {
+		err := fn(r.sources[source])
+		if ctx.Err() != nil {
+			// the caller gave up, the source is not to blame
+			return err
+		}
+
+		r.report(source, err)
+		if !isTransientStorageError(err) {
+			return err
+		}
+		errs = append(errs, fmt.Errorf("source %d: %w", source, err))
+	}
+	return errors.Join(errs...)
+}
+
+// Open reads the whole file from the first available source, so that read errors can fail over as well.
+func (r *replicaFS) Open(ctx context.Context, path string, options *gostorage.ReaderOptions) (*gostorage.File, error) {
+	var file *gostorage.File
+	err := r.try(ctx, func(fs storage.FS) error {
+		srcFile, err := fs.Open(ctx, path, options)
+		if err != nil {
+			return err
+		}
+		defer srcFile.Close()
+
+		data, err := io.ReadAll(srcFile)
+		if err != nil {
+			return err
+		}
+
+		file = &gostorage.File{
+			ReadCloser: io.NopCloser(bytes.NewReader(data)),
+			Attributes: srcFile.Attributes,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (r *replicaFS) Attributes(ctx context.Context, path string, options *gostorage.ReaderOptions) (*gostorage.Attributes, error) {
+	var attrs *gostorage.Attributes
+	err := r.try(ctx, func(fs storage.FS) error {
+		var err error
+		attrs, err = fs.Attributes(ctx, path, options)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+// Walk fails over only if the source failed before visiting any path, so that no path is visited twice.
+func (r *replicaFS) Walk(ctx context.Context, path string, fn gostorage.WalkFn) error {
+	var visited bool
+	return r.try(ctx, func(fs storage.FS) error {
+		err := fs.Walk(ctx, path, func(path string) error {
+			visited = true
+			return fn(path)
+		})
+		if err != nil && visited {
+			return fmt.Errorf("walk failed: %w", &permanentStorageError{err: err})
+		}
+		return err
+	})
+}
+
+func (r *replicaFS) Create(ctx context.Context, path string, options *gostorage.WriterOptions) (io.WriteCloser, error) {
+	return r.sources[0].Create(ctx, path, options)
+}
+
+func (r *replicaFS) Delete(ctx context.Context, path string) error {
+	return r.sources[0].Delete(ctx, path)
+}
+
+func (r *replicaFS) URL(ctx context.Context, path string, options *gostorage.SignedURLOptions) (string, error) {
+	return r.sources[0].URL(ctx, path, options)
+}
+
+// permanentStorageError marks the error that must not fail over to other sources.
+type permanentStorageError struct {
+	err error
+}
+
+func (e *permanentStorageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentStorageError) Unwrap() error {
+	return e.err
+}
+
+// isTransientStorageError reports whether the read may succeed on other source. Missing files
+// are missing on all sources.
+func isTransientStorageError(err error) bool {
+	var permanentErr *permanentStorageError
+	return err != nil && !storage.IsNotExist(err) && !errors.As(err, &permanentErr)
+}
@@ -0,0 +1,183 @@
+package ethwal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/local"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+var errUnavailable = errors.New("service unavailable")
+
+// unavailableFS fails reads of the paths matched by fail.
+type unavailableFS struct {
+	storage.FS
+
+	fail  atomic.Pointer[func(path string) bool]
+	reads atomic.Int64
+}
+
+func newUnavailableFS(fs storage.FS, fail func(path string) bool) *unavailableFS {
+	u := &unavailableFS{FS: fs}
+	u.fail.Store(&fail)
+	return u
+}
+
+func (u *unavailableFS) Open(ctx context.Context, path string, options *gostorage.ReaderOptions) (*gostorage.File, error) {
+	u.reads.Add(1)
+	if (*u.fail.Load())(path) {
+		return nil, errUnavailable
+	}
+	return u.FS.Open(ctx, path, options)
+}
+
+func (u *unavailableFS) Attributes(ctx context.Context, path string, options *gostorage.ReaderOptions) (*gostorage.Attributes, error) {
+	u.reads.Add(1)
+	if (*u.fail.Load())(path) {
+		return nil, errUnavailable
+	}
+	return u.FS.Attributes(ctx, path, options)
+}
+
+func TestReader_ReplicaFailover(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	// same dataset in both regions
+	for _, region := range []string{"primary", "replica"} {
+		w, err := NewWriter[int](Options{
+			Dataset:         Dataset{Path: path.Join(testPath, region, "dataset")},
+			FileRollPolicy:  NewLastBlockNumberRollPolicy(1),
+			FileRollOnClose: true,
+		})
+		require.NoError(t, err)
+		for i := 1; i <= 10; i++ {
+			require.NoError(t, w.Write(context.Background(), Block[int]{Number: uint64(i), Data: i}))
+		}
+		require.NoError(t, w.Close(context.Background()))
+	}
+
+	// the primary fails for every other file and for the file index
+	failingFiles := make(map[string]bool)
+	for i := uint64(1); i <= 10; i += 2 {
+		file := &File{FirstBlockNum: i, LastBlockNum: i}
+		failingFiles[file.Path()] = true
+	}
+	primary := newUnavailableFS(local.NewLocalFS(path.Join(testPath, "primary")), func(filePath string) bool {
+		filePath = strings.TrimPrefix(filePath, "dataset/")
+		return failingFiles[filePath] || filePath == FileIndexFileName
+	})
+	replica := newUnavailableFS(local.NewLocalFS(path.Join(testPath, "replica")), func(string) bool {
+		return false
+	})
+
+	var mu sync.Mutex
+	served := make(map[int]int)
+	failed := make(map[int]int)
+
+	r, err := NewReader[int](Options{
+		Dataset:                 Dataset{Path: "dataset"},
+		FileSystem:              primary,
+		ReplicaFileSystems:      []storage.FS{replica},
+		ReplicaFailureThreshold: 100,
+		OnReplicaAccess: func(source int, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed[source]++
+			} else {
+				served[source]++
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	for i := 1; i <= 10; i++ {
+		b, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), b.Number)
+		require.Equal(t, i, b.Data)
+	}
+	_, err = r.Read(context.Background())
+	require.ErrorIs(t, err, io.EOF)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotZero(t, served[0])
+	require.NotZero(t, served[1])
+	require.NotZero(t, failed[0])
+	require.Zero(t, failed[1])
+}
+
+func TestReplicaFS_Health(t *testing.T) {
+	primaryMem := gostorage.NewMemoryFS()
+	replicaMem := gostorage.NewMemoryFS()
+	for _, fs := range []gostorage.FS{primaryMem, replicaMem} {
+		f, err := fs.Create(context.Background(), "file", nil)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("data"))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+
+	primary := newUnavailableFS(primaryMem, func(string) bool { return true })
+	replica := newUnavailableFS(replicaMem, func(string) bool { return false })
+
+	now := time.Now()
+	fs := newReplicaFS(Options{
+		FileSystem:              primary,
+		ReplicaFileSystems:      []storage.FS{replica},
+		ReplicaFailureThreshold: 2,
+		ReplicaCooldown:         time.Minute,
+	}).(*replicaFS)
+	fs.now = func() time.Time { return now }
+
+	read := func() {
+		f, err := fs.Open(context.Background(), "file", nil)
+		require.NoError(t, err)
+		data, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, "data", string(data))
+		require.NoError(t, f.Close())
+	}
+
+	// the primary is tried first until it fails twice in a row
+	read()
+	read()
+	require.Equal(t, int64(2), primary.reads.Load())
+	require.Equal(t, int64(2), replica.reads.Load())
+
+	// the replica is preferred during the cool-down
+	read()
+	read()
+	require.Equal(t, int64(2), primary.reads.Load())
+	require.Equal(t, int64(4), replica.reads.Load())
+
+	// the primary recovered and is preferred again after the cool-down
+	recovered := func(string) bool { return false }
+	primary.fail.Store(&recovered)
+	now = now.Add(time.Minute)
+
+	read()
+	require.Equal(t, int64(3), primary.reads.Load())
+	require.Equal(t, int64(4), replica.reads.Load())
+
+	// not existing file is not retried against the replica
+	_, err := fs.Open(context.Background(), "missing", nil)
+	require.True(t, storage.IsNotExist(err))
+	require.Equal(t, int64(4), primary.reads.Load())
+	require.Equal(t, int64(4), replica.reads.Load())
+}
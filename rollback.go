@@ -0,0 +1,247 @@
+package ethwal
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"sort"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+)
+
+// ErrRollbackSealed is returned by Index.Rollback if the index is sealed after the block, the sealed positions
+// can't be removed.
+var ErrRollbackSealed = fmt.Errorf("rollback below the index seal point")
+
+func (w *writer[T]) Rollback(ctx context.Context, toBlockNum uint64) error {
+	defer w.callHooks()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.instance.wrapError(w.rollback(ctx, toBlockNum))
+}
+
+func (w *writer[T]) rollback(ctx context.Context, toBlockNum uint64) error {
+	if err := validateBlockNum(toBlockNum); err != nil {
+		return err
+	}
+	if w.genesis || toBlockNum >= w.lastBlockNum {
+		return nil
+	}
+
+	// the buffered blocks up to the block are rolled to the file truncated with the others, the buffered
+	// blocks after it are dropped
+	if w.lastBlockNum >= w.firstBlockNum && w.firstBlockNum <= toBlockNum {
+		err := w.rollFile(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to roll file: %w", err)
+		}
+	}
+
+	err := newWriterBackfill(w).truncate(ctx, toBlockNum)
+	if err != nil {
+		return err
+	}
+
+	if w.bufferCloser != nil {
+		_ = w.bufferCloser.Close()
+	}
+	if w.journal != nil {
+		err = w.journal.Truncate()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the tail of the dropped blocks isn't read by the followers
+	if w.options.TailFlushInterval > 0 {
+		err = w.metaFs.Delete(ctx, TailFileName)
+		if err != nil && !storage.IsNotExist(err) {
+			return fmt.Errorf("failed to delete tail: %w", err)
+		}
+	}
+	if w.pendingPresence != nil {
+		w.pendingPresence.RemoveRange(toBlockNum+1, MaxSupportedBlockNum+1)
+	}
+
+	w.lastBlockNum = toBlockNum
+	w.durableBlockNum = min(w.durableBlockNum, toBlockNum)
+	w.genesis = len(w.fileIndex.Files()) == 0
+	return w.newFile()
+}
+
+// newWriterBackfill returns the backfill of the files of the writer.
+func newWriterBackfill[T any](w *writer[T]) *backfill[T] {
+	return &backfill[T]{
+		opt:         w.options,
+		fs:          w.fs,
+		metaFs:      w.metaFs,
+		fileIndex:   w.fileIndex,
+		blocks:      make(map[uint64][]Block[T]),
+		changed:     make(map[uint64]*File),
+		modified:    make(map[uint64]struct{}),
+		blobs:       cmp.Or(w.options.BlobStore, NewFSBlobStore(w.fs)),
+		bloomKeys:   w.bloomKeys,
+		blockDigest: w.blockDigest,
+		changelog:   w.changelog,
+	}
+}
+
+// truncate removes the blocks after the block from the files. The files after it are deleted, the file
+// containing it is replaced by the file of its blocks up to the block. The replacement file is written
+// before the file index is saved and the files are deleted after, so the file index never lists the missing
+// file. The digests of the kept blocks are recomputed.
+func (b *backfill[T]) truncate(ctx context.Context, toBlockNum uint64) error {
+	files := b.fileIndex.Files()
+
+	// the first file with the blocks after the block
+	start := sort.Search(len(files), func(i int) bool {
+		return files[i].LastBlockNum > toBlockNum
+	})
+	if start == len(files) {
+		return nil
+	}
+	removed := slices.Clone(files[start:])
+
+	var replacement *File
+	if boundary := files[start]; boundary.FirstBlockNum <= toBlockNum {
+		if boundary.SchemaVersion != b.opt.SchemaVersion {
+			return fmt.Errorf("file[%d-%d]: schema version %d doesn't match %d", boundary.FirstBlockNum, boundary.LastBlockNum, boundary.SchemaVersion, b.opt.SchemaVersion)
+		}
+
+		blocks, err := b.load(ctx, boundary)
+		if err != nil {
+			return err
+		}
+		kept := blocks[:sort.Search(len(blocks), func(i int) bool {
+			return blocks[i].Number > toBlockNum
+		})]
+
+		// the file without the kept blocks is deleted
+		if len(kept) > 0 {
+			replacement = &File{FirstBlockNum: boundary.FirstBlockNum, LastBlockNum: toBlockNum, SchemaVersion: boundary.SchemaVersion}
+			b.blocks[replacement.FirstBlockNum] = kept
+			err = b.writeFile(ctx, replacement)
+			if err != nil {
+				return fmt.Errorf("file[%d-%d]: %w", replacement.FirstBlockNum, replacement.LastBlockNum, err)
+			}
+			replacement.Bloom = b.bloomKeys != nil
+		}
+	}
+
+	b.fileIndex.files = slices.Delete(files, start, len(files))
+	if replacement != nil {
+		b.fileIndex.files = append(b.fileIndex.files, replacement)
+	}
+	err := b.fileIndex.Save(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save file index: %w", err)
+	}
+
+	// the files aren't listed anymore, the files that failed to delete are left behind
+	events := make([]ChangeEvent, 0, len(removed)+1)
+	for _, file := range removed {
+		err = deleteFile(ctx, b.fs, file)
+		if err != nil {
+			log.Default().Println("failed to delete rolled back file", "file", file.Path(), "err", err)
+		}
+		events = append(events, ChangeEvent{Type: ChangeFileRemoved, File: file.clone()})
+	}
+	if replacement != nil {
+		events = append(events, ChangeEvent{Type: ChangeFileAdded, File: replacement.clone()})
+	}
+
+	if b.changelog == nil {
+		return nil
+	}
+	return b.changelog.publish(ctx, events...)
+}
+
+// Rollback removes the positions of the blocks higher than toBlockNum from the mutable index files and rewinds
+// the last block number indexed to it, so that the blocks written again after the chain reorg are indexed
+// again, see Writer.Rollback. The index sealed after the block fails with ErrRollbackSealed.
+//
+// The last block number indexed is rewound before the positions are removed, so the rollback that failed
+// halfway is completed by the next one.
+func (i *Index[T]) Rollback(ctx context.Context, fs storage.FS, toBlockNum uint64) error {
+	if err := validateBlockNum(toBlockNum); err != nil {
+		return err
+	}
+
+	seal, err := readIndexSeal(ctx, fs, i.name)
+	if err != nil {
+		return err
+	}
+	if seal != nil && seal.BlockNum > toBlockNum+1 {
+		return fmt.Errorf("index %s: %w: sealed before block %d, rollback to block %d", i.name, ErrRollbackSealed, seal.BlockNum, toBlockNum)
+	}
+
+	lastBlockNumIndexed, err := i.readLastBlockNumIndexed(ctx, fs)
+	if err != nil {
+		return err
+	}
+	if lastBlockNumIndexed > toBlockNum {
+		err = storage.Update(ctx, fs, indexedBlockNumFilePath(string(i.name)), func([]byte) ([]byte, error) {
+			return binary.BigEndian.AppendUint64(nil, toBlockNum), nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write IndexBlock file: %w", err)
+		}
+	}
+	if i.numBlocksIndexed != nil {
+		i.numBlocksIndexed.Store(min(i.numBlocksIndexed.Load(), toBlockNum))
+	}
+
+	// the delta files are merged into the index files trimmed below
+	err = i.compactAll(ctx, fs)
+	if err != nil {
+		return err
+	}
+
+	files, err := i.indexFiles(ctx, fs)
+	if err != nil {
+		return err
+	}
+	return i.trimIndexFiles(ctx, fs, files, trimAfter(toBlockNum))
+}
+
+// trimAfter returns the trim of the positions of the blocks higher than toBlockNum.
+func trimAfter(toBlockNum uint64) func(bmap *roaring64.Bitmap) {
+	return func(bmap *roaring64.Bitmap) {
+		if toBlockNum >= MaxSupportedBlockNum {
+			return
+		}
+		// the range excludes its end, the last position of the last block
+		bmap.RemoveRange(uint64(NewIndexCompoundID(toBlockNum+1, 0)), math.MaxUint64)
+		bmap.Remove(math.MaxUint64)
+	}
+}
+
+// Rollback flushes the pending updates and rolls back all indexes to the block, see Index.Rollback.
+func (i *Indexer[T]) Rollback(ctx context.Context, toBlockNum uint64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	err := i.flush(ctx)
+	if err != nil {
+		return i.instance.wrapError(err)
+	}
+
+	for name, idx := range i.indexes {
+		err = idx.Rollback(ctx, i.fs, toBlockNum)
+		if err != nil {
+			return i.instance.wrapError(fmt.Errorf("Indexer.Rollback: %w", err))
+		}
+
+		i.indexUpdates[name].LastBlockNum = min(i.indexUpdates[name].LastBlockNum, toBlockNum)
+		i.flushedBlockNums[name] = min(i.flushedBlockNums[name], toBlockNum)
+		if retryBlockNum, ok := i.retryBlockNums[name]; ok && retryBlockNum > toBlockNum {
+			delete(i.retryBlockNums, name)
+		}
+	}
+	return nil
+}
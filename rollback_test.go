@@ -0,0 +1,187 @@
+package ethwal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter_Rollback(t *testing.T) {
+	// the files 1-4 and 5-8, the blocks 9-10 are buffered
+	setup := func(t *testing.T) (Writer[int], Options) {
+		opt := Options{Dataset: Dataset{Path: "ethwal"}, FileSystem: memory.NewMemoryFS()}
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = w.Close(context.Background()) })
+
+		for blockNum := uint64(1); blockNum <= 10; blockNum++ {
+			require.NoError(t, w.Write(context.Background(), Block[int]{Number: blockNum, Data: int(blockNum)}))
+			if blockNum%4 == 0 {
+				require.NoError(t, w.RollFile(context.Background()))
+			}
+		}
+		return w, opt
+	}
+
+	fileRanges := func(t *testing.T, opt Options) [][2]uint64 {
+		fi := NewFileIndex(storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()))
+		require.NoError(t, fi.Load(context.Background()))
+
+		var ranges [][2]uint64
+		for _, file := range fi.Files() {
+			ranges = append(ranges, [2]uint64{file.FirstBlockNum, file.LastBlockNum})
+		}
+		return ranges
+	}
+
+	t.Run("mid_file", func(t *testing.T) {
+		w, opt := setup(t)
+
+		require.NoError(t, w.Rollback(context.Background(), 6))
+		require.Equal(t, uint64(6), w.AcceptedBlockNum())
+		require.Equal(t, [][2]uint64{{1, 4}, {5, 6}}, fileRanges(t, opt))
+		require.Equal(t, blockRange(1, 6), readBlockNums(t, opt))
+
+		// the blocks after the rollback are written again
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 7, Data: 70}))
+		require.NoError(t, w.RollFile(context.Background()))
+		require.Equal(t, [][2]uint64{{1, 4}, {5, 6}, {7, 7}}, fileRanges(t, opt))
+		require.Equal(t, blockRange(1, 7), readBlockNums(t, opt))
+	})
+
+	t.Run("buffered", func(t *testing.T) {
+		w, opt := setup(t)
+
+		// the buffered blocks up to the block are rolled
+		require.NoError(t, w.Rollback(context.Background(), 9))
+		require.Equal(t, [][2]uint64{{1, 4}, {5, 8}, {9, 9}}, fileRanges(t, opt))
+
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 10, Data: 100}))
+		require.NoError(t, w.RollFile(context.Background()))
+		require.Equal(t, [][2]uint64{{1, 4}, {5, 8}, {9, 9}, {10, 10}}, fileRanges(t, opt))
+
+		r, err := NewReader[int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+		require.NoError(t, r.Seek(context.Background(), 10))
+		b, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 100, b.Data)
+	})
+
+	t.Run("file_boundary", func(t *testing.T) {
+		w, opt := setup(t)
+
+		require.NoError(t, w.Rollback(context.Background(), 4))
+		require.Equal(t, [][2]uint64{{1, 4}}, fileRanges(t, opt))
+		require.Equal(t, blockRange(1, 4), readBlockNums(t, opt))
+	})
+
+	t.Run("all", func(t *testing.T) {
+		w, opt := setup(t)
+
+		require.NoError(t, w.Rollback(context.Background(), 0))
+		require.Equal(t, uint64(0), w.AcceptedBlockNum())
+		require.Empty(t, fileRanges(t, opt))
+
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 1}))
+		require.NoError(t, w.RollFile(context.Background()))
+		require.Equal(t, blockRange(1, 1), readBlockNums(t, opt))
+	})
+
+	t.Run("noop", func(t *testing.T) {
+		w, opt := setup(t)
+
+		require.NoError(t, w.Rollback(context.Background(), 10))
+		require.NoError(t, w.Rollback(context.Background(), 20))
+		require.Equal(t, uint64(10), w.AcceptedBlockNum())
+		require.NoError(t, w.RollFile(context.Background()))
+		require.Equal(t, blockRange(1, 10), readBlockNums(t, opt))
+	})
+
+	t.Run("after_flush", func(t *testing.T) {
+		w, opt := setup(t)
+
+		// the flushed file is rolled without new blocks before it's truncated
+		require.NoError(t, w.Flush(context.Background()))
+		require.NoError(t, w.Rollback(context.Background(), 9))
+		require.Equal(t, [][2]uint64{{1, 4}, {5, 8}, {9, 9}}, fileRanges(t, opt))
+		require.Equal(t, blockRange(1, 9), readBlockNums(t, opt))
+
+		// the rollback after the flushed blocks is a no-op
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 10, Data: 100}))
+		require.NoError(t, w.Flush(context.Background()))
+		require.NoError(t, w.Rollback(context.Background(), 10))
+		require.NoError(t, w.Close(context.Background()))
+		require.Equal(t, [][2]uint64{{1, 4}, {5, 8}, {9, 9}, {10, 10}}, fileRanges(t, opt))
+		require.Equal(t, blockRange(1, 10), readBlockNums(t, opt))
+	})
+
+	t.Run("no_gap", func(t *testing.T) {
+		w, opt := setup(t)
+		wng := NewWriterNoGap(w)
+
+		require.NoError(t, wng.Rollback(context.Background(), 6))
+		require.NoError(t, wng.Write(context.Background(), Block[int]{Number: 8}))
+		require.NoError(t, wng.RollFile(context.Background()))
+		require.Equal(t, blockRange(1, 8), readBlockNums(t, opt))
+	})
+}
+
+func TestWriterWithIndexer_Rollback(t *testing.T) {
+	fs := memory.NewMemoryFS()
+	indexerOpt := IndexerOptions[[]int]{
+		Dataset:    Dataset{Path: "ethwal"},
+		FileSystem: fs,
+		Indexes:    generateMixedIntIndexes(),
+	}
+	indexer, err := NewIndexer(context.Background(), indexerOpt)
+	require.NoError(t, err)
+
+	w, err := NewWriter[[]int](Options{Dataset: Dataset{Path: "ethwal"}, FileSystem: fs})
+	require.NoError(t, err)
+
+	wi, err := NewWriterWithIndexer(w, indexer)
+	require.NoError(t, err)
+	defer wi.Close(context.Background())
+
+	for blockNum := uint64(1); blockNum <= 10; blockNum++ {
+		require.NoError(t, wi.Write(context.Background(), Block[[]int]{Number: blockNum, Data: []int{int(blockNum)}}))
+	}
+	require.NoError(t, wi.RollFile(context.Background()))
+
+	// the blocks after the chain reorg are even
+	require.NoError(t, wi.Rollback(context.Background(), 5))
+	require.Equal(t, uint64(5), indexer.BlockNum())
+	for blockNum := uint64(6); blockNum <= 8; blockNum++ {
+		require.NoError(t, wi.Write(context.Background(), Block[[]int]{Number: blockNum, Data: []int{int(blockNum) * 2}}))
+	}
+	require.NoError(t, wi.Flush(context.Background()))
+
+	f, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset:    Dataset{Path: "ethwal"},
+		FileSystem: fs,
+		Indexes:    indexerOpt.Indexes,
+	})
+	require.NoError(t, err)
+
+	filterBlockNums := func(filter Filter) []uint64 {
+		var blockNums []uint64
+		for iter := filter.Eval(context.Background()); iter.HasNext(); {
+			blockNum, _ := iter.Next()
+			blockNums = append(blockNums, blockNum)
+		}
+		return blockNums
+	}
+	require.Equal(t, []uint64{1, 3, 5}, filterBlockNums(f.Eq("only_odd", "true")))
+	require.Equal(t, []uint64{2, 4, 6, 7, 8}, filterBlockNums(f.Eq("only_even", "true")))
+
+	// the sealed positions aren't rolled back
+	require.NoError(t, SealIndexes(context.Background(), indexerOpt, 4))
+	require.ErrorIs(t, indexer.Rollback(context.Background(), 2), ErrRollbackSealed)
+	require.NoError(t, indexer.Rollback(context.Background(), 3))
+	require.Equal(t, uint64(3), indexer.BlockNum())
+}
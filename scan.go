@@ -0,0 +1,130 @@
+package ethwal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ScanDataset decodes the files of the dataset with the workers and calls fn with their blocks, the files are
+// independent, so that the whole dataset scans aren't bound by the decoding of the sequential reader. The
+// blocks of the file are passed in their order, the blocks of the different files in any order, fn is called by
+// the workers concurrently and must be safe for the concurrent use. The first error, of the file or of fn,
+// cancels the scan and is returned. The dataset is opened as NewReader opens it, the patches and the blobs
+// are resolved, the checksums are verified and the empty files are skipped as the reader does. Zero workers
+// means runtime.GOMAXPROCS.
+func ScanDataset[T any](ctx context.Context, opt Options, workers int, fn func(Block[T]) error) error {
+	return ScanDatasetWithUpgrades[T](ctx, opt, nil, workers, fn)
+}
+
+// ScanDatasetWithUpgrades scans the dataset as ScanDataset, the blocks of files written under older payload
+// schema versions are upgraded to Options.SchemaVersion.
+func ScanDatasetWithUpgrades[T any](ctx context.Context, opt Options, upgrades SchemaUpgrades[T], workers int, fn func(Block[T]) error) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	// the files are decoded at once, there's nothing to prefetch ahead of them
+	opt.DisablePrefetch = true
+
+	rdr, err := NewReaderWithUpgrades[T](opt, upgrades)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	r := rdr.(*reader[T])
+
+	errGrp, gctx := errgroup.WithContext(ctx)
+	errGrp.SetLimit(workers)
+	for _, file := range r.fileIndex.Files() {
+		// the canceled scan doesn't start the remaining files
+		if gctx.Err() != nil {
+			break
+		}
+
+		errGrp.Go(func() error {
+			return r.scanFile(gctx, file, fn)
+		})
+	}
+
+	err = errGrp.Wait()
+	if err == nil {
+		// the scan canceled before starting all files isn't complete
+		err = ctx.Err()
+	}
+	return r.instance.wrapError(err)
+}
+
+// scanFile decodes the blocks of the file and calls fn with them, the file is opened apart from the sequential
+// reads of the reader.
+func (r *reader[T]) scanFile(ctx context.Context, file *File, fn func(Block[T]) error) error {
+	decodeBlock, err := newSchemaDecoder(r.options, r.upgrades, file.SchemaVersion)
+	if err != nil {
+		return newFileError(file, err)
+	}
+
+	rdr, _, err := r.openFile(ctx, file)
+	if err != nil {
+		return newFileError(file, fmt.Errorf("failed to open file: %w", err))
+	}
+	defer rdr.Close()
+
+	rdr, err = nonEmptyReader(rdr)
+	if errors.Is(err, ErrEmptyFile) && r.options.SkipCorruptFiles {
+		return nil
+	}
+	if err != nil {
+		return newFileError(file, err)
+	}
+
+	var checksum *checksumReader
+	if r.options.VerifyChecksumOnRead && file.Checksum != nil {
+		checksum = newChecksumReader(rdr, file)
+		rdr = checksum
+	}
+
+	var decmprRdr = io.NopCloser(rdr)
+	if r.options.NewDecompressor != nil {
+		decmprRdr = r.options.NewDecompressor(decmprRdr)
+	}
+	defer decmprRdr.Close()
+
+	decoder := newBlockDecoder(r.options, decmprRdr, r.warnLegacyJSON)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		var block Block[T]
+		err = decodeBlock(decoder, &block)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return newFileError(file, fmt.Errorf("failed to decode file data: %w", checksum.decodeErr(err)))
+		}
+
+		if block.Number < file.FirstBlockNum || block.Number > file.LastBlockNum {
+			return newFileError(file, fmt.Errorf("block number %d is out of file block %d-%d range", block.Number, file.FirstBlockNum, file.LastBlockNum))
+		}
+
+		block, err = r.applyPatch(ctx, block)
+		if err == nil && r.options.ResolveBlobs {
+			block, err = resolveBlob(ctx, r.options, r.blobs, block)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = fn(block)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// writeScanDataset writes the blocks 1 up to the block, the files have blocksPerFile blocks.
+func writeScanDataset[T any](t testing.TB, opt Options, lastBlockNum, blocksPerFile uint64, data func(blockNum uint64) T) {
+	w, err := NewWriter[T](opt)
+	require.NoError(t, err)
+	for blockNum := uint64(1); blockNum <= lastBlockNum; blockNum++ {
+		require.NoError(t, w.Write(context.Background(), Block[T]{Number: blockNum, Data: data(blockNum)}))
+		if blockNum%blocksPerFile == 0 {
+			require.NoError(t, w.RollFile(context.Background()))
+		}
+	}
+	require.NoError(t, w.RollFile(context.Background()))
+	require.NoError(t, w.Close(context.Background()))
+}
+
+func TestScanDataset(t *testing.T) {
+	ctx := context.Background()
+	opt := Options{Dataset: Dataset{Path: "ethwal"}, FileSystem: memory.NewMemoryFS()}
+	writeScanDataset(t, opt, 100, 10, func(blockNum uint64) int { return int(blockNum) * 2 })
+
+	t.Run("all", func(t *testing.T) {
+		for _, workers := range []int{0, 1, 4} {
+			var (
+				mu        sync.Mutex
+				blockNums []uint64
+				// the last block of the file the block is in, the blocks of the file are in order
+				fileLast = make(map[uint64]uint64)
+			)
+			// fn is called by the workers, the failures are returned instead of failing the test
+			err := ScanDataset(ctx, opt, workers, func(b Block[int]) error {
+				if b.Data != int(b.Number)*2 {
+					return fmt.Errorf("block %d has data %d", b.Number, b.Data)
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				first := (b.Number-1)/10*10 + 1
+				if fileLast[first] >= b.Number {
+					return fmt.Errorf("block %d after block %d", b.Number, fileLast[first])
+				}
+				fileLast[first] = b.Number
+				blockNums = append(blockNums, b.Number)
+				return nil
+			})
+			require.NoError(t, err)
+
+			slices.Sort(blockNums)
+			require.Equal(t, blockRange(1, 100), blockNums, "workers %d", workers)
+		}
+	})
+
+	t.Run("fn_error", func(t *testing.T) {
+		errStop := fmt.Errorf("stop")
+
+		var (
+			mu      sync.Mutex
+			scanned int
+		)
+		err := ScanDataset(ctx, opt, 2, func(b Block[int]) error {
+			mu.Lock()
+			defer mu.Unlock()
+			scanned++
+			if b.Number == 15 {
+				return errStop
+			}
+			return nil
+		})
+		require.ErrorIs(t, err, errStop)
+		require.Less(t, scanned, 100)
+	})
+
+	t.Run("corrupt_file", func(t *testing.T) {
+		opt := Options{Dataset: Dataset{Path: "ethwal"}, FileSystem: memory.NewMemoryFS()}
+		writeScanDataset(t, opt, 30, 10, func(blockNum uint64) int { return int(blockNum) })
+
+		middle := &File{FirstBlockNum: 11, LastBlockNum: 20}
+		wr, err := storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()).Create(ctx, middle.Path(), nil)
+		require.NoError(t, err)
+		_, err = wr.Write([]byte{0xff, 0xff})
+		require.NoError(t, err)
+		require.NoError(t, wr.Close())
+
+		err = ScanDataset(ctx, opt, 3, func(b Block[int]) error { return nil })
+		var fileErr *FileError
+		require.ErrorAs(t, err, &fileErr)
+		require.Equal(t, middle.Path(), fileErr.Path)
+		require.Equal(t, uint64(11), fileErr.FirstBlockNum)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		err := ScanDataset(canceledCtx, opt, 2, func(b Block[int]) error { return nil })
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func BenchmarkScanDataset(b *testing.B) {
+	ctx := context.Background()
+	opt := Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      memory.NewMemoryFS(),
+		NewCompressor:   NewZSTDCompressor,
+		NewDecompressor: NewZSTDDecompressor,
+	}
+	writeScanDataset(b, opt, 20000, 1000, func(blockNum uint64) []testDictLog { return testDictBlock(blockNum).Data })
+
+	b.Run("reader", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			r, err := NewReader[[]testDictLog](opt)
+			require.NoError(b, err)
+
+			var blocks int
+			for ; ; blocks++ {
+				_, err = r.Read(ctx)
+				if err != nil {
+					break
+				}
+			}
+			require.Equal(b, 20000, blocks)
+			require.NoError(b, r.Close())
+		}
+	})
+
+	for _, workers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("scan_%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var (
+					mu     sync.Mutex
+					blocks int
+				)
+				err := ScanDataset(ctx, opt, workers, func(Block[[]testDictLog]) error {
+					mu.Lock()
+					blocks++
+					mu.Unlock()
+					return nil
+				})
+				require.NoError(b, err)
+				require.Equal(b, 20000, blocks)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package ethwal
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+const DatasetSchemaFileName = ".schema"
+
+var (
+	ErrSchemaVersionUnsupported = fmt.Errorf("schema version is newer than supported")
+	ErrSchemaUpgradeMissing     = fmt.Errorf("schema upgrade is missing")
+	ErrSchemaVersionDowngrade   = fmt.Errorf("schema version is lower than the dataset schema version")
+)
+
+// RawData is the encoded block data, it's decoded by the upgrade function.
+type RawData []byte
+
+func (r RawData) MarshalCBOR() ([]byte, error) {
+	return r, nil
+}
+
+func (r *RawData) UnmarshalCBOR(data []byte) error {
+	*r = append((*r)[:0], data...)
+	return nil
+}
+
+func (r RawData) MarshalJSON() ([]byte, error) {
+	return r, nil
+}
+
+func (r *RawData) UnmarshalJSON(data []byte) error {
+	*r = append((*r)[:0], data...)
+	return nil
+}
+
+// RawBlock is the block written under older payload schema version.
+type RawBlock struct {
+	Block[RawData]
+
+	// SchemaVersion is the payload schema version the block was written under.
+	SchemaVersion int
+
+	newDecoder NewDecoderFunc
+}
+
+// DecodeData decodes the block data into v, which should be the data type of the block schema version.
+func (b RawBlock) DecodeData(v any) error {
+	return b.newDecoder(bytes.NewReader(b.Data)).Decode(v)
+}
+
+// SchemaUpgrades are the functions that convert blocks written under older payload schema versions
+// to the current version, keyed by the version they convert from. Files written before the schema
+// versioning was enabled have version 0.
+type SchemaUpgrades[T any] map[int]func(raw RawBlock) (T, error)
+
+// datasetSchema is the dataset metadata stored in DatasetSchemaFileName.
+type datasetSchema struct {
+	Version    int    `cbor:"0,keyasint"`
+	CBORPreset string `cbor:"1,keyasint,omitempty"`
+	// Streams are the codec names of the streams of the multi-stream dataset keyed by the stream name.
+	Streams map[string]string `cbor:"2,keyasint,omitempty"`
+}
+
+var ErrCBORPresetMismatch = fmt.Errorf("cbor preset doesn't match the dataset cbor preset")
+
+// DatasetSchemaVersion returns the latest payload schema version recorded by the writer, or 0 if
+// the dataset doesn't use schema versioning.
+func DatasetSchemaVersion(ctx context.Context, opt Options) (int, error) {
+	opt = opt.WithDefaults()
+	schema, err := readDatasetSchema(ctx, storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()))
+	return schema.Version, err
+}
+
+// DatasetCBORPreset returns the CBOR preset recorded by the writer, or empty string if the dataset
+// doesn't use a preset.
+func DatasetCBORPreset(ctx context.Context, opt Options) (string, error) {
+	opt = opt.WithDefaults()
+	schema, err := readDatasetSchema(ctx, storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()))
+	return schema.CBORPreset, err
+}
+
+// DatasetStreams returns the codec names of the streams recorded by the multi-stream writer keyed by
+// the stream name, or nil if the dataset has no streams.
+func DatasetStreams(ctx context.Context, opt Options) (map[string]string, error) {
+	opt = opt.WithDefaults()
+	schema, err := readDatasetSchema(ctx, storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()))
+	return schema.Streams, err
+}
+
+func readDatasetSchema(ctx context.Context, fs storage.FS) (datasetSchema, error) {
+	file, err := fs.Open(ctx, DatasetSchemaFileName, nil)
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return datasetSchema{}, nil
+		}
+		return datasetSchema{}, fmt.Errorf("failed to open dataset schema: %w", err)
+	}
+	defer file.Close()
+
+	var schema datasetSchema
+	err = NewCBORDecoder(file).Decode(&schema)
+	if err != nil {
+		return datasetSchema{}, fmt.Errorf("failed to decode dataset schema: %w", err)
+	}
+	return schema, nil
+}
+
+func writeDatasetSchema(ctx context.Context, fs storage.FS, schema datasetSchema) error {
+	file, err := fs.Create(ctx, DatasetSchemaFileName, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create dataset schema: %w", err)
+	}
+
+	err = NewCBOREncoder(file).Encode(schema)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to encode dataset schema: %w", err)
+	}
+	return file.Close()
+}
+
+// recordDatasetSchema records the schema version and the CBOR preset of the writer. The version can only
+// be bumped and the preset can't be changed once recorded, zero values are not recorded.
+func recordDatasetSchema(ctx context.Context, fs storage.FS, version int, cborPreset string) error {
+	current, err := readDatasetSchema(ctx, fs)
+	if err != nil {
+		return err
+	}
+	if version > 0 && version < current.Version {
+		return fmt.Errorf("%w: %d < %d", ErrSchemaVersionDowngrade, version, current.Version)
+	}
+	if cborPreset != "" && current.CBORPreset != "" && cborPreset != current.CBORPreset {
+		return fmt.Errorf("%w: %q != %q", ErrCBORPresetMismatch, cborPreset, current.CBORPreset)
+	}
+
+	schema := datasetSchema{Version: max(version, current.Version), CBORPreset: cmp.Or(current.CBORPreset, cborPreset), Streams: current.Streams}
+	if schema.Version == current.Version && schema.CBORPreset == current.CBORPreset {
+		return nil
+	}
+	return writeDatasetSchema(ctx, fs, schema)
+}
+
+// recordDatasetStreams records the codec names of the streams of the multi-stream writer. The streams can
+// be added but the codec of the recorded stream can't be changed.
+func recordDatasetStreams(ctx context.Context, fs storage.FS, streams map[string]string) error {
+	current, err := readDatasetSchema(ctx, fs)
+	if err != nil {
+		return err
+	}
+
+	schema := current
+	schema.Streams = make(map[string]string, len(current.Streams)+len(streams))
+	for stream, codec := range current.Streams {
+		schema.Streams[stream] = codec
+	}
+
+	var changed bool
+	for stream, codec := range streams {
+		recorded, ok := current.Streams[stream]
+		if ok && recorded != codec {
+			return fmt.Errorf("%w: stream %q codec %q != %q", ErrStreamCodecMismatch, stream, codec, recorded)
+		}
+		if !ok {
+			schema.Streams[stream] = codec
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return writeDatasetSchema(ctx, fs, schema)
+}
+
+// schemaDecoder decodes the blocks of a file written under the schema version.
+type schemaDecoder[T any] func(dec Decoder, block *Block[T]) error
+
+// newSchemaDecoder returns the decoder of the blocks written under the file schema version. Versioning
+// is disabled if the reader has schema version 0 and no upgrades.
+func newSchemaDecoder[T any](opt Options, upgrades SchemaUpgrades[T], fileVersion int) (schemaDecoder[T], error) {
+	decode := func(dec Decoder, block *Block[T]) error {
+		return dec.Decode(block)
+	}
+
+	if (opt.SchemaVersion == 0 && len(upgrades) == 0) || fileVersion == opt.SchemaVersion {
+		return decode, nil
+	}
+	if fileVersion > opt.SchemaVersion {
+		return nil, fmt.Errorf("%w: file version %d, reader version %d", ErrSchemaVersionUnsupported, fileVersion, opt.SchemaVersion)
+	}
+
+	upgrade, ok := upgrades[fileVersion]
+	if !ok {
+		return nil, fmt.Errorf("%w: from version %d to %d", ErrSchemaUpgradeMissing, fileVersion, opt.SchemaVersion)
+	}
+
+	return func(dec Decoder, block *Block[T]) error {
+		var raw Block[RawData]
+		err := dec.Decode(&raw)
+		if err != nil {
+			return err
+		}
+
+		if raw.Blob != nil {
+			return fmt.Errorf("block %d: offloaded data of schema version %d can't be upgraded", raw.Number, fileVersion)
+		}
+
+		*block = Block[T]{Hash: raw.Hash, Number: raw.Number, TS: raw.TS, Meta: raw.Meta, Parent: raw.Parent}
+
+		block.Data, err = upgrade(RawBlock{Block: raw, SchemaVersion: fileVersion, newDecoder: opt.NewDecoder})
+		if err != nil {
+			return fmt.Errorf("failed to upgrade block %d from schema version %d: %w", raw.Number, fileVersion, err)
+		}
+		return nil
+	}, nil
+}
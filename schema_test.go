@@ -0,0 +1,165 @@
+package ethwal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type paymentV1 struct {
+	Value int
+}
+
+type paymentV2 struct {
+	Amount int
+	Unit   string
+}
+
+type paymentV3 struct {
+	Amount uint64
+	Unit   string
+	Memo   string
+}
+
+func writeSchemaVersion[T any](t *testing.T, opt Options, version int, from, to int, data func(i int) T) {
+	opt.SchemaVersion = version
+
+	w, err := NewWriter[T](opt)
+	require.NoError(t, err)
+	for i := from; i <= to; i++ {
+		require.NoError(t, w.Write(context.Background(), Block[T]{Number: uint64(i), Data: data(i)}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+}
+
+func TestReader_SchemaUpgrades(t *testing.T) {
+	codecs := map[string]struct {
+		newEncoder NewEncoderFunc
+		newDecoder NewDecoderFunc
+	}{
+		"cbor": {NewCBOREncoder, NewCBORDecoder},
+		"json": {NewJSONEncoder, NewJSONDecoder},
+	}
+
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				_ = os.RemoveAll(testPath)
+			}()
+
+			opt := Options{
+				Dataset:         Dataset{Path: testPath},
+				NewEncoder:      codec.newEncoder,
+				NewDecoder:      codec.newDecoder,
+				NewCompressor:   NewZSTDCompressor,
+				NewDecompressor: NewZSTDDecompressor,
+				FileRollPolicy:  NewLastBlockNumberRollPolicy(5),
+				FileRollOnClose: true,
+			}
+
+			writeSchemaVersion(t, opt, 1, 1, 10, func(i int) paymentV1 {
+				return paymentV1{Value: i}
+			})
+			writeSchemaVersion(t, opt, 2, 11, 20, func(i int) paymentV2 {
+				return paymentV2{Amount: i, Unit: "wei"}
+			})
+			writeSchemaVersion(t, opt, 3, 21, 30, func(i int) paymentV3 {
+				return paymentV3{Amount: uint64(i), Unit: "wei", Memo: "v3"}
+			})
+
+			version, err := DatasetSchemaVersion(context.Background(), opt)
+			require.NoError(t, err)
+			require.Equal(t, 3, version)
+
+			upgrades := SchemaUpgrades[paymentV3]{
+				1: func(raw RawBlock) (paymentV3, error) {
+					var data paymentV1
+					if err := raw.DecodeData(&data); err != nil {
+						return paymentV3{}, err
+					}
+					return paymentV3{Amount: uint64(data.Value), Unit: "wei"}, nil
+				},
+				2: func(raw RawBlock) (paymentV3, error) {
+					var data paymentV2
+					if err := raw.DecodeData(&data); err != nil {
+						return paymentV3{}, err
+					}
+					return paymentV3{Amount: uint64(data.Amount), Unit: data.Unit}, nil
+				},
+			}
+
+			t.Run("upgrade", func(t *testing.T) {
+				ropt := opt
+				ropt.SchemaVersion = 3
+
+				r, err := NewReaderWithUpgrades[paymentV3](ropt, upgrades)
+				require.NoError(t, err)
+				defer r.Close()
+
+				for i := 1; i <= 30; i++ {
+					b, loc, err := r.ReadWithLocation(context.Background())
+					require.NoError(t, err)
+					require.Equal(t, uint64(i), b.Number)
+					require.Equal(t, uint64(i), b.Data.Amount)
+					require.Equal(t, "wei", b.Data.Unit)
+					require.Equal(t, (i-1)/10+1, loc.File.SchemaVersion)
+
+					fetched, err := r.ReadAtLocation(context.Background(), loc)
+					require.NoError(t, err)
+					require.Equal(t, b, fetched)
+				}
+				_, err = r.Read(context.Background())
+				require.ErrorIs(t, err, io.EOF)
+			})
+
+			t.Run("missing_upgrade", func(t *testing.T) {
+				ropt := opt
+				ropt.SchemaVersion = 3
+
+				r, err := NewReaderWithUpgrades[paymentV3](ropt, SchemaUpgrades[paymentV3]{2: upgrades[2]})
+				require.NoError(t, err)
+				defer r.Close()
+
+				_, err = r.Read(context.Background())
+				require.ErrorIs(t, err, ErrSchemaUpgradeMissing)
+			})
+
+			t.Run("future_version", func(t *testing.T) {
+				ropt := opt
+				ropt.SchemaVersion = 2
+
+				r, err := NewReaderWithUpgrades[paymentV2](ropt, SchemaUpgrades[paymentV2]{
+					1: func(raw RawBlock) (paymentV2, error) {
+						var data paymentV1
+						err := raw.DecodeData(&data)
+						return paymentV2{Amount: data.Value, Unit: "wei"}, err
+					},
+				})
+				require.NoError(t, err)
+				defer r.Close()
+
+				for {
+					_, err = r.Read(context.Background())
+					if err != nil {
+						break
+					}
+				}
+				require.ErrorIs(t, err, ErrSchemaVersionUnsupported)
+				require.False(t, errors.Is(err, io.EOF))
+				require.Equal(t, uint64(20), r.BlockNum())
+			})
+
+			t.Run("downgrade", func(t *testing.T) {
+				wopt := opt
+				wopt.SchemaVersion = 2
+
+				_, err := NewWriter[paymentV2](wopt)
+				require.ErrorIs(t, err, ErrSchemaVersionDowngrade)
+			})
+		})
+	}
+}
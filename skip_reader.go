@@ -0,0 +1,151 @@
+package ethwal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+var blockNumJSONKey = []byte(`"blockNum"`)
+
+// SkipReader is a reader of newline delimited JSON blocks that skips all lines with block number
+// lower or equal to the provided block number. Once the first line with higher block number is found
+// the rest of the input is passed through unchanged.
+type SkipReader struct {
+	rdr      *bufio.Reader
+	blockNum uint64
+
+	skipping bool
+	pending  []byte
+	err      error
+
+	skippedLines uint64
+	skippedBytes uint64
+}
+
+// SkipUntilBlock returns a reader that skips newline delimited JSON blocks until the first block with
+// number higher than blockNum. Lines that block number can't be extracted from end the skipping, so
+// that the consumer can report them.
+func SkipUntilBlock(r io.Reader, blockNum uint64) *SkipReader {
+	return &SkipReader{
+		rdr:      bufio.NewReader(r),
+		blockNum: blockNum,
+		skipping: true,
+	}
+}
+
+func (s *SkipReader) Read(p []byte) (int, error) {
+	for s.skipping {
+		line, err := s.rdr.ReadBytes('\n')
+		if len(line) > 0 {
+			if s.isSkippable(line) {
+				s.skippedLines++
+				s.skippedBytes += uint64(len(line))
+			} else {
+				s.skipping = false
+				s.pending = line
+			}
+		}
+		if err != nil {
+			s.skipping = false
+			s.err = err
+		}
+	}
+
+	if len(s.pending) > 0 {
+		n := copy(p, s.pending)
+		s.pending = s.pending[n:]
+		return n, nil
+	}
+
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.rdr.Read(p)
+}
+
+// SkippedLines returns the number of lines skipped.
+func (s *SkipReader) SkippedLines() uint64 {
+	return s.skippedLines
+}
+
+// SkippedBytes returns the number of input bytes skipped.
+func (s *SkipReader) SkippedBytes() uint64 {
+	return s.skippedBytes
+}
+
+func (s *SkipReader) isSkippable(line []byte) bool {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return true
+	}
+
+	blockNum, ok := parseBlockNumFromJSON(line)
+	return ok && blockNum <= s.blockNum
+}
+
+// parseBlockNumFromJSON extracts the block number from JSON encoded Block without unmarshalling
+// the whole block if possible.
+func parseBlockNumFromJSON(line []byte) (uint64, bool) {
+	if index := topLevelKeyIndex(line, blockNumJSONKey); index >= 0 {
+		rest := bytes.TrimLeft(line[index+len(blockNumJSONKey):], " \t")
+		if len(rest) > 0 && rest[0] == ':' {
+			rest = bytes.TrimLeft(rest[1:], " \t")
+
+			end := 0
+			for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+				end++
+			}
+
+			if end > 0 && end < len(rest) && (rest[end] == ',' || rest[end] == '}' || rest[end] == ' ') {
+				blockNum, err := strconv.ParseUint(string(rest[:end]), 10, 64)
+				if err == nil {
+					return blockNum, true
+				}
+			}
+		}
+	}
+
+	// slow path
+	var block struct {
+		Number *uint64 `json:"blockNum"`
+	}
+	if err := json.Unmarshal(line, &block); err != nil || block.Number == nil {
+		return 0, false
+	}
+	return *block.Number, true
+}
+
+// topLevelKeyIndex returns the index of the key in the top level JSON object or -1.
+func topLevelKeyIndex(data []byte, key []byte) int {
+	var depth int
+	var inString, escaped bool
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+		case '"':
+			if depth == 1 && bytes.HasPrefix(data[i:], key) {
+				return i
+			}
+			inString = true
+		}
+	}
+	return -1
+}
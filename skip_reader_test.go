@@ -0,0 +1,169 @@
+package ethwal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSkipUntilBlock(t *testing.T) {
+	testCases := []struct {
+		name         string
+		input        string
+		blockNum     uint64
+		expected     string
+		skippedLines uint64
+	}{
+		{
+			name:         "exact-boundary",
+			input:        "{\"blockNum\":1}\n{\"blockNum\":2}\n{\"blockNum\":3}\n",
+			blockNum:     2,
+			expected:     "{\"blockNum\":3}\n",
+			skippedLines: 2,
+		},
+		{
+			name:         "skip-none",
+			input:        "{\"blockNum\":1}\n{\"blockNum\":2}\n",
+			blockNum:     0,
+			expected:     "{\"blockNum\":1}\n{\"blockNum\":2}\n",
+			skippedLines: 0,
+		},
+		{
+			name:         "skip-all",
+			input:        "{\"blockNum\":1}\n{\"blockNum\":2}",
+			blockNum:     2,
+			expected:     "",
+			skippedLines: 2,
+		},
+		{
+			name:         "nested-block-num",
+			input:        "{\"blockData\":{\"blockNum\":100},\"blockNum\":1}\n{\"blockNum\":2, \"blockData\":null}\n",
+			blockNum:     1,
+			expected:     "{\"blockNum\":2, \"blockData\":null}\n",
+			skippedLines: 1,
+		},
+		{
+			name:         "empty-lines",
+			input:        "\n{\"blockNum\":1}\n  \n{\"blockNum\":2}\n",
+			blockNum:     1,
+			expected:     "{\"blockNum\":2}\n",
+			skippedLines: 3,
+		},
+		{
+			name:         "malformed-line",
+			input:        "{\"blockNum\":1}\n{\"blockNum\":\n{\"blockNum\":2}\n",
+			blockNum:     5,
+			expected:     "{\"blockNum\":\n{\"blockNum\":2}\n",
+			skippedLines: 1,
+		},
+		{
+			name:         "missing-block-num",
+			input:        "{\"blockNum\":1}\n{\"blockHash\":\"0x01\"}\n",
+			blockNum:     5,
+			expected:     "{\"blockHash\":\"0x01\"}\n",
+			skippedLines: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rdr := SkipUntilBlock(strings.NewReader(tc.input), tc.blockNum)
+
+			data, err := io.ReadAll(rdr)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, string(data))
+			require.Equal(t, tc.skippedLines, rdr.SkippedLines())
+			require.Equal(t, uint64(len(tc.input)-len(tc.expected)), rdr.SkippedBytes())
+		})
+	}
+}
+
+func TestSkipUntilBlock_ResumedImport(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	var input bytes.Buffer
+	for i := 1; i <= 100; i++ {
+		data, err := json.Marshal(Block[int]{
+			Hash:   common.BytesToHash([]byte{byte(i)}),
+			Number: uint64(i),
+			Data:   i,
+		})
+		require.NoError(t, err)
+		input.Write(append(data, '\n'))
+	}
+
+	importBlocks := func(t *testing.T, w Writer[int], rdr io.Reader, maxBlocks int) {
+		in := bufio.NewReader(rdr)
+		for i := 0; i < maxBlocks; i++ {
+			line, err := in.ReadString('\n')
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			require.NoError(t, err)
+
+			var b Block[int]
+			require.NoError(t, json.Unmarshal([]byte(line), &b))
+			require.NoError(t, w.Write(context.Background(), b))
+		}
+	}
+
+	readBlocks := func(t *testing.T, opt Options) []Block[int] {
+		r, err := NewReader[int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		var blocks []Block[int]
+		for {
+			b, err := r.Read(context.Background())
+			if errors.Is(err, io.EOF) {
+				return blocks
+			}
+			require.NoError(t, err)
+			blocks = append(blocks, b)
+		}
+	}
+
+	singlePassOpt := Options{
+		Dataset:         Dataset{Path: path.Join(testPath, "single-pass")},
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(15),
+		FileRollOnClose: true,
+	}
+
+	w, err := NewWriter[int](singlePassOpt)
+	require.NoError(t, err)
+	importBlocks(t, w, bytes.NewReader(input.Bytes()), math.MaxInt)
+	require.NoError(t, w.Close(context.Background()))
+
+	resumedOpt := singlePassOpt
+	resumedOpt.Dataset = Dataset{Path: path.Join(testPath, "resumed")}
+
+	// interrupted import, the writer is not closed
+	w, err = NewWriter[int](resumedOpt)
+	require.NoError(t, err)
+	importBlocks(t, w, bytes.NewReader(input.Bytes()), 70)
+	require.Equal(t, uint64(60), w.DurableBlockNum())
+
+	// resumed import
+	w, err = NewWriter[int](resumedOpt)
+	require.NoError(t, err)
+
+	skipReader := SkipUntilBlock(bytes.NewReader(input.Bytes()), w.DurableBlockNum())
+	importBlocks(t, w, skipReader, math.MaxInt)
+	require.NoError(t, w.Close(context.Background()))
+	require.Equal(t, uint64(60), skipReader.SkippedLines())
+
+	require.Equal(t, readBlocks(t, singlePassOpt), readBlocks(t, resumedOpt))
+}
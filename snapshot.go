@@ -0,0 +1,627 @@
+package ethwal
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
+	gostorage "github.com/Shopify/go-storage"
+)
+
+const (
+	// SnapshotObjectsDirectory is the directory of the snapshot objects, they are stored by their digest,
+	// so that the objects unchanged between snapshots are stored once.
+	SnapshotObjectsDirectory = "objects"
+	// SnapshotManifestsDirectory is the directory of the snapshot manifests.
+	SnapshotManifestsDirectory = "manifests"
+)
+
+var (
+	ErrSnapshotDigestMismatch  = fmt.Errorf("snapshot object digest mismatch")
+	ErrSnapshotTargetNotEmpty  = fmt.Errorf("snapshot restore target is not empty")
+	ErrSnapshotManifestInvalid = fmt.Errorf("invalid snapshot manifest")
+)
+
+// SnapshotOptions are the options of Snapshot.
+type SnapshotOptions struct {
+	// Previous is the manifest of the previous snapshot stored in the same destination. The objects
+	// that didn't change since the previous snapshot are not copied again.
+	Previous *SnapshotManifest
+
+	// Dedupe is the dedupe index of the snapshot storage, see LoadDedupeIndex. The objects that are
+	// already stored by the snapshots of any dataset in the snapshot storage are not written again.
+	// Snapshot saves the index once the manifest is stored.
+	Dedupe *DedupeIndex
+
+	// Pause is called before the cut is captured, the returned resume function is called right after.
+	// It lets the caller briefly stop a live writer and indexer, so that the cut includes the latest
+	// blocks. Without it, the cut is the latest state that is consistent in the storage.
+	Pause func(ctx context.Context) (resume func(), err error)
+}
+
+// SnapshotManifest describes the snapshot, the dataset objects and their digests.
+type SnapshotManifest struct {
+	// CutBlockNum is the last block number of the snapshot, both the files and the indexes are
+	// complete up to the block.
+	CutBlockNum uint64    `json:"cutBlockNum"`
+	CreatedAt   time.Time `json:"createdAt"`
+
+	Objects []SnapshotObject `json:"objects"`
+}
+
+// SnapshotObject is the dataset object stored in the snapshot.
+type SnapshotObject struct {
+	// Path is the path of the object relative to the dataset path.
+	Path string `json:"path"`
+	// Digest is the hex encoded sha-256 digest of the object.
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// Path returns the path to the manifest in the snapshot storage.
+func (m SnapshotManifest) Path() string {
+	return fmt.Sprintf("%s/%020d-%d.json", SnapshotManifestsDirectory, m.CutBlockNum, m.CreatedAt.UnixNano())
+}
+
+func snapshotObjectPath(digest string) string {
+	return fmt.Sprintf("%s/%s/%s", SnapshotObjectsDirectory, digest[:2], digest)
+}
+
+// ReadSnapshotManifest reads the manifest stored by Snapshot at manifestPath, see SnapshotManifest.Path.
+func ReadSnapshotManifest(ctx context.Context, src storage.FS, manifestPath string) (SnapshotManifest, error) {
+	file, err := src.Open(ctx, manifestPath, nil)
+	if err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to open snapshot manifest: %w", err)
+	}
+	defer file.Close()
+
+	var manifest SnapshotManifest
+	err = json.NewDecoder(file).Decode(&manifest)
+	if err != nil {
+		return SnapshotManifest{}, fmt.Errorf("%w: %w", ErrSnapshotManifestInvalid, err)
+	}
+	return manifest, nil
+}
+
+// snapshotWriter stores the objects in the snapshot storage by their digest.
+type snapshotWriter struct {
+	dst storage.FS
+
+	// stored are the digests of the objects that are already in the snapshot storage
+	stored map[string]bool
+	// immutable are the objects of the previous snapshot that never change once written
+	immutable map[string]SnapshotObject
+	dedupe    *DedupeIndex
+
+	objects []SnapshotObject
+}
+
+func newSnapshotWriter(dst storage.FS, previous *SnapshotManifest, dedupe *DedupeIndex) *snapshotWriter {
+	sw := &snapshotWriter{
+		dst:       dst,
+		stored:    make(map[string]bool),
+		immutable: make(map[string]SnapshotObject),
+		dedupe:    dedupe,
+	}
+
+	if previous != nil {
+		for _, object := range previous.Objects {
+			sw.stored[object.Digest] = true
+			if isImmutableObject(object.Path) {
+				sw.immutable[object.Path] = object
+			}
+		}
+	}
+	return sw
+}
+
+// isImmutableObject reports whether the object never changes once written, the ethwal files, their bloom
+// filters and the blobs.
+func isImmutableObject(objectPath string) bool {
+	return !strings.HasPrefix(objectPath, ".") || strings.HasPrefix(objectPath, BlobsDirectory+"/")
+}
+
+// reuse adds the object of the previous snapshot if the object is immutable.
+func (sw *snapshotWriter) reuse(objectPath string) bool {
+	object, ok := sw.immutable[objectPath]
+	if ok {
+		sw.objects = append(sw.objects, object)
+	}
+	return ok
+}
+
+func (sw *snapshotWriter) put(ctx context.Context, objectPath string, data []byte) error {
+	hash := sha256.Sum256(data)
+	digest := hex.EncodeToString(hash[:])
+
+	if !sw.stored[digest] && sw.dedupe != nil {
+		deduplicated, err := sw.dedupe.CopyDeduplicated(ctx, digest, snapshotObjectPath(digest))
+		if err != nil {
+			return fmt.Errorf("failed to copy deduplicated snapshot object: %w", err)
+		}
+		sw.stored[digest] = deduplicated
+	}
+
+	if !sw.stored[digest] {
+		file, err := sw.dst.Create(ctx, snapshotObjectPath(digest), nil)
+		if err != nil {
+			return fmt.Errorf("failed to create snapshot object: %w", err)
+		}
+
+		_, err = file.Write(data)
+		if err != nil {
+			_ = file.Close()
+			return fmt.Errorf("failed to write snapshot object: %w", err)
+		}
+
+		err = file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to close snapshot object: %w", err)
+		}
+		sw.stored[digest] = true
+
+		if sw.dedupe != nil {
+			sw.dedupe.Record(digest, snapshotObjectPath(digest))
+		}
+	}
+
+	sw.objects = append(sw.objects, SnapshotObject{Path: objectPath, Digest: digest, Size: int64(len(data))})
+	return nil
+}
+
+// copy stores the object of the file system as is.
+func (sw *snapshotWriter) copy(ctx context.Context, fs storage.FS, objectPath string) error {
+	return sw.copyAs(ctx, fs, objectPath, objectPath)
+}
+
+// copyAs stores the object of the file system as is under the dataset path.
+func (sw *snapshotWriter) copyAs(ctx context.Context, fs storage.FS, objectPath string, datasetPath string) error {
+	if sw.reuse(datasetPath) {
+		return nil
+	}
+
+	data, err := readObject(ctx, fs, objectPath)
+	if err != nil {
+		return err
+	}
+	return sw.put(ctx, datasetPath, data)
+}
+
+// putBitmap stores the object written by write with the bitmap trimmed to the values lower than
+// toExclusive. The bitmaps that become empty are skipped.
+func (sw *snapshotWriter) putBitmap(ctx context.Context, staging storage.FS, objectPath string, datasetPath string, bmap *roaring64.Bitmap, toExclusive uint64, write func(bmap *roaring64.Bitmap) error) error {
+	bmap.RemoveRange(toExclusive, math.MaxUint64)
+	if bmap.IsEmpty() {
+		return nil
+	}
+
+	err := write(bmap)
+	if err != nil {
+		return err
+	}
+
+	data, err := readObject(ctx, staging, objectPath)
+	if err != nil {
+		return err
+	}
+	return sw.put(ctx, datasetPath, data)
+}
+
+func readObject(ctx context.Context, fs storage.FS, objectPath string) ([]byte, error) {
+	file, err := fs.Open(ctx, objectPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// Snapshot copies the consistent cut of the dataset and its indexes to the snapshot storage and stores
+// the manifest of the snapshot. The cut is the last file boundary that all indexes reached, the index
+// files and the examined block marks are trimmed to the cut, the tail is not included.
+func Snapshot[T any](ctx context.Context, opt Options, dst storage.FS, snapOpt SnapshotOptions, indexerOpt ...IndexerOptions[T]) (SnapshotManifest, error) {
+	opt = opt.WithDefaults()
+	fs := storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath())
+
+	var indexFses []storage.FS
+	var indexNames [][]IndexName
+	for _, iOpt := range indexerOpt {
+		iOpt = iOpt.WithDefaults()
+		indexFses = append(indexFses, storage.NewPrefixWrapper(iOpt.FileSystem, fmt.Sprintf("%s/", path.Join(iOpt.Dataset.FullPath(), IndexesDirectory))))
+
+		var names []IndexName
+		for _, index := range iOpt.Indexes {
+			names = append(names, index.Name())
+		}
+		indexNames = append(indexNames, names)
+	}
+
+	// capture the cut, the indexes are read before the file index, so that the files cover them
+	cut, files, err := captureSnapshotCut[T](ctx, fs, indexFses, indexNames, snapOpt.Pause)
+	if err != nil {
+		return SnapshotManifest{}, err
+	}
+
+	sw := newSnapshotWriter(dst, snapOpt.Previous, snapOpt.Dedupe)
+	staging := gostorage.NewMemoryFS()
+
+	// files
+	for _, file := range files {
+		if !sw.reuse(file.Path()) {
+			rdr, err := file.Open(ctx, fs)
+			if err != nil {
+				return SnapshotManifest{}, fmt.Errorf("failed to open file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err)
+			}
+
+			data, err := io.ReadAll(rdr)
+			_ = rdr.Close()
+			if err != nil {
+				return SnapshotManifest{}, fmt.Errorf("failed to read file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err)
+			}
+
+			err = sw.put(ctx, file.Path(), data)
+			if err != nil {
+				return SnapshotManifest{}, err
+			}
+		}
+
+		if file.Bloom {
+			err = sw.copy(ctx, fs, file.BloomPath())
+			if err != nil && !storage.IsNotExist(err) {
+				return SnapshotManifest{}, fmt.Errorf("failed to copy bloom filter: %w", err)
+			}
+		}
+
+		if file.DigestRoot != nil {
+			err = sw.copy(ctx, fs, file.DigestsPath())
+			if err != nil && !storage.IsNotExist(err) {
+				return SnapshotManifest{}, fmt.Errorf("failed to copy block digests: %w", err)
+			}
+		}
+	}
+
+	err = NewFileIndexFromFiles(staging, files).Save(ctx)
+	if err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to save file index: %w", err)
+	}
+
+	err = sw.copy(ctx, staging, FileIndexFileName)
+	if err != nil {
+		return SnapshotManifest{}, err
+	}
+
+	// dataset metadata, patches and blobs
+	err = sw.copy(ctx, fs, DatasetSchemaFileName)
+	if err != nil && !storage.IsNotExist(err) {
+		return SnapshotManifest{}, fmt.Errorf("failed to copy dataset schema: %w", err)
+	}
+
+	err = sw.copy(ctx, fs, DatasetManifestFileName)
+	if err != nil && !storage.IsNotExist(err) {
+		return SnapshotManifest{}, fmt.Errorf("failed to copy dataset manifest: %w", err)
+	}
+
+	err = sw.copy(ctx, fs, DatasetDictionaryFileName)
+	if err != nil && !storage.IsNotExist(err) {
+		return SnapshotManifest{}, fmt.Errorf("failed to copy dataset dictionary: %w", err)
+	}
+
+	for _, dir := range []string{PatchesDirectory, BlobsDirectory} {
+		err = snapshotWalk(ctx, fs, dir, func(objectPath string) error {
+			return sw.copy(ctx, fs, objectPath)
+		})
+		if err != nil {
+			return SnapshotManifest{}, err
+		}
+	}
+
+	// examined block marks
+	err = snapshotWalk(ctx, fs, PresenceDirectory, func(objectPath string) error {
+		shardFrom, err := strconv.ParseUint(strings.TrimSuffix(path.Base(objectPath), ".idx"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid presence shard %s: %w", objectPath, err)
+		}
+		shard := shardFrom / presenceShardSize
+
+		bmap, err := newPresenceStore(fs).readShard(ctx, shard)
+		if err != nil {
+			return err
+		}
+
+		return sw.putBitmap(ctx, staging, objectPath, objectPath, bmap, cut+1, func(bmap *roaring64.Bitmap) error {
+			return newPresenceStore(staging).writeShard(ctx, shard, bmap)
+		})
+	})
+	if err != nil {
+		return SnapshotManifest{}, err
+	}
+
+	// indexes
+	for i, indexFs := range indexFses {
+		err = snapshotIndexes[T](ctx, sw, indexFs, staging, indexNames[i], cut)
+		if err != nil {
+			return SnapshotManifest{}, err
+		}
+	}
+
+	manifest := SnapshotManifest{
+		CutBlockNum: cut,
+		CreatedAt:   time.Now().UTC(),
+		Objects:     sw.objects,
+	}
+
+	// the manifest is stored last, so that it references only the stored objects
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to encode snapshot manifest: %w", err)
+	}
+
+	file, err := dst.Create(ctx, manifest.Path(), nil)
+	if err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to create snapshot manifest: %w", err)
+	}
+
+	_, err = file.Write(data)
+	if err != nil {
+		_ = file.Close()
+		return SnapshotManifest{}, fmt.Errorf("failed to write snapshot manifest: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to close snapshot manifest: %w", err)
+	}
+
+	if snapOpt.Dedupe != nil {
+		err = snapOpt.Dedupe.Save(ctx)
+		if err != nil {
+			return SnapshotManifest{}, fmt.Errorf("failed to save dedupe index: %w", err)
+		}
+	}
+	return manifest, nil
+}
+
+// captureSnapshotCut returns the last file boundary reached by all indexes and the files up to it.
+func captureSnapshotCut[T any](ctx context.Context, fs storage.FS, indexFses []storage.FS, indexNames [][]IndexName, pause func(ctx context.Context) (func(), error)) (uint64, []*File, error) {
+	if pause != nil {
+		resume, err := pause(ctx)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to pause writer: %w", err)
+		}
+		defer resume()
+	}
+
+	var indexed uint64 = MaxSupportedBlockNum
+	for i, indexFs := range indexFses {
+		for _, name := range indexNames[i] {
+			index := NewIndex[T](name, nil)
+
+			lastBlockNum, err := index.readLastBlockNumIndexed(ctx, indexFs)
+			if err != nil {
+				return 0, nil, fmt.Errorf("failed to read last block number indexed for %s: %w", name, err)
+			}
+			indexed = min(indexed, lastBlockNum)
+		}
+	}
+
+	fileIndex := NewFileIndex(fs)
+	err := fileIndex.Load(ctx)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to load file index: %w", err)
+	}
+
+	var cut uint64
+	var files []*File
+	for _, file := range fileIndex.Files() {
+		if file.LastBlockNum > indexed {
+			break
+		}
+
+		cut = file.LastBlockNum
+		files = append(files, file)
+	}
+	return cut, files, nil
+}
+
+// snapshotIndexes stores the indexes trimmed to the cut.
+func snapshotIndexes[T any](ctx context.Context, sw *snapshotWriter, indexFs, staging storage.FS, names []IndexName, cut uint64) error {
+	indexStaging := storage.NewPrefixWrapper(staging, IndexesDirectory+"/")
+	toExclusive := uint64(NewIndexCompoundID(cut+1, 0))
+
+	for _, name := range names {
+		// the position format of the index is kept, the snapshot restores the index files as they are
+		var positionFormat string
+		bitmaps := make(map[string]*roaring64.Bitmap)
+		err := snapshotWalk(ctx, indexFs, string(name), func(objectPath string) error {
+			if !isIndexObject(objectPath) {
+				return nil
+			}
+
+			bmap, metadata, err := (&IndexFile{fs: indexFs, path: objectPath}).read(ctx, true)
+			if err != nil {
+				return err
+			}
+			positionFormat = cmp.Or(positionFormat, metadata.PositionFormat)
+
+			// the delta files are merged into their index files
+			if base, _, ok := indexDeltaBase(objectPath); ok {
+				objectPath = base
+			}
+			if stored, ok := bitmaps[objectPath]; ok {
+				bmap.Or(stored)
+			}
+			bitmaps[objectPath] = bmap
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// the sealed positions are stored in the index files of the snapshot
+		seal, err := readIndexSeal(ctx, indexFs, name)
+		if err != nil {
+			return err
+		}
+		if seal != nil {
+			positionFormat = cmp.Or(positionFormat, seal.PositionFormat)
+
+			segment, err := openIndexSegment(ctx, indexFs, *seal, true)
+			if err != nil {
+				return fmt.Errorf("failed to open index segment of %s: %w", name, err)
+			}
+			for value := range segment.dict {
+				bmap, err := segment.read(ctx, indexFs, value)
+				if err != nil {
+					return err
+				}
+
+				objectPath := indexPath(string(name), string(value))
+				if mutable, ok := bitmaps[objectPath]; ok {
+					bmap.Or(mutable)
+				}
+				bitmaps[objectPath] = bmap
+			}
+		}
+
+		objectPaths := make([]string, 0, len(bitmaps))
+		for objectPath := range bitmaps {
+			objectPaths = append(objectPaths, objectPath)
+		}
+		sort.Strings(objectPaths)
+
+		for _, objectPath := range objectPaths {
+			err = sw.putBitmap(ctx, indexStaging, objectPath, path.Join(IndexesDirectory, objectPath), bitmaps[objectPath], toExclusive, func(bmap *roaring64.Bitmap) error {
+				return (&IndexFile{fs: indexStaging, path: objectPath, positionFormat: positionFormat}).Write(ctx, bmap)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		markerPath := indexedBlockNumFilePath(string(name))
+		index := NewIndex[T](name, nil)
+		err = index.storeLastBlockNumIndexed(ctx, indexStaging, cut)
+		if err != nil {
+			return fmt.Errorf("failed to store last block number indexed for %s: %w", name, err)
+		}
+
+		// the marker isn't stored if nothing is indexed
+		err = sw.copyAs(ctx, indexStaging, markerPath, path.Join(IndexesDirectory, markerPath))
+		if err != nil && !storage.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err := sw.copyAs(ctx, indexFs, indexRetentionFilePath, path.Join(IndexesDirectory, indexRetentionFilePath))
+	if err != nil && !storage.IsNotExist(err) {
+		return fmt.Errorf("failed to copy index retention floor: %w", err)
+	}
+	return nil
+}
+
+// snapshotWalk calls fn for each object in the directory, the missing directory is skipped.
+func snapshotWalk(ctx context.Context, fs storage.FS, dir string, fn func(objectPath string) error) error {
+	var objectPaths []string
+	err := fs.Walk(ctx, dir+"/", func(objectPath string) error {
+		objectPaths = append(objectPaths, objectPath)
+		return nil
+	})
+	if err != nil && !storage.IsNotExist(err) {
+		return fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+
+	for _, objectPath := range objectPaths {
+		err = fn(objectPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore restores the snapshot stored in the snapshot storage to the empty dataset. The digests
+// of all objects are validated, the file index is restored last.
+func Restore(ctx context.Context, src storage.FS, manifest SnapshotManifest, dst Options) error {
+	dst = dst.WithDefaults()
+	fs := storage.NewPrefixWrapper(dst.FileSystem, dst.Dataset.FullPath())
+
+	_, err := fs.Attributes(ctx, FileIndexFileName, nil)
+	if err == nil {
+		return ErrSnapshotTargetNotEmpty
+	}
+	if !storage.IsNotExist(err) {
+		return fmt.Errorf("failed to check restore target: %w", err)
+	}
+
+	var fileIndex *SnapshotObject
+	for i, object := range manifest.Objects {
+		if object.Path == FileIndexFileName {
+			fileIndex = &manifest.Objects[i]
+			continue
+		}
+
+		err = restoreObject(ctx, src, dst.withObjectClass(fs, snapshotObjectClass(object.Path)), object)
+		if err != nil {
+			return err
+		}
+	}
+
+	if fileIndex == nil {
+		return fmt.Errorf("%w: file index is missing", ErrSnapshotManifestInvalid)
+	}
+	return restoreObject(ctx, src, dst.withObjectClass(fs, ObjectClassMeta), *fileIndex)
+}
+
+func snapshotObjectClass(objectPath string) ObjectClass {
+	switch {
+	case strings.HasPrefix(objectPath, IndexesDirectory+"/"):
+		return ObjectClassIndex
+	case strings.HasPrefix(objectPath, PresenceDirectory+"/"), objectPath == DatasetSchemaFileName, objectPath == DatasetManifestFileName,
+		objectPath == DatasetDictionaryFileName:
+		return ObjectClassMeta
+	default:
+		return ObjectClassData
+	}
+}
+
+func restoreObject(ctx context.Context, src, fs storage.FS, object SnapshotObject) error {
+	if len(object.Digest) < 2 {
+		return fmt.Errorf("%w: object %s has invalid digest", ErrSnapshotManifestInvalid, object.Path)
+	}
+
+	data, err := readObject(ctx, src, snapshotObjectPath(object.Digest))
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot object %s: %w", object.Path, err)
+	}
+
+	hash := sha256.Sum256(data)
+	if hex.EncodeToString(hash[:]) != object.Digest || int64(len(data)) != object.Size {
+		return fmt.Errorf("%w: %s", ErrSnapshotDigestMismatch, object.Path)
+	}
+
+	file, err := fs.Create(ctx, object.Path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", object.Path, err)
+	}
+
+	_, err = io.Copy(file, bytes.NewReader(data))
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write %s: %w", object.Path, err)
+	}
+	return file.Close()
+}
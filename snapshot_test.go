@@ -0,0 +1,174 @@
+package ethwal
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+// createdPathsFS records the paths of the created objects.
+type createdPathsFS struct {
+	storage.FS
+
+	mu      sync.Mutex
+	created []string
+}
+
+func (c *createdPathsFS) Create(ctx context.Context, path string, options *gostorage.WriterOptions) (io.WriteCloser, error) {
+	c.mu.Lock()
+	c.created = append(c.created, path)
+	c.mu.Unlock()
+	return c.FS.Create(ctx, path, options)
+}
+
+func restoreAndCheck(t *testing.T, dst storage.FS, manifest SnapshotManifest, indexerOpt IndexerOptions[[]int]) {
+	opt := Options{Dataset: Dataset{Path: "restored"}, FileSystem: gostorage.NewMemoryFS()}
+	require.NoError(t, Restore(context.Background(), dst, manifest, opt))
+
+	indexerOpt.Dataset = opt.Dataset
+	indexerOpt.FileSystem = opt.FileSystem
+	require.NoError(t, CheckInvariants(context.Background(), opt, indexerOpt))
+
+	r, err := NewReader[[]int](opt)
+	require.NoError(t, err)
+	defer r.Close()
+
+	blocks := generateMixedIntBlocks()
+	for _, expected := range blocks[:manifest.CutBlockNum] {
+		b, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, expected, b)
+	}
+	_, err = r.Read(context.Background())
+	require.ErrorIs(t, err, io.EOF)
+
+	f, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset:    opt.Dataset,
+		FileSystem: opt.FileSystem,
+		Indexes:    indexerOpt.Indexes,
+	})
+	require.NoError(t, err)
+
+	var expectedOdd []uint64
+	for blockNum := uint64(21); blockNum <= min(40, manifest.CutBlockNum); blockNum++ {
+		expectedOdd = append(expectedOdd, blockNum)
+	}
+
+	var odd []uint64
+	for _, id := range f.Eq("only_odd", "true").Eval(context.Background()).Bitmap().ToArray() {
+		odd = append(odd, IndexCompoundID(id).BlockNumber())
+	}
+	require.Equal(t, expectedOdd, odd)
+
+	require.ErrorIs(t, Restore(context.Background(), dst, manifest, opt), ErrSnapshotTargetNotEmpty)
+}
+
+func TestSnapshot(t *testing.T) {
+	src := gostorage.NewMemoryFS()
+	opt := Options{
+		Dataset:        Dataset{Path: "ethwal"},
+		FileSystem:     src,
+		FileRollPolicy: NewLastBlockNumberRollPolicy(10),
+		TrackPresence:  true,
+	}
+	indexerOpt := IndexerOptions[[]int]{
+		Dataset:    opt.Dataset,
+		FileSystem: src,
+		Indexes:    generateMixedIntIndexes(),
+	}
+
+	w, err := NewWriter[[]int](opt)
+	require.NoError(t, err)
+	defer w.Close(context.Background())
+
+	indexer, err := NewIndexer(context.Background(), indexerOpt)
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	// the indexes are ahead of the rolled files, as if the ingestion was running
+	ingest := func(blocks []Block[[]int]) {
+		for _, b := range blocks {
+			require.NoError(t, w.Write(context.Background(), b))
+			require.NoError(t, indexer.Index(context.Background(), b))
+		}
+		require.NoError(t, indexer.Flush(context.Background()))
+	}
+
+	blocks := generateMixedIntBlocks()
+	ingest(blocks[:35])
+	require.ErrorIs(t, CheckInvariants(context.Background(), opt, indexerOpt), ErrInvariantViolated)
+
+	dst := &createdPathsFS{FS: gostorage.NewMemoryFS()}
+
+	first, err := Snapshot(context.Background(), opt, dst, SnapshotOptions{}, indexerOpt)
+	require.NoError(t, err)
+	require.Equal(t, uint64(30), first.CutBlockNum)
+
+	stored, err := ReadSnapshotManifest(context.Background(), dst, first.Path())
+	require.NoError(t, err)
+	require.Equal(t, first.CutBlockNum, stored.CutBlockNum)
+	require.Equal(t, first.Objects, stored.Objects)
+
+	restoreAndCheck(t, dst, first, indexerOpt)
+
+	t.Run("incremental", func(t *testing.T) {
+		ingest(blocks[35:55])
+		dst.created = nil
+
+		var pauses, resumes int
+		second, err := Snapshot(context.Background(), opt, dst, SnapshotOptions{
+			Previous: &first,
+			Pause: func(ctx context.Context) (func(), error) {
+				pauses++
+				return func() { resumes++ }, nil
+			},
+		}, indexerOpt)
+		require.NoError(t, err)
+		require.Equal(t, 1, pauses)
+		require.Equal(t, 1, resumes)
+		require.Equal(t, uint64(50), second.CutBlockNum)
+
+		// the files of the previous snapshot are not copied again
+		previousDigests := make(map[string]bool)
+		for _, object := range first.Objects {
+			previousDigests[object.Digest] = true
+		}
+		for _, created := range dst.created {
+			if strings.HasPrefix(created, SnapshotObjectsDirectory+"/") {
+				require.False(t, previousDigests[created[strings.LastIndex(created, "/")+1:]], created)
+			}
+		}
+
+		var numFiles int
+		for _, object := range second.Objects {
+			if !strings.HasPrefix(object.Path, ".") {
+				numFiles++
+			}
+		}
+		require.Equal(t, 5, numFiles)
+
+		restoreAndCheck(t, dst, second, indexerOpt)
+
+		// the previous snapshot is still restorable
+		restoreAndCheck(t, dst, first, indexerOpt)
+	})
+
+	t.Run("digest_mismatch", func(t *testing.T) {
+		object := first.Objects[0]
+
+		file, err := dst.Create(context.Background(), snapshotObjectPath(object.Digest), nil)
+		require.NoError(t, err)
+		_, err = file.Write([]byte("corrupted"))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		err = Restore(context.Background(), dst, first, Options{Dataset: Dataset{Path: "restored"}, FileSystem: gostorage.NewMemoryFS()})
+		require.ErrorIs(t, err, ErrSnapshotDigestMismatch)
+	})
+}
@@ -0,0 +1,175 @@
+package ethwal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+// Status is the dataset status used by health checks.
+type Status struct {
+	// HeadBlockNum is the last block number stored in the dataset.
+	HeadBlockNum uint64 `json:"headBlockNum"`
+	// TailBlockNum is the last block number stored in the tail, beyond the head, 0 if there's no tail.
+	TailBlockNum uint64 `json:"tailBlockNum,omitempty"`
+	// FileCount is the number of the files of the dataset.
+	FileCount int `json:"fileCount"`
+	// GapCount is the number of the block ranges between the files that aren't covered by any file. The
+	// blocks missing within the files aren't counted, see FindGaps.
+	GapCount int `json:"gapCount,omitempty"`
+	// UpdatedAt is the last modification time of the file index or the tail, the last sign of life of the
+	// writer.
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Indexes contains the last block number indexed by each index.
+	Indexes map[IndexName]uint64 `json:"indexes,omitempty"`
+}
+
+// DatasetStatus returns the dataset head and the last block numbers indexed by the indexes. It reads
+// only the file index, the tail header and one small object per index, so it's cheap enough to be called
+// by probes.
+func DatasetStatus[T any](ctx context.Context, opt Options, indexerOpt ...IndexerOptions[T]) (Status, error) {
+	// apply default options on uninitialized fields
+	opt = opt.WithDefaults()
+
+	if opt.Dataset.Path == "" {
+		return Status{}, fmt.Errorf("path cannot be empty")
+	}
+
+	// mount FS with dataset path prefix
+	fs := storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath())
+
+	// load file index
+	fileIndex := NewFileIndex(fs)
+	err := fileIndex.Load(ctx)
+	if err != nil {
+		return Status{}, fmt.Errorf("failed to load file index: %w", err)
+	}
+
+	var status Status
+	files := fileIndex.Files()
+	if len(files) > 0 {
+		status.HeadBlockNum = files[len(files)-1].LastBlockNum
+	}
+	status.FileCount = len(files)
+	for i := 1; i < len(files); i++ {
+		if files[i].FirstBlockNum > files[i-1].LastBlockNum+1 {
+			status.GapCount++
+		}
+	}
+
+	tailBlockNum, ok, err := readTailLastBlockNum(ctx, fs)
+	if err != nil {
+		return Status{}, err
+	}
+	if ok && tailBlockNum > status.HeadBlockNum {
+		status.TailBlockNum = tailBlockNum
+	}
+
+	markers := []string{FileIndexFileName}
+	if ok {
+		markers = append(markers, TailFileName)
+	}
+	for _, marker := range markers {
+		attrs, err := fs.Attributes(ctx, marker, nil)
+		if storage.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return Status{}, fmt.Errorf("failed to read attributes of %s: %w", marker, err)
+		}
+		if attrs.ModTime.After(status.UpdatedAt) {
+			status.UpdatedAt = attrs.ModTime
+		}
+	}
+
+	for _, iOpt := range indexerOpt {
+		iOpt = iOpt.WithDefaults()
+
+		// mount indexes directory
+		indexFs := storage.NewPrefixWrapper(iOpt.FileSystem, fmt.Sprintf("%s/", path.Join(iOpt.Dataset.FullPath(), IndexesDirectory)))
+
+		for name, index := range iOpt.Indexes {
+			// always read the persisted value
+			index.numBlocksIndexed = nil
+
+			lastBlockNum, err := index.LastBlockNumIndexed(ctx, indexFs)
+			if err != nil {
+				return Status{}, fmt.Errorf("failed to get last block number indexed for %s: %w", name, err)
+			}
+
+			if status.Indexes == nil {
+				status.Indexes = make(map[IndexName]uint64)
+			}
+			status.Indexes[name] = lastBlockNum
+		}
+	}
+	return status, nil
+}
+
+// HeadBlockTime returns the number and the timestamp of the last block stored in the dataset, including
+// the tail. It decodes the tail or the last file, so it's called only when the head changes, e.g. by the
+// monitor polling DatasetStatus. The empty dataset has no head block, its number is 0.
+func HeadBlockTime(ctx context.Context, opt Options) (uint64, time.Time, error) {
+	// apply default options on uninitialized fields
+	opt = opt.WithDefaults()
+
+	// mount FS with dataset path prefix
+	fs := storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath())
+
+	var head Block[skippedData]
+	tailBlocks, err := readTail[skippedData](ctx, fs, opt)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if len(tailBlocks) > 0 {
+		head = tailBlocks[len(tailBlocks)-1]
+	}
+
+	fileIndex := NewFileIndex(fs)
+	err = fileIndex.Load(ctx)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to load file index: %w", err)
+	}
+
+	// the tail ahead of the files has the head block
+	files := fileIndex.Files()
+	if len(files) > 0 && files[len(files)-1].LastBlockNum > head.Number {
+		lastFile := files[len(files)-1]
+		err = decodeFile(ctx, opt, fs, lastFile, func(b Block[skippedData]) error {
+			head = b
+			if b.Number == lastFile.LastBlockNum {
+				return io.EOF
+			}
+			return nil
+		})
+		if err != nil && err != io.EOF {
+			return 0, time.Time{}, fmt.Errorf("file[%d-%d]: %w", lastFile.FirstBlockNum, lastFile.LastBlockNum, err)
+		}
+	}
+
+	if head.Number == 0 && head.TS == 0 {
+		return 0, time.Time{}, nil
+	}
+	return head.Number, time.Unix(int64(head.TS), 0), nil
+}
+
+// NewDatasetStatusHandler returns http.Handler that serves DatasetStatus as JSON. It responds with
+// http.StatusServiceUnavailable if the status can't be read.
+func NewDatasetStatusHandler[T any](opt Options, indexerOpt ...IndexerOptions[T]) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, err := DatasetStatus(r.Context(), opt, indexerOpt...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status)
+	})
+}
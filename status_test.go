@@ -0,0 +1,114 @@
+package ethwal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/local"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+// countingFS counts the number of files opened.
+type countingFS struct {
+	storage.FS
+
+	opens atomic.Int64
+}
+
+func (c *countingFS) Open(ctx context.Context, path string, options *gostorage.ReaderOptions) (*gostorage.File, error) {
+	c.opens.Add(1)
+	return c.FS.Open(ctx, path, options)
+}
+
+func TestDatasetStatus(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	blocks := generateMixedIntBlocks()
+
+	writeDataset := func(t *testing.T, datasetPath string, blocks []Block[[]int]) {
+		indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+			Dataset: Dataset{Path: datasetPath},
+			Indexes: generateMixedIntIndexes(),
+		})
+		require.NoError(t, err)
+
+		w, err := NewWriter[[]int](Options{
+			Dataset:         Dataset{Path: datasetPath},
+			FileRollPolicy:  NewLastBlockNumberRollPolicy(1),
+			FileRollOnClose: true,
+		})
+		require.NoError(t, err)
+
+		wi, err := NewWriterWithIndexer(w, indexer)
+		require.NoError(t, err)
+
+		for _, b := range blocks {
+			require.NoError(t, wi.Write(context.Background(), b))
+		}
+		require.NoError(t, wi.Close(context.Background()))
+	}
+
+	status := func(t *testing.T, datasetPath string) (Status, int64) {
+		fs := &countingFS{FS: local.NewLocalFS("")}
+
+		s, err := DatasetStatus(context.Background(), Options{
+			Dataset:    Dataset{Path: datasetPath},
+			FileSystem: fs,
+		}, IndexerOptions[[]int]{
+			Dataset:    Dataset{Path: datasetPath},
+			FileSystem: fs,
+			Indexes:    generateMixedIntIndexes(),
+		})
+		require.NoError(t, err)
+		return s, fs.opens.Load()
+	}
+
+	smallPath := path.Join(testPath, "small")
+	writeDataset(t, smallPath, blocks[:10])
+
+	largePath := path.Join(testPath, "large")
+	writeDataset(t, largePath, blocks)
+
+	smallStatus, smallOpens := status(t, smallPath)
+	require.Equal(t, uint64(10), smallStatus.HeadBlockNum)
+	require.Len(t, smallStatus.Indexes, 4)
+
+	largeStatus, largeOpens := status(t, largePath)
+	require.Equal(t, uint64(70), largeStatus.HeadBlockNum)
+	require.Equal(t, map[IndexName]uint64{
+		"all":       70,
+		"odd_even":  70,
+		"only_even": 70,
+		"only_odd":  70,
+	}, largeStatus.Indexes)
+	require.Equal(t, 70, largeStatus.FileCount)
+	require.Zero(t, largeStatus.GapCount)
+	require.WithinDuration(t, time.Now(), largeStatus.UpdatedAt, time.Minute)
+
+	// the number of reads doesn't depend on the number of files
+	require.Equal(t, smallOpens, largeOpens)
+
+	// http handler
+	rec := httptest.NewRecorder()
+	NewDatasetStatusHandler[[]int](Options{Dataset: Dataset{Path: largePath}}).
+		ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var served Status
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&served))
+	require.Equal(t, uint64(70), served.HeadBlockNum)
+	require.Equal(t, 70, served.FileCount)
+	require.True(t, largeStatus.UpdatedAt.Equal(served.UpdatedAt))
+	require.Empty(t, served.Indexes)
+}
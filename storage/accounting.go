@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/Shopify/go-storage"
+)
+
+// ClassifyFunc returns the accounting class of the object at the path. The path is the full path seen by the
+// accounting wrapper, including the prefixes of the wrappers above it.
+type ClassifyFunc func(path string) string
+
+// OperationStats are the operation counters of the object class.
+type OperationStats struct {
+	Opens        uint64
+	Creates      uint64
+	Attributes   uint64
+	Deletes      uint64
+	Walks        uint64
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// Accounting counts the operations and bytes of the accounting wrappers per object class.
+type Accounting struct {
+	classify ClassifyFunc
+
+	mu      sync.Mutex
+	classes map[string]*OperationStats
+}
+
+// NewAccounting creates the accounting classifying the objects by classify. If classify is nil, all objects
+// are counted under the empty class.
+func NewAccounting(classify ClassifyFunc) *Accounting {
+	if classify == nil {
+		classify = func(string) string { return "" }
+	}
+	return &Accounting{classify: classify, classes: make(map[string]*OperationStats)}
+}
+
+// Snapshot returns the counters per object class.
+func (a *Accounting) Snapshot() map[string]OperationStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	snapshot := make(map[string]OperationStats, len(a.classes))
+	for class, stats := range a.classes {
+		snapshot[class] = *stats
+	}
+	return snapshot
+}
+
+// SnapshotAndReset returns the counters per object class and resets them, so that the periodic exports
+// get the counters of the period.
+func (a *Accounting) SnapshotAndReset() map[string]OperationStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	snapshot := make(map[string]OperationStats, len(a.classes))
+	for class, stats := range a.classes {
+		snapshot[class] = *stats
+	}
+	a.classes = make(map[string]*OperationStats)
+	return snapshot
+}
+
+func (a *Accounting) count(path string, fn func(stats *OperationStats)) {
+	class := a.classify(path)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats, ok := a.classes[class]
+	if !ok {
+		stats = &OperationStats{}
+		a.classes[class] = stats
+	}
+	fn(stats)
+}
+
+// NewAccountingWrapper creates the file system which counts the operations on fs in accounting. The range
+// reads are passed through if fs implements RangeReader.
+func NewAccountingWrapper(fs FS, accounting *Accounting) FS {
+	wrapped := &accountingWrapper{fs: fs, accounting: accounting}
+	if rr, ok := fs.(RangeReader); ok {
+		return &accountingRangeWrapper{accountingWrapper: wrapped, rr: rr}
+	}
+	return wrapped
+}
+
+// IsAccounted reports whether fs is the accounting wrapper counting in accounting.
+func IsAccounted(fs FS, accounting *Accounting) bool {
+	switch a := fs.(type) {
+	case *accountingWrapper:
+		return a.accounting == accounting
+	case *accountingRangeWrapper:
+		return a.accounting == accounting
+	}
+	return false
+}
+
+type accountingWrapper struct {
+	fs         FS
+	accounting *Accounting
+}
+
+func (a *accountingWrapper) Open(ctx context.Context, path string, options *storage.ReaderOptions) (*storage.File, error) {
+	a.accounting.count(path, func(stats *OperationStats) { stats.Opens++ })
+
+	file, err := a.fs.Open(ctx, path, options)
+	if err != nil {
+		return nil, err
+	}
+	file.ReadCloser = &accountingReader{ReadCloser: file.ReadCloser, accounting: a.accounting, path: path}
+	return file, nil
+}
+
+func (a *accountingWrapper) Attributes(ctx context.Context, path string, options *storage.ReaderOptions) (*storage.Attributes, error) {
+	a.accounting.count(path, func(stats *OperationStats) { stats.Attributes++ })
+	return a.fs.Attributes(ctx, path, options)
+}
+
+func (a *accountingWrapper) Create(ctx context.Context, path string, options *storage.WriterOptions) (io.WriteCloser, error) {
+	a.accounting.count(path, func(stats *OperationStats) { stats.Creates++ })
+
+	w, err := a.fs.Create(ctx, path, options)
+	if err != nil {
+		return nil, err
+	}
+	return &accountingWriter{WriteCloser: w, accounting: a.accounting, path: path}, nil
+}
+
+func (a *accountingWrapper) Delete(ctx context.Context, path string) error {
+	a.accounting.count(path, func(stats *OperationStats) { stats.Deletes++ })
+	return a.fs.Delete(ctx, path)
+}
+
+func (a *accountingWrapper) Walk(ctx context.Context, path string, fn storage.WalkFn) error {
+	a.accounting.count(path, func(stats *OperationStats) { stats.Walks++ })
+	return a.fs.Walk(ctx, path, fn)
+}
+
+func (a *accountingWrapper) URL(ctx context.Context, path string, options *storage.SignedURLOptions) (string, error) {
+	return a.fs.URL(ctx, path, options)
+}
+
+type accountingRangeWrapper struct {
+	*accountingWrapper
+	rr RangeReader
+}
+
+func (a *accountingRangeWrapper) OpenRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	a.accounting.count(path, func(stats *OperationStats) { stats.Opens++ })
+
+	rdr, err := a.rr.OpenRange(ctx, path, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return &accountingReader{ReadCloser: rdr, accounting: a.accounting, path: path}, nil
+}
+
+type accountingReader struct {
+	io.ReadCloser
+
+	accounting *Accounting
+	path       string
+}
+
+func (a *accountingReader) Read(p []byte) (int, error) {
+	n, err := a.ReadCloser.Read(p)
+	if n > 0 {
+		a.accounting.count(a.path, func(stats *OperationStats) { stats.BytesRead += uint64(n) })
+	}
+	return n, err
+}
+
+type accountingWriter struct {
+	io.WriteCloser
+
+	accounting *Accounting
+	path       string
+}
+
+func (a *accountingWriter) Write(p []byte) (int, error) {
+	n, err := a.WriteCloser.Write(p)
+	if n > 0 {
+		a.accounting.count(a.path, func(stats *OperationStats) { stats.BytesWritten += uint64(n) })
+	}
+	return n, err
+}
+
+// Unwrap returns the file system wrapped by the accounting wrapper, other file systems are returned as is.
+func Unwrap(fs FS) FS {
+	switch a := fs.(type) {
+	case *accountingWrapper:
+		return a.fs
+	case *accountingRangeWrapper:
+		return a.fs
+	}
+	return fs
+}
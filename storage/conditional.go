@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Shopify/go-storage"
+)
+
+var ErrPreconditionFailed = fmt.Errorf("precondition failed")
+
+// maxUpdateAttempts is the number of times Update reads and writes the object that keeps changing.
+const maxUpdateAttempts = 8
+
+// ConditionalWriter is implemented by the file systems that can replace the object only if it hasn't changed
+// since it was read, e.g. the generation preconditions of the cloud storage.
+type ConditionalWriter interface {
+	// ReadVersion reads the object and its version, the missing object has no data and version 0.
+	ReadVersion(ctx context.Context, path string) ([]byte, int64, error)
+	// CreateIfVersion writes the object if its version is version, it fails with ErrPreconditionFailed
+	// otherwise.
+	CreateIfVersion(ctx context.Context, path string, data []byte, version int64, options *storage.WriterOptions) error
+}
+
+// ReadVersion reads the object and its version with the ConditionalWriter of the file system, it fails with
+// ErrNotImplemented if the file system doesn't implement it.
+func ReadVersion(ctx context.Context, fs FS, path string) ([]byte, int64, error) {
+	if cw, ok := fs.(ConditionalWriter); ok {
+		return cw.ReadVersion(ctx, path)
+	}
+	// the accounting wrapper doesn't count the conditional writes
+	if cw, ok := Unwrap(fs).(ConditionalWriter); ok {
+		return cw.ReadVersion(ctx, path)
+	}
+	return nil, 0, notImplemented("read version", path)
+}
+
+// CreateIfVersion writes the object if its version is version with the ConditionalWriter of the file system,
+// it fails with ErrNotImplemented if the file system doesn't implement it.
+func CreateIfVersion(ctx context.Context, fs FS, path string, data []byte, version int64, options *storage.WriterOptions) error {
+	if cw, ok := fs.(ConditionalWriter); ok {
+		return cw.CreateIfVersion(ctx, path, data, version, options)
+	}
+	if cw, ok := Unwrap(fs).(ConditionalWriter); ok {
+		return cw.CreateIfVersion(ctx, path, data, version, options)
+	}
+	return notImplemented("create if version", path)
+}
+
+// CreateIfNotExist writes the object if it doesn't exist, it fails with ErrPreconditionFailed otherwise. The file
+// systems without the ConditionalWriter check the existence before the write, which narrows the race of the
+// concurrent writers but doesn't close it.
+func CreateIfNotExist(ctx context.Context, fs FS, path string, data []byte) error {
+	err := CreateIfVersion(ctx, fs, path, data, 0, nil)
+	if !errors.Is(err, ErrNotImplemented) {
+		return err
+	}
+
+	_, err = fs.Attributes(ctx, path, nil)
+	if err == nil {
+		return fmt.Errorf("%s: %w: already exists", path, ErrPreconditionFailed)
+	}
+	if !IsNotExist(err) {
+		return err
+	}
+	return writeAll(ctx, fs, path, data)
+}
+
+// Update replaces the object with the data returned by update for its current data, nil if it doesn't
+// exist, update returns nil to keep the object. The object that changed since it was read is read and
+// updated again, with the ConditionalWriter where the file system implements it. Elsewhere the written
+// object is read back and updated again if another writer replaced it, which narrows the race of the
+// concurrent writers but doesn't close it.
+func Update(ctx context.Context, fs FS, path string, update func(data []byte) ([]byte, error)) error {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		current, version, err := ReadVersion(ctx, fs, path)
+		if errors.Is(err, ErrNotImplemented) {
+			return updateUnconditionally(ctx, fs, path, update)
+		}
+		if err != nil {
+			return err
+		}
+
+		data, err := update(current)
+		if err != nil || data == nil {
+			return err
+		}
+
+		err = CreateIfVersion(ctx, fs, path, data, version, nil)
+		if errors.Is(err, ErrPreconditionFailed) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("%s: %w: changed by %d attempts", path, ErrPreconditionFailed, maxUpdateAttempts)
+}
+
+// updateUnconditionally updates the object and reads it back, the update is repeated if another writer
+// replaced the object in between.
+func updateUnconditionally(ctx context.Context, fs FS, path string, update func(data []byte) ([]byte, error)) error {
+	current, err := readAll(ctx, fs, path)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		data, err := update(current)
+		if err != nil || data == nil {
+			return err
+		}
+
+		err = writeAll(ctx, fs, path, data)
+		if err != nil {
+			return err
+		}
+
+		current, err = readAll(ctx, fs, path)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(current, data) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %w: changed by %d attempts", path, ErrPreconditionFailed, maxUpdateAttempts)
+}
+
+// readAll reads the object, the missing object has no data.
+func readAll(ctx context.Context, fs FS, path string) ([]byte, error) {
+	file, err := fs.Open(ctx, path, nil)
+	if IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+func writeAll(ctx context.Context, fs FS, path string, data []byte) error {
+	file, err := fs.Create(ctx, path, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"io"
+)
+
+// Copier is implemented by the file systems that can copy the object within the storage without
+// transferring its data, e.g. the server-side copy of the cloud storage.
+type Copier interface {
+	Copy(ctx context.Context, srcPath, dstPath string) error
+}
+
+// Copy copies the object at srcPath to dstPath. The objects of the file systems that don't implement
+// Copier are read and written through the file system.
+func Copy(ctx context.Context, fs FS, srcPath, dstPath string) error {
+	if c, ok := fs.(Copier); ok {
+		return c.Copy(ctx, srcPath, dstPath)
+	}
+
+	src, err := fs.Open(ctx, srcPath, nil)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := fs.Create(ctx, dstPath, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// Renamer is implemented by the file systems that can move the object atomically, e.g. the local file
+// system.
+type Renamer interface {
+	Rename(ctx context.Context, srcPath, dstPath string) error
+}
+
+// Rename moves the object at srcPath to dstPath. The objects of the file systems that don't implement
+// Renamer are copied, see Copy, and deleted.
+func Rename(ctx context.Context, fs FS, srcPath, dstPath string) error {
+	if r, ok := fs.(Renamer); ok {
+		return r.Rename(ctx, srcPath, dstPath)
+	}
+	// the accounting wrapper doesn't count the renames
+	if r, ok := Unwrap(fs).(Renamer); ok {
+		return r.Rename(ctx, srcPath, dstPath)
+	}
+
+	err := Copy(ctx, fs, srcPath, dstPath)
+	if err != nil {
+		return err
+	}
+	return fs.Delete(ctx, srcPath)
+}
@@ -1,7 +1,14 @@
 package storage
 
-import "github.com/Shopify/go-storage"
+import (
+	"errors"
+	"io/fs"
 
+	"github.com/Shopify/go-storage"
+)
+
+// IsNotExist reports whether the error reports the missing object, either by the go-storage file systems
+// or by wrapping fs.ErrNotExist.
 func IsNotExist(err error) bool {
-	return storage.IsNotExist(err)
+	return storage.IsNotExist(err) || errors.Is(err, fs.ErrNotExist)
 }
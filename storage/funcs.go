@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Shopify/go-storage"
+)
+
+// ErrNotImplemented is returned by the operations of the file system created by FSFromFuncs without
+// the function of the operation.
+var ErrNotImplemented = storage.ErrNotImplemented
+
+// OpenFunc opens the object at the path for reading.
+type OpenFunc func(ctx context.Context, path string) (io.ReadCloser, error)
+
+// CreateFunc creates or replaces the object at the path, the object must be stored once the writer is closed.
+type CreateFunc func(ctx context.Context, path string) (io.WriteCloser, error)
+
+// StatFunc returns the size and the modification time of the object at the path.
+type StatFunc func(ctx context.Context, path string) (size int64, modTime time.Time, err error)
+
+// DeleteFunc deletes the object at the path.
+type DeleteFunc func(ctx context.Context, path string) error
+
+// WalkFunc calls fn with the path of every object whose path starts with the prefix. The walk stops with
+// the first error returned by fn.
+type WalkFunc func(ctx context.Context, prefix string, fn func(path string) error) error
+
+// FSFromFuncs creates the file system from the functions of the embedding system, e.g. the one storing the
+// objects in its database. The functions must report the missing objects with the errors wrapping
+// fs.ErrNotExist. The operations of the nil functions fail with ErrNotImplemented, the functions required by
+// the ethwal components are:
+//   - Writer: open, create, stat and delete, walk to create the dataset without the file index,
+//   - Reader: open and stat, walk to read the dataset without the file index,
+//   - Indexer and FilterBuilder: open and create, SealIndexes: walk and delete,
+//   - FileIndex.Load: open, walk if the file index doesn't exist, FileIndex.Save: create,
+//   - ListFiles, ListDatasets, Snapshot, CheckInvariants and Index.IndexStats: walk, DeleteDataset: walk and delete.
+//
+// The object attributes other than the size and the modification time, e.g. the object metadata, are not
+// stored, and the files opened by Open have no attributes. The cache of Dataset.CachePath is not supported,
+// it recognizes the missing objects by the go-storage errors only.
+func FSFromFuncs(open OpenFunc, create CreateFunc, stat StatFunc, delete DeleteFunc, walk WalkFunc) FS {
+	return &funcFS{open: open, create: create, stat: stat, delete: delete, walk: walk}
+}
+
+type funcFS struct {
+	open   OpenFunc
+	create CreateFunc
+	stat   StatFunc
+	delete DeleteFunc
+	walk   WalkFunc
+}
+
+func notImplemented(op, path string) error {
+	return fmt.Errorf("%s %s: %w", op, path, ErrNotImplemented)
+}
+
+func (f *funcFS) Open(ctx context.Context, path string, options *storage.ReaderOptions) (*storage.File, error) {
+	if f.open == nil {
+		return nil, notImplemented("open", path)
+	}
+
+	rdr, err := f.open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.File{ReadCloser: rdr}, nil
+}
+
+func (f *funcFS) Attributes(ctx context.Context, path string, options *storage.ReaderOptions) (*storage.Attributes, error) {
+	if f.stat == nil {
+		return nil, notImplemented("stat", path)
+	}
+
+	size, modTime, err := f.stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.Attributes{Size: size, ModTime: modTime}, nil
+}
+
+func (f *funcFS) Create(ctx context.Context, path string, options *storage.WriterOptions) (io.WriteCloser, error) {
+	if f.create == nil {
+		return nil, notImplemented("create", path)
+	}
+	return f.create(ctx, path)
+}
+
+func (f *funcFS) Delete(ctx context.Context, path string) error {
+	if f.delete == nil {
+		return notImplemented("delete", path)
+	}
+	return f.delete(ctx, path)
+}
+
+func (f *funcFS) Walk(ctx context.Context, path string, fn storage.WalkFn) error {
+	if f.walk == nil {
+		return notImplemented("walk", path)
+	}
+	return f.walk(ctx, path, fn)
+}
+
+func (f *funcFS) URL(ctx context.Context, path string, options *storage.SignedURLOptions) (string, error) {
+	return "", notImplemented("url", path)
+}
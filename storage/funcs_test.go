@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+type mapWriter struct {
+	bytes.Buffer
+	close func(data []byte)
+}
+
+func (w *mapWriter) Close() error {
+	w.close(bytes.Clone(w.Bytes()))
+	return nil
+}
+
+// newMapFuncFS creates the func file system of the objects stored in the map.
+func newMapFuncFS() FS {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	modTimes := make(map[string]time.Time)
+
+	return FSFromFuncs(
+		func(ctx context.Context, path string) (io.ReadCloser, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			data, ok := objects[path]
+			if !ok {
+				return nil, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+			}
+			return io.NopCloser(bytes.NewReader(data)), nil
+		},
+		func(ctx context.Context, path string) (io.WriteCloser, error) {
+			return &mapWriter{close: func(data []byte) {
+				mu.Lock()
+				defer mu.Unlock()
+				objects[path], modTimes[path] = data, time.Now()
+			}}, nil
+		},
+		func(ctx context.Context, path string) (int64, time.Time, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			data, ok := objects[path]
+			if !ok {
+				return 0, time.Time{}, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+			}
+			return int64(len(data)), modTimes[path], nil
+		},
+		func(ctx context.Context, path string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := objects[path]; !ok {
+				return fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+			}
+			delete(objects, path)
+			delete(modTimes, path)
+			return nil
+		},
+		func(ctx context.Context, prefix string, fn func(path string) error) error {
+			mu.Lock()
+			var paths []string
+			for path := range objects {
+				if strings.HasPrefix(path, prefix) {
+					paths = append(paths, path)
+				}
+			}
+			mu.Unlock()
+
+			slices.Sort(paths)
+			for _, path := range paths {
+				if err := fn(path); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	)
+}
+
+func writeObject(t *testing.T, fs FS, path string, data string) {
+	w, err := fs.Create(context.Background(), path, nil)
+	require.NoError(t, err)
+	_, err = w.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+}
+
+func readObject(t *testing.T, fs FS, path string) string {
+	file, err := fs.Open(context.Background(), path, nil)
+	require.NoError(t, err)
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	require.NoError(t, err)
+	return string(data)
+}
+
+// testFSContract checks the behaviour of the file system ethwal relies on.
+func testFSContract(t *testing.T, fs FS) {
+	ctx := context.Background()
+
+	_, err := fs.Open(ctx, "a/missing", nil)
+	require.True(t, IsNotExist(err))
+	_, err = fs.Attributes(ctx, "a/missing", nil)
+	require.True(t, IsNotExist(err))
+
+	writeObject(t, fs, "a/1", "one")
+	writeObject(t, fs, "a/2", "two")
+	writeObject(t, fs, "b/1", "three")
+	require.Equal(t, "one", readObject(t, fs, "a/1"))
+
+	attrs, err := fs.Attributes(ctx, "a/2", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), attrs.Size)
+	require.False(t, attrs.ModTime.IsZero())
+
+	// create replaces the object
+	writeObject(t, fs, "a/1", "replaced")
+	require.Equal(t, "replaced", readObject(t, fs, "a/1"))
+
+	var walked []string
+	require.NoError(t, fs.Walk(ctx, "a/", func(path string) error {
+		walked = append(walked, path)
+		return nil
+	}))
+	slices.Sort(walked)
+	require.Equal(t, []string{"a/1", "a/2"}, walked)
+
+	stop := fmt.Errorf("stop")
+	require.ErrorIs(t, fs.Walk(ctx, "", func(path string) error { return stop }), stop)
+
+	require.NoError(t, fs.Delete(ctx, "a/1"))
+	_, err = fs.Open(ctx, "a/1", nil)
+	require.True(t, IsNotExist(err))
+
+	require.NoError(t, Copy(ctx, fs, "a/2", "c/2"))
+	require.Equal(t, "two", readObject(t, fs, "c/2"))
+	require.True(t, IsNotExist(Copy(ctx, fs, "a/1", "c/1")))
+
+	// the prefix wrapper used for the datasets
+	prefixed := NewPrefixWrapper(fs, "b/")
+	require.Equal(t, "three", readObject(t, prefixed, "1"))
+}
+
+func TestFSFromFuncs(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testFSContract(t, storage.NewMemoryFS())
+	})
+
+	t.Run("funcs", func(t *testing.T) {
+		testFSContract(t, newMapFuncFS())
+	})
+
+	t.Run("accounting", func(t *testing.T) {
+		testFSContract(t, NewAccountingWrapper(newMapFuncFS(), NewAccounting(nil)))
+	})
+
+	t.Run("not_implemented", func(t *testing.T) {
+		fs := FSFromFuncs(nil, nil, nil, nil, nil)
+
+		_, err := fs.Open(context.Background(), "a", nil)
+		require.ErrorIs(t, err, ErrNotImplemented)
+		require.False(t, IsNotExist(err))
+		_, err = fs.Create(context.Background(), "a", nil)
+		require.ErrorIs(t, err, ErrNotImplemented)
+		_, err = fs.Attributes(context.Background(), "a", nil)
+		require.ErrorIs(t, err, ErrNotImplemented)
+		require.ErrorIs(t, fs.Delete(context.Background(), "a"), ErrNotImplemented)
+		require.ErrorIs(t, fs.Walk(context.Background(), "", func(string) error { return nil }), ErrNotImplemented)
+		_, err = fs.URL(context.Background(), "a", nil)
+		require.ErrorIs(t, err, ErrNotImplemented)
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	fs := NewPrefixWrapper(storage.NewMemoryFS(), "prefix/")
+
+	increment := func(data []byte) ([]byte, error) {
+		if len(data) > 0 && data[0] >= 2 {
+			return nil, nil
+		}
+		return []byte{byte(len(data)) + 1}, nil
+	}
+
+	// the file systems without the conditional writes are updated and read back
+	_, _, err := ReadVersion(context.Background(), fs, "counter")
+	require.ErrorIs(t, err, ErrNotImplemented)
+
+	require.NoError(t, Update(context.Background(), fs, "counter", increment))
+	require.NoError(t, Update(context.Background(), fs, "counter", func(data []byte) ([]byte, error) {
+		return []byte{data[0] + 1}, nil
+	}))
+	require.NoError(t, Update(context.Background(), fs, "counter", increment))
+
+	file, err := fs.Open(context.Background(), "counter", nil)
+	require.NoError(t, err)
+	data, err := io.ReadAll(file)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.Equal(t, []byte{2}, data)
+
+	updateErr := fmt.Errorf("update failed")
+	require.ErrorIs(t, Update(context.Background(), fs, "counter", func(data []byte) ([]byte, error) {
+		return nil, updateErr
+	}), updateErr)
+}
+
+func TestCreateIfNotExist(t *testing.T) {
+	fs := NewPrefixWrapper(storage.NewMemoryFS(), "prefix/")
+
+	require.NoError(t, CreateIfNotExist(context.Background(), fs, "object", []byte{1}))
+	require.ErrorIs(t, CreateIfNotExist(context.Background(), fs, "object", []byte{2}), ErrPreconditionFailed)
+
+	data, err := readAll(context.Background(), fs, "object")
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, data)
+}
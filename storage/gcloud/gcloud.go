@@ -1,16 +1,135 @@
 package gcloud
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync"
+
+	gstorage "cloud.google.com/go/storage"
 	"github.com/Shopify/go-storage"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	ethwalstorage "github.com/0xsequence/ethwal/storage"
 )
 
 type GCloudFS struct {
 	storage.FS
+
+	bucket      string
+	credentials *google.Credentials
+
+	mu     sync.Mutex
+	client *gstorage.Client
 }
 
 func NewGCloudFS(bucket string, credentials *google.Credentials) *GCloudFS {
-	return &GCloudFS{FS: NewGoogleCloudChecksumStorage(
-		storage.NewCloudStorageFS(bucket, credentials),
-	)}
+	return &GCloudFS{
+		FS: NewGoogleCloudChecksumStorage(
+			storage.NewCloudStorageFS(bucket, credentials),
+		),
+		bucket:      bucket,
+		credentials: credentials,
+	}
+}
+
+// Copy copies the object within the bucket using the server-side copy, the data is not downloaded.
+func (g *GCloudFS) Copy(ctx context.Context, srcPath, dstPath string) error {
+	client, err := g.storageClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	bucket := client.Bucket(g.bucket)
+	_, err = bucket.Object(dstPath).CopierFrom(bucket.Object(srcPath)).Run(ctx)
+	if errors.Is(err, gstorage.ErrObjectNotExist) {
+		return fmt.Errorf("%s: %w", srcPath, fs.ErrNotExist)
+	}
+	return err
+}
+
+// ReadVersion reads the object and its generation.
+func (g *GCloudFS) ReadVersion(ctx context.Context, path string) ([]byte, int64, error) {
+	client, err := g.storageClient(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rdr, err := client.Bucket(g.bucket).Object(path).NewReader(ctx)
+	if errors.Is(err, gstorage.ErrObjectNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rdr.Close()
+
+	data, err := io.ReadAll(rdr)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, rdr.Attrs.Generation, nil
+}
+
+// CreateIfVersion writes the object with the precondition of its generation, version 0 is the missing object.
+func (g *GCloudFS) CreateIfVersion(ctx context.Context, path string, data []byte, version int64, options *storage.WriterOptions) error {
+	client, err := g.storageClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	conditions := gstorage.Conditions{GenerationMatch: version}
+	if version == 0 {
+		conditions = gstorage.Conditions{DoesNotExist: true}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := client.Bucket(g.bucket).Object(path).If(conditions).NewWriter(ctx)
+	if options != nil {
+		w.ContentType = options.Attributes.ContentType
+		w.Metadata = options.Attributes.Metadata
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		// the canceled context aborts the upload
+		cancel()
+		_ = w.Close()
+		return err
+	}
+
+	err = w.Close()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		return fmt.Errorf("%s: %w", path, ethwalstorage.ErrPreconditionFailed)
+	}
+	return err
+}
+
+func (g *GCloudFS) storageClient(ctx context.Context) (*gstorage.Client, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.client != nil {
+		return g.client, nil
+	}
+
+	var options []option.ClientOption
+	if g.credentials != nil {
+		options = append(options, option.WithCredentials(g.credentials))
+	}
+
+	client, err := gstorage.NewClient(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("building client: %w", err)
+	}
+	g.client = client
+	return client, nil
 }
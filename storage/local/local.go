@@ -1,18 +1,141 @@
 package local
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/Shopify/go-storage"
+
+	ethwalstorage "github.com/0xsequence/ethwal/storage"
 )
 
 type LocalFS struct {
 	storage.FS
+
+	root string
+
+	// mu serializes the conditional writes of the process, the lock files serialize them across processes
+	mu sync.Mutex
 }
 
 func NewLocalFS(path string) *LocalFS {
 	if len(path) > 0 && path[len(path)-1] != os.PathSeparator {
 		path = path + string(os.PathSeparator)
 	}
-	return &LocalFS{FS: storage.NewLocalFS(path)}
+	return &LocalFS{FS: storage.NewLocalFS(path), root: path}
+}
+
+// Rename moves the file atomically with os.Rename, the directory of the destination is created.
+func (l *LocalFS) Rename(ctx context.Context, srcPath, dstPath string) error {
+	dst := filepath.Join(l.root, dstPath)
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(l.root, srcPath), dst)
+}
+
+// OpenRange opens length bytes of the file at offset.
+func (l *LocalFS) OpenRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	file, err := l.FS.Open(ctx, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	seeker, ok := file.ReadCloser.(io.Seeker)
+	if !ok {
+		_ = file.Close()
+		return nil, fmt.Errorf("file %s is not seekable", path)
+	}
+
+	_, err = seeker.Seek(offset, io.SeekStart)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to seek to offset %d: %w", offset, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{Reader: io.LimitReader(file, length), Closer: file}, nil
+}
+
+// ReadVersion reads the file and its version, the hash of its content.
+func (l *LocalFS) ReadVersion(ctx context.Context, path string) ([]byte, int64, error) {
+	data, err := os.ReadFile(filepath.Join(l.root, path))
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, contentVersion(data), nil
+}
+
+// CreateIfVersion writes the file if its version is version. The file is compared and replaced under the
+// exclusive lock of its lock file in the temporary directory, the file is replaced with os.Rename, so the
+// readers never see it partially written.
+func (l *LocalFS) CreateIfVersion(ctx context.Context, path string, data []byte, version int64, options *storage.WriterOptions) error {
+	filePath := filepath.Join(l.root, path)
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	unlock, err := lockFile(lockFilePath(filePath))
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	defer unlock()
+
+	current, currentVersion, err := l.ReadVersion(ctx, path)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		currentVersion = 0
+	}
+	if currentVersion != version {
+		return fmt.Errorf("%s: %w: version %d, expected %d", path, ethwalstorage.ErrPreconditionFailed, currentVersion, version)
+	}
+
+	var suffix [8]byte
+	_, _ = rand.Read(suffix[:])
+	tmpPath := filePath + ".tmp-" + hex.EncodeToString(suffix[:])
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, filePath)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// lockFilePath returns the path of the lock file of the file, it's kept out of the dataset directory.
+func lockFilePath(filePath string) string {
+	if abs, err := filepath.Abs(filePath); err == nil {
+		filePath = abs
+	}
+	digest := sha256.Sum256([]byte(filePath))
+	return filepath.Join(os.TempDir(), "ethwal-"+hex.EncodeToString(digest[:8])+".lock")
+}
+
+// contentVersion returns the version of the file content, it's never 0, the version of the missing file.
+func contentVersion(data []byte) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	return int64(h.Sum64() | 1)
 }
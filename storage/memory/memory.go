@@ -0,0 +1,230 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/go-storage"
+
+	ethwalstorage "github.com/0xsequence/ethwal/storage"
+)
+
+// MemoryFS is the file system keeping the objects in memory, e.g. for the tests or the embedded use without
+// the disk. It's safe for concurrent use, the object is stored once its writer is closed, so the readers never
+// see it partially written. The missing objects are reported with the errors wrapping fs.ErrNotExist, see
+// storage.IsNotExist.
+type MemoryFS struct {
+	mu      sync.RWMutex
+	objects map[string]*object
+}
+
+type object struct {
+	data  []byte
+	attrs storage.Attributes
+}
+
+var (
+	_ ethwalstorage.FS                = (*MemoryFS)(nil)
+	_ ethwalstorage.Copier            = (*MemoryFS)(nil)
+	_ ethwalstorage.Renamer           = (*MemoryFS)(nil)
+	_ ethwalstorage.RangeReader       = (*MemoryFS)(nil)
+	_ ethwalstorage.ConditionalWriter = (*MemoryFS)(nil)
+)
+
+func NewMemoryFS() *MemoryFS {
+	return &MemoryFS{objects: make(map[string]*object)}
+}
+
+func notExist(op, path string) error {
+	return &fs.PathError{Op: op, Path: path, Err: fs.ErrNotExist}
+}
+
+// get returns the object at the path, the stored objects are never modified.
+func (m *MemoryFS) get(path string) (*object, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	obj, ok := m.objects[path]
+	return obj, ok
+}
+
+func (m *MemoryFS) Open(ctx context.Context, path string, options *storage.ReaderOptions) (*storage.File, error) {
+	obj, ok := m.get(path)
+	if !ok {
+		return nil, notExist("open", path)
+	}
+	return &storage.File{ReadCloser: io.NopCloser(bytes.NewReader(obj.data)), Attributes: obj.attrs}, nil
+}
+
+func (m *MemoryFS) Attributes(ctx context.Context, path string, options *storage.ReaderOptions) (*storage.Attributes, error) {
+	obj, ok := m.get(path)
+	if !ok {
+		return nil, notExist("attributes", path)
+	}
+	attrs := obj.attrs
+	return &attrs, nil
+}
+
+// Create returns the writer of the object, the object is stored, or replaced, once the writer is closed.
+func (m *MemoryFS) Create(ctx context.Context, path string, options *storage.WriterOptions) (io.WriteCloser, error) {
+	var attrs storage.Attributes
+	if options != nil {
+		attrs = options.Attributes
+	}
+	return &writer{fs: m, path: path, attrs: attrs}, nil
+}
+
+// Delete deletes the object, deleting the missing object succeeds like on the local file system.
+func (m *MemoryFS) Delete(ctx context.Context, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, path)
+	return nil
+}
+
+// Walk calls fn with the paths of the objects starting with the prefix in the path order, e.g. "dataset/"
+// lists all objects of the dataset directory. The objects created or deleted by fn don't change the walk.
+func (m *MemoryFS) Walk(ctx context.Context, prefix string, fn storage.WalkFn) error {
+	m.mu.RLock()
+	var paths []string
+	for path := range m.objects {
+		if strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+	}
+	m.mu.RUnlock()
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryFS) URL(ctx context.Context, path string, options *storage.SignedURLOptions) (string, error) {
+	return "", storage.ErrNotImplemented
+}
+
+// Copy copies the object, the data is shared by both objects.
+func (m *MemoryFS) Copy(ctx context.Context, srcPath, dstPath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[srcPath]
+	if !ok {
+		return notExist("copy", srcPath)
+	}
+	m.objects[dstPath] = obj
+	return nil
+}
+
+// Rename moves the object atomically.
+func (m *MemoryFS) Rename(ctx context.Context, srcPath, dstPath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[srcPath]
+	if !ok {
+		return notExist("rename", srcPath)
+	}
+	delete(m.objects, srcPath)
+	m.objects[dstPath] = obj
+	return nil
+}
+
+// OpenRange opens length bytes of the object at offset, the range past the end of the object is truncated.
+func (m *MemoryFS) OpenRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	obj, ok := m.get(path)
+	if !ok {
+		return nil, notExist("open range", path)
+	}
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range of %s: offset %d, length %d", path, offset, length)
+	}
+
+	data := obj.data[min(offset, int64(len(obj.data))):]
+	return io.NopCloser(bytes.NewReader(data[:min(length, int64(len(data)))])), nil
+}
+
+// ReadVersion reads the object and its version, the hash of its content.
+func (m *MemoryFS) ReadVersion(ctx context.Context, path string) ([]byte, int64, error) {
+	obj, ok := m.get(path)
+	if !ok {
+		return nil, 0, nil
+	}
+	return bytes.Clone(obj.data), contentVersion(obj.data), nil
+}
+
+// CreateIfVersion writes the object if its version is version.
+func (m *MemoryFS) CreateIfVersion(ctx context.Context, path string, data []byte, version int64, options *storage.WriterOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var currentVersion int64
+	if obj, ok := m.objects[path]; ok {
+		currentVersion = contentVersion(obj.data)
+	}
+	if currentVersion != version {
+		return fmt.Errorf("%s: %w: version %d, expected %d", path, ethwalstorage.ErrPreconditionFailed, currentVersion, version)
+	}
+
+	var attrs storage.Attributes
+	if options != nil {
+		attrs = options.Attributes
+	}
+	m.objects[path] = newObject(bytes.Clone(data), attrs)
+	return nil
+}
+
+func newObject(data []byte, attrs storage.Attributes) *object {
+	attrs.Size = int64(len(data))
+	attrs.ModTime = time.Now()
+	return &object{data: data, attrs: attrs}
+}
+
+// contentVersion returns the version of the object content, it's never 0, the version of the missing object.
+func contentVersion(data []byte) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	return int64(h.Sum64() | 1)
+}
+
+type writer struct {
+	fs    *MemoryFS
+	path  string
+	attrs storage.Attributes
+
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	return w.buf.Write(p)
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return fs.ErrClosed
+	}
+	w.closed = true
+
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	w.fs.objects[w.path] = newObject(w.buf.Bytes(), w.attrs)
+	return nil
+}
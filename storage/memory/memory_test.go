@@ -0,0 +1,188 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+
+	ethwalstorage "github.com/0xsequence/ethwal/storage"
+)
+
+func writeObject(t *testing.T, fs ethwalstorage.FS, path string, data string) {
+	w, err := fs.Create(context.Background(), path, nil)
+	require.NoError(t, err)
+	_, err = w.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+}
+
+func readObject(t *testing.T, fs ethwalstorage.FS, path string) string {
+	file, err := fs.Open(context.Background(), path, nil)
+	require.NoError(t, err)
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func walk(t *testing.T, fs ethwalstorage.FS, prefix string) []string {
+	var paths []string
+	require.NoError(t, fs.Walk(context.Background(), prefix, func(path string) error {
+		paths = append(paths, path)
+		return nil
+	}))
+	return paths
+}
+
+func TestMemoryFS(t *testing.T) {
+	ctx := context.Background()
+	fs := NewMemoryFS()
+
+	t.Run("not_exist", func(t *testing.T) {
+		_, err := fs.Open(ctx, "a/missing", nil)
+		require.True(t, ethwalstorage.IsNotExist(err))
+		_, err = fs.Attributes(ctx, "a/missing", nil)
+		require.True(t, ethwalstorage.IsNotExist(err))
+		_, err = fs.OpenRange(ctx, "a/missing", 0, 1)
+		require.True(t, ethwalstorage.IsNotExist(err))
+		require.True(t, ethwalstorage.IsNotExist(fs.Rename(ctx, "a/missing", "a/other")))
+		require.NoError(t, fs.Delete(ctx, "a/missing"))
+	})
+
+	t.Run("create", func(t *testing.T) {
+		w, err := fs.Create(ctx, "a/1", &storage.WriterOptions{Attributes: storage.Attributes{Metadata: map[string]string{"k": "v"}}})
+		require.NoError(t, err)
+		_, err = w.Write([]byte("one"))
+		require.NoError(t, err)
+
+		// the object is stored once the writer is closed
+		_, err = fs.Open(ctx, "a/1", nil)
+		require.True(t, ethwalstorage.IsNotExist(err))
+		require.NoError(t, w.Close())
+		require.Error(t, w.Close())
+
+		require.Equal(t, "one", readObject(t, fs, "a/1"))
+		attrs, err := fs.Attributes(ctx, "a/1", nil)
+		require.NoError(t, err)
+		require.Equal(t, int64(3), attrs.Size)
+		require.Equal(t, map[string]string{"k": "v"}, attrs.Metadata)
+		require.False(t, attrs.ModTime.IsZero())
+
+		// create replaces the object
+		writeObject(t, fs, "a/1", "replaced")
+		require.Equal(t, "replaced", readObject(t, fs, "a/1"))
+	})
+
+	t.Run("walk", func(t *testing.T) {
+		writeObject(t, fs, "a/2", "two")
+		writeObject(t, fs, "a/b/3", "three")
+		writeObject(t, fs, "ab/4", "four")
+
+		require.Equal(t, []string{"a/1", "a/2", "a/b/3"}, walk(t, fs, "a/"))
+		require.Equal(t, []string{"a/b/3"}, walk(t, fs, "a/b/"))
+		require.Equal(t, []string{"a/1", "a/2", "a/b/3", "ab/4"}, walk(t, fs, ""))
+		require.Empty(t, walk(t, fs, "missing/"))
+
+		stop := fmt.Errorf("stop")
+		require.ErrorIs(t, fs.Walk(ctx, "", func(path string) error { return stop }), stop)
+
+		// the objects deleted during the walk
+		require.NoError(t, fs.Walk(ctx, "a/", func(path string) error {
+			return fs.Delete(ctx, path)
+		}))
+		require.Equal(t, []string{"ab/4"}, walk(t, fs, ""))
+	})
+
+	t.Run("copy_rename", func(t *testing.T) {
+		writeObject(t, fs, "c/1", "one")
+		require.NoError(t, ethwalstorage.Copy(ctx, fs, "c/1", "c/2"))
+		require.NoError(t, ethwalstorage.Rename(ctx, fs, "c/2", "c/3"))
+		require.Equal(t, []string{"c/1", "c/3"}, walk(t, fs, "c/"))
+		require.Equal(t, "one", readObject(t, fs, "c/3"))
+
+		// the copy isn't changed by the source
+		writeObject(t, fs, "c/1", "changed")
+		require.Equal(t, "one", readObject(t, fs, "c/3"))
+	})
+
+	t.Run("open_range", func(t *testing.T) {
+		writeObject(t, fs, "d/1", "0123456789")
+		for _, tc := range []struct {
+			offset, length int64
+			expected       string
+		}{{0, 3, "012"}, {7, 3, "789"}, {8, 5, "89"}, {12, 1, ""}} {
+			r, err := ethwalstorage.OpenRange(ctx, fs, "d/1", tc.offset, tc.length)
+			require.NoError(t, err)
+			data, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, string(data))
+		}
+	})
+
+	t.Run("conditional", func(t *testing.T) {
+		require.NoError(t, ethwalstorage.CreateIfNotExist(ctx, fs, "e/1", []byte("one")))
+		require.ErrorIs(t, ethwalstorage.CreateIfNotExist(ctx, fs, "e/1", []byte("two")), ethwalstorage.ErrPreconditionFailed)
+
+		data, version, err := ethwalstorage.ReadVersion(ctx, fs, "e/1")
+		require.NoError(t, err)
+		require.Equal(t, "one", string(data))
+		require.NoError(t, ethwalstorage.CreateIfVersion(ctx, fs, "e/1", []byte("two"), version, nil))
+		require.ErrorIs(t, ethwalstorage.CreateIfVersion(ctx, fs, "e/1", []byte("three"), version, nil), ethwalstorage.ErrPreconditionFailed)
+		require.Equal(t, "two", readObject(t, fs, "e/1"))
+	})
+
+	t.Run("prefix_wrapper", func(t *testing.T) {
+		writeObject(t, fs, "f/1", "one")
+		prefixed := ethwalstorage.NewPrefixWrapper(fs, "f/")
+		require.Equal(t, "one", readObject(t, prefixed, "1"))
+		require.Equal(t, []string{"1"}, walk(t, prefixed, ""))
+	})
+}
+
+func TestMemoryFS_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	fs := NewMemoryFS()
+
+	const numWriters, numObjects = 8, 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWriters; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numObjects; j++ {
+				w, err := fs.Create(ctx, fmt.Sprintf("%d/%d", i, j), nil)
+				if err == nil {
+					_, _ = w.Write([]byte(fmt.Sprint(j)))
+					_ = w.Close()
+				}
+			}
+		}()
+
+		// the readers see either no object or the whole object
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numObjects; j++ {
+				file, err := fs.Open(ctx, fmt.Sprintf("%d/%d", i, j), nil)
+				if err != nil {
+					continue
+				}
+				data, _ := io.ReadAll(file)
+				_ = file.Close()
+				if string(data) != fmt.Sprint(j) {
+					t.Errorf("partial object %d/%d: %q", i, j, data)
+				}
+				_ = fs.Walk(ctx, fmt.Sprintf("%d/", i), func(string) error { return nil })
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, walk(t, fs, ""), numWriters*numObjects)
+}
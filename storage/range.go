@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/Shopify/go-storage"
+)
+
+// RangeReader is implemented by the file systems that can read a byte range of the object without
+// reading the whole object.
+type RangeReader interface {
+	OpenRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error)
+}
+
+// OpenRange opens length bytes of the object at offset. The objects of the file systems that don't
+// implement RangeReader are read from the start and the bytes before the offset are discarded.
+func OpenRange(ctx context.Context, fs FS, path string, offset, length int64) (io.ReadCloser, error) {
+	if rr, ok := fs.(RangeReader); ok {
+		return rr.OpenRange(ctx, path, offset, length)
+	}
+
+	file, err := fs.Open(ctx, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.CopyN(io.Discard, file, offset)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to skip to offset %d: %w", offset, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{Reader: io.LimitReader(file, length), Closer: file}, nil
+}
+
+// NewPrefixWrapper creates the file system which prefixes all paths with prefix. The range reads are
+// passed through if fs implements RangeReader, the conditional writes if it implements ConditionalWriter
+// and the copies if it implements Copier.
+func NewPrefixWrapper(fs FS, prefix string) FS {
+	wrapped := &prefixWrapper{FS: storage.NewPrefixWrapper(fs, prefix), fs: fs, prefix: prefix}
+	if rr, ok := fs.(RangeReader); ok {
+		return &prefixRangeWrapper{prefixWrapper: wrapped, rr: rr}
+	}
+	return wrapped
+}
+
+type prefixWrapper struct {
+	FS
+	fs     FS
+	prefix string
+}
+
+func (p *prefixWrapper) ReadVersion(ctx context.Context, path string) ([]byte, int64, error) {
+	return ReadVersion(ctx, p.fs, p.prefix+path)
+}
+
+func (p *prefixWrapper) CreateIfVersion(ctx context.Context, path string, data []byte, version int64, options *storage.WriterOptions) error {
+	return CreateIfVersion(ctx, p.fs, p.prefix+path, data, version, options)
+}
+
+func (p *prefixWrapper) Copy(ctx context.Context, srcPath, dstPath string) error {
+	return Copy(ctx, p.fs, p.prefix+srcPath, p.prefix+dstPath)
+}
+
+type prefixRangeWrapper struct {
+	*prefixWrapper
+	rr RangeReader
+}
+
+func (p *prefixRangeWrapper) OpenRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	return p.rr.OpenRange(ctx, p.prefix+path, offset, length)
+}
@@ -0,0 +1,420 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Shopify/go-storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	ethwalstorage "github.com/0xsequence/ethwal/storage"
+)
+
+// DefaultPartSize is the size of the parts of the multipart upload, the objects smaller than the part are
+// uploaded with one request.
+const DefaultPartSize = 16 << 20 // 16 MB
+
+// MinPartSize is the minimal size of the part of the multipart upload allowed by S3, except the last part.
+const MinPartSize = 5 << 20 // 5 MB
+
+// Client is the S3 API used by the file system, it's implemented by *s3.Client.
+type Client interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// Option configures the S3 file system.
+type Option func(*S3FS)
+
+// WithEndpoint sets the endpoint of the S3-compatible service, e.g. MinIO, the objects are addressed by
+// the path. The region defaults to us-east-1.
+func WithEndpoint(endpoint string) Option {
+	return func(s *S3FS) {
+		s.clientOptions = append(s.clientOptions, func(o *s3.Options) {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+			if o.Region == "" {
+				o.Region = "us-east-1"
+			}
+		})
+	}
+}
+
+// WithPartSize sets the size of the parts of the multipart upload, see DefaultPartSize. S3 rejects the
+// parts smaller than MinPartSize.
+func WithPartSize(size int64) Option {
+	return func(s *S3FS) {
+		s.partSize = size
+	}
+}
+
+// S3FS is the file system of the S3 bucket. The missing objects fail Open and Attributes with the error
+// wrapping fs.ErrNotExist, Delete of the missing object succeeds as S3 doesn't report it.
+type S3FS struct {
+	bucket   string
+	client   Client
+	partSize int64
+
+	clientOptions []func(*s3.Options)
+}
+
+var _ storage.FS = (*S3FS)(nil)
+var _ ethwalstorage.Copier = (*S3FS)(nil)
+var _ ethwalstorage.RangeReader = (*S3FS)(nil)
+
+// NewS3FS creates the file system of the bucket with the client created from the AWS config.
+func NewS3FS(bucket string, cfg aws.Config, options ...Option) *S3FS {
+	s := newS3FS(bucket, options)
+	s.client = s3.NewFromConfig(cfg, s.clientOptions...)
+	return s
+}
+
+// NewDefaultS3FS creates the file system of the bucket with the default AWS config, read from the
+// environment and the shared config files.
+func NewDefaultS3FS(ctx context.Context, bucket string, options ...Option) (*S3FS, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load aws config: %w", err)
+	}
+	return NewS3FS(bucket, cfg, options...), nil
+}
+
+// NewS3FSWithClient creates the file system of the bucket with the client, the endpoint options are
+// ignored.
+func NewS3FSWithClient(bucket string, client Client, options ...Option) *S3FS {
+	s := newS3FS(bucket, options)
+	s.client = client
+	return s
+}
+
+func newS3FS(bucket string, options []Option) *S3FS {
+	s := &S3FS{bucket: bucket, partSize: DefaultPartSize}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+func (s *S3FS) Open(ctx context.Context, path string, options *storage.ReaderOptions) (*storage.File, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(path)})
+	if err != nil {
+		return nil, s.wrapError(path, err)
+	}
+
+	return &storage.File{
+		ReadCloser: out.Body,
+		Attributes: attributes(aws.ToString(out.ContentType), aws.ToString(out.ContentEncoding), out.Metadata,
+			out.LastModified, aws.ToInt64(out.ContentLength)),
+	}, nil
+}
+
+// OpenRange opens length bytes of the object at offset with the ranged GET.
+func (s *S3FS) OpenRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return nil, s.wrapError(path, err)
+	}
+	return out.Body, nil
+}
+
+func (s *S3FS) Attributes(ctx context.Context, path string, options *storage.ReaderOptions) (*storage.Attributes, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(path)})
+	if err != nil {
+		return nil, s.wrapError(path, err)
+	}
+
+	attrs := attributes(aws.ToString(out.ContentType), aws.ToString(out.ContentEncoding), out.Metadata,
+		out.LastModified, aws.ToInt64(out.ContentLength))
+	return &attrs, nil
+}
+
+// Create creates the writer of the object, the object is written on Close. The data is uploaded with the
+// multipart upload once it exceeds the part size.
+func (s *S3FS) Create(ctx context.Context, path string, options *storage.WriterOptions) (io.WriteCloser, error) {
+	w := &writer{ctx: ctx, fs: s, path: path}
+	if options != nil {
+		w.contentType = options.Attributes.ContentType
+		w.contentEncoding = options.Attributes.ContentEncoding
+		w.metadata = options.Attributes.Metadata
+	}
+	return w, nil
+}
+
+func (s *S3FS) Delete(ctx context.Context, path string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(path)})
+	if err != nil {
+		return s.wrapError(path, err)
+	}
+	return nil
+}
+
+// Walk calls fn with the keys of the objects starting with the path in the lexicographical order.
+func (s *S3FS) Walk(ctx context.Context, path string, fn storage.WalkFn) error {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket), Prefix: aws.String(path)}
+	for {
+		out, err := s.client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return s.wrapError(path, err)
+		}
+
+		for _, object := range out.Contents {
+			err = fn(aws.ToString(object.Key))
+			if err != nil {
+				return err
+			}
+		}
+
+		if !aws.ToBool(out.IsTruncated) {
+			return nil
+		}
+		input.ContinuationToken = out.NextContinuationToken
+	}
+}
+
+// Copy copies the object within the bucket using the server-side copy, the data is not downloaded.
+func (s *S3FS) Copy(ctx context.Context, srcPath, dstPath string) error {
+	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(dstPath),
+		CopySource: aws.String(url.PathEscape(s.bucket + "/" + srcPath)),
+	})
+	if err != nil {
+		return s.wrapError(srcPath, err)
+	}
+	return nil
+}
+
+// URL returns the presigned GET URL of the object, it's supported only by the file system created with
+// the AWS config.
+func (s *S3FS) URL(ctx context.Context, path string, options *storage.SignedURLOptions) (string, error) {
+	client, ok := s.client.(*s3.Client)
+	if !ok {
+		return "", storage.ErrNotImplemented
+	}
+
+	expiry := storage.DefaultSignedURLExpiry
+	if options != nil && options.Expiry > 0 {
+		expiry = options.Expiry
+	}
+
+	req, err := s3.NewPresignClient(client).PresignGetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(path)},
+		s3.WithPresignExpires(expiry))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// wrapError wraps the error of the missing object with fs.ErrNotExist.
+func (s *S3FS) wrapError(path string, err error) error {
+	if isNotFound(err) {
+		return fmt.Errorf("s3 %s/%s: %w", s.bucket, path, fs.ErrNotExist)
+	}
+	return fmt.Errorf("s3 %s/%s: %w", s.bucket, path, err)
+}
+
+// isNotFound reports whether the error is the missing object or bucket, HEAD reports it without the error
+// code in the body.
+func isNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+func attributes(contentType, contentEncoding string, metadata map[string]string, modTime *time.Time, size int64) storage.Attributes {
+	lowerMetadata := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		lowerMetadata[strings.ToLower(key)] = value
+	}
+
+	attrs := storage.Attributes{
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+		Metadata:        lowerMetadata,
+		Size:            size,
+	}
+	if modTime != nil {
+		attrs.ModTime = *modTime
+		attrs.CreationTime = *modTime
+	}
+	return attrs
+}
+
+// writer buffers the object until it's closed or the buffer exceeds the part size, the parts are uploaded
+// as they are filled. The upload failed or not closed is aborted.
+type writer struct {
+	ctx  context.Context
+	fs   *S3FS
+	path string
+
+	contentType     string
+	contentEncoding string
+	metadata        map[string]string
+
+	buf      bytes.Buffer
+	uploadID *string
+	parts    []types.CompletedPart
+	err      error
+	closed   bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, fmt.Errorf("s3 %s/%s: write to closed writer", w.fs.bucket, w.path)
+	}
+
+	n, _ := w.buf.Write(p)
+	for int64(w.buf.Len()) >= w.fs.partSize {
+		err := w.uploadPart(w.buf.Next(int(w.fs.partSize)))
+		if err != nil {
+			w.abort(err)
+			return n, w.err
+		}
+	}
+	return n, nil
+}
+
+func (w *writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	// the object smaller than the part is uploaded with one request
+	if w.uploadID == nil {
+		_, err := w.fs.client.PutObject(w.ctx, &s3.PutObjectInput{
+			Bucket:          aws.String(w.fs.bucket),
+			Key:             aws.String(w.path),
+			Body:            bytes.NewReader(w.buf.Bytes()),
+			ContentLength:   aws.Int64(int64(w.buf.Len())),
+			ContentType:     optionalString(w.contentType),
+			ContentEncoding: optionalString(w.contentEncoding),
+			Metadata:        w.metadata,
+		})
+		if err != nil {
+			w.err = w.fs.wrapError(w.path, err)
+		}
+		return w.err
+	}
+
+	if w.buf.Len() > 0 {
+		err := w.uploadPart(w.buf.Bytes())
+		if err != nil {
+			w.abort(err)
+			return w.err
+		}
+	}
+
+	_, err := w.fs.client.CompleteMultipartUpload(w.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(w.fs.bucket),
+		Key:             aws.String(w.path),
+		UploadId:        w.uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: w.parts},
+	})
+	if err != nil {
+		w.abort(err)
+	}
+	return w.err
+}
+
+// uploadPart uploads the next part, the multipart upload is created with the first part.
+func (w *writer) uploadPart(data []byte) error {
+	if w.uploadID == nil {
+		out, err := w.fs.client.CreateMultipartUpload(w.ctx, &s3.CreateMultipartUploadInput{
+			Bucket:          aws.String(w.fs.bucket),
+			Key:             aws.String(w.path),
+			ContentType:     optionalString(w.contentType),
+			ContentEncoding: optionalString(w.contentEncoding),
+			Metadata:        w.metadata,
+		})
+		if err != nil {
+			return err
+		}
+		w.uploadID = out.UploadId
+	}
+
+	partNumber := aws.Int32(int32(len(w.parts) + 1))
+	out, err := w.fs.client.UploadPart(w.ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(w.fs.bucket),
+		Key:           aws.String(w.path),
+		UploadId:      w.uploadID,
+		PartNumber:    partNumber,
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+	})
+	if err != nil {
+		return err
+	}
+
+	w.parts = append(w.parts, types.CompletedPart{ETag: out.ETag, PartNumber: partNumber})
+	return nil
+}
+
+// abort aborts the multipart upload, so that the uploaded parts aren't stored.
+func (w *writer) abort(err error) {
+	w.err = w.fs.wrapError(w.path, err)
+	w.closed = true
+	if w.uploadID == nil {
+		return
+	}
+
+	_, abortErr := w.fs.client.AbortMultipartUpload(context.WithoutCancel(w.ctx), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(w.fs.bucket),
+		Key:      aws.String(w.path),
+		UploadId: w.uploadID,
+	})
+	if abortErr != nil {
+		w.err = errors.Join(w.err, fmt.Errorf("failed to abort multipart upload: %w", abortErr))
+	}
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
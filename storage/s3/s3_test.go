@@ -0,0 +1,353 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/0xsequence/ethwal"
+	ethwalstorage "github.com/0xsequence/ethwal/storage"
+)
+
+type fakeObject struct {
+	data     []byte
+	metadata map[string]string
+	modTime  time.Time
+}
+
+// fakeClient is the in-memory S3 bucket, the listing returns maxKeys keys per page and HEAD of the missing
+// object fails without the typed error, as the real service does.
+type fakeClient struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	uploads map[string]map[int32][]byte
+	maxKeys int
+
+	puts, parts, completed, aborted int
+	failPart                        int32
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{objects: make(map[string]fakeObject), uploads: make(map[string]map[int32][]byte), maxKeys: 2}
+}
+
+func (f *fakeClient) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	object, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+	}
+
+	data := object.data
+	if params.Range != nil {
+		var from, to int
+		_, err := fmt.Sscanf(aws.ToString(params.Range), "bytes=%d-%d", &from, &to)
+		if err != nil {
+			return nil, err
+		}
+		data = data[from:min(to+1, len(data))]
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+		Metadata:      object.metadata,
+		LastModified:  aws.Time(object.modTime),
+	}, nil
+}
+
+func (f *fakeClient) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	object, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NotFound", Message: "Not Found"}
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(object.data))),
+		Metadata:      object.metadata,
+		LastModified:  aws.Time(object.modTime),
+	}, nil
+}
+
+func (f *fakeClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.puts++
+	f.objects[aws.ToString(params.Key)] = fakeObject{data: data, metadata: params.Metadata, modTime: time.Now()}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeClient) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	source, err := url.PathUnescape(aws.ToString(params.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	object, ok := f.objects[strings.TrimPrefix(source, aws.ToString(params.Bucket)+"/")]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	f.objects[aws.ToString(params.Key)] = fakeObject{data: bytes.Clone(object.data), metadata: object.metadata, modTime: time.Now()}
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeClient) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeClient) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) && key > aws.ToString(params.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(len(keys) > f.maxKeys)}
+	if len(keys) > f.maxKeys {
+		keys = keys[:f.maxKeys]
+		out.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		out.Contents = append(out.Contents, types.Object{Key: aws.String(key)})
+	}
+	return out, nil
+}
+
+func (f *fakeClient) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	uploadID := strconv.Itoa(len(f.uploads) + 1)
+	f.uploads[uploadID] = make(map[int32][]byte)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(uploadID)}, nil
+}
+
+func (f *fakeClient) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	partNumber := aws.ToInt32(params.PartNumber)
+	if partNumber == f.failPart {
+		return nil, fmt.Errorf("upload failed")
+	}
+	f.parts++
+	f.uploads[aws.ToString(params.UploadId)][partNumber] = data
+	return &s3.UploadPartOutput{ETag: aws.String(strconv.Itoa(int(partNumber)))}, nil
+}
+
+func (f *fakeClient) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := f.uploads[aws.ToString(params.UploadId)]
+	var data []byte
+	for _, part := range params.MultipartUpload.Parts {
+		data = append(data, parts[aws.ToInt32(part.PartNumber)]...)
+	}
+	delete(f.uploads, aws.ToString(params.UploadId))
+
+	f.completed++
+	f.objects[aws.ToString(params.Key)] = fakeObject{data: data, modTime: time.Now()}
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeClient) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.aborted++
+	delete(f.uploads, aws.ToString(params.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func writeObject(t *testing.T, fs *S3FS, path string, data []byte) {
+	w, err := fs.Create(context.Background(), path, nil)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+}
+
+func TestS3FS_NotExist(t *testing.T) {
+	fs := NewS3FSWithClient("bucket", newFakeClient())
+
+	_, err := fs.Open(context.Background(), "missing", nil)
+	require.True(t, ethwalstorage.IsNotExist(err))
+	require.Contains(t, err.Error(), "not exist")
+
+	_, err = fs.Attributes(context.Background(), "missing", nil)
+	require.True(t, ethwalstorage.IsNotExist(err))
+
+	_, err = fs.OpenRange(context.Background(), "missing", 0, 10)
+	require.True(t, ethwalstorage.IsNotExist(err))
+
+	require.True(t, ethwalstorage.IsNotExist(fs.Copy(context.Background(), "missing", "copy")))
+	require.NoError(t, fs.Delete(context.Background(), "missing"))
+
+	// the file stored at the legacy path is found by the fallback
+	file := &ethwal.File{FirstBlockNum: 1, LastBlockNum: 10}
+	require.False(t, file.Exist(context.Background(), fs))
+	writeObject(t, fs, "1_10.wal", []byte("legacy"))
+	require.True(t, file.Exist(context.Background(), fs))
+
+	rdr, err := file.Open(context.Background(), fs)
+	require.NoError(t, err)
+	data, err := io.ReadAll(rdr)
+	require.NoError(t, err)
+	require.NoError(t, rdr.Close())
+	require.Equal(t, "legacy", string(data))
+
+	size, err := file.Size(context.Background(), fs)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), size)
+}
+
+func TestS3FS_Walk(t *testing.T) {
+	fs := NewS3FSWithClient("bucket", newFakeClient())
+	keys := []string{"a/1", "a/2", "a/3", "a/b/1", "ab/1", "b/1"}
+	for _, key := range keys {
+		writeObject(t, fs, key, []byte(key))
+	}
+
+	walk := func(prefix string) []string {
+		var walked []string
+		require.NoError(t, fs.Walk(context.Background(), prefix, func(path string) error {
+			walked = append(walked, path)
+			return nil
+		}))
+		return walked
+	}
+
+	// the listing spans the pages
+	require.Equal(t, keys, walk(""))
+	require.Equal(t, []string{"a/1", "a/2", "a/3", "a/b/1"}, walk("a/"))
+	require.Equal(t, []string{"a/1", "a/2", "a/3", "a/b/1", "ab/1"}, walk("a"))
+	require.Empty(t, walk("c/"))
+
+	// the walk stops at the first error
+	var count int
+	err := fs.Walk(context.Background(), "", func(path string) error {
+		count++
+		return fmt.Errorf("stop")
+	})
+	require.EqualError(t, err, "stop")
+	require.Equal(t, 1, count)
+}
+
+func TestS3FS_Multipart(t *testing.T) {
+	client := newFakeClient()
+	fs := NewS3FSWithClient("bucket", client, WithPartSize(10))
+
+	// the small object is uploaded with one request
+	writeObject(t, fs, "small", []byte("0123"))
+	require.Equal(t, 1, client.puts)
+	require.Zero(t, client.parts)
+
+	// the large object is uploaded in parts
+	data := bytes.Repeat([]byte("0123456789"), 3)
+	data = append(data, "abc"...)
+	w, err := fs.Create(context.Background(), "large", nil)
+	require.NoError(t, err)
+	for _, chunk := range [][]byte{data[:7], data[7:25], data[25:]} {
+		_, err = w.Write(chunk)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	require.Equal(t, 4, client.parts)
+	require.Equal(t, 1, client.completed)
+
+	f, err := fs.Open(context.Background(), "large", nil)
+	require.NoError(t, err)
+	read, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+	require.Equal(t, int64(len(data)), f.Size)
+
+	rdr, err := fs.OpenRange(context.Background(), "large", 8, 5)
+	require.NoError(t, err)
+	read, err = io.ReadAll(rdr)
+	require.NoError(t, err)
+	require.Equal(t, "89012", string(read))
+
+	// the failed upload is aborted and not stored
+	client.failPart = 2
+	w, err = fs.Create(context.Background(), "failed", nil)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.Error(t, err)
+	require.Error(t, w.Close())
+	require.Equal(t, 1, client.aborted)
+	_, err = fs.Attributes(context.Background(), "failed", nil)
+	require.True(t, ethwalstorage.IsNotExist(err))
+}
+
+func TestS3FS_Dataset(t *testing.T) {
+	fs := NewS3FSWithClient("bucket", newFakeClient())
+	opt := ethwal.Options{
+		Dataset:         ethwal.Dataset{Path: "ethwal"},
+		FileSystem:      fs,
+		NewCompressor:   ethwal.NewZSTDCompressor,
+		NewDecompressor: ethwal.NewZSTDDecompressor,
+		FileRollPolicy:  ethwal.NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+
+	w, err := ethwal.NewWriter[int](opt)
+	require.NoError(t, err)
+	for blockNum := uint64(1); blockNum <= 25; blockNum++ {
+		require.NoError(t, w.Write(context.Background(), ethwal.Block[int]{Number: blockNum, Data: int(blockNum)}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	r, err := ethwal.NewReader[int](opt)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var blockNum uint64
+	for {
+		b, err := r.Read(context.Background())
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		blockNum++
+		require.Equal(t, blockNum, b.Number)
+	}
+	require.Equal(t, uint64(25), blockNum)
+}
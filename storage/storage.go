@@ -8,6 +8,4 @@ type Walker storage.Walker
 
 type File storage.File
 
-var NewPrefixWrapper = storage.NewPrefixWrapper
-
 var NewCacheWrapper = storage.NewCacheWrapper
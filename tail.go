@@ -0,0 +1,125 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+// TailFileName is the name of the object the writer periodically stores its in-memory buffer to. The object is
+// advisory, it's never included in the FileIndex and the readers always prefer rolled files.
+const TailFileName = ".tail"
+
+// tailHeaderSize is the size of the tail header: first and last block number (uint64 each).
+const tailHeaderSize = 16
+
+// writeTail stores the encoded blocks of the file that is not rolled yet to the .tail object.
+func writeTail(ctx context.Context, fs storage.FS, opt Options, firstBlockNum, lastBlockNum uint64, data []byte) error {
+	var buf bytes.Buffer
+
+	var header [tailHeaderSize]byte
+	binary.BigEndian.PutUint64(header[0:8], firstBlockNum)
+	binary.BigEndian.PutUint64(header[8:16], lastBlockNum)
+	buf.Write(header[:])
+
+	payload := io.WriteCloser(nopWriteCloser{Writer: &buf})
+	if opt.NewCompressor != nil {
+		payload = opt.NewCompressor(&buf)
+	}
+
+	_, err := payload.Write(data)
+	if err != nil {
+		_ = payload.Close()
+		return fmt.Errorf("failed to compress tail: %w", err)
+	}
+
+	err = payload.Close()
+	if err != nil {
+		return fmt.Errorf("failed to compress tail: %w", err)
+	}
+
+	f, err := fs.Create(ctx, TailFileName, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create tail: %w", err)
+	}
+
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write tail: %w", err)
+	}
+	return f.Close()
+}
+
+// readTailLastBlockNum reads the last block number from the header of the .tail object. It reports false if
+// the object doesn't exist.
+func readTailLastBlockNum(ctx context.Context, fs storage.FS) (uint64, bool, error) {
+	f, err := fs.Open(ctx, TailFileName, nil)
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("failed to open tail: %w", err)
+	}
+	defer f.Close()
+
+	var header [tailHeaderSize]byte
+	_, err = io.ReadFull(f, header[:])
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read tail header: %w", err)
+	}
+	return binary.BigEndian.Uint64(header[8:16]), true, nil
+}
+
+// readTail reads blocks stored in the .tail object. If the object doesn't exist, no blocks are returned.
+func readTail[T any](ctx context.Context, fs storage.FS, opt Options) ([]Block[T], error) {
+	f, err := fs.Open(ctx, TailFileName, nil)
+	if err != nil {
+		// tail doesn't exist
+		return nil, nil
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tail: %w", err)
+	}
+
+	if len(data) < tailHeaderSize {
+		return nil, fmt.Errorf("failed to read tail: header too short")
+	}
+
+	var payload = io.NopCloser(bytes.NewReader(data[tailHeaderSize:]))
+	if opt.NewDecompressor != nil {
+		payload = opt.NewDecompressor(payload)
+	}
+	defer payload.Close()
+
+	var blocks []Block[T]
+	dec := opt.NewDecoder(payload)
+	for {
+		var block Block[T]
+		err = dec.Decode(&block)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode tail: %w", err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
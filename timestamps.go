@@ -0,0 +1,145 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+)
+
+var ErrZeroTimestamp = fmt.Errorf("block timestamp is zero")
+
+// TimestampStrategy is the way the timestamps of the blocks without one are derived from their neighbors.
+type TimestampStrategy int
+
+const (
+	// TimestampInterpolate interpolates the timestamp linearly between the previous and the next block
+	// with the timestamp, it's the default.
+	TimestampInterpolate TimestampStrategy = iota
+	// TimestampCopyPrevious copies the timestamp of the previous block with the timestamp.
+	TimestampCopyPrevious
+)
+
+func (s TimestampStrategy) String() string {
+	switch s {
+	case TimestampInterpolate:
+		return "interpolate"
+	case TimestampCopyPrevious:
+		return "copy-previous"
+	default:
+		return fmt.Sprintf("TimestampStrategy(%d)", int(s))
+	}
+}
+
+// blockTimestamp is the number and the timestamp of the block the missing timestamps are derived from.
+type blockTimestamp struct {
+	Number uint64
+	TS     uint64
+}
+
+// timestamp returns the timestamp of the block between the previous block and the next block, both with
+// the timestamp. The timestamp of the next block is used if there is no previous block, the timestamp of
+// the previous block is used if there is no next block or the timestamps decrease.
+func (s TimestampStrategy) timestamp(blockNum uint64, prev, next *blockTimestamp) uint64 {
+	switch {
+	case prev == nil && next == nil:
+		return 0
+	case prev == nil:
+		return next.TS
+	case next == nil || s == TimestampCopyPrevious || next.TS <= prev.TS:
+		return prev.TS
+	}
+
+	// (next.TS - prev.TS) * (blockNum - prev.Number) / (next.Number - prev.Number) without the overflow,
+	// the quotient fits as the block is between the two
+	hi, lo := bits.Mul64(next.TS-prev.TS, blockNum-prev.Number)
+	quo, _ := bits.Div64(hi, lo, next.Number-prev.Number)
+	return prev.TS + quo
+}
+
+// validateTimestamp returns ErrZeroTimestamp if the timestamp of the block other than the genesis block is
+// zero.
+func validateTimestamp(blockNum, ts uint64) error {
+	if blockNum != 0 && ts == 0 {
+		return fmt.Errorf("%w: block %d", ErrZeroTimestamp, blockNum)
+	}
+	return nil
+}
+
+// RepairTimestamps rewrites the files of the dataset with the blocks whose timestamp is zero, e.g. the
+// filler blocks written by the no gap writer before it derived their timestamps, with the timestamps
+// derived by the strategy from the nearest blocks with the timestamp. The genesis block is left as is.
+// It returns the number of the repaired blocks.
+//
+// The files are rewritten in place as by BackfillGaps, so it must not run concurrently with the writer of
+// the dataset. The recorded digests of the repaired blocks are recomputed. The blocks of the tail, not yet
+// rolled into a file, aren't repaired.
+func RepairTimestamps[T any](ctx context.Context, opt Options, strategy TimestampStrategy) (int, error) {
+	opt = opt.WithDefaults()
+
+	b, err := newBackfill[T](ctx, opt)
+	if err != nil {
+		return 0, fmt.Errorf("repair timestamps: %w", err)
+	}
+
+	type position struct {
+		file  *File
+		index int
+	}
+
+	var (
+		prev     *blockTimestamp
+		pending  []position
+		repaired int
+	)
+
+	// repair fills the timestamps of the pending blocks, the next block is nil at the end of the dataset
+	repair := func(next *blockTimestamp) {
+		for _, pos := range pending {
+			blocks := b.blocks[pos.file.FirstBlockNum]
+			blocks[pos.index].TS = strategy.timestamp(blocks[pos.index].Number, prev, next)
+			if blocks[pos.index].TS != 0 {
+				b.changed[pos.file.FirstBlockNum] = pos.file
+				b.modified[blocks[pos.index].Number] = struct{}{}
+				repaired++
+			}
+		}
+		pending = pending[:0]
+	}
+
+	for _, file := range b.fileIndex.Files() {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+
+		blocks, err := b.load(ctx, file)
+		if err != nil {
+			return 0, fmt.Errorf("repair timestamps: %w", err)
+		}
+
+		for i, block := range blocks {
+			if validateTimestamp(block.Number, block.TS) == nil {
+				if len(pending) > 0 {
+					repair(&blockTimestamp{Number: block.Number, TS: block.TS})
+				}
+				if block.TS != 0 {
+					prev = &blockTimestamp{Number: block.Number, TS: block.TS}
+				}
+				continue
+			}
+			pending = append(pending, position{file: file, index: i})
+		}
+
+		// only the files with the pending or the repaired blocks are kept in memory
+		_, changed := b.changed[file.FirstBlockNum]
+		if !changed && (len(pending) == 0 || pending[len(pending)-1].file != file) {
+			delete(b.blocks, file.FirstBlockNum)
+		}
+	}
+	repair(nil)
+
+	err = b.write(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("repair timestamps: %w", err)
+	}
+	return repaired, nil
+}
@@ -0,0 +1,132 @@
+package ethwal
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestampStrategy(t *testing.T) {
+	prev := &blockTimestamp{Number: 10, TS: 1000}
+	next := &blockTimestamp{Number: 14, TS: 1040}
+
+	require.Equal(t, uint64(1010), TimestampInterpolate.timestamp(11, prev, next))
+	require.Equal(t, uint64(1030), TimestampInterpolate.timestamp(13, prev, next))
+	require.Equal(t, uint64(1000), TimestampCopyPrevious.timestamp(13, prev, next))
+
+	// the boundaries of the dataset
+	require.Equal(t, uint64(1040), TimestampInterpolate.timestamp(9, nil, next))
+	require.Equal(t, uint64(1000), TimestampInterpolate.timestamp(15, prev, nil))
+	require.Equal(t, uint64(0), TimestampInterpolate.timestamp(15, nil, nil))
+
+	// the decreasing timestamps aren't interpolated
+	require.Equal(t, uint64(1000), TimestampInterpolate.timestamp(11, prev, &blockTimestamp{Number: 14, TS: 900}))
+
+	// no overflow
+	require.Equal(t, uint64(1<<63), TimestampInterpolate.timestamp(1<<47, &blockTimestamp{Number: 0, TS: 0}, &blockTimestamp{Number: 1 << 48, TS: 1<<64 - 1})+1)
+}
+
+func TestRepairTimestamps(t *testing.T) {
+	// zeroed are the blocks written without the timestamp, the leading run, the run within the file 1-10,
+	// the run across the files 11-20 and 21-30 and the trailing run
+	zeroed := func(blockNum uint64) bool {
+		return blockNum <= 2 || (blockNum >= 5 && blockNum <= 7) || (blockNum >= 19 && blockNum <= 22) || blockNum >= 29
+	}
+	ts := func(blockNum uint64) uint64 {
+		return 1000 + blockNum*12
+	}
+
+	writeDataset := func(t *testing.T) Options {
+		opt := Options{
+			Dataset:         Dataset{Path: "ethwal"},
+			FileSystem:      gostorage.NewMemoryFS(),
+			NewCompressor:   NewZSTDCompressor,
+			NewDecompressor: NewZSTDDecompressor,
+			FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+			FileRollOnClose: true,
+			BlockDigest:     CanonicalBlockDigest[int],
+		}
+
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+		for i := uint64(1); i <= 30; i++ {
+			b := Block[int]{Number: i, Data: int(i)}
+			if !zeroed(i) {
+				b.TS = ts(i)
+			}
+			require.NoError(t, w.Write(context.Background(), b))
+		}
+		require.NoError(t, w.Close(context.Background()))
+		return opt
+	}
+
+	readTimestamps := func(t *testing.T, opt Options) []uint64 {
+		r, err := NewReader[int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		var timestamps []uint64
+		for {
+			b, err := r.Read(context.Background())
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			require.Equal(t, int(b.Number), b.Data)
+			timestamps = append(timestamps, b.TS)
+		}
+		return timestamps
+	}
+
+	t.Run("interpolate", func(t *testing.T) {
+		opt := writeDataset(t)
+
+		repaired, err := RepairTimestamps[int](context.Background(), opt, TimestampInterpolate)
+		require.NoError(t, err)
+		require.Equal(t, 11, repaired)
+
+		timestamps := readTimestamps(t, opt)
+		require.Len(t, timestamps, 30)
+		for i, got := range timestamps {
+			blockNum := uint64(i + 1)
+			switch {
+			case blockNum <= 2:
+				require.Equal(t, ts(3), got, blockNum)
+			case blockNum >= 29:
+				require.Equal(t, ts(28), got, blockNum)
+			default:
+				require.Equal(t, ts(blockNum), got, blockNum)
+			}
+		}
+
+		// the digests of the rewritten files are recomputed
+		fileIndex := NewFileIndex(storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()))
+		require.NoError(t, fileIndex.Load(context.Background()))
+		for _, file := range fileIndex.Files() {
+			require.NotNil(t, file.DigestRoot)
+			require.NoError(t, AuditFile[int](context.Background(), opt, file))
+		}
+
+		// nothing left to repair
+		repaired, err = RepairTimestamps[int](context.Background(), opt, TimestampInterpolate)
+		require.NoError(t, err)
+		require.Zero(t, repaired)
+	})
+
+	t.Run("copy_previous", func(t *testing.T) {
+		opt := writeDataset(t)
+
+		repaired, err := RepairTimestamps[int](context.Background(), opt, TimestampCopyPrevious)
+		require.NoError(t, err)
+		require.Equal(t, 11, repaired)
+
+		timestamps := readTimestamps(t, opt)
+		require.Equal(t, ts(4), timestamps[6])
+		require.Equal(t, ts(18), timestamps[21])
+		require.Equal(t, ts(3), timestamps[0])
+	})
+}
@@ -0,0 +1,227 @@
+package ethwal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/0xsequence/ethwal/storage"
+)
+
+// VerifyLevel is the depth of the dataset verification by VerifyDataset, every level includes the checks of
+// the levels before it.
+type VerifyLevel int
+
+const (
+	// VerifyFileIndex checks that the files of the file index have valid non-overlapping block ranges and
+	// exist on the file system and aren't empty, and have the size recorded by the writer.
+	VerifyFileIndex VerifyLevel = iota
+	// VerifyFiles also decodes the files end to end with the configured decoder and decompressor and checks
+	// that their block numbers increase within the file block range and their checksums match, see
+	// Options.VerifyChecksumOnRead.
+	VerifyFiles
+	// VerifyDigests also recomputes the block digests of the files written with them, see AuditFile.
+	VerifyDigests
+)
+
+func (l VerifyLevel) String() string {
+	switch l {
+	case VerifyFileIndex:
+		return "file-index"
+	case VerifyFiles:
+		return "files"
+	case VerifyDigests:
+		return "digests"
+	default:
+		return fmt.Sprintf("VerifyLevel(%d)", int(l))
+	}
+}
+
+// VerifyProblem is the problem of the file found by VerifyDataset.
+type VerifyProblem struct {
+	File *File
+	Err  error
+}
+
+func (p VerifyProblem) String() string {
+	return fmt.Sprintf("file[%d-%d]: %s", p.File.FirstBlockNum, p.File.LastBlockNum, p.Err)
+}
+
+// VerifyReport is the result of VerifyDataset.
+type VerifyReport struct {
+	Level VerifyLevel
+	// Files is the number of the files of the file index.
+	Files int
+	// Blocks is the number of the decoded blocks, zero for VerifyFileIndex.
+	Blocks uint64
+	// Problems are the problems of the files in the file index order.
+	Problems []VerifyProblem
+}
+
+// OK reports whether no problems were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) add(file *File, err error) {
+	r.Problems = append(r.Problems, VerifyProblem{File: file.clone(), Err: err})
+}
+
+// VerifyDataset checks the integrity of the dataset at the level, e.g. after the dataset was copied. The
+// problems of all files are collected in the report, the error is returned only if the check couldn't be
+// done, e.g. the file index can't be loaded. The problems wrap ErrInvariantViolated, ErrFileNotExist,
+// ErrEmptyFile, ErrChecksumMismatch, the decoding errors or ErrFileDigestRootMismatch. The decoding of the file stops at its
+// first decoding error, the block range and order violations are reported once per file. The patches are
+// not applied.
+func VerifyDataset[T any](ctx context.Context, opt Options, level VerifyLevel) (*VerifyReport, error) {
+	opt = opt.WithDefaults()
+
+	var blockDigest BlockDigestFunc[T]
+	if level >= VerifyDigests {
+		var err error
+		blockDigest, err = blockDigestFunc[T](opt)
+		if err != nil {
+			return nil, err
+		}
+		if blockDigest == nil {
+			return nil, fmt.Errorf("block digest function is not set")
+		}
+	}
+
+	fs := storage.NewPrefixWrapper(newReplicaFS(opt), opt.Dataset.FullPath())
+	fileIndex := NewFileIndex(fs)
+	err := fileIndex.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file index: %w", err)
+	}
+
+	report := &VerifyReport{Level: level, Files: len(fileIndex.Files())}
+
+	var prev *File
+	for _, file := range fileIndex.Files() {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if file.FirstBlockNum > file.LastBlockNum {
+			report.add(file, fmt.Errorf("%w: invalid block range", ErrInvariantViolated))
+		}
+		if prev != nil && file.FirstBlockNum <= prev.LastBlockNum {
+			report.add(file, fmt.Errorf("%w: overlaps file[%d-%d]", ErrInvariantViolated, prev.FirstBlockNum, prev.LastBlockNum))
+		}
+		if prev == nil || file.LastBlockNum > prev.LastBlockNum {
+			prev = file
+		}
+
+		size, err := file.Size(ctx, fs)
+		if errors.Is(err, ErrFileNotExist) {
+			report.add(file, ErrFileNotExist)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("file[%d-%d]: %w", file.FirstBlockNum, file.LastBlockNum, err)
+		}
+		if size == 0 {
+			report.add(file, ErrEmptyFile)
+			continue
+		}
+		if level < VerifyFiles {
+			// the size of the file read to the end is checked with its checksum
+			if file.Checksum != nil && uint64(size) != file.ContentSize {
+				report.add(file, fmt.Errorf("%w: %d bytes, expected %d", ErrChecksumMismatch, size, file.ContentSize))
+			}
+			continue
+		}
+
+		blocks, err := verifyFile[T](ctx, opt, fs, file, report)
+		report.Blocks += blocks
+		if err != nil {
+			return nil, err
+		}
+
+		if blockDigest != nil && file.DigestRoot != nil {
+			err = AuditFile[T](ctx, opt, file)
+			if errors.Is(err, ErrFileDigestRootMismatch) {
+				report.add(file, ErrFileDigestRootMismatch)
+			} else if err != nil && ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return report, nil
+}
+
+// verifyFile decodes the file adding its problems to the report, it returns the number of the decoded
+// blocks. The error is returned only if the context is done.
+func verifyFile[T any](ctx context.Context, opt Options, fs storage.FS, file *File, report *VerifyReport) (uint64, error) {
+	decodeBlock, err := newSchemaDecoder[T](opt, nil, file.SchemaVersion)
+	if err != nil {
+		report.add(file, err)
+		return 0, nil
+	}
+
+	rdr, err := file.Open(ctx, fs)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		report.add(file, fmt.Errorf("failed to open file: %w", err))
+		return 0, nil
+	}
+	defer rdr.Close()
+
+	var checksum *checksumReader
+	if file.Checksum != nil {
+		checksum = newChecksumReader(rdr, file)
+		rdr = checksum
+	}
+
+	decmprRdr := io.NopCloser(rdr)
+	if opt.NewDecompressor != nil {
+		decmprRdr = opt.NewDecompressor(rdr)
+		defer decmprRdr.Close()
+	}
+
+	var (
+		decoder      = newBlockDecoder(opt, decmprRdr, nil)
+		blocks       uint64
+		lastBlockNum uint64
+		outOfRange   bool
+		outOfOrder   bool
+	)
+	for {
+		if ctx.Err() != nil {
+			return blocks, ctx.Err()
+		}
+
+		var block Block[T]
+		err = decodeBlock(decoder, &block)
+		if errors.Is(err, io.EOF) {
+			return blocks, nil
+		}
+		if err != nil {
+			err = checksum.decodeErr(err)
+		}
+		if errors.Is(err, ErrChecksumMismatch) {
+			report.add(file, err)
+			return blocks, nil
+		}
+		if err != nil {
+			// the truncated file fails to decode
+			report.add(file, fmt.Errorf("failed to decode block record %d: %w", blocks, err))
+			return blocks, nil
+		}
+
+		if !outOfRange && (block.Number < file.FirstBlockNum || block.Number > file.LastBlockNum) {
+			report.add(file, fmt.Errorf("%w: block %d is out of file block range", ErrInvariantViolated, block.Number))
+			outOfRange = true
+		}
+		if !outOfOrder && blocks > 0 && block.Number <= lastBlockNum {
+			report.add(file, fmt.Errorf("%w: block %d is not after block %d", ErrInvariantViolated, block.Number, lastBlockNum))
+			outOfOrder = true
+		}
+		lastBlockNum = max(lastBlockNum, block.Number)
+		blocks++
+	}
+}
@@ -0,0 +1,162 @@
+package ethwal
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyDataset(t *testing.T) {
+	opt, files := writeDigestDataset(t)
+	require.Len(t, files, 7)
+
+	report, err := VerifyDataset[[]int](context.Background(), opt, VerifyDigests)
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Problems)
+	require.Equal(t, 7, report.Files)
+	require.Equal(t, uint64(len(generateMixedIntBlocks())), report.Blocks)
+
+	fs := storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath())
+	readFile := func(file *File) []byte {
+		data, err := storageReadAll(fs, file.Path())
+		require.NoError(t, err)
+		return data
+	}
+	encodeBlocks := func(blocks []Block[[]int]) []byte {
+		var buf bytes.Buffer
+		encoder := opt.WithDefaults().NewEncoder(&buf)
+		for _, b := range blocks {
+			require.NoError(t, encoder.Encode(b))
+		}
+		return buf.Bytes()
+	}
+	writeFile := func(file *File, data []byte) {
+		w, err := file.Create(context.Background(), fs)
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+
+	// the file truncated by the bad copy
+	data := readFile(files[0])
+	writeFile(files[0], data[:len(data)/2+1])
+
+	// the missing file
+	require.NoError(t, fs.Delete(context.Background(), files[1].Path()))
+
+	// the file changed since it was written
+	mutateBlock(t, opt, files[2], 25)
+
+	// the file with the blocks of another file
+	writeFile(files[3], readFile(files[4]))
+
+	// the file with the blocks out of order
+	var blocks []Block[[]int]
+	require.NoError(t, decodeFile(context.Background(), opt.WithDefaults(), fs, files[4], func(b Block[[]int]) error {
+		blocks = append(blocks, b)
+		return nil
+	}))
+	slices.Reverse(blocks)
+	writeFile(files[4], encodeBlocks(blocks))
+
+	// the file overlapping the last file
+	overlapping := &File{FirstBlockNum: 69, LastBlockNum: 80}
+	writeFile(overlapping, encodeBlocks([]Block[[]int]{{Number: 70}, {Number: 80}}))
+	require.NoError(t, NewFileIndexFromFiles(fs, append(files, overlapping)).Save(context.Background()))
+
+	problems := func(report *VerifyReport) map[uint64][]error {
+		problems := make(map[uint64][]error)
+		for _, problem := range report.Problems {
+			problems[problem.File.FirstBlockNum] = append(problems[problem.File.FirstBlockNum], problem.Err)
+		}
+		return problems
+	}
+
+	t.Run("file_index", func(t *testing.T) {
+		report, err := VerifyDataset[[]int](context.Background(), opt, VerifyFileIndex)
+		require.NoError(t, err)
+		require.False(t, report.OK())
+		require.Equal(t, 8, report.Files)
+		require.Zero(t, report.Blocks)
+
+		found := problems(report)
+		require.Len(t, found, 4)
+		require.Len(t, found[11], 1)
+		require.ErrorIs(t, found[11][0], ErrFileNotExist)
+		require.Len(t, found[69], 1)
+		require.ErrorIs(t, found[69][0], ErrInvariantViolated)
+		require.Contains(t, found[69][0].Error(), "overlaps file[61-70]")
+
+		// the files of the changed size don't match their recorded size
+		require.Len(t, found[1], 1)
+		require.ErrorIs(t, found[1][0], ErrChecksumMismatch)
+		require.Len(t, found[21], 1)
+		require.ErrorIs(t, found[21][0], ErrChecksumMismatch)
+	})
+
+	t.Run("files", func(t *testing.T) {
+		report, err := VerifyDataset[[]int](context.Background(), opt, VerifyFiles)
+		require.NoError(t, err)
+
+		found := problems(report)
+		require.Len(t, found, 6)
+		require.Len(t, found[11], 1)
+		require.Len(t, found[69], 1)
+		require.Len(t, found[1], 1)
+		require.ErrorIs(t, found[1][0], ErrChecksumMismatch)
+		require.Len(t, found[31], 2)
+		require.ErrorIs(t, found[31][0], ErrInvariantViolated)
+		require.Contains(t, found[31][0].Error(), "block 41 is out of file block range")
+		require.ErrorIs(t, found[31][1], ErrChecksumMismatch)
+		require.Len(t, found[41], 2)
+		require.ErrorIs(t, found[41][0], ErrInvariantViolated)
+		require.Contains(t, found[41][0].Error(), "block 49 is not after block 50")
+		require.ErrorIs(t, found[41][1], ErrChecksumMismatch)
+
+		// the mutated file decodes, but doesn't match its checksum
+		require.Len(t, found[21], 1)
+		require.ErrorIs(t, found[21][0], ErrChecksumMismatch)
+
+		// the files written before the checksums were recorded are decoded only
+		legacyFiles := make([]*File, 0, len(files))
+		for _, file := range append(files, overlapping) {
+			legacy := file.clone()
+			legacy.ContentSize, legacy.Checksum = 0, nil
+			legacyFiles = append(legacyFiles, legacy)
+		}
+		require.NoError(t, NewFileIndexFromFiles(fs, legacyFiles).Save(context.Background()))
+		defer func() {
+			require.NoError(t, NewFileIndexFromFiles(fs, append(files, overlapping)).Save(context.Background()))
+		}()
+
+		report, err = VerifyDataset[[]int](context.Background(), opt, VerifyFiles)
+		require.NoError(t, err)
+
+		found = problems(report)
+		require.Len(t, found, 5)
+		require.Contains(t, found[1][0].Error(), "failed to decode")
+		require.Len(t, found[31], 1)
+		require.Len(t, found[41], 1)
+		require.NotContains(t, found, uint64(21))
+	})
+
+	t.Run("digests", func(t *testing.T) {
+		report, err := VerifyDataset[[]int](context.Background(), opt, VerifyDigests)
+		require.NoError(t, err)
+
+		found := problems(report)
+		require.Len(t, found[21], 2)
+		require.ErrorIs(t, found[21][0], ErrChecksumMismatch)
+		require.ErrorIs(t, found[21][1], ErrFileDigestRootMismatch)
+
+		noDigest := opt
+		noDigest.BlockDigest = nil
+		_, err = VerifyDataset[[]int](context.Background(), noDigest, VerifyDigests)
+		require.Error(t, err)
+	})
+}
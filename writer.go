@@ -2,79 +2,258 @@ package ethwal
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/0xsequence/ethwal/storage"
-	"github.com/0xsequence/ethwal/storage/local"
+	"github.com/RoaringBitmap/roaring/v2/roaring64"
 )
 
 type Writer[T any] interface {
 	FileSystem() storage.FS
 	Write(ctx context.Context, b Block[T]) error
+	// WriteWithStatus writes the block and returns the state of the writer after the write.
+	WriteWithStatus(ctx context.Context, b Block[T]) (WriteStatus, error)
+	// WriteBatch writes the blocks, sorted ascending by the block number, as Write does but under one lock
+	// and with the file roll policy checked only before the batch or every Options.BatchRollCheckInterval
+	// blocks. The blocks less than or equal to the last written block are skipped. Nothing is written if
+	// the batch isn't sorted or any block is invalid.
+	WriteBatch(ctx context.Context, blocks []Block[T]) error
+	// WillRollNext reports whether the next write rolls the file.
+	WillRollNext() bool
+	// BlockNum returns the last block number accepted by the writer.
+	//
+	// Deprecated: use AcceptedBlockNum or DurableBlockNum instead.
 	BlockNum() uint64
+	// AcceptedBlockNum returns the last block number accepted by the writer chain. The block
+	// may not be persisted to the storage yet.
+	AcceptedBlockNum() uint64
+	// DurableBlockNum returns the last block number that is guaranteed to be persisted to the
+	// storage. This is the block number the ingestion should resume from after a crash.
+	DurableBlockNum() uint64
 	RollFile(ctx context.Context) error
+	// Flush writes the blocks of the current file to the file system and the file index without rolling the
+	// file, the next blocks are appended to the same file. The next flush or the roll replaces the file
+	// index entry of the flushed file with the extended one and deletes the flushed file.
+	Flush(ctx context.Context) error
+	// ReconfigureRollPolicy replaces the file roll policy of the writer at the file boundary given by the
+	// mode. The flush hooks of the wrapped policy, like the indexer flush, are kept and the new policy is
+	// seeded with the state of the writer.
+	ReconfigureRollPolicy(ctx context.Context, p FileRollPolicy, mode RolloverMode) error
+	// Rollback removes the blocks after toBlockNum from the dataset, e.g. after the chain reorg deeper than the
+	// blocks kept by the caller, so that the next write continues at toBlockNum+1. The buffered blocks and the
+	// files after the block are dropped, the file containing the block is rewritten with its blocks up to it.
+	// The writer with indexer rolls back the indexes too, see Indexer.Rollback. It's a no-op if toBlockNum
+	// isn't before the last accepted block, so the rollback that failed is retried.
+	Rollback(ctx context.Context, toBlockNum uint64) error
+	// MarkExamined records that the ingester examined the blocks in the range [from, to], even if it
+	// wrote nothing. It must be called after the blocks in the range are written. The marks are stored
+	// with the next file roll, RollFile or Close. It's a no-op unless Options.TrackPresence is set.
+	MarkExamined(ctx context.Context, from, to uint64) error
+	// Close writes the pending blocks if Options.FileRollOnClose is set and releases all resources held
+	// by the writer and the components it wraps. It's safe to call Close multiple times.
 	Close(ctx context.Context) error
 	Options() Options
 	SetOptions(opt Options)
+	// Accounting returns the storage accounting of the writer, or nil if Options.EnableAccounting isn't set.
+	Accounting() *storage.Accounting
+	// ID returns the identity of the innermost writer instance.
+	ID() Instance
+}
+
+// sequencedWriter is implemented by the writers that check the block sequence, see Options.StrictSequence.
+// The wrappers delegate it to the writer they wrap.
+type sequencedWriter interface {
+	// checkSequence returns the error the write of the blocks would fail with because of their sequence.
+	checkSequence(blockNums []uint64) error
+	// allowGaps disables ErrBlockGap, e.g. for the writer whose gaps are filled by the wrapper.
+	allowGaps()
+	// empty reports whether the dataset has no blocks, the next block starts it.
+	empty() bool
+}
+
+// checkSequence returns the sequence error of the blocks written next to the writer, nil if the writer
+// doesn't check the sequence.
+func checkSequence[T any](w Writer[T], blockNums []uint64) error {
+	if sw, ok := w.(sequencedWriter); ok {
+		return sw.checkSequence(blockNums)
+	}
+	return nil
+}
+
+// allowGaps disables ErrBlockGap of the writer.
+func allowGaps[T any](w Writer[T]) {
+	if sw, ok := w.(sequencedWriter); ok {
+		sw.allowGaps()
+	}
+}
+
+// writerEmpty reports whether the dataset of the writer has no blocks, the writer that doesn't tell is empty
+// until it accepts a block after block 0.
+func writerEmpty[T any](w Writer[T]) bool {
+	if sw, ok := w.(sequencedWriter); ok {
+		return sw.empty()
+	}
+	return w.AcceptedBlockNum() == 0
+}
+
+// FileStats contains metadata of the file written by the writer.
+type FileStats struct {
+	Path             string
+	NumBlocks        uint64
+	Size             uint64
+	UncompressedSize uint64
+	// Took is the duration of the roll, the end of the compressed stream and the writes of the file and the file
+	// index.
+	Took time.Duration
+}
+
+// WriteStatus is the state of the writer after the write.
+type WriteStatus struct {
+	// BufferedBytes is the number of bytes of the file that is not rolled yet.
+	BufferedBytes uint64
+	// BufferedBlocks is the number of blocks of the file that is not rolled yet.
+	BufferedBlocks uint64
+	// BytesUntilRoll is the estimated number of bytes that can be written before the size roll policy
+	// triggers the roll. It's math.MaxUint64 if no size roll policy is used.
+	BytesUntilRoll uint64
+	// Rolled reports whether the write rolled the file.
+	Rolled bool
+	// PendingIndexBytes is the estimated size of the index updates that are not flushed yet. It's set by
+	// the writer with indexer.
+	PendingIndexBytes uint64
+	// CompressionRatio is the ratio of the stored to the encoded size of the files written by the writer.
+	// It's zero until the first file is written.
+	CompressionRatio float64
 }
 
 type writer[T any] struct {
-	options Options
+	options  Options
+	instance Instance
 
 	path string
 	fs   storage.FS
+	// metaFs is fs for the file index, the tail and the presence shards
+	metaFs storage.FS
 
 	buffer       *bytes.Buffer
 	bufferCloser io.Closer
 
-	firstBlockNum uint64
-	lastBlockNum  uint64
+	firstBlockNum   uint64
+	lastBlockNum    uint64
+	durableBlockNum uint64
+	// genesis is set until the first block of the empty dataset is written, so that block 0 is accepted
+	genesis bool
+	// gapsAllowed disables ErrBlockGap of Options.StrictSequence, see allowGaps
+	gapsAllowed bool
 
 	fileIndex *FileIndex
+	// manifestPending is set until the writer records the manifest of the dataset without it
+	manifestPending bool
+	// flushedFile is the current file written by Flush, it's replaced by the next flush or the roll
+	flushedFile              *File
+	flushedBytes             uint64
+	flushedUncompressedBytes uint64
 
 	encoder Encoder
 
+	numBlocks         uint64
+	uncompressedBytes uint64
+
+	// totals of the written files for the compression ratio
+	totalBytes             uint64
+	totalUncompressedBytes uint64
+
+	tailBuffer    bytes.Buffer
+	lastTailFlush time.Time
+
+	journal *journal
+
+	blobs BlobStore
+
+	bloomKeys   BloomKeysFunc[T]
+	bloomHashes map[[2]uint64]struct{}
+
+	blockDigest BlockDigestFunc[T]
+	digests     *blockDigests
+
+	// pendingRollPolicy is installed by the next file, see ReconfigureRollPolicy
+	pendingRollPolicy FileRollPolicy
+	fileStartedAt     time.Time
+
+	presence        *presenceStore
+	pendingPresence *roaring64.Bitmap
+
+	changelog *changelog
+
+	fileWrittenQueue chan fileWrittenEvent
+	fileWrittenWg    sync.WaitGroup
+
+	// hookCalls are the calls of Options.Hooks made once the lock is released, see callHooks
+	hookCalls []func()
+
 	mu sync.Mutex
 }
 
+type fileWrittenEvent struct {
+	ctx   context.Context
+	file  *File
+	stats FileStats
+}
+
 func NewWriter[T any](opt Options) (Writer[T], error) {
 	// apply default options on uninitialized fields
-	opt = opt.WithDefaults()
+	opt = opt.WithDefaults().withAccounting()
+
+	// create instance identity
+	instance := newInstance(opt.InstanceID, opt.Dataset)
 
 	if opt.Dataset.Path == "" {
-		return nil, fmt.Errorf("path cannot be empty")
+		return nil, instance.wrapError(fmt.Errorf("path cannot be empty"))
 	}
 
 	// build dataset path
 	datasetPath := opt.Dataset.FullPath()
 
-	// create dataset directory if it doesn't exist on local FS
-	if _, ok := opt.FileSystem.(*local.LocalFS); ok {
-		if _, err := os.Stat(datasetPath); os.IsNotExist(err) {
+	// create dataset directory if it doesn't exist on local FS, unless only the existing dataset is opened
+	if isLocalFS(opt.FileSystem) {
+		if _, err := os.Stat(datasetPath); os.IsNotExist(err) && !opt.OpenExisting {
 			err := os.MkdirAll(datasetPath, 0755)
 			if err != nil {
-				return nil, fmt.Errorf("failed to create ethwal directory")
+				return nil, instance.wrapError(fmt.Errorf("failed to create ethwal directory"))
 			}
 		}
 	}
 
-	// mount FS with dataset path prefix
-	fs := storage.NewPrefixWrapper(opt.FileSystem, datasetPath)
+	// mount FS with dataset path prefix, objects are labeled with their class
+	fs := opt.withObjectClass(storage.NewPrefixWrapper(opt.FileSystem, datasetPath), ObjectClassData)
+	metaFs := opt.withObjectClass(storage.NewPrefixWrapper(opt.FileSystem, datasetPath), ObjectClassMeta)
 
 	// create file index
-	fileIndex := NewFileIndex(fs)
+	fileIndex := NewFileIndex(metaFs)
 
 	// load file index
 	ctx, cancel := context.WithTimeout(context.Background(), loadIndexFileTimeout)
 	defer cancel()
 
+	if opt.OpenExisting {
+		err := checkDatasetExists(ctx, metaFs, datasetPath)
+		if err != nil {
+			return nil, instance.wrapError(err)
+		}
+	}
+
 	err := fileIndex.Load(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load file index: %w", err)
+		return nil, instance.wrapError(fmt.Errorf("failed to load file index: %w", err))
 	}
 
 	var lastBlockNum uint64
@@ -83,16 +262,122 @@ func NewWriter[T any](opt Options) (Writer[T], error) {
 		lastBlockNum = fileIndexFileList[len(fileIndexFileList)-1].LastBlockNum
 	}
 
+	// corrupted file index could make the next block number overflow
+	err = validateBlockNum(lastBlockNum)
+	if err != nil {
+		return nil, instance.wrapError(fmt.Errorf("invalid file index: %w", err))
+	}
+
+	if opt.CBORPreset != "" {
+		_, err = LookupCBORPreset(opt.CBORPreset)
+		if err != nil {
+			return nil, instance.wrapError(err)
+		}
+	}
+
+	// unsupported encoding options fail before any block is written, the probe block is decoded only with
+	// the preset as the decoder of the custom encoder might not be set
+	err = validateCodecRoundTrip[T](opt, opt.CBORPreset != "")
+	if err != nil {
+		return nil, instance.wrapError(err)
+	}
+
+	if opt.SchemaVersion > 0 || opt.CBORPreset != "" {
+		err = recordDatasetSchema(ctx, metaFs, opt.SchemaVersion, opt.CBORPreset)
+		if err != nil {
+			return nil, instance.wrapError(err)
+		}
+	}
+
+	// the writer must write the files the way the manifest describes
+	manifest, err := readDatasetManifest(ctx, metaFs)
+	if err != nil {
+		return nil, instance.wrapError(err)
+	}
+	if manifest != nil {
+		err = manifest.checkWriter(opt)
+		if err != nil {
+			return nil, instance.wrapError(err)
+		}
+	}
+
+	// the files are compressed with the dataset dictionary
+	dict, err := loadDatasetDictionary(ctx, metaFs, manifest)
+	if err != nil {
+		return nil, instance.wrapError(err)
+	}
+	useDatasetDictionary(&opt, dict)
+
+	bloomKeys, err := bloomKeysFunc[T](opt)
+	if err != nil {
+		return nil, instance.wrapError(err)
+	}
+
+	blockDigest, err := blockDigestFunc[T](opt)
+	if err != nil {
+		return nil, instance.wrapError(err)
+	}
+
 	// create new writer
-	return &writer[T]{
-		options:       opt,
-		path:          datasetPath,
-		fs:            fs,
-		firstBlockNum: lastBlockNum + 1,
-		lastBlockNum:  lastBlockNum,
-		fileIndex:     fileIndex,
-		buffer:        bytes.NewBuffer(make([]byte, 0, defaultFileSize)),
-	}, nil
+	w := &writer[T]{
+		options:         opt,
+		instance:        instance,
+		path:            datasetPath,
+		fs:              fs,
+		metaFs:          metaFs,
+		firstBlockNum:   lastBlockNum + 1,
+		lastBlockNum:    lastBlockNum,
+		durableBlockNum: lastBlockNum,
+		genesis:         len(fileIndexFileList) == 0,
+		fileIndex:       fileIndex,
+		manifestPending: manifest == nil,
+		buffer:          bytes.NewBuffer(make([]byte, 0, defaultFileSize)),
+		bloomKeys:       bloomKeys,
+		blockDigest:     blockDigest,
+	}
+
+	if opt.BlobThreshold > 0 {
+		w.blobs = cmp.Or(opt.BlobStore, NewFSBlobStore(fs))
+	}
+
+	if opt.TrackPresence {
+		w.presence = newPresenceStore(metaFs)
+		w.pendingPresence = roaring64.New()
+	}
+
+	// the files saved before the crash that weren't appended to the changelog are appended first
+	if opt.EnableChangefeed {
+		w.changelog = newChangelog(metaFs)
+		err = w.changelog.recoverFiles(ctx, fileIndex.Files())
+		if err != nil {
+			return nil, instance.wrapError(fmt.Errorf("failed to recover changelog: %w", err))
+		}
+	}
+
+	if opt.OnFileWritten != nil && opt.OnFileWrittenAsync {
+		w.fileWrittenQueue = make(chan fileWrittenEvent, defaultFileWrittenQueueSize)
+		w.fileWrittenWg.Add(1)
+		go w.notifyFileWritten(w.fileWrittenQueue)
+	}
+
+	// open journal and recover blocks that were not rolled
+	if opt.LocalJournalPath != "" {
+		j, err := openJournal(opt.LocalJournalPath, opt)
+		if err != nil {
+			return nil, instance.wrapError(err)
+		}
+
+		// recovered blocks are already in the journal
+		err = journalRecover(j, func(b Block[T]) error {
+			return w.Write(context.Background(), b)
+		})
+		if err != nil {
+			_ = j.Close()
+			return nil, instance.wrapError(fmt.Errorf("failed to recover journal: %w", err))
+		}
+		w.journal = j
+	}
+	return w, nil
 }
 
 func (w *writer[T]) FileSystem() storage.FS {
@@ -100,76 +385,440 @@ func (w *writer[T]) FileSystem() storage.FS {
 }
 
 func (w *writer[T]) Write(ctx context.Context, b Block[T]) error {
+	defer w.callHooks()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.instance.wrapError(w.write(ctx, b))
+}
+
+func (w *writer[T]) WriteWithStatus(ctx context.Context, b Block[T]) (WriteStatus, error) {
+	defer w.callHooks()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// the roll makes the written blocks durable
+	durableBlockNum := w.durableBlockNum
+
+	err := w.write(ctx, b)
+	if err != nil {
+		return WriteStatus{}, w.instance.wrapError(err)
+	}
+
+	status := w.status()
+	status.Rolled = w.durableBlockNum != durableBlockNum
+	return status, nil
+}
+
+func (w *writer[T]) WillRollNext() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// the file is rolled only if there are blocks to write
+	return w.isReadyToWrite() && w.lastBlockNum >= w.firstBlockNum && w.options.FileRollPolicy.ShouldRoll()
+}
+
+func (w *writer[T]) status() WriteStatus {
+	bytesUntilRoll, ok := bytesUntilRoll(w.options.FileRollPolicy)
+	if !ok {
+		bytesUntilRoll = math.MaxUint64
+	}
+
+	var compressionRatio float64
+	if w.totalUncompressedBytes > 0 {
+		compressionRatio = float64(w.totalBytes) / float64(w.totalUncompressedBytes)
+	}
+
+	return WriteStatus{
+		BufferedBytes:    uint64(w.buffer.Len()),
+		BufferedBlocks:   w.numBlocks,
+		BytesUntilRoll:   bytesUntilRoll,
+		CompressionRatio: compressionRatio,
+	}
+}
+
+func (w *writer[T]) WriteBatch(ctx context.Context, blocks []Block[T]) error {
+	defer w.callHooks()
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	if w.lastBlockNum >= b.Number {
+	return w.instance.wrapError(w.writeBatch(ctx, blocks))
+}
+
+func (w *writer[T]) write(ctx context.Context, b Block[T]) error {
+	if err := validateBlockNum(b.Number); err != nil {
+		return err
+	}
+	if err := validateBlockMeta(w.options, b.Meta); err != nil {
+		return err
+	}
+	if err := w.sequenceError(b.Number); err != nil {
+		return err
+	}
+	return w.writeBlock(ctx, b, true)
+}
+
+func (w *writer[T]) writeBatch(ctx context.Context, blocks []Block[T]) error {
+	err := validateBatch(blocks)
+	if err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		if err := validateBlockMeta(w.options, b.Meta); err != nil {
+			return fmt.Errorf("block %d: %w", b.Number, err)
+		}
+	}
+	if err := w.sequenceError(batchBlockNums(blocks)...); err != nil {
+		return err
+	}
+
+	var written int
+	for _, b := range blocks {
+		if !w.accepts(b.Number) {
+			continue
+		}
+
+		checkRoll := written == 0 || (w.options.BatchRollCheckInterval > 0 && written%w.options.BatchRollCheckInterval == 0)
+		err = w.writeBlock(ctx, b, checkRoll)
+		if err != nil {
+			return err
+		}
+		written++
+	}
+	return nil
+}
+
+// accepts reports whether the block is after the last written block, the empty dataset accepts block 0.
+func (w *writer[T]) accepts(blockNum uint64) bool {
+	return blockNum > w.lastBlockNum || (w.genesis && blockNum == 0)
+}
+
+// sequenceError returns ErrNonMonotonicBlock or ErrBlockGap of the first block written out of sequence if
+// Options.StrictSequence is set. The block numbers are ascending.
+func (w *writer[T]) sequenceError(blockNums ...uint64) error {
+	if !w.options.StrictSequence {
 		return nil
 	}
 
-	if !w.isReadyToWrite() || w.options.FileRollPolicy.ShouldRoll() {
+	lastBlockNum, genesis := w.lastBlockNum, w.genesis
+	for _, blockNum := range blockNums {
+		if blockNum <= lastBlockNum && !(genesis && blockNum == 0) {
+			return &ErrNonMonotonicBlock{Got: blockNum, Last: lastBlockNum}
+		}
+		// the empty dataset starts at any block
+		if !genesis && !w.gapsAllowed && blockNum > lastBlockNum+1 {
+			return &ErrBlockGap{Expected: lastBlockNum + 1, Got: blockNum}
+		}
+		lastBlockNum, genesis = blockNum, false
+	}
+	return nil
+}
+
+func (w *writer[T]) checkSequence(blockNums []uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.sequenceError(blockNums...)
+}
+
+func (w *writer[T]) allowGaps() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.gapsAllowed = true
+}
+
+func (w *writer[T]) empty() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.genesis
+}
+
+// writeBlock writes the validated block, the file roll policy is checked before the block if checkRoll is set.
+func (w *writer[T]) writeBlock(ctx context.Context, b Block[T], checkRoll bool) error {
+	if !w.accepts(b.Number) {
+		return nil
+	}
+
+	policy := w.options.FileRollPolicy
+	if !w.isReadyToWrite() || (checkRoll && (policy.ShouldRoll() || shouldRollBefore(policy, b.Number))) {
 		if err := w.rollFile(ctx); err != nil {
 			return fmt.Errorf("failed to roll to the next file: %w", err)
 		}
 	}
 
+	// the genesis block starts the first file of the dataset
+	if b.Number == 0 {
+		w.firstBlockNum = 0
+	}
+
+	if w.journal != nil {
+		err := w.journal.Append(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	// collect bloom keys before the data is offloaded
+	if w.bloomKeys != nil {
+		for _, key := range w.bloomKeys(b) {
+			h1, h2 := bloomHash(key)
+			w.bloomHashes[[2]uint64{h1, h2}] = struct{}{}
+		}
+	}
+
+	// digest the data before it's offloaded
+	if w.blockDigest != nil {
+		w.digests.add(b.Number, w.blockDigest(b))
+	}
+
+	// offload large data to the blob store
+	if w.blobs != nil {
+		var err error
+		b, err = offloadBlob(ctx, w.options, w.blobs, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	encodedBytes := w.uncompressedBytes
 	err := w.encoder.Encode(b)
 	if err != nil {
 		return fmt.Errorf("failed to encode file data: %w", err)
 	}
+	if onBlockWritten := w.options.Hooks.OnBlockWritten; onBlockWritten != nil {
+		blockNum, bytes := b.Number, int(w.uncompressedBytes-encodedBytes)
+		w.queueHook(func() { onBlockWritten(blockNum, bytes) })
+	}
+
+	// make the compressed size of the buffered data known to the roll policy
+	if flusher, ok := w.bufferCloser.(interface{ Flush() error }); ok && shouldFlushCompressor(w.options.FileRollPolicy) {
+		err = flusher.Flush()
+		if err != nil {
+			return fmt.Errorf("failed to flush compressor: %w", err)
+		}
+		onCompressorFlush(w.options.FileRollPolicy)
+	}
 
 	w.lastBlockNum = b.Number
+	w.genesis = false
+	w.numBlocks++
+	if w.pendingPresence != nil {
+		w.pendingPresence.Add(b.Number)
+	}
 	w.options.FileRollPolicy.onBlockProcessed(w.lastBlockNum)
+
+	// store blocks that are not rolled yet for followers
+	if w.options.TailFlushInterval > 0 && time.Since(w.lastTailFlush) >= w.options.TailFlushInterval {
+		err = writeTail(ctx, w.metaFs, w.options, w.firstBlockNum, w.lastBlockNum, w.tailBuffer.Bytes())
+		if err != nil {
+			return err
+		}
+		w.lastTailFlush = time.Now()
+	}
 	return nil
 }
 
 func (w *writer[T]) RollFile(ctx context.Context) error {
+	defer w.callHooks()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.instance.wrapError(w.rollFile(ctx))
+}
+
+func (w *writer[T]) Flush(ctx context.Context) error {
+	defer w.callHooks()
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	return w.rollFile(ctx)
+	return w.instance.wrapError(w.flush(ctx))
+}
+
+func (w *writer[T]) flush(ctx context.Context) error {
+	// skip if there are no blocks written since the last flush
+	if !w.isReadyToWrite() || w.lastBlockNum < w.firstBlockNum {
+		return nil
+	}
+	if w.flushedFile != nil && w.flushedFile.LastBlockNum == w.lastBlockNum {
+		return nil
+	}
+
+	// the file is written with the compressed stream ended, the next blocks are appended to the stream
+	var end []byte
+	if w.options.NewCompressor != nil {
+		compressor, ok := w.bufferCloser.(flushableCompressor)
+		if !ok {
+			return ErrFlushNotSupported
+		}
+
+		var err error
+		end, err = compressor.flushEnd()
+		if err != nil {
+			return fmt.Errorf("failed to flush compressor: %w", err)
+		}
+	}
+
+	size := w.buffer.Len()
+	w.buffer.Write(end)
+	err := w.writeFile(ctx, false)
+	w.buffer.Truncate(size)
+	return err
+}
+
+func (w *writer[T]) ReconfigureRollPolicy(ctx context.Context, p FileRollPolicy, mode RolloverMode) error {
+	defer w.callHooks()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if p == nil {
+		return w.instance.wrapError(fmt.Errorf("file roll policy cannot be nil"))
+	}
+
+	// the policy is installed by the next file, so that the encoder passes the data to it
+	w.pendingRollPolicy = p
+	if mode == RolloverAtNextRoll || !w.isReadyToWrite() {
+		return nil
+	}
+
+	if w.lastBlockNum >= w.firstBlockNum {
+		return w.instance.wrapError(w.rollFile(ctx))
+	}
+
+	// the empty file is dropped
+	err := w.bufferCloser.Close()
+	if err != nil {
+		return w.instance.wrapError(err)
+	}
+	return w.instance.wrapError(w.newFile())
+}
+
+// installRollPolicy replaces the file roll policy, keeping the flush hooks of the wrapped policy.
+func (w *writer[T]) installRollPolicy(p FileRollPolicy) {
+	p = replaceRollPolicy(w.options.FileRollPolicy, p)
+	seedRollPolicy(p, rollPolicyState{
+		compressedBytes:        uint64(w.buffer.Len()),
+		uncompressedBytes:      w.uncompressedBytes,
+		fileStartedAt:          w.fileStartedAt,
+		lastBlockNum:           w.lastBlockNum,
+		numBlocks:              w.numBlocks,
+		totalCompressedBytes:   w.totalBytes,
+		totalUncompressedBytes: w.totalUncompressedBytes,
+	})
+
+	w.options.FileRollPolicy = p
+	w.pendingRollPolicy = nil
+}
+
+func (w *writer[T]) MarkExamined(ctx context.Context, from, to uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.pendingPresence == nil {
+		return nil
+	}
+
+	if from > to {
+		return w.instance.wrapError(fmt.Errorf("invalid block range: %d > %d", from, to))
+	}
+	if err := validateBlockNum(to); err != nil {
+		return w.instance.wrapError(err)
+	}
+
+	w.pendingPresence.AddRange(from, to+1)
+	return nil
 }
 
 func (w *writer[T]) BlockNum() uint64 {
+	return w.AcceptedBlockNum()
+}
+
+func (w *writer[T]) AcceptedBlockNum() uint64 {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	return w.lastBlockNum
 }
 
+func (w *writer[T]) DurableBlockNum() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.durableBlockNum
+}
+
 func (w *writer[T]) Close(ctx context.Context) error {
+	defer w.callHooks()
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	err := w.close(ctx)
+	if w.changelog != nil {
+		// the events that failed to append are retried once more
+		err = errors.Join(err, w.changelog.publish(ctx))
+	}
+	return w.instance.wrapError(err)
+}
+
+func (w *writer[T]) close(ctx context.Context) error {
+	// wait for pending file written notifications
+	if w.fileWrittenQueue != nil {
+		defer func() {
+			close(w.fileWrittenQueue)
+			w.fileWrittenQueue = nil
+			w.fileWrittenWg.Wait()
+		}()
+	}
+
+	// close journal, not rolled blocks are recovered by the next writer
+	if w.journal != nil {
+		defer func() {
+			_ = w.journal.Close()
+			w.journal = nil
+		}()
+	}
+
 	if w.options.FileRollOnClose {
 		// close previous buffer and write file to fs
 		if w.bufferCloser != nil {
 			// skip if there are no blocks to write
 			if w.lastBlockNum < w.firstBlockNum {
-				return nil
-			}
-
-			err := w.bufferCloser.Close()
-			if err != nil {
-				return err
+				return w.flushPresence(ctx)
 			}
 
-			err = w.writeFile(ctx)
+			err := w.writeRolledFile(ctx)
 			if err != nil {
 				return err
 			}
 		}
 		w.bufferCloser = nil
 	}
-	return nil
+	return w.flushPresence(ctx)
 }
 
 func (w *writer[T]) Options() Options {
 	return w.options
 }
 
+func (w *writer[T]) Accounting() *storage.Accounting {
+	return w.options.Accounting
+}
+
 func (w *writer[T]) SetOptions(opt Options) {
 	w.options = opt
 }
 
+func (w *writer[T]) ID() Instance {
+	return w.instance
+}
+
+// countingWriter is a writer that counts the number of bytes written to it.
+type countingWriter struct {
+	io.Writer
+
+	n *uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	*c.n += uint64(n)
+	return n, err
+}
+
 func (w *writer[T]) isReadyToWrite() bool {
 	return w.encoder != nil
 }
@@ -179,15 +828,15 @@ func (w *writer[T]) rollFile(ctx context.Context) error {
 	if w.bufferCloser != nil {
 		// skip if there are no blocks to write
 		if w.lastBlockNum < w.firstBlockNum {
-			return nil
+			return w.flushPresence(ctx)
 		}
 
-		err := w.bufferCloser.Close()
+		err := w.writeRolledFile(ctx)
 		if err != nil {
 			return err
 		}
-
-		err = w.writeFile(ctx)
+	} else {
+		err := w.flushPresence(ctx)
 		if err != nil {
 			return err
 		}
@@ -196,51 +845,306 @@ func (w *writer[T]) rollFile(ctx context.Context) error {
 	return w.newFile()
 }
 
-func (w *writer[T]) writeFile(ctx context.Context) error {
+// writeRolledFile ends the compressed stream of the current file and writes the file, the rolled file is reported
+// to Options.OnFileWritten and the failed roll to Options.Hooks.
+func (w *writer[T]) writeRolledFile(ctx context.Context) error {
+	start := time.Now()
+	err := w.bufferCloser.Close()
+	if err == nil {
+		err = w.writeFile(ctx, true)
+	}
+	if err != nil {
+		if onFileRollError := w.options.Hooks.OnFileRollError; onFileRollError != nil {
+			w.queueHook(func() { onFileRollError(err) })
+		}
+		return err
+	}
+
+	// notify about written file, it's the flushed one until the next file, the callback gets its copy
+	if w.options.OnFileWritten != nil {
+		file := w.flushedFile.clone()
+		stats := FileStats{
+			Path:             file.Path(),
+			NumBlocks:        w.numBlocks,
+			Size:             uint64(w.buffer.Len()),
+			UncompressedSize: w.uncompressedBytes,
+			Took:             time.Since(start),
+		}
+
+		hookCtx := ContextWithInstance(ctx, w.instance)
+		if w.fileWrittenQueue != nil {
+			w.fileWrittenQueue <- fileWrittenEvent{ctx: context.WithoutCancel(hookCtx), file: file, stats: stats}
+		} else {
+			w.options.OnFileWritten(hookCtx, file, stats)
+		}
+	}
+	return nil
+}
+
+// queueHook queues the call of the hook until the lock of the writer is released.
+func (w *writer[T]) queueHook(call func()) {
+	w.hookCalls = append(w.hookCalls, call)
+}
+
+// callHooks calls the queued hooks, it's deferred by the methods before they take the lock, so that the hooks
+// are called once it's released.
+func (w *writer[T]) callHooks() {
+	w.mu.Lock()
+	calls := w.hookCalls
+	w.hookCalls = nil
+	w.mu.Unlock()
+
+	for _, call := range calls {
+		call()
+	}
+}
+
+// writeFile writes the current file, the file written by Flush before the roll is published to the changelog
+// as ChangeFileFlushed and isn't reported to Options.OnFileWritten.
+func (w *writer[T]) writeFile(ctx context.Context, rolled bool) error {
+	// the empty file would be unreadable, the buffer is never empty if the blocks were written
+	if w.lastBlockNum < w.firstBlockNum || w.buffer.Len() == 0 {
+		return fmt.Errorf("file[%d-%d]: %w", w.firstBlockNum, w.lastBlockNum, ErrEmptyFile)
+	}
+
 	// create new file
-	newFile := &File{FirstBlockNum: w.firstBlockNum, LastBlockNum: w.lastBlockNum}
+	newFile := &File{FirstBlockNum: w.firstBlockNum, LastBlockNum: w.lastBlockNum, SchemaVersion: w.options.SchemaVersion, Bloom: w.bloomKeys != nil}
+	if w.blockDigest != nil {
+		root := w.digests.root()
+		newFile.DigestRoot = &root
+	}
+	newFile.recordChecksum(w.buffer.Bytes())
 	w.options.FileRollPolicy.onFlush(ctx)
 
-	// add file to file index
-	err := w.fileIndex.AddFile(newFile)
+	// the file is staged and moved to its path once complete, so that the file index never lists the
+	// missing or partially written file and the interrupted write leaves the dataset readable
+	err := w.stageFile(ctx, newFile)
 	if err != nil {
 		return err
 	}
 
-	// save file index
+	// save bloom filter, files with missing filter are treated as containing any key
+	if w.bloomKeys != nil {
+		bloom := newBloomFilter(uint64(len(w.bloomHashes)), w.options.BloomFalsePositiveRate)
+		for h := range w.bloomHashes {
+			bloom.addHash(h[0], h[1])
+		}
+
+		err = writeBloomFilter(ctx, w.fs, newFile, bloom)
+		if err != nil {
+			return err
+		}
+	}
+
+	// save block digests
+	if w.blockDigest != nil {
+		err = writeBlockDigests(ctx, w.fs, newFile, w.digests)
+		if err != nil {
+			return err
+		}
+	}
+
+	// record the manifest before the first file of the dataset is listed
+	if w.manifestPending {
+		firstBlockNum := newFile.FirstBlockNum
+		if files := w.fileIndex.Files(); len(files) > 0 {
+			firstBlockNum = files[0].FirstBlockNum
+		}
+
+		err = writeDatasetManifest(ctx, w.metaFs, newDatasetManifest(w.options, firstBlockNum))
+		if err != nil {
+			return err
+		}
+		w.manifestPending = false
+	}
+
+	// add file to file index, the file flushed before is replaced by the extended one
+	if w.flushedFile != nil {
+		err = w.fileIndex.replaceLastFile(newFile)
+	} else {
+		err = w.fileIndex.AddFile(newFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	// save file index, the file is listed once it's complete
 	err = w.fileIndex.Save(ctx)
 	if err != nil {
 		return err
 	}
 
-	// save file
-	f, err := newFile.Create(ctx, w.fs)
+	w.durableBlockNum = newFile.LastBlockNum
+	w.totalBytes += uint64(w.buffer.Len()) - w.flushedBytes
+	w.totalUncompressedBytes += w.uncompressedBytes - w.flushedUncompressedBytes
+
+	// the flushed file isn't listed anymore, the file that failed to delete is left behind, the file rolled
+	// without the blocks written after the flush is rewritten at its path
+	replacedFile := w.flushedFile
+	if replacedFile != nil && replacedFile.Path() != newFile.Path() {
+		err = deleteFile(ctx, w.fs, replacedFile)
+		if err != nil {
+			log.Default().Println("failed to delete flushed file", "instance", w.instance, "err", err)
+		}
+	}
+	w.flushedFile = newFile
+	w.flushedBytes = uint64(w.buffer.Len())
+	w.flushedUncompressedBytes = w.uncompressedBytes
+
+	// store examined blocks after the file, so that marked blocks are always readable
+	err = w.flushPresence(ctx)
 	if err != nil {
 		return err
 	}
 
+	// blocks are durable, journal is not needed anymore
+	if w.journal != nil {
+		err = w.journal.Truncate()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the file is durable, the event that failed to append is retried with the next one
+	if w.changelog != nil {
+		eventType := ChangeFileAdded
+		if !rolled {
+			eventType = ChangeFileFlushed
+		}
+		err = w.changelog.publish(ctx, ChangeEvent{Type: eventType, File: newFile.clone()})
+		if err != nil {
+			log.Default().Println("failed to append changelog", "instance", w.instance, "err", err)
+		}
+	}
+
+	// the prune that failed is completed by the next one
+	if w.options.RetentionPolicy != nil {
+		err = w.prune(ctx, w.options.RetentionPolicy.PruneBefore(newFile.LastBlockNum))
+		if err != nil {
+			log.Default().Println("failed to prune files", "instance", w.instance, "err", err)
+		}
+	}
+
+	// wait for both file and file index to be saved
+	// todo: save in background
+	return nil
+}
+
+// prune prunes the files ending before the block and appends their events to the changelog.
+func (w *writer[T]) prune(ctx context.Context, beforeBlockNum uint64) error {
+	if beforeBlockNum == 0 {
+		return nil
+	}
+
+	pruned, err := w.fileIndex.Prune(ctx, beforeBlockNum)
+	if err != nil {
+		return err
+	}
+	if w.changelog == nil || len(pruned) == 0 {
+		return nil
+	}
+
+	events := make([]ChangeEvent, 0, len(pruned))
+	for _, file := range pruned {
+		events = append(events, ChangeEvent{Type: ChangeFilePruned, File: file.clone()})
+	}
+	return w.changelog.publish(ctx, events...)
+}
+
+// stageFile writes the buffer to the staging path of the file, verifies its size and moves it to the file
+// path. The local files are renamed, the files of the other file systems are copied and the staging file
+// is deleted.
+func (w *writer[T]) stageFile(ctx context.Context, file *File) error {
+	stagingPath := file.Path() + StagingFileSuffix
+
+	f, err := w.fs.Create(ctx, stagingPath, nil)
+	if err != nil {
+		return fmt.Errorf("file[%d-%d]: failed to create staging file: %w", file.FirstBlockNum, file.LastBlockNum, err)
+	}
+
 	_, err = f.Write(w.buffer.Bytes())
 	if err != nil {
 		_ = f.Close()
-		return err
+		return fmt.Errorf("file[%d-%d]: failed to write staging file: %w", file.FirstBlockNum, file.LastBlockNum, err)
 	}
 
 	err = f.Close()
 	if err != nil {
-		return err
+		return fmt.Errorf("file[%d-%d]: failed to close staging file: %w", file.FirstBlockNum, file.LastBlockNum, err)
 	}
 
-	// wait for both file and file index to be saved
-	// todo: save in background
+	attrs, err := w.fs.Attributes(ctx, stagingPath, nil)
+	if err != nil {
+		return fmt.Errorf("file[%d-%d]: failed to verify staging file: %w", file.FirstBlockNum, file.LastBlockNum, err)
+	}
+	if attrs.Size != int64(w.buffer.Len()) {
+		return fmt.Errorf("file[%d-%d]: staging file has %d bytes, expected %d", file.FirstBlockNum, file.LastBlockNum, attrs.Size, w.buffer.Len())
+	}
+
+	// the copies are created through the dataset file system, so that they have the object attributes
+	if _, ok := storage.Unwrap(w.options.FileSystem).(storage.Renamer); ok {
+		err = storage.Rename(ctx, w.options.FileSystem, w.path+stagingPath, w.path+file.Path())
+	} else {
+		err = storage.Rename(ctx, w.fs, stagingPath, file.Path())
+	}
+	if err != nil {
+		return fmt.Errorf("file[%d-%d]: failed to move staging file: %w", file.FirstBlockNum, file.LastBlockNum, err)
+	}
 	return nil
 }
 
+// flushPresence stores the pending examined block marks. The marks above the durable block number are kept
+// pending until the blocks written before them are durable.
+func (w *writer[T]) flushPresence(ctx context.Context) error {
+	if w.pendingPresence == nil || w.pendingPresence.IsEmpty() {
+		return nil
+	}
+
+	examined := w.pendingPresence
+	if w.lastBlockNum > w.durableBlockNum {
+		examined = w.pendingPresence.Clone()
+		examined.RemoveRange(w.durableBlockNum+1, MaxSupportedBlockNum+1)
+	}
+
+	err := w.presence.mark(ctx, examined)
+	if err != nil {
+		return fmt.Errorf("failed to store examined blocks: %w", err)
+	}
+
+	w.pendingPresence.AndNot(examined)
+	return nil
+}
+
+func (w *writer[T]) notifyFileWritten(queue <-chan fileWrittenEvent) {
+	defer w.fileWrittenWg.Done()
+	for event := range queue {
+		w.options.OnFileWritten(event.ctx, event.file, event.stats)
+	}
+}
+
 func (w *writer[T]) newFile() error {
-	// update block numbers
+	// update block numbers, lastBlockNum <= MaxSupportedBlockNum so that it can't overflow
 	w.firstBlockNum = w.lastBlockNum + 1
 
 	// reset buffer
 	w.buffer.Reset()
+	w.flushedFile = nil
+	w.flushedBytes = 0
+	w.flushedUncompressedBytes = 0
+	w.numBlocks = 0
+	w.uncompressedBytes = 0
+	w.tailBuffer.Reset()
+	if w.bloomKeys != nil {
+		w.bloomHashes = make(map[[2]uint64]struct{})
+	}
+	if w.blockDigest != nil {
+		w.digests = &blockDigests{}
+	}
+	w.fileStartedAt = time.Now()
+
+	if w.pendingRollPolicy != nil {
+		w.installRollPolicy(w.pendingRollPolicy)
+	}
 
 	// reset file roll policy
 	w.options.FileRollPolicy.Reset()
@@ -263,7 +1167,14 @@ func (w *writer[T]) newFile() error {
 		w.bufferCloser = zw
 	}
 
+	// keep uncompressed copy of the blocks for the tail
+	encoderWriter := io.Writer(&countingWriter{Writer: bufferWriter, n: &w.uncompressedBytes})
+	encoderWriter = &encodeWriterWrapper{Writer: encoderWriter, fsrp: w.options.FileRollPolicy}
+	if w.options.TailFlushInterval > 0 {
+		encoderWriter = io.MultiWriter(encoderWriter, &w.tailBuffer)
+	}
+
 	// create new encoder
-	w.encoder = w.options.NewEncoder(bufferWriter)
+	w.encoder = w.options.NewEncoder(encoderWriter)
 	return nil
 }
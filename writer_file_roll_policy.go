@@ -5,6 +5,8 @@ import (
 	"io"
 	"sync"
 	"time"
+
+	"github.com/c2h5oh/datasize"
 )
 
 type FileRollPolicy interface {
@@ -16,6 +18,115 @@ type FileRollPolicy interface {
 	onFlush(ctx context.Context)
 }
 
+// sizeRollPolicy is implemented by the policies that roll the file based on its size.
+type sizeRollPolicy interface {
+	// bytesUntilRoll returns the number of bytes that can be written before the policy triggers the roll.
+	bytesUntilRoll() (uint64, bool)
+}
+
+// bytesUntilRoll returns the number of bytes until the size roll policy triggers the roll, or false if
+// the policy doesn't depend on the file size.
+func bytesUntilRoll(p FileRollPolicy) (uint64, bool) {
+	sp, ok := p.(sizeRollPolicy)
+	if !ok {
+		return 0, false
+	}
+	return sp.bytesUntilRoll()
+}
+
+// encodeRollPolicy is implemented by the policies that track the uncompressed size of the file.
+type encodeRollPolicy interface {
+	// onEncode is called with the encoded data before it's compressed.
+	onEncode(data []byte)
+}
+
+// onEncode passes the encoded data to the policy if it tracks the uncompressed size of the file.
+func onEncode(p FileRollPolicy, data []byte) {
+	if ep, ok := p.(encodeRollPolicy); ok {
+		ep.onEncode(data)
+	}
+}
+
+// compressorFlushRollPolicy is implemented by the policies that measure the compressed size of the data
+// buffered by the compressor.
+type compressorFlushRollPolicy interface {
+	// shouldFlushCompressor reports whether the compressor should flush the buffered data.
+	shouldFlushCompressor() bool
+	// onCompressorFlush is called after the compressor flushed the buffered data.
+	onCompressorFlush()
+}
+
+// shouldFlushCompressor reports whether the policy needs the compressor to flush the buffered data.
+func shouldFlushCompressor(p FileRollPolicy) bool {
+	fp, ok := p.(compressorFlushRollPolicy)
+	return ok && fp.shouldFlushCompressor()
+}
+
+// onCompressorFlush notifies the policy that the compressor flushed the buffered data.
+func onCompressorFlush(p FileRollPolicy) {
+	if fp, ok := p.(compressorFlushRollPolicy); ok {
+		fp.onCompressorFlush()
+	}
+}
+
+// blockNumberRollPolicy is implemented by the policies that roll the file before the block is written.
+type blockNumberRollPolicy interface {
+	// shouldRollBefore reports whether the file should be rolled before the block is written to it.
+	shouldRollBefore(blockNum uint64) bool
+}
+
+// shouldRollBefore reports whether the policy rolls the file before the block is written to it.
+func shouldRollBefore(p FileRollPolicy, blockNum uint64) bool {
+	bp, ok := p.(blockNumberRollPolicy)
+	return ok && bp.shouldRollBefore(blockNum)
+}
+
+// RolloverMode is the moment Writer.ReconfigureRollPolicy installs the new file roll policy.
+type RolloverMode int
+
+const (
+	// RolloverImmediate rolls the current file and installs the policy for the next file.
+	RolloverImmediate RolloverMode = iota
+	// RolloverAtNextRoll installs the policy when the current policy rolls the file.
+	RolloverAtNextRoll
+)
+
+// rollPolicyState is the state of the writer the policy is seeded with when it's installed by
+// Writer.ReconfigureRollPolicy, so that it continues where the replaced policy left off.
+type rollPolicyState struct {
+	// sizes of the current file
+	compressedBytes   uint64
+	uncompressedBytes uint64
+	fileStartedAt     time.Time
+
+	lastBlockNum uint64
+	numBlocks    uint64
+
+	// totals of the previous files
+	totalCompressedBytes   uint64
+	totalUncompressedBytes uint64
+}
+
+// seededRollPolicy is implemented by the policies that keep state across the blocks of the file.
+type seededRollPolicy interface {
+	seed(state rollPolicyState)
+}
+
+// seedRollPolicy seeds the policy with the writer state.
+func seedRollPolicy(p FileRollPolicy, state rollPolicyState) {
+	if sp, ok := p.(seededRollPolicy); ok {
+		sp.seed(state)
+	}
+}
+
+// replaceRollPolicy returns the policy p wrapped with the flush hooks of the current policy.
+func replaceRollPolicy(current FileRollPolicy, p FileRollPolicy) FileRollPolicy {
+	if wrapped, ok := current.(*wrappedRollPolicy); ok {
+		return &wrappedRollPolicy{rollPolicy: replaceRollPolicy(wrapped.rollPolicy, p), flushFunc: wrapped.flushFunc}
+	}
+	return p
+}
+
 type fileSizeRollPolicy struct {
 	maxSize      uint64
 	bytesWritten uint64
@@ -33,12 +144,23 @@ func (p *fileSizeRollPolicy) Reset() {
 	p.bytesWritten = 0
 }
 
+func (p *fileSizeRollPolicy) bytesUntilRoll() (uint64, bool) {
+	if p.bytesWritten >= p.maxSize {
+		return 0, true
+	}
+	return p.maxSize - p.bytesWritten, true
+}
+
 func (p *fileSizeRollPolicy) onWrite(data []byte) {
 	p.bytesWritten += uint64(len(data))
 }
 
 func (p *fileSizeRollPolicy) onBlockProcessed(blockNum uint64) {}
 
+func (p *fileSizeRollPolicy) seed(state rollPolicyState) {
+	p.bytesWritten = state.compressedBytes
+}
+
 func (p *fileSizeRollPolicy) onFlush(ctx context.Context) {}
 
 // fileStats is a writer that keeps track of the number of bytes written to it.
@@ -53,10 +175,132 @@ func (w *writerWrapper) Write(p []byte) (n int, err error) {
 	return w.Writer.Write(p)
 }
 
+// encodeWriterWrapper is a writer that passes the encoded data to the file roll policy.
+type encodeWriterWrapper struct {
+	io.Writer
+
+	fsrp FileRollPolicy
+}
+
+func (w *encodeWriterWrapper) Write(p []byte) (n int, err error) {
+	// the policy counts the data before the compressor produces the output for it
+	onEncode(w.fsrp, p)
+	return w.Writer.Write(p)
+}
+
+// targetObjectSizeRollPolicy rolls the file when its projected compressed size reaches the target. The
+// compressor buffers the data it hasn't compressed yet, so the compressed size of the file is projected
+// from its uncompressed size and the compression ratio of the previous files. Until the first file is
+// rolled the ratio is unknown, so the policy makes the writer flush the compressor to measure it before
+// the buffered data could exceed the target.
+type targetObjectSizeRollPolicy struct {
+	targetSize uint64
+
+	// compressedBytes is the compressed size of the current file produced so far
+	compressedBytes uint64
+	// uncompressedBytes is the uncompressed size of the current file
+	uncompressedBytes uint64
+
+	// sizes of the current file at the last compressor flush
+	flushedCompressedBytes   uint64
+	flushedUncompressedBytes uint64
+
+	// totals of the previous files for the running compression ratio
+	totalCompressedBytes   uint64
+	totalUncompressedBytes uint64
+}
+
+// NewTargetObjectSizeRollPolicy returns the policy that rolls the file when its compressed size reaches the
+// target size, regardless of the compressibility of the data. The file can exceed the target by the
+// size of the last block and the error of the compression ratio estimate.
+func NewTargetObjectSizeRollPolicy(targetCompressedSize datasize.ByteSize) FileRollPolicy {
+	return &targetObjectSizeRollPolicy{targetSize: uint64(targetCompressedSize)}
+}
+
+func (p *targetObjectSizeRollPolicy) ShouldRoll() bool {
+	return p.projectedSize() >= p.targetSize
+}
+
+func (p *targetObjectSizeRollPolicy) Reset() {
+	// the file is complete, the compressor is closed before the policy is reset
+	p.totalCompressedBytes += p.compressedBytes
+	p.totalUncompressedBytes += p.uncompressedBytes
+
+	p.compressedBytes = 0
+	p.uncompressedBytes = 0
+	p.flushedCompressedBytes = 0
+	p.flushedUncompressedBytes = 0
+}
+
+// compressionRatio returns the ratio of the compressed to the uncompressed size of the files rolled so
+// far, or of the current file at the last compressor flush. It's zero if unknown.
+func (p *targetObjectSizeRollPolicy) compressionRatio() float64 {
+	switch {
+	case p.totalUncompressedBytes > 0:
+		return float64(p.totalCompressedBytes) / float64(p.totalUncompressedBytes)
+	case p.flushedUncompressedBytes > 0:
+		return float64(p.flushedCompressedBytes) / float64(p.flushedUncompressedBytes)
+	default:
+		return 0
+	}
+}
+
+// projectedSize returns the estimated compressed size of the file once the compressor is closed.
+func (p *targetObjectSizeRollPolicy) projectedSize() uint64 {
+	return max(p.compressedBytes, uint64(float64(p.uncompressedBytes)*p.compressionRatio()))
+}
+
+func (p *targetObjectSizeRollPolicy) shouldFlushCompressor() bool {
+	if p.totalUncompressedBytes > 0 {
+		return false
+	}
+
+	// the data written since the last flush might not be compressible at all
+	return p.flushedCompressedBytes+p.uncompressedBytes-p.flushedUncompressedBytes >= p.targetSize
+}
+
+func (p *targetObjectSizeRollPolicy) onCompressorFlush() {
+	p.flushedCompressedBytes = p.compressedBytes
+	p.flushedUncompressedBytes = p.uncompressedBytes
+}
+
+func (p *targetObjectSizeRollPolicy) bytesUntilRoll() (uint64, bool) {
+	projected := p.projectedSize()
+	if projected >= p.targetSize {
+		return 0, true
+	}
+	return p.targetSize - projected, true
+}
+
+func (p *targetObjectSizeRollPolicy) onEncode(data []byte) {
+	p.uncompressedBytes += uint64(len(data))
+}
+
+func (p *targetObjectSizeRollPolicy) onWrite(data []byte) {
+	p.compressedBytes += uint64(len(data))
+}
+
+func (p *targetObjectSizeRollPolicy) onBlockProcessed(blockNum uint64) {}
+
+func (p *targetObjectSizeRollPolicy) seed(state rollPolicyState) {
+	p.compressedBytes = state.compressedBytes
+	p.uncompressedBytes = state.uncompressedBytes
+	p.totalCompressedBytes = state.totalCompressedBytes
+	p.totalUncompressedBytes = state.totalUncompressedBytes
+}
+
+func (p *targetObjectSizeRollPolicy) onFlush(ctx context.Context) {}
+
+// lastBlockNumberRollPolicy rolls the file at the multiples of the interval, the file ends at the multiple of
+// the interval at or above its first block. The block past the multiple rolls the file before it's written, so
+// that the files stay aligned to the interval even if the block of the multiple isn't written.
 type lastBlockNumberRollPolicy struct {
 	rollInterval uint64
 
 	lastBlockNum uint64
+	// fileEndBlockNum is the multiple of the interval the current file ends at, set once it has blocks
+	fileEndBlockNum uint64
+	hasBlocks       bool
 }
 
 func (l *lastBlockNumberRollPolicy) onWrite(data []byte) {}
@@ -66,19 +310,41 @@ func NewLastBlockNumberRollPolicy(rollInterval uint64) FileRollPolicy {
 }
 
 func (l *lastBlockNumberRollPolicy) ShouldRoll() bool {
-	return l.lastBlockNum != 0 && l.lastBlockNum%l.rollInterval == 0
+	return l.hasBlocks && l.lastBlockNum >= l.fileEndBlockNum
 }
 
 func (l *lastBlockNumberRollPolicy) Reset() {
-	// noop
+	l.hasBlocks = false
+}
+
+func (l *lastBlockNumberRollPolicy) shouldRollBefore(blockNum uint64) bool {
+	return l.hasBlocks && blockNum > l.fileEndBlockNum
 }
 
 func (l *lastBlockNumberRollPolicy) onBlockProcessed(blockNum uint64) {
 	l.lastBlockNum = blockNum
+	if !l.hasBlocks {
+		l.startFile(blockNum)
+	}
+}
+
+// startFile sets the end of the file of the first block, the genesis block is in the file of the block 1.
+func (l *lastBlockNumberRollPolicy) startFile(blockNum uint64) {
+	blockNum = max(blockNum, 1)
+	l.fileEndBlockNum = blockNum + (l.rollInterval-blockNum%l.rollInterval)%l.rollInterval
+	l.hasBlocks = true
 }
 
 func (l *lastBlockNumberRollPolicy) onFlush(ctx context.Context) {}
 
+func (l *lastBlockNumberRollPolicy) seed(state rollPolicyState) {
+	l.lastBlockNum = state.lastBlockNum
+	l.hasBlocks = false
+	if state.numBlocks > 0 {
+		l.startFile(state.lastBlockNum)
+	}
+}
+
 type timeBasedRollPolicy struct {
 	rollInterval time.Duration
 	onError      func(err error)
@@ -114,8 +380,35 @@ func (t *timeBasedRollPolicy) onBlockProcessed(blockNum uint64) {}
 
 func (t *timeBasedRollPolicy) onFlush(ctx context.Context) {}
 
+func (t *timeBasedRollPolicy) seed(state rollPolicyState) {
+	t.lastTimeRolled = state.fileStartedAt
+}
+
 type FileRollPolicies []FileRollPolicy
 
+// NewFileSizeOrLastBlockNumberRollPolicy returns the policy rolling the file once it reaches the size or the
+// blocks pass the boundary of the block interval, see NewFileSizeOrLastBlockNumberOrTimeRollPolicy.
+func NewFileSizeOrLastBlockNumberRollPolicy(maxSize uint64, blockInterval uint64) FileRollPolicy {
+	return NewFileSizeOrLastBlockNumberOrTimeRollPolicy(maxSize, blockInterval, 0)
+}
+
+// NewFileSizeOrLastBlockNumberOrTimeRollPolicy returns the policy rolling the file by whichever of the file size,
+// the block interval and the file age triggers first, see NewFileSizeRollPolicy, NewLastBlockNumberRollPolicy
+// and NewTimeBasedRollPolicy. The zero limit disables its policy.
+func NewFileSizeOrLastBlockNumberOrTimeRollPolicy(maxSize uint64, blockInterval uint64, maxAge time.Duration) FileRollPolicy {
+	var policies FileRollPolicies
+	if maxSize > 0 {
+		policies = append(policies, NewFileSizeRollPolicy(maxSize))
+	}
+	if blockInterval > 0 {
+		policies = append(policies, NewLastBlockNumberRollPolicy(blockInterval))
+	}
+	if maxAge > 0 {
+		policies = append(policies, NewTimeBasedRollPolicy(maxAge, nil))
+	}
+	return policies
+}
+
 func (policies FileRollPolicies) ShouldRoll() bool {
 	for _, p := range policies {
 		if p.ShouldRoll() {
@@ -131,12 +424,55 @@ func (policies FileRollPolicies) Reset() {
 	}
 }
 
+func (policies FileRollPolicies) bytesUntilRoll() (uint64, bool) {
+	var (
+		minBytes uint64
+		found    bool
+	)
+	for _, p := range policies {
+		if bytes, ok := bytesUntilRoll(p); ok && (!found || bytes < minBytes) {
+			minBytes, found = bytes, true
+		}
+	}
+	return minBytes, found
+}
+
 func (policies FileRollPolicies) onWrite(data []byte) {
 	for _, p := range policies {
 		p.onWrite(data)
 	}
 }
 
+func (policies FileRollPolicies) shouldFlushCompressor() bool {
+	for _, p := range policies {
+		if shouldFlushCompressor(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policies FileRollPolicies) shouldRollBefore(blockNum uint64) bool {
+	for _, p := range policies {
+		if shouldRollBefore(p, blockNum) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policies FileRollPolicies) onCompressorFlush() {
+	for _, p := range policies {
+		onCompressorFlush(p)
+	}
+}
+
+func (policies FileRollPolicies) onEncode(data []byte) {
+	for _, p := range policies {
+		onEncode(p, data)
+	}
+}
+
 func (policies FileRollPolicies) onBlockProcessed(blockNum uint64) {
 	for _, p := range policies {
 		p.onBlockProcessed(blockNum)
@@ -149,6 +485,12 @@ func (policies FileRollPolicies) onFlush(ctx context.Context) {
 	}
 }
 
+func (policies FileRollPolicies) seed(state rollPolicyState) {
+	for _, p := range policies {
+		seedRollPolicy(p, state)
+	}
+}
+
 type wrappedRollPolicy struct {
 	rollPolicy FileRollPolicy
 	flushFunc  func(ctx context.Context)
@@ -166,10 +508,30 @@ func (w *wrappedRollPolicy) Reset() {
 	w.rollPolicy.Reset()
 }
 
+func (w *wrappedRollPolicy) bytesUntilRoll() (uint64, bool) {
+	return bytesUntilRoll(w.rollPolicy)
+}
+
 func (w *wrappedRollPolicy) onWrite(data []byte) {
 	w.rollPolicy.onWrite(data)
 }
 
+func (w *wrappedRollPolicy) shouldFlushCompressor() bool {
+	return shouldFlushCompressor(w.rollPolicy)
+}
+
+func (w *wrappedRollPolicy) shouldRollBefore(blockNum uint64) bool {
+	return shouldRollBefore(w.rollPolicy, blockNum)
+}
+
+func (w *wrappedRollPolicy) onCompressorFlush() {
+	onCompressorFlush(w.rollPolicy)
+}
+
+func (w *wrappedRollPolicy) onEncode(data []byte) {
+	onEncode(w.rollPolicy, data)
+}
+
 func (w *wrappedRollPolicy) onBlockProcessed(blockNum uint64) {
 	w.rollPolicy.onBlockProcessed(blockNum)
 }
@@ -179,4 +541,9 @@ func (w *wrappedRollPolicy) onFlush(ctx context.Context) {
 	w.flushFunc(ctx)
 }
 
+func (w *wrappedRollPolicy) seed(state rollPolicyState) {
+	seedRollPolicy(w.rollPolicy, state)
+}
+
 var _ FileRollPolicy = &fileSizeRollPolicy{}
+var _ FileRollPolicy = &targetObjectSizeRollPolicy{}
@@ -2,9 +2,15 @@ package ethwal
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/c2h5oh/datasize"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -47,8 +53,92 @@ func TestLastBlockNumberRollPolicy(t *testing.T) {
 	p.onBlockProcessed(10)
 	assert.True(t, p.ShouldRoll())
 
+	p.Reset()
 	p.onBlockProcessed(11)
 	assert.False(t, p.ShouldRoll())
+
+	t.Run("boundary", func(t *testing.T) {
+		p := NewLastBlockNumberRollPolicy(10)
+		p.onBlockProcessed(10)
+		assert.True(t, p.ShouldRoll())
+		p.Reset()
+
+		// the next file ends at the next multiple
+		assert.False(t, p.ShouldRoll())
+		assert.False(t, shouldRollBefore(p, 11))
+		p.onBlockProcessed(11)
+		assert.False(t, p.ShouldRoll())
+		assert.False(t, shouldRollBefore(p, 20))
+		p.onBlockProcessed(20)
+		assert.True(t, p.ShouldRoll())
+	})
+
+	t.Run("skipped_boundary", func(t *testing.T) {
+		p := NewLastBlockNumberRollPolicy(10)
+		p.onBlockProcessed(7)
+		assert.False(t, p.ShouldRoll())
+
+		// the block past the skipped boundary rolls the file before it's written
+		assert.True(t, shouldRollBefore(p, 13))
+		p.Reset()
+		assert.False(t, shouldRollBefore(p, 13))
+		p.onBlockProcessed(13)
+		assert.False(t, p.ShouldRoll())
+
+		// the files stay aligned to the interval
+		assert.False(t, shouldRollBefore(p, 20))
+		p.onBlockProcessed(20)
+		assert.True(t, p.ShouldRoll())
+	})
+
+	t.Run("first_block", func(t *testing.T) {
+		// the dataset starting at the high block rolls at the next boundary
+		p := NewLastBlockNumberRollPolicy(10)
+		p.onBlockProcessed(1000005)
+		assert.False(t, p.ShouldRoll())
+		p.onBlockProcessed(1000010)
+		assert.True(t, p.ShouldRoll())
+
+		// the genesis block is in the file of the block 1
+		p = NewLastBlockNumberRollPolicy(10)
+		p.onBlockProcessed(0)
+		assert.False(t, p.ShouldRoll())
+		assert.False(t, shouldRollBefore(p, 10))
+		assert.True(t, shouldRollBefore(p, 11))
+	})
+
+	t.Run("reset_by_other_policy", func(t *testing.T) {
+		// the file rolled before the boundary, the next file still ends at it
+		p := NewLastBlockNumberRollPolicy(10)
+		p.onBlockProcessed(15)
+		p.Reset()
+		p.onBlockProcessed(19)
+		assert.False(t, p.ShouldRoll())
+		p.onBlockProcessed(20)
+		assert.True(t, p.ShouldRoll())
+	})
+
+	t.Run("seed", func(t *testing.T) {
+		p := NewLastBlockNumberRollPolicy(10)
+		seedRollPolicy(p, rollPolicyState{lastBlockNum: 15, numBlocks: 3})
+		assert.False(t, p.ShouldRoll())
+		assert.True(t, shouldRollBefore(p, 21))
+		p.onBlockProcessed(20)
+		assert.True(t, p.ShouldRoll())
+
+		// the empty file ends at the multiple of its first block
+		p = NewLastBlockNumberRollPolicy(10)
+		seedRollPolicy(p, rollPolicyState{lastBlockNum: 15})
+		assert.False(t, shouldRollBefore(p, 25))
+		p.onBlockProcessed(25)
+		assert.False(t, p.ShouldRoll())
+	})
+
+	t.Run("policies", func(t *testing.T) {
+		p := NewFileSizeOrLastBlockNumberRollPolicy(1<<20, 10)
+		p.onBlockProcessed(7)
+		assert.True(t, shouldRollBefore(p, 13))
+	})
 }
 
 func TestTimeBasedRollPolicy(t *testing.T) {
@@ -68,10 +158,7 @@ func TestTimeBasedRollPolicy(t *testing.T) {
 func TestNewFileSizeOrLastBlockNumberRollPolicy(t *testing.T) {
 	var buff = bytes.NewBuffer(nil)
 
-	fol := FileRollPolicies{
-		NewFileSizeRollPolicy(10),
-		NewLastBlockNumberRollPolicy(10),
-	}
+	fol := NewFileSizeOrLastBlockNumberRollPolicy(10, 10)
 
 	w := writerWrapper{buff, fol}
 
@@ -80,6 +167,7 @@ func TestNewFileSizeOrLastBlockNumberRollPolicy(t *testing.T) {
 	fol.onBlockProcessed(10)
 	assert.True(t, fol.ShouldRoll())
 
+	fol.Reset()
 	fol.onBlockProcessed(11)
 	assert.False(t, fol.ShouldRoll())
 
@@ -94,3 +182,208 @@ func TestNewFileSizeOrLastBlockNumberRollPolicy(t *testing.T) {
 	fol.onBlockProcessed(20)
 	assert.True(t, fol.ShouldRoll())
 }
+
+func TestNewFileSizeOrLastBlockNumberOrTimeRollPolicy(t *testing.T) {
+	p := NewFileSizeOrLastBlockNumberOrTimeRollPolicy(10, 10, 100*time.Millisecond)
+	require.Len(t, p, 3)
+	assert.False(t, p.ShouldRoll())
+
+	// the block interval
+	p.onBlockProcessed(10)
+	assert.True(t, p.ShouldRoll())
+	p.Reset()
+
+	// the file size
+	p.onBlockProcessed(11)
+	p.onWrite([]byte("hello world"))
+	assert.True(t, p.ShouldRoll())
+	p.Reset()
+	assert.False(t, p.ShouldRoll())
+
+	// the file age
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, p.ShouldRoll())
+	p.Reset()
+	assert.False(t, p.ShouldRoll())
+
+	// the zero limits disable their policies
+	require.Len(t, NewFileSizeOrLastBlockNumberOrTimeRollPolicy(0, 10, 0), 1)
+	require.Empty(t, NewFileSizeOrLastBlockNumberOrTimeRollPolicy(0, 0, 0))
+}
+
+func TestTargetObjectSizeRollPolicy(t *testing.T) {
+	const targetSize = 256 * datasize.KB
+
+	payloads := map[string]func(rnd *rand.Rand) []byte{
+		// text-like data compressed by zstd to a fraction of its size
+		"compressible": func(rnd *rand.Rand) []byte {
+			words := []string{"block", "transfer", "approval", "0x00000000", "deposit", "withdrawal"}
+			var buf bytes.Buffer
+			for buf.Len() < 8*1024 {
+				buf.WriteString(words[rnd.Intn(len(words))])
+				buf.WriteString(fmt.Sprintf(" %d ", rnd.Intn(1000)))
+			}
+			return buf.Bytes()
+		},
+		"incompressible": func(rnd *rand.Rand) []byte {
+			data := make([]byte, 8*1024)
+			_, _ = rnd.Read(data)
+			return data
+		},
+	}
+
+	for name, payload := range payloads {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				_ = os.RemoveAll(testPath)
+			}()
+
+			var files []FileStats
+			opt := Options{
+				Dataset:         Dataset{Path: testPath},
+				NewCompressor:   NewZSTDCompressor,
+				NewDecompressor: NewZSTDDecompressor,
+				FileRollPolicy:  NewTargetObjectSizeRollPolicy(targetSize),
+				OnFileWritten: func(ctx context.Context, file *File, stats FileStats) {
+					files = append(files, stats)
+				},
+			}
+
+			w, err := NewWriter[[]byte](opt)
+			require.NoError(t, err)
+
+			rnd := rand.New(rand.NewSource(1))
+			var status WriteStatus
+			for i := uint64(1); i <= 1000; i++ {
+				status, err = w.WriteWithStatus(context.Background(), Block[[]byte]{Number: i, Data: payload(rnd)})
+				require.NoError(t, err)
+			}
+			require.NoError(t, w.Close(context.Background()))
+			require.Greater(t, len(files), 3)
+
+			var totalSize, totalUncompressedSize uint64
+			for _, file := range files {
+				// the objects land within 5% of the target
+				require.InDelta(t, float64(targetSize), float64(file.Size), float64(targetSize)/20, file.Path)
+				totalSize += file.Size
+				totalUncompressedSize += file.UncompressedSize
+			}
+			require.InDelta(t, float64(totalSize)/float64(totalUncompressedSize), status.CompressionRatio, 0.01)
+		})
+	}
+}
+
+func TestWriter_ReconfigureRollPolicy(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	const interval = 200 * time.Millisecond
+
+	var files [][2]uint64
+	w, err := NewWriter[[]int](Options{
+		Dataset:         Dataset{Path: testPath},
+		FileRollPolicy:  NewFileSizeRollPolicy(1 << 20),
+		FileRollOnClose: true,
+		OnFileWritten: func(ctx context.Context, file *File, stats FileStats) {
+			files = append(files, [2]uint64{file.FirstBlockNum, file.LastBlockNum})
+		},
+	})
+	require.NoError(t, err)
+
+	write := func(from, to uint64) {
+		for i := from; i <= to; i++ {
+			require.NoError(t, w.Write(context.Background(), Block[[]int]{Number: i, Data: []int{int(i)}}))
+		}
+	}
+
+	// the size policy doesn't roll the small files
+	write(1, 5)
+	require.Empty(t, files)
+
+	// the time policy created long ago doesn't roll the next file right away
+	timePolicy := NewTimeBasedRollPolicy(interval, nil)
+	time.Sleep(interval)
+	require.NoError(t, w.ReconfigureRollPolicy(context.Background(), timePolicy, RolloverImmediate))
+	require.Equal(t, [][2]uint64{{1, 5}}, files)
+
+	write(6, 8)
+	require.Equal(t, [][2]uint64{{1, 5}}, files)
+	time.Sleep(interval)
+	write(9, 12)
+	require.Equal(t, [][2]uint64{{1, 5}, {6, 8}}, files)
+
+	// the size policy is installed when the time policy rolls the file
+	require.NoError(t, w.ReconfigureRollPolicy(context.Background(), NewFileSizeRollPolicy(1), RolloverAtNextRoll))
+	require.Equal(t, [][2]uint64{{1, 5}, {6, 8}}, files)
+	time.Sleep(interval)
+	write(13, 15)
+	require.Equal(t, [][2]uint64{{1, 5}, {6, 8}, {9, 12}, {13, 13}, {14, 14}}, files)
+
+	// the empty file is replaced right away
+	require.NoError(t, w.ReconfigureRollPolicy(context.Background(), NewFileSizeRollPolicy(1<<20), RolloverImmediate))
+	require.NoError(t, w.ReconfigureRollPolicy(context.Background(), NewFileSizeRollPolicy(1<<20), RolloverImmediate))
+	write(16, 20)
+	require.NoError(t, w.Close(context.Background()))
+	require.Equal(t, [][2]uint64{{1, 5}, {6, 8}, {9, 12}, {13, 13}, {14, 14}, {15, 15}, {16, 20}}, files)
+
+	// no blocks are lost
+	r, err := NewReader[[]int](Options{Dataset: Dataset{Path: testPath}})
+	require.NoError(t, err)
+	defer r.Close()
+	for i := uint64(1); i <= 20; i++ {
+		b, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, i, b.Number)
+		require.Equal(t, []int{int(i)}, b.Data)
+	}
+	_, err = r.Read(context.Background())
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestWriter_ReconfigureRollPolicy_KeepsFlushHooks(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+		Dataset: Dataset{Path: testPath},
+		Indexes: generateMixedIntIndexes(),
+	})
+	require.NoError(t, err)
+
+	var filesWritten, indexFlushes []uint64
+	w, err := NewWriter[[]int](Options{
+		Dataset:         Dataset{Path: testPath},
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+		OnFileWritten: func(ctx context.Context, file *File, stats FileStats) {
+			// indexes are flushed before the file is written
+			require.NotEmpty(t, indexFlushes)
+			require.GreaterOrEqual(t, indexFlushes[len(indexFlushes)-1], file.LastBlockNum)
+			filesWritten = append(filesWritten, file.LastBlockNum)
+		},
+		OnIndexFlushed: func(ctx context.Context, stats IndexFlushStats) {
+			indexFlushes = append(indexFlushes, stats.BlockNum)
+		},
+	})
+	require.NoError(t, err)
+
+	wi, err := NewWriterWithIndexer(w, indexer)
+	require.NoError(t, err)
+
+	blocks := generateMixedIntBlocks()
+	for _, block := range blocks[:15] {
+		require.NoError(t, wi.Write(context.Background(), block))
+	}
+
+	// the last block number policy is seeded with the last block, so it doesn't roll right away
+	require.NoError(t, wi.ReconfigureRollPolicy(context.Background(), NewLastBlockNumberRollPolicy(20), RolloverAtNextRoll))
+	for _, block := range blocks[15:45] {
+		require.NoError(t, wi.Write(context.Background(), block))
+	}
+	require.NoError(t, wi.Close(context.Background()))
+
+	// the indexes are flushed with every file written by the new policy
+	require.Equal(t, []uint64{10, 20, 40, 45}, filesWritten)
+}
@@ -0,0 +1,171 @@
+package ethwal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const defaultLocalJournalSyncInterval = 100 * time.Millisecond
+
+// journalRecordHeaderSize is the size of the record header: payload length (uint32) and crc32 of the payload.
+const journalRecordHeaderSize = 8
+
+// journal is a local append only file of the blocks accepted by the writer, but not rolled yet. Each record
+// is prefixed with the payload length and checksum, so that the torn tail after a crash can be detected.
+type journal struct {
+	file *os.File
+
+	newEncoder NewEncoderFunc
+	newDecoder NewDecoderFunc
+
+	syncInterval time.Duration
+	lastSync     time.Time
+	unsynced     bool
+
+	buffer bytes.Buffer
+}
+
+func openJournal(journalPath string, opt Options) (*journal, error) {
+	err := os.MkdirAll(filepath.Dir(journalPath), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+
+	file, err := os.OpenFile(journalPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+
+	return &journal{
+		file:         file,
+		newEncoder:   opt.NewEncoder,
+		newDecoder:   opt.NewDecoder,
+		syncInterval: opt.LocalJournalSyncInterval,
+		lastSync:     time.Now(),
+	}, nil
+}
+
+// journalRecover reads all fully decodable blocks from the journal and calls fn for each of them. The torn
+// tail of the journal is cut off, so that new records are appended after the last valid one.
+func journalRecover[T any](j *journal, fn func(b Block[T]) error) error {
+	_, err := j.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to seek journal: %w", err)
+	}
+
+	var blocks []Block[T]
+	var validSize int64
+	rdr := bufio.NewReader(j.file)
+	for {
+		var header [journalRecordHeaderSize]byte
+		_, err := io.ReadFull(rdr, header[:])
+		if err != nil {
+			// end of journal or torn header
+			break
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		_, err = io.ReadFull(rdr, payload)
+		if err != nil {
+			// torn payload
+			break
+		}
+
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			// corrupted record
+			break
+		}
+
+		var block Block[T]
+		err = j.newDecoder(bytes.NewReader(payload)).Decode(&block)
+		if err != nil {
+			break
+		}
+		blocks = append(blocks, block)
+		validSize += int64(journalRecordHeaderSize + len(payload))
+	}
+
+	err = j.file.Truncate(validSize)
+	if err != nil {
+		return fmt.Errorf("failed to truncate journal: %w", err)
+	}
+
+	_, err = j.file.Seek(validSize, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to seek journal: %w", err)
+	}
+
+	for _, block := range blocks {
+		if err := fn(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *journal) Append(b any) error {
+	j.buffer.Reset()
+	j.buffer.Write(make([]byte, journalRecordHeaderSize))
+
+	err := j.newEncoder(&j.buffer).Encode(b)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal record: %w", err)
+	}
+
+	record := j.buffer.Bytes()
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(record)-journalRecordHeaderSize))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[journalRecordHeaderSize:]))
+
+	_, err = j.file.Write(record)
+	if err != nil {
+		return fmt.Errorf("failed to write journal record: %w", err)
+	}
+	j.unsynced = true
+
+	// sync in batches
+	if time.Since(j.lastSync) >= j.syncInterval {
+		return j.Sync()
+	}
+	return nil
+}
+
+func (j *journal) Sync() error {
+	if !j.unsynced {
+		return nil
+	}
+
+	err := j.file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	j.lastSync = time.Now()
+	j.unsynced = false
+	return nil
+}
+
+func (j *journal) Truncate() error {
+	err := j.file.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("failed to truncate journal: %w", err)
+	}
+
+	_, err = j.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to seek journal: %w", err)
+	}
+
+	j.unsynced = true
+	return j.Sync()
+}
+
+func (j *journal) Close() error {
+	return errors.Join(j.Sync(), j.file.Close())
+}
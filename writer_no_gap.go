@@ -2,18 +2,68 @@ package ethwal
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/0xsequence/ethwal/storage"
 )
 
+var ErrGapTooLarge = fmt.Errorf("gap too large to fill")
+
+// NoGapOptions are the options of NewWriterNoGapWithOptions.
+type NoGapOptions struct {
+	// Timestamps derives the timestamps of the filler blocks from the previous written block and the block
+	// after the gap. Defaults to TimestampInterpolate.
+	Timestamps TimestampStrategy
+	// MaxGapFill is the maximal number of the filler blocks of one gap, the block after the larger gap fails
+	// with ErrGapTooLarge and nothing is written. Unbounded if zero.
+	MaxGapFill uint64
+}
+
 type noGapWriter[T any] struct {
-	w Writer[T]
+	w       Writer[T]
+	options NoGapOptions
 
+	// lastBlockNum is the block after which the gap is filled, NoBlockNum if it's filled from block 0
 	lastBlockNum uint64
+	// fromFirstBlock is set until the first block is written to the empty dataset without the start block, the
+	// gap is filled after it
+	fromFirstBlock bool
+	// lastTS is the last written block with the timestamp, nil until the first such block is written
+	lastTS *blockTimestamp
 }
 
+// NewWriterNoGap returns the writer that fills the gaps between the written blocks with the filler blocks,
+// marked with BlockMetaFiller, whose timestamps are interpolated between the blocks around the gap. The
+// empty dataset starts with the first written block, see NewWriterNoGapWithStart to fill it from a block.
 func NewWriterNoGap[T any](w Writer[T]) Writer[T] {
-	return &noGapWriter[T]{w: w}
+	return NewWriterNoGapWithOptions[T](w, NoGapOptions{})
+}
+
+// NewWriterNoGapWithOptions returns NewWriterNoGap with the options.
+func NewWriterNoGapWithOptions[T any](w Writer[T], opt NoGapOptions) Writer[T] {
+	n := NewWriterNoGapWithStart[T](w, 0, opt).(*noGapWriter[T])
+	n.fromFirstBlock = writerEmpty(w)
+	return n
+}
+
+// NewWriterNoGapWithStart returns NewWriterNoGap that fills the empty dataset from the start block, e.g. 0
+// for the dataset with the genesis block or 15000000 for the dataset starting mid-chain, so that the blocks
+// before it aren't filled. The blocks before the start block are written as they are. The dataset with
+// blocks is filled after its last block.
+func NewWriterNoGapWithStart[T any](w Writer[T], startBlock uint64, opt ...NoGapOptions) Writer[T] {
+	var options NoGapOptions
+	if len(opt) > 0 {
+		options = opt[0]
+	}
+
+	// NoBlockNum for block 0
+	lastBlockNum := startBlock - 1
+	if accepted := w.AcceptedBlockNum(); accepted > 0 {
+		lastBlockNum = accepted
+	}
+	// the gaps are filled, the blocks before the start block are written with the gaps
+	allowGaps(w)
+	return &noGapWriter[T]{w: w, options: options, lastBlockNum: lastBlockNum}
 }
 
 func (n *noGapWriter[T]) FileSystem() storage.FS {
@@ -21,44 +71,206 @@ func (n *noGapWriter[T]) FileSystem() storage.FS {
 }
 
 func (n *noGapWriter[T]) Write(ctx context.Context, b Block[T]) error {
-	defer func() { n.lastBlockNum = b.Number }()
+	_, err := n.WriteWithStatus(ctx, b)
+	return err
+}
 
-	// skip if block number is less than or equal to last block number
-	if b.Number <= n.lastBlockNum {
-		return nil
+func (n *noGapWriter[T]) WriteWithStatus(ctx context.Context, b Block[T]) (WriteStatus, error) {
+	// validate before filling the gap
+	if err := validateBlockNum(b.Number); err != nil {
+		return WriteStatus{}, n.ID().wrapError(err)
 	}
 
-	// write blocks as there is no gap
-	if b.Number == n.lastBlockNum+1 {
-		return n.w.Write(ctx, b)
+	// the blocks less than or equal to the accepted block number are skipped by the writer
+	lastBlockNum := n.fillAfter(b.Number)
+	if err := n.checkGap(lastBlockNum, b.Number); err != nil {
+		return WriteStatus{}, n.ID().wrapError(err)
 	}
 
-	// write missing blocks
-	for i := n.lastBlockNum + 1; i < b.Number; i++ {
-		err := n.w.Write(ctx, Block[T]{Number: i})
+	defer func() {
+		n.lastBlockNum, n.fromFirstBlock = laterBlockNum(lastBlockNum, b.Number), false
+		if b.TS != 0 {
+			n.lastTS = &blockTimestamp{Number: b.Number, TS: b.TS}
+		}
+	}()
+
+	// write missing blocks, the timestamps of the filler blocks before the first written block are the
+	// timestamp of the block
+	next := &blockTimestamp{Number: b.Number, TS: b.TS}
+	var rolled bool
+	for i := lastBlockNum + 1; i < b.Number; i++ {
+		status, err := n.w.WriteWithStatus(ctx, n.filler(i, n.lastTS, next))
 		if err != nil {
-			return err
+			return WriteStatus{}, err
+		}
+		rolled = rolled || status.Rolled
+	}
+
+	status, err := n.w.WriteWithStatus(ctx, b)
+	if err != nil {
+		return WriteStatus{}, err
+	}
+	status.Rolled = status.Rolled || rolled
+	return status, nil
+}
+
+func (n *noGapWriter[T]) WriteBatch(ctx context.Context, blocks []Block[T]) error {
+	// validate before filling the gaps
+	if err := validateBatch(blocks); err != nil {
+		return n.ID().wrapError(err)
+	}
+
+	if len(blocks) == 0 {
+		return n.w.WriteBatch(ctx, blocks)
+	}
+
+	// the blocks less than or equal to the accepted block number would be skipped by the writer
+	lastBlockNum, lastTS := n.fillAfter(blocks[0].Number), n.lastTS
+	for _, b := range blocks {
+		if err := n.checkGap(lastBlockNum, b.Number); err != nil {
+			return n.ID().wrapError(err)
+		}
+		lastBlockNum = laterBlockNum(lastBlockNum, b.Number)
+	}
+
+	lastBlockNum = n.fillAfter(blocks[0].Number)
+	filled := make([]Block[T], 0, len(blocks))
+	for _, b := range blocks {
+		next := &blockTimestamp{Number: b.Number, TS: b.TS}
+		for i := lastBlockNum + 1; i < b.Number; i++ {
+			filled = append(filled, n.filler(i, lastTS, next))
 		}
+		filled = append(filled, b)
+
+		lastBlockNum = laterBlockNum(lastBlockNum, b.Number)
+		if b.TS != 0 {
+			lastTS = next
+		}
+	}
+
+	n.lastBlockNum, n.lastTS, n.fromFirstBlock = lastBlockNum, lastTS, false
+	return n.w.WriteBatch(ctx, filled)
+}
+
+// fillAfter returns the block after which the gap before the next block is filled, the empty dataset without
+// the start block isn't filled before the first block.
+func (n *noGapWriter[T]) fillAfter(firstBlockNum uint64) uint64 {
+	if accepted := n.w.AcceptedBlockNum(); accepted > 0 {
+		return laterBlockNum(n.lastBlockNum, accepted)
+	}
+	if n.fromFirstBlock && writerEmpty(n.w) {
+		// NoBlockNum for block 0
+		return firstBlockNum - 1
+	}
+	return n.lastBlockNum
+}
+
+// checkGap returns ErrGapTooLarge if the gap between the blocks exceeds NoGapOptions.MaxGapFill.
+func (n *noGapWriter[T]) checkGap(lastBlockNum, blockNum uint64) error {
+	// NoBlockNum + 1 is block 0
+	next := lastBlockNum + 1
+	if n.options.MaxGapFill == 0 || blockNum <= next {
+		return nil
+	}
+	if gap := blockNum - next; gap > n.options.MaxGapFill {
+		return fmt.Errorf("%w: %d blocks before block %d, max %d", ErrGapTooLarge, gap, blockNum, n.options.MaxGapFill)
+	}
+	return nil
+}
+
+// laterBlockNum returns the later of the block numbers, NoBlockNum is before block 0.
+func laterBlockNum(a, b uint64) uint64 {
+	if a == NoBlockNum {
+		return b
+	}
+	if b == NoBlockNum {
+		return a
+	}
+	return max(a, b)
+}
+
+// filler returns the filler block of the gap between the previous block and the next block.
+func (n *noGapWriter[T]) filler(blockNum uint64, prev, next *blockTimestamp) Block[T] {
+	return Block[T]{
+		Number: blockNum,
+		TS:     n.options.Timestamps.timestamp(blockNum, prev, next),
+		Meta:   map[string]string{BlockMetaFiller: "true"},
+	}
+}
+
+func (n *noGapWriter[T]) checkSequence(blockNums []uint64) error {
+	return checkSequence(n.w, blockNums)
+}
+
+func (n *noGapWriter[T]) allowGaps() {}
+
+func (n *noGapWriter[T]) empty() bool {
+	return writerEmpty(n.w)
+}
+
+func (n *noGapWriter[T]) Rollback(ctx context.Context, toBlockNum uint64) error {
+	err := n.w.Rollback(ctx, toBlockNum)
+	if err != nil {
+		return err
 	}
-	return n.w.Write(ctx, b)
+	// the gap after the rollback is filled from the block
+	if n.lastBlockNum != NoBlockNum && n.lastBlockNum > toBlockNum {
+		n.lastBlockNum = toBlockNum
+	}
+	if n.lastTS != nil && n.lastTS.Number > toBlockNum {
+		n.lastTS = nil
+	}
+	return nil
+}
+
+func (n *noGapWriter[T]) WillRollNext() bool {
+	return n.w.WillRollNext()
 }
 
 func (n *noGapWriter[T]) RollFile(ctx context.Context) error {
 	return n.w.RollFile(ctx)
 }
 
+func (n *noGapWriter[T]) Flush(ctx context.Context) error {
+	return n.w.Flush(ctx)
+}
+
+func (n *noGapWriter[T]) MarkExamined(ctx context.Context, from, to uint64) error {
+	return n.w.MarkExamined(ctx, from, to)
+}
+
 func (n *noGapWriter[T]) BlockNum() uint64 {
-	return n.w.BlockNum()
+	return n.AcceptedBlockNum()
+}
+
+func (n *noGapWriter[T]) AcceptedBlockNum() uint64 {
+	return n.w.AcceptedBlockNum()
+}
+
+func (n *noGapWriter[T]) DurableBlockNum() uint64 {
+	return n.w.DurableBlockNum()
 }
 
 func (n *noGapWriter[T]) Close(ctx context.Context) error {
 	return n.w.Close(ctx)
 }
 
+func (n *noGapWriter[T]) ReconfigureRollPolicy(ctx context.Context, p FileRollPolicy, mode RolloverMode) error {
+	return n.w.ReconfigureRollPolicy(ctx, p, mode)
+}
+
 func (n *noGapWriter[T]) Options() Options {
 	return n.w.Options()
 }
 
+func (n *noGapWriter[T]) Accounting() *storage.Accounting {
+	return n.w.Accounting()
+}
+
 func (n *noGapWriter[T]) SetOptions(opts Options) {
 	n.w.SetOptions(opts)
 }
+
+func (n *noGapWriter[T]) ID() Instance {
+	return n.w.ID()
+}
@@ -8,6 +8,8 @@ import (
 	"path"
 	"testing"
 
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/memory"
 	"github.com/stretchr/testify/require"
 )
 
@@ -113,4 +115,279 @@ func TestWriterNoGap(t *testing.T) {
 
 		require.Equal(t, 10, blockCount)
 	})
+
+	t.Run("filler_timestamps", func(t *testing.T) {
+		readTimestamps := func(t *testing.T, opt Options) map[uint64]uint64 {
+			r, err := NewReader[int](opt)
+			require.NoError(t, err)
+			defer r.Close()
+
+			timestamps := make(map[uint64]uint64)
+			for {
+				b, err := r.Read(context.Background())
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				timestamps[b.Number] = b.TS
+			}
+			return timestamps
+		}
+
+		tests := []struct {
+			name     string
+			strategy TimestampStrategy
+			expected map[uint64]uint64
+		}{
+			{
+				name:     "interpolate",
+				strategy: TimestampInterpolate,
+				// the fillers before the first block copy its timestamp, the filler between the decreasing
+				// timestamps copies the previous one
+				expected: map[uint64]uint64{1: 100, 2: 100, 3: 100, 4: 110, 5: 120, 6: 130, 7: 140, 8: 150, 9: 165, 10: 180, 11: 180, 12: 170},
+			},
+			{
+				name:     "copy_previous",
+				strategy: TimestampCopyPrevious,
+				expected: map[uint64]uint64{1: 100, 2: 100, 3: 100, 4: 100, 5: 100, 6: 100, 7: 140, 8: 150, 9: 150, 10: 180, 11: 180, 12: 170},
+			},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				opt := Options{
+					Dataset:         Dataset{Path: "ethwal"},
+					FileSystem:      memory.NewMemoryFS(),
+					FileRollOnClose: true,
+				}
+
+				w, err := NewWriter[int](opt)
+				require.NoError(t, err)
+
+				ngw := NewWriterNoGapWithStart[int](w, 1, NoGapOptions{Timestamps: tc.strategy})
+				for _, b := range []Block[int]{{Number: 3, TS: 100}, {Number: 7, TS: 140}, {Number: 8, TS: 150}, {Number: 10, TS: 180}, {Number: 12, TS: 170}} {
+					require.NoError(t, ngw.Write(context.Background(), b))
+				}
+				require.NoError(t, ngw.Close(context.Background()))
+
+				require.Equal(t, tc.expected, readTimestamps(t, opt))
+			})
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		opt := Options{
+			Dataset:         Dataset{Path: "ethwal"},
+			FileSystem:      memory.NewMemoryFS(),
+			FileRollOnClose: true,
+		}
+
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+
+		ngw := NewWriterNoGap[int](w)
+		require.NoError(t, ngw.WriteBatch(context.Background(), []Block[int]{{Number: 1, TS: 100}, {Number: 4, TS: 130}, {Number: 5, TS: 150}}))
+		require.NoError(t, ngw.WriteBatch(context.Background(), []Block[int]{{Number: 8, TS: 180}}))
+		require.NoError(t, ngw.Write(context.Background(), Block[int]{Number: 10, TS: 200}))
+
+		err = ngw.WriteBatch(context.Background(), []Block[int]{{Number: 12}, {Number: 11}})
+		require.ErrorIs(t, err, ErrBatchNotSorted)
+		require.Equal(t, uint64(10), ngw.AcceptedBlockNum())
+		require.NoError(t, ngw.Close(context.Background()))
+
+		r, err := NewReader[int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		expected := map[uint64]uint64{1: 100, 2: 110, 3: 120, 4: 130, 5: 150, 6: 160, 7: 170, 8: 180, 9: 190, 10: 200}
+		for blockNum := uint64(1); blockNum <= 10; blockNum++ {
+			b, err := r.Read(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, blockNum, b.Number)
+			require.Equal(t, expected[blockNum], b.TS, blockNum)
+
+			filler := blockNum != 1 && blockNum != 4 && blockNum != 5 && blockNum != 8 && blockNum != 10
+			require.Equal(t, filler, b.Meta[BlockMetaFiller] == "true", blockNum)
+		}
+	})
+
+	readBlocks := func(t *testing.T, opt Options) []Block[int] {
+		r, err := NewReader[int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		var blocks []Block[int]
+		for {
+			b, err := r.Read(context.Background())
+			if err == io.EOF {
+				return blocks
+			}
+			require.NoError(t, err)
+			blocks = append(blocks, b)
+		}
+	}
+
+	t.Run("genesis_0", func(t *testing.T) {
+		for _, startBlock := range []uint64{0, 1} {
+			opt := Options{
+				Dataset:         Dataset{Path: "ethwal"},
+				FileSystem:      memory.NewMemoryFS(),
+				FileRollOnClose: true,
+			}
+
+			w, err := NewWriter[int](opt)
+			require.NoError(t, err)
+
+			ngw := NewWriterNoGapWithStart[int](w, startBlock)
+			require.NoError(t, ngw.Write(context.Background(), Block[int]{Number: 0, Data: 100}))
+			require.NoError(t, ngw.Write(context.Background(), Block[int]{Number: 0, Data: 200}))
+			require.NoError(t, ngw.Write(context.Background(), Block[int]{Number: 3, Data: 103}))
+			require.NoError(t, ngw.Close(context.Background()))
+
+			files, err := ListFiles(context.Background(), storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()))
+			require.NoError(t, err)
+			require.Len(t, files, 1)
+			require.Equal(t, uint64(0), files[0].FirstBlockNum)
+
+			blocks := readBlocks(t, opt)
+			require.Len(t, blocks, 4)
+			for i, b := range blocks {
+				require.Equal(t, uint64(i), b.Number)
+				require.Equal(t, i == 1 || i == 2, b.Meta[BlockMetaFiller] == "true", i)
+			}
+			require.Equal(t, 100, blocks[0].Data)
+
+			// the reader seeks to block 0
+			r, err := NewReader[int](opt)
+			require.NoError(t, err)
+			require.NoError(t, r.Seek(context.Background(), 0))
+			b, err := r.Read(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), b.Number)
+			require.NoError(t, r.Close())
+		}
+	})
+
+	t.Run("fill_from_genesis", func(t *testing.T) {
+		opt := Options{
+			Dataset:         Dataset{Path: "ethwal"},
+			FileSystem:      memory.NewMemoryFS(),
+			FileRollOnClose: true,
+		}
+
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+
+		ngw := NewWriterNoGapWithStart[int](w, 0)
+		require.NoError(t, ngw.WriteBatch(context.Background(), []Block[int]{{Number: 2}, {Number: 4}}))
+		require.NoError(t, ngw.Close(context.Background()))
+
+		blocks := readBlocks(t, opt)
+		require.Len(t, blocks, 5)
+		for i, b := range blocks {
+			require.Equal(t, uint64(i), b.Number)
+			require.Equal(t, i != 2 && i != 4, b.Meta[BlockMetaFiller] == "true", i)
+		}
+	})
+
+	t.Run("fresh_dataset_at_high_block", func(t *testing.T) {
+		const startBlock = 15_000_000
+
+		opt := Options{
+			Dataset:         Dataset{Path: "ethwal"},
+			FileSystem:      memory.NewMemoryFS(),
+			FileRollOnClose: true,
+		}
+
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+
+		ngw := NewWriterNoGapWithStart[int](w, startBlock)
+		require.NoError(t, ngw.Write(context.Background(), Block[int]{Number: startBlock}))
+		require.NoError(t, ngw.Write(context.Background(), Block[int]{Number: startBlock + 3}))
+		require.NoError(t, ngw.Close(context.Background()))
+
+		blocks := readBlocks(t, opt)
+		require.Len(t, blocks, 4)
+		require.Equal(t, uint64(startBlock), blocks[0].Number)
+		require.Equal(t, uint64(startBlock+3), blocks[3].Number)
+
+		// the restarted writer fills after the last block of the dataset
+		w, err = NewWriter[int](opt)
+		require.NoError(t, err)
+
+		ngw = NewWriterNoGapWithStart[int](w, 0)
+		require.NoError(t, ngw.Write(context.Background(), Block[int]{Number: startBlock + 5}))
+		require.NoError(t, ngw.Close(context.Background()))
+		require.Len(t, readBlocks(t, opt), 6)
+	})
+
+	t.Run("empty_dataset", func(t *testing.T) {
+		opt := Options{
+			Dataset:         Dataset{Path: "ethwal"},
+			FileSystem:      memory.NewMemoryFS(),
+			FileRollOnClose: true,
+		}
+
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+
+		// the empty dataset starts with the first written block, the gaps after it are filled
+		ngw := NewWriterNoGapWithOptions[int](w, NoGapOptions{MaxGapFill: 10})
+		require.NoError(t, ngw.WriteBatch(context.Background(), []Block[int]{{Number: 15_000_000}, {Number: 15_000_002}}))
+		require.NoError(t, ngw.Write(context.Background(), Block[int]{Number: 15_000_005}))
+		require.NoError(t, ngw.Close(context.Background()))
+
+		var blockNums []uint64
+		for _, b := range readBlocks(t, opt) {
+			blockNums = append(blockNums, b.Number)
+		}
+		require.Equal(t, []uint64{15_000_000, 15_000_001, 15_000_002, 15_000_003, 15_000_004, 15_000_005}, blockNums)
+
+		// the first block written by Write
+		opt.Dataset.Path = "write"
+		w, err = NewWriter[int](opt)
+		require.NoError(t, err)
+		ngw = NewWriterNoGap[int](w)
+		require.NoError(t, ngw.Write(context.Background(), Block[int]{Number: 15_000_000}))
+		require.NoError(t, ngw.Write(context.Background(), Block[int]{Number: 15_000_002}))
+		require.NoError(t, ngw.Close(context.Background()))
+		require.Len(t, readBlocks(t, opt), 3)
+
+		// the dataset with the genesis block is filled after it
+		opt.Dataset.Path = "genesis"
+		w, err = NewWriter[int](opt)
+		require.NoError(t, err)
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 0}))
+		ngw = NewWriterNoGap[int](w)
+		require.NoError(t, ngw.Write(context.Background(), Block[int]{Number: 3}))
+		require.NoError(t, ngw.Close(context.Background()))
+		require.Len(t, readBlocks(t, opt), 4)
+	})
+
+	t.Run("gap_larger_than_max", func(t *testing.T) {
+		opt := Options{
+			Dataset:         Dataset{Path: "ethwal"},
+			FileSystem:      memory.NewMemoryFS(),
+			FileRollOnClose: true,
+		}
+
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+
+		ngw := NewWriterNoGapWithStart[int](w, 1, NoGapOptions{MaxGapFill: 10})
+		require.NoError(t, ngw.Write(context.Background(), Block[int]{Number: 11}))
+
+		err = ngw.Write(context.Background(), Block[int]{Number: 1_000_000})
+		require.ErrorIs(t, err, ErrGapTooLarge)
+		require.Equal(t, uint64(11), ngw.AcceptedBlockNum())
+
+		err = ngw.WriteBatch(context.Background(), []Block[int]{{Number: 15}, {Number: 100}})
+		require.ErrorIs(t, err, ErrGapTooLarge)
+		require.Equal(t, uint64(11), ngw.AcceptedBlockNum())
+
+		require.NoError(t, ngw.WriteBatch(context.Background(), []Block[int]{{Number: 15}, {Number: 26}}))
+		require.NoError(t, ngw.Close(context.Background()))
+		require.Len(t, readBlocks(t, opt), 26)
+	})
 }
@@ -1,14 +1,22 @@
 package ethwal
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/0xsequence/ethwal/storage"
 	"github.com/0xsequence/ethwal/storage/local"
+	gostorage "github.com/Shopify/go-storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -200,6 +208,176 @@ func TestWriter_Continue(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestWriter_AcceptedAndDurableBlockNum(t *testing.T) {
+	opt := Options{
+		Dataset: Dataset{
+			Path: testPath,
+		},
+		NewCompressor:   NewZSTDCompressor,
+		NewDecompressor: NewZSTDDecompressor,
+		FileRollOnClose: true,
+	}
+
+	newIndexer := func(t *testing.T) *Indexer[[]int] {
+		indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+			Dataset: opt.Dataset,
+			Indexes: generateMixedIntIndexes(),
+		})
+		require.NoError(t, err)
+		return indexer
+	}
+
+	testCases := []struct {
+		name      string
+		newWriter func(t *testing.T) Writer[[]int]
+	}{
+		{
+			name: "writer",
+			newWriter: func(t *testing.T) Writer[[]int] {
+				w, err := NewWriter[[]int](opt)
+				require.NoError(t, err)
+				return w
+			},
+		},
+		{
+			name: "no-gap",
+			newWriter: func(t *testing.T) Writer[[]int] {
+				w, err := NewWriter[[]int](opt)
+				require.NoError(t, err)
+				return NewWriterNoGap[[]int](w)
+			},
+		},
+		{
+			name: "with-indexer",
+			newWriter: func(t *testing.T) Writer[[]int] {
+				w, err := NewWriter[[]int](opt)
+				require.NoError(t, err)
+				wi, err := NewWriterWithIndexer(w, newIndexer(t))
+				require.NoError(t, err)
+				return wi
+			},
+		},
+		{
+			name: "no-gap-with-indexer",
+			newWriter: func(t *testing.T) Writer[[]int] {
+				w, err := NewWriter[[]int](opt)
+				require.NoError(t, err)
+				wi, err := NewWriterWithIndexer(w, newIndexer(t))
+				require.NoError(t, err)
+				return NewWriterNoGap[[]int](wi)
+			},
+		},
+	}
+
+	requireBlockNums := func(t *testing.T, w Writer[[]int], accepted, durable uint64) {
+		require.Equal(t, accepted, w.AcceptedBlockNum())
+		require.Equal(t, accepted, w.BlockNum())
+		require.Equal(t, durable, w.DurableBlockNum())
+	}
+
+	blocks := generateMixedIntBlocks()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				_ = os.RemoveAll(testPath)
+			}()
+
+			w := tc.newWriter(t)
+			requireBlockNums(t, w, 0, 0)
+
+			for _, b := range blocks[:5] {
+				require.NoError(t, w.Write(context.Background(), b))
+			}
+			requireBlockNums(t, w, 5, 0)
+
+			require.NoError(t, w.RollFile(context.Background()))
+			requireBlockNums(t, w, 5, 5)
+
+			for _, b := range blocks[5:8] {
+				require.NoError(t, w.Write(context.Background(), b))
+			}
+			requireBlockNums(t, w, 8, 5)
+
+			require.NoError(t, w.Close(context.Background()))
+			requireBlockNums(t, w, 8, 8)
+
+			// crash before blocks are persisted
+			w = tc.newWriter(t)
+			requireBlockNums(t, w, 8, 8)
+
+			for _, b := range blocks[8:10] {
+				require.NoError(t, w.Write(context.Background(), b))
+			}
+			requireBlockNums(t, w, 10, 8)
+
+			// recover
+			w = tc.newWriter(t)
+			requireBlockNums(t, w, 8, 8)
+		})
+	}
+}
+
+func TestWriter_OnFileWritten(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		t.Run(fmt.Sprintf("async-%t", async), func(t *testing.T) {
+			defer testTeardown(t)
+
+			type fileWritten struct {
+				file  *File
+				stats FileStats
+			}
+
+			var mu sync.Mutex
+			var filesWritten []fileWritten
+
+			opt := Options{
+				Dataset: Dataset{
+					Name:    "int-wal",
+					Path:    testPath,
+					Version: defaultDatasetVersion,
+				},
+				NewCompressor:   NewZSTDCompressor,
+				FileRollPolicy:  NewLastBlockNumberRollPolicy(5),
+				FileRollOnClose: true,
+				OnFileWritten: func(ctx context.Context, file *File, stats FileStats) {
+					mu.Lock()
+					defer mu.Unlock()
+					filesWritten = append(filesWritten, fileWritten{file: file, stats: stats})
+				},
+				OnFileWrittenAsync: async,
+			}
+
+			w, err := NewWriter[int](opt)
+			require.NoError(t, err)
+
+			for i := 1; i <= 12; i++ {
+				err := w.Write(context.Background(), Block[int]{Number: uint64(i), Data: i})
+				require.NoError(t, err)
+			}
+
+			require.NoError(t, w.Close(context.Background()))
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			expectedRanges := [][2]uint64{{1, 5}, {6, 10}, {11, 12}}
+			require.Len(t, filesWritten, len(expectedRanges))
+			for i, fw := range filesWritten {
+				require.Equal(t, expectedRanges[i][0], fw.file.FirstBlockNum)
+				require.Equal(t, expectedRanges[i][1], fw.file.LastBlockNum)
+				require.Equal(t, fw.file.Path(), fw.stats.Path)
+				require.Equal(t, expectedRanges[i][1]-expectedRanges[i][0]+1, fw.stats.NumBlocks)
+				require.Greater(t, fw.stats.UncompressedSize, uint64(0))
+
+				fileInfo, err := os.Stat(path.Join(opt.Dataset.FullPath(), fw.stats.Path))
+				require.NoError(t, err)
+				require.Equal(t, uint64(fileInfo.Size()), fw.stats.Size)
+			}
+		})
+	}
+}
+
 func TestNoGapWriter_BlockNum(t *testing.T) {
 	defer testTeardown(t)
 
@@ -470,3 +648,990 @@ func BenchmarkWriter_Write(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkWriter_WriteBatch(b *testing.B) {
+	const (
+		numBlocks = 1_000_000
+		batchSize = 1000
+	)
+
+	newWriter := func(b *testing.B) Writer[int] {
+		w, err := NewWriter[int](Options{
+			Dataset:         Dataset{Path: "ethwal"},
+			FileSystem:      gostorage.NewMemoryFS(),
+			NewCompressor:   NewZSTDCompressor,
+			NewDecompressor: NewZSTDDecompressor,
+		})
+		require.NoError(b, err)
+		return w
+	}
+
+	b.Run("write", func(b *testing.B) {
+		w := newWriter(b)
+		b.ReportAllocs()
+
+		var blockNum uint64
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < numBlocks; j++ {
+				blockNum++
+				require.NoError(b, w.Write(context.Background(), Block[int]{Number: blockNum, Data: j}))
+			}
+		}
+		require.NoError(b, w.Close(context.Background()))
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		w := newWriter(b)
+		b.ReportAllocs()
+
+		var blockNum uint64
+		batch := make([]Block[int], batchSize)
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < numBlocks; j += batchSize {
+				for k := range batch {
+					blockNum++
+					batch[k] = Block[int]{Number: blockNum, Data: j + k}
+				}
+				require.NoError(b, w.WriteBatch(context.Background(), batch))
+			}
+		}
+		require.NoError(b, w.Close(context.Background()))
+	})
+}
+
+func TestWriter_LocalJournal(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	var blocks []Block[int]
+	for i := 1; i <= 50; i++ {
+		blocks = append(blocks, Block[int]{
+			Hash:   common.BytesToHash([]byte{byte(i)}),
+			Number: uint64(i),
+			Data:   i,
+		})
+	}
+
+	readBlocks := func(t *testing.T, opt Options) []Block[int] {
+		r, err := NewReader[int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+
+		var blocks []Block[int]
+		for {
+			b, err := r.Read(context.Background())
+			if err == io.EOF {
+				return blocks
+			}
+			require.NoError(t, err)
+			blocks = append(blocks, b)
+		}
+	}
+
+	crashFreeOpt := Options{
+		Dataset:         Dataset{Path: path.Join(testPath, "crash-free")},
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+
+	w, err := NewWriter[int](crashFreeOpt)
+	require.NoError(t, err)
+	for _, b := range blocks {
+		require.NoError(t, w.Write(context.Background(), b))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	journalPath := path.Join(testPath, "journal", "wal.journal")
+	crashOpt := crashFreeOpt
+	crashOpt.Dataset = Dataset{Path: path.Join(testPath, "crash")}
+	crashOpt.LocalJournalPath = journalPath
+
+	w, err = NewWriter[int](crashOpt)
+	require.NoError(t, err)
+	for _, b := range blocks[:25] {
+		require.NoError(t, w.Write(context.Background(), b))
+	}
+	require.Equal(t, uint64(20), w.DurableBlockNum())
+
+	// simulate crash with torn journal tail
+	require.NoError(t, w.(*writer[int]).journal.file.Close())
+
+	f, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0x00, 0x00, 0x00, 0x20, 0x01, 0x02})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// restarted writer recovers journaled blocks
+	w, err = NewWriter[int](crashOpt)
+	require.NoError(t, err)
+	require.Equal(t, uint64(25), w.AcceptedBlockNum())
+	require.Equal(t, uint64(20), w.DurableBlockNum())
+
+	for _, b := range blocks[25:] {
+		require.NoError(t, w.Write(context.Background(), b))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	require.Equal(t, readBlocks(t, crashFreeOpt), readBlocks(t, crashOpt))
+
+	// journal is truncated after the last roll
+	stat, err := os.Stat(journalPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), stat.Size())
+
+	// crash after flush, the flushed blocks are not replayed twice
+	flushOpt := crashOpt
+	flushOpt.Dataset = Dataset{Path: path.Join(testPath, "crash-flush")}
+
+	w, err = NewWriter[int](flushOpt)
+	require.NoError(t, err)
+	for _, b := range blocks[:15] {
+		require.NoError(t, w.Write(context.Background(), b))
+	}
+	require.NoError(t, w.Flush(context.Background()))
+	for _, b := range blocks[15:25] {
+		require.NoError(t, w.Write(context.Background(), b))
+	}
+	require.Equal(t, uint64(20), w.DurableBlockNum())
+	require.NoError(t, w.(*writer[int]).journal.file.Close())
+
+	w, err = NewWriter[int](flushOpt)
+	require.NoError(t, err)
+	require.Equal(t, uint64(25), w.AcceptedBlockNum())
+	for _, b := range blocks[25:] {
+		require.NoError(t, w.Write(context.Background(), b))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	require.Equal(t, readBlocks(t, crashFreeOpt), readBlocks(t, flushOpt))
+}
+
+func TestWriter_BlockNumBoundary(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	opt := Options{
+		Dataset:         Dataset{Path: testPath},
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(1),
+		FileRollOnClose: true,
+	}
+
+	w, err := NewWriter[int](opt)
+	require.NoError(t, err)
+
+	require.NoError(t, w.Write(context.Background(), Block[int]{Number: MaxSupportedBlockNum - 1}))
+	require.NoError(t, w.Write(context.Background(), Block[int]{Number: MaxSupportedBlockNum}))
+	require.ErrorIs(t, w.Write(context.Background(), Block[int]{Number: MaxSupportedBlockNum + 1}), ErrBlockNumOutOfRange)
+	require.ErrorIs(t, w.Write(context.Background(), Block[int]{Number: math.MaxUint64}), ErrBlockNumOutOfRange)
+	require.NoError(t, w.RollFile(context.Background()))
+	require.NoError(t, w.Close(context.Background()))
+	require.Equal(t, MaxSupportedBlockNum, w.DurableBlockNum())
+
+	// no gap writer rejects the block before filling the gap
+	w, err = NewWriter[int](Options{Dataset: Dataset{Path: path.Join(testPath, "no-gap")}})
+	require.NoError(t, err)
+
+	wng := NewWriterNoGap(w)
+	require.ErrorIs(t, wng.Write(context.Background(), Block[int]{Number: math.MaxUint64}), ErrBlockNumOutOfRange)
+	require.Equal(t, uint64(0), wng.AcceptedBlockNum())
+
+	// block number decoded from the input
+	var b Block[int]
+	require.NoError(t, json.Unmarshal([]byte(`{"blockNum":18446744073709551615}`), &b))
+	require.ErrorIs(t, wng.Write(context.Background(), b), ErrBlockNumOutOfRange)
+}
+
+func TestWriter_TrackPresence(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	opt := Options{
+		Dataset:        Dataset{Path: testPath},
+		FileRollPolicy: NewLastBlockNumberRollPolicy(1000),
+		TrackPresence:  true,
+	}
+
+	w, err := NewWriter[int](opt)
+	require.NoError(t, err)
+
+	// sparse ingestion, blocks 1 - 30 are examined but only 5 and 20 have data
+	require.NoError(t, w.Write(context.Background(), Block[int]{Number: 5, Data: 5}))
+	require.NoError(t, w.Write(context.Background(), Block[int]{Number: 20, Data: 20}))
+	require.NoError(t, w.MarkExamined(context.Background(), 1, 30))
+
+	// blocks are not durable yet
+	examined, err := BlockExamined(context.Background(), opt, 5)
+	require.NoError(t, err)
+	require.False(t, examined)
+
+	require.NoError(t, w.RollFile(context.Background()))
+
+	// blocks 31 - 45 are examined, but the block 40 is not durable on close
+	require.NoError(t, w.Write(context.Background(), Block[int]{Number: 40, Data: 40}))
+	require.NoError(t, w.MarkExamined(context.Background(), 31, 45))
+	require.NoError(t, w.Close(context.Background()))
+
+	r, err := NewReader[int](opt)
+	require.NoError(t, err)
+	defer r.Close()
+
+	for _, blockNum := range []uint64{1, 5, 10, 20, 30} {
+		examined, err := r.BlockExamined(context.Background(), blockNum)
+		require.NoError(t, err)
+		require.True(t, examined, "block %d", blockNum)
+	}
+
+	examined, err = r.BlockRangeExamined(context.Background(), 1, 30)
+	require.NoError(t, err)
+	require.True(t, examined)
+
+	// never examined or not durable
+	for _, blockNum := range []uint64{0, 31, 40, 45, 100} {
+		examined, err := r.BlockExamined(context.Background(), blockNum)
+		require.NoError(t, err)
+		require.False(t, examined, "block %d", blockNum)
+	}
+
+	examined, err = BlockRangeExamined(context.Background(), opt, 25, 35)
+	require.NoError(t, err)
+	require.False(t, examined)
+
+	// examined but empty blocks are stored on close when there are no pending blocks
+	w, err = NewWriter[int](opt)
+	require.NoError(t, err)
+	require.NoError(t, w.MarkExamined(context.Background(), 31, 3*presenceShardSize))
+	require.NoError(t, w.Close(context.Background()))
+
+	examined, err = r.BlockRangeExamined(context.Background(), 1, 3*presenceShardSize)
+	require.NoError(t, err)
+	require.True(t, examined)
+}
+
+func TestWriter_WriteWithStatus(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	const maxFileSize = 200
+
+	w, err := NewWriter[int](Options{
+		Dataset:        Dataset{Path: testPath},
+		FileRollPolicy: NewFileSizeRollPolicy(maxFileSize),
+	})
+	require.NoError(t, err)
+	defer w.Close(context.Background())
+
+	blockSize := func(b Block[int]) uint64 {
+		var buf bytes.Buffer
+		require.NoError(t, NewCBOREncoder(&buf).Encode(b))
+		return uint64(buf.Len())
+	}
+
+	var (
+		bufferedBytes  uint64
+		bufferedBlocks uint64
+		rolls          int
+	)
+	for i := 1; i <= 20; i++ {
+		b := Block[int]{Hash: common.BytesToHash([]byte{byte(i)}), Number: uint64(i), Data: i}
+
+		willRoll := bufferedBytes >= maxFileSize
+		require.Equal(t, willRoll, w.WillRollNext())
+		if willRoll {
+			bufferedBytes, bufferedBlocks = 0, 0
+			rolls++
+		}
+		bufferedBytes += blockSize(b)
+		bufferedBlocks++
+
+		status, err := w.WriteWithStatus(context.Background(), b)
+		require.NoError(t, err)
+		require.Equal(t, willRoll, status.Rolled)
+		require.Equal(t, bufferedBytes, status.BufferedBytes)
+		require.Equal(t, bufferedBlocks, status.BufferedBlocks)
+		require.Equal(t, uint64(maxFileSize)-min(bufferedBytes, maxFileSize), status.BytesUntilRoll)
+		require.Zero(t, status.PendingIndexBytes)
+	}
+	require.Greater(t, rolls, 0)
+
+	// no size roll policy
+	w2, err := NewWriter[int](Options{
+		Dataset:        Dataset{Path: path.Join(testPath, "no-size-policy")},
+		FileRollPolicy: NewLastBlockNumberRollPolicy(10),
+	})
+	require.NoError(t, err)
+	defer w2.Close(context.Background())
+
+	status, err := w2.WriteWithStatus(context.Background(), Block[int]{Number: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint64), status.BytesUntilRoll)
+}
+
+func TestWriter_LastBlockNumberRollPolicyGaps(t *testing.T) {
+	opt := Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      gostorage.NewMemoryFS(),
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+	}
+
+	w, err := NewWriter[int](opt)
+	require.NoError(t, err)
+
+	// the blocks 8-12, 34-44 and 46-60 are skipped
+	blockNums := []uint64{1, 7, 13, 20, 21, 30, 31, 33, 45, 61}
+	for _, blockNum := range blockNums {
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: blockNum, Data: int(blockNum)}))
+	}
+	require.NoError(t, w.Close(context.Background()))
+
+	fileIndex := NewFileIndex(storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()))
+	require.NoError(t, fileIndex.Load(context.Background()))
+
+	var ranges [][2]uint64
+	for _, file := range fileIndex.Files() {
+		ranges = append(ranges, [2]uint64{file.FirstBlockNum, file.LastBlockNum})
+	}
+
+	// the file is rolled before the block past its multiple of 10, the blocks of a file stay within one interval
+	require.Equal(t, [][2]uint64{{1, 7}, {8, 20}, {21, 30}, {31, 33}, {34, 45}, {46, 61}}, ranges)
+
+	r, err := NewReader[int](opt)
+	require.NoError(t, err)
+	defer r.Close()
+	for _, blockNum := range blockNums {
+		b, err := r.Read(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, blockNum, b.Number)
+	}
+}
+
+func TestWriter_WriteBatch(t *testing.T) {
+	batch := func(from, to uint64) []Block[int] {
+		var blocks []Block[int]
+		for blockNum := from; blockNum <= to; blockNum++ {
+			blocks = append(blocks, Block[int]{Number: blockNum, Data: int(blockNum)})
+		}
+		return blocks
+	}
+
+	files := func(t *testing.T, opt Options) [][2]uint64 {
+		fileIndex := NewFileIndex(storage.NewPrefixWrapper(opt.FileSystem, opt.Dataset.FullPath()))
+		require.NoError(t, fileIndex.Load(context.Background()))
+
+		var ranges [][2]uint64
+		for _, file := range fileIndex.Files() {
+			ranges = append(ranges, [2]uint64{file.FirstBlockNum, file.LastBlockNum})
+		}
+		return ranges
+	}
+
+	newOptions := func() Options {
+		return Options{
+			Dataset:         Dataset{Path: "ethwal"},
+			FileSystem:      gostorage.NewMemoryFS(),
+			FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+			FileRollOnClose: true,
+		}
+	}
+
+	t.Run("roll_between_batches", func(t *testing.T) {
+		opt := newOptions()
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+
+		// the policy is checked only before the batch
+		require.NoError(t, w.WriteBatch(context.Background(), batch(1, 25)))
+		require.Equal(t, uint64(25), w.AcceptedBlockNum())
+		require.NoError(t, w.WriteBatch(context.Background(), batch(26, 30)))
+
+		// the written blocks are skipped
+		require.NoError(t, w.WriteBatch(context.Background(), batch(20, 33)))
+		require.NoError(t, w.WriteBatch(context.Background(), nil))
+		require.NoError(t, w.Close(context.Background()))
+
+		// the policy rolls once the file reached the multiple of 10, checked before the block 26 and the block 31
+		require.Equal(t, [][2]uint64{{1, 25}, {26, 30}, {31, 33}}, files(t, opt))
+
+		r, err := NewReader[int](opt)
+		require.NoError(t, err)
+		defer r.Close()
+		for blockNum := uint64(1); blockNum <= 33; blockNum++ {
+			b, err := r.Read(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, blockNum, b.Number)
+			require.Equal(t, int(blockNum), b.Data)
+		}
+	})
+
+	t.Run("roll_check_interval", func(t *testing.T) {
+		opt := newOptions()
+		opt.BatchRollCheckInterval = 5
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+
+		require.NoError(t, w.WriteBatch(context.Background(), batch(1, 25)))
+		require.NoError(t, w.Close(context.Background()))
+
+		require.Equal(t, [][2]uint64{{1, 10}, {11, 20}, {21, 25}}, files(t, opt))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		opt := newOptions()
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+		defer w.Close(context.Background())
+
+		err = w.WriteBatch(context.Background(), []Block[int]{{Number: 1}, {Number: 3}, {Number: 2}})
+		require.ErrorIs(t, err, ErrBatchNotSorted)
+
+		err = w.WriteBatch(context.Background(), []Block[int]{{Number: 1}, {Number: 1}})
+		require.ErrorIs(t, err, ErrBatchNotSorted)
+
+		err = w.WriteBatch(context.Background(), []Block[int]{{Number: 1}, {Number: MaxSupportedBlockNum + 1}})
+		require.ErrorIs(t, err, ErrBlockNumOutOfRange)
+
+		// nothing is written
+		require.Zero(t, w.AcceptedBlockNum())
+	})
+}
+
+func TestWriter_StrictSequence(t *testing.T) {
+	newWriter := func(t *testing.T, strict bool) Writer[int] {
+		w, err := NewWriter[int](Options{
+			Dataset:        Dataset{Path: "ethwal"},
+			FileSystem:     gostorage.NewMemoryFS(),
+			StrictSequence: strict,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = w.Close(context.Background()) })
+		return w
+	}
+
+	t.Run("permissive", func(t *testing.T) {
+		w := newWriter(t, false)
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 1}))
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 5}))
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 5}))
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 2}))
+		require.Equal(t, uint64(5), w.AcceptedBlockNum())
+	})
+
+	t.Run("sequence", func(t *testing.T) {
+		w := newWriter(t, true)
+		// the empty dataset starts at any block
+		for blockNum := uint64(10); blockNum <= 20; blockNum++ {
+			require.NoError(t, w.Write(context.Background(), Block[int]{Number: blockNum}))
+		}
+		require.NoError(t, w.WriteBatch(context.Background(), []Block[int]{{Number: 21}, {Number: 22}}))
+		require.Equal(t, uint64(22), w.AcceptedBlockNum())
+	})
+
+	t.Run("genesis", func(t *testing.T) {
+		w := newWriter(t, true)
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 0}))
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 1}))
+
+		var nonMonotonic *ErrNonMonotonicBlock
+		require.ErrorAs(t, w.Write(context.Background(), Block[int]{Number: 0}), &nonMonotonic)
+		require.Equal(t, ErrNonMonotonicBlock{Got: 0, Last: 1}, *nonMonotonic)
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		w := newWriter(t, true)
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 1}))
+
+		err := w.Write(context.Background(), Block[int]{Number: 1})
+		require.ErrorIs(t, err, ErrBlockOutOfSequence)
+		var nonMonotonic *ErrNonMonotonicBlock
+		require.ErrorAs(t, err, &nonMonotonic)
+		require.Equal(t, ErrNonMonotonicBlock{Got: 1, Last: 1}, *nonMonotonic)
+	})
+
+	t.Run("older", func(t *testing.T) {
+		w := newWriter(t, true)
+		require.NoError(t, w.WriteBatch(context.Background(), []Block[int]{{Number: 1}, {Number: 2}, {Number: 3}}))
+
+		var nonMonotonic *ErrNonMonotonicBlock
+		require.ErrorAs(t, w.Write(context.Background(), Block[int]{Number: 2}), &nonMonotonic)
+		require.Equal(t, ErrNonMonotonicBlock{Got: 2, Last: 3}, *nonMonotonic)
+
+		// nothing of the batch is written
+		require.ErrorAs(t, w.WriteBatch(context.Background(), []Block[int]{{Number: 3}, {Number: 4}}), &nonMonotonic)
+		require.Equal(t, uint64(3), w.AcceptedBlockNum())
+	})
+
+	t.Run("gap", func(t *testing.T) {
+		w := newWriter(t, true)
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 1}))
+
+		err := w.Write(context.Background(), Block[int]{Number: 3})
+		require.ErrorIs(t, err, ErrBlockOutOfSequence)
+		var gap *ErrBlockGap
+		require.ErrorAs(t, err, &gap)
+		require.Equal(t, ErrBlockGap{Expected: 2, Got: 3}, *gap)
+
+		// nothing of the batch is written
+		require.ErrorAs(t, w.WriteBatch(context.Background(), []Block[int]{{Number: 2}, {Number: 4}}), &gap)
+		require.Equal(t, ErrBlockGap{Expected: 3, Got: 4}, *gap)
+		require.Equal(t, uint64(1), w.AcceptedBlockNum())
+	})
+
+	t.Run("no_gap", func(t *testing.T) {
+		w := NewWriterNoGap(newWriter(t, true))
+
+		// the gaps are filled
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 3}))
+		require.NoError(t, w.WriteBatch(context.Background(), []Block[int]{{Number: 6}, {Number: 9}}))
+		require.Equal(t, uint64(9), w.AcceptedBlockNum())
+
+		var nonMonotonic *ErrNonMonotonicBlock
+		require.ErrorAs(t, w.Write(context.Background(), Block[int]{Number: 5}), &nonMonotonic)
+		require.Equal(t, ErrNonMonotonicBlock{Got: 5, Last: 9}, *nonMonotonic)
+	})
+}
+
+func TestWriter_BlockMeta(t *testing.T) {
+	codecs := map[string]struct {
+		newEncoder NewEncoderFunc
+		newDecoder NewDecoderFunc
+	}{
+		"cbor": {NewCBOREncoder, NewCBORDecoder},
+		"json": {NewJSONEncoder, NewJSONDecoder},
+	}
+
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				_ = os.RemoveAll(testPath)
+			}()
+
+			opt := Options{
+				Dataset:         Dataset{Path: testPath},
+				NewEncoder:      codec.newEncoder,
+				NewDecoder:      codec.newDecoder,
+				FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+				FileRollOnClose: true,
+			}
+
+			w, err := NewWriter[int](opt)
+			require.NoError(t, err)
+
+			wng := NewWriterNoGap(w)
+			require.NoError(t, wng.Write(context.Background(), Block[int]{Number: 1, Data: 1, Meta: map[string]string{"source": "node-a"}}))
+			require.NoError(t, wng.Write(context.Background(), Block[int]{Number: 2, Data: 2}))
+			require.NoError(t, wng.Write(context.Background(), Block[int]{Number: 5, Data: 5, Meta: map[string]string{"source": "node-b", "validated": "true"}}))
+			require.NoError(t, wng.Close(context.Background()))
+
+			r, err := NewReader[int](opt)
+			require.NoError(t, err)
+			defer r.Close()
+
+			var metas []map[string]string
+			for {
+				b, err := r.Read(context.Background())
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				metas = append(metas, b.Meta)
+			}
+
+			filler := map[string]string{BlockMetaFiller: "true"}
+			require.Equal(t, []map[string]string{
+				{"source": "node-a"},
+				nil,
+				filler,
+				filler,
+				{"source": "node-b", "validated": "true"},
+			}, metas)
+		})
+	}
+
+	t.Run("limits", func(t *testing.T) {
+		defer func() {
+			_ = os.RemoveAll(testPath)
+		}()
+
+		w, err := NewWriter[int](Options{
+			Dataset:           Dataset{Path: testPath},
+			MaxBlockMetaKeys:  2,
+			MaxBlockMetaBytes: 16,
+		})
+		require.NoError(t, err)
+		defer w.Close(context.Background())
+
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 1, Meta: map[string]string{"a": "1", "b": "2"}}))
+		require.ErrorIs(t, w.Write(context.Background(), Block[int]{Number: 2, Meta: map[string]string{"a": "1", "b": "2", "c": "3"}}), ErrBlockMetaTooLarge)
+		require.ErrorIs(t, w.Write(context.Background(), Block[int]{Number: 2, Meta: map[string]string{"source": "0123456789a"}}), ErrBlockMetaTooLarge)
+		require.Equal(t, uint64(1), w.AcceptedBlockNum())
+
+		// the refused block can be written with smaller meta
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 2, Meta: map[string]string{"source": "0123456789"}}))
+		require.Equal(t, uint64(2), w.AcceptedBlockNum())
+	})
+
+	t.Run("backward_compatible", func(t *testing.T) {
+		var b Block[int]
+		require.NoError(t, json.Unmarshal([]byte(`{"blockNum":1,"blockData":1}`), &b))
+		require.Nil(t, b.Meta)
+
+		data, err := json.Marshal(Block[int]{Number: 1, Data: 1})
+		require.NoError(t, err)
+		require.NotContains(t, string(data), "meta")
+	})
+}
+
+// crashFS fails the operation selected by crash, as if the writer crashed at it.
+type crashFS struct {
+	storage.FS
+	crash func(op, path string) bool
+}
+
+var errCrash = fmt.Errorf("crash")
+
+func (c *crashFS) Create(ctx context.Context, path string, options *gostorage.WriterOptions) (io.WriteCloser, error) {
+	if c.crash("create", path) {
+		return nil, errCrash
+	}
+	return c.FS.Create(ctx, path, options)
+}
+
+func (c *crashFS) Attributes(ctx context.Context, path string, options *gostorage.ReaderOptions) (*gostorage.Attributes, error) {
+	if c.crash("stat", path) {
+		return nil, errCrash
+	}
+	return c.FS.Attributes(ctx, path, options)
+}
+
+func (c *crashFS) Delete(ctx context.Context, path string) error {
+	if c.crash("delete", path) {
+		return errCrash
+	}
+	return c.FS.Delete(ctx, path)
+}
+
+// crashRenameFS is the crashFS of the file system that renames the files.
+type crashRenameFS struct {
+	*crashFS
+	renamer storage.Renamer
+}
+
+func (c *crashRenameFS) Rename(ctx context.Context, srcPath, dstPath string) error {
+	if c.crash("rename", srcPath) {
+		return errCrash
+	}
+	return c.renamer.Rename(ctx, srcPath, dstPath)
+}
+
+func TestWriter_StagedFileCrash(t *testing.T) {
+	// the writer crashes while writing the second file
+	crashed := (&File{FirstBlockNum: 11, LastBlockNum: 20}).Path()
+	isStaging := func(p string) bool { return strings.HasSuffix(p, crashed+StagingFileSuffix) }
+	isFile := func(p string) bool { return strings.HasSuffix(p, crashed) }
+
+	crashPoints := map[string]func(fileIndexSaves *int) func(op, path string) bool{
+		"create_staging_file": func(*int) func(op, path string) bool {
+			return func(op, p string) bool { return op == "create" && isStaging(p) }
+		},
+		"verify_staging_file": func(*int) func(op, path string) bool {
+			return func(op, p string) bool { return op == "stat" && isStaging(p) }
+		},
+		"move_file": func(*int) func(op, path string) bool {
+			return func(op, p string) bool { return (op == "rename" && isStaging(p)) || (op == "create" && isFile(p)) }
+		},
+		"delete_staging_file": func(*int) func(op, path string) bool {
+			return func(op, p string) bool { return op == "delete" && isStaging(p) }
+		},
+		"write_bloom_filter": func(*int) func(op, path string) bool {
+			return func(op, p string) bool { return op == "create" && strings.HasSuffix(p, crashed+BloomFileSuffix) }
+		},
+		"save_file_index": func(saves *int) func(op, path string) bool {
+			return func(op, p string) bool {
+				if op != "create" || !strings.HasSuffix(p, FileIndexFileName) {
+					return false
+				}
+				*saves++
+				return *saves == 2
+			}
+		},
+	}
+
+	fileSystems := map[string]func(t *testing.T) (storage.FS, func(crash func(op, path string) bool) storage.FS){
+		"local": func(t *testing.T) (storage.FS, func(crash func(op, path string) bool) storage.FS) {
+			// the writer creates the dataset directory only on the local file system it's given
+			dir := t.TempDir()
+			require.NoError(t, os.MkdirAll(path.Join(dir, "ethwal"), 0755))
+			fs := local.NewLocalFS(dir)
+			return fs, func(crash func(op, path string) bool) storage.FS {
+				return &crashRenameFS{crashFS: &crashFS{FS: fs, crash: crash}, renamer: fs}
+			}
+		},
+		"memory": func(t *testing.T) (storage.FS, func(crash func(op, path string) bool) storage.FS) {
+			fs := gostorage.NewMemoryFS()
+			return fs, func(crash func(op, path string) bool) storage.FS {
+				return &crashFS{FS: fs, crash: crash}
+			}
+		},
+	}
+
+	for fsName, newFS := range fileSystems {
+		for pointName, crashPoint := range crashPoints {
+			// the local file system renames the staging file, it's never deleted
+			if fsName == "local" && pointName == "delete_staging_file" {
+				continue
+			}
+			t.Run(fsName+"/"+pointName, func(t *testing.T) {
+				fs, withCrash := newFS(t)
+
+				var fileIndexSaves int
+				opt := Options{
+					Dataset:         Dataset{Path: "ethwal"},
+					FileSystem:      withCrash(crashPoint(&fileIndexSaves)),
+					FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+					FileRollOnClose: true,
+					BloomKeys:       BloomKeysFunc[int](func(b Block[int]) [][]byte { return [][]byte{{byte(b.Data % 3)}} }),
+				}
+
+				w, err := NewWriter[int](opt)
+				require.NoError(t, err)
+
+				var writeErr error
+				for blockNum := uint64(1); blockNum <= 30 && writeErr == nil; blockNum++ {
+					writeErr = w.Write(context.Background(), Block[int]{Number: blockNum, Data: int(blockNum)})
+				}
+				require.ErrorIs(t, writeErr, errCrash)
+
+				// the writer crashed, the dataset is readable up to the last complete file
+				opt.FileSystem = fs
+				require.Equal(t, blockRange(1, 10), readBlockNums(t, opt))
+				require.NoError(t, CheckInvariants[int](context.Background(), opt))
+
+				// the writer resumes after the last complete file
+				w, err = NewWriter[int](opt)
+				require.NoError(t, err)
+				require.Equal(t, uint64(10), w.BlockNum())
+				for blockNum := uint64(11); blockNum <= 30; blockNum++ {
+					require.NoError(t, w.Write(context.Background(), Block[int]{Number: blockNum, Data: int(blockNum)}))
+				}
+				require.NoError(t, w.Close(context.Background()))
+
+				require.Equal(t, blockRange(1, 30), readBlockNums(t, opt))
+				require.NoError(t, CheckInvariants[int](context.Background(), opt))
+			})
+		}
+	}
+}
+
+func TestWriter_Flush(t *testing.T) {
+	fs := gostorage.NewMemoryFS()
+	opt := Options{
+		Dataset:          Dataset{Path: "ethwal"},
+		FileSystem:       fs,
+		NewCompressor:    NewZSTDCompressor,
+		NewDecompressor:  NewZSTDDecompressor,
+		FileRollPolicy:   NewLastBlockNumberRollPolicy(20),
+		FileRollOnClose:  true,
+		EnableChangefeed: true,
+		BloomKeys:        BloomKeysFunc[int](func(b Block[int]) [][]byte { return [][]byte{{byte(b.Data)}} }),
+		BlockDigest:      CanonicalBlockDigest[int],
+	}
+
+	w, err := NewWriter[int](opt)
+	require.NoError(t, err)
+
+	write := func(from, to uint64) {
+		for blockNum := from; blockNum <= to; blockNum++ {
+			require.NoError(t, w.Write(context.Background(), Block[int]{Number: blockNum, Data: int(blockNum)}))
+		}
+	}
+	files := func() []*File {
+		fileIndex := NewFileIndex(storage.NewPrefixWrapper(fs, opt.Dataset.FullPath()))
+		require.NoError(t, fileIndex.Load(context.Background()))
+		return fileIndex.Files()
+	}
+	exists := func(file *File) bool {
+		_, err := fs.Attributes(context.Background(), path.Join(opt.Dataset.FullPath(), file.Path()), nil)
+		return err == nil
+	}
+
+	// the flush without blocks is a no-op
+	require.NoError(t, w.Flush(context.Background()))
+	require.Empty(t, files())
+
+	// the flushed blocks are durable and readable
+	write(1, 5)
+	require.NoError(t, w.Flush(context.Background()))
+	require.Equal(t, uint64(5), w.DurableBlockNum())
+	require.Equal(t, blockRange(1, 5), readBlockNums(t, opt))
+	flushed := files()
+	require.Len(t, flushed, 1)
+	require.True(t, exists(flushed[0]))
+
+	// the next flush extends the file entry and deletes the flushed file
+	write(6, 8)
+	require.NoError(t, w.Flush(context.Background()))
+	require.NoError(t, w.Flush(context.Background()))
+	require.Equal(t, blockRange(1, 8), readBlockNums(t, opt))
+	extended := files()
+	require.Len(t, extended, 1)
+	require.Equal(t, uint64(1), extended[0].FirstBlockNum)
+	require.Equal(t, uint64(8), extended[0].LastBlockNum)
+	require.False(t, exists(flushed[0]))
+
+	// the roll extends the file entry of the flushed file, the next blocks are written to the next file
+	write(9, 25)
+	require.NoError(t, w.Close(context.Background()))
+	rolled := files()
+	require.Len(t, rolled, 2)
+	require.Equal(t, uint64(20), rolled[0].LastBlockNum)
+	require.Equal(t, uint64(21), rolled[1].FirstBlockNum)
+	require.False(t, exists(extended[0]))
+	require.Equal(t, blockRange(1, 25), readBlockNums(t, opt))
+
+	report, err := VerifyDataset[int](context.Background(), opt, VerifyDigests)
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Problems)
+	require.NoError(t, CheckInvariants[int](context.Background(), opt))
+
+	// the file entries written by the flushes are superseded by the entry of the rolled file in the changefeed
+	r, err := NewChangefeedReader(opt, 0)
+	require.NoError(t, err)
+	events, err := r.Poll(context.Background())
+	require.NoError(t, err)
+
+	var changes []string
+	for _, event := range events {
+		changes = append(changes, fmt.Sprintf("%s %d-%d", event.Type, event.File.FirstBlockNum, event.File.LastBlockNum))
+	}
+	require.Equal(t, []string{"fileFlushed 1-5", "fileFlushed 1-8", "fileAdded 1-20", "fileAdded 21-25"}, changes)
+
+	t.Run("roll_after_flush", func(t *testing.T) {
+		tests := []struct {
+			name string
+			roll func(w Writer[int]) error
+		}{
+			{"close", func(w Writer[int]) error { return w.Close(context.Background()) }},
+			{"roll_file", func(w Writer[int]) error { return w.RollFile(context.Background()) }},
+			{"reconfigure", func(w Writer[int]) error {
+				return w.ReconfigureRollPolicy(context.Background(), NewLastBlockNumberRollPolicy(10), RolloverImmediate)
+			}},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				opt := opt
+				opt.Dataset = Dataset{Path: "roll_after_flush_" + tc.name}
+				opt.EnableChangefeed = false
+
+				// the roll without the blocks written after the flush rewrites the file at the same path
+				w, err := NewWriter[int](opt)
+				require.NoError(t, err)
+				for blockNum := uint64(1); blockNum <= 5; blockNum++ {
+					require.NoError(t, w.Write(context.Background(), Block[int]{Number: blockNum, Data: int(blockNum)}))
+				}
+				require.NoError(t, w.Flush(context.Background()))
+				require.NoError(t, tc.roll(w))
+				require.Equal(t, blockRange(1, 5), readBlockNums(t, opt))
+
+				report, err := VerifyDataset[int](context.Background(), opt, VerifyDigests)
+				require.NoError(t, err)
+				require.True(t, report.OK(), report.Problems)
+				require.NoError(t, w.Close(context.Background()))
+			})
+		}
+	})
+
+	t.Run("events", func(t *testing.T) {
+		var written []string
+		opt := Options{
+			Dataset:          Dataset{Path: "events"},
+			FileSystem:       fs,
+			NewCompressor:    NewZSTDCompressor,
+			NewDecompressor:  NewZSTDDecompressor,
+			FileRollPolicy:   NewLastBlockNumberRollPolicy(10),
+			EnableChangefeed: true,
+			OnFileWritten: func(ctx context.Context, file *File, stats FileStats) {
+				written = append(written, fmt.Sprintf("%d-%d %d", file.FirstBlockNum, file.LastBlockNum, stats.NumBlocks))
+			},
+		}
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+		for blockNum := uint64(1); blockNum <= 15; blockNum++ {
+			require.NoError(t, w.Write(context.Background(), Block[int]{Number: blockNum, Data: int(blockNum)}))
+			if blockNum == 3 || blockNum == 6 {
+				require.NoError(t, w.Flush(context.Background()))
+			}
+		}
+		require.NoError(t, w.RollFile(context.Background()))
+		require.NoError(t, w.Close(context.Background()))
+
+		// the flushes aren't reported as the written files, the roll reports the whole file
+		require.Equal(t, []string{"1-10 10", "11-15 5"}, written)
+
+		r, err := NewChangefeedReader(opt, 0)
+		require.NoError(t, err)
+		events, err := r.Poll(context.Background())
+		require.NoError(t, err)
+
+		var changes []string
+		for _, event := range events {
+			changes = append(changes, fmt.Sprintf("%s %d-%d", event.Type, event.File.FirstBlockNum, event.File.LastBlockNum))
+		}
+		require.Equal(t, []string{"fileFlushed 1-3", "fileFlushed 1-6", "fileAdded 1-10", "fileAdded 11-15"}, changes)
+	})
+
+	t.Run("uncompressed", func(t *testing.T) {
+		opt := Options{Dataset: Dataset{Path: "uncompressed"}, FileSystem: fs}
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 1}))
+		require.NoError(t, w.Flush(context.Background()))
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 2}))
+		require.NoError(t, w.Flush(context.Background()))
+		require.Equal(t, blockRange(1, 2), readBlockNums(t, opt))
+	})
+
+	t.Run("not_supported", func(t *testing.T) {
+		opt := Options{
+			Dataset:    Dataset{Path: "not_supported"},
+			FileSystem: fs,
+			NewCompressor: func(w io.Writer) Compressor {
+				return nopWriteCloser{Writer: w}
+			},
+			NewDecompressor: NewZSTDDecompressor,
+		}
+		w, err := NewWriter[int](opt)
+		require.NoError(t, err)
+		require.NoError(t, w.Write(context.Background(), Block[int]{Number: 1}))
+		require.ErrorIs(t, w.Flush(context.Background()), ErrFlushNotSupported)
+	})
+}
+
+func readBlockNums(t *testing.T, opt Options) []uint64 {
+	r, err := NewReader[int](opt)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var blockNums []uint64
+	for {
+		b, err := r.Read(context.Background())
+		if err == io.EOF {
+			return blockNums
+		}
+		require.NoError(t, err)
+		blockNums = append(blockNums, b.Number)
+	}
+}
+
+func blockRange(first, last uint64) []uint64 {
+	var blockNums []uint64
+	for blockNum := first; blockNum <= last; blockNum++ {
+		blockNums = append(blockNums, blockNum)
+	}
+	return blockNums
+}
@@ -2,7 +2,9 @@ package ethwal
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 
 	"github.com/0xsequence/ethwal/storage"
@@ -12,28 +14,43 @@ type writerWithIndexer[T any] struct {
 	writer Writer[T]
 
 	indexer *Indexer[T]
+
+	closed bool
 }
 
 var _ Writer[any] = (*writerWithIndexer[any])(nil)
 
+// ErrIndexerCatchUpLimit is returned by NewWriterWithIndexer if the indexer is further behind the writer than
+// Options.IndexerCatchUpLimit.
+var ErrIndexerCatchUpLimit = fmt.Errorf("indexer is too far behind writer")
+
+// NewWriterWithIndexer creates the writer that indexes the blocks before it writes them. The indexer behind the
+// writer, e.g. after the failed index flush, is caught up first, the blocks it's missing are read from the dataset,
+// indexed and flushed. The blocks accepted by the writer but not written yet are rolled to the file before.
 func NewWriterWithIndexer[T any](writer Writer[T], indexer *Indexer[T]) (Writer[T], error) {
-	if writer.BlockNum() > indexer.BlockNum() {
-		// todo: implement a way to catch up indexer with writer
-		// this should never happen if the writer with indexer is used
-		return nil, fmt.Errorf("writer is ahead of indexer, can't catch up")
+	err := catchUpIndexer(context.Background(), writer, indexer)
+	if err != nil {
+		return nil, writer.ID().wrapError(err)
 	}
 
 	opts := writer.Options()
+	wi := &writerWithIndexer[T]{indexer: indexer, writer: writer}
+	indexer.useOnIndexFlushed(func(ctx context.Context, stats IndexFlushStats) {
+		if onIndexFlushed := wi.writer.Options().OnIndexFlushed; onIndexFlushed != nil {
+			onIndexFlushed(ContextWithInstance(ctx, wi.ID()), stats)
+		}
+	})
+
 	wrappedPolicy := NewWrappedRollPolicy(opts.FileRollPolicy, func(ctx context.Context) {
-		err := indexer.Flush(ctx)
+		err := wi.flushIndexer(ctx)
 		if err != nil {
-			log.Default().Println("failed to flush index", "err", err)
+			log.Default().Println("failed to flush index", "instance", wi.ID(), "err", err)
 		}
 	})
 	opts.FileRollPolicy = wrappedPolicy
 	writer.SetOptions(opts)
 
-	return &writerWithIndexer[T]{indexer: indexer, writer: writer}, nil
+	return wi, nil
 }
 
 func (c *writerWithIndexer[T]) FileSystem() storage.FS {
@@ -41,48 +58,238 @@ func (c *writerWithIndexer[T]) FileSystem() storage.FS {
 }
 
 func (c *writerWithIndexer[T]) Write(ctx context.Context, block Block[T]) error {
+	_, err := c.WriteWithStatus(ctx, block)
+	return err
+}
+
+func (c *writerWithIndexer[T]) WriteWithStatus(ctx context.Context, block Block[T]) (WriteStatus, error) {
+	// the block refused by the writer must not be indexed
+	err := validateBlockMeta(c.writer.Options(), block.Meta)
+	if err != nil {
+		return WriteStatus{}, c.ID().wrapError(err)
+	}
+	err = checkSequence(c.writer, []uint64{block.Number})
+	if err != nil {
+		return WriteStatus{}, c.ID().wrapError(err)
+	}
+
 	// update indexes first (idempotent)
-	err := c.index(ctx, block)
+	err = c.index(ctx, block)
 	if err != nil {
-		return err
+		return WriteStatus{}, err
 	}
 
 	// write block, noop if block already written
-	err = c.writer.Write(ctx, block)
+	status, err := c.writer.WriteWithStatus(ctx, block)
 	if err != nil {
-		return err
+		return WriteStatus{}, err
 	}
-	return nil
+
+	status.PendingIndexBytes = uint64(c.indexer.EstimatedBatchSize())
+	return status, nil
 }
 
-func (c *writerWithIndexer[T]) Close(ctx context.Context) error {
-	err := c.indexer.Close(ctx)
+func (c *writerWithIndexer[T]) WriteBatch(ctx context.Context, blocks []Block[T]) error {
+	// the batch refused by the writer must not be indexed
+	err := validateBatch(blocks)
 	if err != nil {
-		return err
+		return c.ID().wrapError(err)
+	}
+	for _, block := range blocks {
+		err = validateBlockMeta(c.writer.Options(), block.Meta)
+		if err != nil {
+			return c.ID().wrapError(fmt.Errorf("block %d: %w", block.Number, err))
+		}
+	}
+	err = checkSequence(c.writer, batchBlockNums(blocks))
+	if err != nil {
+		return c.ID().wrapError(err)
+	}
+
+	// update indexes first (idempotent)
+	for _, block := range blocks {
+		err = c.index(ctx, block)
+		if err != nil {
+			return err
+		}
+	}
+
+	// write blocks, noop for the blocks already written
+	return c.writer.WriteBatch(ctx, blocks)
+}
+
+func (c *writerWithIndexer[T]) checkSequence(blockNums []uint64) error {
+	return checkSequence(c.writer, blockNums)
+}
+
+func (c *writerWithIndexer[T]) allowGaps() {
+	allowGaps(c.writer)
+}
+
+func (c *writerWithIndexer[T]) empty() bool {
+	return writerEmpty(c.writer)
+}
+
+func (c *writerWithIndexer[T]) WillRollNext() bool {
+	return c.writer.WillRollNext()
+}
+
+func (c *writerWithIndexer[T]) Close(ctx context.Context) error {
+	if c.closed {
+		return nil
 	}
-	return c.writer.Close(ctx)
+	c.closed = true
+
+	// close all components even if some of them fail
+	return errors.Join(
+		c.flushIndexer(ctx),
+		c.indexer.Close(ctx),
+		c.writer.Close(ctx),
+	)
 }
 
 func (c *writerWithIndexer[T]) BlockNum() uint64 {
-	return min(c.writer.BlockNum(), c.indexer.BlockNum())
+	return c.AcceptedBlockNum()
+}
+
+func (c *writerWithIndexer[T]) AcceptedBlockNum() uint64 {
+	return min(c.writer.AcceptedBlockNum(), c.indexer.BlockNum())
+}
+
+func (c *writerWithIndexer[T]) DurableBlockNum() uint64 {
+	return min(c.writer.DurableBlockNum(), c.indexer.FlushedBlockNum())
 }
 
 func (c *writerWithIndexer[T]) RollFile(ctx context.Context) error {
-	err := c.indexer.Flush(ctx)
+	err := c.flushIndexer(ctx)
 	if err != nil {
 		return err
 	}
 	return c.writer.RollFile(ctx)
 }
 
+func (c *writerWithIndexer[T]) Flush(ctx context.Context) error {
+	err := c.flushIndexer(ctx)
+	if err != nil {
+		return err
+	}
+	return c.writer.Flush(ctx)
+}
+
+// Rollback rolls back the writer and then the indexer, the rollback retried after the indexer failed rolls back
+// the indexer only.
+func (c *writerWithIndexer[T]) Rollback(ctx context.Context, toBlockNum uint64) error {
+	err := c.writer.Rollback(ctx, toBlockNum)
+	if err != nil {
+		return err
+	}
+	return c.indexer.Rollback(ctx, toBlockNum)
+}
+
+func (c *writerWithIndexer[T]) ReconfigureRollPolicy(ctx context.Context, p FileRollPolicy, mode RolloverMode) error {
+	return c.writer.ReconfigureRollPolicy(ctx, p, mode)
+}
+
+func (c *writerWithIndexer[T]) MarkExamined(ctx context.Context, from, to uint64) error {
+	return c.writer.MarkExamined(ctx, from, to)
+}
+
 func (c *writerWithIndexer[T]) Options() Options {
 	return c.writer.Options()
 }
 
+func (c *writerWithIndexer[T]) Accounting() *storage.Accounting {
+	return c.writer.Accounting()
+}
+
 func (c *writerWithIndexer[T]) SetOptions(options Options) {
 	c.writer.SetOptions(options)
 }
 
+func (c *writerWithIndexer[T]) ID() Instance {
+	return c.writer.ID()
+}
+
+// flushIndexer flushes the indexer, the indexer notifies Options.OnIndexFlushed.
+func (c *writerWithIndexer[T]) flushIndexer(ctx context.Context) error {
+	return c.indexer.Flush(ctx)
+}
+
 func (c *writerWithIndexer[T]) index(ctx context.Context, block Block[T]) error {
 	return c.indexer.Index(ctx, block)
 }
+
+// catchUpIndexer indexes the blocks of the dataset the indexer is missing up to the last block of the writer.
+// The indexes are flushed after each file, Options.OnIndexerCatchUp is notified of the progress.
+func catchUpIndexer[T any](ctx context.Context, writer Writer[T], indexer *Indexer[T]) error {
+	targetBlockNum := writer.AcceptedBlockNum()
+	if targetBlockNum <= indexer.BlockNum() {
+		return nil
+	}
+
+	opts := writer.Options()
+	if opts.IndexerCatchUpLimit > 0 && targetBlockNum-indexer.BlockNum() > opts.IndexerCatchUpLimit {
+		return fmt.Errorf("%w: indexer is at block %d, writer at block %d, limit %d", ErrIndexerCatchUpLimit,
+			indexer.BlockNum(), targetBlockNum, opts.IndexerCatchUpLimit)
+	}
+
+	// the accepted blocks are readable only once they're rolled
+	if writer.DurableBlockNum() < targetBlockNum {
+		err := writer.RollFile(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to roll file before indexer catch-up: %w", err)
+		}
+	}
+
+	opts.TailMode, opts.FollowTail = false, false
+	rdr, err := NewRangeReader[T](opts, indexer.BlockNum()+1, targetBlockNum)
+	if err != nil {
+		return fmt.Errorf("failed to create indexer catch-up reader: %w", err)
+	}
+	defer rdr.Close()
+
+	flush := func() error {
+		err := indexer.Flush(ctx)
+		if err != nil {
+			return err
+		}
+		if opts.OnIndexerCatchUp != nil {
+			opts.OnIndexerCatchUp(ContextWithInstance(ctx, writer.ID()), indexer.FlushedBlockNum(), targetBlockNum)
+		}
+		return nil
+	}
+
+	var file *File
+	for {
+		block, loc, err := rdr.ReadWithLocation(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read block for indexer catch-up: %w", err)
+		}
+
+		if file != nil && loc.File != file {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+		file = loc.File
+
+		err = indexer.Index(ctx, block)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = flush()
+	if err != nil {
+		return err
+	}
+
+	if indexer.BlockNum() < targetBlockNum {
+		return fmt.Errorf("indexer caught up to block %d, writer is at block %d", indexer.BlockNum(), targetBlockNum)
+	}
+	return nil
+}
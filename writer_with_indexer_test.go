@@ -2,10 +2,19 @@ package ethwal
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path"
+	"sync/atomic"
 	"testing"
 
+	"github.com/0xsequence/ethwal/storage"
+	"github.com/0xsequence/ethwal/storage/local"
+	"github.com/0xsequence/ethwal/storage/memory"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/c2h5oh/datasize"
 	"github.com/stretchr/testify/require"
 )
 
@@ -55,5 +64,538 @@ func TestWriterWithIndexer(t *testing.T) {
 
 	ethwalDirEntries, err := os.ReadDir(testPath)
 	require.NoError(t, err)
-	require.Len(t, ethwalDirEntries, 3)
+	require.Len(t, ethwalDirEntries, 4)
+}
+
+func TestWriterWithIndexer_OnIndexFlushed(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+		Dataset: Dataset{
+			Path: testPath,
+		},
+		Indexes: generateMixedIntIndexes(),
+	})
+	require.NoError(t, err)
+
+	var filesWritten []uint64
+	var indexFlushes []uint64
+	w, err := NewWriter[[]int](Options{
+		Dataset: Dataset{
+			Path: testPath,
+		},
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+		OnFileWritten: func(ctx context.Context, file *File, stats FileStats) {
+			// indexes are flushed before the file is written
+			require.NotEmpty(t, indexFlushes)
+			require.GreaterOrEqual(t, indexFlushes[len(indexFlushes)-1], file.LastBlockNum)
+			filesWritten = append(filesWritten, file.LastBlockNum)
+		},
+		OnIndexFlushed: func(ctx context.Context, stats IndexFlushStats) {
+			indexFlushes = append(indexFlushes, stats.BlockNum)
+		},
+	})
+	require.NoError(t, err)
+
+	wi, err := NewWriterWithIndexer(w, indexer)
+	require.NoError(t, err)
+
+	for _, block := range generateMixedIntBlocks()[:25] {
+		err := wi.Write(context.Background(), block)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, wi.Close(context.Background()))
+
+	require.Equal(t, []uint64{10, 20, 25}, filesWritten)
+	require.Equal(t, uint64(25), indexFlushes[len(indexFlushes)-1])
+}
+
+// closeFailingWriter is a writer that records Close calls and fails to close.
+type closeFailingWriter[T any] struct {
+	Writer[T]
+
+	closeCalls int
+}
+
+func (c *closeFailingWriter[T]) Close(ctx context.Context) error {
+	c.closeCalls++
+	return errors.Join(c.Writer.Close(ctx), fmt.Errorf("writer close failed"))
+}
+
+func TestWriterWithIndexer_Close(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	require.NoError(t, os.MkdirAll(testPath, 0755))
+
+	// indexer fails to store indexes
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+		Dataset:    Dataset{Path: testPath},
+		FileSystem: readOnlyFS{FS: local.NewLocalFS("")},
+		Indexes:    generateMixedIntIndexes(),
+	})
+	require.NoError(t, err)
+
+	w, err := NewWriter[[]int](Options{
+		Dataset:         Dataset{Path: testPath},
+		FileRollOnClose: true,
+	})
+	require.NoError(t, err)
+
+	fw := &closeFailingWriter[[]int]{Writer: w}
+	wi, err := NewWriterWithIndexer[[]int](fw, indexer)
+	require.NoError(t, err)
+
+	for _, block := range generateMixedIntBlocks()[:5] {
+		require.NoError(t, wi.Write(context.Background(), block))
+	}
+
+	err = wi.Close(context.Background())
+	require.ErrorContains(t, err, "read only file system")
+	require.ErrorContains(t, err, "writer close failed")
+
+	// writer is closed even though the indexer failed
+	require.Equal(t, 1, fw.closeCalls)
+	require.Equal(t, uint64(5), w.DurableBlockNum())
+
+	// double close is safe
+	require.NoError(t, wi.Close(context.Background()))
+	require.NoError(t, indexer.Close(context.Background()))
+	require.NoError(t, w.Close(context.Background()))
+	require.Equal(t, 1, fw.closeCalls)
+}
+
+func TestWriterWithIndexer_WriteWithStatus(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+		Dataset: Dataset{Path: testPath},
+		Indexes: generateMixedIntIndexes(),
+	})
+	require.NoError(t, err)
+
+	w, err := NewWriter[[]int](Options{
+		Dataset:        Dataset{Path: testPath},
+		FileRollPolicy: NewLastBlockNumberRollPolicy(10),
+	})
+	require.NoError(t, err)
+
+	wi, err := NewWriterWithIndexer(w, indexer)
+	require.NoError(t, err)
+	defer wi.Close(context.Background())
+
+	for _, block := range generateMixedIntBlocks()[:15] {
+		require.Equal(t, block.Number == 11, wi.WillRollNext())
+
+		status, err := wi.WriteWithStatus(context.Background(), block)
+		require.NoError(t, err)
+		require.Equal(t, uint64(indexer.EstimatedBatchSize()), status.PendingIndexBytes)
+
+		// the last block number roll policy rolls before the block 11
+		require.Equal(t, block.Number == 11, status.Rolled)
+		if status.Rolled {
+			require.Equal(t, uint64(1), status.BufferedBlocks)
+		}
+	}
+}
+
+func TestWriterWithIndexer_WriteBatch(t *testing.T) {
+	// write writes the blocks one by one or in batches and returns the index objects
+	write := func(t *testing.T, batchSize int) map[string]string {
+		opt := Options{
+			Dataset:                Dataset{Path: "ethwal"},
+			FileSystem:             gostorage.NewMemoryFS(),
+			FileRollPolicy:         NewLastBlockNumberRollPolicy(10),
+			BatchRollCheckInterval: 1,
+		}
+
+		indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+			Dataset:    opt.Dataset,
+			FileSystem: opt.FileSystem,
+			Indexes:    generateMixedIntIndexes(),
+		})
+		require.NoError(t, err)
+
+		w, err := NewWriter[[]int](opt)
+		require.NoError(t, err)
+
+		wi, err := NewWriterWithIndexer(w, indexer)
+		require.NoError(t, err)
+
+		blocks := generateMixedIntBlocks()
+		if batchSize == 0 {
+			for _, block := range blocks {
+				require.NoError(t, wi.Write(context.Background(), block))
+			}
+		} else {
+			for i := 0; i < len(blocks); i += batchSize {
+				require.NoError(t, wi.WriteBatch(context.Background(), blocks[i:min(i+batchSize, len(blocks))]))
+			}
+		}
+		require.Equal(t, blocks[len(blocks)-1].Number, wi.AcceptedBlockNum())
+		require.NoError(t, wi.Close(context.Background()))
+
+		objects := make(map[string]string)
+		prefix := path.Join(opt.Dataset.FullPath(), ".indexes") + "/"
+		require.NoError(t, opt.FileSystem.Walk(context.Background(), prefix, func(objectPath string) error {
+			data, err := storageReadAll(opt.FileSystem, objectPath)
+			objects[objectPath] = string(data)
+			return err
+		}))
+		require.NotEmpty(t, objects)
+		return objects
+	}
+
+	require.Equal(t, write(t, 0), write(t, 16))
+
+	t.Run("invalid", func(t *testing.T) {
+		fs := gostorage.NewMemoryFS()
+		indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+			Dataset:    Dataset{Path: "ethwal"},
+			FileSystem: fs,
+			Indexes:    generateMixedIntIndexes(),
+		})
+		require.NoError(t, err)
+
+		w, err := NewWriter[[]int](Options{Dataset: Dataset{Path: "ethwal"}, FileSystem: fs})
+		require.NoError(t, err)
+
+		wi, err := NewWriterWithIndexer(w, indexer)
+		require.NoError(t, err)
+		defer wi.Close(context.Background())
+
+		// the unsorted batch isn't indexed
+		err = wi.WriteBatch(context.Background(), []Block[[]int]{{Number: 2}, {Number: 1}})
+		require.ErrorIs(t, err, ErrBatchNotSorted)
+		require.Zero(t, indexer.BlockNum())
+	})
+}
+
+func TestWriterWithIndexer_StrictSequence(t *testing.T) {
+	fs := gostorage.NewMemoryFS()
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+		Dataset:    Dataset{Path: "ethwal"},
+		FileSystem: fs,
+		Indexes:    generateMixedIntIndexes(),
+	})
+	require.NoError(t, err)
+
+	w, err := NewWriter[[]int](Options{Dataset: Dataset{Path: "ethwal"}, FileSystem: fs, StrictSequence: true})
+	require.NoError(t, err)
+
+	wi, err := NewWriterWithIndexer(w, indexer)
+	require.NoError(t, err)
+	defer wi.Close(context.Background())
+
+	require.NoError(t, wi.WriteBatch(context.Background(), []Block[[]int]{{Number: 1, Data: []int{1}}, {Number: 2, Data: []int{2}}}))
+
+	// the blocks refused by the writer aren't indexed
+	require.ErrorIs(t, wi.Write(context.Background(), Block[[]int]{Number: 4, Data: []int{4}}), ErrBlockOutOfSequence)
+	require.ErrorIs(t, wi.WriteBatch(context.Background(), []Block[[]int]{{Number: 3, Data: []int{3}}, {Number: 5, Data: []int{5}}}), ErrBlockOutOfSequence)
+	require.Equal(t, uint64(2), indexer.BlockNum())
+
+	// the block after the refused ones is indexed
+	require.NoError(t, wi.Write(context.Background(), Block[[]int]{Number: 3, Data: []int{3}}))
+	require.Equal(t, uint64(3), indexer.BlockNum())
+	require.Equal(t, uint64(3), wi.AcceptedBlockNum())
+
+	// the gaps are filled under the no-gap writer
+	wng := NewWriterNoGap(wi)
+	require.NoError(t, wng.Write(context.Background(), Block[[]int]{Number: 6, Data: []int{6}}))
+	require.Equal(t, uint64(6), indexer.BlockNum())
+}
+
+func TestWriterWithIndexer_BlockMeta(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	// index blocks by the source node
+	indexes := Indexes[[]int]{
+		"source": NewIndex[[]int]("source", func(block Block[[]int]) (bool, map[IndexedValue][]Position, error) {
+			source, ok := block.Meta["source"]
+			if !ok {
+				return false, nil, nil
+			}
+			return true, map[IndexedValue][]Position{IndexedValue(source): Ordinals(IndexAllDataIndexes)}, nil
+		}),
+	}
+
+	indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+		Dataset: Dataset{Path: testPath},
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+
+	w, err := NewWriter[[]int](Options{
+		Dataset:          Dataset{Path: testPath},
+		FileRollOnClose:  true,
+		MaxBlockMetaKeys: 1,
+	})
+	require.NoError(t, err)
+
+	wi, err := NewWriterWithIndexer(w, indexer)
+	require.NoError(t, err)
+
+	for _, block := range generateMixedIntBlocks() {
+		block.Meta = map[string]string{"source": fmt.Sprintf("node-%d", block.Number%3)}
+		require.NoError(t, wi.Write(context.Background(), block))
+	}
+
+	// the refused block isn't indexed
+	err = wi.Write(context.Background(), Block[[]int]{Number: 71, Meta: map[string]string{"source": "node-bad", "extra": "x"}})
+	require.ErrorIs(t, err, ErrBlockMetaTooLarge)
+	require.NoError(t, wi.Close(context.Background()))
+
+	fb, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset: Dataset{Path: testPath},
+		Indexes: indexes,
+	})
+	require.NoError(t, err)
+	require.True(t, fb.Eq("source", "node-bad").Eval(context.Background()).Bitmap().IsEmpty())
+
+	r, err := NewReader[[]int](Options{Dataset: Dataset{Path: testPath}})
+	require.NoError(t, err)
+	r, err = NewReaderWithFilter[[]int](r, fb.Eq("source", "node-1"))
+	require.NoError(t, err)
+	defer r.Close()
+
+	var blockNums []uint64
+	for {
+		block, err := r.Read(context.Background())
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		require.Equal(t, "node-1", block.Meta["source"])
+		blockNums = append(blockNums, block.Number)
+	}
+	require.Len(t, blockNums, 24)
+	require.Equal(t, uint64(1), blockNums[0])
+}
+
+func TestWriterWithIndexer_CatchUp(t *testing.T) {
+	defer func() {
+		_ = os.RemoveAll(testPath)
+	}()
+
+	const (
+		indexedBlockNum = 40_000
+		lastBlockNum    = 100_000
+	)
+
+	// index blocks by the remainder of the number
+	newIndexes := func(names ...IndexName) Indexes[[]int] {
+		indexes := Indexes[[]int]{}
+		for _, name := range names {
+			indexes[name] = NewIndex[[]int](name, func(block Block[[]int]) (bool, map[IndexedValue][]Position, error) {
+				return true, map[IndexedValue][]Position{IndexedValue(fmt.Sprint(block.Number % 7)): Ordinals(IndexAllDataIndexes)}, nil
+			})
+		}
+		return indexes
+	}
+	newIndexer := func(indexes Indexes[[]int]) *Indexer[[]int] {
+		indexer, err := NewIndexer(context.Background(), IndexerOptions[[]int]{
+			Dataset: Dataset{Path: testPath},
+			Indexes: indexes,
+		})
+		require.NoError(t, err)
+		return indexer
+	}
+
+	var progress []uint64
+	opt := Options{
+		Dataset:         Dataset{Path: testPath},
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10_000),
+		FileRollOnClose: true,
+		OnIndexerCatchUp: func(ctx context.Context, blockNum, targetBlockNum uint64) {
+			require.Equal(t, uint64(lastBlockNum), targetBlockNum)
+			progress = append(progress, blockNum)
+		},
+	}
+	newWriter := func(opt Options) Writer[[]int] {
+		w, err := NewWriter[[]int](opt)
+		require.NoError(t, err)
+		return w
+	}
+	writeBlocks := func(w Writer[[]int], from, to uint64) {
+		for i := from; i <= to; i++ {
+			require.NoError(t, w.Write(context.Background(), Block[[]int]{Number: i, Data: []int{int(i)}}))
+		}
+	}
+
+	wi, err := NewWriterWithIndexer(newWriter(opt), newIndexer(newIndexes("mod7")))
+	require.NoError(t, err)
+	writeBlocks(wi, 1, indexedBlockNum)
+	require.NoError(t, wi.Close(context.Background()))
+
+	// the blocks written without the indexer, the last ones aren't rolled yet
+	w := newWriter(opt)
+	writeBlocks(w, indexedBlockNum+1, lastBlockNum)
+	require.Less(t, w.DurableBlockNum(), uint64(lastBlockNum))
+
+	// the catch-up over the limit fails
+	limitOpt := w.Options()
+	limitOpt.IndexerCatchUpLimit = lastBlockNum - indexedBlockNum - 1
+	w.SetOptions(limitOpt)
+	indexer := newIndexer(newIndexes("mod7"))
+	_, err = NewWriterWithIndexer(w, indexer)
+	require.ErrorIs(t, err, ErrIndexerCatchUpLimit)
+	require.Equal(t, uint64(indexedBlockNum), indexer.BlockNum())
+	require.Empty(t, progress)
+
+	limitOpt.IndexerCatchUpLimit = 0
+	w.SetOptions(limitOpt)
+	wi, err = NewWriterWithIndexer(w, indexer)
+	require.NoError(t, err)
+	require.Equal(t, uint64(lastBlockNum), w.DurableBlockNum())
+	require.Equal(t, uint64(lastBlockNum), indexer.FlushedBlockNum())
+	require.Equal(t, []uint64{50_000, 60_000, 70_000, 80_000, 90_000, 100_000}, progress)
+
+	// the caught-up writer keeps indexing
+	writeBlocks(wi, lastBlockNum+1, lastBlockNum+10)
+	require.NoError(t, wi.Close(context.Background()))
+
+	fb, err := NewFilterBuilder(FilterBuilderOptions[[]int]{
+		Dataset: Dataset{Path: testPath},
+		Indexes: newIndexes("mod7"),
+	})
+	require.NoError(t, err)
+	for _, value := range []string{"0", "3"} {
+		var expected []uint64
+		for i := uint64(1); i <= lastBlockNum+10; i++ {
+			if fmt.Sprint(i%7) == value {
+				expected = append(expected, i)
+			}
+		}
+
+		var blockNums []uint64
+		it := fb.Eq("mod7", value).Eval(context.Background())
+		for it.HasNext() {
+			blockNum, _ := it.Next()
+			blockNums = append(blockNums, blockNum)
+		}
+		require.Equal(t, expected, blockNums, value)
+	}
+}
+
+// failingCreateFS is a file system that fails to create files once failing is set.
+type failingCreateFS struct {
+	storage.FS
+
+	failing atomic.Bool
+}
+
+func (f *failingCreateFS) Create(ctx context.Context, path string, options *gostorage.WriterOptions) (io.WriteCloser, error) {
+	if f.failing.Load() {
+		return nil, fmt.Errorf("create failed")
+	}
+	return f.FS.Create(ctx, path, options)
+}
+
+func TestWriterWithIndexer_Hooks(t *testing.T) {
+	ctx := context.Background()
+	fs := &failingCreateFS{FS: memory.NewMemoryFS()}
+
+	type rolledFile struct {
+		first, last uint64
+		bytes       int
+	}
+	var (
+		blocksWritten []uint64
+		blockBytes    int
+		filesRolled   []rolledFile
+		rollErrs      []error
+		indexFlushes  []datasize.ByteSize
+		indexer       *Indexer[[]int]
+		wi            Writer[[]int]
+	)
+	opt := Options{
+		Dataset:         Dataset{Path: "ethwal"},
+		FileSystem:      fs,
+		FileRollPolicy:  NewLastBlockNumberRollPolicy(10),
+		FileRollOnClose: true,
+		Hooks: Hooks{
+			OnBlockWritten: func(blockNum uint64, bytes int) {
+				// the hooks are called once the lock is released, the ones of the batch after the whole batch
+				require.GreaterOrEqual(t, wi.AcceptedBlockNum(), blockNum)
+				blocksWritten = append(blocksWritten, blockNum)
+				blockBytes += bytes
+			},
+			OnFileRollError: func(err error) {
+				rollErrs = append(rollErrs, err)
+			},
+		},
+		OnFileWritten: func(ctx context.Context, file *File, stats FileStats) {
+			require.Equal(t, file.Path(), stats.Path)
+			require.Positive(t, stats.Took)
+			filesRolled = append(filesRolled, rolledFile{first: file.FirstBlockNum, last: file.LastBlockNum, bytes: int(stats.Size)})
+
+			// the file is the copy of the file index entry
+			file.Checksum = nil
+		},
+		OnIndexFlushed: func(ctx context.Context, stats IndexFlushStats) {
+			// the callback is called once the lock of the indexer is released
+			require.Zero(t, indexer.Stats().PendingBytes)
+			require.Positive(t, stats.Took)
+			indexFlushes = append(indexFlushes, stats.Size)
+		},
+	}
+	var err error
+	indexer, err = NewIndexer(ctx, IndexerOptions[[]int]{Dataset: opt.Dataset, FileSystem: fs, Indexes: generateMixedIntIndexes()})
+	require.NoError(t, err)
+	w, err := NewWriter[[]int](opt)
+	require.NoError(t, err)
+	wi, err = NewWriterWithIndexer(w, indexer)
+	require.NoError(t, err)
+
+	blocks := generateMixedIntBlocks()[:25]
+	for _, block := range blocks[:20] {
+		require.NoError(t, wi.Write(ctx, block))
+	}
+	require.NoError(t, wi.WriteBatch(ctx, blocks[20:]))
+
+	// the roll that fails is reported and retried by the close
+	fs.failing.Store(true)
+	require.Error(t, wi.RollFile(ctx))
+	require.Len(t, rollErrs, 1)
+	require.ErrorContains(t, rollErrs[0], "create failed")
+	fs.failing.Store(false)
+
+	require.NoError(t, wi.Close(ctx))
+
+	var blockNums []uint64
+	for _, block := range blocks {
+		blockNums = append(blockNums, block.Number)
+	}
+	require.Equal(t, blockNums, blocksWritten)
+	require.Positive(t, blockBytes)
+
+	// the rolled files with their stored size
+	require.Len(t, filesRolled, 3)
+	for i, expected := range [][2]uint64{{1, 10}, {11, 20}, {21, 25}} {
+		require.Equal(t, expected, [2]uint64{filesRolled[i].first, filesRolled[i].last})
+
+		data, err := readObject(ctx, fs, path.Join("ethwal", (&File{FirstBlockNum: expected[0], LastBlockNum: expected[1]}).Path()))
+		require.NoError(t, err)
+		require.Equal(t, len(data), filesRolled[i].bytes)
+	}
+
+	files, err := ListFiles(ctx, storage.NewPrefixWrapper(fs, opt.Dataset.FullPath()))
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	for _, file := range files {
+		require.NotEmpty(t, file.Checksum)
+	}
+
+	// the indexes are flushed by the rolls and by the close, the callback of the writer is set on the indexer
+	require.GreaterOrEqual(t, len(indexFlushes), 3)
+	require.Positive(t, indexFlushes[0])
 }
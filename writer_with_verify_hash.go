@@ -0,0 +1,219 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	"github.com/0xsequence/ethwal/storage"
+)
+
+// BlockHashGetter returns the hash of the block, e.g. from the chain node. It's used by the writer with the
+// hash verification to get the hash of the parent block that it hasn't written.
+type BlockHashGetter func(ctx context.Context, blockNum uint64) (common.Hash, error)
+
+// VerifyHashOptions are the options of NewWriterWithVerifyHash.
+type VerifyHashOptions struct {
+	// FirstBlockNum is the first block of the dataset, the parent hash of the blocks up to it isn't verified,
+	// e.g. 1 for the datasets without the genesis block or 15000000 for the dataset starting mid-chain with
+	// the getter that can't serve the older blocks. Block 0, the genesis block, is never verified.
+	FirstBlockNum uint64
+	// RejectZeroTimestamp fails the write of the block other than the genesis block whose timestamp is zero
+	// with ErrZeroTimestamp, see RepairTimestamps for the datasets already written with such blocks.
+	RejectZeroTimestamp bool
+}
+
+type verifyHashWriter[T any] struct {
+	w               Writer[T]
+	blockHashGetter BlockHashGetter
+	options         VerifyHashOptions
+
+	hasPrev  bool
+	prevNum  uint64
+	prevHash common.Hash
+}
+
+// NewWriterWithVerifyHash returns the writer that verifies the parent hash of the blocks, see Block.ParentHash,
+// before they are written. The parent hash is compared to the hash of the previously written block, or to the hash
+// returned by the getter if the previous block wasn't written by this writer, e.g. after the restart. The
+// broken chain fails the write with ErrParentHashMismatch, matching ErrChainBroken, that is returned unchanged
+// by the no gap writer and the writer with indexer wrapping it.
+func NewWriterWithVerifyHash[T any](w Writer[T], blockHashGetter BlockHashGetter, opt VerifyHashOptions) Writer[T] {
+	return &verifyHashWriter[T]{w: w, blockHashGetter: blockHashGetter, options: opt}
+}
+
+func (v *verifyHashWriter[T]) FileSystem() storage.FS {
+	return v.w.FileSystem()
+}
+
+func (v *verifyHashWriter[T]) Write(ctx context.Context, b Block[T]) error {
+	_, err := v.WriteWithStatus(ctx, b)
+	return err
+}
+
+func (v *verifyHashWriter[T]) WriteWithStatus(ctx context.Context, b Block[T]) (WriteStatus, error) {
+	if err := validateBlockNum(b.Number); err != nil {
+		return WriteStatus{}, v.ID().wrapError(err)
+	}
+
+	// the blocks skipped by the writer aren't verified
+	if b.Number == 0 || b.Number > v.w.AcceptedBlockNum() {
+		if err := v.verifyTimestamp(b); err != nil {
+			return WriteStatus{}, v.ID().wrapError(err)
+		}
+		if err := v.verify(ctx, b); err != nil {
+			return WriteStatus{}, v.ID().wrapError(err)
+		}
+	}
+
+	status, err := v.w.WriteWithStatus(ctx, b)
+	if err != nil {
+		return WriteStatus{}, err
+	}
+
+	v.hasPrev, v.prevNum, v.prevHash = true, b.Number, b.Hash
+	return status, nil
+}
+
+func (v *verifyHashWriter[T]) WriteBatch(ctx context.Context, blocks []Block[T]) error {
+	if err := validateBatch(blocks); err != nil {
+		return v.ID().wrapError(err)
+	}
+
+	// the chain is verified across the batch before anything is written, the previous block is restored
+	// if the batch fails
+	hasPrev, prevNum, prevHash := v.hasPrev, v.prevNum, v.prevHash
+	restore := func() {
+		v.hasPrev, v.prevNum, v.prevHash = hasPrev, prevNum, prevHash
+	}
+
+	acceptedBlockNum := v.w.AcceptedBlockNum()
+	for _, b := range blocks {
+		// the blocks skipped by the writer aren't verified
+		if b.Number == 0 || b.Number > acceptedBlockNum {
+			if err := v.verifyTimestamp(b); err != nil {
+				restore()
+				return v.ID().wrapError(err)
+			}
+			if err := v.verify(ctx, b); err != nil {
+				restore()
+				return v.ID().wrapError(err)
+			}
+			acceptedBlockNum = b.Number
+		}
+		v.hasPrev, v.prevNum, v.prevHash = true, b.Number, b.Hash
+	}
+
+	err := v.w.WriteBatch(ctx, blocks)
+	if err != nil {
+		restore()
+		return err
+	}
+	return nil
+}
+
+func (v *verifyHashWriter[T]) checkSequence(blockNums []uint64) error {
+	return checkSequence(v.w, blockNums)
+}
+
+func (v *verifyHashWriter[T]) allowGaps() {
+	allowGaps(v.w)
+}
+
+func (v *verifyHashWriter[T]) empty() bool {
+	return writerEmpty(v.w)
+}
+
+func (v *verifyHashWriter[T]) verifyTimestamp(b Block[T]) error {
+	if !v.options.RejectZeroTimestamp {
+		return nil
+	}
+	return validateTimestamp(b.Number, b.TS)
+}
+
+func (v *verifyHashWriter[T]) verify(ctx context.Context, b Block[T]) error {
+	// the genesis block and the first block of the dataset have no parent to verify
+	if b.Number == 0 || b.Number <= v.options.FirstBlockNum {
+		return nil
+	}
+
+	if b.ParentHash() == (common.Hash{}) {
+		return nil
+	}
+
+	parent := Block[T]{Number: b.Number - 1}
+	if v.hasPrev && v.prevNum == parent.Number {
+		parent.Hash = v.prevHash
+	} else {
+		hash, err := v.blockHashGetter(ctx, parent.Number)
+		if err != nil {
+			return fmt.Errorf("failed to get block %d hash: %w", parent.Number, err)
+		}
+		parent.Hash = hash
+	}
+	return verifyParentHash(parent, b)
+}
+
+func (v *verifyHashWriter[T]) WillRollNext() bool {
+	return v.w.WillRollNext()
+}
+
+func (v *verifyHashWriter[T]) RollFile(ctx context.Context) error {
+	return v.w.RollFile(ctx)
+}
+
+func (v *verifyHashWriter[T]) Flush(ctx context.Context) error {
+	return v.w.Flush(ctx)
+}
+
+func (v *verifyHashWriter[T]) Rollback(ctx context.Context, toBlockNum uint64) error {
+	err := v.w.Rollback(ctx, toBlockNum)
+	if err != nil {
+		return err
+	}
+	// the block after the rollback is verified against the dataset
+	if v.hasPrev && v.prevNum > toBlockNum {
+		v.hasPrev = false
+	}
+	return nil
+}
+
+func (v *verifyHashWriter[T]) MarkExamined(ctx context.Context, from, to uint64) error {
+	return v.w.MarkExamined(ctx, from, to)
+}
+
+func (v *verifyHashWriter[T]) BlockNum() uint64 {
+	return v.AcceptedBlockNum()
+}
+
+func (v *verifyHashWriter[T]) AcceptedBlockNum() uint64 {
+	return v.w.AcceptedBlockNum()
+}
+
+func (v *verifyHashWriter[T]) DurableBlockNum() uint64 {
+	return v.w.DurableBlockNum()
+}
+
+func (v *verifyHashWriter[T]) Close(ctx context.Context) error {
+	return v.w.Close(ctx)
+}
+
+func (v *verifyHashWriter[T]) ReconfigureRollPolicy(ctx context.Context, p FileRollPolicy, mode RolloverMode) error {
+	return v.w.ReconfigureRollPolicy(ctx, p, mode)
+}
+
+func (v *verifyHashWriter[T]) Options() Options {
+	return v.w.Options()
+}
+
+func (v *verifyHashWriter[T]) Accounting() *storage.Accounting {
+	return v.w.Accounting()
+}
+
+func (v *verifyHashWriter[T]) SetOptions(opts Options) {
+	v.w.SetOptions(opts)
+}
+
+func (v *verifyHashWriter[T]) ID() Instance {
+	return v.w.ID()
+}
@@ -0,0 +1,245 @@
+package ethwal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/0xsequence/ethkit/go-ethereum/common"
+	gostorage "github.com/Shopify/go-storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterWithVerifyHash(t *testing.T) {
+	newOptions := func() Options {
+		return Options{
+			Dataset:         Dataset{Path: "ethwal"},
+			FileSystem:      gostorage.NewMemoryFS(),
+			FileRollOnClose: true,
+		}
+	}
+
+	// getter records the requested blocks and serves the hashes of the test chain from the given block
+	getter := func(fromBlockNum uint64, requested *[]uint64) BlockHashGetter {
+		return func(ctx context.Context, blockNum uint64) (common.Hash, error) {
+			*requested = append(*requested, blockNum)
+			if blockNum < fromBlockNum {
+				return common.Hash{}, fmt.Errorf("block %d is not available", blockNum)
+			}
+			return chainedTestBlock(blockNum).Hash, nil
+		}
+	}
+
+	writeBlocks := func(t *testing.T, w Writer[chainedTestData], from, to uint64) {
+		for blockNum := from; blockNum <= to; blockNum++ {
+			require.NoError(t, w.Write(context.Background(), chainedTestBlock(blockNum)))
+		}
+	}
+
+	t.Run("genesis_0", func(t *testing.T) {
+		var requested []uint64
+		w, err := NewWriter[chainedTestData](newOptions())
+		require.NoError(t, err)
+		vw := NewWriterWithVerifyHash[chainedTestData](w, getter(0, &requested), VerifyHashOptions{})
+
+		writeBlocks(t, vw, 0, 5)
+		require.Empty(t, requested)
+		require.Equal(t, uint64(5), vw.BlockNum())
+		require.NoError(t, vw.Close(context.Background()))
+	})
+
+	t.Run("reject_zero_timestamp", func(t *testing.T) {
+		var requested []uint64
+		w, err := NewWriter[chainedTestData](newOptions())
+		require.NoError(t, err)
+		vw := NewWriterWithVerifyHash[chainedTestData](w, getter(0, &requested), VerifyHashOptions{RejectZeroTimestamp: true})
+
+		// the genesis block may have the zero timestamp
+		require.NoError(t, vw.Write(context.Background(), chainedTestBlock(0)))
+
+		b := chainedTestBlock(1)
+		err = vw.Write(context.Background(), b)
+		require.ErrorIs(t, err, ErrZeroTimestamp)
+		require.Equal(t, uint64(0), vw.BlockNum())
+
+		b.TS = 1000
+		require.NoError(t, vw.Write(context.Background(), b))
+		require.NoError(t, vw.Close(context.Background()))
+	})
+
+	t.Run("genesis_1", func(t *testing.T) {
+		var requested []uint64
+		w, err := NewWriter[chainedTestData](newOptions())
+		require.NoError(t, err)
+		vw := NewWriterWithVerifyHash[chainedTestData](w, getter(1, &requested), VerifyHashOptions{FirstBlockNum: 1})
+
+		writeBlocks(t, vw, 1, 5)
+		require.Empty(t, requested)
+		require.Equal(t, uint64(5), vw.BlockNum())
+		require.NoError(t, vw.Close(context.Background()))
+	})
+
+	t.Run("mid_chain", func(t *testing.T) {
+		const firstBlockNum = 15_000_000
+
+		var requested []uint64
+		opt := newOptions()
+		w, err := NewWriter[chainedTestData](opt)
+		require.NoError(t, err)
+		vw := NewWriterWithVerifyHash[chainedTestData](w, getter(firstBlockNum, &requested), VerifyHashOptions{FirstBlockNum: firstBlockNum})
+
+		writeBlocks(t, vw, firstBlockNum, firstBlockNum+5)
+		require.Empty(t, requested)
+		require.NoError(t, vw.Close(context.Background()))
+
+		// the restarted writer gets the hash of the last written block from the getter
+		w, err = NewWriter[chainedTestData](opt)
+		require.NoError(t, err)
+		vw = NewWriterWithVerifyHash[chainedTestData](w, getter(firstBlockNum, &requested), VerifyHashOptions{FirstBlockNum: firstBlockNum})
+
+		writeBlocks(t, vw, firstBlockNum+6, firstBlockNum+8)
+		require.Equal(t, []uint64{firstBlockNum + 5}, requested)
+		require.NoError(t, vw.Close(context.Background()))
+	})
+
+	t.Run("chain_broken", func(t *testing.T) {
+		var requested []uint64
+		w, err := NewWriter[chainedTestData](newOptions())
+		require.NoError(t, err)
+		vw := NewWriterWithVerifyHash[chainedTestData](w, getter(0, &requested), VerifyHashOptions{})
+
+		writeBlocks(t, vw, 1, 3)
+		require.Equal(t, []uint64{0}, requested)
+
+		b := chainedTestBlock(4)
+		b.Data.Parent = common.HexToHash("0xdead")
+		err = vw.Write(context.Background(), b)
+		require.ErrorIs(t, err, ErrChainBroken)
+		require.Equal(t, uint64(3), vw.BlockNum())
+
+		var mismatchErr *ErrParentHashMismatch
+		require.ErrorAs(t, err, &mismatchErr)
+		require.Equal(t, ErrParentHashMismatch{
+			BlockNumber:    4,
+			ExpectedParent: chainedTestBlock(3).Hash,
+			GotParent:      b.Data.Parent,
+		}, *mismatchErr)
+
+		// the parent of the block after the gap is from the getter
+		require.NoError(t, vw.Write(context.Background(), chainedTestBlock(10)))
+		require.Equal(t, []uint64{0, 9}, requested)
+		require.NoError(t, vw.Close(context.Background()))
+	})
+
+	t.Run("block_parent", func(t *testing.T) {
+		var requested []uint64
+		w, err := NewWriter[uint64](newOptions())
+		require.NoError(t, err)
+		vw := NewWriterWithVerifyHash[uint64](w, func(ctx context.Context, blockNum uint64) (common.Hash, error) {
+			requested = append(requested, blockNum)
+			return chainedTestBlock(blockNum).Hash, nil
+		}, VerifyHashOptions{})
+
+		// the block data without the parent hash, the parent of the block is verified
+		block := func(blockNum uint64) Block[uint64] {
+			b := chainedTestBlock(blockNum)
+			return Block[uint64]{Hash: b.Hash, Number: blockNum, Data: blockNum, Parent: &b.Data.Parent}
+		}
+		for blockNum := uint64(1); blockNum <= 3; blockNum++ {
+			require.NoError(t, vw.Write(context.Background(), block(blockNum)))
+		}
+		require.Equal(t, []uint64{0}, requested)
+
+		b := block(4)
+		b.Parent = &common.Hash{0xde, 0xad}
+		var mismatchErr *ErrParentHashMismatch
+		require.ErrorAs(t, vw.Write(context.Background(), b), &mismatchErr)
+		require.Equal(t, *b.Parent, mismatchErr.GotParent)
+		require.Equal(t, uint64(3), vw.BlockNum())
+		require.NoError(t, vw.Close(context.Background()))
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		var requested []uint64
+		w, err := NewWriter[chainedTestData](newOptions())
+		require.NoError(t, err)
+		vw := NewWriterWithVerifyHash[chainedTestData](w, getter(0, &requested), VerifyHashOptions{})
+
+		batch := func(from, to uint64) []Block[chainedTestData] {
+			var blocks []Block[chainedTestData]
+			for blockNum := from; blockNum <= to; blockNum++ {
+				blocks = append(blocks, chainedTestBlock(blockNum))
+			}
+			return blocks
+		}
+
+		// the chain is verified across the batch
+		require.NoError(t, vw.WriteBatch(context.Background(), batch(1, 5)))
+		require.Equal(t, []uint64{0}, requested)
+
+		// the broken chain fails the whole batch
+		broken := batch(6, 8)
+		broken[1].Data.Parent = common.HexToHash("0xdead")
+		err = vw.WriteBatch(context.Background(), broken)
+		require.ErrorIs(t, err, ErrChainBroken)
+		require.Equal(t, uint64(5), vw.BlockNum())
+
+		var mismatchErr *ErrParentHashMismatch
+		require.ErrorAs(t, err, &mismatchErr)
+		require.Equal(t, uint64(7), mismatchErr.BlockNumber)
+
+		// the previous block is restored, the written blocks are skipped
+		require.NoError(t, vw.WriteBatch(context.Background(), batch(4, 8)))
+		require.Equal(t, []uint64{0}, requested)
+
+		// the parent of the block after the gap is from the getter
+		require.NoError(t, vw.WriteBatch(context.Background(), batch(12, 13)))
+		require.Equal(t, []uint64{0, 11}, requested)
+		require.NoError(t, vw.Close(context.Background()))
+	})
+
+	t.Run("wrapped", func(t *testing.T) {
+		testCases := []struct {
+			name string
+			wrap func(t *testing.T, w Writer[chainedTestData]) Writer[chainedTestData]
+		}{
+			{name: "no_gap", wrap: func(t *testing.T, w Writer[chainedTestData]) Writer[chainedTestData] {
+				return NewWriterNoGap[chainedTestData](w)
+			}},
+			{name: "indexer", wrap: func(t *testing.T, w Writer[chainedTestData]) Writer[chainedTestData] {
+				indexer, err := NewIndexer(context.Background(), IndexerOptions[chainedTestData]{
+					Dataset:    w.Options().Dataset,
+					FileSystem: w.Options().FileSystem,
+				})
+				require.NoError(t, err)
+
+				wi, err := NewWriterWithIndexer[chainedTestData](w, indexer)
+				require.NoError(t, err)
+				return wi
+			}},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				var requested []uint64
+				w, err := NewWriter[chainedTestData](newOptions())
+				require.NoError(t, err)
+				vw := tc.wrap(t, NewWriterWithVerifyHash[chainedTestData](w, getter(0, &requested), VerifyHashOptions{FirstBlockNum: 1}))
+
+				writeBlocks(t, vw, 1, 7)
+
+				b := chainedTestBlock(8)
+				b.Data.Parent = common.HexToHash("0xbeef")
+
+				// the expected parent is the hash of the previously written block
+				var mismatchErr *ErrParentHashMismatch
+				require.ErrorAs(t, vw.Write(context.Background(), b), &mismatchErr)
+				require.Equal(t, uint64(8), mismatchErr.BlockNumber)
+				require.Equal(t, chainedTestBlock(7).Hash, mismatchErr.ExpectedParent)
+				require.Equal(t, common.HexToHash("0xbeef"), mismatchErr.GotParent)
+				require.Empty(t, requested)
+				require.NoError(t, vw.Close(context.Background()))
+			})
+		}
+	})
+}